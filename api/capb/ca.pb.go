@@ -0,0 +1,1141 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: ca.proto
+
+package capb // import "github.com/hyperledger/fabric-ca/api/capb"
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+import timestamp "github.com/golang/protobuf/ptypes/timestamp"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
+
+// EnrollmentRequest is a request to enroll or reenroll the caller
+type EnrollmentRequest struct {
+	// PEM-encoded certificate signing request
+	CertificateRequest string `protobuf:"bytes,1,opt,name=certificate_request,json=certificateRequest,proto3" json:"certificate_request,omitempty"`
+	// Hosts of the certificate
+	Hosts []string `protobuf:"bytes,2,rep,name=hosts,proto3" json:"hosts,omitempty"`
+	// Name of the signing profile
+	Profile string `protobuf:"bytes,3,opt,name=profile,proto3" json:"profile,omitempty"`
+	// Label to use in HSM operations
+	Label string `protobuf:"bytes,4,opt,name=label,proto3" json:"label,omitempty"`
+	// Name of the CA; the default CA if empty
+	Caname string `protobuf:"bytes,5,opt,name=caname,proto3" json:"caname,omitempty"`
+	// Attributes to add to the certificate
+	AttrReqs             []*AttributeRequest `protobuf:"bytes,6,rep,name=attr_reqs,json=attrReqs,proto3" json:"attr_reqs,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}            `json:"-"`
+	XXX_unrecognized     []byte              `json:"-"`
+	XXX_sizecache        int32               `json:"-"`
+}
+
+func (m *EnrollmentRequest) Reset()         { *m = EnrollmentRequest{} }
+func (m *EnrollmentRequest) String() string { return proto.CompactTextString(m) }
+func (*EnrollmentRequest) ProtoMessage()    {}
+func (*EnrollmentRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ca_a1eeded4ea501e33, []int{0}
+}
+func (m *EnrollmentRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_EnrollmentRequest.Unmarshal(m, b)
+}
+func (m *EnrollmentRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_EnrollmentRequest.Marshal(b, m, deterministic)
+}
+func (dst *EnrollmentRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_EnrollmentRequest.Merge(dst, src)
+}
+func (m *EnrollmentRequest) XXX_Size() int {
+	return xxx_messageInfo_EnrollmentRequest.Size(m)
+}
+func (m *EnrollmentRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_EnrollmentRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_EnrollmentRequest proto.InternalMessageInfo
+
+func (m *EnrollmentRequest) GetCertificateRequest() string {
+	if m != nil {
+		return m.CertificateRequest
+	}
+	return ""
+}
+
+func (m *EnrollmentRequest) GetHosts() []string {
+	if m != nil {
+		return m.Hosts
+	}
+	return nil
+}
+
+func (m *EnrollmentRequest) GetProfile() string {
+	if m != nil {
+		return m.Profile
+	}
+	return ""
+}
+
+func (m *EnrollmentRequest) GetLabel() string {
+	if m != nil {
+		return m.Label
+	}
+	return ""
+}
+
+func (m *EnrollmentRequest) GetCaname() string {
+	if m != nil {
+		return m.Caname
+	}
+	return ""
+}
+
+func (m *EnrollmentRequest) GetAttrReqs() []*AttributeRequest {
+	if m != nil {
+		return m.AttrReqs
+	}
+	return nil
+}
+
+// AttributeRequest is a request for an attribute of the caller
+type AttributeRequest struct {
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// True if the certificate is issued without the attribute if the caller
+	// does not own it
+	Optional             bool     `protobuf:"varint,2,opt,name=optional,proto3" json:"optional,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *AttributeRequest) Reset()         { *m = AttributeRequest{} }
+func (m *AttributeRequest) String() string { return proto.CompactTextString(m) }
+func (*AttributeRequest) ProtoMessage()    {}
+func (*AttributeRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ca_a1eeded4ea501e33, []int{1}
+}
+func (m *AttributeRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_AttributeRequest.Unmarshal(m, b)
+}
+func (m *AttributeRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_AttributeRequest.Marshal(b, m, deterministic)
+}
+func (dst *AttributeRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_AttributeRequest.Merge(dst, src)
+}
+func (m *AttributeRequest) XXX_Size() int {
+	return xxx_messageInfo_AttributeRequest.Size(m)
+}
+func (m *AttributeRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_AttributeRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_AttributeRequest proto.InternalMessageInfo
+
+func (m *AttributeRequest) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *AttributeRequest) GetOptional() bool {
+	if m != nil {
+		return m.Optional
+	}
+	return false
+}
+
+// EnrollmentResponse is the response to an enrollment request
+type EnrollmentResponse struct {
+	// PEM-encoded enrollment certificate
+	Cert []byte `protobuf:"bytes,1,opt,name=cert,proto3" json:"cert,omitempty"`
+	// Information of the CA which issued the certificate
+	ServerInfo           *CAInfo  `protobuf:"bytes,2,opt,name=server_info,json=serverInfo,proto3" json:"server_info,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *EnrollmentResponse) Reset()         { *m = EnrollmentResponse{} }
+func (m *EnrollmentResponse) String() string { return proto.CompactTextString(m) }
+func (*EnrollmentResponse) ProtoMessage()    {}
+func (*EnrollmentResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ca_a1eeded4ea501e33, []int{2}
+}
+func (m *EnrollmentResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_EnrollmentResponse.Unmarshal(m, b)
+}
+func (m *EnrollmentResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_EnrollmentResponse.Marshal(b, m, deterministic)
+}
+func (dst *EnrollmentResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_EnrollmentResponse.Merge(dst, src)
+}
+func (m *EnrollmentResponse) XXX_Size() int {
+	return xxx_messageInfo_EnrollmentResponse.Size(m)
+}
+func (m *EnrollmentResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_EnrollmentResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_EnrollmentResponse proto.InternalMessageInfo
+
+func (m *EnrollmentResponse) GetCert() []byte {
+	if m != nil {
+		return m.Cert
+	}
+	return nil
+}
+
+func (m *EnrollmentResponse) GetServerInfo() *CAInfo {
+	if m != nil {
+		return m.ServerInfo
+	}
+	return nil
+}
+
+// GetCACertRequest is a request for the information of a CA
+type GetCACertRequest struct {
+	// Name of the CA; the default CA if empty
+	Caname               string   `protobuf:"bytes,1,opt,name=caname,proto3" json:"caname,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetCACertRequest) Reset()         { *m = GetCACertRequest{} }
+func (m *GetCACertRequest) String() string { return proto.CompactTextString(m) }
+func (*GetCACertRequest) ProtoMessage()    {}
+func (*GetCACertRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ca_a1eeded4ea501e33, []int{3}
+}
+func (m *GetCACertRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetCACertRequest.Unmarshal(m, b)
+}
+func (m *GetCACertRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetCACertRequest.Marshal(b, m, deterministic)
+}
+func (dst *GetCACertRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetCACertRequest.Merge(dst, src)
+}
+func (m *GetCACertRequest) XXX_Size() int {
+	return xxx_messageInfo_GetCACertRequest.Size(m)
+}
+func (m *GetCACertRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetCACertRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetCACertRequest proto.InternalMessageInfo
+
+func (m *GetCACertRequest) GetCaname() string {
+	if m != nil {
+		return m.Caname
+	}
+	return ""
+}
+
+// CAInfo is the information of a CA
+type CAInfo struct {
+	Caname string `protobuf:"bytes,1,opt,name=caname,proto3" json:"caname,omitempty"`
+	// PEM-encoded certificates of the CA chain
+	CaChain []byte `protobuf:"bytes,2,opt,name=ca_chain,json=caChain,proto3" json:"ca_chain,omitempty"`
+	// Idemix issuer public key
+	IssuerPublicKey []byte `protobuf:"bytes,3,opt,name=issuer_public_key,json=issuerPublicKey,proto3" json:"issuer_public_key,omitempty"`
+	// PEM-encoded Idemix issuer revocation public key
+	IssuerRevocationPublicKey []byte `protobuf:"bytes,4,opt,name=issuer_revocation_public_key,json=issuerRevocationPublicKey,proto3" json:"issuer_revocation_public_key,omitempty"`
+	// Version of the server
+	Version              string   `protobuf:"bytes,5,opt,name=version,proto3" json:"version,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *CAInfo) Reset()         { *m = CAInfo{} }
+func (m *CAInfo) String() string { return proto.CompactTextString(m) }
+func (*CAInfo) ProtoMessage()    {}
+func (*CAInfo) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ca_a1eeded4ea501e33, []int{4}
+}
+func (m *CAInfo) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CAInfo.Unmarshal(m, b)
+}
+func (m *CAInfo) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CAInfo.Marshal(b, m, deterministic)
+}
+func (dst *CAInfo) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CAInfo.Merge(dst, src)
+}
+func (m *CAInfo) XXX_Size() int {
+	return xxx_messageInfo_CAInfo.Size(m)
+}
+func (m *CAInfo) XXX_DiscardUnknown() {
+	xxx_messageInfo_CAInfo.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CAInfo proto.InternalMessageInfo
+
+func (m *CAInfo) GetCaname() string {
+	if m != nil {
+		return m.Caname
+	}
+	return ""
+}
+
+func (m *CAInfo) GetCaChain() []byte {
+	if m != nil {
+		return m.CaChain
+	}
+	return nil
+}
+
+func (m *CAInfo) GetIssuerPublicKey() []byte {
+	if m != nil {
+		return m.IssuerPublicKey
+	}
+	return nil
+}
+
+func (m *CAInfo) GetIssuerRevocationPublicKey() []byte {
+	if m != nil {
+		return m.IssuerRevocationPublicKey
+	}
+	return nil
+}
+
+func (m *CAInfo) GetVersion() string {
+	if m != nil {
+		return m.Version
+	}
+	return ""
+}
+
+// RegistrationRequest is a request to register an identity
+type RegistrationRequest struct {
+	// Enrollment ID of the identity
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// Type of the identity, such as "peer" or "client"
+	Type string `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	// Enrollment secret; a random one is generated if empty
+	Secret string `protobuf:"bytes,3,opt,name=secret,proto3" json:"secret,omitempty"`
+	// Maximum number of enrollments with the secret; that of the CA if 0
+	MaxEnrollments int32        `protobuf:"varint,4,opt,name=max_enrollments,json=maxEnrollments,proto3" json:"max_enrollments,omitempty"`
+	Affiliation    string       `protobuf:"bytes,5,opt,name=affiliation,proto3" json:"affiliation,omitempty"`
+	Attrs          []*Attribute `protobuf:"bytes,6,rep,name=attrs,proto3" json:"attrs,omitempty"`
+	// Name of the CA; the default CA if empty
+	Caname               string   `protobuf:"bytes,7,opt,name=caname,proto3" json:"caname,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RegistrationRequest) Reset()         { *m = RegistrationRequest{} }
+func (m *RegistrationRequest) String() string { return proto.CompactTextString(m) }
+func (*RegistrationRequest) ProtoMessage()    {}
+func (*RegistrationRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ca_a1eeded4ea501e33, []int{5}
+}
+func (m *RegistrationRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RegistrationRequest.Unmarshal(m, b)
+}
+func (m *RegistrationRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RegistrationRequest.Marshal(b, m, deterministic)
+}
+func (dst *RegistrationRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RegistrationRequest.Merge(dst, src)
+}
+func (m *RegistrationRequest) XXX_Size() int {
+	return xxx_messageInfo_RegistrationRequest.Size(m)
+}
+func (m *RegistrationRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_RegistrationRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RegistrationRequest proto.InternalMessageInfo
+
+func (m *RegistrationRequest) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *RegistrationRequest) GetType() string {
+	if m != nil {
+		return m.Type
+	}
+	return ""
+}
+
+func (m *RegistrationRequest) GetSecret() string {
+	if m != nil {
+		return m.Secret
+	}
+	return ""
+}
+
+func (m *RegistrationRequest) GetMaxEnrollments() int32 {
+	if m != nil {
+		return m.MaxEnrollments
+	}
+	return 0
+}
+
+func (m *RegistrationRequest) GetAffiliation() string {
+	if m != nil {
+		return m.Affiliation
+	}
+	return ""
+}
+
+func (m *RegistrationRequest) GetAttrs() []*Attribute {
+	if m != nil {
+		return m.Attrs
+	}
+	return nil
+}
+
+func (m *RegistrationRequest) GetCaname() string {
+	if m != nil {
+		return m.Caname
+	}
+	return ""
+}
+
+// Attribute is an attribute of an identity
+type Attribute struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	// True if the attribute is added to enrollment certificates by default
+	Ecert                bool     `protobuf:"varint,3,opt,name=ecert,proto3" json:"ecert,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Attribute) Reset()         { *m = Attribute{} }
+func (m *Attribute) String() string { return proto.CompactTextString(m) }
+func (*Attribute) ProtoMessage()    {}
+func (*Attribute) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ca_a1eeded4ea501e33, []int{6}
+}
+func (m *Attribute) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Attribute.Unmarshal(m, b)
+}
+func (m *Attribute) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Attribute.Marshal(b, m, deterministic)
+}
+func (dst *Attribute) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Attribute.Merge(dst, src)
+}
+func (m *Attribute) XXX_Size() int {
+	return xxx_messageInfo_Attribute.Size(m)
+}
+func (m *Attribute) XXX_DiscardUnknown() {
+	xxx_messageInfo_Attribute.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Attribute proto.InternalMessageInfo
+
+func (m *Attribute) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *Attribute) GetValue() string {
+	if m != nil {
+		return m.Value
+	}
+	return ""
+}
+
+func (m *Attribute) GetEcert() bool {
+	if m != nil {
+		return m.Ecert
+	}
+	return false
+}
+
+// RegistrationResponse is the response to a registration request
+type RegistrationResponse struct {
+	// Enrollment secret of the identity
+	Secret               string   `protobuf:"bytes,1,opt,name=secret,proto3" json:"secret,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RegistrationResponse) Reset()         { *m = RegistrationResponse{} }
+func (m *RegistrationResponse) String() string { return proto.CompactTextString(m) }
+func (*RegistrationResponse) ProtoMessage()    {}
+func (*RegistrationResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ca_a1eeded4ea501e33, []int{7}
+}
+func (m *RegistrationResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RegistrationResponse.Unmarshal(m, b)
+}
+func (m *RegistrationResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RegistrationResponse.Marshal(b, m, deterministic)
+}
+func (dst *RegistrationResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RegistrationResponse.Merge(dst, src)
+}
+func (m *RegistrationResponse) XXX_Size() int {
+	return xxx_messageInfo_RegistrationResponse.Size(m)
+}
+func (m *RegistrationResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_RegistrationResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RegistrationResponse proto.InternalMessageInfo
+
+func (m *RegistrationResponse) GetSecret() string {
+	if m != nil {
+		return m.Secret
+	}
+	return ""
+}
+
+// RevocationRequest is a request to revoke the certificate with the serial
+// number and AKI, or all of the certificates of the identity
+type RevocationRequest struct {
+	// Enrollment ID of the identity
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// Serial number of the certificate, in hex
+	Serial string `protobuf:"bytes,2,opt,name=serial,proto3" json:"serial,omitempty"`
+	// AKI of the certificate, in hex
+	Aki string `protobuf:"bytes,3,opt,name=aki,proto3" json:"aki,omitempty"`
+	// Reason for revocation, such as "keycompromise"
+	Reason string `protobuf:"bytes,4,opt,name=reason,proto3" json:"reason,omitempty"`
+	// Name of the CA; the default CA if empty
+	Caname string `protobuf:"bytes,5,opt,name=caname,proto3" json:"caname,omitempty"`
+	// True to return a CRL
+	Gencrl               bool     `protobuf:"varint,6,opt,name=gencrl,proto3" json:"gencrl,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RevocationRequest) Reset()         { *m = RevocationRequest{} }
+func (m *RevocationRequest) String() string { return proto.CompactTextString(m) }
+func (*RevocationRequest) ProtoMessage()    {}
+func (*RevocationRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ca_a1eeded4ea501e33, []int{8}
+}
+func (m *RevocationRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RevocationRequest.Unmarshal(m, b)
+}
+func (m *RevocationRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RevocationRequest.Marshal(b, m, deterministic)
+}
+func (dst *RevocationRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RevocationRequest.Merge(dst, src)
+}
+func (m *RevocationRequest) XXX_Size() int {
+	return xxx_messageInfo_RevocationRequest.Size(m)
+}
+func (m *RevocationRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_RevocationRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RevocationRequest proto.InternalMessageInfo
+
+func (m *RevocationRequest) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *RevocationRequest) GetSerial() string {
+	if m != nil {
+		return m.Serial
+	}
+	return ""
+}
+
+func (m *RevocationRequest) GetAki() string {
+	if m != nil {
+		return m.Aki
+	}
+	return ""
+}
+
+func (m *RevocationRequest) GetReason() string {
+	if m != nil {
+		return m.Reason
+	}
+	return ""
+}
+
+func (m *RevocationRequest) GetCaname() string {
+	if m != nil {
+		return m.Caname
+	}
+	return ""
+}
+
+func (m *RevocationRequest) GetGencrl() bool {
+	if m != nil {
+		return m.Gencrl
+	}
+	return false
+}
+
+// RevokedCert is a revoked certificate
+type RevokedCert struct {
+	Serial               string   `protobuf:"bytes,1,opt,name=serial,proto3" json:"serial,omitempty"`
+	Aki                  string   `protobuf:"bytes,2,opt,name=aki,proto3" json:"aki,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RevokedCert) Reset()         { *m = RevokedCert{} }
+func (m *RevokedCert) String() string { return proto.CompactTextString(m) }
+func (*RevokedCert) ProtoMessage()    {}
+func (*RevokedCert) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ca_a1eeded4ea501e33, []int{9}
+}
+func (m *RevokedCert) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RevokedCert.Unmarshal(m, b)
+}
+func (m *RevokedCert) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RevokedCert.Marshal(b, m, deterministic)
+}
+func (dst *RevokedCert) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RevokedCert.Merge(dst, src)
+}
+func (m *RevokedCert) XXX_Size() int {
+	return xxx_messageInfo_RevokedCert.Size(m)
+}
+func (m *RevokedCert) XXX_DiscardUnknown() {
+	xxx_messageInfo_RevokedCert.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RevokedCert proto.InternalMessageInfo
+
+func (m *RevokedCert) GetSerial() string {
+	if m != nil {
+		return m.Serial
+	}
+	return ""
+}
+
+func (m *RevokedCert) GetAki() string {
+	if m != nil {
+		return m.Aki
+	}
+	return ""
+}
+
+// RevocationResponse is the response to a revocation request
+type RevocationResponse struct {
+	RevokedCerts []*RevokedCert `protobuf:"bytes,1,rep,name=revoked_certs,json=revokedCerts,proto3" json:"revoked_certs,omitempty"`
+	// PEM-encoded CRL, if the request asked for it
+	Crl                  []byte   `protobuf:"bytes,2,opt,name=crl,proto3" json:"crl,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RevocationResponse) Reset()         { *m = RevocationResponse{} }
+func (m *RevocationResponse) String() string { return proto.CompactTextString(m) }
+func (*RevocationResponse) ProtoMessage()    {}
+func (*RevocationResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ca_a1eeded4ea501e33, []int{10}
+}
+func (m *RevocationResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RevocationResponse.Unmarshal(m, b)
+}
+func (m *RevocationResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RevocationResponse.Marshal(b, m, deterministic)
+}
+func (dst *RevocationResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RevocationResponse.Merge(dst, src)
+}
+func (m *RevocationResponse) XXX_Size() int {
+	return xxx_messageInfo_RevocationResponse.Size(m)
+}
+func (m *RevocationResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_RevocationResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RevocationResponse proto.InternalMessageInfo
+
+func (m *RevocationResponse) GetRevokedCerts() []*RevokedCert {
+	if m != nil {
+		return m.RevokedCerts
+	}
+	return nil
+}
+
+func (m *RevocationResponse) GetCrl() []byte {
+	if m != nil {
+		return m.Crl
+	}
+	return nil
+}
+
+// GenCRLRequest is a request to generate a CRL of the certificates revoked
+// and expiring in the time ranges, if given
+type GenCRLRequest struct {
+	// Name of the CA; the default CA if empty
+	Caname        string               `protobuf:"bytes,1,opt,name=caname,proto3" json:"caname,omitempty"`
+	RevokedAfter  *timestamp.Timestamp `protobuf:"bytes,2,opt,name=revoked_after,json=revokedAfter,proto3" json:"revoked_after,omitempty"`
+	RevokedBefore *timestamp.Timestamp `protobuf:"bytes,3,opt,name=revoked_before,json=revokedBefore,proto3" json:"revoked_before,omitempty"`
+	ExpireAfter   *timestamp.Timestamp `protobuf:"bytes,4,opt,name=expire_after,json=expireAfter,proto3" json:"expire_after,omitempty"`
+	ExpireBefore  *timestamp.Timestamp `protobuf:"bytes,5,opt,name=expire_before,json=expireBefore,proto3" json:"expire_before,omitempty"`
+	// True to sign the CRL with the previous key of the CA after it is rekeyed
+	PreviousKey          bool     `protobuf:"varint,6,opt,name=previous_key,json=previousKey,proto3" json:"previous_key,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GenCRLRequest) Reset()         { *m = GenCRLRequest{} }
+func (m *GenCRLRequest) String() string { return proto.CompactTextString(m) }
+func (*GenCRLRequest) ProtoMessage()    {}
+func (*GenCRLRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ca_a1eeded4ea501e33, []int{11}
+}
+func (m *GenCRLRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GenCRLRequest.Unmarshal(m, b)
+}
+func (m *GenCRLRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GenCRLRequest.Marshal(b, m, deterministic)
+}
+func (dst *GenCRLRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GenCRLRequest.Merge(dst, src)
+}
+func (m *GenCRLRequest) XXX_Size() int {
+	return xxx_messageInfo_GenCRLRequest.Size(m)
+}
+func (m *GenCRLRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_GenCRLRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GenCRLRequest proto.InternalMessageInfo
+
+func (m *GenCRLRequest) GetCaname() string {
+	if m != nil {
+		return m.Caname
+	}
+	return ""
+}
+
+func (m *GenCRLRequest) GetRevokedAfter() *timestamp.Timestamp {
+	if m != nil {
+		return m.RevokedAfter
+	}
+	return nil
+}
+
+func (m *GenCRLRequest) GetRevokedBefore() *timestamp.Timestamp {
+	if m != nil {
+		return m.RevokedBefore
+	}
+	return nil
+}
+
+func (m *GenCRLRequest) GetExpireAfter() *timestamp.Timestamp {
+	if m != nil {
+		return m.ExpireAfter
+	}
+	return nil
+}
+
+func (m *GenCRLRequest) GetExpireBefore() *timestamp.Timestamp {
+	if m != nil {
+		return m.ExpireBefore
+	}
+	return nil
+}
+
+func (m *GenCRLRequest) GetPreviousKey() bool {
+	if m != nil {
+		return m.PreviousKey
+	}
+	return false
+}
+
+// GenCRLResponse is the response to a request to generate a CRL
+type GenCRLResponse struct {
+	// PEM-encoded CRL
+	Crl                  []byte   `protobuf:"bytes,1,opt,name=crl,proto3" json:"crl,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GenCRLResponse) Reset()         { *m = GenCRLResponse{} }
+func (m *GenCRLResponse) String() string { return proto.CompactTextString(m) }
+func (*GenCRLResponse) ProtoMessage()    {}
+func (*GenCRLResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ca_a1eeded4ea501e33, []int{12}
+}
+func (m *GenCRLResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GenCRLResponse.Unmarshal(m, b)
+}
+func (m *GenCRLResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GenCRLResponse.Marshal(b, m, deterministic)
+}
+func (dst *GenCRLResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GenCRLResponse.Merge(dst, src)
+}
+func (m *GenCRLResponse) XXX_Size() int {
+	return xxx_messageInfo_GenCRLResponse.Size(m)
+}
+func (m *GenCRLResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_GenCRLResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GenCRLResponse proto.InternalMessageInfo
+
+func (m *GenCRLResponse) GetCrl() []byte {
+	if m != nil {
+		return m.Crl
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*EnrollmentRequest)(nil), "capb.EnrollmentRequest")
+	proto.RegisterType((*AttributeRequest)(nil), "capb.AttributeRequest")
+	proto.RegisterType((*EnrollmentResponse)(nil), "capb.EnrollmentResponse")
+	proto.RegisterType((*GetCACertRequest)(nil), "capb.GetCACertRequest")
+	proto.RegisterType((*CAInfo)(nil), "capb.CAInfo")
+	proto.RegisterType((*RegistrationRequest)(nil), "capb.RegistrationRequest")
+	proto.RegisterType((*Attribute)(nil), "capb.Attribute")
+	proto.RegisterType((*RegistrationResponse)(nil), "capb.RegistrationResponse")
+	proto.RegisterType((*RevocationRequest)(nil), "capb.RevocationRequest")
+	proto.RegisterType((*RevokedCert)(nil), "capb.RevokedCert")
+	proto.RegisterType((*RevocationResponse)(nil), "capb.RevocationResponse")
+	proto.RegisterType((*GenCRLRequest)(nil), "capb.GenCRLRequest")
+	proto.RegisterType((*GenCRLResponse)(nil), "capb.GenCRLResponse")
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// CAClient is the client API for CA service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type CAClient interface {
+	// Enroll issues an enrollment certificate to the caller
+	Enroll(ctx context.Context, in *EnrollmentRequest, opts ...grpc.CallOption) (*EnrollmentResponse, error)
+	// Reenroll issues a new enrollment certificate to the caller
+	Reenroll(ctx context.Context, in *EnrollmentRequest, opts ...grpc.CallOption) (*EnrollmentResponse, error)
+	// Register registers an identity
+	Register(ctx context.Context, in *RegistrationRequest, opts ...grpc.CallOption) (*RegistrationResponse, error)
+	// Revoke revokes a certificate or all of the certificates of an identity
+	Revoke(ctx context.Context, in *RevocationRequest, opts ...grpc.CallOption) (*RevocationResponse, error)
+	// GetCACert returns the certificate chain and information of a CA
+	GetCACert(ctx context.Context, in *GetCACertRequest, opts ...grpc.CallOption) (*CAInfo, error)
+	// GenCRL generates a CRL
+	GenCRL(ctx context.Context, in *GenCRLRequest, opts ...grpc.CallOption) (*GenCRLResponse, error)
+}
+
+type cAClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewCAClient(cc *grpc.ClientConn) CAClient {
+	return &cAClient{cc}
+}
+
+func (c *cAClient) Enroll(ctx context.Context, in *EnrollmentRequest, opts ...grpc.CallOption) (*EnrollmentResponse, error) {
+	out := new(EnrollmentResponse)
+	err := c.cc.Invoke(ctx, "/capb.CA/Enroll", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cAClient) Reenroll(ctx context.Context, in *EnrollmentRequest, opts ...grpc.CallOption) (*EnrollmentResponse, error) {
+	out := new(EnrollmentResponse)
+	err := c.cc.Invoke(ctx, "/capb.CA/Reenroll", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cAClient) Register(ctx context.Context, in *RegistrationRequest, opts ...grpc.CallOption) (*RegistrationResponse, error) {
+	out := new(RegistrationResponse)
+	err := c.cc.Invoke(ctx, "/capb.CA/Register", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cAClient) Revoke(ctx context.Context, in *RevocationRequest, opts ...grpc.CallOption) (*RevocationResponse, error) {
+	out := new(RevocationResponse)
+	err := c.cc.Invoke(ctx, "/capb.CA/Revoke", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cAClient) GetCACert(ctx context.Context, in *GetCACertRequest, opts ...grpc.CallOption) (*CAInfo, error) {
+	out := new(CAInfo)
+	err := c.cc.Invoke(ctx, "/capb.CA/GetCACert", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cAClient) GenCRL(ctx context.Context, in *GenCRLRequest, opts ...grpc.CallOption) (*GenCRLResponse, error) {
+	out := new(GenCRLResponse)
+	err := c.cc.Invoke(ctx, "/capb.CA/GenCRL", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CAServer is the server API for CA service.
+type CAServer interface {
+	// Enroll issues an enrollment certificate to the caller
+	Enroll(context.Context, *EnrollmentRequest) (*EnrollmentResponse, error)
+	// Reenroll issues a new enrollment certificate to the caller
+	Reenroll(context.Context, *EnrollmentRequest) (*EnrollmentResponse, error)
+	// Register registers an identity
+	Register(context.Context, *RegistrationRequest) (*RegistrationResponse, error)
+	// Revoke revokes a certificate or all of the certificates of an identity
+	Revoke(context.Context, *RevocationRequest) (*RevocationResponse, error)
+	// GetCACert returns the certificate chain and information of a CA
+	GetCACert(context.Context, *GetCACertRequest) (*CAInfo, error)
+	// GenCRL generates a CRL
+	GenCRL(context.Context, *GenCRLRequest) (*GenCRLResponse, error)
+}
+
+func RegisterCAServer(s *grpc.Server, srv CAServer) {
+	s.RegisterService(&_CA_serviceDesc, srv)
+}
+
+func _CA_Enroll_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EnrollmentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CAServer).Enroll(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/capb.CA/Enroll",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CAServer).Enroll(ctx, req.(*EnrollmentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CA_Reenroll_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EnrollmentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CAServer).Reenroll(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/capb.CA/Reenroll",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CAServer).Reenroll(ctx, req.(*EnrollmentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CA_Register_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegistrationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CAServer).Register(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/capb.CA/Register",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CAServer).Register(ctx, req.(*RegistrationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CA_Revoke_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RevocationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CAServer).Revoke(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/capb.CA/Revoke",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CAServer).Revoke(ctx, req.(*RevocationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CA_GetCACert_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetCACertRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CAServer).GetCACert(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/capb.CA/GetCACert",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CAServer).GetCACert(ctx, req.(*GetCACertRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CA_GenCRL_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GenCRLRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CAServer).GenCRL(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/capb.CA/GenCRL",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CAServer).GenCRL(ctx, req.(*GenCRLRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _CA_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "capb.CA",
+	HandlerType: (*CAServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Enroll",
+			Handler:    _CA_Enroll_Handler,
+		},
+		{
+			MethodName: "Reenroll",
+			Handler:    _CA_Reenroll_Handler,
+		},
+		{
+			MethodName: "Register",
+			Handler:    _CA_Register_Handler,
+		},
+		{
+			MethodName: "Revoke",
+			Handler:    _CA_Revoke_Handler,
+		},
+		{
+			MethodName: "GetCACert",
+			Handler:    _CA_GetCACert_Handler,
+		},
+		{
+			MethodName: "GenCRL",
+			Handler:    _CA_GenCRL_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "ca.proto",
+}
+
+func init() { proto.RegisterFile("ca.proto", fileDescriptor_ca_a1eeded4ea501e33) }
+
+var fileDescriptor_ca_a1eeded4ea501e33 = []byte{
+	// 887 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x55, 0xcd, 0x6a, 0x23, 0x47,
+	0x10, 0x66, 0x64, 0x49, 0x96, 0x4a, 0xf2, 0x5f, 0xdb, 0x38, 0x63, 0x11, 0x88, 0x32, 0x10, 0xe2,
+	0x6c, 0x58, 0x89, 0xd8, 0x90, 0x1c, 0x96, 0xc5, 0xc8, 0x22, 0x2c, 0xc1, 0x39, 0x84, 0x26, 0x10,
+	0xc8, 0x21, 0xa2, 0x67, 0xb6, 0x46, 0x6e, 0x3c, 0x9a, 0x9e, 0xed, 0x6e, 0x09, 0xeb, 0x51, 0xf2,
+	0x3a, 0x79, 0x80, 0x5c, 0x73, 0xcc, 0x35, 0x8f, 0x11, 0xfa, 0x67, 0x46, 0x63, 0xcb, 0x6b, 0xc3,
+	0xde, 0xba, 0xaa, 0xeb, 0xf7, 0xfb, 0xaa, 0xba, 0xa1, 0x93, 0xb0, 0x51, 0x21, 0x85, 0x16, 0xa4,
+	0x99, 0xb0, 0x22, 0x1e, 0x7c, 0x31, 0x17, 0x62, 0x9e, 0xe1, 0xd8, 0xea, 0xe2, 0x65, 0x3a, 0xd6,
+	0x7c, 0x81, 0x4a, 0xb3, 0x45, 0xe1, 0xcc, 0xa2, 0x7f, 0x02, 0x38, 0xfa, 0x31, 0x97, 0x22, 0xcb,
+	0x16, 0x98, 0x6b, 0x8a, 0x1f, 0x96, 0xa8, 0x34, 0x19, 0xc3, 0x71, 0x82, 0x52, 0xf3, 0x94, 0x27,
+	0x4c, 0xe3, 0x4c, 0x3a, 0x75, 0x18, 0x0c, 0x83, 0xf3, 0x2e, 0x25, 0xb5, 0xab, 0xd2, 0xe1, 0x04,
+	0x5a, 0xb7, 0x42, 0x69, 0x15, 0x36, 0x86, 0x3b, 0xe7, 0x5d, 0xea, 0x04, 0x12, 0xc2, 0x6e, 0x21,
+	0x45, 0xca, 0x33, 0x0c, 0x77, 0xac, 0x6b, 0x29, 0x1a, 0xfb, 0x8c, 0xc5, 0x98, 0x85, 0x4d, 0xab,
+	0x77, 0x02, 0x39, 0x85, 0x76, 0xc2, 0x72, 0xb6, 0xc0, 0xb0, 0x65, 0xd5, 0x5e, 0x22, 0x97, 0xd0,
+	0x65, 0x5a, 0x4b, 0x53, 0x87, 0x0a, 0xdb, 0xc3, 0x9d, 0xf3, 0xde, 0xc5, 0xe9, 0xc8, 0xf4, 0x37,
+	0x9a, 0x68, 0x2d, 0x79, 0xbc, 0xac, 0x0a, 0xa1, 0x1d, 0x63, 0x48, 0xf1, 0x83, 0x8a, 0xae, 0xe1,
+	0xf0, 0xf1, 0x2d, 0x21, 0xd0, 0xb4, 0xe1, 0x5d, 0x23, 0xf6, 0x4c, 0x06, 0xd0, 0x11, 0x85, 0xe6,
+	0x22, 0x67, 0x59, 0xd8, 0x18, 0x06, 0xe7, 0x1d, 0x5a, 0xc9, 0xd1, 0x6f, 0x40, 0xea, 0xe0, 0xa8,
+	0x42, 0xe4, 0x0a, 0x4d, 0x14, 0x03, 0x81, 0x8d, 0xd2, 0xa7, 0xf6, 0x4c, 0x5e, 0x43, 0x4f, 0xa1,
+	0x5c, 0xa1, 0x9c, 0xf1, 0x3c, 0x15, 0x36, 0x50, 0xef, 0xa2, 0xef, 0x8a, 0x9c, 0x4e, 0x7e, 0xca,
+	0x53, 0x41, 0xc1, 0x19, 0x98, 0x73, 0xf4, 0x0a, 0x0e, 0xdf, 0xa1, 0x9e, 0x4e, 0xa6, 0x28, 0x2b,
+	0xd0, 0x37, 0xdd, 0x07, 0xf5, 0xee, 0xa3, 0xbf, 0x02, 0x68, 0xbb, 0x10, 0x1f, 0x33, 0x21, 0x67,
+	0x86, 0xf8, 0x59, 0x72, 0xcb, 0x78, 0x6e, 0x53, 0xf7, 0xe9, 0x6e, 0xc2, 0xa6, 0x46, 0x24, 0xaf,
+	0xe0, 0x88, 0x2b, 0xb5, 0x44, 0x39, 0x2b, 0x96, 0x71, 0xc6, 0x93, 0xd9, 0x1d, 0xae, 0x2d, 0x1b,
+	0x7d, 0x7a, 0xe0, 0x2e, 0x7e, 0xb1, 0xfa, 0x1b, 0x5c, 0x93, 0x2b, 0xf8, 0xdc, 0xdb, 0x4a, 0x5c,
+	0x89, 0x84, 0x19, 0x14, 0xea, 0x6e, 0x4d, 0xeb, 0x76, 0xe6, 0x6c, 0x68, 0x65, 0xb2, 0x09, 0x10,
+	0xc2, 0xee, 0x0a, 0xa5, 0xe2, 0x22, 0xf7, 0x0c, 0x96, 0x62, 0xf4, 0x6f, 0x00, 0xc7, 0x14, 0xe7,
+	0x5c, 0x69, 0x69, 0x7d, 0x9e, 0x63, 0x84, 0x40, 0x53, 0xaf, 0x0b, 0xb4, 0x9d, 0x74, 0xa9, 0x3d,
+	0x9b, 0xce, 0x15, 0x26, 0x12, 0xb5, 0x9f, 0x24, 0x2f, 0x91, 0xaf, 0xe1, 0x60, 0xc1, 0xee, 0x67,
+	0x58, 0xb1, 0xa4, 0x6c, 0x95, 0x2d, 0xba, 0xbf, 0x60, 0xf7, 0x1b, 0xee, 0x14, 0x19, 0x42, 0x8f,
+	0xa5, 0x29, 0xcf, 0x38, 0xd3, 0x9b, 0xf2, 0xea, 0x2a, 0xf2, 0x15, 0xb4, 0xcc, 0xf0, 0x94, 0x13,
+	0x76, 0xf0, 0x78, 0xc2, 0xdc, 0x6d, 0x8d, 0x83, 0xdd, 0x07, 0x34, 0xdd, 0x40, 0xb7, 0xb2, 0x7d,
+	0xb2, 0xad, 0x13, 0x68, 0xad, 0x58, 0xb6, 0x2c, 0xfb, 0x72, 0x82, 0xd1, 0xa2, 0x9d, 0xa6, 0x1d,
+	0x3b, 0x7b, 0x4e, 0x88, 0x46, 0x70, 0xf2, 0x10, 0x2d, 0x3f, 0x7a, 0x1b, 0x18, 0x82, 0x3a, 0x0c,
+	0xd1, 0x9f, 0x01, 0x1c, 0x6d, 0x08, 0x79, 0x0e, 0x5c, 0x1b, 0x41, 0x72, 0x3f, 0xec, 0x5d, 0xea,
+	0x25, 0x72, 0x08, 0x3b, 0xec, 0x8e, 0x7b, 0x74, 0xcd, 0xd1, 0x58, 0x4a, 0x64, 0x4a, 0xe4, 0x7e,
+	0x49, 0xbd, 0xf4, 0xd1, 0x2d, 0x3d, 0x85, 0xf6, 0x1c, 0xf3, 0x44, 0x66, 0x61, 0xdb, 0xb6, 0xe2,
+	0xa5, 0xe8, 0x07, 0xe8, 0x99, 0xd2, 0xee, 0xf0, 0xbd, 0x99, 0xf6, 0x5a, 0x01, 0xc1, 0x53, 0x05,
+	0x34, 0xaa, 0x02, 0xa2, 0x3f, 0x80, 0xd4, 0x7b, 0xf2, 0x10, 0x7c, 0x0f, 0x7b, 0xd2, 0x85, 0x9b,
+	0x19, 0xa8, 0x54, 0x18, 0x58, 0xba, 0x8e, 0x1c, 0x5d, 0xb5, 0x4c, 0xb4, 0x2f, 0x37, 0x82, 0x32,
+	0xf1, 0x4d, 0x6d, 0x6e, 0x3d, 0xcc, 0x31, 0xfa, 0xbb, 0x01, 0x7b, 0xef, 0x30, 0x9f, 0xd2, 0x9f,
+	0x5f, 0x58, 0x41, 0x72, 0xb5, 0xc9, 0xc9, 0x52, 0x8d, 0xd2, 0xef, 0xf7, 0x60, 0xe4, 0x9e, 0xd7,
+	0x51, 0xf9, 0xbc, 0x8e, 0x7e, 0x2d, 0x9f, 0xd7, 0x2a, 0xf9, 0xc4, 0xd8, 0x93, 0x09, 0xec, 0x97,
+	0x01, 0x62, 0x4c, 0x85, 0x74, 0x0f, 0xe2, 0xf3, 0x11, 0xca, 0x94, 0xd7, 0xd6, 0x81, 0xbc, 0x85,
+	0x3e, 0xde, 0x17, 0x5c, 0xa2, 0x2f, 0xa1, 0xf9, 0x62, 0x80, 0x9e, 0xb3, 0x77, 0x15, 0x5c, 0xc1,
+	0x9e, 0x77, 0xf7, 0x05, 0xb4, 0x5e, 0x6e, 0xc1, 0x39, 0xf8, 0xfc, 0x5f, 0x42, 0xbf, 0x90, 0xb8,
+	0xe2, 0x62, 0xa9, 0xec, 0x63, 0xe0, 0x48, 0xee, 0x95, 0xba, 0x1b, 0x5c, 0x47, 0x11, 0xec, 0x97,
+	0x78, 0x7a, 0xb2, 0x3c, 0xe8, 0x41, 0x05, 0xfa, 0xc5, 0x7f, 0x0d, 0x68, 0x4c, 0x27, 0xe4, 0x0d,
+	0xb4, 0xdd, 0x76, 0x92, 0xcf, 0x1c, 0x71, 0x5b, 0x9f, 0xd0, 0x20, 0xdc, 0xbe, 0xf0, 0x51, 0xdf,
+	0x42, 0x87, 0x22, 0x7e, 0xb2, 0xfb, 0x04, 0x3a, 0x6e, 0xb9, 0x50, 0x92, 0xb3, 0x72, 0x6c, 0xb6,
+	0x9e, 0xa6, 0xc1, 0xe0, 0xa9, 0x2b, 0x1f, 0xe2, 0x0d, 0xb4, 0xdd, 0xa4, 0x95, 0xf9, 0xb7, 0x96,
+	0x6f, 0x10, 0x6e, 0x5f, 0x78, 0xe7, 0xef, 0xa0, 0x5b, 0x3d, 0xfe, 0xc4, 0x7f, 0x64, 0x8f, 0x7f,
+	0x83, 0xc1, 0x83, 0xbf, 0x83, 0x5c, 0x42, 0xdb, 0x21, 0x4b, 0x8e, 0x4b, 0xfb, 0xda, 0xdc, 0x0e,
+	0x4e, 0x1e, 0x2a, 0x5d, 0x9e, 0xeb, 0x6f, 0x7f, 0xff, 0x66, 0xce, 0xf5, 0xed, 0x32, 0x1e, 0x25,
+	0x62, 0x31, 0xbe, 0x5d, 0x17, 0x28, 0x33, 0x7c, 0x3f, 0x47, 0x39, 0x4e, 0x59, 0x2c, 0x79, 0xf2,
+	0x3a, 0x61, 0x63, 0x56, 0xf0, 0xb1, 0xf1, 0x8d, 0xdb, 0x76, 0x00, 0x2e, 0xff, 0x1f, 0x00, 0xbb,
+	0xff, 0xe4, 0xe6, 0x42, 0x08, 0x00, 0x00,
+}
@@ -0,0 +1,12 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package capb has the messages and the client and server interfaces of the
+// gRPC service of the fabric-ca server, which are generated from ca.proto by
+// protoc-gen-go v1.2.0 with its grpc plugin.
+package capb
+
+//go:generate protoc --go_out=plugins=grpc,paths=source_relative:. ca.proto
@@ -67,6 +67,9 @@ type EnrollmentRequest struct {
 	// The type of the enrollment request: x509 or idemix
 	// The default is a request for an X509 enrollment certificate
 	Type string `def:"x509" help:"The type of enrollment request: 'x509' or 'idemix'"`
+	// SVID is true if the request is for an X.509 SPIFFE Verifiable Identity
+	// Document, which is issued with the SPIFFE signing profile of the CA
+	SVID bool `json:"-" help:"Request an X.509-SVID with the SPIFFE signing profile of the CA; the certificate has no hosts"`
 }
 
 func (er EnrollmentRequest) String() string {
@@ -87,6 +90,11 @@ type ReenrollmentRequest struct {
 	// AttrReqs are requests for attributes to add to the certificate.
 	// Each attribute is added only if the requestor owns the attribute.
 	AttrReqs []*AttributeRequest `json:"attr_reqs,omitempty"`
+	// ReuseKey is true if the certificate signing request is signed with the
+	// key of the current enrollment certificate rather than a new key
+	ReuseKey bool `json:"-" skip:"true"`
+	// SVID is true if the request is for an X.509-SVID
+	SVID bool `json:"-" skip:"true"`
 }
 
 // RevocationRequest is a revocation request for a single certificate or all certificates
@@ -106,7 +114,7 @@ type RevocationRequest struct {
 	AKI string `json:"aki,omitempty" opt:"a" help:"AKI (Authority Key Identifier) of the certificate to be revoked"`
 	// Reason is the reason for revocation.  See https://godoc.org/golang.org/x/crypto/ocsp for
 	// valid values.  The default value is 0 (ocsp.Unspecified).
-	Reason string `json:"reason,omitempty" opt:"r" help:"Reason for revocation"`
+	Reason string `json:"reason,omitempty" opt:"r" help:"Reason for revocation: unspecified, keycompromise, cacompromise, affiliationchanged, superseded, cessationofoperation, certificatehold, removefromcrl, privilegewithdrawn or aacompromise"`
 	// CAName is the name of the CA to connect to
 	CAName string `json:"caname,omitempty" skip:"true"`
 	// GenCRL specifies whether to generate a CRL
@@ -169,6 +177,9 @@ type TCert struct {
 // GetCAInfoRequest is request to get generic CA information
 type GetCAInfoRequest struct {
 	CAName string `json:"caname,omitempty" skip:"true"`
+	// ETag is the ETag of the CA information which the client already has,
+	// which the server does not return again if it is unchanged
+	ETag string `json:"-" skip:"true"`
 }
 
 // GenCRLRequest represents a request to get CRL for the specified certificate authority
@@ -178,12 +189,86 @@ type GenCRLRequest struct {
 	RevokedBefore time.Time `json:"revokedbefore,omitempty"`
 	ExpireAfter   time.Time `json:"expireafter,omitempty"`
 	ExpireBefore  time.Time `json:"expirebefore,omitempty"`
+	PreviousKey   bool      `json:"previouskey,omitempty"`
+	// ETag is the ETag of the CRL which the client already has, which the
+	// server does not return again if it lists the same revoked certificates
+	ETag string `json:"-" skip:"true"`
 }
 
 // GenCRLResponse represents a response to get CRL
 type GenCRLResponse struct {
 	// CRL is PEM-encoded certificate revocation list (CRL) that contains requested unexpired revoked certificates
 	CRL []byte
+	// ETag is the ETag of the CRL
+	ETag string
+	// NotModified is true if the CRL is unchanged from the one whose ETag
+	// was in the request, in which case CRL is empty
+	NotModified bool
+}
+
+// LogLevelRequest is a request to set the log level of the server
+type LogLevelRequest struct {
+	// Level is debug, info, warning, error, critical or fatal
+	Level string `json:"level"`
+}
+
+// LogLevelResponse is the response to a request to get or set the log level of the server
+type LogLevelResponse struct {
+	// Level is the current log level of the server
+	Level string `json:"level"`
+}
+
+// ConfigSetting is a setting of the effective configuration of the server
+type ConfigSetting struct {
+	// Setting is the path of the setting in the configuration file, such as
+	// "db.tls.enabled"
+	Setting string `json:"setting"`
+	// Value is the value of the setting, with secrets masked
+	Value interface{} `json:"value"`
+	// Source is where the value comes from: "flag", "env", "file" or
+	// "default", in decreasing order of precedence
+	Source string `json:"source"`
+}
+
+// ConfigResponse is the response to a request for the effective
+// configuration of the server
+type ConfigResponse struct {
+	// Settings are the settings of the server and of its default CA, sorted
+	// by path
+	Settings []ConfigSetting `json:"settings"`
+}
+
+// VersionResponse is the response to a request for the version of the server
+type VersionResponse struct {
+	// Version is the release version of the server
+	Version string `json:"version"`
+	// APIVersion is the version of the REST API of the endpoint
+	APIVersion string `json:"apiversion"`
+	// APIVersions are the versions of the REST API served by the server,
+	// oldest first
+	APIVersions []string `json:"apiversions"`
+	// Commit is the git commit from which the server was built, if known
+	Commit string `json:"commit,omitempty"`
+	// BuildDate is the date at which the server was built, if known
+	BuildDate string `json:"builddate,omitempty"`
+	// GoVersion is the version of Go with which the server was built
+	GoVersion string `json:"goversion"`
+}
+
+// SelfTestResult is the result of the self-test of a component of the server
+type SelfTestResult struct {
+	// Component is the name of the component, such as "ca1/signer/tls"
+	Component string `json:"component"`
+	// Error is the reason the self-test of the component failed, if it did
+	Error string `json:"error,omitempty"`
+}
+
+// SelfTestResponse is the response to a request to run the self-test of the server
+type SelfTestResponse struct {
+	// Passed is true if the self-test of every component passed
+	Passed bool `json:"passed"`
+	// Results are the results of the self-test of each component
+	Results []SelfTestResult `json:"results"`
 }
 
 // GetCRIRequest is a request to send to server to get Idemix credential revocation information
@@ -212,6 +297,10 @@ type AddIdentityRequest struct {
 	CAName string `json:"caname,omitempty" skip:"true"`
 }
 
+func (ar *AddIdentityRequest) String() string {
+	return util.StructToString(ar)
+}
+
 // ModifyIdentityRequest represents the request to modify an existing identity on the
 // fabric-ca-server
 type ModifyIdentityRequest struct {
@@ -224,6 +313,10 @@ type ModifyIdentityRequest struct {
 	CAName         string      `json:"caname,omitempty" skip:"true"`
 }
 
+func (mr *ModifyIdentityRequest) String() string {
+	return util.StructToString(mr)
+}
+
 // RemoveIdentityRequest represents the request to remove an existing identity from the
 // fabric-ca-server
 type RemoveIdentityRequest struct {
@@ -239,7 +332,22 @@ type GetIDResponse struct {
 	Affiliation    string      `json:"affiliation"`
 	Attributes     []Attribute `json:"attrs" mapstructure:"attrs" `
 	MaxEnrollments int         `json:"max_enrollments" mapstructure:"max_enrollments"`
-	CAName         string      `json:"caname,omitempty"`
+	// RemainingEnrollments is the number of times the identity may still
+	// enroll, or -1 if unlimited
+	RemainingEnrollments int    `json:"remaining_enrollments" mapstructure:"remaining_enrollments"`
+	CAName               string `json:"caname,omitempty"`
+}
+
+// GetAllIDsRequest is the request of the identities visible to the caller
+// which are of the type and in the affiliation, or its sub-affiliations, of
+// the request
+type GetAllIDsRequest struct {
+	// Type is the type of the identities, or empty for all types
+	Type string `json:"type,omitempty"`
+	// Affiliation is the affiliation of the identities, or empty for the
+	// affiliation of the caller
+	Affiliation string `json:"affiliation,omitempty"`
+	CAName      string `json:"caname,omitempty"`
 }
 
 // GetAllIDsResponse is the response from the GetAllIdentities call
@@ -266,6 +374,9 @@ type IdentityInfo struct {
 	Affiliation    string      `json:"affiliation"`
 	Attributes     []Attribute `json:"attrs" mapstructure:"attrs"`
 	MaxEnrollments int         `json:"max_enrollments" mapstructure:"max_enrollments"`
+	// RemainingEnrollments is the number of times the identity may still
+	// enroll, or -1 if unlimited
+	RemainingEnrollments int `json:"remaining_enrollments" mapstructure:"remaining_enrollments"`
 }
 
 // AddAffiliationRequest represents the request to add a new affiliation to the
@@ -335,7 +446,8 @@ type GetCertificatesRequest struct {
 
 // CertificateResponse contains the response from Get or Delete certificate request.
 type CertificateResponse struct {
-	Certs []string `json:"certs"`
+	Certs  []string `json:"certs"`
+	CAName string   `json:"caname"`
 }
 
 // TimeRange specifies a range of time
@@ -68,6 +68,21 @@ type RevocationRequestNet struct {
 	RevocationRequest
 }
 
+// RevocationResponseNet is the network response to a revocation request
+type RevocationResponseNet struct {
+	// RevokedCerts are the certificates which were revoked
+	RevokedCerts []RevokedCert
+	// CRL is the base64 encoding of the PEM-encoded CRL if the request asked
+	// for it
+	CRL string
+}
+
+// GenCRLResponseNet is the network response to a request to generate a CRL
+type GenCRLResponseNet struct {
+	// CRL is the base64 encoding of the PEM-encoded CRL
+	CRL string
+}
+
 // GetTCertBatchRequestNet is a network request for a batch of transaction certificates
 type GetTCertBatchRequestNet struct {
 	GetTCertBatchRequest
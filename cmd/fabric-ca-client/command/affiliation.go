@@ -17,10 +17,16 @@ limitations under the License.
 package command
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 
 	"github.com/cloudflare/cfssl/log"
 	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
@@ -29,8 +35,24 @@ type affiliationArgs struct {
 	add         api.AddAffiliationRequest
 	modify      api.ModifyAffiliationRequest
 	remove      api.RemoveAffiliationRequest
+	rename      api.ModifyAffiliationRequest
+	// listOutput is the output format of list
+	listOutput string
+	// output is the output format of the other affiliation commands
+	output string
 }
 
+const (
+	// affiliationOutputTree writes the affiliations as an indented tree
+	affiliationOutputTree = "tree"
+	// affiliationOutputFlat writes the name of an affiliation per line
+	affiliationOutputFlat = "flat"
+	// affiliationOutputText writes the result of a change as a sentence
+	affiliationOutputText = "text"
+	// affiliationOutputJSON writes the affiliations as JSON
+	affiliationOutputJSON = "json"
+)
+
 func (c *ClientCmd) newAffiliationCommand() *cobra.Command {
 	affiliationCmd := &cobra.Command{
 		Use:   "affiliation",
@@ -40,15 +62,17 @@ func (c *ClientCmd) newAffiliationCommand() *cobra.Command {
 	affiliationCmd.AddCommand(c.newListAffiliationCommand())
 	affiliationCmd.AddCommand(c.newAddAffiliationCommand())
 	affiliationCmd.AddCommand(c.newModifyAffiliationCommand())
+	affiliationCmd.AddCommand(c.newRenameAffiliationCommand())
 	affiliationCmd.AddCommand(c.newRemoveAffiliationCommand())
 	return affiliationCmd
 }
 
 func (c *ClientCmd) newListAffiliationCommand() *cobra.Command {
 	affiliationListCmd := &cobra.Command{
-		Use:   "list",
-		Short: "List affiliations",
-		Long:  "List affiliations visible to caller",
+		Use:     "list",
+		Short:   "List affiliations",
+		Long:    "List affiliations visible to caller",
+		Example: "fabric-ca-client affiliation list --affiliation org1 --output flat",
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			log.Level = log.LevelWarning
 			err := c.ConfigInit()
@@ -65,6 +89,9 @@ func (c *ClientCmd) newListAffiliationCommand() *cobra.Command {
 	flags := affiliationListCmd.Flags()
 	flags.StringVarP(
 		&c.dynamicAffiliation.affiliation, "affiliation", "", "", "Get affiliation information from the fabric-ca server")
+	flags.StringVar(
+		&c.dynamicAffiliation.listOutput, "output", affiliationOutputTree, "Output format: tree, flat or json")
+	setFlagValues(flags, "output", affiliationOutputTree, affiliationOutputFlat, affiliationOutputJSON)
 	return affiliationListCmd
 }
 
@@ -73,12 +100,14 @@ func (c *ClientCmd) newAddAffiliationCommand() *cobra.Command {
 		Use:     "add <affiliation>",
 		Short:   "Add affiliation",
 		Long:    "Add affiliation",
+		Example: "fabric-ca-client affiliation add org1.dept1 --force",
 		PreRunE: c.affiliationPreRunE,
 		RunE:    c.runAddAffiliation,
 	}
 	flags := affiliationAddCmd.Flags()
 	flags.BoolVarP(
 		&c.dynamicAffiliation.add.Force, "force", "", false, "Creates parent affiliations if they do not exist")
+	c.addAffiliationOutputFlag(affiliationAddCmd)
 	return affiliationAddCmd
 }
 
@@ -87,6 +116,7 @@ func (c *ClientCmd) newModifyAffiliationCommand() *cobra.Command {
 		Use:     "modify <affiliation>",
 		Short:   "Modify affiliation",
 		Long:    "Modify existing affiliation",
+		Example: "fabric-ca-client affiliation modify org1.dept1 --name org1.sales",
 		PreRunE: c.affiliationPreRunE,
 		RunE:    c.runModifyAffiliation,
 	}
@@ -95,20 +125,51 @@ func (c *ClientCmd) newModifyAffiliationCommand() *cobra.Command {
 		&c.dynamicAffiliation.modify.NewName, "name", "", "", "Rename the affiliation")
 	flags.BoolVarP(
 		&c.dynamicAffiliation.modify.Force, "force", "", false, "Forces identities using old affiliation to use new affiliation")
+	c.addAffiliationOutputFlag(affiliationModifyCmd)
 	return affiliationModifyCmd
 }
 
+func (c *ClientCmd) newRenameAffiliationCommand() *cobra.Command {
+	affiliationRenameCmd := &cobra.Command{
+		Use:     "rename <affiliation> <new affiliation>",
+		Short:   "Rename affiliation",
+		Long:    "Rename an existing affiliation",
+		Example: "fabric-ca-client affiliation rename org1.dept1 org1.sales --force",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return errors.Errorf("The affiliation and its new name are required\n\n%s", cmd.UsageString())
+			}
+			err := c.ConfigInit()
+			if err != nil {
+				return err
+			}
+
+			log.Debugf("Client configuration settings: %+v", c.clientCfg)
+
+			return nil
+		},
+		RunE: c.runRenameAffiliation,
+	}
+	flags := affiliationRenameCmd.Flags()
+	flags.BoolVarP(
+		&c.dynamicAffiliation.rename.Force, "force", "", false, "Forces identities using old affiliation to use new affiliation")
+	c.addAffiliationOutputFlag(affiliationRenameCmd)
+	return affiliationRenameCmd
+}
+
 func (c *ClientCmd) newRemoveAffiliationCommand() *cobra.Command {
 	affiliationRemoveCmd := &cobra.Command{
 		Use:     "remove <affiliation>",
 		Short:   "Remove affiliation",
 		Long:    "Remove affiliation",
+		Example: "fabric-ca-client affiliation remove org1.dept1 --force",
 		PreRunE: c.affiliationPreRunE,
 		RunE:    c.runRemoveAffiliation,
 	}
 	flags := affiliationRemoveCmd.Flags()
 	flags.BoolVarP(
-		&c.dynamicAffiliation.remove.Force, "force", "", false, "Forces removal of any child affiliations and any identities associated with removed affiliations")
+		&c.dynamicAffiliation.remove.Force, "force", "", false, "Forces removal of any child affiliations and any identities associated with removed affiliations; without it, an affiliation which has any is not removed")
+	c.addAffiliationOutputFlag(affiliationRemoveCmd)
 	return affiliationRemoveCmd
 }
 
@@ -116,26 +177,34 @@ func (c *ClientCmd) newRemoveAffiliationCommand() *cobra.Command {
 func (c *ClientCmd) runListAffiliation(cmd *cobra.Command, args []string) error {
 	log.Debugf("Entered runListAffiliation: %+v", c.dynamicAffiliation)
 
+	output := c.dynamicAffiliation.listOutput
+	err := checkAffiliationOutput(output, affiliationOutputTree, affiliationOutputFlat, affiliationOutputJSON)
+	if err != nil {
+		return err
+	}
+
 	id, err := c.LoadMyIdentity()
 	if err != nil {
 		return err
 	}
 
+	var resp *api.AffiliationResponse
 	if c.dynamicAffiliation.affiliation != "" {
-		resp, err := id.GetAffiliation(c.dynamicAffiliation.affiliation, c.clientCfg.CAName)
-		if err != nil {
-			return err
-		}
-
-		printTree(resp)
-		return nil
+		resp, err = id.GetAffiliation(c.dynamicAffiliation.affiliation, c.clientCfg.CAName)
+	} else {
+		resp, err = id.GetAllAffiliations(c.clientCfg.CAName)
 	}
-
-	resp, err := id.GetAllAffiliations(c.clientCfg.CAName)
 	if err != nil {
 		return err
 	}
 
+	switch output {
+	case affiliationOutputFlat:
+		printFlat(os.Stdout, &resp.AffiliationInfo)
+		return nil
+	case affiliationOutputJSON:
+		return writeAffiliationJSON(os.Stdout, resp)
+	}
 	printTree(resp)
 	return nil
 }
@@ -144,6 +213,11 @@ func (c *ClientCmd) runListAffiliation(cmd *cobra.Command, args []string) error
 func (c *ClientCmd) runAddAffiliation(cmd *cobra.Command, args []string) error {
 	log.Debugf("Entered runAddAffiliation: %+v", c.dynamicAffiliation)
 
+	err := checkAffiliationOutput(c.dynamicAffiliation.output, affiliationOutputText, affiliationOutputJSON)
+	if err != nil {
+		return err
+	}
+
 	id, err := c.LoadMyIdentity()
 	if err != nil {
 		return err
@@ -159,6 +233,9 @@ func (c *ClientCmd) runAddAffiliation(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	if c.dynamicAffiliation.output == affiliationOutputJSON {
+		return writeAffiliationJSON(os.Stdout, resp)
+	}
 	fmt.Printf("Successfully added affiliation: %+v\n", resp.Name)
 
 	return nil
@@ -168,6 +245,11 @@ func (c *ClientCmd) runAddAffiliation(cmd *cobra.Command, args []string) error {
 func (c *ClientCmd) runModifyAffiliation(cmd *cobra.Command, args []string) error {
 	log.Debugf("Entered runModifyAffiliation: %+v", c.dynamicAffiliation)
 
+	err := checkAffiliationOutput(c.dynamicAffiliation.output, affiliationOutputText, affiliationOutputJSON)
+	if err != nil {
+		return err
+	}
+
 	id, err := c.LoadMyIdentity()
 	if err != nil {
 		return err
@@ -184,15 +266,57 @@ func (c *ClientCmd) runModifyAffiliation(cmd *cobra.Command, args []string) erro
 		return err
 	}
 
+	if c.dynamicAffiliation.output == affiliationOutputJSON {
+		return writeAffiliationJSON(os.Stdout, resp)
+	}
 	fmt.Printf("Successfully modified affiliation: %+v\n", resp)
 
 	return nil
 }
 
+// The client side logic for renaming an affiliation
+func (c *ClientCmd) runRenameAffiliation(cmd *cobra.Command, args []string) error {
+	log.Debugf("Entered runRenameAffiliation: %+v", c.dynamicAffiliation)
+
+	err := checkAffiliationOutput(c.dynamicAffiliation.output, affiliationOutputText, affiliationOutputJSON)
+	if err != nil {
+		return err
+	}
+
+	id, err := c.LoadMyIdentity()
+	if err != nil {
+		return err
+	}
+
+	req := &api.ModifyAffiliationRequest{
+		Name:    args[0],
+		NewName: args[1],
+		Force:   c.dynamicAffiliation.rename.Force,
+		CAName:  c.clientCfg.CAName,
+	}
+	resp, err := id.ModifyAffiliation(req)
+	if err != nil {
+		return err
+	}
+
+	if c.dynamicAffiliation.output == affiliationOutputJSON {
+		return writeAffiliationJSON(os.Stdout, resp)
+	}
+	_, ids := countAffiliationTree(&resp.AffiliationInfo)
+	fmt.Printf("Successfully renamed affiliation '%s' to '%s'; %d identities were updated\n", req.Name, req.NewName, ids)
+
+	return nil
+}
+
 // The client side logic for removing an affiliation
 func (c *ClientCmd) runRemoveAffiliation(cmd *cobra.Command, args []string) error {
 	log.Debugf("Entered runRemoveAffiliation: %+v", c.dynamicAffiliation)
 
+	err := checkAffiliationOutput(c.dynamicAffiliation.output, affiliationOutputText, affiliationOutputJSON)
+	if err != nil {
+		return err
+	}
+
 	id, err := c.LoadMyIdentity()
 	if err != nil {
 		return err
@@ -203,16 +327,60 @@ func (c *ClientCmd) runRemoveAffiliation(cmd *cobra.Command, args []string) erro
 	req.CAName = c.clientCfg.CAName
 	req.Force = c.dynamicAffiliation.remove.Force
 
+	// The server does not tell the caller why it refuses to remove an
+	// affiliation, so the dependents are checked first
+	if !req.Force {
+		err = checkAffiliationDependents(id, req.Name, req.CAName)
+		if err != nil {
+			return err
+		}
+	}
+
 	resp, err := id.RemoveAffiliation(req)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Successfully removed affiliation: %+v\n", resp)
+	if c.dynamicAffiliation.output == affiliationOutputJSON {
+		return writeAffiliationJSON(os.Stdout, resp)
+	}
+	affs, ids := countAffiliationTree(&resp.AffiliationInfo)
+	fmt.Printf("Successfully removed affiliation '%s' with %d sub-affiliations and %d identities\n", req.Name, affs, ids)
 
 	return nil
 }
 
+// checkAffiliationDependents returns an error if the affiliation 'name' has
+// sub-affiliations or identities, which would be removed with it. The
+// identities which the caller can't list are left to the server to check.
+func checkAffiliationDependents(id *lib.Identity, name, caname string) error {
+	aff, err := id.GetAffiliation(name, caname)
+	if err != nil {
+		return err
+	}
+	affs, _ := countAffiliationTree(&aff.AffiliationInfo)
+	ids := 0
+	err = id.GetFilteredIdentities(&api.GetAllIDsRequest{Affiliation: name, CAName: caname}, func(decoder *json.Decoder) error {
+		var info api.IdentityInfo
+		err := decoder.Decode(&info)
+		if err != nil {
+			return err
+		}
+		ids++
+		return nil
+	})
+	if err != nil {
+		if re, ok := errors.Cause(err).(*lib.ResponseError); !ok || !re.IsAuthorizationFailure() {
+			return err
+		}
+		log.Debugf("The identities of affiliation '%s' can't be listed: %s", name, err)
+	}
+	if affs > 0 || ids > 0 {
+		return errors.Errorf("Affiliation '%s' has %d sub-affiliations and %d identities, which would be removed with it; use --force to remove them", name, affs, ids)
+	}
+	return nil
+}
+
 func (c *ClientCmd) affiliationPreRunE(cmd *cobra.Command, args []string) error {
 	err := argsCheck(args, "affiliation")
 	if err != nil {
@@ -251,3 +419,52 @@ func printChildren(children []api.AffiliationInfo, level int) {
 		printChildren(child.Affiliations, level+1)
 	}
 }
+
+// printFlat writes the full name of 'info' and of each of its
+// sub-affiliations to 'w', one per line
+func printFlat(w io.Writer, info *api.AffiliationInfo) {
+	if info.Name != "" {
+		fmt.Fprintln(w, info.Name)
+	}
+	for i := range info.Affiliations {
+		printFlat(w, &info.Affiliations[i])
+	}
+}
+
+// countAffiliationTree returns the number of sub-affiliations of 'info' and
+// the number of identities of 'info' and of its sub-affiliations
+func countAffiliationTree(info *api.AffiliationInfo) (affs, ids int) {
+	ids = len(info.Identities)
+	for i := range info.Affiliations {
+		childAffs, childIDs := countAffiliationTree(&info.Affiliations[i])
+		affs += 1 + childAffs
+		ids += childIDs
+	}
+	return affs, ids
+}
+
+// addAffiliationOutputFlag adds the flag of the output of a change of the
+// affiliations to 'cmd'
+func (c *ClientCmd) addAffiliationOutputFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&c.dynamicAffiliation.output, "output", affiliationOutputText, "Output format: text or json")
+	setFlagValues(cmd.Flags(), "output", affiliationOutputText, affiliationOutputJSON)
+}
+
+// checkAffiliationOutput returns an error if 'output' is not one of 'formats'
+func checkAffiliationOutput(output string, formats ...string) error {
+	for _, format := range formats {
+		if output == format {
+			return nil
+		}
+	}
+	return errors.Errorf("Invalid output format '%s'; must be one of: %s", output, strings.Join(formats, ", "))
+}
+
+func writeAffiliationJSON(w io.Writer, resp *api.AffiliationResponse) error {
+	buf, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal the affiliations")
+	}
+	_, err = fmt.Fprintln(w, string(buf))
+	return err
+}
@@ -0,0 +1,106 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package command
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAffiliationSubcommands(t *testing.T) {
+	homeDir, err := ioutil.TempDir("", "affiliationcmds")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(homeDir)
+	srv := setupEnrollTest(t)
+	defer stopAndCleanupServer(t, srv)
+	srv.CA.Config.Cfg.Affiliations.AllowRemove = true
+	srv.CA.Config.Cfg.Identities.AllowRemove = true
+	srv.ApplyConfig()
+	registry := srv.CA.DBAccessor()
+
+	err = RunMain([]string{cmdName, "enroll", "-u", enrollURL, "-H", homeDir})
+	util.FatalError(t, err, "Failed to enroll the admin")
+	run := func(args ...string) (string, error) {
+		return captureStdout(t, func() error {
+			return RunMain(append([]string{cmdName, "affiliation"}, append(args, "-H", homeDir)...))
+		})
+	}
+
+	// list
+	out, err := run("list", "--output", "flat")
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	assert.Subset(t, lines, []string{"hyperledger", "hyperledger.org1", "hyperledger.org2", "company1", "company1.dept1", "company2"})
+	out, err = run("list", "--affiliation", "hyperledger", "--output", "flat")
+	assert.NoError(t, err)
+	assert.Equal(t, "hyperledger\nhyperledger.org1\nhyperledger.org2\nhyperledger.org3\n", out)
+	out, err = run("list", "--affiliation", "company1", "--output", "json")
+	assert.NoError(t, err)
+	var resp api.AffiliationResponse
+	err = json.Unmarshal([]byte(out), &resp)
+	assert.NoError(t, err, "The affiliations should be JSON: %s", out)
+	assert.Equal(t, "company1", resp.Name)
+	if assert.Len(t, resp.Affiliations, 1) {
+		assert.Equal(t, "company1.dept1", resp.Affiliations[0].Name)
+	}
+	out, err = run("list", "--affiliation", "company1")
+	assert.NoError(t, err)
+	assert.Equal(t, "affiliation: company1\n   affiliation: company1.dept1\n", out, "The default output should be a tree")
+	_, err = run("list", "--output", "text")
+	util.ErrorContains(t, err, "Invalid output format 'text'", "Changes, not lists, are output as text")
+
+	// add
+	out, err = run("add", "company2.sales")
+	assert.NoError(t, err)
+	assert.Equal(t, "Successfully added affiliation: company2.sales\n", out)
+	out, err = run("add", "company3.dept1", "--force", "--output", "json")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"name": "company3.dept1"}`, out)
+	_, err = run("add", "company2.sales")
+	assert.Error(t, err, "Adding an existing affiliation should fail")
+
+	// remove refuses an affiliation with dependents without --force
+	err = RunMain([]string{cmdName, "identity", "add", "user1", "--affiliation", "company1.dept1", "-H", homeDir})
+	util.FatalError(t, err, "Failed to add identity user1")
+	_, err = run("remove", "company1")
+	util.ErrorContains(t, err, "Affiliation 'company1' has 1 sub-affiliations and 1 identities", "Removing an affiliation with dependents should fail")
+	_, err = run("remove", "company1.dept1")
+	util.ErrorContains(t, err, "has 0 sub-affiliations and 1 identities", "Removing an affiliation with identities should fail")
+	_, err = registry.GetAffiliation("company1.dept1")
+	assert.NoError(t, err, "The affiliation should not be removed")
+
+	// rename
+	_, err = run("rename", "company1.dept1")
+	util.ErrorContains(t, err, "The affiliation and its new name are required", "Renaming requires the new name")
+	out, err = run("rename", "company1.dept1", "company1.sales", "--force")
+	assert.NoError(t, err)
+	assert.Equal(t, "Successfully renamed affiliation 'company1.dept1' to 'company1.sales'; 1 identities were updated\n", out)
+	user, err := registry.GetUser("user1", nil)
+	util.FatalError(t, err, "Failed to get user1")
+	assert.Equal(t, "company1.sales", strings.Join(user.GetAffiliationPath(), "."))
+
+	// remove
+	out, err = run("remove", "company2.sales")
+	assert.NoError(t, err, "An affiliation without dependents should be removed without --force")
+	assert.Equal(t, "Successfully removed affiliation 'company2.sales' with 0 sub-affiliations and 0 identities\n", out)
+	out, err = run("remove", "company1", "--force", "--output", "json")
+	assert.NoError(t, err)
+	err = json.Unmarshal([]byte(out), &resp)
+	assert.NoError(t, err, "The removed affiliations should be JSON: %s", out)
+	assert.Equal(t, "company1", resp.Name)
+	_, err = registry.GetUser("user1", nil)
+	assert.Error(t, err, "The identities of the affiliation should be removed")
+	_, err = run("remove", "company1")
+	assert.Error(t, err, "Removing an affiliation which does not exist should fail")
+}
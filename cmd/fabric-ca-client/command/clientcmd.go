@@ -7,14 +7,18 @@ SPDX-License-Identifier: Apache-2.0
 package command
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"github.com/cloudflare/cfssl/log"
 	"github.com/hyperledger/fabric-ca/lib"
+	caclient "github.com/hyperledger/fabric-ca/lib/client"
 	"github.com/hyperledger/fabric-ca/lib/metadata"
 	"github.com/hyperledger/fabric-ca/util"
 	"github.com/pkg/profile"
@@ -28,14 +32,15 @@ const (
 )
 
 const (
-	client    = "client"
-	enroll    = "enroll"
-	reenroll  = "reenroll"
-	register  = "register"
-	revoke    = "revoke"
-	getcacert = "getcacert"
-	getcainfo = "getcainfo"
-	gencsr    = "gencsr"
+	client      = "client"
+	enroll      = "enroll"
+	enrollBatch = "enroll-batch"
+	reenroll    = "reenroll"
+	register    = "register"
+	revoke      = "revoke"
+	getcacert   = "getcacert"
+	getcainfo   = "getcainfo"
+	gencsr      = "gencsr"
 )
 
 // Command interface initializes client command and loads an identity
@@ -51,6 +56,14 @@ type Command interface {
 	// Returns viper instance associated with this comamnd
 	GetViper() *viper.Viper
 	GetHomeDirectory() string
+	// Returns the context of the requests of this command, which is canceled
+	// when the command is interrupted
+	GetContext() context.Context
+	// Returns the format of the credentials obtained by this command
+	GetOutputFormat() string
+	// Prompts for the passphrase of the private key; 'newKey' is true if
+	// the passphrase is chosen for a new key
+	GetKeyPassphrase(newKey bool) ([]byte, error)
 }
 
 type crlArgs struct {
@@ -62,6 +75,16 @@ type crlArgs struct {
 	ExpireAfter string `help:"Generate CRL with certificates that expire after this UTC timestamp (in RFC3339 format)"`
 	// Genenerate CRL with all the certificates that expire before this timestamp
 	ExpireBefore string `help:"Generate CRL with certificates that expire before this UTC timestamp (in RFC3339 format)"`
+	// Generate CRL with the certificates that were issued under the CA's previous key
+	PreviousKey bool `help:"Generate CRL with certificates that were issued under the CA's previous key during a key rollover"`
+	// Out is the file to which the CRL is written
+	Out string `help:"File to which the CRL is written instead of the crls directory of the msp directory"`
+	// OutForm is the encoding of the CRL written to Out
+	OutForm string `def:"pem" help:"Encoding of the CRL written to the --out file, pem or der"`
+	// Print specifies whether to print the revoked certificates of the CRL
+	Print bool `help:"Print the serial numbers and revocation reasons of the certificates in the CRL"`
+	// Accept is the format in which the server returns the CRL
+	Accept string `help:"Format in which the server returns the CRL, json, pem or der; the response is written as returned to the --out file, or to stdout, rather than stored"`
 }
 
 type revokeArgs struct {
@@ -69,6 +92,13 @@ type revokeArgs struct {
 	GenCRL bool `def:"false" json:"gencrl,omitempty" opt:"" help:"Generates a CRL that contains all revoked certificates"`
 }
 
+type registerArgs struct {
+	// secretFile is the file to which the enrollment secret is written
+	secretFile string
+	// json specifies whether to print the result as JSON
+	json bool
+}
+
 // ClientCmd encapsulates cobra command that provides command line interface
 // for the Fabric CA client and the configuration used by the Fabric CA client
 type ClientCmd struct {
@@ -99,6 +129,10 @@ type ClientCmd struct {
 	crlParams crlArgs
 	// revoke command argument values
 	revokeParams revokeArgs
+	// register command argument values
+	registerParams registerArgs
+	// reenroll command generates a new key rather than reusing the current one
+	reenrollNewKey bool
 	// profileMode is the profiling mode, cpu or mem or empty
 	profileMode string
 	// profileInst is the profiling instance object
@@ -111,6 +145,22 @@ type ClientCmd struct {
 	dynamicAffiliation affiliationArgs
 	// Enable debug level logging
 	debug bool
+	// traceFile is the file to which the HTTP exchanges are written in full
+	traceFile string
+	// errorFormat is the format in which the error of the command is written
+	errorFormat string
+	// runStarted is set when the run function of the command starts, so
+	// that earlier errors are known to be in the command line
+	runStarted bool
+	// outputFormat is the format of the credentials obtained by the command
+	outputFormat string
+	// noEncrypt stores the private key unencrypted, regardless of the
+	// keyencryption.enabled setting
+	noEncrypt bool
+	// keyPrompter prompts for the passphrase of the private key
+	keyPrompter prompter
+	// ctx is the context of the requests of the command
+	ctx context.Context
 }
 
 // NewCommand returns new ClientCmd ready for running
@@ -123,9 +173,67 @@ func NewCommand(name string) *ClientCmd {
 	return c
 }
 
-// Execute runs this ClientCmd
+// Execute runs this ClientCmd. An interrupt or termination signal cancels
+// the requests in progress, and the command fails.
 func (c *ClientCmd) Execute() error {
-	return c.rootCmd.Execute()
+	return c.ExecuteContext(context.Background())
+}
+
+// ExecuteContext runs this ClientCmd like Execute; canceling 'ctx' also
+// cancels the requests in progress
+func (c *ClientCmd) ExecuteContext(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Infof("Received %s; canceling the requests in progress", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	c.ctx = ctx
+	err := c.rootCmd.Execute()
+	if err == nil {
+		return nil
+	}
+	if !c.runStarted {
+		err = newUsageError(err)
+	}
+	if c.errorFormat == errorFormatJSON {
+		if werr := writeJSONError(os.Stderr, err); werr != nil {
+			log.Errorf("Failed to write the error: %s", werr)
+		}
+	}
+	return err
+}
+
+// GetContext returns the context of the requests of the command
+func (c *ClientCmd) GetContext() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// GetOutputFormat returns the format of the credentials obtained by the command
+func (c *ClientCmd) GetOutputFormat() string {
+	if c.outputFormat == "" {
+		return outputFormatFiles
+	}
+	return c.outputFormat
+}
+
+// GetKeyPassphrase prompts for the passphrase of the private key, which is
+// used when it is not configured
+func (c *ClientCmd) GetKeyPassphrase(newKey bool) ([]byte, error) {
+	if c.keyPrompter == nil {
+		c.keyPrompter = newTerminalPrompter()
+	}
+	return promptForKeyPassphrase(c.keyPrompter, newKey)
 }
 
 // init initializes the ClientCmd instance
@@ -140,6 +248,10 @@ func (c *ClientCmd) init() {
 			if err != nil {
 				return err
 			}
+			err = checkOutputFormat(c.outputFormat)
+			if err != nil {
+				return err
+			}
 			util.CmdRunBegin(c.myViper)
 			cmd.SilenceUsage = true
 			return nil
@@ -153,6 +265,7 @@ func (c *ClientCmd) init() {
 	}
 	c.rootCmd.AddCommand(c.newRegisterCommand(),
 		newEnrollCmd(c).getCommand(),
+		newEnrollBatchCmd(c).getCommand(),
 		c.newReenrollCommand(),
 		c.newRevokeCommand(),
 		newGetCAInfoCmd(c).getCommand(),
@@ -160,7 +273,19 @@ func (c *ClientCmd) init() {
 		c.newGenCRLCommand(),
 		c.newIdentityCommand(),
 		c.newAffiliationCommand(),
-		createCertificateCommand(c))
+		createCertificateCommand(c),
+		newTokenCmd(c).getCommand(),
+		newRenewerCmd(c).getCommand(),
+		c.newCompletionCommand())
+	var showVersion bool
+	c.rootCmd.Flags().BoolVar(&showVersion, "version", false, "Prints Fabric CA Client version")
+	c.rootCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if !showVersion {
+			return cmd.Help()
+		}
+		fmt.Print(metadata.GetVersionInfo(cmdName))
+		return nil
+	}
 	c.rootCmd.AddCommand(&cobra.Command{
 		Use:   "version",
 		Short: "Prints Fabric CA Client version",
@@ -169,6 +294,8 @@ func (c *ClientCmd) init() {
 		},
 	})
 	c.registerFlags()
+	annotateCompletions(c.rootCmd)
+	trackRun(c.rootCmd, &c.runStarted)
 	log.Level = log.LevelInfo
 }
 
@@ -192,15 +319,24 @@ func (c *ClientCmd) registerFlags() {
 	pflags.MarkHidden("config")
 	// Don't want to use the default parameter for StringVarP. Need to be able to identify if home directory was explicitly set
 	pflags.StringVarP(&c.homeDirectory, "home", "H", "", fmt.Sprintf("Client's home directory (default \"%s\")", filepath.Dir(cfg)))
-	pflags.StringSliceVarP(
-		&c.cfgAttrs, "id.attrs", "", nil, "A list of comma-separated attributes of the form <name>=<value> (e.g. foo=foo1,bar=bar1)")
+	pflags.VarP((*attrListValue)(&c.cfgAttrs), "id.attrs", "",
+		"A list of comma-separated attributes of the form <name>=<value> (e.g. foo=foo1,bar=bar1); values containing commas must be quoted (e.g. 'hf.Registrar.Roles=\"peer,user\"')")
 	pflags.StringSliceVarP(
 		&c.cfgAttrReqs, "enrollment.attrs", "", nil, "A list of comma-separated attribute requests of the form <name>[:opt] (e.g. foo,bar:opt)")
 	util.FlagString(c.myViper, pflags, "myhost", "m", host,
 		"Hostname to include in the certificate signing request during enrollment")
 	pflags.StringSliceVarP(
 		&c.cfgCsrNames, "csr.names", "", nil, "A list of comma-separated CSR names of the form <name>=<value> (e.g. C=CA,O=Org1)")
-	pflags.BoolVarP(&c.debug, "debug", "d", false, "Enable debug level logging")
+	pflags.BoolVarP(&c.debug, "debug", "d", false,
+		"Enable debug level logging, including the HTTP requests and responses with their authorization headers and secrets redacted")
+	pflags.StringVar(&c.traceFile, "trace-file", "",
+		"File to which the HTTP requests and responses are appended in full; WARNING: it contains enrollment secrets and tokens")
+	c.errorFormat = errorFormatText
+	pflags.Var(&errorFormatValue{format: &c.errorFormat, cmd: c.rootCmd}, "error-format",
+		"Format of the error of a failed command written to stderr: text, or json for a JSON object with the exit code")
+	pflags.StringVar(&c.outputFormat, "format", outputFormatFiles,
+		"Output format of the credentials: files stores them in the msp directory, json and pem-stdout write them to stdout")
+	pflags.BoolVar(&c.noEncrypt, "no-encrypt", false, "Store the private key unencrypted, even if keyencryption.enabled is set")
 
 	c.clientCfg = &lib.ClientConfig{}
 	tags := map[string]string{
@@ -243,23 +379,26 @@ func (c *ClientCmd) checkAndEnableProfiling() error {
 // Certain client commands can only be executed if enrollment credentials
 // are present
 func (c *ClientCmd) requiresEnrollment() bool {
-	return c.name != enroll && c.name != getcacert && c.name != getcainfo && c.name != gencsr
+	return c.name != enroll && c.name != enrollBatch && c.name != getcacert && c.name != getcainfo && c.name != gencsr
 }
 
-// Create default client configuration file only during an enroll or gencsr command
+// Create default client configuration file only during an enroll, enroll-batch
+// or gencsr command
 func (c *ClientCmd) shouldCreateDefaultConfig() bool {
-	return c.name == enroll || c.name == gencsr
+	return c.name == enroll || c.name == enrollBatch || c.name == gencsr
 }
 
 func (c *ClientCmd) requiresUser() bool {
-	return c.name != gencsr
+	return c.name != gencsr && c.name != enrollBatch
 }
 
 // LoadMyIdentity loads the client's identity
 func (c *ClientCmd) LoadMyIdentity() (*lib.Identity, error) {
 	client := &lib.Client{
-		HomeDir: filepath.Dir(c.cfgFileName),
-		Config:  c.clientCfg,
+		HomeDir:       filepath.Dir(c.cfgFileName),
+		Config:        c.clientCfg,
+		Context:       c.ctx,
+		KeyPassphrase: c.GetKeyPassphrase,
 	}
 
 	id, err := client.LoadMyIdentity()
@@ -270,6 +409,16 @@ func (c *ClientCmd) LoadMyIdentity() (*lib.Identity, error) {
 	return id, nil
 }
 
+// newClient returns the client of the server of the configuration of the
+// command 'c', whose identity is stored in the msp directory
+func newClient(c Command) (*caclient.Client, error) {
+	return caclient.New(&caclient.Config{
+		ClientConfig:  c.GetClientCfg(),
+		HomeDir:       filepath.Dir(c.GetCfgFileName()),
+		KeyPassphrase: c.GetKeyPassphrase,
+	})
+}
+
 // GetClientCfg returns client configuration
 func (c *ClientCmd) GetClientCfg() *lib.ClientConfig {
 	return c.clientCfg
@@ -0,0 +1,399 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+const (
+	// completionValuesAnnotation is the annotation of a flag with the values
+	// which it is completed with
+	completionValuesAnnotation = "fabric_ca_client_completion_values"
+	// completionCANamesAnnotation is the annotation of a flag which is
+	// completed with the CA names of the client's configuration file
+	completionCANamesAnnotation = "fabric_ca_client_completion_canames"
+	// shellFuncPrefix is the prefix of the functions of the completion
+	// scripts, which must be a valid identifier in every shell
+	shellFuncPrefix = "__fabric_ca_client"
+)
+
+// completionFlagValues are the values of the flags of all commands which
+// take one of a fixed set of values, by flag name
+var completionFlagValues = map[string][]string{
+	"format":          {outputFormatFiles, outputFormatJSON, outputFormatPEMStdout},
+	"error-format":    {errorFormatText, errorFormatJSON},
+	"outform":         {"pem", "der"},
+	"revoke.reason":   revocationReasonNames(),
+	"enrollment.type": {"x509", "idemix"},
+}
+
+// revocationReasonNames returns the names of the revocation reasons, sorted
+func revocationReasonNames() []string {
+	var names []string
+	for name := range util.RevocationReasonCodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setFlagValues sets the values which the flag 'name' of 'flags' is
+// completed with, for flags whose values differ between commands
+func setFlagValues(flags *pflag.FlagSet, name string, values ...string) {
+	flags.SetAnnotation(name, completionValuesAnnotation, values)
+	flags.SetAnnotation(name, cobra.BashCompCustom, []string{shellFuncPrefix + "_values " + strings.Join(values, " ")})
+}
+
+// annotateCompletions annotates the flags of 'cmd' and its subcommands with
+// the values which they are completed with. It is called once the command
+// tree is built, so that the flags of new commands are completed as well.
+func annotateCompletions(cmd *cobra.Command) {
+	annotate := func(flags *pflag.FlagSet) {
+		flags.VisitAll(func(flag *pflag.Flag) {
+			if _, ok := flag.Annotations[completionValuesAnnotation]; ok {
+				return
+			}
+			if values, ok := completionFlagValues[flag.Name]; ok {
+				setFlagValues(flags, flag.Name, values...)
+			} else if flag.Name == "caname" {
+				flags.SetAnnotation(flag.Name, completionCANamesAnnotation, []string{})
+				flags.SetAnnotation(flag.Name, cobra.BashCompCustom, []string{shellFuncPrefix + "_canames"})
+			}
+		})
+	}
+	annotate(cmd.PersistentFlags())
+	annotate(cmd.LocalNonPersistentFlags())
+	for _, sub := range cmd.Commands() {
+		annotateCompletions(sub)
+	}
+}
+
+func (c *ClientCmd) newCompletionCommand() *cobra.Command {
+	completionCmd := &cobra.Command{
+		Use:   "completion bash|zsh|fish",
+		Short: "Generate a shell completion script",
+		Long: "Write to stdout the script which completes the commands, flags and flag values of " + cmdName +
+			" in bash, zsh or fish; the CA names are completed from the client's configuration file, if any",
+		Example: "source <(fabric-ca-client completion bash)\n" +
+			"fabric-ca-client completion zsh > \"${fpath[1]}/_fabric-ca-client\"\n" +
+			"fabric-ca-client completion fish > ~/.config/fish/completions/fabric-ca-client.fish",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				return errors.Errorf("Unknown shell '%s'; must be bash, zsh or fish", args[0])
+			}
+			return errors.New("The shell, bash, zsh or fish, is required")
+		},
+		Run: func(cmd *cobra.Command, args []string) {},
+	}
+	for _, shell := range []struct {
+		name string
+		gen  func(root *cobra.Command, w io.Writer) error
+	}{
+		{"bash", genBashCompletion},
+		{"zsh", genZshCompletion},
+		{"fish", genFishCompletion},
+	} {
+		gen := shell.gen
+		completionCmd.AddCommand(&cobra.Command{
+			Use:   shell.name,
+			Short: fmt.Sprintf("Generate the %s completion script", shell.name),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				if len(args) > 0 {
+					return newUsageError(errors.Errorf(extraArgsError, args, cmd.UsageString()))
+				}
+				return gen(c.rootCmd, os.Stdout)
+			},
+		})
+	}
+	// The completion scripts run this command to complete CA names; it only
+	// reads the configuration file, so completing is fast and works offline
+	completionCmd.AddCommand(&cobra.Command{
+		Use:    "canames",
+		Short:  "Print the CA names of the client's configuration file",
+		Hidden: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			for _, name := range c.configuredCANames() {
+				fmt.Println(name)
+			}
+			return nil
+		},
+	})
+	return completionCmd
+}
+
+// configuredCANames returns the CA names of the client's configuration
+// file, or none if there is no configuration file
+func (c *ClientCmd) configuredCANames() []string {
+	cfgFileName, _, err := util.ValidateAndReturnAbsConf(c.cfgFileName, c.homeDirectory, cmdName)
+	if err != nil {
+		return nil
+	}
+	if _, err := os.Stat(cfgFileName); err != nil {
+		return nil
+	}
+	v := viper.New()
+	v.SetConfigFile(cfgFileName)
+	if v.ReadInConfig() != nil {
+		return nil
+	}
+	if name := v.GetString("caname"); name != "" {
+		return []string{name}
+	}
+	return nil
+}
+
+// completionCommands returns 'cmd' and its available subcommands, in the
+// order in which they are listed by help
+func completionCommands(cmd *cobra.Command) []*cobra.Command {
+	cmds := []*cobra.Command{cmd}
+	for _, sub := range cmd.Commands() {
+		if sub.IsAvailableCommand() && sub.Name() != "help" {
+			cmds = append(cmds, completionCommands(sub)...)
+		}
+	}
+	return cmds
+}
+
+// commandPath returns the path of 'cmd' below the root command, such as
+// "identity list"
+func commandPath(cmd *cobra.Command) string {
+	path := cmd.CommandPath()
+	return strings.TrimPrefix(strings.TrimPrefix(path, cmd.Root().Name()), " ")
+}
+
+// completedFlags calls 'f' with the flags of 'cmd' which are completed,
+// which are its local flags and, if 'inherited' is true, the flags which it
+// inherits
+func completedFlags(cmd *cobra.Command, inherited bool, f func(flag *pflag.Flag)) {
+	visit := func(flag *pflag.Flag) {
+		if !flag.Hidden && flag.Deprecated == "" {
+			f(flag)
+		}
+	}
+	if cmd.HasParent() {
+		cmd.LocalNonPersistentFlags().VisitAll(visit)
+	} else {
+		cmd.NonInheritedFlags().VisitAll(visit)
+	}
+	if inherited {
+		cmd.InheritedFlags().VisitAll(visit)
+	}
+}
+
+// isBoolFlag returns true if 'flag' takes no value
+func isBoolFlag(flag *pflag.Flag) bool {
+	return flag.NoOptDefVal != ""
+}
+
+// genBashCompletion writes the bash completion script of 'root' to 'w', with
+// the functions which complete the annotated flag values
+func genBashCompletion(root *cobra.Command, w io.Writer) error {
+	root.BashCompletionFunction = fmt.Sprintf(`%[1]s_values()
+{
+    COMPREPLY=( $(compgen -W "$*" -- "$cur") )
+}
+
+%[1]s_canames()
+{
+    COMPREPLY=( $(compgen -W "$(%[2]s completion canames 2>/dev/null)" -- "$cur") )
+}
+`, shellFuncPrefix, root.Name())
+	return root.GenBashCompletion(w)
+}
+
+// zshQuote returns 's' single-quoted for zsh
+func zshQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// zshEscape returns 's' with its brackets and colons escaped, so that it can
+// be the description of an option or subcommand of _arguments and _describe
+func zshEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+}
+
+// zshFlagSpecs returns the _arguments specifications of 'flag'
+func zshFlagSpecs(flag *pflag.Flag) []string {
+	desc := "[" + zshEscape(strings.Split(flag.Usage, "\n")[0]) + "]"
+	action := ""
+	if !isBoolFlag(flag) {
+		action = ":" + flag.Name + ":_default"
+		if values, ok := flag.Annotations[completionValuesAnnotation]; ok {
+			action = ":" + flag.Name + ":(" + strings.Join(values, " ") + ")"
+		} else if _, ok := flag.Annotations[completionCANamesAnnotation]; ok {
+			action = ":" + flag.Name + ":" + shellFuncPrefix + "_canames"
+		}
+	}
+	long := "--" + flag.Name
+	if !isBoolFlag(flag) {
+		long += "="
+	}
+	if flag.Shorthand == "" {
+		return []string{zshQuote(long + desc + action)}
+	}
+	exclusive := fmt.Sprintf("(-%s --%s)", flag.Shorthand, flag.Name)
+	return []string{
+		zshQuote(exclusive + "-" + flag.Shorthand + desc + action),
+		zshQuote(exclusive + long + desc + action),
+	}
+}
+
+// genZshCompletion writes the zsh completion script of 'root' to 'w'. The
+// words of the command line which are subcommands select the command whose
+// flags and subcommands are completed.
+func genZshCompletion(root *cobra.Command, w io.Writer) error {
+	var buf bytes.Buffer
+	name := root.Name()
+	fmt.Fprintf(&buf, "#compdef %s\n\n", name)
+	fmt.Fprintf(&buf, "%s_canames()\n{\n    local -a canames\n    canames=(${(f)\"$(%s completion canames 2>/dev/null)\"})\n    _describe 'CA name' canames\n}\n\n", shellFuncPrefix, name)
+	fmt.Fprintf(&buf, "_%s()\n{\n", strings.Replace(name, "-", "_", -1))
+	buf.WriteString("    local -a commands global_flags subcommands\n    commands=(\n")
+	cmds := completionCommands(root)
+	for _, cmd := range cmds[1:] {
+		fmt.Fprintf(&buf, "        %s\n", zshQuote(commandPath(cmd)))
+	}
+	buf.WriteString("    )\n    global_flags=(\n")
+	root.PersistentFlags().VisitAll(func(flag *pflag.Flag) {
+		if !flag.Hidden && flag.Deprecated == "" {
+			for _, spec := range zshFlagSpecs(flag) {
+				fmt.Fprintf(&buf, "        %s\n", spec)
+			}
+		}
+	})
+	buf.WriteString(`    )
+    # path is the array tied to PATH in zsh, so the command path is cmdpath
+    local cmdpath="" candidate word state line
+    typeset -A opt_args
+    integer i last=1
+    for (( i = 2; i < CURRENT; i++ )); do
+        word=${words[i]}
+        [[ $word == -* ]] && continue
+        candidate="${cmdpath:+$cmdpath }$word"
+        if (( ${commands[(Ie)$candidate]} )); then
+            cmdpath=$candidate
+            last=i
+        fi
+    done
+    words=("${(@)words[last,-1]}")
+    (( CURRENT -= last - 1 ))
+    case $cmdpath in
+`)
+	for _, cmd := range cmds {
+		fmt.Fprintf(&buf, "    %s)\n        subcommands=(\n", zshQuote(commandPath(cmd)))
+		for _, sub := range cmd.Commands() {
+			if sub.IsAvailableCommand() && sub.Name() != "help" {
+				fmt.Fprintf(&buf, "            %s\n", zshQuote(sub.Name()+":"+zshEscape(sub.Short)))
+			}
+		}
+		buf.WriteString("        )\n        _arguments -s \"${global_flags[@]}\"")
+		completedFlags(cmd, false, func(flag *pflag.Flag) {
+			if cmd.HasParent() || root.PersistentFlags().Lookup(flag.Name) == nil {
+				for _, spec := range zshFlagSpecs(flag) {
+					fmt.Fprintf(&buf, " \\\n            %s", spec)
+				}
+			}
+		})
+		buf.WriteString(" \\\n            '*::subcommand:->subcommands'\n")
+		buf.WriteString("        (( ${#subcommands} )) && [[ $state == subcommands ]] && _describe command subcommands\n        ;;\n")
+	}
+	buf.WriteString("    esac\n}\n\n")
+	fmt.Fprintf(&buf, "compdef _%s %s\n", strings.Replace(name, "-", "_", -1), name)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// fishQuote returns 's' single-quoted for fish
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+// fishFlag returns the complete command of 'flag' with the condition 'cond'
+func fishFlag(name string, flag *pflag.Flag, cond string) string {
+	line := "complete -c " + name
+	if cond != "" {
+		line += " -n " + fishQuote(cond)
+	}
+	line += " -l " + flag.Name
+	if flag.Shorthand != "" {
+		line += " -s " + flag.Shorthand
+	}
+	line += " -d " + fishQuote(strings.Split(flag.Usage, "\n")[0])
+	if !isBoolFlag(flag) {
+		if values, ok := flag.Annotations[completionValuesAnnotation]; ok {
+			line += " -x -a " + fishQuote(strings.Join(values, " "))
+		} else if _, ok := flag.Annotations[completionCANamesAnnotation]; ok {
+			line += " -x -a " + fishQuote("("+name+" completion canames 2>/dev/null)")
+		} else {
+			line += " -r"
+		}
+	}
+	return line
+}
+
+// genFishCompletion writes the fish completion script of 'root' to 'w'. The
+// words of the command line which are subcommands select the command whose
+// flags and subcommands are completed.
+func genFishCompletion(root *cobra.Command, w io.Writer) error {
+	var buf bytes.Buffer
+	name := root.Name()
+	cmds := completionCommands(root)
+	fmt.Fprintf(&buf, "# fish completion for %s\n\n", name)
+	fmt.Fprintf(&buf, "set -g %s_commands", shellFuncPrefix)
+	for _, cmd := range cmds[1:] {
+		fmt.Fprintf(&buf, " %s", fishQuote(commandPath(cmd)))
+	}
+	fmt.Fprintf(&buf, `
+
+function %[1]s_path
+    set -l path ''
+    for word in (commandline -opc)[2..-1]
+        string match -q -- '-*' $word; and continue
+        set -l candidate (string trim -- "$path $word")
+        contains -- $candidate $%[1]s_commands; and set path $candidate
+    end
+    echo $path
+end
+
+function %[1]s_at
+    test (%[1]s_path) = "$argv[1]"
+end
+
+complete -c %[2]s -f
+`, shellFuncPrefix, name)
+	root.PersistentFlags().VisitAll(func(flag *pflag.Flag) {
+		if !flag.Hidden && flag.Deprecated == "" {
+			fmt.Fprintln(&buf, fishFlag(name, flag, ""))
+		}
+	})
+	for _, cmd := range cmds {
+		cond := fmt.Sprintf("%s_at %s", shellFuncPrefix, fishQuote(commandPath(cmd)))
+		for _, sub := range cmd.Commands() {
+			if sub.IsAvailableCommand() && sub.Name() != "help" {
+				fmt.Fprintf(&buf, "complete -c %s -n %s -a %s -d %s\n", name, fishQuote(cond), sub.Name(), fishQuote(sub.Short))
+			}
+		}
+		completedFlags(cmd, false, func(flag *pflag.Flag) {
+			if cmd.HasParent() || root.PersistentFlags().Lookup(flag.Name) == nil {
+				fmt.Fprintln(&buf, fishFlag(name, flag, cond))
+			}
+		})
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,142 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package command
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+)
+
+// checkScriptSyntax checks the syntax of 'script' with 'shell', if installed
+func checkScriptSyntax(t *testing.T, shell, script string, args ...string) {
+	path, err := exec.LookPath(shell)
+	if err != nil {
+		t.Logf("%s is not installed; not checking the syntax of its completion script", shell)
+		return
+	}
+	file, err := ioutil.TempFile("", "completion")
+	util.FatalError(t, err, "Failed to create temporary file")
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(script)
+	file.Close()
+	util.FatalError(t, err, "Failed to write the completion script")
+	out, err := exec.Command(path, append(args, file.Name())...).CombinedOutput()
+	assert.NoError(t, err, "The %s completion script should parse: %s", shell, out)
+}
+
+func TestCompletionScripts(t *testing.T) {
+	scripts := map[string]string{}
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		out, err := captureStdout(t, func() error {
+			return RunMain([]string{cmdName, "completion", shell})
+		})
+		util.FatalError(t, err, "Failed to generate the "+shell+" completion script")
+		scripts[shell] = out
+	}
+	checkScriptSyntax(t, "bash", scripts["bash"], "-n")
+	checkScriptSyntax(t, "zsh", scripts["zsh"], "-n")
+	checkScriptSyntax(t, "fish", scripts["fish"], "--no-execute")
+
+	// Every command and flag is completed
+	var visit func(cmd *cobra.Command)
+	visit = func(cmd *cobra.Command) {
+		if cmd.HasParent() {
+			for _, script := range scripts {
+				assert.Contains(t, script, cmd.Name(), "The command '%s' should be completed", cmd.CommandPath())
+			}
+		}
+		cmd.NonInheritedFlags().VisitAll(func(flag *pflag.Flag) {
+			if flag.Hidden || flag.Deprecated != "" {
+				return
+			}
+			for shell, script := range scripts {
+				long := "--" + flag.Name
+				if shell == "fish" {
+					long = "-l " + flag.Name
+				}
+				assert.Contains(t, script, long, "The flag '%s' of '%s' should be completed in %s", flag.Name, cmd.CommandPath(), shell)
+			}
+		})
+		for _, sub := range cmd.Commands() {
+			if sub.IsAvailableCommand() && sub.Name() != "help" {
+				visit(sub)
+			}
+		}
+	}
+	visit(NewCommand(cmdName).rootCmd)
+
+	// The flags which take one of a fixed set of values are completed with them
+	for _, script := range scripts {
+		for _, values := range []string{
+			"aacompromise affiliationchanged cacompromise certificatehold cessationofoperation keycompromise privilegewithdrawn removefromcrl superseded unspecified",
+			"files json pem-stdout",
+			"tree flat json",
+			"table json",
+			"pem der",
+		} {
+			assert.Contains(t, script, values)
+		}
+		assert.Contains(t, script, "completion canames", "The CA names should be completed from the configuration file")
+	}
+
+	err := RunMain([]string{cmdName, "completion", "tcsh"})
+	util.ErrorContains(t, err, "Unknown shell 'tcsh'", "An unsupported shell should fail")
+	assert.Equal(t, ExitCodeUsage, ExitCode(err))
+}
+
+func TestCompletionCANames(t *testing.T) {
+	homeDir, err := ioutil.TempDir("", "completioncanames")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(homeDir)
+
+	out, err := captureStdout(t, func() error {
+		return RunMain([]string{cmdName, "completion", "canames", "-H", homeDir})
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, out, "There are no CA names without a configuration file")
+	_, err = os.Stat(filepath.Join(homeDir, "fabric-ca-client-config.yaml"))
+	assert.True(t, os.IsNotExist(err), "Completing should not create the configuration file")
+
+	cfg := "url: http://localhost:7054\ncaname: ca-org1\n"
+	err = ioutil.WriteFile(filepath.Join(homeDir, "fabric-ca-client-config.yaml"), []byte(cfg), 0644)
+	util.FatalError(t, err, "Failed to write the configuration file")
+	out, err = captureStdout(t, func() error {
+		return RunMain([]string{cmdName, "completion", "canames", "-H", homeDir})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "ca-org1\n", out)
+}
+
+func TestHelpExamples(t *testing.T) {
+	out, err := captureStdout(t, func() error {
+		return RunMain([]string{cmdName, "help", "revoke"})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, out, "Examples:\nfabric-ca-client revoke -e peer1 -r keycompromise --gencrl")
+	assert.Contains(t, out, "--revoke.reason")
+
+	var visit func(cmd *cobra.Command)
+	visit = func(cmd *cobra.Command) {
+		if cmd.Runnable() && cmd.IsAvailableCommand() && cmd.HasParent() && cmd.Name() != "version" &&
+			!strings.HasPrefix(cmd.CommandPath(), cmdName+" completion ") {
+			assert.NotEmpty(t, cmd.Example, "The command '%s' should have examples", cmd.CommandPath())
+		}
+		for _, sub := range cmd.Commands() {
+			visit(sub)
+		}
+	}
+	visit(NewCommand(cmdName).rootCmd)
+}
@@ -10,6 +10,7 @@ import (
 	"testing"
 
 	"github.com/hyperledger/fabric-ca/lib"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestProcessAttributes(t *testing.T) {
@@ -89,3 +90,23 @@ func TestProcessAttributes(t *testing.T) {
 		t.Fatal("Negative test case 2 should have failed")
 	}
 }
+
+func TestSplitAttributes(t *testing.T) {
+	for list, expected := range map[string][]string{
+		"foo=bar":         {"foo=bar"},
+		"foo=bar,baz=qux": {"foo=bar", "baz=qux"},
+		`"hf.Registrar.Roles=peer,user",hf.Revoker=true`: {"hf.Registrar.Roles=peer,user", "hf.Revoker=true"},
+		`hf.Registrar.Roles="peer,user":ecert,foo=bar`:   {"hf.Registrar.Roles=peer,user:ecert", "foo=bar"},
+	} {
+		attrs, err := splitAttributes(list)
+		if assert.NoError(t, err, "Failed to split '%s'", list) {
+			assert.Equal(t, expected, attrs)
+		}
+	}
+	_, err := splitAttributes(`foo="bar,baz`)
+	assert.Error(t, err, "An unterminated quote should fail")
+
+	clientCfg := lib.ClientConfig{}
+	err = processAttributes([]string{"=bar"}, &clientCfg)
+	assert.Error(t, err, "An attribute without a name should fail")
+}
@@ -0,0 +1,442 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package command
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib"
+	caclient "github.com/hyperledger/fabric-ca/lib/client"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/hyperledger/fabric/bccsp/factory"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// EnrollBatchCmdUsage is the usage text for the enroll-batch command
+	EnrollBatchCmdUsage = "enroll-batch -u http://serverAddr:serverPort --manifest <file> [--workers <count>] [--report <file>] [--resume]"
+	// EnrollBatchCmdShortDesc is the short description for the enroll-batch command
+	EnrollBatchCmdShortDesc = "Enroll the identities of a manifest"
+)
+
+// The status of a row of the manifest in the report of enroll-batch
+const (
+	batchEnrolled = "enrolled"
+	batchSkipped  = "skipped"
+	batchFailed   = "failed"
+)
+
+// The columns of a CSV manifest, whose first line must name them
+var batchCSVColumns = []string{"id", "secret", "hosts", "serialnumber", "keyalgo", "keysize", "output"}
+
+type enrollBatchCmd struct {
+	Command
+	// manifest is the JSON or CSV file of the identities to enroll
+	manifest string
+	// workers is the number of enrollments performed concurrently
+	workers int
+	// report is the file of the report, which is written to stdout if empty
+	report string
+	// resume skips the rows whose msp directory already has a valid
+	// enrollment certificate
+	resume bool
+}
+
+// batchRow is a row of the manifest of enroll-batch
+type batchRow struct {
+	// ID and Secret are the enrollment ID and secret of the identity
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+	// CSR overrides the CSR of the configuration; its common name is always
+	// the enrollment ID
+	CSR struct {
+		Hosts        []string             `json:"hosts"`
+		SerialNumber string               `json:"serialnumber"`
+		Key          *api.BasicKeyRequest `json:"key"`
+	} `json:"csr"`
+	// Output is the msp directory of the identity, relative to the client's
+	// home directory; it defaults to the enrollment ID
+	Output string `json:"output"`
+}
+
+// batchResult is the result of a row in the report of enroll-batch
+type batchResult struct {
+	// Row is the number of the row in the manifest, starting at 1
+	Row    int    `json:"row"`
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	MSPDir string `json:"mspdir,omitempty"`
+	Serial string `json:"serial,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// batchReport is the report of enroll-batch
+type batchReport struct {
+	Total    int           `json:"total"`
+	Enrolled int           `json:"enrolled"`
+	Skipped  int           `json:"skipped"`
+	Failed   int           `json:"failed"`
+	Results  []batchResult `json:"results"`
+}
+
+func newEnrollBatchCmd(c Command) *enrollBatchCmd {
+	return &enrollBatchCmd{Command: c}
+}
+
+func (c *enrollBatchCmd) getCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   EnrollBatchCmdUsage,
+		Short: EnrollBatchCmdShortDesc,
+		Long: "Enroll the identities listed in a JSON or CSV manifest, each into its own msp directory, concurrently, " +
+			"and write a JSON report of the result of each identity; a failed enrollment does not stop the others",
+		Example: "fabric-ca-client enroll-batch -u http://localhost:7054 --manifest identities.csv --report report.json --resume",
+		PreRunE: c.preRunEnrollBatch,
+		RunE:    c.runEnrollBatch,
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&c.manifest, "manifest", "", "JSON or CSV file listing the identities to enroll")
+	flags.IntVar(&c.workers, "workers", 4, "Number of enrollments performed concurrently")
+	flags.StringVar(&c.report, "report", "", "File to which the JSON report is written; it is written to stdout if not set")
+	flags.BoolVar(&c.resume, "resume", false, "Skip the identities whose msp directory already has a valid enrollment certificate")
+	return cmd
+}
+
+func (c *enrollBatchCmd) preRunEnrollBatch(cmd *cobra.Command, args []string) error {
+	if len(args) > 0 {
+		return errors.Errorf(extraArgsError, args, cmd.UsageString())
+	}
+	if c.manifest == "" {
+		return errors.New("The --manifest flag is required")
+	}
+	if c.workers < 1 {
+		return errors.Errorf("Invalid number of workers %d; it must be at least 1", c.workers)
+	}
+	err := c.ConfigInit()
+	if err != nil {
+		return err
+	}
+	log.Debugf("Client configuration settings: %+v", c.GetClientCfg())
+	return nil
+}
+
+func (c *enrollBatchCmd) runEnrollBatch(cmd *cobra.Command, args []string) error {
+	log.Debug("Entered runEnrollBatch")
+	rows, err := readBatchManifest(c.manifest)
+	if err != nil {
+		return err
+	}
+	cfg := c.GetClientCfg()
+	serverURL, err := url.Parse(cfg.URL)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid server URL '%s'", cfg.URL)
+	}
+	serverURL.User = nil
+	homeDir := filepath.Dir(c.GetCfgFileName())
+	passphrase := c.batchKeyPassphrase()
+	// The enrollments of the rows share the connections of a client whose
+	// keys are kept in memory
+	connCfg := batchRowConfig(c.GetClientCfg(), &batchRow{}, homeDir)
+	connCfg.MSPDir = ""
+	conns, err := caclient.New(&caclient.Config{ClientConfig: connCfg, HomeDir: homeDir})
+	if err != nil {
+		return err
+	}
+
+	results := make([]batchResult, len(rows))
+	outputs := map[string]int{}
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < c.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				results[i] = c.enrollRow(&rows[i], *serverURL, homeDir, passphrase, conns)
+				results[i].Row = i + 1
+			}
+		}()
+	}
+	for i := range rows {
+		if rows[i].Output == "" {
+			rows[i].Output = rows[i].ID
+		}
+		// Two rows may not share an msp directory
+		out := filepath.Clean(rows[i].Output)
+		if prev, ok := outputs[out]; ok {
+			results[i] = batchResult{Row: i + 1, ID: rows[i].ID, Status: batchFailed,
+				Error: fmt.Sprintf("The output '%s' is also the output of row %d", rows[i].Output, prev)}
+			continue
+		}
+		outputs[out] = i + 1
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	report := batchReport{Total: len(rows), Results: results}
+	for _, res := range results {
+		switch res.Status {
+		case batchEnrolled:
+			report.Enrolled++
+		case batchSkipped:
+			report.Skipped++
+		default:
+			report.Failed++
+		}
+	}
+	err = c.writeBatchReport(&report)
+	if err != nil {
+		return err
+	}
+	if report.Failed > 0 {
+		return errors.Errorf("%d of the %d enrollments of the manifest failed", report.Failed, report.Total)
+	}
+	return nil
+}
+
+// enrollRow enrolls the identity of 'row' into its msp directory over the
+// connections of 'conns', or skips it if --resume is set and the msp
+// directory already has a valid enrollment
+func (c *enrollBatchCmd) enrollRow(row *batchRow, serverURL url.URL, homeDir string, passphrase func(bool) ([]byte, error),
+	conns *caclient.Client) batchResult {
+	res := batchResult{ID: row.ID, Status: batchFailed}
+	fail := func(err error) batchResult {
+		res.Error = err.Error()
+		log.Errorf("Failed to enroll '%s': %s", row.ID, err)
+		return res
+	}
+	if row.ID == "" {
+		return fail(errors.New("The row has no enrollment ID"))
+	}
+	out := filepath.Clean(row.Output)
+	if filepath.IsAbs(out) || out == ".." || strings.HasPrefix(out, ".."+string(filepath.Separator)) {
+		return fail(errors.Errorf("The output '%s' must be a directory within the home directory", row.Output))
+	}
+	cfg := batchRowConfig(c.GetClientCfg(), row, homeDir)
+	res.MSPDir = cfg.MSPDir
+
+	if c.resume {
+		serial, err := verifyBatchEnrollment(cfg, row.ID, homeDir, passphrase)
+		if err == nil {
+			log.Infof("Skipping '%s', which is already enrolled in %s", row.ID, cfg.MSPDir)
+			res.Status = batchSkipped
+			res.Serial = serial
+			return res
+		}
+		log.Debugf("Enrolling '%s' again: %s", row.ID, err)
+	}
+	if row.Secret == "" {
+		return fail(errors.New("The row has no enrollment secret"))
+	}
+	serverURL.User = url.UserPassword(row.ID, row.Secret)
+	err := cfg.SetEnrollmentURL(serverURL.String())
+	if err != nil {
+		return fail(err)
+	}
+	cl, err := caclient.New(&caclient.Config{ClientConfig: cfg, HomeDir: homeDir, KeyPassphrase: passphrase, Connections: conns})
+	if err != nil {
+		return fail(err)
+	}
+	resp, err := cl.Enroll(c.GetContext(), &cfg.Enrollment)
+	if err != nil {
+		return fail(err)
+	}
+	err = storeEnrollment(cfg, resp)
+	if err != nil {
+		return fail(err)
+	}
+	res.Status = batchEnrolled
+	res.Serial = util.GetSerialAsHex(resp.Identity.GetECert().GetX509Cert().SerialNumber)
+	log.Infof("Enrolled '%s' in %s", row.ID, cfg.MSPDir)
+	return res
+}
+
+// batchRowConfig returns a copy of the configuration 'cfg' for the enrollment
+// of 'row', which the enrollment of another row can't modify
+func batchRowConfig(cfg *lib.ClientConfig, row *batchRow, homeDir string) *lib.ClientConfig {
+	rowCfg := *cfg
+	rowCfg.MSPDir = filepath.Join(homeDir, row.Output)
+	rowCfg.Enrollment.Name = ""
+	rowCfg.Enrollment.Secret = ""
+	rowCfg.TLS.CertFiles = append([]string{}, cfg.TLS.CertFiles...)
+	rowCfg.CSR.CN = row.ID
+	if row.CSR.SerialNumber != "" {
+		rowCfg.CSR.SerialNumber = row.CSR.SerialNumber
+	}
+	if row.CSR.Key != nil {
+		rowCfg.CSR.KeyRequest = row.CSR.Key
+	}
+	if len(row.CSR.Hosts) > 0 {
+		rowCfg.CSR.Hosts = row.CSR.Hosts
+	} else {
+		rowCfg.CSR.Hosts = append([]string{}, cfg.CSR.Hosts...)
+	}
+	// The keystore of each row is in its msp directory
+	if cfg.CSP != nil {
+		csp := *cfg.CSP
+		if csp.SwOpts != nil {
+			swOpts := *csp.SwOpts
+			swOpts.FileKeystore = nil
+			csp.SwOpts = &swOpts
+		}
+		rowCfg.CSP = &csp
+	} else {
+		rowCfg.CSP = &factory.FactoryOpts{}
+	}
+	return &rowCfg
+}
+
+// verifyBatchEnrollment returns the serial number of the enrollment
+// certificate in the msp directory of 'cfg' if it is the unexpired
+// certificate of 'id' and its key is in the keystore
+func verifyBatchEnrollment(cfg *lib.ClientConfig, id, homeDir string, passphrase func(bool) ([]byte, error)) (string, error) {
+	if _, err := os.Stat(filepath.Join(cfg.MSPDir, "signcerts", "cert.pem")); err != nil {
+		return "", err
+	}
+	// The configuration of the client is modified by its initialization
+	verifyCfg := *cfg
+	client := &lib.Client{HomeDir: homeDir, Config: &verifyCfg, KeyPassphrase: passphrase}
+	identity, err := client.LoadMyIdentity()
+	if err != nil {
+		return "", err
+	}
+	signer := identity.GetECert()
+	if signer == nil {
+		return "", errors.New("The msp directory has no enrollment certificate")
+	}
+	cert := signer.GetX509Cert()
+	if name := util.GetEnrollmentIDFromX509Certificate(cert); name != id {
+		return "", errors.Errorf("The enrollment certificate is the one of '%s'", name)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return "", errors.New("The enrollment certificate has expired")
+	}
+	return util.GetSerialAsHex(cert.SerialNumber), nil
+}
+
+// batchKeyPassphrase returns the function which returns the passphrase of the
+// private keys of the batch, if they are encrypted. The passphrase is prompted
+// for at most once, rather than once per identity.
+func (c *enrollBatchCmd) batchKeyPassphrase() func(bool) ([]byte, error) {
+	var once sync.Once
+	var passphrase []byte
+	var err error
+	return func(newKey bool) ([]byte, error) {
+		once.Do(func() {
+			passphrase, err = c.GetKeyPassphrase(true)
+		})
+		return passphrase, err
+	}
+}
+
+func (c *enrollBatchCmd) writeBatchReport(report *batchReport) error {
+	buf, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal the report")
+	}
+	buf = append(buf, '\n')
+	if c.report == "" {
+		_, err = os.Stdout.Write(buf)
+		return err
+	}
+	err = ioutil.WriteFile(c.report, buf, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write the report to '%s'", c.report)
+	}
+	log.Infof("Wrote the report of %d enrollments to %s", report.Total, c.report)
+	return nil
+}
+
+// readBatchManifest reads the rows of the manifest 'file', which is a JSON
+// array of rows or, if its extension is .csv, a CSV file whose first line
+// names its columns
+func readBatchManifest(file string) ([]batchRow, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read the manifest '%s'", file)
+	}
+	var rows []batchRow
+	if strings.EqualFold(filepath.Ext(file), ".csv") {
+		rows, err = parseBatchCSV(buf)
+	} else {
+		err = json.Unmarshal(buf, &rows)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid manifest '%s'", file)
+	}
+	if len(rows) == 0 {
+		return nil, errors.Errorf("The manifest '%s' has no rows", file)
+	}
+	return rows, nil
+}
+
+// parseBatchCSV parses a CSV manifest; the hosts column is a list of
+// space-separated host names, and the keyalgo and keysize columns are the
+// key request of the CSR
+func parseBatchCSV(buf []byte) ([]batchRow, error) {
+	r := csv.NewReader(bytes.NewReader(buf))
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read the header of the CSV manifest")
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !util.StrContained(name, batchCSVColumns) {
+			return nil, errors.Errorf("Unknown column '%s'; the columns are: %s", name, strings.Join(batchCSVColumns, ", "))
+		}
+		columns[name] = i
+	}
+	if _, ok := columns["id"]; !ok {
+		return nil, errors.New("The CSV manifest has no 'id' column")
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	var rows []batchRow
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read the CSV manifest")
+		}
+		row := batchRow{ID: field(record, "id"), Secret: field(record, "secret"), Output: field(record, "output")}
+		row.CSR.Hosts = strings.Fields(field(record, "hosts"))
+		row.CSR.SerialNumber = field(record, "serialnumber")
+		if algo, size := field(record, "keyalgo"), field(record, "keysize"); algo != "" || size != "" {
+			row.CSR.Key = &api.BasicKeyRequest{Algo: algo}
+			if size != "" {
+				row.CSR.Key.Size, err = strconv.Atoi(size)
+				if err != nil {
+					return nil, errors.Errorf("Invalid key size '%s' on line %d", size, len(rows)+2)
+				}
+			}
+		}
+		rows = append(rows, row)
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package command
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func readBatchReport(t *testing.T, file string) *batchReport {
+	buf, err := ioutil.ReadFile(file)
+	util.FatalError(t, err, "Failed to read the report")
+	report := &batchReport{}
+	err = json.Unmarshal(buf, report)
+	util.FatalError(t, err, "Failed to parse the report")
+	return report
+}
+
+func batchStatuses(report *batchReport) []string {
+	statuses := []string{}
+	for _, res := range report.Results {
+		statuses = append(statuses, res.ID+":"+res.Status)
+	}
+	return statuses
+}
+
+func TestEnrollBatch(t *testing.T) {
+	homeDir, err := ioutil.TempDir("", "enrollbatch")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(homeDir)
+	adminHome := filepath.Join(homeDir, "admin")
+	srv := setupEnrollTest(t)
+	defer stopAndCleanupServer(t, srv)
+
+	err = RunMain([]string{cmdName, "enroll", "-u", enrollURL, "-H", adminHome})
+	util.FatalError(t, err, "Failed to enroll the registrar")
+	for _, id := range []string{"device1", "device2", "device3", "device4"} {
+		err = RunMain([]string{cmdName, "register", "-u", serverURL, "-H", adminHome, "--id.name", id, "--id.secret", id + "pw"})
+		util.FatalError(t, err, "Failed to register %s", id)
+	}
+
+	manifest := filepath.Join(homeDir, "manifest.json")
+	err = ioutil.WriteFile(manifest, []byte(`[
+  {"id": "device1", "secret": "device1pw"},
+  {"id": "device2", "secret": "device2pw", "csr": {"hosts": ["sensor2.example.com"], "key": {"algo": "ecdsa", "size": 384}}, "output": "sensors/2"},
+  {"id": "device3", "secret": "wrongpw"},
+  {"id": "device4"},
+  {"id": "device5", "secret": "device5pw", "output": "../escaped"},
+  {"id": "device6", "secret": "device6pw", "output": "device1"},
+  {"secret": "nobodypw", "output": "nobody"}
+]`), 0644)
+	util.FatalError(t, err, "Failed to write the manifest")
+	reportFile := filepath.Join(homeDir, "report.json")
+	err = RunMain([]string{cmdName, "enroll-batch", "-u", serverURL, "-H", homeDir,
+		"--manifest", manifest, "--workers", "3", "--report", reportFile})
+	util.ErrorContains(t, err, "5 of the 7 enrollments", "The failed rows should fail the command")
+
+	report := readBatchReport(t, reportFile)
+	assert.Equal(t, 7, report.Total)
+	assert.Equal(t, 2, report.Enrolled)
+	assert.Equal(t, 5, report.Failed)
+	assert.Equal(t, []string{"device1:enrolled", "device2:enrolled", "device3:failed", "device4:failed",
+		"device5:failed", "device6:failed", ":failed"}, batchStatuses(report))
+	for i, res := range report.Results {
+		assert.Equal(t, i+1, res.Row)
+		if res.Status == batchFailed {
+			assert.NotEmpty(t, res.Error, "The error of row %d should be reported", res.Row)
+		}
+	}
+	assert.NotEmpty(t, report.Results[0].Serial)
+	assert.Equal(t, filepath.Join(homeDir, "device1"), report.Results[0].MSPDir)
+
+	cert, err := util.GetX509CertificateFromPEMFile(filepath.Join(homeDir, "sensors", "2", "signcerts", "cert.pem"))
+	util.FatalError(t, err, "The certificate of device2 should be stored in its output directory")
+	assert.Equal(t, "device2", cert.Subject.CommonName)
+	assert.Equal(t, []string{"sensor2.example.com"}, cert.DNSNames, "The CSR of the row should override the configuration")
+	if pub, ok := cert.PublicKey.(*ecdsa.PublicKey); assert.True(t, ok) {
+		assert.Equal(t, 384, pub.Curve.Params().BitSize, "The key request of the row should be used")
+	}
+	assert.Contains(t, mspTree(t, filepath.Join(homeDir, "device1")), "keystore/<ski>_sk")
+	_, err = os.Stat(filepath.Join(homeDir, "..", "escaped"))
+	assert.True(t, os.IsNotExist(err), "No directory should be created outside of the home directory")
+
+	// With --resume, the rows which are already enrolled are skipped
+	csvManifest := filepath.Join(homeDir, "manifest.csv")
+	err = ioutil.WriteFile(csvManifest, []byte("id,secret,hosts,output\n"+
+		"device1,,,\n"+
+		"device2,device2pw,sensor2.example.com,sensors/2\n"+
+		"device3,device3pw,,\n"+
+		"device4,device4pw,host1 host2,\n"), 0644)
+	util.FatalError(t, err, "Failed to write the manifest")
+	stdout, err := captureStdout(t, func() error {
+		return RunMain([]string{cmdName, "enroll-batch", "-u", serverURL, "-H", homeDir, "--manifest", csvManifest, "--resume"})
+	})
+	util.FatalError(t, err, "Failed to resume the batch")
+	report = &batchReport{}
+	err = json.Unmarshal([]byte(stdout), report)
+	util.FatalError(t, err, "The report should be written to stdout")
+	assert.Equal(t, []string{"device1:skipped", "device2:skipped", "device3:enrolled", "device4:enrolled"}, batchStatuses(report))
+	cert, err = util.GetX509CertificateFromPEMFile(filepath.Join(homeDir, "device4", "signcerts", "cert.pem"))
+	util.FatalError(t, err, "The certificate of device4 should be stored")
+	assert.Equal(t, []string{"host1", "host2"}, cert.DNSNames)
+
+	// A row whose certificate is not the one of its identity is enrolled again
+	err = os.Rename(filepath.Join(homeDir, "device3"), filepath.Join(homeDir, "device3.old"))
+	util.FatalError(t, err, "Failed to move the msp directory")
+	err = os.Rename(filepath.Join(homeDir, "device4"), filepath.Join(homeDir, "device3"))
+	util.FatalError(t, err, "Failed to move the msp directory")
+	stdout, err = captureStdout(t, func() error {
+		return RunMain([]string{cmdName, "enroll-batch", "-u", serverURL, "-H", homeDir, "--manifest", csvManifest, "--resume", "--workers", "1"})
+	})
+	util.FatalError(t, err, "Failed to resume the batch")
+	report = &batchReport{}
+	err = json.Unmarshal([]byte(stdout), report)
+	util.FatalError(t, err, "Failed to parse the report")
+	assert.Equal(t, []string{"device1:skipped", "device2:skipped", "device3:enrolled", "device4:enrolled"}, batchStatuses(report))
+}
+
+func TestReadBatchManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batchmanifest")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(dir)
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		err := ioutil.WriteFile(file, []byte(content), 0644)
+		util.FatalError(t, err, "Failed to write the manifest")
+		return file
+	}
+
+	rows, err := readBatchManifest(write("m.csv", "ID, Secret, Hosts, KeyAlgo, KeySize\nuser1,pw1,\"a.example.com b.example.com\",ecdsa,384\nuser2,pw2,,,\n"))
+	if assert.NoError(t, err) && assert.Len(t, rows, 2) {
+		assert.Equal(t, "user1", rows[0].ID)
+		assert.Equal(t, "pw1", rows[0].Secret)
+		assert.Equal(t, []string{"a.example.com", "b.example.com"}, rows[0].CSR.Hosts)
+		assert.Equal(t, &api.BasicKeyRequest{Algo: "ecdsa", Size: 384}, rows[0].CSR.Key)
+		assert.Nil(t, rows[1].CSR.Key)
+	}
+	_, err = readBatchManifest(write("size.csv", "id,keysize\nuser1,big\n"))
+	util.ErrorContains(t, err, "Invalid key size 'big' on line 2", "An invalid key size should fail")
+	_, err = readBatchManifest(write("unknown.csv", "id,password\nuser1,pw1\n"))
+	util.ErrorContains(t, err, "Unknown column 'password'", "An unknown column should fail")
+	_, err = readBatchManifest(write("noid.csv", "secret\npw1\n"))
+	util.ErrorContains(t, err, "no 'id' column", "A CSV manifest needs an id column")
+	_, err = readBatchManifest(write("empty.json", "[]"))
+	util.ErrorContains(t, err, "has no rows", "An empty manifest should fail")
+	_, err = readBatchManifest(write("bad.json", "{"))
+	util.ErrorContains(t, err, "Invalid manifest", "A malformed manifest should fail")
+	_, err = readBatchManifest(filepath.Join(dir, "nosuchfile.json"))
+	assert.Error(t, err)
+
+	err = RunMain([]string{cmdName, "enroll-batch", "-H", dir})
+	util.ErrorContains(t, err, "--manifest flag is required", "The manifest is required")
+	err = RunMain([]string{cmdName, "enroll-batch", "-H", dir, "--manifest", "m.json", "--workers", "0"})
+	util.ErrorContains(t, err, "Invalid number of workers", "At least one worker is required")
+}
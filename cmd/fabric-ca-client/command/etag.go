@@ -0,0 +1,48 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package command
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/util"
+)
+
+// etagsFolder is the MSP folder in which the ETags of the stored CA chain
+// and CRL are kept, so that they are only downloaded again when changed
+const etagsFolder = ".etags"
+
+// readETag returns the ETag stored under the name 'name' in the msp
+// directory 'mspDir', or an empty string if there is none
+func readETag(mspDir, name string) string {
+	etag, err := ioutil.ReadFile(filepath.Join(mspDir, etagsFolder, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(etag))
+}
+
+// storeETag stores the ETag 'etag' under the name 'name' in the msp
+// directory 'mspDir', or removes the stored one if 'etag' is empty. A failure
+// is only logged, since the next request then downloads the file again.
+func storeETag(mspDir, name, etag string) {
+	file := filepath.Join(mspDir, etagsFolder, name)
+	if etag == "" {
+		os.Remove(file)
+		return
+	}
+	err := util.WriteFileAtomic(file, []byte(etag+"\n"), 0644)
+	if err != nil {
+		log.Warningf("Failed to store the ETag at '%s': %s", file, err)
+		return
+	}
+	log.Debugf("Stored the ETag %s at %s", etag, file)
+}
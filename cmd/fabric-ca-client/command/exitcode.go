@@ -0,0 +1,276 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+
+	cfsslapi "github.com/cloudflare/cfssl/api"
+	"github.com/hyperledger/fabric-ca/lib"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// The exit codes of the client, which distinguish why a command failed
+const (
+	// ExitCodeFailure is the exit code of any failure other than the following
+	ExitCodeFailure = 1
+	// ExitCodeAuthFailure is the exit code when the server could not
+	// authenticate the caller, such as when the enrollment secret is wrong
+	ExitCodeAuthFailure = 2
+	// ExitCodeNetworkFailure is the exit code when the request could not be
+	// sent to the server or its response could not be received
+	ExitCodeNetworkFailure = 3
+	// ExitCodeRejected is the exit code when the server rejected the request
+	// for any reason other than authentication or authorization
+	ExitCodeRejected = 4
+	// ExitCodeTimeout is the exit code when the server did not respond within
+	// the request timeout, or the request did not complete within its deadline
+	ExitCodeTimeout = 5
+	// ExitCodeProxyFailure is the exit code when the request could not be
+	// sent through the proxy, such as when the proxy refused the connection
+	ExitCodeProxyFailure = 6
+	// ExitCodeAuthorizationFailure is the exit code when the server
+	// authenticated the caller but did not authorize the request
+	ExitCodeAuthorizationFailure = 7
+	// ExitCodeServerError is the exit code when the server failed to process
+	// the request, such as when its database is not available
+	ExitCodeServerError = 8
+	// ExitCodeUsage is the exit code when the command line or configuration of
+	// the command is invalid, which is detected before any request is sent
+	ExitCodeUsage = 9
+	// ExitCodeCanceled is the exit code when the command was interrupted,
+	// which by convention is 128 plus the number of SIGINT
+	ExitCodeCanceled = 130
+)
+
+// exitCodeClasses are the names of the exit codes in the JSON error output
+var exitCodeClasses = map[int]string{
+	ExitCodeFailure:              "failure",
+	ExitCodeAuthFailure:          "authentication_failure",
+	ExitCodeNetworkFailure:       "network_failure",
+	ExitCodeRejected:             "rejected",
+	ExitCodeTimeout:              "timeout",
+	ExitCodeProxyFailure:         "proxy_failure",
+	ExitCodeAuthorizationFailure: "authorization_failure",
+	ExitCodeServerError:          "server_error",
+	ExitCodeUsage:                "usage",
+	ExitCodeCanceled:             "canceled",
+}
+
+// authenticationErrorCodes are the error codes of the server which mean that
+// it could not authenticate the caller
+var authenticationErrorCodes = map[int]bool{
+	caerrors.ErrNoAuthHdr:                true,
+	caerrors.ErrBadReqToken:              true,
+	caerrors.ErrAuthenticationFailure:    true,
+	caerrors.ErrNoUserPass:               true,
+	caerrors.ErrInvalidUser:              true,
+	caerrors.ErrInvalidPass:              true,
+	caerrors.ErrInvalidToken:             true,
+	caerrors.ErrUntrustedCertificate:     true,
+	caerrors.ErrCertExpired:              true,
+	caerrors.ErrCertRevoked:              true,
+	caerrors.ErrCallerIsNotAuthenticated: true,
+	caerrors.ErrRevokedID:                true,
+}
+
+// authorizationErrorCodes are the error codes of the server which mean that
+// it authenticated the caller but did not authorize the request. Some of them
+// are returned with the status code 401 rather than 403.
+var authorizationErrorCodes = map[int]bool{
+	caerrors.ErrNotRevoker:             true,
+	caerrors.ErrCertWrongOwner:         true,
+	caerrors.ErrRevokerNotAffiliated:   true,
+	caerrors.ErrNoGenCRLAuth:           true,
+	caerrors.ErrRegAttrAuth:            true,
+	caerrors.ErrCallerNotAffiliated:    true,
+	caerrors.ErrNoCrlSignAuth:          true,
+	caerrors.ErrUpdateConfigAuth:       true,
+	caerrors.ErrRegistrarInvalidType:   true,
+	caerrors.ErrRegistrarNotAffiliated: true,
+	caerrors.ErrMissingRole:            true,
+	caerrors.ErrAuthorizationFailure:   true,
+	caerrors.ErrNoAdminAuth:            true,
+}
+
+// ExitCode returns the exit code of the client for the error returned by
+// RunMain. It is the one mapping of errors to exit codes of all commands.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if isUsageError(err) {
+		return ExitCodeUsage
+	}
+	cause := errors.Cause(err)
+	if cause == context.Canceled {
+		return ExitCodeCanceled
+	}
+	switch cause := cause.(type) {
+	case *lib.ResponseError:
+		return responseExitCode(cause)
+	case *lib.TimeoutError:
+		return ExitCodeTimeout
+	case *lib.ProxyError:
+		return ExitCodeProxyFailure
+	case net.Error:
+		return ExitCodeNetworkFailure
+	}
+	return ExitCodeFailure
+}
+
+// responseExitCode returns the exit code for the error response 're' of the
+// server, from the error codes in its body or else from its status code
+func responseExitCode(re *lib.ResponseError) int {
+	for _, e := range re.Errors {
+		if authorizationErrorCodes[e.Code] {
+			return ExitCodeAuthorizationFailure
+		}
+	}
+	for _, e := range re.Errors {
+		if authenticationErrorCodes[e.Code] {
+			return ExitCodeAuthFailure
+		}
+	}
+	switch {
+	case re.IsAuthFailure():
+		return ExitCodeAuthFailure
+	case re.IsAuthorizationFailure():
+		return ExitCodeAuthorizationFailure
+	case re.StatusCode >= 500:
+		return ExitCodeServerError
+	}
+	return ExitCodeRejected
+}
+
+// usageError is an error in the command line or configuration of a command
+type usageError struct {
+	err error
+}
+
+// newUsageError returns 'err' as an error in the command line or
+// configuration of a command
+func newUsageError(err error) error {
+	if err == nil || isUsageError(err) {
+		return err
+	}
+	return &usageError{err: err}
+}
+
+func (ue *usageError) Error() string {
+	return ue.err.Error()
+}
+
+// Cause returns the error which is a usage error
+func (ue *usageError) Cause() error {
+	return ue.err
+}
+
+// isUsageError returns true if 'err' or an error which it wraps is a usage
+// error
+func isUsageError(err error) bool {
+	for err != nil {
+		if _, ok := err.(*usageError); ok {
+			return true
+		}
+		cause, ok := err.(interface {
+			Cause() error
+		})
+		if !ok {
+			return false
+		}
+		err = cause.Cause()
+	}
+	return false
+}
+
+// trackRun wraps the run functions of 'cmd' and of its subcommands so that
+// '*started' is set when one of them starts. An error returned before then,
+// such as an unknown flag or command or an error of a PreRunE function, is
+// an error in the command line or configuration.
+func trackRun(cmd *cobra.Command, started *bool) {
+	if runE := cmd.RunE; runE != nil {
+		cmd.RunE = func(cmd *cobra.Command, args []string) error {
+			*started = true
+			return runE(cmd, args)
+		}
+	}
+	if run := cmd.Run; run != nil {
+		cmd.Run = func(cmd *cobra.Command, args []string) {
+			*started = true
+			run(cmd, args)
+		}
+	}
+	for _, sub := range cmd.Commands() {
+		trackRun(sub, started)
+	}
+}
+
+const (
+	// errorFormatText writes "Error: <message>" to stderr
+	errorFormatText = "text"
+	// errorFormatJSON writes a JSON object describing the error to stderr
+	errorFormatJSON = "json"
+)
+
+// errorFormatValue is the value of the --error-format flag; a JSON error is
+// written instead of the usage and error messages of cobra
+type errorFormatValue struct {
+	format *string
+	cmd    *cobra.Command
+}
+
+func (v *errorFormatValue) String() string {
+	return *v.format
+}
+
+func (v *errorFormatValue) Set(format string) error {
+	if format != errorFormatText && format != errorFormatJSON {
+		return errors.Errorf("Invalid error format '%s'; must be '%s' or '%s'", format, errorFormatText, errorFormatJSON)
+	}
+	*v.format = format
+	v.cmd.SilenceErrors = format == errorFormatJSON
+	v.cmd.SilenceUsage = format == errorFormatJSON
+	return nil
+}
+
+func (v *errorFormatValue) Type() string {
+	return "string"
+}
+
+// jsonError is the JSON object written for an error with --error-format json
+type jsonError struct {
+	Error    string `json:"error"`
+	ExitCode int    `json:"exit_code"`
+	Class    string `json:"class"`
+	// StatusCode is the HTTP status code of the server's error response
+	StatusCode int `json:"status_code,omitempty"`
+	// ServerErrors are the errors in the body of the server's response
+	ServerErrors []cfsslapi.ResponseMessage `json:"server_errors,omitempty"`
+}
+
+// writeJSONError writes 'err' and its exit code to 'w' as a JSON object
+func writeJSONError(w io.Writer, err error) error {
+	code := ExitCode(err)
+	je := jsonError{Error: err.Error(), ExitCode: code, Class: exitCodeClasses[code]}
+	if re, ok := errors.Cause(err).(*lib.ResponseError); ok {
+		je.StatusCode = re.StatusCode
+		je.ServerErrors = re.Errors
+	}
+	buf, merr := json.Marshal(&je)
+	if merr != nil {
+		return errors.Wrap(merr, "Failed to marshal the error")
+	}
+	_, werr := fmt.Fprintf(w, "%s\n", buf)
+	return werr
+}
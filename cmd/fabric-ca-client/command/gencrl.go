@@ -14,6 +14,11 @@ limitations under the License.
 package command
 
 import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
@@ -22,6 +27,7 @@ import (
 	"github.com/cloudflare/cfssl/log"
 	"github.com/hyperledger/fabric-ca/api"
 	"github.com/hyperledger/fabric-ca/lib"
+	caclient "github.com/hyperledger/fabric-ca/lib/client"
 	"github.com/hyperledger/fabric-ca/util"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
@@ -39,6 +45,8 @@ func (c *ClientCmd) newGenCRLCommand() *cobra.Command {
 		Use:   "gencrl",
 		Short: "Generate a CRL",
 		Long:  "Generate a Certificate Revocation List",
+		Example: "fabric-ca-client gencrl --revokedafter 2018-01-01T00:00:00Z --print\n" +
+			"fabric-ca-client gencrl --out crl.der --outform der",
 		// PreRunE block for this command will load client configuration
 		// before running the command
 		PreRunE: func(cmd *cobra.Command, args []string) error {
@@ -67,11 +75,11 @@ func (c *ClientCmd) newGenCRLCommand() *cobra.Command {
 // The client register main logic
 func (c *ClientCmd) runGenCRL() error {
 	log.Debug("Entered runGenCRL")
-	client := lib.Client{
-		HomeDir: filepath.Dir(c.cfgFileName),
-		Config:  c.clientCfg,
+	cl, err := newClient(c)
+	if err != nil {
+		return err
 	}
-	id, err := client.LoadMyIdentity()
+	id, err := cl.LoadIdentity()
 	if err != nil {
 		return err
 	}
@@ -79,36 +87,39 @@ func (c *ClientCmd) runGenCRL() error {
 	if c.crlParams.RevokedAfter != "" {
 		revokedAfter, err = time.Parse(time.RFC3339, c.crlParams.RevokedAfter)
 		if err != nil {
-			return errors.Wrap(err, "Invalid 'revokedafter' value")
+			return newUsageError(errors.Wrap(err, "Invalid 'revokedafter' value"))
 		}
 	}
 	if c.crlParams.RevokedBefore != "" {
 		revokedBefore, err = time.Parse(time.RFC3339, c.crlParams.RevokedBefore)
 		if err != nil {
-			return errors.Wrap(err, "Invalid 'revokedbefore' value")
+			return newUsageError(errors.Wrap(err, "Invalid 'revokedbefore' value"))
 		}
 	}
 	if !revokedBefore.IsZero() && revokedAfter.After(revokedBefore) {
-		return errors.Errorf("Invalid revokedafter value '%s'. It must not be a timestamp greater than revokedbefore value '%s'",
-			c.crlParams.RevokedAfter, c.crlParams.RevokedBefore)
+		return newUsageError(errors.Errorf("Invalid revokedafter value '%s'. It must not be a timestamp greater than revokedbefore value '%s'",
+			c.crlParams.RevokedAfter, c.crlParams.RevokedBefore))
 	}
 
 	var expireAfter, expireBefore time.Time
 	if c.crlParams.ExpireAfter != "" {
 		expireAfter, err = time.Parse(time.RFC3339, c.crlParams.ExpireAfter)
 		if err != nil {
-			return errors.Wrap(err, "Invalid 'expireafter' value")
+			return newUsageError(errors.Wrap(err, "Invalid 'expireafter' value"))
 		}
 	}
 	if c.crlParams.ExpireBefore != "" {
 		expireBefore, err = time.Parse(time.RFC3339, c.crlParams.ExpireBefore)
 		if err != nil {
-			return errors.Wrap(err, "Invalid 'expirebefore' value")
+			return newUsageError(errors.Wrap(err, "Invalid 'expirebefore' value"))
 		}
 	}
 	if !expireBefore.IsZero() && expireAfter.After(expireBefore) {
-		return errors.Errorf("Invalid expireafter value '%s'. It must not be a timestamp greater than expirebefore value '%s'",
-			c.crlParams.ExpireAfter, c.crlParams.ExpireBefore)
+		return newUsageError(errors.Errorf("Invalid expireafter value '%s'. It must not be a timestamp greater than expirebefore value '%s'",
+			c.crlParams.ExpireAfter, c.crlParams.ExpireBefore))
+	}
+	if c.crlParams.OutForm != "pem" && c.crlParams.OutForm != "der" {
+		return newUsageError(errors.Errorf("Invalid outform value '%s'. It must be 'pem' or 'der'", c.crlParams.OutForm))
 	}
 	req := &api.GenCRLRequest{
 		CAName:        c.clientCfg.CAName,
@@ -116,19 +127,203 @@ func (c *ClientCmd) runGenCRL() error {
 		RevokedBefore: revokedBefore,
 		ExpireAfter:   expireAfter,
 		ExpireBefore:  expireBefore,
+		PreviousKey:   c.crlParams.PreviousKey,
+	}
+	if c.crlParams.Accept != "" {
+		return c.writeCRLAs(cl, id, req)
+	}
+	// The CRL stored in the msp directory is kept if it lists the same
+	// revoked certificates, while it is still fresh
+	var stored *pkix.CertificateList
+	if c.crlParams.Out == "" {
+		stored = storedCRL(c.clientCfg.MSPDir)
+		if stored != nil {
+			req.ETag = readETag(c.clientCfg.MSPDir, crlFile)
+		}
 	}
-	resp, err := id.GenCRL(req)
+	resp, err := cl.GenCRL(c.ctx, id, req)
 	if err != nil {
 		return err
 	}
+	if resp.NotModified {
+		log.Infof("The CRL is unchanged since it was stored in %s", path.Join(c.clientCfg.MSPDir, crlsFolder, crlFile))
+		if c.crlParams.Print {
+			return printCRL(stored)
+		}
+		return nil
+	}
 	log.Info("Successfully generated the CRL")
-	err = storeCRL(c.clientCfg, resp.CRL)
+	crl, err := verifyCRL(c.clientCfg.MSPDir, resp.CRL)
+	if err != nil {
+		return err
+	}
+	if c.crlParams.Print {
+		err = printCRL(crl)
+		if err != nil {
+			return err
+		}
+	}
+	if c.crlParams.Out == "" {
+		err = storeCRL(c.clientCfg, resp.CRL)
+		if err != nil {
+			return err
+		}
+		storeETag(c.clientCfg.MSPDir, crlFile, resp.ETag)
+		return nil
+	}
+	out := resp.CRL
+	if c.crlParams.OutForm == "der" {
+		block, _ := pem.Decode(resp.CRL)
+		if block == nil {
+			return errors.New("The CRL returned by the server is not PEM-encoded")
+		}
+		out = block.Bytes
+	}
+	err = util.WriteFile(c.crlParams.Out, out, 0644)
 	if err != nil {
+		return errors.Wrapf(err, "Failed to write CRL to the file %s", c.crlParams.Out)
+	}
+	log.Infof("Successfully stored the CRL in the file %s", c.crlParams.Out)
+	return nil
+}
+
+// writeCRLAs writes the CRL returned by the server in the format of the
+// --accept flag to the --out file or to stdout, once it is verified
+func (c *ClientCmd) writeCRLAs(cl *caclient.Client, id *lib.Identity, req *api.GenCRLRequest) error {
+	format := lib.Format(c.crlParams.Accept)
+	body, err := cl.GenCRLAs(c.ctx, id, req, format)
+	if err != nil {
+		return err
+	}
+	log.Info("Successfully generated the CRL")
+	crlBytes := body
+	if format == lib.FormatJSON {
+		var result api.GenCRLResponseNet
+		err = decodeJSONResult(body, &result)
+		if err != nil {
+			return err
+		}
+		crlBytes, err = util.B64Decode(result.CRL)
+		if err != nil {
+			return err
+		}
+	}
+	crl, err := verifyCRL(c.clientCfg.MSPDir, crlBytes)
+	if err != nil {
+		return err
+	}
+	if c.crlParams.Print {
+		err = printCRL(crl)
+		if err != nil {
+			return err
+		}
+	}
+	if c.crlParams.Out == "" {
+		_, err = os.Stdout.Write(body)
 		return err
 	}
+	err = util.WriteFile(c.crlParams.Out, body, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write CRL to the file %s", c.crlParams.Out)
+	}
+	log.Infof("Successfully stored the CRL in the file %s", c.crlParams.Out)
 	return nil
 }
 
+// verifyCRL parses the PEM or DER CRL 'crlPEM' and verifies its signature
+// with the CA certificates stored in the msp directory 'mspDir', so that a
+// CRL which peers would reject is never stored
+func verifyCRL(mspDir string, crlPEM []byte) (*pkix.CertificateList, error) {
+	crl, err := x509.ParseCRL(crlPEM)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the CRL returned by the server")
+	}
+	var caCerts []*x509.Certificate
+	for _, dir := range []string{"cacerts", "intermediatecerts", "tlscacerts", "tlsintermediatecerts"} {
+		files, err := filepath.Glob(filepath.Join(mspDir, dir, "*.pem"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to list the certificates in the %s directory", dir)
+		}
+		for _, file := range files {
+			certs, err := readCertificates(file)
+			if err != nil {
+				return nil, err
+			}
+			caCerts = append(caCerts, certs...)
+		}
+	}
+	if len(caCerts) == 0 {
+		return nil, errors.Errorf("There are no CA certificates in the msp directory %s to verify the CRL with; run the getcainfo command first", mspDir)
+	}
+	for _, cert := range caCerts {
+		if cert.CheckCRLSignature(crl) == nil {
+			log.Debugf("The CRL is signed by the CA '%s'", cert.Subject)
+			return crl, nil
+		}
+	}
+	return nil, errors.Errorf("The signature of the CRL issued by '%s' does not verify with any CA certificate in the msp directory %s; the CRL was not stored",
+		crl.TBSCertList.Issuer, mspDir)
+}
+
+// readCertificates returns the certificates of the PEM-encoded file 'file'
+func readCertificates(file string) ([]*x509.Certificate, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read the CA certificate file %s", file)
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, buf = pem.Decode(buf)
+		if block == nil {
+			return certs, nil
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to parse a certificate in the CA certificate file %s", file)
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// printCRL prints the update times of 'crl' and the serial number, revocation
+// time and revocation reason of each of its revoked certificates
+func printCRL(crl *pkix.CertificateList) error {
+	tbs := crl.TBSCertList
+	fmt.Printf("Issuer: %s\n", tbs.Issuer)
+	fmt.Printf("This Update: %s\n", tbs.ThisUpdate.UTC().Format(time.RFC3339))
+	fmt.Printf("Next Update: %s\n", tbs.NextUpdate.UTC().Format(time.RFC3339))
+	fmt.Printf("Revoked Certificates: %d\n", len(tbs.RevokedCertificates))
+	for i := range tbs.RevokedCertificates {
+		entry := &tbs.RevokedCertificates[i]
+		reason, err := util.CRLEntryReason(entry)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("  Serial: %x Revoked: %s Reason: %s\n", entry.SerialNumber,
+			entry.RevocationTime.UTC().Format(time.RFC3339), util.RevocationReasonName(reason))
+	}
+	return nil
+}
+
+// storedCRL returns the CRL stored in the msp directory 'mspDir' if less than
+// half of its validity has elapsed, or nil
+func storedCRL(mspDir string) *pkix.CertificateList {
+	buf, err := ioutil.ReadFile(path.Join(mspDir, crlsFolder, crlFile))
+	if err != nil {
+		return nil
+	}
+	crl, err := x509.ParseCRL(buf)
+	if err != nil {
+		return nil
+	}
+	tbs := crl.TBSCertList
+	if time.Now().After(tbs.ThisUpdate.Add(tbs.NextUpdate.Sub(tbs.ThisUpdate) / 2)) {
+		return nil
+	}
+	return crl
+}
+
 // Store the CRL
 func storeCRL(config *lib.ClientConfig, crl []byte) error {
 	dirName := path.Join(config.MSPDir, crlsFolder)
@@ -143,6 +338,6 @@ func storeCRL(config *lib.ClientConfig, crl []byte) error {
 	if err != nil {
 		return errors.Wrapf(err, "Failed to write CRL to the file %s", fileName)
 	}
-	log.Info("Successfully stored the CRL in the file %s", fileName)
+	log.Infof("Successfully stored the CRL in the file %s", fileName)
 	return nil
 }
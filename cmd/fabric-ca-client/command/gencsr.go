@@ -27,9 +27,10 @@ import (
 func (c *ClientCmd) newGenCsrCommand() *cobra.Command {
 	// initCmd represents the init command
 	gencsrCmd := &cobra.Command{
-		Use:   "gencsr",
-		Short: "Generate a CSR",
-		Long:  "Generate a Certificate Signing Request for an identity",
+		Use:     "gencsr",
+		Short:   "Generate a CSR",
+		Long:    "Generate a Certificate Signing Request for an identity",
+		Example: "fabric-ca-client gencsr --csr.cn peer1 --csr.hosts peer1.example.com",
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			if len(args) > 0 {
 				return errors.Errorf(extraArgsError, args, cmd.UsageString())
@@ -18,7 +18,10 @@ package command
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"net/url"
@@ -32,23 +35,30 @@ import (
 	"github.com/cloudflare/cfssl/log"
 	"github.com/hyperledger/fabric-ca/api"
 	"github.com/hyperledger/fabric-ca/lib"
+	caclient "github.com/hyperledger/fabric-ca/lib/client"
+	"github.com/hyperledger/fabric-ca/lib/common"
 	"github.com/hyperledger/fabric-ca/util"
 	"github.com/spf13/cobra"
 )
 
 const (
 	// GetCAInfoCmdUsage is the usage text for getCACert command
-	GetCAInfoCmdUsage = "getcainfo -u http://serverAddr:serverPort -M <MSP-directory>"
+	GetCAInfoCmdUsage = "getcainfo -u http://serverAddr:serverPort -M <MSP-directory> [--fingerprint <SHA-256 of root CA certificate>]"
 	// GetCAInfoCmdShortDesc is the short description for getCACert command
 	GetCAInfoCmdShortDesc = "Get CA certificate chain and Idemix public key"
 )
 
 type getCAInfoCmd struct {
 	Command
+	// fingerprint is the expected SHA-256 fingerprint of the root CA certificate
+	fingerprint string
+	// accept is the format in which the CA chain is requested and written
+	// to stdout rather than stored
+	accept string
 }
 
 func newGetCAInfoCmd(c Command) *getCAInfoCmd {
-	getcacertcmd := &getCAInfoCmd{c}
+	getcacertcmd := &getCAInfoCmd{Command: c}
 	return getcacertcmd
 }
 
@@ -57,9 +67,14 @@ func (c *getCAInfoCmd) getCommand() *cobra.Command {
 		Use:     GetCAInfoCmdUsage,
 		Short:   GetCAInfoCmdShortDesc,
 		Aliases: []string{"getcacert"},
+		Example: "fabric-ca-client getcainfo -u http://localhost:7054 -M msp --fingerprint <SHA-256 of root CA certificate>",
 		PreRunE: c.preRunGetCACert,
 		RunE:    c.runGetCACert,
 	}
+	cmd.Flags().StringVar(&c.fingerprint, "fingerprint", "",
+		"The hex-encoded SHA-256 fingerprint of the root CA certificate; the CA chain is not stored if the root CA certificate does not match")
+	cmd.Flags().StringVar(&c.accept, "accept", "",
+		"Format in which the server returns the CA chain, json, pem or der; the response is written to stdout as returned rather than stored")
 	return cmd
 }
 
@@ -81,29 +96,113 @@ func (c *getCAInfoCmd) preRunGetCACert(cmd *cobra.Command, args []string) error
 func (c *getCAInfoCmd) runGetCACert(cmd *cobra.Command, args []string) error {
 	log.Debug("Entered runGetCACert")
 
-	client := &lib.Client{
-		HomeDir: filepath.Dir(c.GetCfgFileName()),
-		Config:  c.GetClientCfg(),
+	cl, err := newClient(c)
+	if err != nil {
+		return err
 	}
 
 	req := &api.GetCAInfoRequest{
 		CAName: c.GetClientCfg().CAName,
 	}
 
-	si, err := client.GetCAInfo(req)
+	if c.accept != "" {
+		return c.printCACertAs(cl, req)
+	}
+
+	// The CA information is only downloaded again if it has changed since it
+	// was stored, unless the root certificate is to be checked or printed
+	cfg := c.GetClientCfg()
+	files := c.GetOutputFormat() == outputFormatFiles
+	etagName, err := caInfoETagName(cfg)
+	if err != nil {
+		return err
+	}
+	if files && c.fingerprint == "" && util.FileExists(rootCACertPath(cfg, etagName)) {
+		req.ETag = readETag(cfg.MSPDir, etagName)
+	}
+
+	// The CA chain is verified, so nothing is stored unless it is valid and,
+	// if a fingerprint was specified, its root certificate is the expected one
+	si, err := cl.GetCACert(c.GetContext(), req)
 	if err != nil {
 		return err
 	}
+	if si.NotModified {
+		log.Infof("The CA information is unchanged since it was stored in %s", cfg.MSPDir)
+		return nil
+	}
+	if c.fingerprint != "" {
+		err = checkRootFingerprint(si.CAChain, c.fingerprint)
+		if err != nil {
+			return err
+		}
+	}
 
-	err = storeCAChain(client.Config, si)
+	if !files {
+		return printCAChain(c.GetOutputFormat(), si.CAChain)
+	}
+	err = storeCAChain(cfg, si)
 	if err != nil {
 		return err
 	}
-	err = storeIssuerPublicKey(client.Config, si)
+	err = storeIssuerPublicKey(cfg, si)
 	if err != nil {
 		return err
 	}
-	return storeIssuerRevocationPublicKey(client.Config, si)
+	err = storeIssuerRevocationPublicKey(cfg, si)
+	if err != nil {
+		return err
+	}
+	storeETag(cfg.MSPDir, etagName, si.ETag)
+	return nil
+}
+
+// printCACertAs writes the CA chain returned by the server in the format of
+// the --accept flag to stdout, once its root certificate is checked if a
+// fingerprint was specified
+func (c *getCAInfoCmd) printCACertAs(cl *caclient.Client, req *api.GetCAInfoRequest) error {
+	format := lib.Format(c.accept)
+	body, err := cl.GetCACertAs(c.GetContext(), req, format)
+	if err != nil {
+		return err
+	}
+	if c.fingerprint != "" {
+		var chain []byte
+		switch format {
+		case lib.FormatJSON:
+			var si common.CAInfoResponseNet
+			err = decodeJSONResult(body, &si)
+			if err == nil {
+				chain, err = util.B64Decode(si.CAChain)
+			}
+		case lib.FormatDER:
+			chain = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: body})
+		default:
+			chain = body
+		}
+		if err != nil {
+			return err
+		}
+		err = checkRootFingerprint(chain, c.fingerprint)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = os.Stdout.Write(body)
+	return err
+}
+
+// decodeJSONResult decodes the result of the JSON response 'body' of the
+// server into 'result'
+func decodeJSONResult(body []byte, result interface{}) error {
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+	}
+	err := json.Unmarshal(body, &resp)
+	if err == nil {
+		err = json.Unmarshal(resp.Result, result)
+	}
+	return errors.Wrap(err, "Failed to parse the JSON response of the server")
 }
 
 // Store the CAChain in the CACerts folder of MSP (Membership Service Provider)
@@ -111,17 +210,10 @@ func (c *getCAInfoCmd) runGetCACert(cmd *cobra.Command, args []string) error {
 // The others (if any) go into the MSP 'intermediatecerts' directory.
 func storeCAChain(config *lib.ClientConfig, si *lib.GetCAInfoResponse) error {
 	mspDir := config.MSPDir
-	// Get a unique name to use for filenames
-	serverURL, err := url.Parse(config.URL)
+	fname, err := caChainFileName(config)
 	if err != nil {
 		return err
 	}
-	fname := serverURL.Host
-	if config.CAName != "" {
-		fname = fmt.Sprintf("%s-%s", fname, config.CAName)
-	}
-	fname = strings.Replace(fname, ":", "-", -1)
-	fname = strings.Replace(fname, ".", "-", -1) + ".pem"
 	tlsfname := fmt.Sprintf("tls-%s", fname)
 
 	rootCACertsDir := path.Join(mspDir, "cacerts")
@@ -191,6 +283,78 @@ func storeCAChain(config *lib.ClientConfig, si *lib.GetCAInfoResponse) error {
 	return nil
 }
 
+// caChainFileName returns the name of the files in which the CA chain of the
+// CA of 'config' is stored, which is unique to its server and CA name
+func caChainFileName(config *lib.ClientConfig) (string, error) {
+	serverURL, err := url.Parse(config.URL)
+	if err != nil {
+		return "", err
+	}
+	fname := serverURL.Host
+	if fname == "" {
+		// The URL of a Unix domain socket has no host, so use the socket's name
+		fname = filepath.Base(serverURL.Path)
+	}
+	if config.CAName != "" {
+		fname = fmt.Sprintf("%s-%s", fname, config.CAName)
+	}
+	fname = strings.Replace(fname, ":", "-", -1)
+	return strings.Replace(fname, ".", "-", -1) + ".pem", nil
+}
+
+// caInfoETagName returns the name under which the ETag of the CA information
+// of the CA of 'config' is stored, which is that of the stored root CA
+// certificate file
+func caInfoETagName(config *lib.ClientConfig) (string, error) {
+	fname, err := caChainFileName(config)
+	if err != nil {
+		return "", err
+	}
+	if config.Enrollment.Profile == "tls" {
+		fname = "tls-" + fname
+	}
+	return fname, nil
+}
+
+// rootCACertPath returns the path of the root CA certificate file 'fname' of
+// the msp directory of 'config'
+func rootCACertPath(config *lib.ClientConfig, fname string) string {
+	if config.Enrollment.Profile == "tls" {
+		return path.Join(config.MSPDir, "tlscacerts", fname)
+	}
+	return path.Join(config.MSPDir, "cacerts", fname)
+}
+
+// checkRootFingerprint returns an error unless the SHA-256 fingerprint of a
+// root certificate of the CA chain is 'fingerprint', which is hex-encoded and
+// may be separated by colons
+func checkRootFingerprint(chain []byte, fingerprint string) error {
+	expected := strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+	var found []string
+	for len(chain) > 0 {
+		var block *pem.Block
+		block, chain = pem.Decode(chain)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return errors.Wrap(err, "Failed to parse certificate in the CA chain")
+		}
+		if len(cert.AuthorityKeyId) != 0 && !bytes.Equal(cert.AuthorityKeyId, cert.SubjectKeyId) {
+			continue
+		}
+		sum := sha256.Sum256(cert.Raw)
+		actual := hex.EncodeToString(sum[:])
+		if actual == expected {
+			return nil
+		}
+		found = append(found, actual)
+	}
+	return errors.Errorf("The fingerprint of the root CA certificate does not match '%s'; the CA chain has root certificates with fingerprints: %s",
+		fingerprint, strings.Join(found, ", "))
+}
+
 func storeIssuerPublicKey(config *lib.ClientConfig, si *lib.GetCAInfoResponse) error {
 	if len(si.IssuerPublicKey) > 0 {
 		err := storeToFile("Issuer public key", config.MSPDir, "IssuerPublicKey", si.IssuerPublicKey)
@@ -217,7 +381,7 @@ func storeToFile(what, dir, fname string, contents []byte) error {
 		return errors.Wrapf(err, "Failed to create directory for %s at '%s'", what, dir)
 	}
 	fpath := path.Join(dir, fname)
-	err = util.WriteFile(fpath, contents, 0644)
+	err = util.WriteFileAtomic(fpath, contents, 0644)
 	if err != nil {
 		return errors.WithMessage(err, fmt.Sprintf("Failed to store %s at '%s'", what, fpath))
 	}
@@ -17,11 +17,27 @@ limitations under the License.
 package command
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/hyperledger/fabric-ca/cmd/fabric-ca-client/command/mocks"
 	"github.com/hyperledger/fabric-ca/lib"
+	"github.com/hyperledger/fabric-ca/util"
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
@@ -74,3 +90,193 @@ func TestGoodConfigPreRunGetCACert(t *testing.T) {
 	err := getcacertCmd.preRunGetCACert(cobraCmd, []string{})
 	assert.NoError(t, err)
 }
+
+func TestGetCACertFingerprint(t *testing.T) {
+	mspDir, err := ioutil.TempDir("", "getcacertmsp")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(mspDir)
+	srv := setupEnrollTest(t)
+	defer stopAndCleanupServer(t, srv)
+
+	caCert, err := ioutil.ReadFile(filepath.Join(srv.HomeDir, "ca-cert.pem"))
+	util.FatalError(t, err, "Failed to read the CA certificate")
+	block, _ := pem.Decode(caCert)
+	sum := sha256.Sum256(block.Bytes)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	// Nothing is stored if the root certificate is not the expected one
+	err = RunMain([]string{cmdName, "getcacert", "-u", serverURL, "-M", mspDir, "--fingerprint", strings.Repeat("ab", sha256.Size)})
+	if assert.Error(t, err, "A fingerprint which does not match should fail") {
+		assert.Contains(t, err.Error(), fingerprint, "The error should include the fingerprint of the root certificate")
+	}
+	assert.False(t, util.FileExists(filepath.Join(mspDir, "cacerts", "localhost-7090.pem")), "The CA chain should not be stored")
+
+	// The fingerprint may be in upper case and separated by colons
+	var pairs []string
+	for i := 0; i < len(fingerprint); i += 2 {
+		pairs = append(pairs, strings.ToUpper(fingerprint[i:i+2]))
+	}
+	err = RunMain([]string{cmdName, "getcacert", "-u", serverURL, "-M", mspDir, "--fingerprint", strings.Join(pairs, ":")})
+	util.FatalError(t, err, "Failed to get the CA chain with a matching fingerprint")
+	stored, err := ioutil.ReadFile(filepath.Join(mspDir, "cacerts", "localhost-7090.pem"))
+	util.FatalError(t, err, "The root certificate should be stored")
+	assert.Equal(t, block.Bytes, decodeCert(t, stored).Raw)
+	assert.False(t, util.FileExists(filepath.Join(mspDir, "intermediatecerts")), "A single-certificate chain has no intermediate certificates")
+}
+
+func TestGetCACertAccept(t *testing.T) {
+	mspDir, err := ioutil.TempDir("", "getcacertaccept")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(mspDir)
+	srv := setupEnrollTest(t)
+	defer stopAndCleanupServer(t, srv)
+
+	caCert, err := ioutil.ReadFile(filepath.Join(srv.HomeDir, "ca-cert.pem"))
+	util.FatalError(t, err, "Failed to read the CA certificate")
+	block, _ := pem.Decode(caCert)
+	sum := sha256.Sum256(block.Bytes)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	for _, accept := range []string{"json", "pem", "der"} {
+		out, err := captureStdout(t, func() error {
+			return RunMain([]string{cmdName, "getcacert", "-u", serverURL, "-M", mspDir, "--accept", accept, "--fingerprint", fingerprint})
+		})
+		util.FatalError(t, err, "Failed to get the CA chain as "+accept)
+		switch accept {
+		case "json":
+			assert.Contains(t, out, `"success":true`)
+		case "pem":
+			assert.Equal(t, block.Bytes, decodeCert(t, []byte(out)).Raw)
+		case "der":
+			assert.Equal(t, block.Bytes, []byte(out))
+		}
+		_, err = captureStdout(t, func() error {
+			return RunMain([]string{cmdName, "getcacert", "-u", serverURL, "-M", mspDir, "--accept", accept, "--fingerprint", strings.Repeat("ab", sha256.Size)})
+		})
+		assert.Error(t, err, "A fingerprint which does not match should fail with --accept %s", accept)
+	}
+	assert.False(t, util.FileExists(filepath.Join(mspDir, "cacerts", "localhost-7090.pem")), "The CA chain should not be stored with --accept")
+	err = RunMain([]string{cmdName, "getcacert", "-u", serverURL, "-M", mspDir, "--accept", "txt"})
+	util.ErrorContains(t, err, "Invalid format 'txt'", "An unknown format should fail")
+}
+
+func TestStoreCAChainWithIntermediate(t *testing.T) {
+	mspDir, err := ioutil.TempDir("", "cachainmsp")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(mspDir)
+
+	root, rootKey := genTestCACert(t, "root", nil, nil)
+	intermediate, _ := genTestCACert(t, "intermediate", root, rootKey)
+	rootPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})
+	intPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: intermediate.Raw})
+	si := &lib.GetCAInfoResponse{CAChain: append(append([]byte{}, rootPEM...), intPEM...)}
+
+	err = si.VerifyCAChain()
+	assert.NoError(t, err, "A chain with an intermediate certificate should be valid")
+	sum := sha256.Sum256(root.Raw)
+	err = checkRootFingerprint(si.CAChain, hex.EncodeToString(sum[:]))
+	assert.NoError(t, err, "The fingerprint of the root certificate should match")
+	sum = sha256.Sum256(intermediate.Raw)
+	err = checkRootFingerprint(si.CAChain, hex.EncodeToString(sum[:]))
+	assert.Error(t, err, "The fingerprint of an intermediate certificate should not match")
+
+	cfg := &lib.ClientConfig{URL: "http://localhost:7054", MSPDir: mspDir}
+	err = storeCAChain(cfg, si)
+	util.FatalError(t, err, "Failed to store the CA chain")
+	stored, err := ioutil.ReadFile(filepath.Join(mspDir, "cacerts", "localhost-7054.pem"))
+	util.FatalError(t, err, "The root certificate should be stored")
+	assert.Equal(t, rootPEM, stored)
+	stored, err = ioutil.ReadFile(filepath.Join(mspDir, "intermediatecerts", "localhost-7054.pem"))
+	util.FatalError(t, err, "The intermediate certificate should be stored")
+	assert.Equal(t, intPEM, stored)
+
+	// A chain whose intermediate certificate was not issued by its root is invalid
+	other, _ := genTestCACert(t, "other", nil, nil)
+	otherPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other.Raw})
+	si = &lib.GetCAInfoResponse{CAChain: append(otherPEM, intPEM...)}
+	assert.Error(t, si.VerifyCAChain(), "An intermediate certificate without its root should fail")
+	si = &lib.GetCAInfoResponse{CAChain: intPEM}
+	assert.Error(t, si.VerifyCAChain(), "A chain without a root certificate should fail")
+}
+
+// genTestCACert generates a CA certificate and key; the certificate is
+// self-signed if 'parent' is nil
+func genTestCACert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	util.FatalError(t, err, "Failed to generate key")
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	util.FatalError(t, err, "Failed to marshal public key")
+	ski := sha256.Sum256(pub)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SubjectKeyId:          ski[:20],
+	}
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	util.FatalError(t, err, fmt.Sprintf("Failed to create certificate '%s'", cn))
+	cert, err := x509.ParseCertificate(der)
+	util.FatalError(t, err, "Failed to parse certificate")
+	return cert, key
+}
+
+func decodeCert(t *testing.T, certPEM []byte) *x509.Certificate {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatal("Failed to decode certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	util.FatalError(t, err, "Failed to parse certificate")
+	return cert
+}
+
+func TestGetCACertETag(t *testing.T) {
+	mspDir, err := ioutil.TempDir("", "getcacertetag")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(mspDir)
+	srv := setupEnrollTest(t)
+	defer stopAndCleanupServer(t, srv)
+
+	err = RunMain([]string{cmdName, "getcacert", "-u", serverURL, "-M", mspDir})
+	util.FatalError(t, err, "Failed to get the CA chain")
+	rootCert := filepath.Join(mspDir, "cacerts", "localhost-7090.pem")
+	etag, err := ioutil.ReadFile(filepath.Join(mspDir, etagsFolder, "localhost-7090.pem"))
+	util.FatalError(t, err, "The ETag of the CA information should be stored")
+	assert.NotEmpty(t, strings.TrimSpace(string(etag)))
+
+	// The unchanged CA chain is not stored again
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	err = os.Chtimes(rootCert, past, past)
+	util.FatalError(t, err, "Failed to set the modification time of the root certificate")
+	err = RunMain([]string{cmdName, "getcacert", "-u", serverURL, "-M", mspDir})
+	util.FatalError(t, err, "Failed to get the CA chain")
+	fi, err := os.Stat(rootCert)
+	util.FatalError(t, err, "The root certificate should be stored")
+	assert.True(t, fi.ModTime().Equal(past), "The unchanged root certificate should not be rewritten")
+
+	// but it is if the stored ETag is not the current one
+	err = ioutil.WriteFile(filepath.Join(mspDir, etagsFolder, "localhost-7090.pem"), []byte(`"stale"`), 0644)
+	util.FatalError(t, err, "Failed to replace the ETag")
+	err = RunMain([]string{cmdName, "getcacert", "-u", serverURL, "-M", mspDir})
+	util.FatalError(t, err, "Failed to get the CA chain")
+	fi, err = os.Stat(rootCert)
+	util.FatalError(t, err, "The root certificate should be stored")
+	assert.False(t, fi.ModTime().Equal(past), "The root certificate should be rewritten")
+	again, err := ioutil.ReadFile(filepath.Join(mspDir, etagsFolder, "localhost-7090.pem"))
+	util.FatalError(t, err, "The ETag should be stored")
+	assert.Equal(t, etag, again)
+
+	// or if the root certificate was removed
+	os.Remove(rootCert)
+	err = RunMain([]string{cmdName, "getcacert", "-u", serverURL, "-M", mspDir})
+	util.FatalError(t, err, "Failed to get the CA chain")
+	assert.True(t, util.FileExists(rootCert), "The root certificate should be stored again")
+}
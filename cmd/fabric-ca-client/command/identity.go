@@ -17,7 +17,13 @@ limitations under the License.
 package command
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 
 	"github.com/cloudflare/cfssl/log"
 	"github.com/hyperledger/fabric-ca/api"
@@ -33,6 +39,37 @@ type identityArgs struct {
 	add    api.AddIdentityRequest
 	modify api.ModifyIdentityRequest
 	remove api.RemoveIdentityRequest
+	// list filters the identities which are listed
+	list api.GetAllIDsRequest
+	// fields are the comma-separated fields which list and get output
+	fields string
+	// output is the output format of list and get
+	output string
+}
+
+// String returns the arguments with the secrets of the identity masked, so
+// that they can be logged
+func (ia *identityArgs) String() string {
+	return fmt.Sprintf("{id:%s json:%s add:%s modify:%s remove:%+v list:%+v fields:%s output:%s}",
+		ia.id, util.RedactBody([]byte(ia.json), 0), &ia.add, &ia.modify, ia.remove, ia.list, ia.fields, ia.output)
+}
+
+const (
+	// identityOutputTable writes the identities as a table
+	identityOutputTable = "table"
+	// identityOutputJSON writes the identities as JSON
+	identityOutputJSON = "json"
+)
+
+// identityFields are the fields of an identity which list and get output,
+// in their order, with their names in tables
+var identityFields = []struct{ name, title string }{
+	{"id", "ID"},
+	{"type", "Type"},
+	{"affiliation", "Affiliation"},
+	{"max_enrollments", "Max Enrollments"},
+	{"remaining_enrollments", "Remaining Enrollments"},
+	{"attrs", "Attributes"},
 }
 
 func (c *ClientCmd) newIdentityCommand() *cobra.Command {
@@ -42,6 +79,7 @@ func (c *ClientCmd) newIdentityCommand() *cobra.Command {
 		Long:  "Manage identities",
 	}
 	identityCmd.AddCommand(c.newListIdentityCommand())
+	identityCmd.AddCommand(c.newGetIdentityCommand())
 	identityCmd.AddCommand(c.newAddIdentityCommand())
 	identityCmd.AddCommand(c.newModifyIdentityCommand())
 	identityCmd.AddCommand(c.newRemoveIdentityCommand())
@@ -50,9 +88,10 @@ func (c *ClientCmd) newIdentityCommand() *cobra.Command {
 
 func (c *ClientCmd) newListIdentityCommand() *cobra.Command {
 	identityListCmd := &cobra.Command{
-		Use:   "list",
-		Short: "List identities",
-		Long:  "List identities visible to caller",
+		Use:     "list",
+		Short:   "List identities",
+		Long:    "List identities visible to caller",
+		Example: "fabric-ca-client identity list --type peer --affiliation org1 --output json",
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			log.Level = log.LevelWarning
 			err := c.ConfigInit()
@@ -69,9 +108,41 @@ func (c *ClientCmd) newListIdentityCommand() *cobra.Command {
 	flags := identityListCmd.Flags()
 	flags.StringVarP(
 		&c.dynamicIdentity.id, "id", "", "", "Get identity information from the fabric-ca server")
+	flags.StringVar(
+		&c.dynamicIdentity.list.Type, "type", "", "List only the identities of this type")
+	flags.StringVar(
+		&c.dynamicIdentity.list.Affiliation, "affiliation", "", "List only the identities of this affiliation and its sub-affiliations")
+	c.addIdentityOutputFlags(identityListCmd)
 	return identityListCmd
 }
 
+func (c *ClientCmd) newGetIdentityCommand() *cobra.Command {
+	identityGetCmd := &cobra.Command{
+		Use:     "get <id>",
+		Short:   "Get identity",
+		Long:    "Get an identity visible to caller, including its attributes and remaining enrollments",
+		Example: "fabric-ca-client identity get user1 --fields id,type,attrs",
+		PreRunE: c.identityPreRunE,
+		RunE:    c.runGetIdentity,
+	}
+	c.addIdentityOutputFlags(identityGetCmd)
+	return identityGetCmd
+}
+
+// addIdentityOutputFlags adds the flags of the output of identity list and get
+func (c *ClientCmd) addIdentityOutputFlags(cmd *cobra.Command) {
+	var names []string
+	for _, field := range identityFields {
+		names = append(names, field.name)
+	}
+	flags := cmd.Flags()
+	flags.StringVar(
+		&c.dynamicIdentity.fields, "fields", "", fmt.Sprintf("Comma-separated fields to output, of: %s (default all)", strings.Join(names, ",")))
+	flags.StringVar(
+		&c.dynamicIdentity.output, "output", identityOutputTable, "Output format: table or json")
+	setFlagValues(flags, "output", identityOutputTable, identityOutputJSON)
+}
+
 func (c *ClientCmd) newAddIdentityCommand() *cobra.Command {
 	identityAddCmd := &cobra.Command{
 		Use:     "add <id>",
@@ -130,32 +201,93 @@ func (c *ClientCmd) newRemoveIdentityCommand() *cobra.Command {
 func (c *ClientCmd) runListIdentity(cmd *cobra.Command, args []string) error {
 	log.Debug("Entered runListIdentity")
 
+	if len(args) > 0 {
+		return errors.Errorf(extraArgsError, args, cmd.UsageString())
+	}
+	fields, err := parseIdentityFields(c.dynamicIdentity.fields)
+	if err != nil {
+		return err
+	}
+	err = checkIdentityOutput(c.dynamicIdentity.output)
+	if err != nil {
+		return err
+	}
+
 	id, err := c.LoadMyIdentity()
 	if err != nil {
 		return err
 	}
 
 	if c.dynamicIdentity.id != "" {
-		resp, err := id.GetIdentity(c.dynamicIdentity.id, c.clientCfg.CAName)
+		return c.getIdentity(id, c.dynamicIdentity.id, fields)
+	}
+
+	req := c.dynamicIdentity.list
+	req.CAName = c.clientCfg.CAName
+	var ids []api.IdentityInfo
+	err = id.GetFilteredIdentities(&req, func(decoder *json.Decoder) error {
+		var info api.IdentityInfo
+		err := decoder.Decode(&info)
 		if err != nil {
 			return err
 		}
-
-		fmt.Printf("Name: %s, Type: %s, Affiliation: %s, Max Enrollments: %d, Attributes: %+v\n", resp.ID, resp.Type, resp.Affiliation, resp.MaxEnrollments, resp.Attributes)
+		ids = append(ids, info)
 		return nil
+	})
+	if err != nil {
+		what := "The identities"
+		if req.Type != "" {
+			what = fmt.Sprintf("%s of type '%s'", what, req.Type)
+		}
+		if req.Affiliation != "" {
+			what = fmt.Sprintf("%s in affiliation '%s'", what, req.Affiliation)
+		}
+		return notVisibleError(err, what+" are")
 	}
 
-	err = id.GetAllIdentities(c.clientCfg.CAName, lib.IdentityDecoder)
+	return printIdentities(os.Stdout, ids, fields, c.dynamicIdentity.output)
+}
+
+// The client side logic for getting an identity
+func (c *ClientCmd) runGetIdentity(cmd *cobra.Command, args []string) error {
+	log.Debugf("Entered runGetIdentity: %s", &c.dynamicIdentity)
+
+	fields, err := parseIdentityFields(c.dynamicIdentity.fields)
+	if err != nil {
+		return err
+	}
+	err = checkIdentityOutput(c.dynamicIdentity.output)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	id, err := c.LoadMyIdentity()
+	if err != nil {
+		return err
+	}
+	return c.getIdentity(id, args[0], fields)
+}
+
+// getIdentity writes the identity 'name' with 'fields' to stdout
+func (c *ClientCmd) getIdentity(id *lib.Identity, name string, fields []string) error {
+	resp, err := id.GetIdentity(name, c.clientCfg.CAName)
+	if err != nil {
+		return notVisibleError(err, fmt.Sprintf("Identity '%s' is", name))
+	}
+	info := api.IdentityInfo{
+		ID:                   resp.ID,
+		Type:                 resp.Type,
+		Affiliation:          resp.Affiliation,
+		Attributes:           resp.Attributes,
+		MaxEnrollments:       resp.MaxEnrollments,
+		RemainingEnrollments: resp.RemainingEnrollments,
+	}
+	return printIdentity(os.Stdout, &info, fields, c.dynamicIdentity.output)
 }
 
 // The client side logic for adding an identity
 func (c *ClientCmd) runAddIdentity(cmd *cobra.Command, args []string) error {
-	log.Debugf("Entered runAddIdentity: %+v", c.dynamicIdentity)
+	log.Debugf("Entered runAddIdentity: %s", &c.dynamicIdentity)
 	if c.dynamicIdentity.json != "" && checkOtherFlags(cmd) {
 		return errors.Errorf("Can't use 'json' flag in conjunction with other flags")
 	}
@@ -190,7 +322,7 @@ func (c *ClientCmd) runAddIdentity(cmd *cobra.Command, args []string) error {
 
 // The client side logic for modifying an identity
 func (c *ClientCmd) runModifyIdentity(cmd *cobra.Command, args []string) error {
-	log.Debugf("Entered runModifyIdentity: %+v", c.dynamicIdentity)
+	log.Debugf("Entered runModifyIdentity: %s", &c.dynamicIdentity)
 	if c.dynamicIdentity.json != "" && checkOtherFlags(cmd) {
 		return errors.Errorf("Can't use 'json' flag in conjunction with other flags")
 	}
@@ -225,7 +357,7 @@ func (c *ClientCmd) runModifyIdentity(cmd *cobra.Command, args []string) error {
 
 // The client side logic for removing an identity
 func (c *ClientCmd) runRemoveIdentity(cmd *cobra.Command, args []string) error {
-	log.Debugf("Entered runRemoveIdentity: %+v", c.dynamicIdentity)
+	log.Debugf("Entered runRemoveIdentity: %s", &c.dynamicIdentity)
 
 	id, err := c.LoadMyIdentity()
 	if err != nil {
@@ -288,3 +420,158 @@ func argsCheck(args []string, field string) error {
 	}
 	return nil
 }
+
+// notVisibleError returns 'err', explained as 'what' not being visible to the
+// caller if the server did not authorize the request, which is the case if
+// the caller is not a registrar or if the types or affiliation of the
+// identities are not among the ones the caller may act on
+func notVisibleError(err error, what string) error {
+	if re, ok := errors.Cause(err).(*lib.ResponseError); ok && re.IsAuthorizationFailure() {
+		return errors.WithMessage(err, what+" not visible to you")
+	}
+	return err
+}
+
+// checkIdentityOutput returns an error if 'output' is not an output format of
+// identity list and get
+func checkIdentityOutput(output string) error {
+	if output != identityOutputTable && output != identityOutputJSON {
+		return errors.Errorf("Invalid output format '%s'; must be one of: %s, %s", output, identityOutputTable, identityOutputJSON)
+	}
+	return nil
+}
+
+// parseIdentityFields returns the fields of the comma-separated list
+// 'fields', or all fields if it is empty
+func parseIdentityFields(fields string) ([]string, error) {
+	var names []string
+	for _, field := range identityFields {
+		names = append(names, field.name)
+	}
+	if fields == "" {
+		return names, nil
+	}
+	var result []string
+	for _, field := range strings.Split(fields, ",") {
+		field = strings.TrimSpace(field)
+		if !util.ListContains(strings.Join(names, ","), field) {
+			return nil, errors.Errorf("Unknown identity field '%s'; must be one of: %s", field, strings.Join(names, ", "))
+		}
+		result = append(result, field)
+	}
+	return result, nil
+}
+
+// identityFieldValue returns the value of the field 'name' of 'id', as
+// written to JSON
+func identityFieldValue(id *api.IdentityInfo, name string) interface{} {
+	switch name {
+	case "id":
+		return id.ID
+	case "type":
+		return id.Type
+	case "affiliation":
+		return id.Affiliation
+	case "max_enrollments":
+		return id.MaxEnrollments
+	case "remaining_enrollments":
+		return id.RemainingEnrollments
+	case "attrs":
+		if id.Attributes == nil {
+			return []api.Attribute{}
+		}
+		return id.Attributes
+	}
+	return nil
+}
+
+// identityFieldString returns the value of the field 'name' of 'id', as
+// written to a table
+func identityFieldString(id *api.IdentityInfo, name string) string {
+	switch name {
+	case "max_enrollments", "remaining_enrollments":
+		n := identityFieldValue(id, name).(int)
+		if n == -1 {
+			return "unlimited"
+		}
+		return strconv.Itoa(n)
+	case "attrs":
+		var attrs []string
+		for _, attr := range id.Attributes {
+			s := fmt.Sprintf("%s=%s", attr.Name, attr.Value)
+			if attr.ECert {
+				s += ":ecert"
+			}
+			attrs = append(attrs, s)
+		}
+		return strings.Join(attrs, ",")
+	}
+	return fmt.Sprint(identityFieldValue(id, name))
+}
+
+// identityFieldTitle returns the name of the field 'name' in tables
+func identityFieldTitle(name string) string {
+	for _, field := range identityFields {
+		if field.name == name {
+			return field.title
+		}
+	}
+	return name
+}
+
+// identityJSON returns the fields 'fields' of 'id' as a JSON object
+func identityJSON(id *api.IdentityInfo, fields []string) map[string]interface{} {
+	obj := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		obj[field] = identityFieldValue(id, field)
+	}
+	return obj
+}
+
+// printIdentities writes the fields 'fields' of 'ids' to 'w' as a table with
+// a row per identity, or as a JSON array
+func printIdentities(w io.Writer, ids []api.IdentityInfo, fields []string, output string) error {
+	if output == identityOutputJSON {
+		objs := make([]map[string]interface{}, 0, len(ids))
+		for i := range ids {
+			objs = append(objs, identityJSON(&ids[i], fields))
+		}
+		return writeIdentityJSON(w, objs)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	var titles []string
+	for _, field := range fields {
+		titles = append(titles, strings.ToUpper(identityFieldTitle(field)))
+	}
+	fmt.Fprintln(tw, strings.Join(titles, "\t"))
+	for i := range ids {
+		var values []string
+		for _, field := range fields {
+			values = append(values, identityFieldString(&ids[i], field))
+		}
+		fmt.Fprintln(tw, strings.Join(values, "\t"))
+	}
+	return tw.Flush()
+}
+
+// printIdentity writes the fields 'fields' of 'id' to 'w' as a line per
+// field, or as a JSON object
+func printIdentity(w io.Writer, id *api.IdentityInfo, fields []string, output string) error {
+	if output == identityOutputJSON {
+		return writeIdentityJSON(w, identityJSON(id, fields))
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	for _, field := range fields {
+		fmt.Fprintf(tw, "%s:\t%s\n", identityFieldTitle(field), identityFieldString(id, field))
+	}
+	return tw.Flush()
+}
+
+func writeIdentityJSON(w io.Writer, v interface{}) error {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal the identities")
+	}
+	_, err = fmt.Fprintln(w, string(buf))
+	return err
+}
@@ -692,6 +692,7 @@ func TestIdentityCmd(t *testing.T) {
 	assert.NoError(t, err, "Failed to add user 'testuser2'")
 
 	server.CA.Config.Registry.MaxEnrollments = 50
+	server.ApplyConfig()
 	// Test default max enrollment values for adding identity default to using CA's max enrollment value
 	err = RunMain([]string{
 		cmdName, "identity", "add", "testuser3"})
@@ -801,6 +802,7 @@ func TestIdentityCmd(t *testing.T) {
 	assert.Equal(t, 50, user.GetMaxEnrollments())
 
 	server.CA.Config.Cfg.Identities.AllowRemove = true
+	server.ApplyConfig()
 
 	err = RunMain([]string{
 		cmdName, "identity", "remove", "testuser1"})
@@ -873,6 +875,7 @@ func TestAffiliationCmd(t *testing.T) {
 	assert.NoError(t, err, "Caller with root affiliation failed to add affiliation 'org4.dept1.team2'")
 
 	server.CA.Config.Cfg.Affiliations.AllowRemove = true
+	server.ApplyConfig()
 
 	registry := server.CA.DBAccessor()
 
@@ -1547,6 +1550,7 @@ func testRegisterCommandLine(t *testing.T, srv *lib.Server) {
 
 	// Register an identity with no max enrollment specified should pick up CA's make enrollment
 	srv.CA.Config.Registry.MaxEnrollments = 200
+	srv.ApplyConfig()
 
 	userName = "Test Register6"
 	err = RunMain([]string{cmdName, "register", "-d", "--id.name", userName,
@@ -2206,6 +2210,12 @@ func TestVersion(t *testing.T) {
 	if err != nil {
 		t.Error("Failed to get fabric-ca-client version: ", err)
 	}
+	output, err := captureOutput(RunMain, []string{cmdName, "--version"})
+	if err != nil {
+		t.Error("Failed to get fabric-ca-client version with the --version flag: ", err)
+	}
+	assert.Contains(t, output, "Version: "+metadata.Version)
+	assert.Contains(t, output, "API versions: "+strings.Join(metadata.APIVersions, ", "))
 }
 
 func captureOutput(f func(args []string) error, args []string) (string, error) {
@@ -1,6 +1,7 @@
 // Code generated by mockery v1.0.0. DO NOT EDIT.
 package mocks
 
+import context "context"
 import lib "github.com/hyperledger/fabric-ca/lib"
 import mock "github.com/stretchr/testify/mock"
 import viper "github.com/spf13/viper"
@@ -68,6 +69,59 @@ func (_m *Command) GetHomeDirectory() string {
 	return r0
 }
 
+// GetContext provides a mock function with given fields:
+func (_m *Command) GetContext() context.Context {
+	ret := _m.Called()
+
+	var r0 context.Context
+	if rf, ok := ret.Get(0).(func() context.Context); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(context.Context)
+		}
+	}
+
+	return r0
+}
+
+// GetKeyPassphrase provides a mock function with given fields: newKey
+func (_m *Command) GetKeyPassphrase(newKey bool) ([]byte, error) {
+	ret := _m.Called(newKey)
+
+	var r0 []byte
+	if rf, ok := ret.Get(0).(func(bool) []byte); ok {
+		r0 = rf(newKey)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]byte)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(bool) error); ok {
+		r1 = rf(newKey)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetOutputFormat provides a mock function with given fields:
+func (_m *Command) GetOutputFormat() string {
+	ret := _m.Called()
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func() string); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	return r0
+}
+
 // GetViper provides a mock function with given fields:
 func (_m *Command) GetViper() *viper.Viper {
 	ret := _m.Called()
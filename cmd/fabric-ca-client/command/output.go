@@ -0,0 +1,167 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package command
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/lib"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/hyperledger/fabric/bccsp"
+	"github.com/pkg/errors"
+)
+
+// The output formats of the credentials obtained by a command
+const (
+	// outputFormatFiles stores the credentials in the msp directory
+	outputFormatFiles = "files"
+	// outputFormatJSON writes the credentials to stdout as a JSON document
+	outputFormatJSON = "json"
+	// outputFormatPEMStdout writes the certificates and key to stdout as
+	// concatenated PEM blocks
+	outputFormatPEMStdout = "pem-stdout"
+)
+
+var outputFormats = []string{outputFormatFiles, outputFormatJSON, outputFormatPEMStdout}
+
+// checkOutputFormat returns an error if 'format' is not an output format
+func checkOutputFormat(format string) error {
+	for _, f := range outputFormats {
+		if format == f {
+			return nil
+		}
+	}
+	return errors.Errorf("Invalid output format '%s'; must be one of: %s", format, strings.Join(outputFormats, ", "))
+}
+
+// credentialOutput is the document written by the json output format. Its
+// field names are relied upon by scripts, so they must not be changed.
+type credentialOutput struct {
+	// Key is the PEM-encoded private key of the certificate, if it can be
+	// exported from the BCCSP
+	Key string `json:"key,omitempty"`
+	// Cert is the PEM-encoded certificate
+	Cert string `json:"cert,omitempty"`
+	// Chain is the PEM-encoded certificates of the CA chain, as returned by
+	// the server
+	Chain []string `json:"chain"`
+	// Serial is the hex-encoded serial number of the certificate
+	Serial string `json:"serial,omitempty"`
+	// Expiry is the expiration time of the certificate, in RFC 3339 format
+	Expiry string `json:"expiry,omitempty"`
+}
+
+// newCredentialOutput returns the output of a certificate, its key and its
+// CA chain, all PEM-encoded. 'cert' and 'key' are empty when only the CA
+// chain is output.
+func newCredentialOutput(cert, key, chain []byte) (*credentialOutput, error) {
+	out := &credentialOutput{Key: string(key), Chain: []string{}}
+	if len(cert) > 0 {
+		x509Cert, err := util.GetX509CertificateFromPEM(cert)
+		if err != nil {
+			return nil, err
+		}
+		out.Cert = string(cert)
+		out.Serial = util.GetSerialAsHex(x509Cert.SerialNumber)
+		out.Expiry = x509Cert.NotAfter.UTC().Format(time.RFC3339)
+	}
+	for len(chain) > 0 {
+		var block *pem.Block
+		block, chain = pem.Decode(chain)
+		if block == nil {
+			break
+		}
+		out.Chain = append(out.Chain, string(pem.EncodeToMemory(block)))
+	}
+	return out, nil
+}
+
+// writeCredentialOutput writes 'out' to 'w' in 'format', which is either
+// json or pem-stdout
+func writeCredentialOutput(w io.Writer, format string, out *credentialOutput) error {
+	switch format {
+	case outputFormatJSON:
+		buf, err := json.MarshalIndent(out, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "Failed to marshal the output")
+		}
+		_, err = fmt.Fprintf(w, "%s\n", buf)
+		return err
+	case outputFormatPEMStdout:
+		blocks := []string{out.Cert}
+		blocks = append(blocks, out.Chain...)
+		blocks = append(blocks, out.Key)
+		for _, block := range blocks {
+			if block == "" {
+				continue
+			}
+			if !strings.HasSuffix(block, "\n") {
+				block += "\n"
+			}
+			_, err := io.WriteString(w, block)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return errors.Errorf("Output format '%s' does not write the credentials to stdout", format)
+}
+
+// readPrivateKeyPEM returns the PEM-encoded private key 'key' from the file
+// keystore of the BCCSP, or nil if the key is not kept in a file keystore,
+// such as when it is in an HSM
+func readPrivateKeyPEM(cfg *lib.ClientConfig, key bccsp.Key) ([]byte, error) {
+	if key == nil || cfg.CSP == nil || cfg.CSP.SwOpts == nil || cfg.CSP.SwOpts.FileKeystore == nil {
+		return nil, nil
+	}
+	keyFile := filepath.Join(cfg.CSP.SwOpts.FileKeystore.KeyStorePath, hex.EncodeToString(key.SKI())+"_sk")
+	buf, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "Failed to read the private key from '%s'", keyFile)
+	}
+	return buf, nil
+}
+
+// printCredentials writes the certificate of 'id', its private key and the
+// CA chain to stdout in 'format'
+func printCredentials(cfg *lib.ClientConfig, format string, id *lib.Identity, caChain []byte) error {
+	signer := id.GetECert()
+	if signer == nil {
+		return errors.Errorf("The identity '%s' has no enrollment certificate", id.GetName())
+	}
+	key, err := readPrivateKeyPEM(cfg, signer.Key())
+	if err != nil {
+		return err
+	}
+	out, err := newCredentialOutput(signer.Cert(), key, caChain)
+	if err != nil {
+		return err
+	}
+	return writeCredentialOutput(os.Stdout, format, out)
+}
+
+// printCAChain writes the CA chain to stdout in 'format'
+func printCAChain(format string, caChain []byte) error {
+	out, err := newCredentialOutput(nil, nil, caChain)
+	if err != nil {
+		return err
+	}
+	return writeCredentialOutput(os.Stdout, format, out)
+}
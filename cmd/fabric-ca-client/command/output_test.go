@@ -0,0 +1,153 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+var updateGolden = flag.Bool("update", false, "Update the golden files of the tests")
+
+func readTestFile(t *testing.T, name string) []byte {
+	buf, err := ioutil.ReadFile(filepath.Join(tdDir, name))
+	util.FatalError(t, err, "Failed to read test file")
+	return buf
+}
+
+func TestCredentialOutputGolden(t *testing.T) {
+	cert := readTestFile(t, "tls_client-cert.pem")
+	key := readTestFile(t, "tls_client-key.pem")
+	chain := readTestFile(t, "root.pem")
+	out, err := newCredentialOutput(cert, key, chain)
+	util.FatalError(t, err, "Failed to create the output")
+
+	var buf bytes.Buffer
+	err = writeCredentialOutput(&buf, outputFormatJSON, out)
+	util.FatalError(t, err, "Failed to write the output")
+	golden := filepath.Join(tdDir, "credentialoutput.json")
+	if *updateGolden {
+		err = ioutil.WriteFile(golden, buf.Bytes(), 0644)
+		util.FatalError(t, err, "Failed to update the golden file")
+	}
+	expected, err := ioutil.ReadFile(golden)
+	util.FatalError(t, err, "Failed to read the golden file")
+	assert.Equal(t, string(expected), buf.String(), "The JSON output changed; its schema must remain stable")
+
+	// Without a certificate, only the CA chain is output
+	out, err = newCredentialOutput(nil, nil, chain)
+	util.FatalError(t, err, "Failed to create the output")
+	buf.Reset()
+	err = writeCredentialOutput(&buf, outputFormatJSON, out)
+	util.FatalError(t, err, "Failed to write the output")
+	var doc map[string]interface{}
+	err = json.Unmarshal(buf.Bytes(), &doc)
+	util.FatalError(t, err, "Failed to parse the output")
+	assert.Equal(t, []string{"chain"}, mapKeys(doc))
+}
+
+func mapKeys(m map[string]interface{}) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func TestWriteCredentialOutputPEM(t *testing.T) {
+	cert := readTestFile(t, "tls_client-cert.pem")
+	key := readTestFile(t, "tls_client-key.pem")
+	chain := readTestFile(t, "root.pem")
+	out, err := newCredentialOutput(cert, key, chain)
+	util.FatalError(t, err, "Failed to create the output")
+
+	var buf bytes.Buffer
+	err = writeCredentialOutput(&buf, outputFormatPEMStdout, out)
+	util.FatalError(t, err, "Failed to write the output")
+	assert.Equal(t, string(cert)+string(chain)+string(key), buf.String(), "The certificate, chain and key should be concatenated")
+
+	out, err = newCredentialOutput(nil, nil, chain)
+	util.FatalError(t, err, "Failed to create the output")
+	buf.Reset()
+	err = writeCredentialOutput(&buf, outputFormatPEMStdout, out)
+	util.FatalError(t, err, "Failed to write the output")
+	assert.Equal(t, string(chain), buf.String())
+
+	err = writeCredentialOutput(&buf, outputFormatFiles, out)
+	assert.Error(t, err, "The files format should not write to stdout")
+	assert.NoError(t, checkOutputFormat(outputFormatPEMStdout))
+	assert.Error(t, checkOutputFormat("yaml"))
+}
+
+// captureStdout returns what 'f' writes to stdout
+func captureStdout(t *testing.T, f func() error) (string, error) {
+	r, w, err := os.Pipe()
+	util.FatalError(t, err, "Failed to create pipe")
+	stdout := os.Stdout
+	os.Stdout = w
+	outC := make(chan string)
+	go func() {
+		buf, _ := ioutil.ReadAll(r)
+		outC <- string(buf)
+	}()
+	err = f()
+	os.Stdout = stdout
+	w.Close()
+	return <-outC, err
+}
+
+func TestOutputFormats(t *testing.T) {
+	homeDir, err := ioutil.TempDir("", "outputformats")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(homeDir)
+	mspDir := filepath.Join(homeDir, "msp")
+	srv := setupEnrollTest(t)
+	defer stopAndCleanupServer(t, srv)
+
+	err = RunMain([]string{cmdName, "enroll", "-u", enrollURL, "-H", homeDir, "-M", mspDir, "--format", "yaml"})
+	util.ErrorContains(t, err, "Invalid output format 'yaml'", "An invalid format should fail")
+
+	stdout, err := captureStdout(t, func() error {
+		return RunMain([]string{cmdName, "enroll", "-u", enrollURL, "-H", homeDir, "-M", mspDir, "--format", "json"})
+	})
+	util.FatalError(t, err, "Failed to enroll with the json format")
+	var out credentialOutput
+	err = json.Unmarshal([]byte(stdout), &out)
+	util.FatalError(t, err, "The output should be a JSON document")
+	assert.Contains(t, out.Cert, "BEGIN CERTIFICATE")
+	assert.Contains(t, out.Key, "PRIVATE KEY", "The key should be in the output")
+	assert.NotEmpty(t, out.Chain)
+	assert.NotEmpty(t, out.Serial)
+	assert.NotEmpty(t, out.Expiry)
+	_, err = os.Stat(filepath.Join(mspDir, "signcerts", "cert.pem"))
+	assert.True(t, os.IsNotExist(err), "The certificate should not be stored in the msp directory")
+
+	stdout, err = captureStdout(t, func() error {
+		return RunMain([]string{cmdName, "getcacert", "-u", serverURL, "-H", homeDir, "-M", mspDir, "--format", "pem-stdout"})
+	})
+	util.FatalError(t, err, "Failed to get the CA chain with the pem-stdout format")
+	assert.True(t, strings.HasPrefix(stdout, "-----BEGIN CERTIFICATE-----"), "The CA chain should be written to stdout")
+	assert.NotContains(t, stdout, "PRIVATE KEY", "No key should be written with the CA chain")
+
+	// The files format prints nothing
+	stdout, err = captureStdout(t, func() error {
+		return RunMain([]string{cmdName, "enroll", "-u", enrollURL, "-H", homeDir, "-M", mspDir})
+	})
+	util.FatalError(t, err, "Failed to enroll with the files format")
+	assert.Empty(t, stdout)
+	_, err = os.Stat(filepath.Join(mspDir, "signcerts", "cert.pem"))
+	assert.NoError(t, err, "The certificate should be stored in the msp directory")
+}
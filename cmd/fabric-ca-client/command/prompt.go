@@ -0,0 +1,170 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package command
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/hyperledger/fabric-ca/lib"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+)
+
+// prompter asks the user of the client for the settings which are missing
+type prompter interface {
+	// canPrompt returns true if the user can be prompted
+	canPrompt() bool
+	// readLine prompts for and returns a line of input
+	readLine(prompt string) (string, error)
+	// readSecret prompts for and returns a line of input without echoing it
+	readSecret(prompt string) (string, error)
+}
+
+// terminalPrompter prompts the user on the terminal of the client's
+// standard input
+type terminalPrompter struct {
+	in  *os.File
+	out io.Writer
+	r   *bufio.Reader
+}
+
+func newTerminalPrompter() *terminalPrompter {
+	return &terminalPrompter{in: os.Stdin, out: os.Stderr, r: bufio.NewReader(os.Stdin)}
+}
+
+func (tp *terminalPrompter) canPrompt() bool {
+	return isTerminal(int(tp.in.Fd()))
+}
+
+func (tp *terminalPrompter) readLine(prompt string) (string, error) {
+	fmt.Fprint(tp.out, prompt)
+	line, err := tp.r.ReadString('\n')
+	if err != nil && !(err == io.EOF && line != "") {
+		return "", errors.Wrap(err, "Failed to read from the terminal")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (tp *terminalPrompter) readSecret(prompt string) (string, error) {
+	restore, err := disableEcho(int(tp.in.Fd()))
+	if err != nil {
+		return "", errors.WithMessage(err, "Failed to turn off echoing on the terminal")
+	}
+	defer func() {
+		restore()
+		fmt.Fprintln(tp.out)
+	}()
+	return tp.readLine(prompt)
+}
+
+// EnrollmentSecretEnvVar is the environment variable which contains the
+// enrollment secret, if it is not in the URL or in the --secret-file file
+const EnrollmentSecretEnvVar = "FABRIC_CA_CLIENT_ENROLLMENT_SECRET"
+
+// promptForCredentials returns the URL of the server 'rawurl' with the
+// enrollment ID and secret which it is missing. The enrollment ID is prompted
+// for. The secret is read, in order of precedence, from the URL, from
+// 'secretFile', from the FABRIC_CA_CLIENT_ENROLLMENT_SECRET environment
+// variable or by prompting for it without echoing it. The URL is returned
+// unchanged if it has no enrollment ID and the user can't be prompted; it is
+// an error if the secret can be obtained from none of these sources.
+func promptForCredentials(rawurl, secretFile string, p prompter) (string, error) {
+	purl, err := url.Parse(rawurl)
+	if err != nil {
+		// The URL's error is returned by the enrollment
+		return rawurl, nil
+	}
+	var name, secret string
+	hasSecret := false
+	if purl.User != nil {
+		name = purl.User.Username()
+		secret, hasSecret = purl.User.Password()
+	}
+	if name != "" && hasSecret {
+		return rawurl, nil
+	}
+	if name == "" {
+		if !p.canPrompt() {
+			return rawurl, nil
+		}
+		name, err = p.readLine("Enrollment ID: ")
+		if err != nil {
+			return "", err
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return "", errors.New("An enrollment ID is required")
+		}
+	}
+	if !hasSecret {
+		secret, err = readEnrollmentSecret(name, secretFile, p)
+		if err != nil {
+			return "", err
+		}
+	}
+	purl.User = url.UserPassword(name, secret)
+	return purl.String(), nil
+}
+
+// readEnrollmentSecret returns the enrollment secret of 'name' which is not
+// in the URL
+func readEnrollmentSecret(name, secretFile string, p prompter) (string, error) {
+	if secretFile != "" {
+		buf, err := ioutil.ReadFile(secretFile)
+		if err != nil {
+			return "", errors.Wrapf(err, "Failed to read the enrollment secret from '%s'", secretFile)
+		}
+		secret := strings.TrimRight(string(buf), "\r\n")
+		if secret == "" {
+			return "", errors.Errorf("The enrollment secret file '%s' is empty", secretFile)
+		}
+		return secret, nil
+	}
+	if secret := os.Getenv(EnrollmentSecretEnvVar); secret != "" {
+		return secret, nil
+	}
+	if !p.canPrompt() {
+		return "", errors.Errorf("The enrollment secret of '%s' is not in the URL and can't be prompted for because the input is not a terminal; "+
+			"use the --secret-file flag or the %s environment variable", name, EnrollmentSecretEnvVar)
+	}
+	return p.readSecret(fmt.Sprintf("Enrollment secret of '%s': ", name))
+}
+
+// promptForKeyPassphrase returns the passphrase of the private key, as
+// answered by the user. The passphrase of a new key is asked for twice.
+func promptForKeyPassphrase(p prompter, newKey bool) ([]byte, error) {
+	if !p.canPrompt() {
+		msg := fmt.Sprintf("The passphrase of the private key can't be prompted for because the input is not a terminal; set the keyencryption.passphrasefile setting or the %s environment variable", lib.KeyPassphraseEnvVar)
+		if newKey {
+			return nil, errors.New(msg)
+		}
+		return nil, errors.WithMessage(util.ErrNoPassphrase, msg)
+	}
+	passphrase, err := p.readSecret("Passphrase of the private key: ")
+	if err != nil {
+		return nil, err
+	}
+	if passphrase == "" {
+		return nil, errors.New("The passphrase of the private key is empty")
+	}
+	if newKey {
+		confirm, err := p.readSecret("Confirm the passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if confirm != passphrase {
+			return nil, errors.New("The passphrases do not match")
+		}
+	}
+	return []byte(passphrase), nil
+}
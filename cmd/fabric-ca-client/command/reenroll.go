@@ -7,21 +7,23 @@ SPDX-License-Identifier: Apache-2.0
 package command
 
 import (
+	"context"
 	"fmt"
-	"path/filepath"
 
 	"github.com/cloudflare/cfssl/log"
 	"github.com/hyperledger/fabric-ca/api"
 	"github.com/hyperledger/fabric-ca/lib"
+	caclient "github.com/hyperledger/fabric-ca/lib/client"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
 func (c *ClientCmd) newReenrollCommand() *cobra.Command {
 	reenrollCmd := &cobra.Command{
-		Use:   "reenroll",
-		Short: "Reenroll an identity",
-		Long:  "Reenroll an identity with Fabric CA server",
+		Use:     "reenroll",
+		Short:   "Reenroll an identity",
+		Long:    "Reenroll an identity with Fabric CA server, reusing the key of its current certificate unless --newkey is specified",
+		Example: "fabric-ca-client reenroll --newkey",
 		// PreRunE block for this command will check to make sure enrollment
 		// information exists before running the command
 		PreRunE: func(cmd *cobra.Command, args []string) error {
@@ -47,6 +49,7 @@ func (c *ClientCmd) newReenrollCommand() *cobra.Command {
 			return nil
 		},
 	}
+	reenrollCmd.Flags().BoolVar(&c.reenrollNewKey, "newkey", false, "Generate a new key for the certificate rather than reusing the key of the current certificate")
 	return reenrollCmd
 }
 
@@ -54,28 +57,22 @@ func (c *ClientCmd) newReenrollCommand() *cobra.Command {
 func (c *ClientCmd) runReenroll() error {
 	log.Debug("Entered runReenroll")
 
-	client := lib.Client{
-		HomeDir: filepath.Dir(c.cfgFileName),
-		Config:  c.clientCfg,
-	}
-
-	id, err := client.LoadMyIdentity()
+	cl, err := newClient(c)
 	if err != nil {
 		return err
 	}
-
-	req := &api.ReenrollmentRequest{
-		Label:   c.clientCfg.Enrollment.Label,
-		Profile: c.clientCfg.Enrollment.Profile,
-		CSR:     &c.clientCfg.CSR,
-		CAName:  c.clientCfg.CAName,
+	id, err := cl.LoadIdentity()
+	if err != nil {
+		return err
 	}
 
-	resp, err := id.Reenroll(req)
+	resp, err := reenrollIdentity(c.ctx, cl, id, c.clientCfg, !c.reenrollNewKey)
 	if err != nil {
-		return errors.WithMessage(err, fmt.Sprintf("Failed to reenroll '%s'", id.GetName()))
+		return err
+	}
+	if format := c.GetOutputFormat(); format != outputFormatFiles {
+		return printCredentials(c.clientCfg, format, resp.Identity, resp.CAInfo.CAChain)
 	}
-
 	err = resp.Identity.Store()
 	if err != nil {
 		return err
@@ -88,3 +85,28 @@ func (c *ClientCmd) runReenroll() error {
 
 	return nil
 }
+
+// reenrollIdentity reenrolls 'id' with the enrollment settings of 'cfg',
+// reusing the key of its current certificate if 'reuseKey' is set, and
+// returns its new credentials, which are not stored, once they verify
+// against the CA chain
+func reenrollIdentity(ctx context.Context, cl *caclient.Client, id *lib.Identity, cfg *lib.ClientConfig, reuseKey bool) (*lib.EnrollmentResponse, error) {
+	req := &api.ReenrollmentRequest{
+		Label:    cfg.Enrollment.Label,
+		Profile:  cfg.Enrollment.Profile,
+		CSR:      &cfg.CSR,
+		CAName:   cfg.CAName,
+		ReuseKey: reuseKey,
+		SVID:     cfg.Enrollment.SVID,
+	}
+	resp, err := cl.Reenroll(ctx, id, req)
+	if err != nil {
+		return nil, errors.WithMessage(err, fmt.Sprintf("Failed to reenroll '%s'", id.GetName()))
+	}
+	// The current credential is only replaced by one which verifies
+	err = resp.VerifyCert()
+	if err != nil {
+		return nil, errors.WithMessage(err, fmt.Sprintf("The certificate issued to '%s' is not valid; keeping the current certificate", id.GetName()))
+	}
+	return resp, nil
+}
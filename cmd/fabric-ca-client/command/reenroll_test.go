@@ -0,0 +1,91 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package command
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReenrollKeyReuse(t *testing.T) {
+	adminHome := filepath.Join(tdDir, "reenrollkeyhome")
+	os.RemoveAll(adminHome)
+	defer os.RemoveAll(adminHome)
+	srv := setupEnrollTest(t)
+	defer stopAndCleanupServer(t, srv)
+
+	err := RunMain([]string{cmdName, "enroll", "-u", enrollURL, "-H", adminHome})
+	util.FatalError(t, err, "Failed to enroll")
+	mspDir := filepath.Join(adminHome, "msp")
+	cert, keys := readCredential(t, mspDir)
+
+	// The key of the current certificate is reused by default
+	err = RunMain([]string{cmdName, "reenroll", "-u", serverURL, "-H", adminHome})
+	util.FatalError(t, err, "Failed to reenroll")
+	reusedCert, reusedKeys := readCredential(t, mspDir)
+	assert.NotEqual(t, cert.SerialNumber, reusedCert.SerialNumber, "A new certificate should be stored")
+	assert.Equal(t, publicKey(t, cert), publicKey(t, reusedCert), "The key should be reused")
+	assert.Equal(t, keys, reusedKeys, "No key should be generated")
+
+	err = RunMain([]string{cmdName, "reenroll", "-u", serverURL, "-H", adminHome, "--newkey"})
+	util.FatalError(t, err, "Failed to reenroll with a new key")
+	newKeyCert, newKeys := readCredential(t, mspDir)
+	assert.NotEqual(t, publicKey(t, cert), publicKey(t, newKeyCert), "A new key should be used")
+	assert.Equal(t, keys+1, newKeys, "The new key should be stored")
+}
+
+func TestReenrollFailureKeepsCredential(t *testing.T) {
+	adminHome := filepath.Join(tdDir, "reenrollfailhome")
+	os.RemoveAll(adminHome)
+	defer os.RemoveAll(adminHome)
+	srv := setupEnrollTest(t)
+	defer stopAndCleanupServer(t, srv)
+
+	err := RunMain([]string{cmdName, "enroll", "-u", enrollURL, "-H", adminHome})
+	util.FatalError(t, err, "Failed to enroll")
+	certFile := filepath.Join(adminHome, "msp", "signcerts", "cert.pem")
+	before, err := ioutil.ReadFile(certFile)
+	util.FatalError(t, err, "Failed to read certificate")
+
+	// The server rejects a request to a CA which does not exist
+	err = RunMain([]string{cmdName, "reenroll", "-u", serverURL, "-H", adminHome, "--newkey", "--caname", "nosuchca"})
+	assert.Error(t, err, "Reenrollment with a CA which does not exist should fail")
+	after, err := ioutil.ReadFile(certFile)
+	util.FatalError(t, err, "Failed to read certificate")
+	assert.Equal(t, before, after, "The current certificate should be kept when reenrollment fails")
+
+	// The current key is kept, so the current credential can still be used
+	err = RunMain([]string{cmdName, "reenroll", "-u", serverURL, "-H", adminHome})
+	assert.NoError(t, err, "The current credential should still work")
+	files, err := ioutil.ReadDir(filepath.Dir(certFile))
+	util.FatalError(t, err, "Failed to read signcerts directory")
+	assert.Len(t, files, 1, "No temporary file should be left behind")
+}
+
+// readCredential returns the certificate in the MSP directory 'mspDir' and
+// the number of keys in its keystore
+func readCredential(t *testing.T, mspDir string) (*x509.Certificate, int) {
+	buf, err := ioutil.ReadFile(filepath.Join(mspDir, "signcerts", "cert.pem"))
+	util.FatalError(t, err, "Failed to read certificate")
+	cert, err := util.GetX509CertificateFromPEM(buf)
+	util.FatalError(t, err, "Failed to parse certificate")
+	keys, err := ioutil.ReadDir(filepath.Join(mspDir, "keystore"))
+	util.FatalError(t, err, "Failed to read keystore")
+	return cert, len(keys)
+}
+
+func publicKey(t *testing.T, cert *x509.Certificate) []byte {
+	buf, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	util.FatalError(t, err, "Failed to marshal public key")
+	return buf
+}
@@ -17,20 +17,26 @@ limitations under the License.
 package command
 
 import (
+	"encoding/json"
 	"fmt"
-	"path/filepath"
+	"io"
+	"os"
 
+	cfsslapi "github.com/cloudflare/cfssl/api"
 	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/api"
 	"github.com/hyperledger/fabric-ca/lib"
+	"github.com/hyperledger/fabric-ca/util"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
 func (c *ClientCmd) newRegisterCommand() *cobra.Command {
 	registerCmd := &cobra.Command{
-		Use:   "register",
-		Short: "Register an identity",
-		Long:  "Register an identity with Fabric CA server",
+		Use:     "register",
+		Short:   "Register an identity",
+		Long:    "Register an identity with Fabric CA server",
+		Example: "fabric-ca-client register --id.name peer1 --id.type peer --id.affiliation org1.department1 --id.attrs foo=bar",
 		// PreRunE block for this command will check to make sure enrollment
 		// information exists before running the command
 		PreRunE: func(cmd *cobra.Command, args []string) error {
@@ -56,30 +62,96 @@ func (c *ClientCmd) newRegisterCommand() *cobra.Command {
 			return nil
 		},
 	}
+	flags := registerCmd.Flags()
+	flags.StringVar(&c.registerParams.secretFile, "secret-file", "", "Write the enrollment secret of the registered identity to this file rather than printing it")
+	flags.BoolVar(&c.registerParams.json, "json", false, "Print the result, or the errors returned by the server, as JSON")
 	return registerCmd
 }
 
+// registerResult is the output of the register command in JSON
+type registerResult struct {
+	Name       string `json:"name"`
+	Secret     string `json:"secret,omitempty"`
+	SecretFile string `json:"secretfile,omitempty"`
+}
+
+// registerErrors is the output of the register command in JSON when the
+// server rejects the request
+type registerErrors struct {
+	Errors []cfsslapi.ResponseMessage `json:"errors"`
+}
+
 // The client register main logic
 func (c *ClientCmd) runRegister() error {
 	log.Debug("Entered runRegister")
 
-	client := lib.Client{
-		HomeDir: filepath.Dir(c.cfgFileName),
-		Config:  c.clientCfg,
+	cl, err := newClient(c)
+	if err != nil {
+		return err
 	}
-
-	id, err := client.LoadMyIdentity()
+	id, err := cl.LoadIdentity()
 	if err != nil {
 		return err
 	}
 
 	c.clientCfg.ID.CAName = c.clientCfg.CAName
-	resp, err := id.Register(&c.clientCfg.ID)
+	resp, err := cl.Register(c.ctx, id, &c.clientCfg.ID)
 	if err != nil {
+		if c.registerJSON() {
+			printRegisterErrors(os.Stdout, err)
+		}
 		return err
 	}
 
-	fmt.Printf("Password: %s\n", resp.Secret)
+	return c.printRegisterResult(os.Stdout, &c.clientCfg.ID, resp)
+}
 
+// registerJSON returns true if the result of the register command is printed
+// as JSON, either because of its --json flag or of the json output format
+func (c *ClientCmd) registerJSON() bool {
+	return c.registerParams.json || c.outputFormat == outputFormatJSON
+}
+
+// printRegisterResult prints the enrollment secret of the registered
+// identity, or writes it to the secret file if one was specified, so
+// that the secret is output exactly once
+func (c *ClientCmd) printRegisterResult(w io.Writer, req *api.RegistrationRequest, resp *api.RegistrationResponse) error {
+	result := registerResult{Name: req.Name, Secret: resp.Secret}
+	if c.registerParams.secretFile != "" {
+		secretFile := c.registerParams.secretFile
+		err := util.WriteFileAtomic(secretFile, []byte(resp.Secret+"\n"), 0600)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to write the enrollment secret")
+		}
+		result.Secret = ""
+		result.SecretFile = secretFile
+	}
+	if c.registerJSON() {
+		out, err := json.Marshal(&result)
+		if err != nil {
+			return errors.Wrap(err, "Failed to marshal the registration result")
+		}
+		fmt.Fprintln(w, string(out))
+		return nil
+	}
+	if result.SecretFile != "" {
+		fmt.Fprintf(w, "Password written to %s\n", result.SecretFile)
+	} else {
+		fmt.Fprintf(w, "Password: %s\n", result.Secret)
+	}
 	return nil
 }
+
+// printRegisterErrors prints the errors returned by the server in JSON.
+// Nothing is printed if the request failed for any other reason.
+func printRegisterErrors(w io.Writer, err error) {
+	re, ok := errors.Cause(err).(*lib.ResponseError)
+	if !ok || len(re.Errors) == 0 {
+		return
+	}
+	out, merr := json.Marshal(&registerErrors{Errors: re.Errors})
+	if merr != nil {
+		return
+	}
+	fmt.Fprintln(w, string(out))
+}
@@ -0,0 +1,129 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cfsslapi "github.com/cloudflare/cfssl/api"
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterCommand(t *testing.T) {
+	adminHome := filepath.Join(tdDir, "registeradminhome")
+	userHome := filepath.Join(tdDir, "registeruserhome")
+	secretFile := filepath.Join(tdDir, "registeruser.secret")
+	os.RemoveAll(adminHome)
+	os.RemoveAll(userHome)
+	defer os.RemoveAll(adminHome)
+	defer os.RemoveAll(userHome)
+	defer os.Remove(secretFile)
+	srv := setupEnrollTest(t)
+	defer stopAndCleanupServer(t, srv)
+
+	err := RunMain([]string{cmdName, "enroll", "-u", enrollURL, "-H", adminHome})
+	util.FatalError(t, err, "Failed to enroll admin")
+
+	// A malformed attribute is refused before a request is sent
+	err = RunMain([]string{cmdName, "register", "-u", serverURL, "-H", adminHome,
+		"--id.name", "registeruser", "--id.affiliation", "hyperledger.org1", "--id.attrs", "foo=bar,baz"})
+	util.ErrorContains(t, err, "Attribute 'baz' is missing '='", "A malformed attribute should fail")
+	err = RunMain([]string{cmdName, "register", "-u", serverURL, "-H", adminHome,
+		"--id.name", "registeruser", "--id.affiliation", "hyperledger.org1", "--id.attrs", `foo="bar,baz`})
+	util.ErrorContains(t, err, "unterminated quote", "An unterminated quote should fail")
+
+	err = RunMain([]string{cmdName, "register", "-u", serverURL, "-H", adminHome,
+		"--id.name", "registeruser", "--id.type", "client", "--id.affiliation", "hyperledger.org1",
+		"--id.attrs", `hf.Registrar.Roles="client,user",foo=bar`, "--secret-file", secretFile, "--json"})
+	util.FatalError(t, err, "Failed to register user")
+	secret, err := ioutil.ReadFile(secretFile)
+	util.FatalError(t, err, "The secret should be written to the secret file")
+	info, err := os.Stat(secretFile)
+	util.FatalError(t, err, "Failed to stat the secret file")
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "The secret file should only be readable by its owner")
+
+	userURL := "http://registeruser:" + strings.TrimSpace(string(secret)) + "@localhost:7090"
+	err = RunMain([]string{cmdName, "enroll", "-u", userURL, "-H", userHome})
+	util.FatalError(t, err, "Failed to enroll with the secret from the secret file")
+
+	// The user is not a registrar of type 'peer', so the server rejects the request
+	err = RunMain([]string{cmdName, "register", "-u", serverURL, "-H", userHome,
+		"--id.name", "registerpeer", "--id.type", "peer", "--id.affiliation", "hyperledger.org1", "--json"})
+	if assert.Error(t, err, "Registering an identity of a type the registrar may not register should fail") {
+		assert.Equal(t, ExitCodeAuthorizationFailure, ExitCode(err))
+		re, ok := errors.Cause(err).(*lib.ResponseError)
+		if assert.True(t, ok, "The error should be the server's response") {
+			assert.NotEmpty(t, re.Errors, "The error should include the errors returned by the server")
+		}
+	}
+}
+
+func TestPrintRegisterResult(t *testing.T) {
+	req := &api.RegistrationRequest{Name: "user1"}
+	resp := &api.RegistrationResponse{Secret: "user1pw"}
+
+	c := &ClientCmd{}
+	var buf bytes.Buffer
+	err := c.printRegisterResult(&buf, req, resp)
+	util.FatalError(t, err, "Failed to print the result")
+	assert.Equal(t, "Password: user1pw\n", buf.String())
+
+	c.registerParams.json = true
+	buf.Reset()
+	err = c.printRegisterResult(&buf, req, resp)
+	util.FatalError(t, err, "Failed to print the result as JSON")
+	var result registerResult
+	err = json.Unmarshal(buf.Bytes(), &result)
+	util.FatalError(t, err, "Failed to parse the JSON output")
+	assert.Equal(t, registerResult{Name: "user1", Secret: "user1pw"}, result)
+
+	dir, err := ioutil.TempDir("", "registersecret")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, "user1.secret")
+	c.registerParams.secretFile = secretFile
+	buf.Reset()
+	err = c.printRegisterResult(&buf, req, resp)
+	util.FatalError(t, err, "Failed to write the secret file")
+	assert.NotContains(t, buf.String(), "user1pw", "The secret should not be printed when it is written to a file")
+	result = registerResult{}
+	err = json.Unmarshal(buf.Bytes(), &result)
+	util.FatalError(t, err, "Failed to parse the JSON output")
+	assert.Equal(t, registerResult{Name: "user1", SecretFile: secretFile}, result)
+
+	c.registerParams.json = false
+	buf.Reset()
+	err = c.printRegisterResult(&buf, req, resp)
+	util.FatalError(t, err, "Failed to write the secret file")
+	assert.Equal(t, "Password written to "+secretFile+"\n", buf.String())
+	secret, err := ioutil.ReadFile(secretFile)
+	util.FatalError(t, err, "Failed to read the secret file")
+	assert.Equal(t, "user1pw\n", string(secret))
+}
+
+func TestPrintRegisterErrors(t *testing.T) {
+	var buf bytes.Buffer
+	printRegisterErrors(&buf, errors.New("connection refused"))
+	assert.Empty(t, buf.String(), "Only the errors returned by the server should be printed")
+
+	re := &lib.ResponseError{
+		StatusCode: 401,
+		Errors:     []cfsslapi.ResponseMessage{{Code: 71, Message: "Authorization failure"}},
+	}
+	printRegisterErrors(&buf, errors.WithStack(re))
+	assert.Equal(t, `{"errors":[{"code":71,"message":"Authorization failure"}]}`+"\n", buf.String())
+}
@@ -0,0 +1,289 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package command
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/lib"
+	caclient "github.com/hyperledger/fabric-ca/lib/client"
+	"github.com/hyperledger/fabric-ca/lib/logging"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// RenewerCmdUsage is the usage text for the renewer command
+	RenewerCmdUsage = "renewer [--renew-fraction <fraction> | --renew-before <duration>] [--jitter <duration>] [--post-renew-hook <command>] [--once]"
+	// RenewerCmdShortDesc is the short description for the renewer command
+	RenewerCmdShortDesc = "Renew the enrollment certificate before it expires"
+
+	// renewerMaxSleep is the longest time the renewer sleeps before checking
+	// the wall clock again, so that a suspended host does not renew late
+	renewerMaxSleep = 10 * time.Minute
+	// journalStreamEnv is set by systemd when stderr is the journal
+	journalStreamEnv = "JOURNAL_STREAM"
+)
+
+// renewerNow returns the current time; it is replaced by tests
+var renewerNow = time.Now
+
+type renewerCmd struct {
+	Command
+	// fraction is the fraction of the lifetime of the certificate after
+	// which it is renewed
+	fraction float64
+	// before is the time before the certificate expires at which it is
+	// renewed; it overrides fraction if set
+	before time.Duration
+	// jitter is the maximum random time by which the renewal is advanced
+	jitter time.Duration
+	// hook is the command run after the certificate is renewed
+	hook string
+	// once renews the certificate if it is due and exits
+	once bool
+	// newKey generates a new key for the renewed certificate
+	newKey bool
+	// retryInterval and maxRetryInterval are the first and longest times
+	// between the attempts of a renewal which fails
+	retryInterval    time.Duration
+	maxRetryInterval time.Duration
+	// logFormat is the format of the log messages, text or journal
+	logFormat string
+}
+
+func newRenewerCmd(c Command) *renewerCmd {
+	return &renewerCmd{Command: c}
+}
+
+func (c *renewerCmd) getCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   RenewerCmdUsage,
+		Short: RenewerCmdShortDesc,
+		Long: "Watch the enrollment certificate in the msp directory and reenroll when it is due for renewal, " +
+			"replacing the stored certificate atomically and running the post-renew hook. A failed renewal is retried " +
+			"with backoff; the command fails only if the certificate expires without being renewed",
+		Example: "fabric-ca-client renewer --renew-before 72h --jitter 1h --post-renew-hook 'systemctl reload peer'\n" +
+			"fabric-ca-client renewer --renew-fraction 0.5 --once",
+		PreRunE: c.preRunRenewer,
+		RunE:    c.runRenewer,
+	}
+	flags := cmd.Flags()
+	flags.Float64Var(&c.fraction, "renew-fraction", 0.67, "Fraction of the lifetime of the certificate after which it is renewed")
+	flags.DurationVar(&c.before, "renew-before", 0, "Time before the certificate expires at which it is renewed; overrides --renew-fraction")
+	flags.DurationVar(&c.jitter, "jitter", 0, "Maximum random time by which each renewal is advanced, so that hosts do not renew together")
+	flags.StringVar(&c.hook, "post-renew-hook", "", "Command run by the shell after the certificate is renewed, such as one which reloads the service using it")
+	flags.BoolVar(&c.once, "once", false, "Renew the certificate if it is due and exit, as from cron")
+	flags.BoolVar(&c.newKey, "newkey", false, "Generate a new key for the renewed certificate rather than reusing the current key")
+	flags.DurationVar(&c.retryInterval, "retry-interval", 30*time.Second, "Time before the first retry of a failed renewal, which doubles with each retry")
+	flags.DurationVar(&c.maxRetryInterval, "max-retry-interval", 30*time.Minute, "Longest time between the retries of a failed renewal")
+	flags.StringVar(&c.logFormat, "log-format", "", "Format of the log messages: text, or journal for the systemd journal (default journal if run by systemd, otherwise text)")
+	setFlagValues(flags, "log-format", logging.FormatText, logging.FormatJournal)
+	return cmd
+}
+
+func (c *renewerCmd) preRunRenewer(cmd *cobra.Command, args []string) error {
+	if len(args) > 0 {
+		return errors.Errorf(extraArgsError, args, cmd.UsageString())
+	}
+	if c.fraction <= 0 || c.fraction >= 1 {
+		return errors.Errorf("Invalid renewal fraction %g; it must be greater than 0 and less than 1", c.fraction)
+	}
+	if c.before < 0 || c.jitter < 0 {
+		return errors.New("The --renew-before and --jitter durations may not be negative")
+	}
+	if c.retryInterval <= 0 || c.maxRetryInterval < c.retryInterval {
+		return errors.New("The --retry-interval must be positive and no longer than the --max-retry-interval")
+	}
+	if c.logFormat == "" {
+		c.logFormat = logging.FormatText
+		if os.Getenv(journalStreamEnv) != "" {
+			c.logFormat = logging.FormatJournal
+		}
+	}
+	if c.logFormat != logging.FormatText && c.logFormat != logging.FormatJournal {
+		return errors.Errorf("Invalid log format '%s'; must be '%s' or '%s'", c.logFormat, logging.FormatText, logging.FormatJournal)
+	}
+	if c.logFormat == logging.FormatJournal {
+		err := logging.Configure(&logging.Config{Format: c.logFormat}, "")
+		if err != nil {
+			return err
+		}
+	}
+	err := c.ConfigInit()
+	if err != nil {
+		return err
+	}
+	log.Debugf("Client configuration settings: %+v", c.GetClientCfg())
+	return nil
+}
+
+func (c *renewerCmd) runRenewer(cmd *cobra.Command, args []string) error {
+	log.Debug("Entered runRenewer")
+	ctx := c.GetContext()
+	cl, err := newClient(c)
+	if err != nil {
+		return err
+	}
+	retry := c.retryInterval
+	renewed := false
+	for {
+		id, err := cl.LoadIdentity()
+		if err != nil {
+			return err
+		}
+		cert := id.GetECert().GetX509Cert()
+		at := c.renewalTime(cert)
+		if renewed && !renewerNow().Before(at) {
+			// The lifetime of the certificates issued by the CA is shorter
+			// than the renewal lead time, so it is not renewed in a loop
+			log.Warningf("The renewed certificate of '%s' is already due for renewal; renewing it again in %s",
+				id.GetName(), c.retryInterval)
+			at = renewerNow().Add(c.retryInterval)
+		}
+		if now := renewerNow(); now.Before(at) {
+			if c.once {
+				log.Infof("The certificate of '%s' expires at %s; it is not due for renewal until %s",
+					id.GetName(), cert.NotAfter.Format(time.RFC3339), at.Format(time.RFC3339))
+				return nil
+			}
+			log.Infof("The certificate of '%s' expires at %s; renewing it at %s",
+				id.GetName(), cert.NotAfter.Format(time.RFC3339), at.Format(time.RFC3339))
+			if !sleepUntil(ctx, at) {
+				return nil
+			}
+		}
+
+		err = c.renew(ctx, cl, id)
+		renewed = err == nil
+		if err == nil {
+			retry = c.retryInterval
+			if c.once {
+				return nil
+			}
+			continue
+		}
+		if ctx.Err() != nil {
+			log.Infof("Stopped renewing the certificate of '%s'", id.GetName())
+			return nil
+		}
+		if !renewerNow().Before(cert.NotAfter) {
+			return errors.WithMessage(err, fmt.Sprintf("The certificate of '%s' expired at %s without being renewed",
+				id.GetName(), cert.NotAfter.Format(time.RFC3339)))
+		}
+		if c.once {
+			log.Errorf("Failed to renew the certificate of '%s', which expires at %s: %s",
+				id.GetName(), cert.NotAfter.Format(time.RFC3339), err)
+			return nil
+		}
+		// The last attempt is made when the certificate expires
+		next := renewerNow().Add(retry)
+		if next.After(cert.NotAfter) {
+			next = cert.NotAfter
+		}
+		log.Warningf("Failed to renew the certificate of '%s', which expires at %s; retrying at %s: %s",
+			id.GetName(), cert.NotAfter.Format(time.RFC3339), next.Format(time.RFC3339), err)
+		if !sleepUntil(ctx, next) {
+			return nil
+		}
+		retry *= 2
+		if retry > c.maxRetryInterval {
+			retry = c.maxRetryInterval
+		}
+	}
+}
+
+// renewalTime returns the time at which 'cert' is due for renewal
+func (c *renewerCmd) renewalTime(cert *x509.Certificate) time.Time {
+	var at time.Time
+	if c.before > 0 {
+		at = cert.NotAfter.Add(-c.before)
+	} else {
+		lifetime := cert.NotAfter.Sub(cert.NotBefore)
+		at = cert.NotBefore.Add(time.Duration(float64(lifetime) * c.fraction))
+	}
+	if c.jitter > 0 {
+		at = at.Add(-time.Duration(rand.Int63n(int64(c.jitter))))
+	}
+	return at
+}
+
+// renew reenrolls the identity 'id', stores its new credentials in place of
+// the current ones and runs the post-renew hook
+func (c *renewerCmd) renew(ctx context.Context, cl *caclient.Client, id *lib.Identity) error {
+	cfg := c.GetClientCfg()
+	resp, err := reenrollIdentity(ctx, cl, id, cfg, !c.newKey)
+	if err != nil {
+		return err
+	}
+	err = resp.Identity.Store()
+	if err != nil {
+		return err
+	}
+	err = storeCAChain(cfg, &resp.CAInfo)
+	if err != nil {
+		return err
+	}
+	cert := resp.Identity.GetECert().GetX509Cert()
+	log.Infof("Renewed the certificate of '%s', which now expires at %s", id.GetName(), cert.NotAfter.Format(time.RFC3339))
+	if c.hook == "" {
+		return nil
+	}
+	// A failure of the hook does not undo the renewal, so it is only logged
+	err = c.runHook(ctx, filepath.Join(cfg.MSPDir, "signcerts", "cert.pem"), cert)
+	if err != nil {
+		log.Errorf("The post-renew hook failed: %s", err)
+	}
+	return nil
+}
+
+// runHook runs the post-renew hook with the shell, with the name of the
+// renewed certificate file and its serial number in its environment
+func (c *renewerCmd) runHook(ctx context.Context, certFile string, cert *x509.Certificate) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", c.hook)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", c.hook)
+	}
+	cmd.Env = append(os.Environ(),
+		"RENEWED_CERT_FILE="+certFile,
+		"RENEWED_CERT_SERIAL="+util.GetSerialAsHex(cert.SerialNumber))
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	log.Debugf("Running the post-renew hook '%s'", c.hook)
+	return errors.Wrapf(cmd.Run(), "Failed to run '%s'", c.hook)
+}
+
+// sleepUntil sleeps until the wall clock reaches 't' and returns true, or
+// returns false if 'ctx' is done first
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	for {
+		d := t.Sub(renewerNow())
+		if d <= 0 {
+			return true
+		}
+		if d > renewerMaxSleep {
+			d = renewerMaxSleep
+		}
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
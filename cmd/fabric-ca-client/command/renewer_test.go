@@ -0,0 +1,161 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package command
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// The lead time which makes any certificate of the test server due for renewal
+const renewNow = "87600h"
+
+func TestRenewerOnce(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The post-renew hook of the test requires a POSIX shell")
+	}
+	homeDir, err := ioutil.TempDir("", "renewer")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(homeDir)
+	srv := setupEnrollTest(t)
+	defer stopAndCleanupServer(t, srv)
+
+	err = RunMain([]string{cmdName, "enroll", "-u", enrollURL, "-H", homeDir})
+	util.FatalError(t, err, "Failed to enroll")
+	mspDir := filepath.Join(homeDir, "msp")
+	cert, keys := readCredential(t, mspDir)
+
+	// A certificate which is not due for renewal is kept
+	err = RunMain([]string{cmdName, "renewer", "-u", serverURL, "-H", homeDir, "--once"})
+	util.FatalError(t, err, "The renewer failed")
+	kept, _ := readCredential(t, mspDir)
+	assert.Equal(t, cert.SerialNumber, kept.SerialNumber, "A certificate which is not due should not be renewed")
+
+	// A certificate which is due is renewed, with the same key, and the hook
+	// is run with the renewed certificate
+	hookFile := filepath.Join(homeDir, "hook.out")
+	hook := `echo "$RENEWED_CERT_SERIAL $RENEWED_CERT_FILE" > ` + hookFile
+	err = RunMain([]string{cmdName, "renewer", "-u", serverURL, "-H", homeDir, "--once", "--renew-before", renewNow,
+		"--post-renew-hook", hook})
+	util.FatalError(t, err, "The renewer failed")
+	renewed, renewedKeys := readCredential(t, mspDir)
+	assert.NotEqual(t, cert.SerialNumber, renewed.SerialNumber, "The certificate should be renewed")
+	assert.Equal(t, publicKey(t, cert), publicKey(t, renewed), "The key should be reused")
+	assert.Equal(t, keys, renewedKeys, "No key should be generated")
+	out, err := ioutil.ReadFile(hookFile)
+	util.FatalError(t, err, "The post-renew hook should have been run")
+	assert.Equal(t, util.GetSerialAsHex(renewed.SerialNumber)+" "+filepath.Join(mspDir, "signcerts", "cert.pem"),
+		strings.TrimSpace(string(out)))
+
+	// A failing hook does not fail the renewal
+	err = RunMain([]string{cmdName, "renewer", "-u", serverURL, "-H", homeDir, "--once", "--renew-before", renewNow,
+		"--newkey", "--post-renew-hook", "exit 1"})
+	assert.NoError(t, err, "A failure of the hook should not fail the renewer")
+	newKey, newKeys := readCredential(t, mspDir)
+	assert.NotEqual(t, publicKey(t, renewed), publicKey(t, newKey), "A new key should be used")
+	assert.Equal(t, keys+1, newKeys, "The new key should be stored")
+
+	for _, args := range [][]string{
+		{"--renew-fraction", "1.5"},
+		{"--renew-before", "-1h"},
+		{"--retry-interval", "1h", "--max-retry-interval", "1m"},
+		{"--log-format", "json"},
+	} {
+		err = RunMain(append([]string{cmdName, "renewer", "-u", serverURL, "-H", homeDir, "--once"}, args...))
+		if assert.Error(t, err, "The flags %v should be invalid", args) {
+			assert.Equal(t, ExitCodeUsage, ExitCode(err))
+		}
+	}
+}
+
+func TestRenewerFailure(t *testing.T) {
+	homeDir, err := ioutil.TempDir("", "renewerfailure")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(homeDir)
+	srv := setupEnrollTest(t)
+	defer os.RemoveAll(srv.HomeDir)
+
+	err = RunMain([]string{cmdName, "enroll", "-u", enrollURL, "-H", homeDir})
+	util.FatalError(t, err, "Failed to enroll")
+	mspDir := filepath.Join(homeDir, "msp")
+	cert, _ := readCredential(t, mspDir)
+	err = srv.Stop()
+	util.FatalError(t, err, "Failed to stop the server")
+
+	// A failed renewal of a certificate which has not expired is not an error
+	err = RunMain([]string{cmdName, "renewer", "-u", serverURL, "-H", homeDir, "--once", "--renew-before", renewNow})
+	assert.NoError(t, err, "A failed renewal before the certificate expires should not fail")
+	kept, _ := readCredential(t, mspDir)
+	assert.Equal(t, cert.SerialNumber, kept.SerialNumber, "The certificate should be kept")
+
+	// but it is once the certificate has expired
+	renewerNow = func() time.Time { return cert.NotAfter.Add(time.Hour) }
+	defer func() { renewerNow = time.Now }()
+	err = RunMain([]string{cmdName, "renewer", "-u", serverURL, "-H", homeDir, "--once"})
+	util.ErrorContains(t, err, "expired at "+cert.NotAfter.Format(time.RFC3339)+" without being renewed",
+		"The renewer should fail when the certificate expires")
+	assert.Equal(t, ExitCodeNetworkFailure, ExitCode(err))
+	err = RunMain([]string{cmdName, "renewer", "-u", serverURL, "-H", homeDir, "--retry-interval", "10ms"})
+	util.ErrorContains(t, err, "without being renewed", "The renewer should stop when the certificate expires")
+}
+
+func TestRenewerDaemon(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The post-renew hook of the test requires a POSIX shell")
+	}
+	homeDir, err := ioutil.TempDir("", "renewerdaemon")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(homeDir)
+	srv := setupEnrollTest(t)
+	defer stopAndCleanupServer(t, srv)
+
+	err = RunMain([]string{cmdName, "enroll", "-u", enrollURL, "-H", homeDir})
+	util.FatalError(t, err, "Failed to enroll")
+
+	// Each renewed certificate is immediately due again, so it is renewed
+	// after the retry interval until the renewer is stopped
+	hookFile := filepath.Join(homeDir, "hook.out")
+	saveOsArgs := os.Args
+	defer func() { os.Args = saveOsArgs }()
+	os.Args = []string{cmdName, "renewer", "-u", serverURL, "-H", homeDir, "--renew-before", renewNow,
+		"--retry-interval", "100ms", "--post-renew-hook", `echo "$RENEWED_CERT_SERIAL" >> ` + hookFile}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- NewCommand("renewer").ExecuteContext(ctx)
+	}()
+	var serials []string
+	for start := time.Now(); len(serials) < 2 && time.Since(start) < 20*time.Second; time.Sleep(50 * time.Millisecond) {
+		out, _ := ioutil.ReadFile(hookFile)
+		serials = strings.Fields(string(out))
+	}
+	cancel()
+	select {
+	case err = <-done:
+		assert.NoError(t, err, "The renewer should stop without error when its context is canceled")
+	case <-time.After(20 * time.Second):
+		t.Fatal("The renewer did not stop when its context was canceled")
+	}
+	if assert.True(t, len(serials) >= 2, "The certificate should be renewed repeatedly") {
+		assert.NotEqual(t, serials[0], serials[1])
+	}
+	cert, _ := readCredential(t, filepath.Join(homeDir, "msp"))
+	out, err := ioutil.ReadFile(hookFile)
+	util.FatalError(t, err, "Failed to read the output of the hook")
+	renewed := strings.Fields(string(out))
+	assert.Equal(t, util.GetSerialAsHex(cert.SerialNumber), renewed[len(renewed)-1], "The last renewed certificate should be stored")
+}
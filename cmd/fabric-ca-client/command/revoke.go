@@ -17,13 +17,16 @@ limitations under the License.
 package command
 
 import (
-	"path/filepath"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
 
 	"github.com/cloudflare/cfssl/log"
 	"github.com/hyperledger/fabric-ca/api"
-	"github.com/hyperledger/fabric-ca/lib"
 	"github.com/hyperledger/fabric-ca/util"
 	"github.com/spf13/cobra"
 )
@@ -35,6 +38,8 @@ func (c *ClientCmd) newRevokeCommand() *cobra.Command {
 		Use:   "revoke",
 		Short: "Revoke an identity",
 		Long:  "Revoke an identity with Fabric CA server",
+		Example: "fabric-ca-client revoke -e peer1 -r keycompromise --gencrl\n" +
+			"fabric-ca-client revoke -s 1a2b3c -a 4d5e6f -r superseded",
 		// PreRunE block for this command will check to make sure enrollment
 		// information exists before running the command
 		PreRunE: func(cmd *cobra.Command, args []string) error {
@@ -68,14 +73,11 @@ func (c *ClientCmd) newRevokeCommand() *cobra.Command {
 func (c *ClientCmd) runRevoke(cmd *cobra.Command) error {
 	log.Debug("Entered runRevoke")
 
-	var err error
-
-	client := lib.Client{
-		HomeDir: filepath.Dir(c.cfgFileName),
-		Config:  c.clientCfg,
+	cl, err := newClient(c)
+	if err != nil {
+		return err
 	}
-
-	id, err := client.LoadMyIdentity()
+	id, err := cl.LoadIdentity()
 	if err != nil {
 		return err
 	}
@@ -91,23 +93,60 @@ func (c *ClientCmd) runRevoke(cmd *cobra.Command) error {
 		return errInput
 	}
 
+	reason, err := checkRevocationReason(c.clientCfg.Revoke.Reason)
+	if err != nil {
+		return err
+	}
+
 	req := &api.RevocationRequest{
 		Name:   c.clientCfg.Revoke.Name,
 		Serial: c.clientCfg.Revoke.Serial,
 		AKI:    c.clientCfg.Revoke.AKI,
-		Reason: c.clientCfg.Revoke.Reason,
+		Reason: reason,
 		GenCRL: c.revokeParams.GenCRL,
 		CAName: c.clientCfg.CAName,
 	}
-	result, err := id.Revoke(req)
+	result, err := cl.Revoke(c.ctx, id, req)
 
 	if err != nil {
 		return err
 	}
 	log.Infof("Sucessfully revoked certificates: %+v", result.RevokedCerts)
+	printRevokedCerts(os.Stdout, result.RevokedCerts)
 
 	if req.GenCRL {
 		return storeCRL(c.clientCfg, result.CRL)
 	}
 	return nil
 }
+
+// checkRevocationReason returns the name of the revocation reason 'reason',
+// which is case insensitive, or an error listing the valid reasons if it is
+// not one of them. An empty reason is sent as is, which the server treats as
+// "unspecified".
+func checkRevocationReason(reason string) (string, error) {
+	if reason == "" {
+		return "", nil
+	}
+	name := strings.ToLower(reason)
+	if _, ok := util.RevocationReasonCodes[name]; ok {
+		return name, nil
+	}
+	var valid []string
+	for r := range util.RevocationReasonCodes {
+		valid = append(valid, r)
+	}
+	sort.Strings(valid)
+	return "", errors.Errorf("Invalid revocation reason '%s'; the valid reasons are: %s", reason, strings.Join(valid, ", "))
+}
+
+// printRevokedCerts prints the serial number and AKI of each revoked certificate
+func printRevokedCerts(w io.Writer, certs []api.RevokedCert) {
+	if len(certs) == 0 {
+		fmt.Fprintln(w, "No certificates were revoked")
+		return
+	}
+	for _, cert := range certs {
+		fmt.Fprintf(w, "Revoked certificate: serial %s, AKI %s\n", cert.Serial, cert.AKI)
+	}
+}
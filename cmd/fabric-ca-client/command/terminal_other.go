@@ -0,0 +1,21 @@
+// +build !linux,!darwin
+
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package command
+
+import "github.com/pkg/errors"
+
+// isTerminal returns false because terminals are not supported on this
+// platform, so the user is not prompted
+func isTerminal(fd int) bool {
+	return false
+}
+
+func disableEcho(fd int) (func(), error) {
+	return nil, errors.New("Turning off echoing is not supported on this platform")
+}
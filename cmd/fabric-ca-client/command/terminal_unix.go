@@ -0,0 +1,53 @@
+// +build linux darwin
+
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package command
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func getTermios(fd int) (*syscall.Termios, error) {
+	t := &syscall.Termios{}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), ioctlGetTermios, uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return nil, errno
+	}
+	return t, nil
+}
+
+func setTermios(fd int, t *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), ioctlSetTermios, uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// isTerminal returns true if 'fd' is a terminal
+func isTerminal(fd int) bool {
+	_, err := getTermios(fd)
+	return err == nil
+}
+
+// disableEcho turns off echoing of the input of the terminal 'fd' and
+// returns the function which turns it back on
+func disableEcho(fd int) (func(), error) {
+	t, err := getTermios(fd)
+	if err != nil {
+		return nil, err
+	}
+	noEcho := *t
+	noEcho.Lflag &^= syscall.ECHO
+	err = setTermios(fd, &noEcho)
+	if err != nil {
+		return nil, err
+	}
+	return func() { setTermios(fd, t) }, nil
+}
@@ -0,0 +1,90 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package command
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// TokenCmdUsage is the usage text for the token command
+	TokenCmdUsage = "token [--body <file>]"
+	// TokenCmdShortDesc is the short description for the token command
+	TokenCmdShortDesc = "Create the authorization token of a request"
+)
+
+type tokenCmd struct {
+	Command
+	// body is the file containing the body of the request, or "-" for stdin
+	body string
+}
+
+func newTokenCmd(c Command) *tokenCmd {
+	return &tokenCmd{Command: c}
+}
+
+func (c *tokenCmd) getCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   TokenCmdUsage,
+		Short: TokenCmdShortDesc,
+		Long: "Write to stdout the value of the authorization header of a request with the body of the file, " +
+			"signed with the enrollment certificate and key in the msp directory, for sending custom requests to the server",
+		Example: "fabric-ca-client token --body request.json",
+		PreRunE: c.preRunToken,
+		RunE:    c.runToken,
+	}
+	cmd.Flags().StringVar(&c.body, "body", "", "File containing the body of the request, or '-' to read it from stdin; the body is empty if not set")
+	return cmd
+}
+
+func (c *tokenCmd) preRunToken(cmd *cobra.Command, args []string) error {
+	if len(args) > 0 {
+		return errors.Errorf(extraArgsError, args, cmd.UsageString())
+	}
+	err := c.ConfigInit()
+	if err != nil {
+		return err
+	}
+	log.Debugf("Client configuration settings: %+v", c.GetClientCfg())
+	return nil
+}
+
+func (c *tokenCmd) runToken(cmd *cobra.Command, args []string) error {
+	var body []byte
+	var err error
+	switch c.body {
+	case "":
+	case "-":
+		body, err = ioutil.ReadAll(os.Stdin)
+	default:
+		body, err = ioutil.ReadFile(c.body)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Failed to read the body of the request")
+	}
+	id, err := c.LoadMyIdentity()
+	if err != nil {
+		return err
+	}
+	signer := id.GetECert()
+	if signer == nil {
+		return errors.Errorf("The identity '%s' has no enrollment certificate", id.GetName())
+	}
+	token, err := util.CreateToken(id.GetClient().GetCSP(), signer.Cert(), signer.Key(), body)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to create the token")
+	}
+	fmt.Println(token)
+	return nil
+}
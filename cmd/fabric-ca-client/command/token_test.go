@@ -0,0 +1,64 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package command
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenCommand(t *testing.T) {
+	homeDir, err := ioutil.TempDir("", "tokencmd")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(homeDir)
+	mspDir := filepath.Join(homeDir, "msp")
+	srv := setupEnrollTest(t)
+	defer stopAndCleanupServer(t, srv)
+
+	err = RunMain([]string{cmdName, "token", "-H", homeDir, "-M", mspDir})
+	assert.Error(t, err, "A token can't be created before enrolling")
+
+	err = RunMain([]string{cmdName, "enroll", "-u", enrollURL, "-H", homeDir, "-M", mspDir})
+	util.FatalError(t, err, "Failed to enroll")
+
+	body := []byte(`{"id":"tokenuser"}`)
+	bodyFile := filepath.Join(homeDir, "body.json")
+	err = ioutil.WriteFile(bodyFile, body, 0644)
+	util.FatalError(t, err, "Failed to write the body")
+	stdout, err := captureStdout(t, func() error {
+		return RunMain([]string{cmdName, "token", "-H", homeDir, "-M", mspDir, "--body", bodyFile})
+	})
+	util.FatalError(t, err, "Failed to create the token")
+	token := strings.TrimSpace(stdout)
+	cert, err := util.VerifyToken(util.GetDefaultBCCSP(), token, body)
+	if assert.NoError(t, err, "The token should be valid for the body") {
+		assert.Equal(t, "admin", cert.Subject.CommonName)
+	}
+
+	// The token of an empty body authorizes a GET request to the server
+	stdout, err = captureStdout(t, func() error {
+		return RunMain([]string{cmdName, "token", "-H", homeDir, "-M", mspDir})
+	})
+	util.FatalError(t, err, "Failed to create the token")
+	req, err := http.NewRequest("GET", serverURL+"/api/v1/identities/admin", nil)
+	util.FatalError(t, err, "Failed to create the request")
+	req.Header.Set("authorization", strings.TrimSpace(stdout))
+	resp, err := http.DefaultClient.Do(req)
+	util.FatalError(t, err, "Failed to send the request")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "The server should accept the token")
+
+	err = RunMain([]string{cmdName, "token", "-H", homeDir, "-M", mspDir, "--body", filepath.Join(homeDir, "nosuchfile")})
+	util.ErrorContains(t, err, "Failed to read the body", "A missing body file should fail")
+}
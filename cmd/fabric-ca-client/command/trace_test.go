@@ -0,0 +1,77 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package command
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugRedactsHTTPExchanges(t *testing.T) {
+	homeDir, err := ioutil.TempDir("", "debugtrace")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(homeDir)
+	srv := setupEnrollTest(t)
+	defer stopAndCleanupServer(t, srv)
+	basicAuth := base64.StdEncoding.EncodeToString([]byte("admin:adminpw"))
+
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+	err = RunMain([]string{cmdName, "enroll", "-d", "-u", enrollURL, "-H", homeDir})
+	util.FatalError(t, err, "Failed to enroll the admin")
+	err = RunMain([]string{cmdName, "register", "-d", "-H", homeDir, "--id.name", "user1", "--id.secret", "user1secretpw", "--id.affiliation", "hyperledger"})
+	util.FatalError(t, err, "Failed to register user1")
+	err = RunMain([]string{cmdName, "identity", "add", "user2", "-d", "-H", homeDir, "--secret", "user2secretpw", "--affiliation", "hyperledger"})
+	util.FatalError(t, err, "Failed to add user2")
+	err = RunMain([]string{cmdName, "identity", "add", "user5", "-d", "-H", homeDir, "--json", `{"secret": "user5secretpw", "affiliation": "hyperledger"}`})
+	util.FatalError(t, err, "Failed to add user5")
+	// A registration with a generated secret returns it in the response
+	out, err := captureStdout(t, func() error {
+		return RunMain([]string{cmdName, "register", "-d", "-H", homeDir, "--id.name", "user3", "--id.affiliation", "hyperledger"})
+	})
+	util.FatalError(t, err, "Failed to register user3")
+	generated := strings.TrimSpace(strings.TrimPrefix(out, "Password:"))
+	assert.NotEmpty(t, generated)
+	log.SetOutput(os.Stderr)
+
+	logs := logBuf.String()
+	assert.Contains(t, logs, "HTTP request: POST http://localhost:7090/api/v2/enroll")
+	assert.Regexp(t, "HTTP response: 201 Created to POST http://localhost:7090/register in \\S+", logs, "The time of each request should be logged")
+	assert.Contains(t, logs, "Authorization: ****")
+	assert.Contains(t, logs, `"secret":"****"`)
+	for _, secret := range []string{"adminpw", basicAuth, "user1secretpw", "user2secretpw", "user5secretpw"} {
+		assert.NotContains(t, logs, secret, "A secret should not be logged at debug level")
+	}
+	assert.NotContains(t, logs, generated, "A generated secret should not be logged at debug level")
+
+	// The trace file has the full exchanges
+	logBuf.Reset()
+	log.SetOutput(&logBuf)
+	traceFile := filepath.Join(homeDir, "trace.log")
+	err = RunMain([]string{cmdName, "register", "-H", homeDir, "--trace-file", traceFile, "--id.name", "user4", "--id.secret", "user4secretpw", "--id.affiliation", "hyperledger"})
+	log.SetOutput(os.Stderr)
+	util.FatalError(t, err, "Failed to register user4")
+	assert.Contains(t, logBuf.String(), "it contains enrollment secrets", "Writing a trace file should be warned about")
+	assert.NotContains(t, logBuf.String(), "user4secretpw")
+	trace, err := ioutil.ReadFile(traceFile)
+	util.FatalError(t, err, "Failed to read the trace file")
+	assert.Contains(t, string(trace), "POST http://localhost:7090/register")
+	assert.Contains(t, string(trace), "user4secretpw")
+	info, err := os.Stat(traceFile)
+	util.FatalError(t, err, "Failed to stat the trace file")
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "Only the owner should read the trace file")
+}
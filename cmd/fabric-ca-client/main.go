@@ -25,6 +25,6 @@ import (
 // The fabric-ca client main
 func main() {
 	if err := command.RunMain(os.Args); err != nil {
-		os.Exit(1)
+		os.Exit(command.ExitCode(err))
 	}
 }
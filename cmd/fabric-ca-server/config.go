@@ -52,6 +52,9 @@ const (
 #      b) FABRIC_CA_SERVER_CA_KEYFILE="../mykey.pem"
 #         To set the "keyfile" element in the "ca" section below;
 #         note the '_' separator character.
+#      The legacy FABRIC_COP_ prefix is also accepted, but FABRIC_CA_SERVER_
+#      variables take precedence over it. An invalid value, such as
+#      FABRIC_CA_SERVER_DEBUG=yes, stops the server from starting.
 #   3) configuration file
 #   4) default value (if there is one)
 #      All default values are shown beside each element below.
@@ -66,29 +69,432 @@ const (
 #   absolute path, it is interpretted as being relative to the location
 #   of this configuration file.
 #
+#   RELOADING THE CONFIGURATION
+#   ---------------------------
+#   This file is re-read when the server receives a SIGHUP signal. The
+#   signing profiles, registry.maxenrollments, crl.expiry, the cfg section,
+#   crlsizelimit, shutdowntimeout, debug and the log section take effect
+#   immediately; changes to other elements require a restart.
+#
 #############################################################################
 
 # Version of config file
 version: <<<VERSION>>>
 
-# Server's listening port (default: 7054)
+# Server's listening port (default: 7054); if 0, a free port is chosen, which
+# is logged and written to the file specified by 'listeners.addressfile'
 port: 7054
 
+# Path prefix under which the endpoints are served, for a server behind a
+# reverse proxy which forwards a path to it; for example, /ca when requests
+# for https://gw.example.com/ca/ are forwarded to the server. The endpoints
+# are then at /ca/api/v1/..., as are the operations and debug endpoints
+# unless they have their own listener, and clients use the URL of the proxy
+# with its path, such as https://gw.example.com/ca (default: none)
+basepath:
+
+#############################################################################
+#  Listeners section
+#
+#  addresses - additional addresses on which the server accepts requests,
+#     each either host:port or unix://path for a Unix domain socket; a
+#     relative socket path is relative to the server's home directory. TCP
+#     addresses use the TLS settings of the server's listening port, but Unix
+#     domain sockets are served without TLS, so access to them must be
+#     restricted by their file permissions
+#  socketmode - file permissions (in octal) of the Unix domain sockets,
+#     which are removed when the server stops (default: 0660)
+#  addressfile - file to which the addresses on which the server listens are
+#     written as a JSON object once it is listening, with the fields 'url',
+#     'address', 'port', 'operations' and 'additional'. Ports configured as 0
+#     are the ones chosen by the server, so a test harness can start the
+#     server on a free port and read its address from this file. The file is
+#     removed when the server stops; a relative path is relative to the
+#     server's home directory
+#############################################################################
+listeners:
+  addresses:
+  socketmode: "0660"
+  addressfile:
+
 # Enables debug logging (default: false)
 debug: false
 
+#############################################################################
+#  Logging section
+#
+#  format - 'text' (the default) or 'json', which writes each log message
+#     as a JSON object on one line with the keys 'ts', 'level' and 'msg'; the
+#     message logged for each request also has the keys 'request_id',
+#     'identity', 'path', 'method', 'remote', 'status', 'duration_ms' and
+#     'size'. The request ID is returned in the X-Request-Id response header,
+#     and a panic while handling a request is logged with it; or 'journal',
+#     which prefixes each message with its syslog priority rather than a
+#     timestamp, for a server run by systemd
+#  level - debug, info, warning, error, critical or fatal; if not set, info,
+#     or debug if 'debug' is true
+#  file - file to which log messages are written; if not set, standard error
+#  bodylimit - maximum number of bytes of a request or response body which
+#     are logged or included in an error message, after which the body is
+#     truncated; binary bodies are replaced by their size
+#  syslog - forwards the log messages, and the audit events of the
+#     authentication and authorization of requests, to a syslog endpoint in
+#     the format of RFC 5424
+#    address - unix:///dev/log for the local syslog daemon, udp://host[:514],
+#       tcp://host[:514], or tls://host[:6514] for TCP with TLS; if not set,
+#       log messages are not forwarded
+#    facility - kern, user, daemon, auth, authpriv, syslog, or local0 to local7
+#    appname - application name of the forwarded messages
+#    queuesize - maximum number of messages waiting to be forwarded; while
+#       the endpoint is slow or unreachable, further messages are dropped
+#       rather than delaying requests, and are counted by the metric
+#       fabric_ca_log_messages_dropped_total
+#    tls - the trusted certificate files and client certificate used to
+#       connect with TLS; if no certificate files are set, the system's
+#       trusted roots are used
+#
+#  The fields of a message are its structured data with the ID
+#  'fabric-ca@32473'. Audit events have the message ID 'audit' and the field
+#  'event': 'authentication_success' with the severity informational, or
+#  'authentication_failure' or 'authorization_failure' with the severity
+#  warning; they are forwarded whatever the log level.
+#############################################################################
+log:
+  format: text
+  level:
+  file:
+  bodylimit: 2048
+  syslog:
+    address:
+    facility: local0
+    appname: fabric-ca-server
+    queuesize: 1000
+    tls:
+      certfiles:
+      client:
+        certfile:
+        keyfile:
 # Size limit of an acceptable CRL in bytes (default: 512000)
 crlsizelimit: 512000
 
+# Maximum time to wait for in-flight requests to complete when the server
+# receives SIGTERM or SIGINT; requests still running after this time are
+# aborted (default: 30s)
+shutdowntimeout: 30s
+
+#############################################################################
+#  HTTP section
+#
+#  Timeouts and limits of the server's connections, which keep clients that
+#  open connections without completing their requests from holding them open
+#  forever. A setting of 0 gets its default value.
+#
+#  readheadertimeout - maximum time to read the headers of a request
+#  readtimeout - maximum time to read a request, including its body
+#  writetimeout - maximum time from the end of reading the headers of a
+#     request to the end of writing its response. It applies to every
+#     request, so it must be long enough to sign the largest batch of
+#     TCerts that the 'tcert' endpoint is asked for
+#  idletimeout - maximum time to wait for the next request on a keep-alive
+#     connection
+#  maxheaderbytes - maximum size in bytes of the headers of a request
+#  maxbodysize - maximum size in bytes of the body of a request. A request
+#     whose body is larger is rejected with a 413 status code, before its
+#     body is read if its length is sent in the 'Content-Length' header
+#  maxbodysizes - maximum sizes in bytes of the bodies of the requests to
+#     endpoints, such as 'enroll' or 'est/simpleenroll', which override
+#     'maxbodysize' for these endpoints
+#  bodyreadtimeout - maximum time to read the body of a request. A client
+#     which is still sending the body after this time, such as one which
+#     sends it a byte at a time, is cut off with a 408 status code
+#  disablecompression - if true, responses are not compressed and request
+#     bodies compressed with gzip are rejected. Otherwise, the responses of
+#     at least 'compressionminsize' bytes to clients which send
+#     'Accept-Encoding: gzip' are compressed, and request bodies with
+#     'Content-Encoding: gzip' are decompressed before the authorization
+#     token, which is over the uncompressed body, is verified
+#  compressionminsize - minimum size in bytes of a compressed response
+#  maxdecompressedbodysize - maximum size in bytes of a gzip request body
+#     once decompressed, which keeps a small compressed body from
+#     decompressing into an unbounded amount of memory
+#  cachemaxage - time for which clients may use the CA information and the
+#     published CRL without revalidating them, as sent in the
+#     'Cache-Control' header of their responses. The responses have an
+#     'ETag', so that a client revalidating its copy with 'If-None-Match'
+#     gets a 304 response without a body if it is unchanged
+#############################################################################
+http:
+  readheadertimeout: 10s
+  readtimeout: 60s
+  writetimeout: 5m
+  idletimeout: 120s
+  maxheaderbytes: 1048576
+  maxbodysize: 10485760
+  maxbodysizes:
+  #  est/simpleenroll: 65536
+  bodyreadtimeout: 30s
+  disablecompression: false
+  compressionminsize: 1024
+  maxdecompressedbodysize: 10485760
+  cachemaxage: 60s
+
+#############################################################################
+#  API section
+#
+#  The server serves the v1 and v2 versions of its REST API; the v1
+#  endpoints are also served without a version prefix. A v1 endpoint which
+#  is superseded by a v2 endpoint, such as /api/v1/enroll by /api/v2/enroll,
+#  is deprecated: its responses have the 'Deprecation' header and a 'Link'
+#  header to the v2 endpoint.
+#
+#  sunset - date, as YYYY-MM-DD, after which the deprecated v1 endpoints may
+#     be removed, which is sent in the 'Sunset' header of their responses
+#  legacyerrors - if true, errors are returned in the cfssl response format
+#     of previous versions rather than in error envelopes
+#############################################################################
+api:
+  sunset:
+  legacyerrors: false
+
+#############################################################################
+#  Concurrency section
+#
+#  Limits the number of requests which an endpoint handles at the same time,
+#  so that a burst of expensive requests such as 'enroll' or 'tcert' can't
+#  exhaust the server's CPU. Each key is the name of an endpoint, such as
+#  'enroll', 'reenroll', 'tcert' or 'idemix/credential'; endpoints which are
+#  not listed have no limit.
+#
+#  max - maximum number of requests handled at the same time
+#  mode - what happens to requests beyond the maximum: 'queue' (the
+#     default), in which they wait for a request in progress to complete, or
+#     'reject', in which they are rejected immediately with a 503 error and a
+#     Retry-After header
+#  queuedepth - in queue mode, maximum number of waiting requests, beyond
+#     which requests are rejected; if 0, the same as 'max'
+#  queuetimeout - in queue mode, maximum time that a request waits before it
+#     is rejected (default: 30s)
+#  retryafter - time after which rejected clients are told to retry
+#     (default: 1s)
+#############################################################################
+concurrency:
+#  enroll:
+#    max: 20
+#    mode: queue
+#    queuedepth: 100
+#    queuetimeout: 10s
+#  tcert:
+#    max: 4
+#    mode: reject
+#    retryafter: 5s
+
+#############################################################################
+#  Events section
+#
+#  The server posts a JSON event to each subscription when an identity is
+#  registered (identity.registered), modified (identity.modified) or removed
+#  (identity.removed), and when a certificate is issued by an enrollment
+#  (cert.issued) or reenrollment (cert.reenrolled) or is revoked
+#  (cert.revoked). Each event has a unique ID, which is also sent in the
+#  X-Fabric-CA-Event-ID header and is the same in each attempt to send it.
+#  An event which is not delivered by the last attempt, or which does not fit
+#  in the queue, is written to the spool and sent again when the server starts.
+#
+#  queuesize - maximum number of events waiting to be sent to a subscription
+#  spooldir - directory of the undelivered events, relative to the home
+#     directory
+#  subscriptions - the webhooks to which events are posted:
+#     url - the http or https URL to which events are posted
+#     events - the types of the events which are sent; all if empty
+#     secret - if set, the X-Fabric-CA-Signature header of each request is
+#        'sha256=' followed by the hex HMAC-SHA256 of the body with it
+#     timeout - maximum time to wait for a response (default: 10s)
+#     retry - maxattempts (default: 5), and basedelay (default: 1s) and
+#        maxdelay (default: 1m) of the exponential backoff between attempts
+#  kafka - the Kafka topics to which events are published; each event is a
+#     message whose key is the enrollment ID of its identity, so the events
+#     of an identity are in the same partition, and whose headers are
+#     X-Fabric-CA-Event-ID and X-Fabric-CA-Event-Type. Only the servers
+#     built with the 'kafka' tag support them:
+#     brokers - the host:port of the bootstrap brokers
+#     topic - the topic to which events are published
+#     clientid - the client ID of the requests (default: fabric-ca-server)
+#     requiredacks - -1 to wait for all in-sync replicas (default) or 1 to
+#        wait for the leader only
+#     timeout - maximum time to wait for a broker (default: 10s)
+#     tls - the TLS settings of the connections to the brokers; the system
+#        roots are trusted if no certfiles are set
+#     sasl - mechanism (PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512), username
+#        and password of the SASL authentication, if any
+#     events - the types of the events which are published; all if empty
+#     batchsize - maximum number of events in a request (default: 100)
+#     batchtimeout - maximum time to wait for a batch to fill (default: 100ms)
+#     retry - the retries of a failed request, as for a webhook
+#  The number of events delivered, failed and spooled of each subscription
+#  are the fabric_ca_events_delivered_total,
+#  fabric_ca_event_delivery_failures_total and fabric_ca_events_spooled_total
+#  metrics.
+#############################################################################
+events:
+  queuesize: 1000
+  spooldir: events
+  subscriptions:
+#    - url: https://hooks.example.com/fabric-ca
+#      events:
+#        - cert.issued
+#        - cert.revoked
+#      secret: hooksecret
+#      timeout: 10s
+#      retry:
+#        maxattempts: 5
+#        basedelay: 1s
+#        maxdelay: 1m
+  kafka:
+#    - brokers:
+#        - kafka1.example.com:9093
+#      topic: fabric-ca-events
+#      tls:
+#        enabled: true
+#        certfiles:
+#      sasl:
+#        mechanism: SCRAM-SHA-512
+#        username: fabric-ca
+#        password: kafkapassword
+#      batchsize: 100
+#      batchtimeout: 100ms
+
+#############################################################################
+#  CORS section
+#
+#  If enabled, the server sends the CORS (Cross-Origin Resource Sharing)
+#  headers which allow browser-based clients, such as an administration
+#  console, served from the allowed origins to call its endpoints. Preflight
+#  (OPTIONS) requests are answered without authentication; the actual
+#  requests are authenticated as usual.
+#
+#  allowedorigins - origins from which browsers may call the server, such as
+#     https://console.example.com; an origin may have a '*' matching any part
+#     of it, such as https://*.example.com, and '*' allows any origin
+#  allowedmethods - methods allowed in cross-origin requests (default: GET,
+#     HEAD, POST, PUT, DELETE)
+#  allowedheaders - headers allowed in cross-origin requests (default:
+#     Authorization, Content-Type, Accept)
+#  maxage - time for which browsers may cache the answer to a preflight request
+#  allowcredentials - allow browsers to send credentials such as cookies and
+#     TLS client certificates; may not be used with the origin '*'
+#############################################################################
+cors:
+  enabled: false
+  allowedorigins:
+  allowedmethods:
+  allowedheaders:
+  maxage: 10m
+  allowcredentials: false
+
+#############################################################################
+#  Operations section
+#
+#  The liveness endpoint (GET /healthz) returns 200 while the server process
+#  is running. The readiness endpoint (GET /readyz) returns 200 when the user
+#  registry, certificate database and signer of every CA are available, and
+#  503 with the status of each component otherwise or while the server is
+#  shutting down. The metrics endpoint (GET /metrics) returns the number,
+#  duration and response size of the requests to each API endpoint in the
+#  Prometheus text format. None of these endpoints requires authentication.
+#
+#  listenaddress - if set (host:port), the operations endpoints are served
+#     over HTTP on this address rather than on the server's port
+#  healthcheckinterval - interval at which the components are checked; the
+#     readiness endpoint reports the result of the most recent check
+#############################################################################
+operations:
+  listenaddress:
+  healthcheckinterval: 10s
+
+#############################################################################
+#  Profiling section
+#
+#  If enabled, the net/http/pprof profiles (GET /api/v1/debug/pprof/),
+#  the expvar variables (GET /api/v1/debug/vars) and a dump of the stacks
+#  of all goroutines (GET /api/v1/debug/goroutines) are served to identities
+#  with the hf.Admin attribute, which must authenticate with a token as for
+#  the other administrative endpoints.
+#
+#  enabled - whether the profiling endpoints are served at all
+#  operations - if true, the profiling endpoints are served under /debug/
+#     on operations.listenaddress, which must then be a loopback address
+#     such as 127.0.0.1:9443, rather than on the server's port
+#############################################################################
+profiling:
+  enabled: false
+  operations: false
+
+#############################################################################
+#  Admin section
+#
+#  The administration endpoints reload the TLS certificate and configuration
+#  (POST /reload), get or set the log level (GET or PUT /loglevel), run the
+#  self-test (POST /selftest), purge expired records (POST /purge) and stream
+#  a backup of the database (GET /backup). If listenaddress is not set, they
+#  are served on the server's port to identities with the hf.Admin attribute.
+#  If it is set, they are served only on that listener and not on the
+#  server's port, and each request to them is authorized by the listener:
+#
+#  listenaddress - either host:port, which must be a loopback address such as
+#     127.0.0.1:7055 unless allowremote is true, or unix://path for a Unix
+#     domain socket, whose permissions are 'listeners.socketmode'
+#  secret - the value which each request to a host:port listener must have
+#     in the X-Fabric-CA-Admin-Secret header; optional for a Unix domain socket
+#  allowremote - allow listenaddress to be an address which is not a
+#     loopback address; requests to it are not encrypted
+#  swaggerui - URL of a Swagger UI distribution, such as
+#     https://unpkg.com/swagger-ui-dist@3, from which the listener's /swagger/
+#     page loads its scripts and styles to browse the API document; the page
+#     is not served if it is not set
+#############################################################################
+admin:
+  listenaddress:
+  secret:
+  allowremote: false
+  swaggerui:
+
+#############################################################################
+#  gRPC section
+#
+#  If listenaddress (host:port) is set, the core operations of the REST API
+#  (enroll, reenroll, register, revoke, cainfo and gencrl) are also served
+#  by the CA service of api/capb/ca.proto on that listener, with the server's
+#  TLS configuration, including the verification of client certificates.
+#  The credentials of a call are in its "authorization" metadata, as those
+#  of a REST request are in its Authorization header.
+#  Each call is handled as a request to the REST endpoint of its operation,
+#  whose body size and concurrency limits apply to it.
+#############################################################################
+grpc:
+  listenaddress:
+
 #############################################################################
 #  TLS section for the server's listening port
 #
 #  The following types are supported for client authentication: NoClientCert,
 #  RequestClientCert, RequireAnyClientCert, VerifyClientCertIfGiven,
-#  and RequireAndVerifyClientCert.
+#  and RequireAndVerifyClientCert. The types None, Request, and
+#  Require-And-Verify are accepted as aliases.
 #
 #  Certfiles is a list of root certificate authorities that the server uses
-#  when verifying client certificates.
+#  when verifying client certificates; it is required for the
+#  VerifyClientCertIfGiven and RequireAndVerifyClientCert types.
+#
+#  The minversion and maxversion properties bound the TLS protocol versions
+#  accepted by the server (1.0, 1.1, 1.2 or 1.3). The ciphersuites property
+#  is a list of cipher suite names (e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256);
+#  when empty, a default set of strong cipher suites is used. The
+#  curvepreferences property is a list of elliptic curves (P256, P384, P521
+#  and X25519) in order of preference.
+#
+#  The TLS certificate and key are reloaded when the server receives
+#  a SIGHUP signal, so a renewed certificate may be put in place without
+#  restarting the server.
 #############################################################################
 tls:
   # Enable TLS (default: false)
@@ -96,10 +502,57 @@ tls:
   # TLS for the server's listening port
   certfile:
   keyfile:
+  minversion: 1.2
+  maxversion: 1.2
+  ciphersuites:
+  curvepreferences:
   clientauth:
     type: noclientcert
     certfiles:
 
+#############################################################################
+#  Vault section
+#
+#  The server reads the secrets which its configuration references as
+#  vault:<path>#<key> from HashiCorp Vault: the value of the field <key> of
+#  the secret at <path>, such as vault:secret/data/ca#cert for a version 2
+#  KV secret. The db.datasource of a CA may be such a reference, or contain
+#  references of the form ${vault:<path>#<key>}, such as
+#  "host=db user=${vault:database/creds/ca#username} password=${vault:database/creds/ca#password}".
+#  The tls.certfile and tls.keyfile may both reference the PEM of the
+#  server's TLS certificate and key.
+#
+#  The secrets are read when the server starts, failing the start if they
+#  cannot be, and again when it receives a SIGHUP signal. The leases of
+#  secrets such as the credentials of the database secrets engine are
+#  renewed; when a lease cannot be renewed further, the secret is read
+#  again and the CA's database connections are reopened with the new
+#  credentials before the old ones expire. A failure to renew a lease is
+#  reported by the readiness endpoint until the lease expires.
+#
+#  auth: 'token' to authenticate with the token, which may be given as
+#    env:<variable> or file:<path> and is read from VAULT_TOKEN if not set;
+#    or 'kubernetes' to log in as 'role' with the Kubernetes service account
+#    token in 'jwtfile' to the kubernetes auth method mounted at 'mount'
+#  namespace: the Vault Enterprise namespace of the secrets
+#  tls: with an https address, the certificate of Vault is verified with
+#    the trusted certificate files, or else the system's roots
+#############################################################################
+vault:
+  address:
+  auth: token
+  token:
+  role:
+  mount: kubernetes
+  jwtfile: /var/run/secrets/kubernetes.io/serviceaccount/token
+  namespace:
+  timeout: 10s
+  tls:
+    certfiles:
+    client:
+      certfile:
+      keyfile:
+
 #############################################################################
 #  The CA section contains information related to the Certificate Authority
 #  including the name of the CA, which should be unique for all members
@@ -130,6 +583,87 @@ crl:
   # specified by this property is added to the UTC time, the resulting time
   # is used to set the 'Next Update' date of the CRL.
   expiry: 24h
+  # File to which the CRL of all the revoked certificates is published each
+  # time it is generated, and from which the unauthenticated crl endpoint
+  # serves it. A relative path is relative to the CA's home directory.
+  # The CRL is not published if it is not set.
+  publishfile:
+
+#############################################################################
+#  Clients may send an Idempotency-Key header with register and revoke
+#  requests so that they can safely retry them. The response to such a
+#  request is kept for 'retention' and returned, rather than the request
+#  being processed again, to a request with the same key and body. A
+#  request with the same key but another body is rejected. A retention of
+#  0 ignores idempotency keys.
+#############################################################################
+idempotency:
+  retention: 24h
+
+#############################################################################
+#  The rollover section is used when the CA's key is replaced by the
+#  "fabric-ca-server rekey" command. The CA's previous certificate is stored
+#  in 'previouscertfile'. Until the 'cutover' UTC timestamp (in RFC3339
+#  format) the previous certificate is included in the CA chain and the
+#  certificates issued under the previous key are accepted; after it, they
+#  are rejected. If 'cutover' is not set, there is no key rollover.
+#############################################################################
+rollover:
+  # Certificate of the CA's previous key (default: ca-cert-previous.pem)
+  previouscertfile:
+  cutover:
+
+#############################################################################
+#  The scep section enables the CA's responder of the Simple Certificate
+#  Enrollment Protocol (SCEP) for network devices, served at /scep (or
+#  /scep/<caname> for a CA other than the default). The challenge password
+#  of a request is the enrollment secret of the identity in the CSR's common
+#  name; a request signed by a certificate of the CA is a renewal. The
+#  responder's RSA certificate 'certfile' must be issued by the CA, and
+#  'profile' is the signing profile of the certificates it issues (the
+#  default profile if not set).
+#############################################################################
+scep:
+  enabled: false
+  profile:
+  # RSA certificate and key of the SCEP responder (default: scep-cert.pem and scep-key.pem)
+  certfile:
+  keyfile:
+
+#############################################################################
+#  The est section enables the CA's responder of Enrollment over Secure
+#  Transport (EST, RFC 7030), served at /.well-known/est (or
+#  /.well-known/est/<caname> for a CA other than the default). A
+#  simpleenroll request is authenticated by the enrollment secret of the
+#  identity in the CSR's common name, and a simplereenroll request by its TLS
+#  client certificate, which requires 'tls.clientauth.type' to verify client
+#  certificates issued by the CA. 'profile' is the signing profile of the
+#  certificates issued by the responder (the default profile if not set).
+#############################################################################
+est:
+  enabled: false
+  profile:
+
+#############################################################################
+#  The spiffe section makes the certificates issued by the CA with the
+#  SPIFFE signing profile X.509 SPIFFE Verifiable Identity Documents
+#  (X.509-SVIDs) of the trust domain 'trustdomain'. The only URI of an
+#  X.509-SVID is the SPIFFE ID spiffe://<trustdomain><path>, where the path
+#  is the template 'path' with the ID, Type and Affiliation (whose levels
+#  are separated by '/') of the identity, and the empty levels of the path
+#  are removed. An X.509-SVID has no email address, and only the DNS names
+#  and IP addresses of 'hosts', where '*.' matches a single label. CSRs
+#  with other names are rejected. The signing profile 'profile' is created,
+#  with the digital signature, key encipherment, key agreement, server auth
+#  and client auth usages and an expiry of 1h, if it does not exist; if it
+#  does, it may not have the cert sign or crl sign usages. The expiry of the
+#  profile is the maximum validity of an X.509-SVID.
+#############################################################################
+spiffe:
+  trustdomain:
+  profile: spiffe
+  path: "/{{.Affiliation}}/{{.ID}}"
+  hosts:
 
 #############################################################################
 #  The registry section controls how the fabric-ca-server does two things:
@@ -167,6 +701,7 @@ registry:
           hf.GenCRL: true
           hf.Registrar.Attributes: "*"
           hf.AffiliationMgr: true
+          hf.Admin: true
 
 #############################################################################
 #  Database section
@@ -377,6 +912,11 @@ idemix:
 #############################################################################
 # BCCSP (BlockChain Crypto Service Provider) section is used to select which
 # crypto library implementation to use
+#
+# To store the CA signing key in an HSM, set 'default' to PKCS11 and add a
+# pkcs11 section with the 'library', 'label' and 'pin' of the token (requires
+# a server built with the pkcs11 build tag). The pin may be given as
+# 'env:<variable>' or 'file:<path>' so that it is not stored in this file.
 #############################################################################
 bccsp:
     default: SW
@@ -387,6 +927,39 @@ bccsp:
             # The directory used for the software file-based keystore
             keystore: msp/keystore
 
+#############################################################################
+# KMS section is used to hold the CA signing key in a cloud key management
+# service rather than in BCCSP. The key is created in the KMS with its own
+# tools; the CA only gets its public key and asks the KMS to sign with it.
+#
+# provider: 'aws' for AWS KMS or 'gcp' for GCP Cloud KMS; if empty, the key
+#   is held by BCCSP
+# keyid: the ARN of the AWS KMS key, or the resource name of the GCP Cloud KMS
+#   key version (projects/<p>/locations/<l>/keyRings/<r>/cryptoKeys/<k>/cryptoKeyVersions/<v>)
+# region: the AWS region of the key, if it is not in the key's ARN
+# endpoint: the URL of the KMS API, if it is not the provider's public endpoint
+#
+# The credentials are found as the provider's SDKs find them: for AWS, in the
+# AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables, the
+# shared credentials file, or the role of the ECS task or EC2 instance; for
+# GCP, in the file named by GOOGLE_APPLICATION_CREDENTIALS, the gcloud
+# application default credentials, or the service account of the GCE instance.
+#
+# If the CA certificate file does not exist, a root CA's certificate is
+# self-signed with the KMS key; an intermediate CA's certificate must be
+# issued by its parent for the KMS key and stored in the file beforehand.
+# Requests which fail with a transient error are retried up to 'maxattempts'
+# times, with a delay starting at 'basedelay' and doubling after each retry.
+#############################################################################
+kms:
+  provider:
+  keyid:
+  region:
+  endpoint:
+  timeout: 10s
+  maxattempts: 3
+  basedelay: 200ms
+
 #############################################################################
 # Multi CA section
 #
@@ -483,8 +1056,13 @@ func (s *ServerCmd) configInit() (err error) {
 
 	log.Debugf("Home directory: %s", s.homeDirectory)
 
-	// If the config file doesn't exist, create a default one
+	// If the config file doesn't exist, create a default one, except for the
+	// validate and config commands, which have nothing to inspect, and the
+	// setup command, whose BCCSP must be configured first
 	if !util.FileExists(s.cfgFileName) {
+		if s.name == validate || s.name == configCommand || s.name == setupCommand {
+			return errors.Errorf("Configuration file '%s' does not exist", s.cfgFileName)
+		}
 		err = s.createDefaultConfigFile()
 		if err != nil {
 			return errors.WithMessage(err, "Failed to create default configuration file")
@@ -494,12 +1072,38 @@ func (s *ServerCmd) configInit() (err error) {
 		log.Infof("Configuration file location: %s", s.cfgFileName)
 	}
 
+	// Check the environment variables which override settings before reading
+	// the config, so that an invalid value is reported with its variable's name
+	envOverrides, err := lib.GetEnvOverrides(os.Environ())
+	if err != nil {
+		return err
+	}
+
 	// Read the config
 	s.myViper.AutomaticEnv() // read in environment variables that match
 	err = lib.UnmarshalConfig(s.cfg, s.myViper, s.cfgFileName, true)
 	if err != nil {
 		return err
 	}
+	// Settings in the environment override those in the config file, and
+	// command line flags override both
+	err = envOverrides.Apply(s.cfg, s.isSetOnCommandLine)
+	if err != nil {
+		return err
+	}
+	s.provenance, err = lib.NewConfigProvenance(s.cfgFileName, envOverrides, s.isSetOnCommandLine)
+	if err != nil {
+		return err
+	}
+	s.flagOverrides, err = lib.GetFlagOverrides(s.cfg, s.isSetOnCommandLine)
+	if err != nil {
+		return err
+	}
+	// Settings which are misspelled are otherwise silently ignored
+	err = lib.WarnUnknownConfigSettings(s.cfgFileName)
+	if err != nil {
+		return err
+	}
 
 	// The pathlength field controls how deep the CA hierarchy when requesting
 	// certificates. If it is explicitly set to 0, set the PathLenZero field to
@@ -519,6 +1123,13 @@ func (s *ServerCmd) configInit() (err error) {
 	return nil
 }
 
+// isSetOnCommandLine returns true if the flag of the setting at 'path' is
+// set on the command line
+func (s *ServerCmd) isSetOnCommandLine(path string) bool {
+	flag := s.rootCmd.PersistentFlags().Lookup(path)
+	return flag != nil && flag.Changed
+}
+
 func (s *ServerCmd) createDefaultConfigFile() error {
 	var user, pass string
 	// If LDAP is enabled, authentication of enrollment requests are performed
@@ -17,7 +17,9 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -232,6 +234,213 @@ func TestDBLocation(t *testing.T) {
 	os.Unsetenv("FABRIC_CA_SERVER_DB_DATASOURCE")
 }
 
+// Test the precedence of the config file, environment variables and command
+// line flags
+func TestEnvPrecedence(t *testing.T) {
+	blockingStart = false
+	os.Unsetenv(homeEnvVar)
+	os.Unsetenv("CA_CFG_PATH")
+	const homeDir = "envPrecedence"
+	os.RemoveAll(homeDir)
+	defer os.RemoveAll(homeDir)
+	err := os.MkdirAll(homeDir, 0755)
+	util.FatalError(t, err, "Failed to create directory")
+	cfgFile := filepath.Join(homeDir, "fabric-ca-server-config.yaml")
+	cfgYaml := "port: 7060\ncrlsizelimit: 2000\nca:\n  name: fileca\n  keyfile: ca-key.pem\n"
+	err = ioutil.WriteFile(cfgFile, []byte(cfgYaml), 0644)
+	util.FatalError(t, err, "Failed to write config file")
+
+	envs := map[string]string{
+		"FABRIC_CA_SERVER_PORT":         "7070",
+		"FABRIC_COP_CA_NAME":            "envca",
+		"FABRIC_CA_SERVER_CRLSIZELIMIT": "1000",
+	}
+	for name, value := range envs {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	saveOsArgs := os.Args
+	defer func() { os.Args = saveOsArgs }()
+	os.Args = []string{cmdName, "init", "-c", cfgFile, "-p", "7080", "-b", "admin:adminpw"}
+	scmd := NewCommand("init", blockingStart)
+	err = scmd.Execute()
+	util.FatalError(t, err, "Failed to initialize the server")
+	assert.Equal(t, 7080, scmd.cfg.Port, "Command line flags should take precedence over the environment")
+	assert.Equal(t, "envca", scmd.cfg.CAcfg.CA.Name, "The environment should take precedence over the config file")
+	assert.Equal(t, 1000, scmd.cfg.CRLSizeLimit, "The environment should take precedence over the config file")
+
+	// An invalid value fails and names its environment variable
+	os.Setenv("FABRIC_CA_SERVER_DEBUG", "maybe")
+	defer os.Unsetenv("FABRIC_CA_SERVER_DEBUG")
+	err = RunMain([]string{cmdName, "init", "-c", cfgFile, "-b", "admin:adminpw"})
+	util.ErrorContains(t, err, "FABRIC_CA_SERVER_DEBUG", "An invalid environment variable should fail")
+}
+
+func TestValidateCommand(t *testing.T) {
+	const homeDir = "validateHome"
+	os.RemoveAll(homeDir)
+	defer os.RemoveAll(homeDir)
+	err := os.MkdirAll(homeDir, 0755)
+	util.FatalError(t, err, "Failed to create directory")
+	cfgFile := filepath.Join(homeDir, "fabric-ca-server-config.yaml")
+
+	err = RunMain([]string{cmdName, "validate", "-c", cfgFile})
+	util.ErrorContains(t, err, "does not exist", "Validating a config file which does not exist should fail")
+
+	err = ioutil.WriteFile(cfgFile, []byte("ca:\n  name: validca\n"), 0644)
+	util.FatalError(t, err, "Failed to write config file")
+	err = RunMain([]string{cmdName, "validate", "-c", cfgFile})
+	assert.NoError(t, err, "Validating a valid config file should succeed")
+	err = RunMain([]string{cmdName, "validate", "-c", cfgFile, "--format", "xml"})
+	util.ErrorContains(t, err, "Invalid format", "An invalid report format should fail")
+
+	err = ioutil.WriteFile(cfgFile, []byte("ca:\n  name: validca\ndb:\n  type: oracle\nlog:\n  format: xml\n"), 0644)
+	util.FatalError(t, err, "Failed to write config file")
+	err = RunMain([]string{cmdName, "validate", "-c", cfgFile, "--format", "json"})
+	util.ErrorContains(t, err, "2 problems found", "Validating an invalid config file should report all of its problems")
+	assert.False(t, util.FileExists(filepath.Join(homeDir, "fabric-ca-server.db")), "Validating should not create the database")
+}
+
+func TestSetupKeygenCommand(t *testing.T) {
+	const homeDir = "keygenHome"
+	os.RemoveAll(homeDir)
+	defer os.RemoveAll(homeDir)
+	err := os.MkdirAll(homeDir, 0755)
+	util.FatalError(t, err, "Failed to create directory")
+	cfgFile := filepath.Join(homeDir, "fabric-ca-server-config.yaml")
+	csrFile := filepath.Join(homeDir, "ca.csr")
+
+	err = RunMain([]string{cmdName, "setup", "keygen", "-c", cfgFile, "--csr", csrFile})
+	util.ErrorContains(t, err, "does not exist", "Generating a key without a config file should fail")
+
+	err = ioutil.WriteFile(cfgFile, []byte("ca:\n  name: keygenca\ncsr:\n  cn: keygenca\n"), 0644)
+	util.FatalError(t, err, "Failed to write config file")
+	err = RunMain([]string{cmdName, "setup", "keygen", "-c", cfgFile})
+	util.ErrorContains(t, err, "--csr", "Generating a key without the --csr flag should fail")
+	err = RunMain([]string{cmdName, "setup", "keygen", "-c", cfgFile, "--csr", csrFile})
+	assert.NoError(t, err, "Generating a key should succeed")
+	assert.True(t, util.FileExists(csrFile), "The certificate signing request should be stored")
+	assert.False(t, util.FileExists(filepath.Join(homeDir, "ca-cert.pem")), "Generating a key should not create the CA certificate")
+}
+
+// precedenceSetting is a setting whose value may come from each source
+type precedenceSetting struct {
+	path  string
+	yaml  string // the setting in the config file
+	env   string // the environment variable of the setting
+	flag  string // the command line flag of the setting
+	value map[lib.ConfigSource]string
+}
+
+// Test the effective value and the source of settings for every combination
+// of the config file, environment variables and command line flags
+func TestConfigPrecedence(t *testing.T) {
+	os.Unsetenv(homeEnvVar)
+	os.Unsetenv("CA_CFG_PATH")
+	const homeDir = "configPrecedence"
+	os.RemoveAll(homeDir)
+	defer os.RemoveAll(homeDir)
+	err := os.MkdirAll(homeDir, 0755)
+	util.FatalError(t, err, "Failed to create directory")
+	cfgFile := filepath.Join(homeDir, "fabric-ca-server-config.yaml")
+
+	settings := []precedenceSetting{
+		{"port", "port: %s\n", "FABRIC_CA_SERVER_PORT", "--port",
+			map[lib.ConfigSource]string{lib.ConfigSourceDefault: "7054", lib.ConfigSourceFile: "7060", lib.ConfigSourceEnv: "7070", lib.ConfigSourceFlag: "7080"}},
+		{"crlsizelimit", "crlsizelimit: %s\n", "FABRIC_CA_SERVER_CRLSIZELIMIT", "--crlsizelimit",
+			map[lib.ConfigSource]string{lib.ConfigSourceDefault: "512000", lib.ConfigSourceFile: "2000", lib.ConfigSourceEnv: "3000", lib.ConfigSourceFlag: "4000"}},
+		{"shutdowntimeout", "shutdowntimeout: %s\n", "FABRIC_CA_SERVER_SHUTDOWNTIMEOUT", "--shutdowntimeout",
+			map[lib.ConfigSource]string{lib.ConfigSourceDefault: "30s", lib.ConfigSourceFile: "1m0s", lib.ConfigSourceEnv: "2m0s", lib.ConfigSourceFlag: "3m0s"}},
+		{"ca.name", "ca:\n  name: %s\n", "FABRIC_CA_SERVER_CA_NAME", "--ca.name",
+			map[lib.ConfigSource]string{lib.ConfigSourceDefault: "", lib.ConfigSourceFile: "fileca", lib.ConfigSourceEnv: "envca", lib.ConfigSourceFlag: "flagca"}},
+		{"registry.maxenrollments", "registry:\n  maxenrollments: %s\n", "FABRIC_CA_SERVER_REGISTRY_MAXENROLLMENTS", "--registry.maxenrollments",
+			map[lib.ConfigSource]string{lib.ConfigSourceDefault: "-1", lib.ConfigSourceFile: "5", lib.ConfigSourceEnv: "6", lib.ConfigSourceFlag: "7"}},
+	}
+
+	for combination := 0; combination < 8; combination++ {
+		inFile, inEnv, inFlag := combination&1 != 0, combination&2 != 0, combination&4 != 0
+		name := fmt.Sprintf("file=%t,env=%t,flag=%t", inFile, inEnv, inFlag)
+		// The config file must exist even if it sets none of the settings
+		cfgYaml := "tls:\n  enabled: false\n"
+		args := []string{"config", "show", "-c", cfgFile, "--format", "json"}
+		for _, setting := range settings {
+			if inFile {
+				cfgYaml += fmt.Sprintf(setting.yaml, setting.value[lib.ConfigSourceFile])
+			}
+			if inEnv {
+				os.Setenv(setting.env, setting.value[lib.ConfigSourceEnv])
+			} else {
+				os.Unsetenv(setting.env)
+			}
+			if inFlag {
+				args = append(args, setting.flag, setting.value[lib.ConfigSourceFlag])
+			}
+		}
+		err = ioutil.WriteFile(cfgFile, []byte(cfgYaml), 0644)
+		util.FatalError(t, err, "Failed to write config file")
+
+		effective := showConfig(t, args)
+		for _, setting := range settings {
+			source := lib.ConfigSourceDefault
+			switch {
+			case inFlag:
+				source = lib.ConfigSourceFlag
+			case inEnv:
+				source = lib.ConfigSourceEnv
+			case inFile:
+				source = lib.ConfigSourceFile
+			}
+			if assert.Contains(t, effective, setting.path, "%s: the setting should be shown", name) {
+				assert.Equal(t, setting.value[source], fmt.Sprint(effective[setting.path].Value), "%s: wrong value of %s", name, setting.path)
+				assert.Equal(t, string(source), effective[setting.path].Source, "%s: wrong source of %s", name, setting.path)
+			}
+		}
+	}
+	for _, setting := range settings {
+		os.Unsetenv(setting.env)
+	}
+
+	// The settings which are set by flags are recorded, so that they are
+	// applied again when the configuration is reloaded
+	scmd := NewCommand(configCommand, false)
+	scmd.rootCmd.SetArgs([]string{"config", "show", "-c", cfgFile, "--crlsizelimit", "4000", "--format", "json"})
+	scmd.rootCmd.SetOutput(ioutil.Discard)
+	err = scmd.Execute()
+	util.FatalError(t, err, "Failed to show the configuration")
+	assert.Equal(t, lib.FlagOverrides{"crlsizelimit": 4000}, scmd.getServer().FlagOverrides)
+
+	// Secrets are masked, and misspelled settings are reported
+	err = ioutil.WriteFile(cfgFile, []byte("admin:\n  secret: adminpw\nregsitry:\n  maxenrollments: 3\n"), 0644)
+	util.FatalError(t, err, "Failed to write config file")
+	effective := showConfig(t, []string{"config", "show", "-c", cfgFile, "--format", "json"})
+	assert.Equal(t, "****", effective["admin.secret"].Value, "The secret should be masked")
+	unknown, err := lib.UnknownConfigSettings(cfgFile)
+	util.FatalError(t, err, "Failed to get the unknown settings")
+	assert.Equal(t, []string{"regsitry.maxenrollments"}, unknown, "The misspelled setting should be unknown")
+
+	err = RunMain([]string{cmdName, "config", "show", "-c", cfgFile, "--format", "xml"})
+	util.ErrorContains(t, err, "Invalid format", "An invalid format should fail")
+}
+
+// showConfig runs the command 'args' which shows the configuration as JSON and
+// returns its settings by path
+func showConfig(t *testing.T, args []string) map[string]api.ConfigSetting {
+	scmd := NewCommand(configCommand, false)
+	var out bytes.Buffer
+	scmd.rootCmd.SetArgs(args)
+	scmd.rootCmd.SetOutput(&out)
+	err := scmd.Execute()
+	util.FatalError(t, err, "Failed to show the configuration")
+	var resp api.ConfigResponse
+	err = json.Unmarshal(out.Bytes(), &resp)
+	util.FatalError(t, err, "Failed to parse the configuration")
+	settings := map[string]api.ConfigSetting{}
+	for _, setting := range resp.Settings {
+		settings[setting.Setting] = setting
+	}
+	return settings
+}
+
 func TestDefaultMultiCAs(t *testing.T) {
 	blockingStart = false
 
@@ -370,6 +579,10 @@ func TestVersion(t *testing.T) {
 	if err != nil {
 		t.Error("Failed to get fabric-ca-server version: ", err)
 	}
+	err = RunMain([]string{cmdName, "--version"})
+	if err != nil {
+		t.Error("Failed to get fabric-ca-server version with the --version flag: ", err)
+	}
 }
 
 // Run server with specified args and check if the configuration and datasource
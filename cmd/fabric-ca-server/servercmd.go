@@ -17,11 +17,15 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/api"
 	"github.com/hyperledger/fabric-ca/lib"
 	"github.com/hyperledger/fabric-ca/lib/metadata"
 	"github.com/hyperledger/fabric-ca/util"
@@ -31,13 +35,16 @@ import (
 )
 
 const (
-	version = "version"
+	version       = "version"
+	validate      = "validate"
+	configCommand = "config"
+	setupCommand  = "setup"
 )
 
 // ServerCmd encapsulates cobra command that provides command line interface
 // for the Fabric CA server and the configuration used by the Fabric CA server
 type ServerCmd struct {
-	// name of the fabric-ca-server command (init, start, version)
+	// name of the fabric-ca-server command (init, start, rekey, setup, backup, restore, validate, config, version)
 	name string
 	// rootCmd is the cobra command
 	rootCmd *cobra.Command
@@ -51,6 +58,10 @@ type ServerCmd struct {
 	homeDirectory string
 	// serverCfg is the server's configuration
 	cfg *lib.ServerConfig
+	// provenance is the source of each setting of the server's configuration
+	provenance lib.ConfigProvenance
+	// flagOverrides are the settings which are set by command line flags
+	flagOverrides lib.FlagOverrides
 }
 
 // NewCommand returns new ServerCmd ready for running
@@ -78,6 +89,10 @@ func (s *ServerCmd) init() {
 		Use:   cmdName,
 		Short: longName,
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			// The root command only prints the version or the usage
+			if cmd == s.rootCmd {
+				return nil
+			}
 			err := s.configInit()
 			if err != nil {
 				return err
@@ -114,11 +129,18 @@ func (s *ServerCmd) init() {
 		Short: fmt.Sprintf("Start the %s", shortName),
 	}
 
+	var skipSelfTest bool
+	startCmd.Flags().BoolVar(&skipSelfTest, "skip-selftest", false,
+		"Start without testing that each CA can sign and verify certificates; use only in an emergency")
+
 	startCmd.RunE = func(cmd *cobra.Command, args []string) error {
 		if len(args) > 0 {
 			return errors.Errorf(extraArgsError, args, startCmd.UsageString())
 		}
-		err := s.getServer().Start()
+		server := s.getServer()
+		server.SkipSelfTest = skipSelfTest
+		server.HandleSignals = true
+		err := server.Start()
 		if err != nil {
 			return err
 		}
@@ -126,6 +148,163 @@ func (s *ServerCmd) init() {
 	}
 	s.rootCmd.AddCommand(startCmd)
 
+	// rekeyCmd represents the server rekey command
+	rekeyCmd := &cobra.Command{
+		Use:   "rekey",
+		Short: fmt.Sprintf("Generate a new key for the %s's CA", shortName),
+		Long: "Generate a new key and certificate for the server's CA, keeping its current certificate " +
+			"in the file specified by rollover.previouscertfile. If the --csr flag is set, a certificate " +
+			"signing request for the new key is stored in the specified file instead of a new certificate",
+	}
+	var csrFile string
+	rekeyCmd.Flags().StringVar(&csrFile, "csr", "", "Store a certificate signing request for the new key in this file")
+	rekeyCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if len(args) > 0 {
+			return errors.Errorf(extraArgsError, args, rekeyCmd.UsageString())
+		}
+		err := s.getServer().Rekey(csrFile)
+		if err != nil {
+			util.Fatal("Rekey failure: %s", err)
+		}
+		log.Info("Rekey was successful")
+		return nil
+	}
+	s.rootCmd.AddCommand(rekeyCmd)
+
+	// setupCmd groups the commands which prepare the server before it is
+	// initialized
+	setupCmd := &cobra.Command{
+		Use:   setupCommand,
+		Short: fmt.Sprintf("Prepare the %s before it is initialized", shortName),
+	}
+	keygenCmd := &cobra.Command{
+		Use:   "keygen",
+		Short: fmt.Sprintf("Generate the key of the %s's CA", shortName),
+		Long: "Generate the key of the server's CA with the configured BCCSP, inside the token if BCCSP is " +
+			"configured with PKCS11, and store a certificate signing request for it in the file specified " +
+			"by the --csr flag. Once the request is signed by another CA, store the certificate in the file " +
+			"specified by ca.certfile and initialize the server",
+	}
+	var keygenCSRFile string
+	keygenCmd.Flags().StringVar(&keygenCSRFile, "csr", "", "File in which the certificate signing request for the key is stored")
+	keygenCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if len(args) > 0 {
+			return errors.Errorf(extraArgsError, args, keygenCmd.UsageString())
+		}
+		if keygenCSRFile == "" {
+			return errors.New("The --csr flag is required")
+		}
+		err := s.getServer().KeyGen(keygenCSRFile)
+		if err != nil {
+			util.Fatal("Key generation failure: %s", err)
+		}
+		log.Info("Key generation was successful")
+		return nil
+	}
+	setupCmd.AddCommand(keygenCmd)
+	s.rootCmd.AddCommand(setupCmd)
+
+	// backupCmd represents the server backup command
+	backupCmd := &cobra.Command{
+		Use:   "backup",
+		Short: fmt.Sprintf("Back up the database of the %s", shortName),
+		Long: "Write an archive of the affiliations, identities and certificates in the database of a CA " +
+			"to the file specified by the --file flag, or to standard output if it is '-'. " +
+			"The secrets of the identities remain hashed in the archive",
+	}
+	var backupFile, backupCA string
+	var backupGzip bool
+	backupCmd.Flags().StringVar(&backupFile, "file", "", "File to which the backup archive is written, or '-' for standard output")
+	backupCmd.Flags().BoolVar(&backupGzip, "gzip", false, "Compress the backup archive with gzip")
+	backupCmd.Flags().StringVar(&backupCA, "caname", "", "Name of the CA whose database is backed up; if not set, the default CA")
+	backupCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if len(args) > 0 {
+			return errors.Errorf(extraArgsError, args, backupCmd.UsageString())
+		}
+		if backupFile == "" {
+			return errors.New("The --file flag is required")
+		}
+		err := s.backup(backupFile, backupCA, backupGzip)
+		if err != nil {
+			util.Fatal("Backup failure: %s", err)
+		}
+		log.Info("Backup was successful")
+		return nil
+	}
+	s.rootCmd.AddCommand(backupCmd)
+
+	// restoreCmd represents the server restore command
+	restoreCmd := &cobra.Command{
+		Use:   "restore",
+		Short: fmt.Sprintf("Restore the database of the %s from a backup", shortName),
+		Long: "Load an archive written by the backup command into the database of a CA in one transaction. " +
+			"The records in the database are replaced by those of the archive unless the --merge flag is set, " +
+			"in which case the records of the archive which are not in the database are added. " +
+			"The server must not be running while its database is restored",
+	}
+	var restoreFile, restoreCA string
+	var restoreMerge bool
+	restoreCmd.Flags().StringVar(&restoreFile, "file", "", "File from which the backup archive is read, or '-' for standard input")
+	restoreCmd.Flags().BoolVar(&restoreMerge, "merge", false, "Add the records of the archive to those in the database instead of replacing them")
+	restoreCmd.Flags().StringVar(&restoreCA, "caname", "", "Name of the CA whose database is restored; if not set, the default CA")
+	restoreCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if len(args) > 0 {
+			return errors.Errorf(extraArgsError, args, restoreCmd.UsageString())
+		}
+		if restoreFile == "" {
+			return errors.New("The --file flag is required")
+		}
+		err := s.restore(restoreFile, restoreCA, restoreMerge)
+		if err != nil {
+			util.Fatal("Restore failure: %s", err)
+		}
+		log.Info("Restore was successful")
+		return nil
+	}
+	s.rootCmd.AddCommand(restoreCmd)
+
+	// validateCmd represents the server validate command
+	validateCmd := &cobra.Command{
+		Use:   validate,
+		Short: fmt.Sprintf("Validate the configuration of the %s", shortName),
+		Long: "Check the configuration without starting the server: the settings of the server, the key and " +
+			"certificate of each CA, the connections to the user registry and certificate database, the " +
+			"signing profiles and the endpoints of the concurrency limits. Every problem found is reported, " +
+			"and the command fails if there are any",
+	}
+	var validateFormat string
+	validateCmd.Flags().StringVar(&validateFormat, "format", "text", "Format of the report: 'text' or 'json'")
+	validateCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if len(args) > 0 {
+			return errors.Errorf(extraArgsError, args, validateCmd.UsageString())
+		}
+		return s.validate(validateFormat)
+	}
+	s.rootCmd.AddCommand(validateCmd)
+
+	// configCmd groups the commands which inspect the server's configuration
+	configCmd := &cobra.Command{
+		Use:   configCommand,
+		Short: fmt.Sprintf("Inspect the configuration of the %s", shortName),
+	}
+	showCmd := &cobra.Command{
+		Use:   "show",
+		Short: "Print the effective configuration and the source of each setting",
+		Long: "Print the value of each setting of the effective configuration and where it comes from: a command " +
+			"line flag, which takes precedence over an environment variable, which takes precedence over the " +
+			"configuration file, which takes precedence over the default value. The values of secrets are masked",
+	}
+	var showFormat string
+	showCmd.Flags().StringVar(&showFormat, "format", "text", "Format of the configuration: 'text' or 'json'")
+	showCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if len(args) > 0 {
+			return errors.Errorf(extraArgsError, args, showCmd.UsageString())
+		}
+		return s.showConfig(cmd.OutOrStdout(), showFormat)
+	}
+	configCmd.AddCommand(showCmd)
+	s.rootCmd.AddCommand(configCmd)
+
 	var versionCmd = &cobra.Command{
 		Use:   "version",
 		Short: "Prints Fabric CA Server version",
@@ -134,6 +313,16 @@ func (s *ServerCmd) init() {
 		},
 	}
 	s.rootCmd.AddCommand(versionCmd)
+
+	var showVersion bool
+	rootCmd.Flags().BoolVar(&showVersion, "version", false, "Prints Fabric CA Server version")
+	rootCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if !showVersion {
+			return cmd.Help()
+		}
+		fmt.Print(metadata.GetVersionInfo(cmdName))
+		return nil
+	}
 	s.registerFlags()
 }
 
@@ -178,15 +367,110 @@ func (s *ServerCmd) configRequired() bool {
 	return s.name != version
 }
 
-// getServer returns a lib.Server for the init and start commands
+// getServer returns a lib.Server for the init, start, rekey, setup, backup, restore and validate commands
 func (s *ServerCmd) getServer() *lib.Server {
 	return &lib.Server{
-		HomeDir:       s.homeDirectory,
-		Config:        s.cfg,
-		BlockingStart: s.blockingStart,
+		HomeDir:          s.homeDirectory,
+		Config:           s.cfg,
+		ConfigProvenance: s.provenance,
+		FlagOverrides:    s.flagOverrides,
+		BlockingStart:    s.blockingStart,
 		CA: lib.CA{
 			Config:         &s.cfg.CAcfg,
 			ConfigFilePath: s.cfgFileName,
 		},
 	}
 }
+
+// backup writes a backup archive of the database of the CA named 'caName'
+// to 'file', or to standard output if it is "-"
+func (s *ServerCmd) backup(file, caName string, compress bool) error {
+	if file == "-" {
+		return s.getServer().Backup(caName, os.Stdout, compress)
+	}
+	// The archive contains hashed secrets, so only the owner may read it
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create backup archive '%s'", file)
+	}
+	err = s.getServer().Backup(caName, f, compress)
+	err2 := f.Close()
+	if err == nil && err2 != nil {
+		err = errors.Wrapf(err2, "Failed to write backup archive '%s'", file)
+	}
+	if err != nil {
+		os.Remove(file)
+	}
+	return err
+}
+
+// restore loads the backup archive in 'file', or from standard input if it
+// is "-", into the database of the CA named 'caName'
+func (s *ServerCmd) restore(file, caName string, merge bool) error {
+	if file == "-" {
+		return s.getServer().Restore(caName, os.Stdin, merge)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to open backup archive '%s'", file)
+	}
+	defer f.Close()
+	return s.getServer().Restore(caName, f, merge)
+}
+
+// validate reports the problems found in the server's configuration to
+// standard output in 'format', returning an error if there are any
+func (s *ServerCmd) validate(format string) error {
+	if format != "text" && format != "json" {
+		return errors.Errorf("Invalid format '%s'; must be 'text' or 'json'", format)
+	}
+	problems := s.getServer().Validate()
+	switch format {
+	case "json":
+		report := struct {
+			Valid    bool                `json:"valid"`
+			Problems []lib.ConfigProblem `json:"problems"`
+		}{len(problems) == 0, problems}
+		out, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "Failed to marshal the validation report")
+		}
+		fmt.Println(string(out))
+	default:
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if len(problems) == 0 {
+			fmt.Println("The configuration is valid")
+		}
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("%d problems found in the configuration", len(problems))
+	}
+	return nil
+}
+
+// showConfig writes the effective configuration of the server and the source
+// of each of its settings to 'w' in 'format'
+func (s *ServerCmd) showConfig(w io.Writer, format string) error {
+	if format != "text" && format != "json" {
+		return errors.Errorf("Invalid format '%s'; must be 'text' or 'json'", format)
+	}
+	settings := lib.EffectiveConfig(s.cfg, s.provenance)
+	if format == "json" {
+		out, err := json.MarshalIndent(&api.ConfigResponse{Settings: settings}, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "Failed to marshal the configuration")
+		}
+		fmt.Fprintln(w, string(out))
+		return nil
+	}
+	for _, setting := range settings {
+		value, err := json.Marshal(setting.Value)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to marshal the setting '%s'", setting.Setting)
+		}
+		fmt.Fprintf(w, "%s: %s (%s)\n", setting.Setting, value, setting.Source)
+	}
+	return nil
+}
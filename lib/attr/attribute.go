@@ -45,6 +45,7 @@ const (
 	GenCRL         = "hf.GenCRL"
 	RegistrarAttr  = "hf.Registrar.Attributes"
 	AffiliationMgr = "hf.AffiliationMgr"
+	Admin          = "hf.Admin"
 	EnrollmentID   = "hf.EnrollmentID"
 	Type           = "hf.Type"
 	Affiliation    = "hf.Affiliation"
@@ -108,7 +109,7 @@ var attributeMap = initAttrs()
 func initAttrs() map[string]*attributeControl {
 	var attributeMap = make(map[string]*attributeControl)
 
-	booleanAttributes := []string{Revoker, IntermediateCA, GenCRL, AffiliationMgr}
+	booleanAttributes := []string{Revoker, IntermediateCA, GenCRL, AffiliationMgr, Admin}
 
 	for _, attr := range booleanAttributes {
 		attributeMap[attr] = &attributeControl{
@@ -7,12 +7,11 @@ SPDX-License-Identifier: Apache-2.0
 package lib
 
 import (
-	"bytes"
+	"crypto"
 	"crypto/dsa"
 	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/x509"
-	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -20,6 +19,8 @@ import (
 	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/cloudflare/cfssl/config"
@@ -33,12 +34,14 @@ import (
 	"github.com/hyperledger/fabric-ca/lib/caerrors"
 	"github.com/hyperledger/fabric-ca/lib/common"
 	"github.com/hyperledger/fabric-ca/lib/dbutil"
+	"github.com/hyperledger/fabric-ca/lib/kms"
 	"github.com/hyperledger/fabric-ca/lib/ldap"
 	"github.com/hyperledger/fabric-ca/lib/metadata"
 	idemix "github.com/hyperledger/fabric-ca/lib/server/idemix"
 	"github.com/hyperledger/fabric-ca/lib/spi"
 	"github.com/hyperledger/fabric-ca/lib/tcert"
 	"github.com/hyperledger/fabric-ca/lib/tls"
+	"github.com/hyperledger/fabric-ca/lib/vault"
 	"github.com/hyperledger/fabric-ca/util"
 	"github.com/hyperledger/fabric/bccsp"
 	"github.com/hyperledger/fabric/common/attrmgr"
@@ -75,16 +78,21 @@ type CA struct {
 	db *dbutil.DB
 	// The crypto service provider (BCCSP)
 	csp bccsp.BCCSP
+	// The signer of the CA's key if it is held by a cloud KMS
+	kms *kms.Signer
 	// The certificate DB accessor
 	certDBAccessor *CertDBAccessor
 	// The user registry
 	registry spi.UserRegistry
-	// The signer used for enrollment
+	// The signer used for enrollment with the signing profiles the CA was
+	// initialized with; requests use the one of the configuration in service,
+	// which a reload replaces
 	enrollSigner signer.Signer
 	// Idemix issuer
 	issuer idemix.Issuer
-	// The options to use in verifying a signature in token-based authentication
-	verifyOptions *x509.VerifyOptions
+	// The CA's certificate and chain (a *caCerts), from which the options to
+	// verify a signature in token-based authentication are also computed
+	certs atomic.Value
 	// The attribute manager
 	attrMgr *attrmgr.Mgr
 	// The tcert manager for this CA
@@ -97,6 +105,21 @@ type CA struct {
 	levels *dbutil.Levels
 	// CA mutex
 	mutex sync.Mutex
+	// The certificate of the CA's previous key if a key rollover is configured
+	previousCert *x509.Certificate
+	// Time until which certificates issued under the previous key are accepted
+	rolloverCutover time.Time
+	// The SCEP responder if it is enabled
+	scep *scepResponder
+	// The template of the paths of the SPIFFE IDs if the CA has a trust domain
+	svidPath *template.Template
+	// Time of the last removal of the expired idempotency keys
+	idempotencySweep time.Time
+	// The ETag of the published CRL file
+	crlETag *publishedCRLETag
+	// Called after each step of the registration of identities, which fails
+	// if it returns an error; tests set it to inject faults
+	registrationFault func(step string) error
 }
 
 const (
@@ -155,6 +178,12 @@ func (ca *CA) init(renew bool) (err error) {
 		return err
 	}
 
+	// Get the CA's key from the cloud KMS if it is held by one
+	err = ca.initKMS()
+	if err != nil {
+		return err
+	}
+
 	// Initialize key materials
 	err = ca.initKeyMaterial(renew)
 	if err != nil {
@@ -175,12 +204,48 @@ func (ca *CA) init(renew bool) (err error) {
 	if err != nil {
 		return err
 	}
+	// Load the CA's certificate and chain, which are served from memory; if
+	// they can't be loaded yet, they are loaded when they are first needed
+	err = ca.refreshCACerts()
+	if err != nil {
+		log.Warningf("Failed to load the certificate chain of CA '%s': %s", ca.Config.CA.Name, err)
+	}
+	// Load the certificate of the previous key if a key rollover is configured
+	err = ca.initRollover()
+	if err != nil {
+		return err
+	}
+	// Check the SPIFFE trust domain and create its signing profile if it is
+	// set, before the SCEP and EST responders, which may issue X.509-SVIDs
+	err = ca.initSPIFFE()
+	if err != nil {
+		return err
+	}
+	// Load the certificate and key of the SCEP responder if it is enabled
+	err = ca.initSCEP()
+	if err != nil {
+		return err
+	}
+	// Check the signing profile of the EST responder if it is enabled
+	err = ca.checkESTConfig()
+	if err != nil {
+		return err
+	}
 	// Create the attribute manager
 	ca.attrMgr = attrmgr.New()
 	// Initialize TCert handling
 	keyfile := ca.Config.CA.Keyfile
 	certfile := ca.Config.CA.Certfile
-	ca.tcertMgr, err = tcert.LoadMgr(keyfile, certfile, ca.csp)
+	if ca.kms != nil {
+		var cert *x509.Certificate
+		cert, err = util.GetX509CertificateFromPEMFile(certfile)
+		if err != nil {
+			return err
+		}
+		ca.tcertMgr, err = tcert.NewMgr(ca.kms, cert)
+	} else {
+		ca.tcertMgr, err = tcert.LoadMgr(keyfile, certfile, ca.csp)
+	}
 	if err != nil {
 		return err
 	}
@@ -208,6 +273,11 @@ func (ca *CA) initKeyMaterial(renew bool) error {
 	keyFile := ca.Config.CA.Keyfile
 	certFile := ca.Config.CA.Certfile
 
+	// If the key is held by a KMS, the certificate must be that of the KMS key
+	if ca.kms != nil && !renew && util.FileExists(certFile) {
+		return ca.initKMSKeyMaterial(certFile)
+	}
+
 	// If we aren't renewing and the key and cert files exist, do nothing
 	if !renew {
 		// If they both exist, the CA was already initialized
@@ -264,8 +334,13 @@ func (ca *CA) initKeyMaterial(renew bool) error {
 	if err != nil {
 		return errors.Wrap(err, "Failed to store certificate")
 	}
-	log.Infof("The CA key and certificate were generated for CA %s", ca.Config.CA.Name)
-	log.Infof("The key was stored by BCCSP provider '%s'", ca.Config.CSP.ProviderName)
+	if ca.kms != nil {
+		log.Infof("The CA certificate was generated for CA %s", ca.Config.CA.Name)
+		log.Infof("The key is held by the %s KMS key '%s'", ca.kms.Provider(), ca.kms.KeyID())
+	} else {
+		log.Infof("The CA key and certificate were generated for CA %s", ca.Config.CA.Name)
+		log.Infof("The key was stored by BCCSP provider '%s'", ca.Config.CSP.ProviderName)
+	}
 	log.Infof("The certificate is at: %s", certFile)
 
 	return nil
@@ -274,6 +349,11 @@ func (ca *CA) initKeyMaterial(renew bool) error {
 // Get the CA certificate for this CA
 func (ca *CA) getCACert() (cert []byte, err error) {
 	if ca.Config.Intermediate.ParentServer.URL != "" {
+		// The enrollment with the parent server generates the CA's key
+		if ca.kms != nil {
+			return nil, errors.Errorf("The certificate of the KMS key of intermediate CA '%s' must be issued by its parent and stored at '%s'",
+				ca.Config.CA.Name, ca.Config.CA.Certfile)
+		}
 		// This is an intermediate CA, so call the parent fabric-ca-server
 		// to get the cert
 		log.Debugf("Getting CA cert; parent server URL is %s", util.GetMaskedURL(ca.Config.Intermediate.ParentServer.URL))
@@ -331,36 +411,18 @@ func (ca *CA) getCACert() (cert []byte, err error) {
 		log.Debugf("Stored intermediate certificate chain at %s", chainPath)
 	} else {
 		// This is a root CA, so create a CSR (Certificate Signing Request)
-		if ca.Config.CSR.CN == "" {
-			ca.Config.CSR.CN = "fabric-ca-server"
-		}
-		csr := &ca.Config.CSR
-		if csr.CA == nil {
-			csr.CA = &cfcsr.CAConfig{}
-		}
-		if csr.CA.Expiry == "" {
-			csr.CA.Expiry = defaultRootCACertificateExpiration
-		}
-
-		if (csr.KeyRequest == nil) || (csr.KeyRequest.Algo == "" && csr.KeyRequest.Size == 0) {
-			csr.KeyRequest = GetKeyRequest(ca.Config)
-		}
-		req := cfcsr.CertificateRequest{
-			CN:           csr.CN,
-			Names:        csr.Names,
-			Hosts:        csr.Hosts,
-			KeyRequest:   &cfcsr.BasicKeyRequest{A: csr.KeyRequest.Algo, S: csr.KeyRequest.Size},
-			CA:           csr.CA,
-			SerialNumber: csr.SerialNumber,
-		}
+		req := ca.getRootCertificateRequest()
 		log.Debugf("Root CA certificate request: %+v", req)
-		// Generate the key/signer
-		_, cspSigner, err := util.BCCSPKeyRequestGenerate(&req, ca.csp)
-		if err != nil {
-			return nil, err
+		// Generate the key/signer, unless the key is held by a KMS
+		var caSigner crypto.Signer = ca.kms
+		if ca.kms == nil {
+			_, caSigner, err = util.BCCSPKeyRequestGenerate(req, ca.csp)
+			if err != nil {
+				return nil, err
+			}
 		}
 		// Call CFSSL to initialize the CA
-		cert, _, err = initca.NewFromSigner(&req, cspSigner)
+		cert, _, err = initca.NewFromSigner(req, caSigner)
 		if err != nil {
 			return nil, errors.WithMessage(err, "Failed to create new CA certificate")
 		}
@@ -368,6 +430,33 @@ func (ca *CA) getCACert() (cert []byte, err error) {
 	return cert, nil
 }
 
+// Get the request for the certificate of a root CA from the CSR section of
+// the CA's configuration
+func (ca *CA) getRootCertificateRequest() *cfcsr.CertificateRequest {
+	if ca.Config.CSR.CN == "" {
+		ca.Config.CSR.CN = "fabric-ca-server"
+	}
+	csr := &ca.Config.CSR
+	if csr.CA == nil {
+		csr.CA = &cfcsr.CAConfig{}
+	}
+	if csr.CA.Expiry == "" {
+		csr.CA.Expiry = defaultRootCACertificateExpiration
+	}
+
+	if (csr.KeyRequest == nil) || (csr.KeyRequest.Algo == "" && csr.KeyRequest.Size == 0) {
+		csr.KeyRequest = GetKeyRequest(ca.Config)
+	}
+	return &cfcsr.CertificateRequest{
+		CN:           csr.CN,
+		Names:        csr.Names,
+		Hosts:        csr.Hosts,
+		KeyRequest:   &cfcsr.BasicKeyRequest{A: csr.KeyRequest.Algo, S: csr.KeyRequest.Size},
+		CA:           csr.CA,
+		SerialNumber: csr.SerialNumber,
+	}
+}
+
 // Return a certificate chain which is the concatenation of chain and cert
 func (ca *CA) concatChain(chain []byte, cert []byte) ([]byte, error) {
 	result := make([]byte, len(chain)+len(cert))
@@ -392,8 +481,27 @@ func (ca *CA) concatChain(chain []byte, cert []byte) ([]byte, error) {
 	return result, nil
 }
 
-// Get the certificate chain for the CA
+// Get the certificate chain for the CA; during a key rollover, the chain
+// also contains the certificate of the CA's previous key
 func (ca *CA) getCAChain() (chain []byte, err error) {
+	c, err := ca.servedCAChain()
+	if err != nil {
+		return nil, err
+	}
+	return c.pem, nil
+}
+
+// Get the certificates of the CA chain, which must not be modified
+func (ca *CA) getCAChainCertificates() ([]*x509.Certificate, error) {
+	c, err := ca.servedCAChain()
+	if err != nil {
+		return nil, err
+	}
+	return c.certs, nil
+}
+
+// Read the certificate chain of the CA's current key from its file
+func (ca *CA) getCurrentCAChain() (chain []byte, err error) {
 	if ca.Config == nil {
 		return nil, errors.New("The server has no configuration")
 	}
@@ -440,6 +548,9 @@ func (ca *CA) initConfig() (err error) {
 	if cfg.CA.Chainfile == "" {
 		cfg.CA.Chainfile = "ca-chain.pem"
 	}
+	if cfg.Rollover.PreviousCertfile == "" {
+		cfg.Rollover.PreviousCertfile = "ca-cert-previous.pem"
+	}
 	if cfg.CSR.CA == nil {
 		cfg.CSR.CA = &cfcsr.CAConfig{}
 	}
@@ -483,69 +594,8 @@ func (ca *CA) initConfig() (err error) {
 // VerifyCertificate verifies that 'cert' was issued by this CA
 // Return nil if successful; otherwise, return an error.
 func (ca *CA) VerifyCertificate(cert *x509.Certificate) error {
-	opts, err := ca.getVerifyOptions()
-	if err != nil {
-		return errors.WithMessage(err, "Failed to get verify options")
-	}
-	_, err = cert.Verify(*opts)
-	if err != nil {
-		return errors.WithMessage(err, "Failed to verify certificate")
-	}
-	return nil
-}
-
-// Get the options to verify
-func (ca *CA) getVerifyOptions() (*x509.VerifyOptions, error) {
-	if ca.verifyOptions != nil {
-		return ca.verifyOptions, nil
-	}
-	chain, err := ca.getCAChain()
-	if err != nil {
-		return nil, err
-	}
-	var intPool *x509.CertPool
-	var rootPool *x509.CertPool
-
-	for len(chain) > 0 {
-		var block *pem.Block
-		block, chain = pem.Decode(chain)
-		if block == nil {
-			break
-		}
-		if block.Type != "CERTIFICATE" {
-			continue
-		}
-
-		cert, err := x509.ParseCertificate(block.Bytes)
-		if err != nil {
-			return nil, errors.Wrap(err, "Failed to parse CA chain certificate")
-		}
-
-		if !cert.IsCA {
-			return nil, errors.New("A certificate in the CA chain is not a CA certificate")
-		}
-
-		// If authority key id is not present or if it is present and equal to subject key id,
-		// then it is a root certificate
-		if len(cert.AuthorityKeyId) == 0 || bytes.Equal(cert.AuthorityKeyId, cert.SubjectKeyId) {
-			if rootPool == nil {
-				rootPool = x509.NewCertPool()
-			}
-			rootPool.AddCert(cert)
-		} else {
-			if intPool == nil {
-				intPool = x509.NewCertPool()
-			}
-			intPool.AddCert(cert)
-		}
-	}
-
-	ca.verifyOptions = &x509.VerifyOptions{
-		Roots:         rootPool,
-		Intermediates: intPool,
-		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
-	}
-	return ca.verifyOptions, nil
+	_, err := ca.verifyCertificate(cert)
+	return err
 }
 
 // Initialize the database for the CA
@@ -577,9 +627,12 @@ func (ca *CA) initDB() error {
 			db.Datasource = "fabric-ca-server.db"
 		}
 
-		db.Datasource, err = util.MakeFileAbs(db.Datasource, ca.HomeDir)
-		if err != nil {
-			return err
+		// The name of a database file read from Vault is made absolute once resolved
+		if !vault.IsRef(db.Datasource) {
+			db.Datasource, err = util.MakeFileAbs(db.Datasource, ca.HomeDir)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
@@ -589,25 +642,12 @@ func (ca *CA) initDB() error {
 
 	log.Debugf("Initializing '%s' database at '%s'", db.Type, ds)
 
-	switch db.Type {
-	case defaultDatabaseType:
-		ca.db, err = dbutil.NewUserRegistrySQLLite3(db.Datasource)
-		if err != nil {
-			return errors.WithMessage(err, "Failed to create user registry for SQLite")
-		}
-	case "postgres":
-		ca.db, err = dbutil.NewUserRegistryPostgres(db.Datasource, &db.TLS)
-		if err != nil {
-			return errors.WithMessage(err, "Failed to create user registry for PostgreSQL")
-		}
-	case "mysql":
-		ca.db, err = dbutil.NewUserRegistryMySQL(db.Datasource, &db.TLS, ca.csp)
-		if err != nil {
-			return errors.WithMessage(err, "Failed to create user registry for MySQL")
-		}
-	default:
-		return errors.Errorf("Invalid db.type in config file: '%s'; must be 'sqlite3', 'postgres', or 'mysql'", db.Type)
+	ca.db, err = ca.openDB()
+	if err != nil {
+		return err
 	}
+	ca.limitConnLifetime(ca.db)
+	ca.db.OnAvailabilityChange = ca.dbAvailabilityChanged
 
 	// Update the database to use the latest schema
 	err = dbutil.UpdateSchema(ca.db, ca.server.levels)
@@ -617,6 +657,7 @@ func (ca *CA) initDB() error {
 
 	// Set the certificate DB accessor
 	ca.certDBAccessor = NewCertDBAccessor(ca.db, ca.levels.Certificate)
+	ca.certDBAccessor.observe = ca.observeCertDB
 
 	// If DB initialization fails and we need to reinitialize DB, need to make sure to set the DB accessor for the signer
 	if ca.enrollSigner != nil {
@@ -668,6 +709,44 @@ func (ca *CA) initDB() error {
 	return nil
 }
 
+// openDB opens the CA's database, with the references to secrets in Vault
+// in its datasource resolved
+func (ca *CA) openDB() (*dbutil.DB, error) {
+	db := &ca.Config.DB
+	datasource, err := ca.resolveSecret(db.Datasource)
+	if err != nil {
+		// The server doesn't start without the secrets it references
+		return nil, caerrors.NewFatalError(caerrors.ErrConfig, "Failed to resolve 'db.datasource': %s", err)
+	}
+	switch db.Type {
+	case defaultDatabaseType:
+		if vault.IsRef(db.Datasource) {
+			datasource, err = util.MakeFileAbs(datasource, ca.HomeDir)
+			if err != nil {
+				return nil, err
+			}
+		}
+		sqlite, err := dbutil.NewUserRegistrySQLLite3(datasource)
+		if err != nil {
+			return nil, errors.WithMessage(err, "Failed to create user registry for SQLite")
+		}
+		return sqlite, nil
+	case "postgres":
+		postgres, err := dbutil.NewUserRegistryPostgres(datasource, &db.TLS)
+		if err != nil {
+			return nil, errors.WithMessage(err, "Failed to create user registry for PostgreSQL")
+		}
+		return postgres, nil
+	case "mysql":
+		mysql, err := dbutil.NewUserRegistryMySQL(datasource, &db.TLS, ca.csp)
+		if err != nil {
+			return nil, errors.WithMessage(err, "Failed to create user registry for MySQL")
+		}
+		return mysql, nil
+	}
+	return nil, errors.Errorf("Invalid db.type in config file: '%s'; must be 'sqlite3', 'postgres', or 'mysql'", db.Type)
+}
+
 // Close CA's DB
 func (ca *CA) closeDB() error {
 	if ca.db != nil {
@@ -709,13 +788,29 @@ func (ca *CA) initUserRegistry() error {
 // Initialize the enrollment signer
 func (ca *CA) initEnrollmentSigner() (err error) {
 	log.Debug("Initializing enrollment signer")
+	ca.enrollSigner, err = ca.newEnrollmentSigner(ca.Config.Signing)
+	return err
+}
+
+// newEnrollmentSigner creates a signer which signs certificates with the CA's
+// key according to 'policy' and records them in the certificate database
+func (ca *CA) newEnrollmentSigner(policy *config.Signing) (signer.Signer, error) {
+	enrollSigner, err := ca.newSigner(policy)
+	if err != nil {
+		return nil, err
+	}
+	enrollSigner.SetDBAccessor(ca.certDBAccessor)
+
+	return enrollSigner, nil
+}
+
+// newSigner creates a signer which signs certificates with the CA's key
+// according to 'policy' without recording them
+func (ca *CA) newSigner(policy *config.Signing) (signer.Signer, error) {
 	c := ca.Config
 
 	// If there is a config, use its signing policy. Otherwise create a default policy.
-	var policy *config.Signing
-	if c.Signing != nil {
-		policy = c.Signing
-	} else {
+	if policy == nil {
 		policy = &config.Signing{
 			Profiles: map[string]*config.SigningProfile{},
 			Default:  config.DefaultConfig(),
@@ -724,34 +819,45 @@ func (ca *CA) initEnrollmentSigner() (err error) {
 	}
 
 	// Make sure the policy reflects the new remote
-	parentServerURL := ca.Config.Intermediate.ParentServer.URL
+	parentServerURL := c.Intermediate.ParentServer.URL
 	if parentServerURL != "" {
-		err = policy.OverrideRemotes(parentServerURL)
+		err := policy.OverrideRemotes(parentServerURL)
 		if err != nil {
-			return errors.Wrap(err, "Failed initializing enrollment signer")
+			return nil, errors.Wrap(err, "Failed initializing enrollment signer")
 		}
 	}
 
-	ca.enrollSigner, err = util.BccspBackedSigner(c.CA.Certfile, c.CA.Keyfile, policy, ca.csp)
-	if err != nil {
-		return err
+	if ca.kms != nil {
+		return ca.newKMSSigner(policy)
 	}
-	ca.enrollSigner.SetDBAccessor(ca.certDBAccessor)
-
-	// Successful enrollment
-	return nil
+	return util.BccspBackedSigner(c.CA.Certfile, c.CA.Keyfile, policy, ca.csp)
 }
 
 // loadUsersTable adds the configured users to the table if not already found
 func (ca *CA) loadUsersTable() error {
 	log.Debug("Loading identity table")
 	registry := &ca.Config.Registry
+	users := make([]*spi.UserInfo, 0, len(registry.Identities))
 	for _, id := range registry.Identities {
 		log.Debugf("Loading identity '%s'", id.Name)
-		err := ca.addIdentity(&id, false)
+		// An identity which is already registered is neither validated nor
+		// registered again, as the registry settings may have changed since
+		registered, _ := ca.registry.GetUser(id.Name, nil)
+		if registered != nil {
+			log.Debugf("Identity '%s' already registered, loaded identity", id.Name)
+			continue
+		}
+		user, err := ca.newIdentityUserInfo(&id)
 		if err != nil {
 			return errors.WithMessage(err, "Failed to load identity table")
 		}
+		users = append(users, user)
+	}
+	// The identities are loaded as a unit, so that either all of those which
+	// are not registered yet are loaded or none is
+	_, err := ca.registerUsers(&registration{users: users, skipRegistered: true})
+	if err != nil {
+		return errors.WithMessage(err, "Failed to load identity table")
 	}
 	log.Debug("Successfully loaded identity table")
 	return nil
@@ -813,28 +919,34 @@ func (ca *CA) loadAffiliationsTableR(val interface{}, parentPath string) (err er
 
 // Add an identity to the registry
 func (ca *CA) addIdentity(id *CAConfigIdentity, errIfFound bool) error {
-	var err error
-	user, _ := ca.registry.GetUser(id.Name, nil)
-	if user != nil {
-		if errIfFound {
-			return errors.Errorf("Identity '%s' is already registered", id.Name)
-		}
-		log.Debugf("Identity '%s' already registered, loaded identity", user.GetName())
-		return nil
+	user, err := ca.newIdentityUserInfo(id)
+	if err != nil {
+		return err
+	}
+	_, err = ca.registerUsers(&registration{users: []*spi.UserInfo{user}, skipRegistered: !errIfFound})
+	if err != nil {
+		return errors.WithMessage(err, fmt.Sprintf("Failed to insert identity '%s'", id.Name))
 	}
+	log.Debugf("Registered identity: %+v", id)
+	return nil
+}
 
+// newIdentityUserInfo returns the identity to register for the identity 'id'
+// of the configuration
+func (ca *CA) newIdentityUserInfo(id *CAConfigIdentity) (*spi.UserInfo, error) {
+	var err error
 	id.MaxEnrollments, err = getMaxEnrollments(id.MaxEnrollments, ca.Config.Registry.MaxEnrollments)
 	if err != nil {
-		return caerrors.NewFatalError(caerrors.ErrConfig, "Configuration Error: %s", err)
+		return nil, caerrors.NewFatalError(caerrors.ErrConfig, "Configuration Error: %s", err)
 	}
 
 	attrs, err := attr.ConvertAttrs(id.Attrs)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	rec := spi.UserInfo{
+	return &spi.UserInfo{
 		Name:           id.Name,
 		Pass:           id.Pass,
 		Type:           id.Type,
@@ -842,13 +954,7 @@ func (ca *CA) addIdentity(id *CAConfigIdentity, errIfFound bool) error {
 		Attributes:     attrs,
 		MaxEnrollments: id.MaxEnrollments,
 		Level:          ca.levels.Identity,
-	}
-	err = ca.registry.InsertUser(&rec)
-	if err != nil {
-		return errors.WithMessage(err, fmt.Sprintf("Failed to insert identity '%s'", id.Name))
-	}
-	log.Debugf("Registered identity: %+v", id)
-	return nil
+	}, nil
 }
 
 func (ca *CA) addAffiliation(path, parentPath string) error {
@@ -860,6 +966,20 @@ func (ca *CA) CertDBAccessor() *CertDBAccessor {
 	return ca.certDBAccessor
 }
 
+// observeCertDB records the metrics of an operation of the certificate DB
+// accessor
+func (ca *CA) observeCertDB(operation string, duration time.Duration, err error) {
+	if ca.server == nil {
+		return
+	}
+	status := "success"
+	if err != nil {
+		status = "error"
+	}
+	ca.server.metricWith(metricCertDBOperations, ca.Config.CA.Name, operation, status).Add(1)
+	ca.server.metricWith(metricCertDBOperationDuration, ca.Config.CA.Name, operation).Observe(duration.Seconds())
+}
+
 // DBAccessor returns the registry DB accessor for server
 func (ca *CA) DBAccessor() spi.UserRegistry {
 	return ca.registry
@@ -878,6 +998,10 @@ func (ca *CA) makeFileNamesAbsolute() error {
 		&ca.Config.CA.Certfile,
 		&ca.Config.CA.Keyfile,
 		&ca.Config.CA.Chainfile,
+		&ca.Config.CRL.PublishFile,
+		&ca.Config.Rollover.PreviousCertfile,
+		&ca.Config.SCEP.Certfile,
+		&ca.Config.SCEP.Keyfile,
 	}
 	err := util.MakeFileNamesAbsolute(fields, ca.HomeDir)
 	if err != nil {
@@ -968,63 +1092,56 @@ func (ca *CA) getUserAffiliation(username string) (string, error) {
 
 // fillCAInfo fills the CA info structure appropriately
 func (ca *CA) fillCAInfo(info *common.CAInfoResponseNet) error {
-	caChain, err := ca.getCAChain()
+	chain, err := ca.servedCAChain()
 	if err != nil {
 		return err
 	}
-	info.CAName = ca.Config.CA.Name
-	info.CAChain = util.B64Encode(caChain)
+	return ca.fillCAInfoFromChain(info, chain)
+}
 
-	ipkBytes, err := ca.issuer.IssuerPublicKey()
+// Perfroms checks on the provided CA cert to make sure it's valid
+func (ca *CA) validateCertAndKey(certFile string, keyFile string) error {
+	log.Debug("Validating the CA certificate and key")
+	cert, err := ca.validateCert(certFile)
 	if err != nil {
 		return err
 	}
-	rpkBytes, err := ca.issuer.RevocationPublicKey()
-	if err != nil {
-		return err
+	if err = validateMatchingKeys(cert, keyFile); err != nil {
+		return errors.WithMessage(err, fmt.Sprintf("Invalid certificate and/or key in files '%s' and '%s'", certFile, keyFile))
 	}
-	info.IssuerPublicKey = util.B64Encode(ipkBytes)
-	info.IssuerRevocationPublicKey = util.B64Encode(rpkBytes)
+	log.Debug("Validation of CA certificate and key successful")
+
 	return nil
 }
 
-// Perfroms checks on the provided CA cert to make sure it's valid
-func (ca *CA) validateCertAndKey(certFile string, keyFile string) error {
-	log.Debug("Validating the CA certificate and key")
-	var err error
-	var certPEM []byte
-
-	certPEM, err = ioutil.ReadFile(certFile)
+// validateCert validates the CA certificate in 'certFile' and returns it
+func (ca *CA) validateCert(certFile string) (*x509.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
 	if err != nil {
-		return errors.Wrapf(err, certificateError+" '%s'", certFile)
+		return nil, errors.Wrapf(err, certificateError+" '%s'", certFile)
 	}
 
 	cert, err := util.GetX509CertificateFromPEM(certPEM)
 	if err != nil {
-		return errors.WithMessage(err, fmt.Sprintf(certificateError+" '%s'", certFile))
+		return nil, errors.WithMessage(err, fmt.Sprintf(certificateError+" '%s'", certFile))
 	}
 
 	if err = validateDates(cert); err != nil {
-		return errors.WithMessage(err, fmt.Sprintf(certificateError+" '%s'", certFile))
+		return nil, errors.WithMessage(err, fmt.Sprintf(certificateError+" '%s'", certFile))
 	}
 	if err = validateUsage(cert, ca.Config.CA.Name); err != nil {
-		return errors.WithMessage(err, fmt.Sprintf(certificateError+" '%s'", certFile))
+		return nil, errors.WithMessage(err, fmt.Sprintf(certificateError+" '%s'", certFile))
 	}
 	if err = validateIsCA(cert); err != nil {
-		return errors.WithMessage(err, fmt.Sprintf(certificateError+" '%s'", certFile))
+		return nil, errors.WithMessage(err, fmt.Sprintf(certificateError+" '%s'", certFile))
 	}
 	if err = validateKeyType(cert); err != nil {
-		return errors.WithMessage(err, fmt.Sprintf(certificateError+" '%s'", certFile))
+		return nil, errors.WithMessage(err, fmt.Sprintf(certificateError+" '%s'", certFile))
 	}
 	if err = validateKeySize(cert); err != nil {
-		return errors.WithMessage(err, fmt.Sprintf(certificateError+" '%s'", certFile))
+		return nil, errors.WithMessage(err, fmt.Sprintf(certificateError+" '%s'", certFile))
 	}
-	if err = validateMatchingKeys(cert, keyFile); err != nil {
-		return errors.WithMessage(err, fmt.Sprintf("Invalid certificate and/or key in files '%s' and '%s'", certFile, keyFile))
-	}
-	log.Debug("Validation of CA certificate and key successful")
-
-	return nil
+	return cert, nil
 }
 
 // Returns expiration of the CA certificate
@@ -0,0 +1,198 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/lib/common"
+	"github.com/hyperledger/fabric-ca/lib/metrics"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+)
+
+// metricCAChainNotAfter is the earliest expiry in the chain of a CA, i.e. the
+// time at which a certificate of the chain first expires
+const metricCAChainNotAfter = "fabric_ca_chain_not_after_timestamp_seconds"
+
+func newCAChainMetrics(reg *metrics.Registry) {
+	reg.NewGauge(metricCAChainNotAfter, "Time, in seconds since the epoch, of the earliest expiry in the CA chain", "ca")
+}
+
+// caChain is a PEM-encoded CA chain and the values computed from it for the
+// requests which serve it
+type caChain struct {
+	// The PEM-encoded chain
+	pem []byte
+	// The base64 encoding of 'pem', as in the CA information of responses
+	b64 string
+	// The certificates of the chain, whose Raw field is their DER encoding
+	certs []*x509.Certificate
+	// The strong ETag of 'pem'
+	etag string
+	// The options to verify a certificate issued by the CA, or the error if
+	// the chain can't verify certificates
+	verifyOptions *x509.VerifyOptions
+	verifyErr     error
+	// The certificates verified against the chain in token-based
+	// authentication, which are verified again against a new chain
+	verified verifiedCerts
+}
+
+func newCAChain(chainPEM []byte) (*caChain, error) {
+	certs, err := util.GetX509CertificatesFromPEM(chainPEM)
+	if err != nil {
+		return nil, err
+	}
+	chain := &caChain{pem: chainPEM, b64: util.B64Encode(chainPEM), certs: certs, etag: strongETag(chainPEM)}
+	chain.verifyOptions, chain.verifyErr = getVerifyOptions(chainPEM)
+	return chain, nil
+}
+
+// caCerts are the certificate and chain of a CA. They are read and parsed
+// from the CA's files when the CA is initialized, and read again only when
+// the server reloads or the CA is rekeyed, so that requests neither read
+// the files nor see them while they are being replaced. They are never
+// modified: reading them again replaces them as a whole.
+type caCerts struct {
+	// The CA's certificate, if its file is configured
+	cert *x509.Certificate
+	// The authority key identifier of the certificates issued by 'cert', as
+	// it is stored in the database
+	aki string
+	// The chain of the CA's current key
+	chain *caChain
+	// The chain which is served during a key rollover, which is 'chain'
+	// followed by the certificate of the CA's previous key, or nil if no
+	// rollover is configured
+	rolloverChain *caChain
+	// The earliest expiry in 'chain'; the time at which a certificate of it
+	// first expires
+	notAfter time.Time
+}
+
+// loadCACerts reads and parses the certificate and chain of 'ca'
+func loadCACerts(ca *CA) (*caCerts, error) {
+	chainPEM, err := ca.getCurrentCAChain()
+	if err != nil {
+		return nil, err
+	}
+	certs := &caCerts{}
+	certs.chain, err = newCAChain(chainPEM)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Invalid CA chain")
+	}
+	for i, cert := range certs.chain.certs {
+		if i == 0 || cert.NotAfter.Before(certs.notAfter) {
+			certs.notAfter = cert.NotAfter
+		}
+	}
+	if ca.Config.CA.Certfile != "" {
+		certs.cert, err = util.GetX509CertificateFromPEMFile(ca.Config.CA.Certfile)
+		if err != nil {
+			return nil, errors.WithMessage(err, "Failed to load the CA's certificate")
+		}
+		certs.aki = strings.TrimLeft(hex.EncodeToString(certs.cert.SubjectKeyId), "0")
+	}
+	if ca.previousCert != nil {
+		prev := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.previousCert.Raw})
+		certs.rolloverChain, err = newCAChain(append(append([]byte{}, chainPEM...), prev...))
+		if err != nil {
+			return nil, errors.WithMessage(err, "Invalid certificate of the CA's previous key")
+		}
+	}
+	return certs, nil
+}
+
+// refreshCACerts reads the certificate and chain of the CA from its files
+// and serves them from now on. If they can't be read, the current ones are
+// still served.
+func (ca *CA) refreshCACerts() error {
+	certs, err := loadCACerts(ca)
+	if err != nil {
+		return err
+	}
+	ca.certs.Store(certs)
+	ca.observeCAChain(certs)
+	log.Debugf("Loaded the certificate chain of CA '%s', which expires at %s", ca.Config.CA.Name, certs.notAfter)
+	return nil
+}
+
+// getCACerts returns the certificate and chain of the CA, which are read
+// from its files if it was not initialized
+func (ca *CA) getCACerts() (*caCerts, error) {
+	if certs, ok := ca.certs.Load().(*caCerts); ok {
+		return certs, nil
+	}
+	err := ca.refreshCACerts()
+	if err != nil {
+		return nil, err
+	}
+	return ca.certs.Load().(*caCerts), nil
+}
+
+// servedCAChain returns the chain which the CA serves: the chain of its
+// current key, also followed by the certificate of its previous key during
+// a key rollover
+func (ca *CA) servedCAChain() (*caChain, error) {
+	certs, err := ca.getCACerts()
+	if err != nil {
+		return nil, err
+	}
+	if certs.rolloverChain != nil && ca.rolloverActive() {
+		return certs.rolloverChain, nil
+	}
+	return certs.chain, nil
+}
+
+// observeCAChain sets the metric of the expiry of the chain 'certs' of the CA
+func (ca *CA) observeCAChain(certs *caCerts) {
+	if ca.server == nil || len(certs.chain.certs) == 0 {
+		return
+	}
+	ca.server.metricWith(metricCAChainNotAfter, ca.Config.CA.Name).Set(float64(certs.notAfter.Unix()))
+}
+
+// fillCAInfoFromChain fills 'info' with the information of the CA and its
+// chain 'chain'
+func (ca *CA) fillCAInfoFromChain(info *common.CAInfoResponseNet, chain *caChain) error {
+	info.CAName = ca.Config.CA.Name
+	info.CAChain = chain.b64
+
+	ipkBytes, err := ca.issuer.IssuerPublicKey()
+	if err != nil {
+		return err
+	}
+	rpkBytes, err := ca.issuer.RevocationPublicKey()
+	if err != nil {
+		return err
+	}
+	info.IssuerPublicKey = util.B64Encode(ipkBytes)
+	info.IssuerRevocationPublicKey = util.B64Encode(rpkBytes)
+	if ca.svidPath != nil {
+		info.SPIFFETrustDomain = ca.Config.SPIFFE.TrustDomain
+		info.SPIFFEProfile = ca.Config.SPIFFE.Profile
+	}
+	return nil
+}
+
+// refreshCAChains reads the certificates and chains of the server's CAs
+// again, so that a rotated CA certificate is served without a restart
+func (s *Server) refreshCAChains() {
+	for _, ca := range s.caMap {
+		err := ca.refreshCACerts()
+		if err != nil {
+			log.Errorf("Failed to reload the certificate chain of CA '%s'; continuing to serve the current chain: %s",
+				ca.Config.CA.Name, err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/lib/common"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCAChainConcurrentRefresh(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	ca := &srv.CA
+	pem, err := ca.getCAChain()
+	util.FatalError(t, err, "Failed to get the CA chain")
+
+	// The requests which read the chain while it is refreshed always get a
+	// whole chain, whose computed values match it
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				chain, err := ca.servedCAChain()
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, pem, chain.pem)
+				assert.Equal(t, util.B64Encode(chain.pem), chain.b64)
+				assert.Equal(t, strongETag(chain.pem), chain.etag)
+				assert.Len(t, chain.certs, 1)
+				info := &common.CAInfoResponseNet{}
+				assert.NoError(t, ca.fillCAInfo(info))
+				assert.Equal(t, chain.b64, info.CAChain)
+				cert, err := getCACert(ca)
+				if assert.NoError(t, err) {
+					assert.Equal(t, chain.certs[0].Raw, cert.Raw)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, ca.refreshCACerts())
+	}
+	close(stop)
+	wg.Wait()
+
+	certs, err := ca.getCACerts()
+	util.FatalError(t, err, "Failed to get the CA certificates")
+	assert.Equal(t, float64(certs.notAfter.Unix()), srv.metrics.Get(metricCAChainNotAfter).With(ca.Config.CA.Name).Value(),
+		"The metric should be the expiry of the CA chain")
+}
+
+func TestCAChainETagAfterRotation(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	ca := &srv.CA
+
+	get := func(etag string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/api/v1/cainfo", rootPort), nil)
+		util.FatalError(t, err, "Failed to create request")
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		util.FatalError(t, err, "Failed to get the CA information")
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		util.FatalError(t, err, "Failed to read the CA information")
+		return resp, body
+	}
+	resp, _ := get("")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	old, err := ca.getCAChain()
+	util.FatalError(t, err, "Failed to get the CA chain")
+
+	// The files of the CA are replaced by those of a rotated certificate,
+	// which are not served until the server reloads
+	rotated, err := ioutil.ReadFile("../testdata/ec256-1-cert.pem")
+	util.FatalError(t, err, "Failed to read certificate")
+	for _, file := range []string{ca.Config.CA.Certfile, ca.Config.CA.Chainfile} {
+		err = ioutil.WriteFile(file, rotated, 0644)
+		util.FatalError(t, err, "Failed to write %s", file)
+	}
+	pem, err := ca.getCAChain()
+	util.FatalError(t, err, "Failed to get the CA chain")
+	assert.Equal(t, old, pem, "The cached chain should be served until the server reloads")
+	resp, _ = get(etag)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	srv.reload()
+	pem, err = ca.getCAChain()
+	util.FatalError(t, err, "Failed to get the CA chain")
+	assert.True(t, bytes.Equal(rotated, pem), "The rotated chain should be served after the server reloads")
+	chain, err := ca.servedCAChain()
+	util.FatalError(t, err, "Failed to get the CA chain")
+	assert.Equal(t, strongETag(rotated), chain.etag, "The cached ETag should be that of the rotated chain")
+
+	resp, body := get(etag)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "The CA information should be returned again after the rotation")
+	assert.Contains(t, string(body), util.B64Encode(rotated))
+	newETag := resp.Header.Get("ETag")
+	assert.NotEqual(t, etag, newETag, "The ETag of the CA information should change with its chain")
+	resp, _ = get(newETag)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	certs, err := ca.getCACerts()
+	util.FatalError(t, err, "Failed to get the CA certificates")
+	assert.Equal(t, float64(certs.chain.certs[0].NotAfter.Unix()), srv.metrics.Get(metricCAChainNotAfter).With(ca.Config.CA.Name).Value(),
+		"The metric should be the expiry of the rotated chain")
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/cloudflare/cfssl/config"
 	"github.com/hyperledger/fabric-ca/api"
 	"github.com/hyperledger/fabric-ca/lib/dbutil"
+	"github.com/hyperledger/fabric-ca/lib/kms"
 	"github.com/hyperledger/fabric-ca/lib/ldap"
 	"github.com/hyperledger/fabric-ca/lib/server/idemix"
 	"github.com/hyperledger/fabric-ca/lib/tls"
@@ -89,12 +90,18 @@ type CAConfig struct {
 	LDAP         ldap.Config
 	DB           CAConfigDB
 	CSP          *factory.FactoryOpts `mapstructure:"bccsp" hide:"true"`
+	KMS          kms.Config
 	// Optional client config for an intermediate server which acts as a client
 	// of the root (or parent) server
 	Client       *ClientConfig `skip:"true"`
 	Intermediate IntermediateCA
 	CRL          CRLConfig
+	Idempotency  IdempotencyConfig
 	Idemix       idemix.Config
+	Rollover     RolloverConfig
+	SCEP         SCEPConfig
+	EST          ESTConfig
+	SPIFFE       SPIFFEConfig
 }
 
 // CfgOptions is a CA configuration that allows for setting different options
@@ -174,6 +181,61 @@ type CRLConfig struct {
 	// The number of hours specified by this property is added to the UTC time, resulting time
 	// is used to set the 'Next Update' date of the CRL
 	Expiry time.Duration `def:"24h" help:"Expiration for the CRL generated by the gencrl request"`
+	// File to which the CRL of all the revoked certificates is published
+	// each time it is generated, and from which the crl endpoint serves it
+	PublishFile string `help:"File to which the CRL of all the revoked certificates is published when it is generated, and from which the crl endpoint serves it"`
+}
+
+// IdempotencyConfig is the configuration of the idempotency keys with which
+// clients may safely retry register and revoke requests
+type IdempotencyConfig struct {
+	// How long the response to a request with an idempotency key is kept
+	// and returned to a request with the same key, or 0 to ignore the keys
+	Retention time.Duration `def:"24h" help:"How long the response to a register or revoke request with an idempotency key is kept and returned to a retry of the request; 0 ignores idempotency keys"`
+}
+
+// RolloverConfig is the configuration of a key rollover, during which the CA
+// issues certificates with its new key but still accepts the certificates
+// issued under its previous key
+type RolloverConfig struct {
+	// Certificate of the CA's previous key
+	PreviousCertfile string `def:"ca-cert-previous.pem" help:"PEM-encoded certificate of the CA's previous key"`
+	// Time until which the certificates issued under the previous key are accepted
+	Cutover string `help:"UTC timestamp (in RFC3339 format) until which certificates issued under the CA's previous key are accepted; if not set, there is no key rollover"`
+}
+
+// SCEPConfig is the configuration of the CA's SCEP responder, which enrolls
+// network devices with the Simple Certificate Enrollment Protocol
+type SCEPConfig struct {
+	Enabled bool `def:"false" help:"Enables the SCEP responder of the CA"`
+	// Signing profile of the certificates issued by the SCEP responder
+	Profile string `help:"Name of the signing profile of the certificates issued by the SCEP responder; if not set, the default profile is used"`
+	// RSA certificate and key with which the responder signs and decrypts
+	// SCEP messages; the certificate must be issued by the CA
+	Certfile string `def:"scep-cert.pem" help:"PEM-encoded RSA certificate of the SCEP responder, issued by the CA"`
+	Keyfile  string `def:"scep-key.pem" help:"PEM-encoded RSA key of the SCEP responder"`
+}
+
+// ESTConfig is the configuration of the CA's responder of Enrollment over
+// Secure Transport (EST)
+type ESTConfig struct {
+	Enabled bool `def:"false" help:"Enables the EST responder of the CA"`
+	// Signing profile of the certificates issued by the EST responder
+	Profile string `help:"Name of the signing profile of the certificates issued by the EST responder; if not set, the default profile is used"`
+}
+
+// SPIFFEConfig is the configuration of the X.509 SPIFFE Verifiable Identity
+// Documents (X.509-SVIDs) issued by the CA with its SPIFFE signing profile
+type SPIFFEConfig struct {
+	TrustDomain string `help:"SPIFFE trust domain of the CA; if set, the certificates issued with the SPIFFE signing profile are X.509-SVIDs"`
+	// Signing profile of the X.509-SVIDs, which is created if it does not
+	// exist
+	Profile string `def:"spiffe" help:"Name of the signing profile of the X.509-SVIDs"`
+	// Template of the path of the SPIFFE ID of an identity
+	Path string `def:"/{{.Affiliation}}/{{.ID}}" help:"Template of the path of the SPIFFE ID of an identity, with the fields ID, Type and Affiliation, whose levels are separated by '/'"`
+	// DNS names and IP addresses which an X.509-SVID may have in addition
+	// to its SPIFFE ID
+	Hosts []string `help:"A list of comma-separated DNS names, which may begin with '*.', and IP addresses which an X.509-SVID may have"`
 }
 
 func (cc CAConfigIdentity) String() string {
@@ -13,6 +13,7 @@ import (
 	"reflect"
 
 	cfsslapi "github.com/cloudflare/cfssl/api"
+	cferr "github.com/cloudflare/cfssl/errors"
 	"github.com/cloudflare/cfssl/log"
 	"github.com/pkg/errors"
 )
@@ -165,8 +166,165 @@ const (
 	ErrAuthorizationFailure = 71
 	// Action is not allowed when using LDAP
 	ErrInvalidLDAPAction = 72
+	// The caller does not have authority to perform server administration
+	ErrNoAdminAuth = 73
+	// Invalid log level
+	ErrInvalidLogLevel = 74
+	// The CA has no previous key because no key rollover is configured
+	ErrNoKeyRollover = 75
+	// Too many requests are in progress at the endpoint
+	ErrServerBusy = 76
+	// The secret of a request to the admin listener is missing or invalid
+	ErrInvalidAdminSecret = 77
+	// Failed to reload the server's configuration
+	ErrReloadFailed = 78
+	// Failed to purge expired records from the database
+	ErrPurgeFailed = 79
+	// The identity is already registered
+	ErrIdentityExists = 80
+	// The affiliation already exists
+	ErrAffiliationExists = 81
+	// A query parameter of a list request is invalid
+	ErrInvalidListParm = 82
+	// The request body, once decompressed, is larger than the server allows
+	ErrReqBodyTooLarge = 83
+	// The request body has a content encoding which the server does not support
+	ErrUnsupportedEncoding = 84
+	// The CA has not published a CRL
+	ErrNoPublishedCRL = 85
+	// The idempotency key of a request is invalid
+	ErrInvalidIdempotencyKey = 86
+	// The idempotency key of a request was used for a different request
+	ErrIdempotencyKeyReused = 87
+	// A request with the same idempotency key is being processed
+	ErrIdempotencyKeyInProgress = 88
+	// The CA failed to sign the certificate
+	ErrSigningFailure = 89
+	// The request body was not received within the body read timeout
+	ErrReqBodyTimeout = 90
 )
 
+// Class is the class of an error, which is the machine-readable code of the
+// error envelope returned to clients
+type Class string
+
+// Error classes
+const (
+	// The caller could not be authenticated
+	ClassAuthentication Class = "authentication"
+	// The caller is not authorized to make the request
+	ClassAuthorization Class = "authorization"
+	// What the request is about does not exist
+	ClassNotFound Class = "not_found"
+	// What the request would create already exists
+	ClassAlreadyExists Class = "already_exists"
+	// The request is valid but is not allowed by the server's policy
+	ClassPolicyViolation Class = "policy_violation"
+	// A backend of the server, such as the database, is unavailable
+	ClassBackendUnavailable Class = "backend_unavailable"
+	// The request is invalid
+	ClassValidation Class = "validation"
+	// The server failed to handle the request
+	ClassInternal Class = "internal"
+)
+
+// Classes are the classes of errors
+var Classes = []Class{
+	ClassAuthentication,
+	ClassAuthorization,
+	ClassNotFound,
+	ClassAlreadyExists,
+	ClassPolicyViolation,
+	ClassBackendUnavailable,
+	ClassValidation,
+	ClassInternal,
+}
+
+// codeClasses are the classes of the error codes whose class is not implied
+// by the HTTP status code of the errors
+var codeClasses = map[int]Class{
+	ErrAuthenticationFailure: ClassAuthentication,
+	ErrAuthorizationFailure:  ClassAuthorization,
+	ErrCANotFound:            ClassNotFound,
+	ErrRevCertNotFound:       ClassNotFound,
+	ErrRevokeIDNotFound:      ClassNotFound,
+	ErrCertAlreadyRevoked:    ClassAlreadyExists,
+	ErrIdentityExists:        ClassAlreadyExists,
+	ErrAffiliationExists:     ClassAlreadyExists,
+	ErrInvalidLDAPAction:     ClassPolicyViolation,
+	ErrNoKeyRollover:         ClassPolicyViolation,
+	ErrConnectingDB:          ClassBackendUnavailable,
+	ErrServerBusy:            ClassBackendUnavailable,
+}
+
+// classStatusCodes are the HTTP status codes of the error envelopes by class
+var classStatusCodes = map[Class]int{
+	ClassAuthentication:     http.StatusUnauthorized,
+	ClassAuthorization:      http.StatusForbidden,
+	ClassNotFound:           http.StatusNotFound,
+	ClassAlreadyExists:      http.StatusConflict,
+	ClassPolicyViolation:    http.StatusUnprocessableEntity,
+	ClassBackendUnavailable: http.StatusServiceUnavailable,
+	ClassValidation:         http.StatusBadRequest,
+	ClassInternal:           http.StatusInternalServerError,
+}
+
+// ClassOf returns the class of an error with the error code 'code' and the
+// HTTP status code 'scode'
+func ClassOf(scode, code int) Class {
+	if class, ok := codeClasses[code]; ok {
+		return class
+	}
+	switch {
+	case scode == http.StatusUnauthorized:
+		return ClassAuthentication
+	case scode == http.StatusForbidden:
+		return ClassAuthorization
+	case scode == http.StatusNotFound:
+		return ClassNotFound
+	case scode == http.StatusConflict:
+		return ClassAlreadyExists
+	case scode == http.StatusUnprocessableEntity:
+		return ClassPolicyViolation
+	case scode == http.StatusServiceUnavailable || scode == http.StatusGatewayTimeout:
+		return ClassBackendUnavailable
+	case scode >= 400 && scode < 500:
+		return ClassValidation
+	}
+	return ClassInternal
+}
+
+// Error returns the class, so that errors.Is(err, class) tells whether 'err'
+// is an HTTP error of the class
+func (c Class) Error() string {
+	return string(c)
+}
+
+// StatusCode returns the HTTP status code of an error envelope of the class
+func (c Class) StatusCode() int {
+	if scode, ok := classStatusCodes[c]; ok {
+		return scode
+	}
+	return http.StatusInternalServerError
+}
+
+// ErrorResponse is the error envelope which the server returns for a failed
+// request
+type ErrorResponse struct {
+	// Code is the class of the error
+	Code Class `json:"code"`
+	// Message describes the error
+	Message string `json:"message"`
+	// Details of the error
+	Details ErrorDetails `json:"details"`
+}
+
+// ErrorDetails are the details of an error envelope
+type ErrorDetails struct {
+	// ErrorCode is the specific error code, as in the legacy response format
+	ErrorCode int `json:"errorcode"`
+}
+
 // CreateHTTPErr constructs a new HTTP error.
 func CreateHTTPErr(scode, code int, format string, args ...interface{}) *HTTPErr {
 	msg := fmt.Sprintf(format, args...)
@@ -202,6 +360,101 @@ func NewAuthorizationErr(code int, format string, args ...interface{}) error {
 	return errors.Wrap(he, "")
 }
 
+// The errors of the constructors below are not wrapped with a stack, so that
+// errors.As finds the *HTTPErr both in them and in the errors which wrap them
+// with fmt.Errorf("%w"). Their message is returned to the client, and the
+// cause of an unavailable or internal error is only logged by the server.
+
+// NewNotFoundErr constructs an HTTP error indicating that what the request is
+// about does not exist
+func NewNotFoundErr(code int, format string, args ...interface{}) error {
+	return CreateHTTPErr(http.StatusNotFound, code, format, args...)
+}
+
+// NewConflictErr constructs an HTTP error indicating that what the request
+// would create already exists
+func NewConflictErr(code int, format string, args ...interface{}) error {
+	return CreateHTTPErr(http.StatusConflict, code, format, args...)
+}
+
+// NewValidationErr constructs an HTTP error indicating that the request is
+// invalid
+func NewValidationErr(code int, format string, args ...interface{}) error {
+	return CreateHTTPErr(http.StatusBadRequest, code, format, args...)
+}
+
+// NewUnavailableErr constructs an HTTP error indicating that a backend of the
+// server, such as the database, failed with the error 'cause'
+func NewUnavailableErr(code int, cause error, format string, args ...interface{}) error {
+	return newCausedErr(http.StatusServiceUnavailable, code, cause, format, args...)
+}
+
+// NewInternalErr constructs an HTTP error indicating that the server failed to
+// handle the request because of the error 'cause'
+func NewInternalErr(code int, cause error, format string, args ...interface{}) error {
+	return newCausedErr(http.StatusInternalServerError, code, cause, format, args...)
+}
+
+// NewCFSSLErr constructs an HTTP error of the failure 'cause' of cfssl. A
+// cfssl error about the certificate request or the signing policy is a
+// validation error whose message has the cfssl message; any other failure is
+// an internal error.
+func NewCFSSLErr(code int, cause error, format string, args ...interface{}) error {
+	if ce, ok := errors.Cause(cause).(*cferr.Error); ok {
+		switch cferr.Category(ce.ErrorCode / 1000 * 1000) {
+		case cferr.CSRError, cferr.PolicyError:
+			he := CreateHTTPErr(http.StatusBadRequest, code, format, args...)
+			he.lmsg = fmt.Sprintf("%s: %s", he.lmsg, ce.Message)
+			he.rmsg = he.lmsg
+			he.cause = cause
+			return he
+		}
+	}
+	return NewInternalErr(code, cause, format, args...)
+}
+
+// newCausedErr constructs an HTTP error whose local message is followed by
+// the message of the error 'cause'
+func newCausedErr(scode, code int, cause error, format string, args ...interface{}) *HTTPErr {
+	he := CreateHTTPErr(scode, code, format, args...)
+	if cause != nil {
+		he.lmsg = fmt.Sprintf("%s: %s", he.lmsg, cause)
+		he.cause = cause
+	}
+	return he
+}
+
+// AsHTTPErr returns the top-most HTTP error in the chain of errors which
+// caused 'err', whether they are wrapped by pkg/errors or by fmt.Errorf, or
+// nil if there is none
+func AsHTTPErr(err error) *HTTPErr {
+	type causer interface {
+		Cause() error
+	}
+	type wrapper interface {
+		Unwrap() error
+	}
+	for err != nil {
+		switch e := err.(type) {
+		case *HTTPErr:
+			return e
+		case causer:
+			err = e.Cause()
+		case wrapper:
+			err = e.Unwrap()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// Is returns true if 'err' was caused by an HTTP error of the class 'class'
+func Is(err error, class Class) bool {
+	he := AsHTTPErr(err)
+	return he != nil && he.GetClass() == class
+}
+
 // HTTPErr is an HTTP error.
 // "local" refers to errors as logged in the server (local to the server).
 // "remote" refers to errors as returned to the client (remote to the server).
@@ -214,6 +467,7 @@ type HTTPErr struct {
 	lmsg  string // local error message
 	rcode int    // remote error code
 	rmsg  string // remote error message
+	cause error  // error which caused it, which is not returned to the client
 }
 
 // Error returns the string representation
@@ -230,6 +484,17 @@ func (he *HTTPErr) String() string {
 		he.scode, he.lcode, he.lmsg, he.rcode, he.rmsg)
 }
 
+// Unwrap returns the error which caused the HTTP error, if any
+func (he *HTTPErr) Unwrap() error {
+	return he.cause
+}
+
+// Is returns true if 'target' is the class of the HTTP error
+func (he *HTTPErr) Is(target error) bool {
+	class, ok := target.(Class)
+	return ok && he.GetClass() == class
+}
+
 // Remote sets the remote code and message to something different from that of the local code and message
 func (he *HTTPErr) Remote(code int, format string, args ...interface{}) *HTTPErr {
 	he.rcode = code
@@ -254,6 +519,37 @@ func (he *HTTPErr) writeResponse(w errorWriter) error {
 	return nil
 }
 
+// GetClass returns the class of the error, which is that of the local error
+// code unless the error is an authentication or authorization failure
+func (he *HTTPErr) GetClass() Class {
+	switch he.rcode {
+	case ErrAuthenticationFailure, ErrAuthorizationFailure:
+		return ClassOf(he.scode, he.rcode)
+	}
+	return ClassOf(he.scode, he.lcode)
+}
+
+// GetEnvelopeStatusCode returns the HTTP status code of the error envelope of
+// the error, which is that of its class. The status code of an invalid
+// request which is more specific, such as 405, is kept.
+func (he *HTTPErr) GetEnvelopeStatusCode() int {
+	class := he.GetClass()
+	if class == ClassValidation && he.scode >= 400 && he.scode < 500 {
+		return he.scode
+	}
+	return class.StatusCode()
+}
+
+// Envelope returns the error envelope of the error, which contains its
+// remote message and code
+func (he *HTTPErr) Envelope() *ErrorResponse {
+	return &ErrorResponse{
+		Code:    he.GetClass(),
+		Message: he.rmsg,
+		Details: ErrorDetails{ErrorCode: he.rcode},
+	}
+}
+
 // GetRemoteCode returns the remote error code
 func (he *HTTPErr) GetRemoteCode() int {
 	return he.rcode
@@ -0,0 +1,39 @@
+// +build go1.13
+
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package caerrors
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestErrorsIsAs verifies that the errors of the constructors work with the
+// errors.Is and errors.As of the standard library
+func TestErrorsIsAs(t *testing.T) {
+	dbErr := errors.New("connection refused")
+	err := fmt.Errorf("revoke failed: %w", NewInternalErr(ErrRevokeFailure, dbErr, "Revoke failed"))
+
+	var he *HTTPErr
+	if assert.True(t, errors.As(err, &he)) {
+		assert.Equal(t, ErrRevokeFailure, he.GetLocalCode())
+	}
+	assert.True(t, errors.Is(err, ClassInternal))
+	assert.False(t, errors.Is(err, ClassNotFound))
+	assert.True(t, errors.Is(err, dbErr))
+	assert.True(t, Is(err, ClassInternal))
+
+	err = fmt.Errorf("get failed: %w", NewNotFoundErr(ErrDBGet, "Failed to get User"))
+	assert.True(t, errors.Is(err, ClassNotFound))
+	if he := AsHTTPErr(err); assert.NotNil(t, he) {
+		assert.Equal(t, 404, he.GetStatusCode())
+	}
+}
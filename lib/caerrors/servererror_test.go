@@ -7,10 +7,13 @@ SPDX-License-Identifier: Apache-2.0
 package caerrors
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	cferr "github.com/cloudflare/cfssl/errors"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -94,3 +97,108 @@ func (m *mockHTTPWriter) Write(buf []byte) (int, error) {
 	w := m.ResponseWriter
 	return w.Write(buf)
 }
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		err   *HTTPErr
+		class Class
+		scode int
+	}{
+		{CreateHTTPErr(401, ErrInvalidPass, "wrong password").Remote(ErrAuthenticationFailure, "Authentication failure"), ClassAuthentication, 401},
+		{CreateHTTPErr(403, ErrConnectingDB, "no database").Remote(ErrAuthorizationFailure, "Authorization failure"), ClassAuthorization, 403},
+		{CreateHTTPErr(404, ErrCANotFound, "no CA"), ClassNotFound, 404},
+		{CreateHTTPErr(404, ErrCertAlreadyRevoked, "revoked"), ClassAlreadyExists, 409},
+		{CreateHTTPErr(400, ErrAffiliationExists, "exists"), ClassAlreadyExists, 409},
+		{CreateHTTPErr(403, ErrInvalidLDAPAction, "LDAP"), ClassPolicyViolation, 422},
+		{CreateHTTPErr(504, ErrConnectingDB, "no database"), ClassBackendUnavailable, 503},
+		{CreateHTTPErr(400, ErrBadReqBody, "bad body"), ClassValidation, 400},
+		{CreateHTTPErr(405, ErrMethodNotAllowed, "bad method"), ClassValidation, 405},
+		{CreateHTTPErr(500, ErrGettingUser, "failed"), ClassInternal, 500},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.class, test.err.GetClass(), "%s", test.err)
+		assert.Equal(t, test.scode, test.err.GetEnvelopeStatusCode(), "%s", test.err)
+		envelope := test.err.Envelope()
+		assert.Equal(t, test.class, envelope.Code)
+		assert.Equal(t, test.err.GetRemoteMsg(), envelope.Message)
+		assert.Equal(t, test.err.GetRemoteCode(), envelope.Details.ErrorCode)
+	}
+	for _, class := range Classes {
+		assert.Equal(t, class, ClassOf(class.StatusCode(), ErrUnknown))
+	}
+}
+
+func TestErrorConstructors(t *testing.T) {
+	dbErr := errors.New("dial tcp 10.0.0.1:5432: connection refused")
+	tests := []struct {
+		err   error
+		class Class
+		scode int
+		// True if the error has an internal detail
+		internal bool
+	}{
+		{NewAuthenticationErr(ErrInvalidPass, "Login failure: %s", dbErr), ClassAuthentication, 401, true},
+		{NewAuthorizationErr(ErrNotRevoker, "Caller does not have authority: %s", dbErr), ClassAuthorization, 403, true},
+		{NewNotFoundErr(ErrRevokeIDNotFound, "Identity %s was not found", "user1"), ClassNotFound, 404, false},
+		{NewConflictErr(ErrIdentityExists, "Identity '%s' is already registered", "user1"), ClassAlreadyExists, 409, false},
+		{NewValidationErr(ErrBadCSR, "Invalid certificate request"), ClassValidation, 400, false},
+		{NewUnavailableErr(ErrConnectingDB, dbErr, "Failed to process database request"), ClassBackendUnavailable, 503, true},
+		{NewInternalErr(ErrRevokeFailure, dbErr, "Revoke of certificate failed"), ClassInternal, 500, true},
+	}
+	for _, test := range tests {
+		he := AsHTTPErr(test.err)
+		if !assert.NotNil(t, he, "%s", test.err) {
+			continue
+		}
+		assert.Equal(t, test.class, he.GetClass(), "%s", test.err)
+		assert.Equal(t, test.scode, he.GetStatusCode(), "%s", test.err)
+		assert.Equal(t, test.scode, he.GetEnvelopeStatusCode(), "%s", test.err)
+		assert.True(t, Is(test.err, test.class), "%s", test.err)
+		assert.True(t, Is(errors.WithMessage(test.err, "wrapped"), test.class), "%s", test.err)
+		// The internal detail is logged but never returned to the client
+		if test.internal {
+			assert.Contains(t, he.Error(), dbErr.Error())
+		}
+		body, err := json.Marshal(he.Envelope())
+		assert.NoError(t, err)
+		assert.NotContains(t, string(body), "connection refused", "%s", test.err)
+	}
+}
+
+func TestInternalErrCause(t *testing.T) {
+	dbErr := errors.New("connection refused")
+	err := NewInternalErr(ErrRevokeFailure, dbErr, "Revoke failed")
+	he := AsHTTPErr(err)
+	assert.Equal(t, dbErr, he.Unwrap())
+	assert.Equal(t, "Revoke failed: connection refused", he.GetLocalMsg())
+	assert.Equal(t, "Revoke failed", he.GetRemoteMsg())
+	assert.True(t, he.Is(ClassInternal))
+	assert.False(t, he.Is(ClassNotFound))
+	assert.False(t, he.Is(dbErr))
+
+	assert.Nil(t, AsHTTPErr(nil))
+	assert.Nil(t, AsHTTPErr(dbErr))
+	assert.False(t, Is(dbErr, ClassInternal))
+	assert.Nil(t, NewNotFoundErr(ErrDBGet, "Failed to get User").(*HTTPErr).Unwrap())
+}
+
+func TestCFSSLErr(t *testing.T) {
+	err := NewCFSSLErr(ErrSigningFailure, cferr.New(cferr.CSRError, cferr.DecodeFailed), "Certificate signing failure")
+	he := AsHTTPErr(err)
+	assert.Equal(t, ClassValidation, he.GetClass())
+	assert.Equal(t, 400, he.GetStatusCode())
+	assert.Equal(t, "Certificate signing failure: CSR Decode failed", he.GetRemoteMsg())
+
+	err = NewCFSSLErr(ErrSigningFailure, cferr.New(cferr.PolicyError, cferr.UnknownProfile), "Certificate signing failure")
+	assert.True(t, Is(err, ClassValidation))
+
+	err = NewCFSSLErr(ErrSigningFailure, cferr.New(cferr.PrivateKeyError, cferr.Unavailable), "Certificate signing failure")
+	he = AsHTTPErr(err)
+	assert.Equal(t, ClassInternal, he.GetClass())
+	assert.Equal(t, "Certificate signing failure", he.GetRemoteMsg())
+	assert.Contains(t, he.GetLocalMsg(), "Private key is unavailable")
+
+	err = NewCFSSLErr(ErrSigningFailure, errors.New("HSM failure"), "Certificate signing failure")
+	assert.True(t, Is(err, ClassInternal))
+	assert.NotContains(t, AsHTTPErr(err).GetRemoteMsg(), "HSM")
+}
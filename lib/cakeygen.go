@@ -0,0 +1,84 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"path/filepath"
+
+	cfcsr "github.com/cloudflare/cfssl/csr"
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+)
+
+// KeyGen generates the key of the server's default CA with its BCCSP, so
+// that the key is generated inside the token if BCCSP is configured with
+// PKCS11, and stores a certificate signing request for the key in 'csrFile'.
+// Once the request is signed, the certificate must be stored in the file
+// specified by ca.certfile; the CA then signs with the key when the server
+// is initialized. The CA must not have a certificate yet.
+func (s *Server) KeyGen(csrFile string) error {
+	if s.HomeDir == "" {
+		s.HomeDir = "."
+	}
+	homeDir, err := filepath.Abs(s.HomeDir)
+	if err != nil {
+		return errors.Wrap(err, "Failed to make server's home directory path absolute")
+	}
+	s.HomeDir = homeDir
+	if s.Config == nil {
+		s.Config = new(ServerConfig)
+	}
+	if s.CA.Config == nil {
+		s.CA.Config = &s.Config.CAcfg
+	}
+	s.CA.server = s
+	s.CA.HomeDir = s.HomeDir
+	return s.CA.keyGen(csrFile)
+}
+
+// keyGen generates the key of the CA; see Server.KeyGen
+func (ca *CA) keyGen(csrFile string) error {
+	err := ca.initConfig()
+	if err != nil {
+		return err
+	}
+	err = ca.makeFileNamesAbsolute()
+	if err != nil {
+		return err
+	}
+	c := ca.Config
+	if c.KMS.Enabled() {
+		return errors.Errorf("The key of CA '%s' is held by the %s KMS key '%s'; create it in the KMS instead",
+			c.CA.Name, c.KMS.Provider, c.KMS.KeyID)
+	}
+	if util.FileExists(c.CA.Certfile) {
+		return errors.Errorf("CA '%s' already has a certificate at '%s'; use the rekey command to replace its key",
+			c.CA.Name, c.CA.Certfile)
+	}
+	ca.csp, err = util.InitBCCSP(&c.CSP, "", ca.HomeDir)
+	if err != nil {
+		return err
+	}
+	req := ca.getRootCertificateRequest()
+	key, cspSigner, err := util.BCCSPKeyRequestGenerate(req, ca.csp)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to generate the CA's key")
+	}
+	csrPEM, err := cfcsr.Generate(cspSigner, req)
+	if err != nil {
+		return errors.Wrap(err, "Failed to generate certificate signing request for the CA's key")
+	}
+	err = writeFile(csrFile, csrPEM, 0644)
+	if err != nil {
+		return errors.Wrap(err, "Failed to store certificate signing request")
+	}
+	log.Infof("The key of CA '%s' was generated by BCCSP provider '%s' with SKI %x", c.CA.Name, c.CSP.ProviderName, key.SKI())
+	log.Infof("The certificate signing request for the key is at: %s", csrFile)
+	log.Infof("Once it is signed, store the certificate at: %s", c.CA.Certfile)
+	return nil
+}
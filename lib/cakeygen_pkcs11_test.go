@@ -0,0 +1,149 @@
+// +build pkcs11
+
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/hyperledger/fabric/bccsp"
+	"github.com/hyperledger/fabric/bccsp/factory"
+	"github.com/hyperledger/fabric/bccsp/pkcs11"
+	cspsigner "github.com/hyperledger/fabric/bccsp/signer"
+	p11 "github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+)
+
+// These tests need a PKCS11 token, such as one of SoftHSM, which is found
+// as by the PKCS11 BCCSP tests: with the PKCS11_LIB, PKCS11_PIN and
+// PKCS11_LABEL environment variables, or else a SoftHSM library in a usual
+// place with the token 'ForFabric' whose PIN is 98765432.
+
+// getPKCS11Opts returns the BCCSP options of the test token, whose PIN is
+// read from an environment variable
+func getPKCS11Opts(t *testing.T) *factory.FactoryOpts {
+	lib, pin, label := pkcs11.FindPKCS11Lib()
+	if lib == "" {
+		t.Skip("No PKCS11 library was found")
+	}
+	os.Setenv("FABRIC_CA_TEST_PKCS11_PIN", pin)
+	return &factory.FactoryOpts{
+		ProviderName: "PKCS11",
+		Pkcs11Opts: &pkcs11.PKCS11Opts{
+			SecLevel:   256,
+			HashFamily: "SHA2",
+			Library:    lib,
+			Label:      label,
+			Pin:        "env:FABRIC_CA_TEST_PKCS11_PIN",
+		},
+	}
+}
+
+func TestCAKeyGenPKCS11(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+	defer os.Unsetenv("FABRIC_CA_TEST_PKCS11_PIN")
+
+	// The key is generated inside the token
+	srv := TestGetServer2(false, rootPort, rootDir, "", -1, t)
+	srv.CA.Config.CSP = getPKCS11Opts(t)
+	csrFile := filepath.Join(rootDir, "ca.csr")
+	err := srv.KeyGen(csrFile)
+	util.FatalError(t, err, "Failed to generate the CA's key in the token")
+	csrPEM, err := ioutil.ReadFile(csrFile)
+	util.FatalError(t, err, "Failed to read certificate signing request")
+	block, _ := pem.Decode(csrPEM)
+	if block == nil {
+		t.Fatal("Invalid PEM-encoded certificate signing request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	util.FatalError(t, err, "Invalid certificate signing request")
+	assert.NoError(t, csr.CheckSignature(), "The request should be signed with the key in the token")
+
+	csp := srv.CA.csp
+	pub, err := csp.KeyImport(csr.PublicKey, &bccsp.ECDSAGoPublicKeyImportOpts{Temporary: true})
+	util.FatalError(t, err, "Failed to import the public key")
+	key, err := csp.GetKey(pub.SKI())
+	util.FatalError(t, err, "The generated key should be in the token")
+	signer, err := cspsigner.New(csp, key)
+	util.FatalError(t, err, "Failed to create signer")
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: csr.Subject.CommonName},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SubjectKeyId:          pub.SKI(),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, csr.PublicKey, signer)
+	util.FatalError(t, err, "Failed to create the CA's certificate")
+	err = ioutil.WriteFile(filepath.Join(rootDir, "ca-cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644)
+	util.FatalError(t, err, "Failed to store the CA's certificate")
+
+	// The CA signs certificates and CRLs with the key in the token
+	srv = TestGetServer2(false, rootPort, rootDir, "", -1, t)
+	srv.CA.Config.CSP = getPKCS11Opts(t)
+	err = srv.Start()
+	util.FatalError(t, err, "Failed to start server with the key in the token")
+	defer srv.Stop()
+	client := TestGetRootClient()
+	defer os.RemoveAll(rootClientDir)
+	resp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll with the key in the token")
+	cert := resp.Identity.GetECert().GetX509Cert()
+	caCert, err := x509.ParseCertificate(certDER)
+	util.FatalError(t, err, "Failed to parse the CA's certificate")
+	assert.NoError(t, cert.CheckSignatureFrom(caCert), "The certificate should be signed with the key in the token")
+
+	// The sessions of the BCCSP are closed, as if the token was reset: the CA
+	// logs in to the token again and still signs
+	closePKCS11Sessions(t, srv.CA.Config.CSP.Pkcs11Opts)
+	caSigner, err := srv.CA.getCASigner(caCert)
+	util.FatalError(t, err, "Failed to get the CA's signer after its sessions were closed")
+	digest := sha256.Sum256([]byte("digest"))
+	_, err = caSigner.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.NoError(t, err, "The CA should sign after its sessions were closed")
+	_, err = resp.Identity.GenCRL(&api.GenCRLRequest{})
+	assert.NoError(t, err, "The CA should generate a CRL after its sessions were closed")
+}
+
+// closePKCS11Sessions closes all of the sessions of the process with the
+// token of 'opts'
+func closePKCS11Sessions(t *testing.T, opts *pkcs11.PKCS11Opts) {
+	ctx := p11.New(opts.Library)
+	if ctx == nil {
+		t.Fatalf("Failed to load PKCS11 library %s", opts.Library)
+	}
+	ctx.Initialize()
+	slots, err := ctx.GetSlotList(true)
+	util.FatalError(t, err, "Failed to get the PKCS11 slots")
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err == nil && info.Label == opts.Label {
+			err = ctx.CloseAllSessions(slot)
+			util.FatalError(t, err, "Failed to close the PKCS11 sessions")
+			return
+		}
+	}
+	t.Fatalf("No PKCS11 token with label %s", opts.Label)
+}
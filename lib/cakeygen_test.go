@@ -0,0 +1,81 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/hyperledger/fabric/bccsp"
+	cspsigner "github.com/hyperledger/fabric/bccsp/signer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCAKeyGen(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+
+	srv := TestGetServer2(false, rootPort, rootDir, "", -1, t)
+	csrFile := filepath.Join(rootDir, "ca.csr")
+	err := srv.KeyGen(csrFile)
+	util.FatalError(t, err, "Failed to generate the CA's key")
+	csrPEM, err := ioutil.ReadFile(csrFile)
+	util.FatalError(t, err, "Failed to read certificate signing request")
+	block, _ := pem.Decode(csrPEM)
+	if block == nil {
+		t.Fatal("Invalid PEM-encoded certificate signing request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	util.FatalError(t, err, "Invalid certificate signing request")
+	assert.NoError(t, csr.CheckSignature(), "The request should be signed with the new key")
+
+	// The request is signed, here by the key itself, and the CA signs with
+	// the generated key once its certificate is stored
+	csp := srv.CA.csp
+	pub, err := csp.KeyImport(csr.PublicKey, &bccsp.ECDSAGoPublicKeyImportOpts{Temporary: true})
+	util.FatalError(t, err, "Failed to import the public key")
+	key, err := csp.GetKey(pub.SKI())
+	util.FatalError(t, err, "The generated key should be stored by BCCSP")
+	signer, err := cspsigner.New(csp, key)
+	util.FatalError(t, err, "Failed to create signer")
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: csr.Subject.CommonName},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SubjectKeyId:          pub.SKI(),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, csr.PublicKey, signer)
+	util.FatalError(t, err, "Failed to create the CA's certificate")
+	certFile := filepath.Join(rootDir, "ca-cert.pem")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644)
+	util.FatalError(t, err, "Failed to store the CA's certificate")
+
+	srv = TestGetServer2(false, rootPort, rootDir, "", -1, t)
+	err = srv.Start()
+	util.FatalError(t, err, "Failed to start server with the generated key")
+	defer srv.Stop()
+	cert, err := getCACert(&srv.CA)
+	util.FatalError(t, err, "Failed to get the CA's certificate")
+	assert.Equal(t, certDER, cert.Raw, "The CA should use the certificate of the generated key")
+
+	// The key of a CA which has a certificate is replaced by rekeying it
+	err = TestGetServer2(false, rootPort, rootDir, "", -1, t).KeyGen(csrFile)
+	util.ErrorContains(t, err, "already has a certificate", "Key generation should fail if the CA has a certificate")
+}
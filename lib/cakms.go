@@ -0,0 +1,164 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/cloudflare/cfssl/config"
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/cfssl/signer"
+	"github.com/cloudflare/cfssl/signer/local"
+	"github.com/hyperledger/fabric-ca/lib/kms"
+	"github.com/hyperledger/fabric-ca/lib/metrics"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+)
+
+// The names of the metrics of the requests to the cloud KMS which holds a
+// CA's key
+const (
+	metricKMSRequests        = "fabric_ca_kms_requests_total"
+	metricKMSRequestDuration = "fabric_ca_kms_request_duration_seconds"
+)
+
+// newKMSMetrics registers the metrics of the requests to the cloud KMS
+func newKMSMetrics(reg *metrics.Registry) {
+	reg.NewCounter(metricKMSRequests, "Number of requests to the KMS which holds the CA's key", "ca", "provider", "operation", "status")
+	reg.NewSummary(metricKMSRequestDuration, "Time taken by requests to the KMS which holds the CA's key", "ca", "provider", "operation")
+}
+
+// initKMS creates the signer of the CA's key if it is held by a cloud KMS
+func (ca *CA) initKMS() error {
+	cfg := &ca.Config.KMS
+	if !cfg.Enabled() {
+		return nil
+	}
+	s, err := kms.New(cfg, ca.observeKMS)
+	if err != nil {
+		return errors.WithMessage(err, fmt.Sprintf("Failed to initialize the KMS key of CA '%s'", ca.Config.CA.Name))
+	}
+	ca.kms = s
+	return nil
+}
+
+// observeKMS records the metrics of a request to the KMS
+func (ca *CA) observeKMS(operation string, duration time.Duration, err error) {
+	if ca.server == nil {
+		return
+	}
+	status := "success"
+	if err != nil {
+		status = "error"
+	}
+	provider := ca.Config.KMS.Provider
+	ca.server.metricWith(metricKMSRequests, ca.Config.CA.Name, provider, operation, status).Add(1)
+	ca.server.metricWith(metricKMSRequestDuration, ca.Config.CA.Name, provider, operation).Observe(duration.Seconds())
+}
+
+// initKMSKeyMaterial checks that the CA certificate in 'certFile' is that
+// of the CA's KMS key and loads the CA's CN from it
+func (ca *CA) initKMSKeyMaterial(certFile string) error {
+	cert, err := ca.validateCert(certFile)
+	if err != nil {
+		return errors.WithMessage(err, "Validation of certificate failed")
+	}
+	if !equalPublicKeys(cert.PublicKey, ca.kms.Public()) {
+		return errors.Errorf("The certificate in '%s' is not that of the %s KMS key '%s'", certFile, ca.kms.Provider(), ca.kms.KeyID())
+	}
+	log.Info("The CA certificate already exists")
+	log.Infof("The key is held by the %s KMS key '%s'", ca.kms.Provider(), ca.kms.KeyID())
+	log.Infof("The certificate is at: %s", certFile)
+	ca.Config.CSR.CN, err = ca.loadCNFromEnrollmentInfo(certFile)
+	if err != nil {
+		return errors.WithMessage(err, fmt.Sprintf("Failed to get CN for certificate in '%s'", certFile))
+	}
+	return nil
+}
+
+// newKMSSigner creates a signer which signs certificates with the CA's KMS
+// key according to 'policy'
+func (ca *CA) newKMSSigner(policy *config.Signing) (signer.Signer, error) {
+	cert, err := util.GetX509CertificateFromPEMFile(ca.Config.CA.Certfile)
+	if err != nil {
+		return nil, err
+	}
+	s, err := local.NewSigner(ca.kms, cert, signer.DefaultSigAlgo(ca.kms), policy)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create new signer")
+	}
+	return s, nil
+}
+
+// getCASigner returns the signer of the CA's key whose certificate is 'cert':
+// the KMS key if it is that key, or else the key stored by BCCSP
+func (ca *CA) getCASigner(cert *x509.Certificate) (crypto.Signer, error) {
+	if ca.kms != nil && equalPublicKeys(cert.PublicKey, ca.kms.Public()) {
+		return ca.kms, nil
+	}
+	_, s, err := util.GetSignerFromCert(cert, ca.csp)
+	return s, err
+}
+
+// selfTestKMS signs a random digest with the CA's KMS key and verifies the
+// signature with the CA certificate's public key
+func (ca *CA) selfTestKMS() error {
+	cert, err := util.GetX509CertificateFromPEMFile(ca.Config.CA.Certfile)
+	if err != nil {
+		return err
+	}
+	digest := make([]byte, sha256.Size)
+	_, err = rand.Read(digest)
+	if err != nil {
+		return errors.Wrap(err, "Failed to generate a digest")
+	}
+	sig, err := ca.kms.Sign(rand.Reader, digest, crypto.SHA256)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to sign with the KMS key")
+	}
+	switch pub := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		var ecSig struct {
+			R, S *big.Int
+		}
+		_, err = asn1.Unmarshal(sig, &ecSig)
+		if err == nil && !ecdsa.Verify(pub, digest, ecSig.R, ecSig.S) {
+			err = errors.New("invalid signature")
+		}
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig)
+	default:
+		err = errors.Errorf("unsupported key type %T", pub)
+	}
+	if err != nil {
+		return errors.Wrap(err, "The signature of the KMS key does not verify with the CA certificate's public key")
+	}
+	return nil
+}
+
+// equalPublicKeys returns true if 'a' and 'b' are the same public key
+func equalPublicKeys(a, b crypto.PublicKey) bool {
+	aDER, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return false
+	}
+	bDER, err := x509.MarshalPKIXPublicKey(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(aDER, bDER)
+}
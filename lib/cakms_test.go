@@ -0,0 +1,146 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib/kms"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+const testKMSKeyARN = "arn:aws:kms:us-east-1:111122223333:key/ca"
+
+// newAWSKMSStub returns a stub of AWS KMS which holds 'key' as the key
+// testKMSKeyARN
+func newAWSKMSStub(t *testing.T, key crypto.Signer) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			KeyID   string `json:"KeyId"`
+			Message []byte
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || req.KeyID != testKMSKeyARN {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"NotFoundException","message":"Key not found"}`))
+			return
+		}
+		var resp interface{}
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.GetPublicKey":
+			der, err := x509.MarshalPKIXPublicKey(key.Public())
+			assert.NoError(t, err)
+			resp = map[string]interface{}{"KeyId": req.KeyID, "PublicKey": der}
+		case "TrentService.Sign":
+			sig, err := key.Sign(rand.Reader, req.Message, crypto.SHA256)
+			assert.NoError(t, err)
+			resp = map[string]interface{}{"KeyId": req.KeyID, "Signature": sig}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func TestCAKMS(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "testsecret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	util.FatalError(t, err, "Failed to generate the key of the KMS")
+	stub := newAWSKMSStub(t, key)
+	defer stub.Close()
+	kmsConfig := kms.Config{Provider: kms.ProviderAWS, KeyID: testKMSKeyARN, Endpoint: stub.URL}
+
+	// The root CA's certificate is self-signed with the KMS key
+	srv := TestGetRootServer(t)
+	srv.CA.Config.KMS = kmsConfig
+	err = srv.Start()
+	util.FatalError(t, err, "Failed to start the server with a KMS key")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	caCert, err := util.GetX509CertificateFromPEMFile(srv.CA.Config.CA.Certfile)
+	util.FatalError(t, err, "Failed to read the CA's certificate")
+	assert.Equal(t, &key.PublicKey, caCert.PublicKey, "The CA's certificate should be that of the KMS key")
+	assert.NoError(t, caCert.CheckSignatureFrom(caCert))
+
+	// The enrollment certificates are signed with the KMS key
+	c := TestGetRootClient()
+	enrollResp, err := c.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin'")
+	admin := enrollResp.Identity
+	assert.NoError(t, admin.GetECert().GetX509Cert().CheckSignatureFrom(caCert))
+
+	// as are the CRLs
+	crlPEM, err := genCRL(&srv.CA, api.GenCRLRequest{CAName: srv.CA.Config.CA.Name}, srv.CA.Config.CRL)
+	util.FatalError(t, err, "Failed to generate a CRL")
+	crl, err := x509.ParseCRL(crlPEM)
+	util.FatalError(t, err, "Failed to parse the CRL")
+	assert.NoError(t, caCert.CheckCRLSignature(crl))
+
+	// The self-test signs with the KMS key
+	resp, err := admin.SelfTest()
+	util.FatalError(t, err, "Failed to run the self-test")
+	assert.True(t, resp.Passed)
+	components := []string{}
+	for _, r := range resp.Results {
+		components = append(components, r.Component)
+	}
+	assert.Contains(t, components, srv.CA.Config.CA.Name+"/kms")
+
+	// The requests to the KMS are measured
+	signs := srv.metrics.Get(metricKMSRequests).With(srv.CA.Config.CA.Name, kms.ProviderAWS, kms.OpSign, "success")
+	assert.True(t, signs.Value() >= 3, "The certificate, CRL and self-test signatures should be counted")
+
+	// The CA can't be rekeyed; its new key is created in the KMS
+	err = srv.CA.rekey("")
+	util.ErrorContains(t, err, "create its new key in the KMS", "A CA whose key is in a KMS should not be rekeyed")
+}
+
+func TestCAKMSMismatch(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "testsecret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	util.FatalError(t, err, "Failed to generate the key of the KMS")
+	stub := newAWSKMSStub(t, key)
+	defer stub.Close()
+
+	// The CA's certificate is that of a key in BCCSP
+	srv := TestGetRootServer(t)
+	defer os.RemoveAll(rootDir)
+	err = srv.init(false)
+	util.FatalError(t, err, "Failed to initialize the server")
+
+	// so a KMS key isn't used with it
+	srv = TestGetServer2(false, rootPort, rootDir, "", -1, t)
+	srv.CA.Config.KMS = kms.Config{Provider: kms.ProviderAWS, KeyID: testKMSKeyARN, Endpoint: stub.URL}
+	err = srv.init(false)
+	util.ErrorContains(t, err, "is not that of the aws KMS key", "The CA's certificate should be that of the KMS key")
+	problems := srv.Validate()
+	assert.Contains(t, problems, ConfigProblem{CA: srv.CA.Config.CA.Name, Setting: "ca.certfile",
+		Message: "The certificate in '" + srv.CA.Config.CA.Certfile + "' is not that of the aws KMS key '" + testKMSKeyARN + "'"})
+
+	// An unknown key fails the initialization of the CA
+	srv.CA.Config.KMS.KeyID = "arn:aws:kms:us-east-1:111122223333:key/other"
+	err = srv.init(false)
+	util.ErrorContains(t, err, "NotFoundException", "An unknown KMS key should fail the initialization")
+}
@@ -0,0 +1,178 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"time"
+
+	cfcsr "github.com/cloudflare/cfssl/csr"
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+)
+
+// Rekey generates a new key for the server's default CA. If 'csrFile' is
+// empty, a certificate for the new key is self-signed (for a root CA) or
+// obtained from the parent server (for an intermediate CA) and replaces the
+// CA's certificate. Otherwise, a certificate signing request for the new key
+// is stored in 'csrFile' so that it can be signed by another CA, and the
+// resulting certificate must then replace the CA's certificate. In both cases,
+// the CA's current certificate is stored in the file specified by
+// rollover.previouscertfile, so that a key rollover can be configured by
+// setting rollover.cutover.
+func (s *Server) Rekey(csrFile string) error {
+	err := s.init(false)
+	defer func() {
+		err2 := s.closeDB()
+		if err2 != nil {
+			log.Errorf("Close DB failed: %s", err2)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	return s.CA.rekey(csrFile)
+}
+
+// rekey generates a new key for the CA; see Server.Rekey
+func (ca *CA) rekey(csrFile string) error {
+	c := ca.Config
+	if ca.kms != nil {
+		return errors.Errorf("The key of CA '%s' is held by the %s KMS key '%s'; create its new key in the KMS instead",
+			c.CA.Name, ca.kms.Provider(), ca.kms.KeyID())
+	}
+	if ca.rolloverActive() {
+		return errors.Errorf("A key rollover of CA '%s' is in progress until %s; the CA can't be rekeyed before then",
+			c.CA.Name, c.Rollover.Cutover)
+	}
+	currentCert, err := ioutil.ReadFile(c.CA.Certfile)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read the CA's certificate '%s'", c.CA.Certfile)
+	}
+
+	if csrFile != "" {
+		req := ca.getRootCertificateRequest()
+		_, cspSigner, err := util.BCCSPKeyRequestGenerate(req, ca.csp)
+		if err != nil {
+			return err
+		}
+		csrPEM, err := cfcsr.Generate(cspSigner, req)
+		if err != nil {
+			return errors.Wrap(err, "Failed to generate certificate signing request for the CA's new key")
+		}
+		err = writeFile(csrFile, csrPEM, 0644)
+		if err != nil {
+			return errors.Wrap(err, "Failed to store certificate signing request")
+		}
+		err = writeFile(c.Rollover.PreviousCertfile, currentCert, 0644)
+		if err != nil {
+			return errors.Wrap(err, "Failed to store the CA's previous certificate")
+		}
+		log.Infof("The certificate signing request for the new key of CA '%s' is at: %s", c.CA.Name, csrFile)
+		log.Infof("Once it is signed, store the certificate at: %s", c.CA.Certfile)
+		return nil
+	}
+
+	isRoot := c.Intermediate.ParentServer.URL == ""
+	if !isRoot {
+		// The CN of an intermediate CA is the ID used to enroll with the parent server
+		c.CSR.CN = ""
+	}
+	cert, err := ca.getCACert()
+	if err != nil {
+		return err
+	}
+	err = writeFile(c.Rollover.PreviousCertfile, currentCert, 0644)
+	if err != nil {
+		return errors.Wrap(err, "Failed to store the CA's previous certificate")
+	}
+	err = writeFile(c.CA.Certfile, cert, 0644)
+	if err != nil {
+		return errors.Wrap(err, "Failed to store certificate")
+	}
+	if isRoot && util.FileExists(c.CA.Chainfile) {
+		err = writeFile(c.CA.Chainfile, cert, 0644)
+		if err != nil {
+			return errors.Wrap(err, "Failed to store the CA's chain")
+		}
+	}
+	// The previous key remains in the BCCSP keystore, so that the CRL of the
+	// certificates issued under it can still be signed
+	if util.FileExists(c.CA.Keyfile) {
+		err = os.Rename(c.CA.Keyfile, c.CA.Keyfile+".previous")
+		if err != nil {
+			return errors.Wrapf(err, "Failed to rename the CA's previous key file '%s'", c.CA.Keyfile)
+		}
+	}
+	log.Infof("The new key and certificate were generated for CA '%s'", c.CA.Name)
+	log.Infof("The certificate is at: %s", c.CA.Certfile)
+	log.Infof("The previous certificate is at: %s", c.Rollover.PreviousCertfile)
+	return ca.refreshCACerts()
+}
+
+// initRollover loads the certificate of the CA's previous key if a key
+// rollover is configured
+func (ca *CA) initRollover() error {
+	ca.previousCert = nil
+	r := &ca.Config.Rollover
+	if r.Cutover == "" {
+		return nil
+	}
+	cutover, err := time.Parse(time.RFC3339, r.Cutover)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid 'rollover.cutover' value '%s'", r.Cutover)
+	}
+	prev, err := util.GetX509CertificateFromPEMFile(r.PreviousCertfile)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to load the certificate of the CA's previous key")
+	}
+	cur, err := getCACert(ca)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(prev.SubjectKeyId, cur.SubjectKeyId) {
+		return errors.Errorf("The certificate '%s' has the same key as the CA's certificate '%s'",
+			r.PreviousCertfile, ca.Config.CA.Certfile)
+	}
+	ca.previousCert = prev
+	ca.rolloverCutover = cutover
+	// The chain served during the rollover also has the previous certificate
+	err = ca.refreshCACerts()
+	if err != nil {
+		return err
+	}
+	if ca.rolloverActive() {
+		log.Infof("Key rollover of CA '%s' is in progress; certificates issued under its previous key are accepted until %s",
+			ca.Config.CA.Name, r.Cutover)
+	} else {
+		log.Infof("Key rollover of CA '%s' ended at %s", ca.Config.CA.Name, r.Cutover)
+	}
+	return nil
+}
+
+// rolloverActive returns true if the CA still accepts the certificates issued
+// under its previous key
+func (ca *CA) rolloverActive() bool {
+	return ca.previousCert != nil && time.Now().Before(ca.rolloverCutover)
+}
+
+// checkRolloverCutover returns an error if 'cert' was issued under the CA's
+// previous key and the cutover of the key rollover has passed
+func (ca *CA) checkRolloverCutover(cert *x509.Certificate) error {
+	if ca.previousCert == nil || ca.rolloverActive() {
+		return nil
+	}
+	if len(cert.AuthorityKeyId) > 0 && bytes.Equal(cert.AuthorityKeyId, ca.previousCert.SubjectKeyId) {
+		return errors.Errorf("The certificate was issued under the CA's previous key, which is not accepted after %s",
+			ca.Config.Rollover.Cutover)
+	}
+	return nil
+}
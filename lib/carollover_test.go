@@ -0,0 +1,163 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCARekey(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+
+	// Enroll two identities under the CA's original key
+	client := TestGetRootClient()
+	enroll := func() *Identity {
+		resp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+		util.FatalError(t, err, "Failed to enroll 'admin'")
+		return resp.Identity
+	}
+	old1 := enroll()
+	old2 := enroll()
+	oldCACert, err := getCACert(&srv.CA)
+	util.FatalError(t, err, "Failed to get CA certificate")
+
+	// Without a rollover, there is no previous key to generate a CRL for
+	_, err = old1.GenCRL(&api.GenCRLRequest{PreviousKey: true})
+	util.ErrorContains(t, err, "does not have a previous key", "GenCRL for the previous key should fail without a rollover")
+
+	// Shut down the server so that the client does not reuse its connections
+	err = srv.Shutdown()
+	util.FatalError(t, err, "Failed to shut down server")
+
+	srv = TestGetServer2(false, rootPort, rootDir, "", -1, t)
+	err = srv.Rekey("")
+	util.FatalError(t, err, "Failed to rekey the CA")
+	prevCert, err := util.GetX509CertificateFromPEMFile(filepath.Join(rootDir, "ca-cert-previous.pem"))
+	util.FatalError(t, err, "Failed to load the CA's previous certificate")
+	assert.Equal(t, oldCACert.Raw, prevCert.Raw, "The previous certificate should be the original CA certificate")
+
+	srv = TestGetServer2(false, rootPort, rootDir, "", -1, t)
+	srv.CA.Config.Rollover.Cutover = time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	err = srv.Start()
+	util.FatalError(t, err, "Failed to start server after rekey")
+	newCACert, err := getCACert(&srv.CA)
+	util.FatalError(t, err, "Failed to get CA certificate")
+	assert.NotEqual(t, oldCACert.SubjectKeyId, newCACert.SubjectKeyId, "The CA should have a new key")
+
+	// During the rollover, the chain contains both CA certificates
+	info, err := client.GetCAInfo(&api.GetCAInfoRequest{})
+	util.FatalError(t, err, "Failed to get CA info")
+	assert.Equal(t, 2, countCerts(t, info.CAChain), "The CA chain should contain the previous CA certificate")
+
+	// Certificates issued under the previous key are accepted and new ones are issued with the new key
+	_, err = old1.GenCRL(&api.GenCRLRequest{})
+	assert.NoError(t, err, "Certificate issued under the previous key should be accepted during the rollover")
+	cur := enroll()
+	assert.Equal(t, newCACert.SubjectKeyId, cur.GetECert().GetX509Cert().AuthorityKeyId)
+
+	err = srv.CA.rekey("")
+	util.ErrorContains(t, err, "in progress", "Rekey during a rollover should fail")
+
+	// Each CRL lists the revoked certificates issued under the key which signs it
+	oldSerial := old2.GetECert().GetX509Cert().SerialNumber
+	_, err = cur.Revoke(&api.RevocationRequest{
+		Serial: util.GetSerialAsHex(oldSerial),
+		AKI:    hex.EncodeToString(old2.GetECert().GetX509Cert().AuthorityKeyId),
+	})
+	util.FatalError(t, err, "Failed to revoke certificate issued under the previous key")
+	resp, err := cur.GenCRL(&api.GenCRLRequest{PreviousKey: true})
+	util.FatalError(t, err, "Failed to generate the CRL of the previous key")
+	crl := parseCRL(t, resp.CRL)
+	assert.NoError(t, prevCert.CheckCRLSignature(crl), "CRL should be signed with the previous key")
+	if assert.Len(t, crl.TBSCertList.RevokedCertificates, 1) {
+		assert.Equal(t, 0, oldSerial.Cmp(crl.TBSCertList.RevokedCertificates[0].SerialNumber))
+	}
+	resp, err = cur.GenCRL(&api.GenCRLRequest{})
+	util.FatalError(t, err, "Failed to generate CRL")
+	crl = parseCRL(t, resp.CRL)
+	assert.NoError(t, newCACert.CheckCRLSignature(crl), "CRL should be signed with the new key")
+	assert.Len(t, crl.TBSCertList.RevokedCertificates, 0)
+
+	// After the cutover, certificates issued under the previous key are rejected
+	srv.CA.rolloverCutover = time.Now().Add(-time.Minute)
+	_, err = old1.GenCRL(&api.GenCRLRequest{})
+	assert.Error(t, err, "Certificate issued under the previous key should be rejected after the cutover")
+	_, err = cur.GenCRL(&api.GenCRLRequest{})
+	assert.NoError(t, err, "Certificate issued under the new key should be accepted after the cutover")
+
+	// A certificate signing request for the next key can be generated once the rollover has ended
+	csrFile := filepath.Join(rootDir, "rekey.csr")
+	err = srv.CA.rekey(csrFile)
+	util.FatalError(t, err, "Failed to generate certificate signing request for a new key")
+	csrPEM, err := ioutil.ReadFile(csrFile)
+	util.FatalError(t, err, "Failed to read certificate signing request")
+	block, _ := pem.Decode(csrPEM)
+	if assert.NotNil(t, block, "Invalid PEM-encoded certificate signing request") {
+		_, err = x509.ParseCertificateRequest(block.Bytes)
+		assert.NoError(t, err, "Invalid certificate signing request")
+	}
+}
+
+func TestCARolloverConfig(t *testing.T) {
+	srv := TestGetRootServer(t)
+	defer os.RemoveAll(rootDir)
+	srv.CA.Config.Rollover.Cutover = "tomorrow"
+	err := srv.Init(false)
+	util.ErrorContains(t, err, "Invalid 'rollover.cutover' value", "Invalid cutover should fail")
+
+	srv = TestGetRootServer(t)
+	srv.CA.Config.Rollover.Cutover = time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	err = srv.Init(false)
+	util.ErrorContains(t, err, "previous key", "Missing previous certificate should fail")
+
+	// The previous certificate must have a different key than the current one
+	cert, err := ioutil.ReadFile(filepath.Join(rootDir, "ca-cert.pem"))
+	util.FatalError(t, err, "Failed to read CA certificate")
+	err = ioutil.WriteFile(filepath.Join(rootDir, "ca-cert-previous.pem"), cert, 0644)
+	util.FatalError(t, err, "Failed to write previous CA certificate")
+	srv = TestGetServer2(false, rootPort, rootDir, "", -1, t)
+	srv.CA.Config.Rollover.Cutover = time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	err = srv.Init(false)
+	util.ErrorContains(t, err, "has the same key", "Previous certificate with the current key should fail")
+}
+
+func countCerts(t *testing.T, chain []byte) int {
+	count := 0
+	for {
+		var block *pem.Block
+		block, chain = pem.Decode(chain)
+		if block == nil {
+			return count
+		}
+		count++
+	}
+}
+
+func parseCRL(t *testing.T, crlPEM []byte) *pkix.CertificateList {
+	crl, err := x509.ParseCRL(crlPEM)
+	util.FatalError(t, err, "Failed to parse CRL")
+	return crl
+}
@@ -0,0 +1,108 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+)
+
+// maxVerifiedCerts is the number of certificates whose verification a CA
+// keeps; a certificate is evicted at random to add one beyond it
+const maxVerifiedCerts = 1024
+
+// verifiedCert is a certificate which was verified to be issued by a CA
+type verifiedCert struct {
+	// The time range in which every certificate of the verified chain is
+	// valid, and so in which the verification holds
+	notBefore time.Time
+	notAfter  time.Time
+	// The AKI and serial number in hex, as they are stored in the
+	// certificates table
+	aki    string
+	serial string
+}
+
+// verifiedCerts are the certificates verified against a CA chain keyed by
+// the SHA-256 hash of their DER encoding. Only the verification of the chain
+// is kept:
+// the signature of a token, the expiration and the revocation of the
+// certificate are checked for each request.
+type verifiedCerts struct {
+	mutex sync.RWMutex
+	certs map[[sha256.Size]byte]*verifiedCert
+}
+
+func (v *verifiedCerts) get(key [sha256.Size]byte) *verifiedCert {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	return v.certs[key]
+}
+
+func (v *verifiedCerts) add(key [sha256.Size]byte, vc *verifiedCert) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.certs == nil {
+		v.certs = map[[sha256.Size]byte]*verifiedCert{}
+	}
+	if len(v.certs) >= maxVerifiedCerts {
+		for k := range v.certs {
+			delete(v.certs, k)
+			break
+		}
+	}
+	v.certs[key] = vc
+}
+
+// verifyCertificate verifies that 'cert' was issued by this CA as
+// VerifyCertificate does, reusing the verification of the same certificate
+// against the same chain while every certificate of its chain is valid
+func (ca *CA) verifyCertificate(cert *x509.Certificate) (*verifiedCert, error) {
+	// The cutover of a rollover may pass while the verification is kept
+	err := ca.checkRolloverCutover(cert)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := ca.servedCAChain()
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to get verify options")
+	}
+	key := sha256.Sum256(cert.Raw)
+	now := time.Now()
+	vc := chain.verified.get(key)
+	if vc != nil && !now.Before(vc.notBefore) && !now.After(vc.notAfter) {
+		return vc, nil
+	}
+	if chain.verifyErr != nil {
+		return nil, errors.WithMessage(chain.verifyErr, "Failed to get verify options")
+	}
+	chains, err := cert.Verify(*chain.verifyOptions)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to verify certificate")
+	}
+	vc = &verifiedCert{
+		aki:    strings.ToLower(strings.TrimLeft(hex.EncodeToString(cert.AuthorityKeyId), "0")),
+		serial: strings.ToLower(strings.TrimLeft(util.GetSerialAsHex(cert.SerialNumber), "0")),
+	}
+	for i, c := range chains[0] {
+		if i == 0 || c.NotBefore.After(vc.notBefore) {
+			vc.notBefore = c.NotBefore
+		}
+		if i == 0 || c.NotAfter.Before(vc.notAfter) {
+			vc.notAfter = c.NotAfter
+		}
+	}
+	chain.verified.add(key, vc)
+	return vc, nil
+}
@@ -0,0 +1,154 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCAVerifiedCertificates(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	ca := &srv.CA
+
+	client := TestGetRootClient()
+	enroll := func() *Identity {
+		resp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+		util.FatalError(t, err, "Failed to enroll 'admin'")
+		return resp.Identity
+	}
+	admin := enroll()
+	admin2 := enroll()
+	cert := admin.GetECert().GetX509Cert()
+	verified := func(cert *x509.Certificate) *verifiedCert {
+		chain, err := ca.servedCAChain()
+		util.FatalError(t, err, "Failed to get the CA chain")
+		return chain.verified.get(sha256.Sum256(cert.Raw))
+	}
+
+	// The verification of a certificate is reused by the requests which follow
+	for i := 0; i < 2; i++ {
+		_, err = admin.GetIdentity("admin", "")
+		assert.NoError(t, err, "Failed to authenticate the certificate")
+	}
+	vc := verified(cert)
+	if assert.NotNil(t, vc, "The verification of the certificate should be kept") {
+		assert.Equal(t, strings.TrimLeft(hex.EncodeToString(cert.AuthorityKeyId), "0"), vc.aki)
+		assert.Equal(t, util.GetSerialAsHex(cert.SerialNumber), vc.serial)
+		assert.False(t, vc.notAfter.After(cert.NotAfter))
+	}
+
+	// A verification which no longer holds is made again
+	vc.notAfter = time.Now().Add(-time.Minute)
+	_, err = admin.GetIdentity("admin", "")
+	assert.NoError(t, err, "Failed to authenticate the certificate")
+	assert.True(t, verified(cert).notAfter.After(time.Now()), "The certificate should be verified again")
+
+	// A certificate is rejected once it is revoked even if it was verified
+	_, err = admin2.Revoke(&api.RevocationRequest{
+		Serial: util.GetSerialAsHex(cert.SerialNumber),
+		AKI:    hex.EncodeToString(cert.AuthorityKeyId),
+	})
+	util.FatalError(t, err, "Failed to revoke the certificate")
+	_, err = admin.GetIdentity("admin", "")
+	assert.Error(t, err, "A revoked certificate should not be authenticated")
+
+	// The failed verification of a certificate issued by another CA is not kept
+	other, err := util.GetX509CertificateFromPEMFile(filepath.Join(testdataDir, "ec.pem"))
+	util.FatalError(t, err, "Failed to load certificate")
+	for i := 0; i < 2; i++ {
+		err = ca.VerifyCertificate(other)
+		assert.Error(t, err, "A certificate of another CA should not be verified")
+	}
+	assert.Nil(t, verified(other))
+}
+
+func TestCAVerifiedCertificatesRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caverify")
+	util.FatalError(t, err, "Failed to create temp directory")
+	defer os.RemoveAll(dir)
+
+	root, rootKey := newVerifyTestCert(t, "root", true, nil, nil)
+	int1, _ := newVerifyTestCert(t, "int1", true, root, rootKey)
+	int2, int2Key := newVerifyTestCert(t, "int2", true, root, rootKey)
+	cert, _ := newVerifyTestCert(t, "user", false, int2, int2Key)
+	chainfile := filepath.Join(dir, "ca-chain.pem")
+	writeChain := func(certs ...*x509.Certificate) {
+		var chain []byte
+		for _, c := range certs {
+			chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+		}
+		err := ioutil.WriteFile(chainfile, chain, 0644)
+		util.FatalError(t, err, "Failed to write the CA chain")
+	}
+	ca := &CA{Config: &CAConfig{}}
+	ca.Config.CA.Chainfile = chainfile
+
+	writeChain(int1, int2, root)
+	err = ca.VerifyCertificate(cert)
+	assert.NoError(t, err, "Failed to verify a certificate of the chain")
+
+	// A certificate chained to an intermediate which is removed from the
+	// chain is rejected once the chain is refreshed, though it was verified
+	writeChain(int1, root)
+	err = ca.refreshCACerts()
+	util.FatalError(t, err, "Failed to refresh the CA chain")
+	err = ca.VerifyCertificate(cert)
+	assert.Error(t, err, "A certificate chained to a removed intermediate should not be verified")
+}
+
+// newVerifyTestCert generates a certificate and key issued by 'parent', or a
+// self-signed CA certificate if 'parent' is nil
+func newVerifyTestCert(t *testing.T, cn string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	util.FatalError(t, err, "Failed to generate key")
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	util.FatalError(t, err, "Failed to create certificate")
+	cert, err := x509.ParseCertificate(der)
+	util.FatalError(t, err, "Failed to parse certificate")
+	return cert, key
+}
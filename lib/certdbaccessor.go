@@ -17,6 +17,7 @@ limitations under the License.
 package lib
 
 import (
+	"database/sql"
 	"fmt"
 	"math/big"
 	"strings"
@@ -27,8 +28,11 @@ import (
 
 	"github.com/cloudflare/cfssl/certdb"
 	certsql "github.com/cloudflare/cfssl/certdb/sql"
+	cferr "github.com/cloudflare/cfssl/errors"
 	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
 	"github.com/hyperledger/fabric-ca/lib/dbutil"
+	"github.com/hyperledger/fabric-ca/lib/metrics"
 	"github.com/hyperledger/fabric-ca/lib/server"
 	"github.com/hyperledger/fabric-ca/util"
 	"github.com/kisielk/sqlstruct"
@@ -55,8 +59,48 @@ WHERE (id = :id AND status != 'revoked');`
 	deleteCertificatebyID = `
 DELETE FROM certificates
 		WHERE (ID = ?);`
+
+	selectUnrevokedSQLbyID = `
+SELECT * FROM certificates
+WHERE (id = ? AND status != 'revoked');`
+)
+
+// The queries of the certificates with the columns of their records
+var (
+	selectCertRecordsByIDSQL    = fmt.Sprintf(selectSQLbyID, sqlstruct.Columns(CertRecord{}))
+	selectCertRecordSQL         = fmt.Sprintf(selectSQL, sqlstruct.Columns(CertRecord{}))
+	selectCertificateRecordsSQL = fmt.Sprintf(selectSQL, sqlstruct.Columns(certdb.CertificateRecord{}))
+	selectCertificateStatusSQL  = fmt.Sprintf(selectSQL, "status")
+)
+
+// The operations of a CertDBAccessor whose queries are prepared, as
+// reported by its metrics
+const (
+	certDBInsertCertificate      = "insert_certificate"
+	certDBGetCertificatesByID    = "get_certificates_by_id"
+	certDBGetCertificate         = "get_certificate"
+	certDBGetCertificateStatus   = "get_certificate_status"
+	certDBGetCertificateWithID   = "get_certificate_with_id"
+	certDBRevokeCertificatesByID = "revoke_certificates_by_id"
 )
 
+// certDBObserver is called after each operation of a CertDBAccessor whose
+// query is prepared with the time the operation took and its error
+type certDBObserver func(operation string, duration time.Duration, err error)
+
+// The names of the metrics of the operations of the certificate DB accessor
+const (
+	metricCertDBOperations        = "fabric_ca_certdb_operations_total"
+	metricCertDBOperationDuration = "fabric_ca_certdb_operation_duration_seconds"
+)
+
+// newCertDBMetrics registers the metrics of the operations of the
+// certificate DB accessors of the CAs
+func newCertDBMetrics(reg *metrics.Registry) {
+	reg.NewCounter(metricCertDBOperations, "Number of operations on the certificates in the database", "ca", "operation", "status")
+	reg.NewSummary(metricCertDBOperationDuration, "Time taken by operations on the certificates in the database", "ca", "operation")
+}
+
 // CertRecord extends CFSSL CertificateRecord by adding an enrollment ID to the record
 type CertRecord struct {
 	ID    string `db:"id"`
@@ -69,12 +113,17 @@ type CertDBAccessor struct {
 	level    int
 	accessor certdb.Accessor
 	db       *dbutil.DB
+	// The prepared statements of the queries of 'db'
+	stmts *certDBStatements
+	// Called after each operation whose query is prepared, if not nil
+	observe certDBObserver
 }
 
 // NewCertDBAccessor returns a new Accessor.
 func NewCertDBAccessor(db *dbutil.DB, level int) *CertDBAccessor {
 	cffslAcc := new(CertDBAccessor)
 	cffslAcc.db = db
+	cffslAcc.stmts = newCertDBStatements(db.DB)
 	cffslAcc.accessor = certsql.NewAccessor(db.DB)
 	cffslAcc.level = level
 	return cffslAcc
@@ -89,7 +138,61 @@ func (d *CertDBAccessor) checkDB() error {
 
 // SetDB changes the underlying sql.DB object Accessor is manipulating.
 func (d *CertDBAccessor) SetDB(db *dbutil.DB) {
+	if d.stmts != nil {
+		d.stmts.close()
+	}
 	d.db = db
+	if db != nil {
+		d.stmts = newCertDBStatements(db.DB)
+	}
+}
+
+// query calls 'f' with the prepared statement of 'query' and observes the
+// operation 'operation'
+func (d *CertDBAccessor) query(operation, query string, f func(*sqlx.Stmt) error) error {
+	start := time.Now()
+	err := withDB(d.db, func() error {
+		return d.stmts.run(query, f)
+	})
+	d.observeOperation(operation, start, err)
+	return err
+}
+
+// namedExec executes the prepared statement of 'query', which has named
+// parameters, with the parameters 'arg' and observes the operation
+// 'operation'
+func (d *CertDBAccessor) namedExec(operation, query string, arg interface{}) (res sql.Result, err error) {
+	start := time.Now()
+	err = withDB(d.db, func() error {
+		return d.stmts.runNamed(query, func(stmt *sqlx.NamedStmt) error {
+			res, err = stmt.Exec(arg)
+			return err
+		})
+	})
+	d.observeOperation(operation, start, err)
+	return res, err
+}
+
+// queryx runs the query 'query' with the arguments 'args' and returns its
+// rows, running it once more with a new connection if the connection to
+// the database was lost
+func (d *CertDBAccessor) queryx(query string, args ...interface{}) (rows *sqlx.Rows, err error) {
+	err = withDB(d.db, func() error {
+		rows, err = d.db.Queryx(query, args...)
+		return err
+	})
+	return rows, err
+}
+
+func (d *CertDBAccessor) observeOperation(operation string, start time.Time, err error) {
+	if d.observe == nil {
+		return
+	}
+	// A query which finds no rows succeeds
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	d.observe(operation, time.Since(start), err)
 }
 
 // InsertCertificate puts a CertificateRecord into db.
@@ -126,7 +229,7 @@ func (d *CertDBAccessor) InsertCertificate(cr certdb.CertificateRecord) error {
 	record.PEM = cr.PEM
 	record.Level = d.level
 
-	res, err := d.db.NamedExec(insertSQL, record)
+	res, err := d.namedExec(certDBInsertCertificate, insertSQL, record)
 	if err != nil {
 		return errors.Wrap(err, "Failed to insert record into database")
 	}
@@ -153,7 +256,9 @@ func (d *CertDBAccessor) GetCertificatesByID(id string) (crs []CertRecord, err e
 		return nil, err
 	}
 
-	err = d.db.Select(&crs, fmt.Sprintf(d.db.Rebind(selectSQLbyID), sqlstruct.Columns(CertRecord{})), id)
+	err = d.query(certDBGetCertificatesByID, selectCertRecordsByIDSQL, func(stmt *sqlx.Stmt) error {
+		return stmt.Select(&crs, id)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -161,17 +266,65 @@ func (d *CertDBAccessor) GetCertificatesByID(id string) (crs []CertRecord, err e
 	return crs, nil
 }
 
+// GetAllCertificates returns the rows of all certificates in the database
+func (d *CertDBAccessor) GetAllCertificates() (*sqlx.Rows, error) {
+	log.Debug("DB: Get all certificates")
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM certificates", sqlstruct.Columns(CertRecord{}))
+	rows, err := d.queryx(query)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to execute query '%s'", query)
+	}
+	return rows, nil
+}
+
 // GetCertificate gets a CertificateRecord indexed by serial.
 func (d *CertDBAccessor) GetCertificate(serial, aki string) (crs []certdb.CertificateRecord, err error) {
 	log.Debugf("DB: Get certificate by serial (%s) and aki (%s)", serial, aki)
-	crs, err = d.accessor.GetCertificate(serial, aki)
+	err = d.checkDB()
 	if err != nil {
 		return nil, err
 	}
 
+	err = d.query(certDBGetCertificate, selectCertificateRecordsSQL, func(stmt *sqlx.Stmt) error {
+		return stmt.Select(&crs, serial, aki)
+	})
+	if err != nil {
+		if caerrors.Is(err, caerrors.ClassBackendUnavailable) {
+			return nil, err
+		}
+		return nil, cferr.Wrap(cferr.CertStoreError, cferr.Unknown, err)
+	}
+
 	return crs, nil
 }
 
+// getCertificateStatuses gets the statuses of the certificates indexed by
+// serial and aki, without reading the certificates themselves
+func (d *CertDBAccessor) getCertificateStatuses(serial, aki string) (statuses []string, err error) {
+	log.Debugf("DB: Get status of certificate by serial (%s) and aki (%s)", serial, aki)
+	err = d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.query(certDBGetCertificateStatus, selectCertificateStatusSQL, func(stmt *sqlx.Stmt) error {
+		return stmt.Select(&statuses, serial, aki)
+	})
+	if err != nil {
+		if caerrors.Is(err, caerrors.ClassBackendUnavailable) {
+			return nil, err
+		}
+		return nil, cferr.Wrap(cferr.CertStoreError, cferr.Unknown, err)
+	}
+
+	return statuses, nil
+}
+
 // GetCertificateWithID gets a CertificateRecord indexed by serial and returns user too.
 func (d *CertDBAccessor) GetCertificateWithID(serial, aki string) (crs CertRecord, err error) {
 	log.Debugf("DB: Get certificate by serial (%s) and aki (%s)", serial, aki)
@@ -181,7 +334,9 @@ func (d *CertDBAccessor) GetCertificateWithID(serial, aki string) (crs CertRecor
 		return crs, err
 	}
 
-	err = d.db.Get(&crs, fmt.Sprintf(d.db.Rebind(selectSQL), sqlstruct.Columns(CertRecord{})), serial, aki)
+	err = d.query(certDBGetCertificateWithID, selectCertRecordSQL, func(stmt *sqlx.Stmt) error {
+		return stmt.Get(&crs, serial, aki)
+	})
 	if err != nil {
 		return crs, getError(err, "Certificate")
 	}
@@ -191,7 +346,10 @@ func (d *CertDBAccessor) GetCertificateWithID(serial, aki string) (crs CertRecor
 
 // GetUnexpiredCertificates gets all unexpired certificate from db.
 func (d *CertDBAccessor) GetUnexpiredCertificates() (crs []certdb.CertificateRecord, err error) {
-	crs, err = d.accessor.GetUnexpiredCertificates()
+	err = withDB(d.db, func() (err error) {
+		crs, err = d.accessor.GetUnexpiredCertificates()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -207,7 +365,41 @@ func (d *CertDBAccessor) GetRevokedCertificates(expiredAfter, expiredBefore, rev
 		return nil, err
 	}
 	var crs []certdb.CertificateRecord
-	revokedSQL := "SELECT %s FROM certificates WHERE (WHERE_CLAUSE);"
+	revokedSQL, args := revokedCertificatesQuery(sqlstruct.Columns(certdb.CertificateRecord{}),
+		expiredAfter, expiredBefore, revokedAfter, revokedBefore)
+	err = withDB(d.db, func() error {
+		return d.db.Select(&crs, d.db.Rebind(revokedSQL), args...)
+	})
+	if err != nil {
+		return crs, getError(err, "Certificate")
+	}
+	return crs, nil
+}
+
+// GetRevokedCertificateRows is like GetRevokedCertificates, but returns a
+// cursor over the certificates, whose rows are scanned into
+// certdb.CertificateRecord structs, so that the revoked certificates of a
+// CA are not all held in memory at once
+func (d *CertDBAccessor) GetRevokedCertificateRows(expiredAfter, expiredBefore, revokedAfter, revokedBefore time.Time) (*sqlx.Rows, error) {
+	log.Debugf("DB: Get cursor of revoked certificates that were revoked after %s and before %s that are expired after %s and before %s",
+		revokedAfter, revokedBefore, expiredAfter, expiredBefore)
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+	revokedSQL, args := revokedCertificatesQuery("serial_number, authority_key_identifier, reason, revoked_at",
+		expiredAfter, expiredBefore, revokedAfter, revokedBefore)
+	rows, err := d.queryx(d.db.Rebind(revokedSQL), args...)
+	if err != nil {
+		return nil, getError(err, "Certificate")
+	}
+	return rows, nil
+}
+
+// revokedCertificatesQuery returns the query of the columns 'columns' of the
+// revoked certificates which expire and were revoked in the specified
+// periods, and its arguments
+func revokedCertificatesQuery(columns string, expiredAfter, expiredBefore, revokedAfter, revokedBefore time.Time) (string, []interface{}) {
 	whereConds := []string{"status='revoked' AND expiry > ? AND revoked_at > ?"}
 	args := []interface{}{expiredAfter, revokedAfter}
 	if !expiredBefore.IsZero() {
@@ -218,19 +410,16 @@ func (d *CertDBAccessor) GetRevokedCertificates(expiredAfter, expiredBefore, rev
 		whereConds = append(whereConds, "revoked_at < ?")
 		args = append(args, revokedBefore)
 	}
-	whereClause := strings.Join(whereConds, " AND ")
-	revokedSQL = strings.Replace(revokedSQL, "WHERE_CLAUSE", whereClause, 1)
-	err = d.db.Select(&crs, fmt.Sprintf(d.db.Rebind(revokedSQL),
-		sqlstruct.Columns(certdb.CertificateRecord{})), args...)
-	if err != nil {
-		return crs, getError(err, "Certificate")
-	}
-	return crs, nil
+	return fmt.Sprintf("SELECT %s FROM certificates WHERE (%s);", columns, strings.Join(whereConds, " AND ")), args
 }
 
 // GetRevokedAndUnexpiredCertificates returns revoked and unexpired certificates
 func (d *CertDBAccessor) GetRevokedAndUnexpiredCertificates() ([]certdb.CertificateRecord, error) {
-	crs, err := d.accessor.GetRevokedAndUnexpiredCertificates()
+	var crs []certdb.CertificateRecord
+	err := withDB(d.db, func() (err error) {
+		crs, err = d.accessor.GetRevokedAndUnexpiredCertificates()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -239,7 +428,11 @@ func (d *CertDBAccessor) GetRevokedAndUnexpiredCertificates() ([]certdb.Certific
 
 // GetRevokedAndUnexpiredCertificatesByLabel returns revoked and unexpired certificates matching the label
 func (d *CertDBAccessor) GetRevokedAndUnexpiredCertificatesByLabel(label string) ([]certdb.CertificateRecord, error) {
-	crs, err := d.accessor.GetRevokedAndUnexpiredCertificatesByLabel(label)
+	var crs []certdb.CertificateRecord
+	err := withDB(d.db, func() (err error) {
+		crs, err = d.accessor.GetRevokedAndUnexpiredCertificatesByLabel(label)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -259,12 +452,14 @@ func (d *CertDBAccessor) RevokeCertificatesByID(id string, reasonCode int) (crs
 	record.ID = id
 	record.Reason = reasonCode
 
-	err = d.db.Select(&crs, d.db.Rebind("SELECT * FROM certificates WHERE (id = ? AND status != 'revoked')"), id)
+	err = d.query(certDBRevokeCertificatesByID, selectUnrevokedSQLbyID, func(stmt *sqlx.Stmt) error {
+		return stmt.Select(&crs, id)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = d.db.NamedExec(updateRevokeSQL, record)
+	_, err = d.namedExec(certDBRevokeCertificatesByID, updateRevokeSQL, record)
 	if err != nil {
 		return nil, err
 	}
@@ -276,34 +471,49 @@ func (d *CertDBAccessor) RevokeCertificatesByID(id string, reasonCode int) (crs
 func (d *CertDBAccessor) RevokeCertificate(serial, aki string, reasonCode int) error {
 	log.Debugf("DB: Revoke certificate by serial (%s) and aki (%s)", serial, aki)
 
-	err := d.accessor.RevokeCertificate(serial, aki, reasonCode)
-	return err
+	return withDB(d.db, func() error {
+		return d.accessor.RevokeCertificate(serial, aki, reasonCode)
+	})
 }
 
 // InsertOCSP puts a new certdb.OCSPRecord into the db.
 func (d *CertDBAccessor) InsertOCSP(rr certdb.OCSPRecord) error {
-	return d.accessor.InsertOCSP(rr)
+	return withDB(d.db, func() error {
+		return d.accessor.InsertOCSP(rr)
+	})
 }
 
 // GetOCSP retrieves a certdb.OCSPRecord from db by serial.
 func (d *CertDBAccessor) GetOCSP(serial, aki string) (ors []certdb.OCSPRecord, err error) {
-	return d.accessor.GetOCSP(serial, aki)
+	err = withDB(d.db, func() (err error) {
+		ors, err = d.accessor.GetOCSP(serial, aki)
+		return err
+	})
+	return ors, err
 }
 
 // GetUnexpiredOCSPs retrieves all unexpired certdb.OCSPRecord from db.
 func (d *CertDBAccessor) GetUnexpiredOCSPs() (ors []certdb.OCSPRecord, err error) {
-	return d.accessor.GetUnexpiredOCSPs()
+	err = withDB(d.db, func() (err error) {
+		ors, err = d.accessor.GetUnexpiredOCSPs()
+		return err
+	})
+	return ors, err
 }
 
 // UpdateOCSP updates a ocsp response record with a given serial number.
 func (d *CertDBAccessor) UpdateOCSP(serial, aki, body string, expiry time.Time) error {
-	return d.accessor.UpdateOCSP(serial, aki, body, expiry)
+	return withDB(d.db, func() error {
+		return d.accessor.UpdateOCSP(serial, aki, body, expiry)
+	})
 }
 
 // UpsertOCSP update a ocsp response record with a given serial number,
 // or insert the record if it doesn't yet exist in the db
 func (d *CertDBAccessor) UpsertOCSP(serial, aki, body string, expiry time.Time) error {
-	return d.accessor.UpsertOCSP(serial, aki, body, expiry)
+	return withDB(d.db, func() error {
+		return d.accessor.UpsertOCSP(serial, aki, body, expiry)
+	})
 }
 
 // GetCertificates returns based on filter parameters certificates
@@ -318,12 +528,14 @@ func (d *CertDBAccessor) GetCertificates(req server.CertificateRequest, callersA
 	whereConds := []string{}
 	args := []interface{}{}
 
-	getCertificateSQL := "SELECT certificates.pem FROM certificates" // Base SQL query for getting certificates
+	// Base SQL query for getting certificates, with the columns by which a page of certificates is sorted
+	getCertificateSQL := "SELECT certificates.id, certificates.serial_number, certificates.authority_key_identifier, " +
+		"certificates.expiry, certificates.revoked_at, certificates.pem FROM certificates"
 
 	// If caller's does not have root affiliation need to filter certificates based on affiliations of identities the
 	// caller is allowed to see
 	if callersAffiliation != "" {
-		getCertificateSQL = "SELECT certificates.pem FROM certificates INNER JOIN users ON users.id = certificates.id"
+		getCertificateSQL += " INNER JOIN users ON users.id = certificates.id"
 
 		whereConds = append(whereConds, "(users.affiliation = ? OR users.affiliation LIKE ?)")
 		args = append(args, callersAffiliation)
@@ -402,7 +614,7 @@ func (d *CertDBAccessor) GetCertificates(req server.CertificateRequest, callersA
 	getCertificateSQL = getCertificateSQL + ";"
 
 	log.Debugf("Executing get certificates query: %s, with args: %s", getCertificateSQL, args)
-	rows, err := d.db.Queryx(d.db.Rebind(getCertificateSQL), args...)
+	rows, err := d.queryx(d.db.Rebind(getCertificateSQL), args...)
 	if err != nil {
 		return nil, getError(err, "Certificate")
 	}
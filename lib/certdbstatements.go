@@ -0,0 +1,140 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// certDBStatements are the prepared statements of the queries of a
+// CertDBAccessor, or of the queries of an Accessor which are made for each
+// request. Each statement is prepared for the database when it is
+// first used and is then used concurrently by all the requests; database/sql
+// prepares it again on each connection it is used on, including those which
+// replace the connections which are reset.
+type certDBStatements struct {
+	db    *sqlx.DB
+	mutex sync.Mutex
+	// The statements by query, each a *sqlx.Stmt or, for a query with named
+	// parameters, a *sqlx.NamedStmt
+	prepared map[string]io.Closer
+}
+
+func newCertDBStatements(db *sqlx.DB) *certDBStatements {
+	return &certDBStatements{db: db, prepared: map[string]io.Closer{}}
+}
+
+// get returns the statement of 'query', which has named parameters if
+// 'named' is true, preparing it if it is not yet. The placeholders of a
+// query are those of the database's driver once prepared.
+func (s *certDBStatements) get(query string, named bool) (io.Closer, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if stmt := s.prepared[query]; stmt != nil {
+		return stmt, nil
+	}
+	var stmt io.Closer
+	var err error
+	if named {
+		stmt, err = s.db.PrepareNamed(query)
+	} else {
+		stmt, err = s.db.Preparex(s.db.Rebind(query))
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to prepare database statement")
+	}
+	s.prepared[query] = stmt
+	return stmt, nil
+}
+
+// forget closes the statement 'stmt' of 'query', which is prepared again
+// when it is next used. A request using the statement when it is closed
+// prepares it again too.
+func (s *certDBStatements) forget(query string, stmt io.Closer) {
+	s.mutex.Lock()
+	if s.prepared[query] == stmt {
+		delete(s.prepared, query)
+	}
+	s.mutex.Unlock()
+	stmt.Close()
+}
+
+// close closes all the statements
+func (s *certDBStatements) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for query, stmt := range s.prepared {
+		stmt.Close()
+		delete(s.prepared, query)
+	}
+}
+
+// run calls 'f' with the statement of 'query'. If the database no longer has
+// the statement, 'f' is called once more with the statement prepared again.
+func (s *certDBStatements) run(query string, f func(*sqlx.Stmt) error) error {
+	return s.retry(query, false, func(stmt io.Closer) error {
+		return f(stmt.(*sqlx.Stmt))
+	})
+}
+
+// runNamed is like run for a query with named parameters
+func (s *certDBStatements) runNamed(query string, f func(*sqlx.NamedStmt) error) error {
+	return s.retry(query, true, func(stmt io.Closer) error {
+		return f(stmt.(*sqlx.NamedStmt))
+	})
+}
+
+func (s *certDBStatements) retry(query string, named bool, f func(io.Closer) error) error {
+	stmt, err := s.get(query, named)
+	if err != nil {
+		return err
+	}
+	err = f(stmt)
+	if !isStaleStatementError(err) {
+		return err
+	}
+	log.Debugf("Preparing the database statement again: %s", err)
+	s.forget(query, stmt)
+	stmt, err = s.get(query, named)
+	if err != nil {
+		return err
+	}
+	return f(stmt)
+}
+
+// isStaleStatementError returns true if 'err' is returned when a statement
+// can no longer be used, but would succeed if prepared again: when it is
+// closed, when the connections to the database are reset and when the
+// database server has dropped it, such as after a failover
+func isStaleStatementError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == driver.ErrBadConn || strings.Contains(err.Error(), "sql: statement is closed") {
+		return true
+	}
+	switch e := errors.Cause(err).(type) {
+	case *pq.Error:
+		// invalid_sql_statement_name
+		return e.Code == "26000"
+	case pq.Error:
+		return e.Code == "26000"
+	case *mysql.MySQLError:
+		// ER_UNKNOWN_STMT_HANDLER
+		return e.Number == 1243
+	}
+	return false
+}
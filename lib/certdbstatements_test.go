@@ -0,0 +1,374 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cfssl/certdb"
+	"github.com/hyperledger/fabric-ca/lib/dbutil"
+	"github.com/hyperledger/fabric-ca/lib/metadata"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// faultyDB is a SQLite database whose connections can be dropped and
+// restored, after which it no longer has the statements prepared before
+type faultyDB struct {
+	mutex sync.Mutex
+	down  bool
+	// Incremented when the database is restored
+	generation int
+	// The number of statements prepared
+	prepares int
+}
+
+func (f *faultyDB) state() (down bool, generation int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.down, f.generation
+}
+
+func (f *faultyDB) drop() {
+	f.mutex.Lock()
+	f.down = true
+	f.mutex.Unlock()
+}
+
+func (f *faultyDB) restore() {
+	f.mutex.Lock()
+	f.down = false
+	f.generation++
+	f.mutex.Unlock()
+}
+
+func (f *faultyDB) prepared() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.prepares
+}
+
+var errDBDown = errors.New("connection refused")
+
+// theFaultyDB is the database of the connections of the faultySQLite driver
+var theFaultyDB = &faultyDB{}
+
+func init() {
+	sql.Register("faultysqlite3", faultySQLite{})
+}
+
+type faultySQLite struct{}
+
+func (faultySQLite) Open(name string) (driver.Conn, error) {
+	if down, _ := theFaultyDB.state(); down {
+		return nil, errDBDown
+	}
+	conn, err := (&sqlite3.SQLiteDriver{}).Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyConn{Conn: conn}, nil
+}
+
+type faultyConn struct {
+	driver.Conn
+}
+
+func (c *faultyConn) Prepare(query string) (driver.Stmt, error) {
+	down, generation := theFaultyDB.state()
+	if down {
+		return nil, driver.ErrBadConn
+	}
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	theFaultyDB.mutex.Lock()
+	theFaultyDB.prepares++
+	theFaultyDB.mutex.Unlock()
+	return &faultyStmt{Stmt: stmt, generation: generation}, nil
+}
+
+type faultyStmt struct {
+	driver.Stmt
+	generation int
+}
+
+// check returns the error of a statement which is used while the database
+// is down, or after it is restored, as PostgreSQL does
+func (s *faultyStmt) check() error {
+	down, generation := theFaultyDB.state()
+	if down {
+		return driver.ErrBadConn
+	}
+	if generation != s.generation {
+		return &pq.Error{Code: "26000", Message: "prepared statement does not exist"}
+	}
+	return nil
+}
+
+func (s *faultyStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	return s.Stmt.Exec(args)
+}
+
+func (s *faultyStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	return s.Stmt.Query(args)
+}
+
+// fatalError fails the test or benchmark 't' if 'err' is not nil
+func fatalError(t testing.TB, err error, msg string) {
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+}
+
+// testCertificateRecord returns a record of a certificate of 'id' with the
+// serial number 'serial'
+func testCertificateRecord(t testing.TB, id string, serial int64) certdb.CertificateRecord {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	fatalError(t, err, "Failed to generate key")
+	template := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: id},
+		SerialNumber:   big.NewInt(serial),
+		AuthorityKeyId: []byte{1, 2, 3, 4},
+		NotAfter:       time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	fatalError(t, err, "Failed to create certificate")
+	return certdb.CertificateRecord{
+		Serial: strconv.FormatInt(serial, 10),
+		AKI:    "01020304",
+		Status: "good",
+		Expiry: template.NotAfter,
+		PEM:    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+	}
+}
+
+// newTestCertDB returns a SQLite database with the tables of the server in
+// 'dir', opened with the driver 'driverName'
+func newTestCertDB(t testing.TB, dir, driverName string) *dbutil.DB {
+	datasource := filepath.Join(dir, "fabric-ca-server.db")
+	db, err := dbutil.NewUserRegistrySQLLite3(datasource)
+	fatalError(t, err, "Failed to create database")
+	levels, err := metadata.GetLevels(metadata.GetVersion())
+	fatalError(t, err, "Failed to get the levels of the database")
+	err = dbutil.UpdateSchema(db, levels)
+	fatalError(t, err, "Failed to update the schema of the database")
+	if driverName == "sqlite3" {
+		return db
+	}
+	db.Close()
+	sdb, err := sqlx.Open(driverName, datasource+"?_busy_timeout=5000")
+	fatalError(t, err, "Failed to open database")
+	sdb.SetMaxOpenConns(1)
+	return &dbutil.DB{DB: sdb, IsDBInitialized: true}
+}
+
+func TestCertDBStatements(t *testing.T) {
+	dir := "certDBStatementsTest"
+	os.RemoveAll(dir)
+	err := os.MkdirAll(dir, 0755)
+	util.FatalError(t, err, "Failed to create directory")
+	defer os.RemoveAll(dir)
+	db := newTestCertDB(t, dir, "faultysqlite3")
+	defer db.Close()
+
+	var mutex sync.Mutex
+	observed := map[string]int{}
+	d := NewCertDBAccessor(db, 1)
+	d.observe = func(operation string, duration time.Duration, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			operation += " error"
+		}
+		observed[operation]++
+	}
+
+	cr := testCertificateRecord(t, "user1", 1000)
+	err = d.InsertCertificate(cr)
+	util.FatalError(t, err, "Failed to insert certificate")
+	serial := util.GetSerialAsHex(big.NewInt(1000))
+
+	// The statements are prepared once and used concurrently
+	prepares := theFaultyDB.prepared()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				crs, err := d.GetCertificate(serial, "1020304")
+				if assert.NoError(t, err) {
+					assert.Len(t, crs, 1)
+				}
+				rec, err := d.GetCertificateWithID(serial, "1020304")
+				if assert.NoError(t, err) {
+					assert.Equal(t, "user1", rec.ID)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, prepares+2, theFaultyDB.prepared(), "Each statement should be prepared once")
+	assert.Equal(t, 100, observed[certDBGetCertificate])
+	assert.Equal(t, 100, observed[certDBGetCertificateWithID])
+	_, err = d.GetCertificateWithID("1234", "1020304")
+	assert.Error(t, err, "A certificate which does not exist should not be found")
+	assert.Equal(t, 101, observed[certDBGetCertificateWithID], "A query which finds no rows should succeed")
+
+	// When the database no longer has the statements prepared on its
+	// connection, such as after a failover, they are prepared again
+	theFaultyDB.restore()
+	crs, err := d.GetCertificate(serial, "1020304")
+	if assert.NoError(t, err, "Failed to get a certificate once its statement is dropped by the database") {
+		assert.Len(t, crs, 1)
+	}
+	assert.Equal(t, prepares+3, theFaultyDB.prepared(), "The statement should be prepared again")
+
+	// While the connection is dropped the operations fail, and once it is
+	// restored, without the statements which were prepared, they are
+	// prepared again
+	theFaultyDB.drop()
+	_, err = d.GetCertificate(serial, "1020304")
+	assert.Error(t, err, "Getting a certificate should fail while the connection is dropped")
+	err = d.InsertCertificate(testCertificateRecord(t, "user1", 1001))
+	assert.Error(t, err, "Inserting a certificate should fail while the connection is dropped")
+	assert.Equal(t, 1, observed[certDBGetCertificate+" error"])
+	assert.Equal(t, 1, observed[certDBInsertCertificate+" error"])
+	theFaultyDB.restore()
+	crs, err = d.GetCertificate(serial, "1020304")
+	if assert.NoError(t, err, "Failed to get a certificate once the connection is restored") {
+		assert.Len(t, crs, 1)
+	}
+	err = d.InsertCertificate(testCertificateRecord(t, "user1", 1001))
+	assert.NoError(t, err, "Failed to insert a certificate once the connection is restored")
+	recs, err := d.RevokeCertificatesByID("user1", 1)
+	if assert.NoError(t, err) {
+		assert.Len(t, recs, 2)
+	}
+	recs, err = d.GetCertificatesByID("user1")
+	if assert.NoError(t, err) && assert.Len(t, recs, 2) {
+		assert.Equal(t, "revoked", recs[0].Status)
+		assert.Equal(t, "revoked", recs[1].Status)
+	}
+
+	// The statements of a database which replaces that of the accessor are
+	// prepared for it
+	d.SetDB(newTestCertDB(t, dir, "faultysqlite3"))
+	defer d.db.Close()
+	crs, err = d.GetCertificate(serial, "1020304")
+	if assert.NoError(t, err) {
+		assert.Len(t, crs, 1)
+	}
+}
+
+func TestIsStaleStatementError(t *testing.T) {
+	for _, err := range []error{
+		driver.ErrBadConn,
+		errors.New("sql: statement is closed"),
+		&pq.Error{Code: "26000"},
+		errors.Wrap(&pq.Error{Code: "26000"}, "Failed"),
+	} {
+		assert.True(t, isStaleStatementError(err), "%v", err)
+	}
+	for _, err := range []error{
+		nil,
+		sql.ErrNoRows,
+		&pq.Error{Code: "23505"},
+		errors.New("database is locked"),
+	} {
+		assert.False(t, isStaleStatementError(err), "%v", err)
+	}
+}
+
+// benchmarkCertDB compares the time to get a certificate from 'db' with a
+// prepared statement and with a statement which is prepared by each query,
+// by requests in parallel
+func benchmarkCertDB(b *testing.B, db *dbutil.DB) {
+	d := NewCertDBAccessor(db, 1)
+	cr := testCertificateRecord(b, "benchuser", time.Now().UnixNano())
+	err := d.InsertCertificate(cr)
+	fatalError(b, err, "Failed to insert certificate")
+	serial, _ := new(big.Int).SetString(cr.Serial, 10)
+	hexSerial := util.GetSerialAsHex(serial)
+	for _, bench := range []struct {
+		name string
+		get  func() ([]certdb.CertificateRecord, error)
+	}{
+		{"Prepared", func() ([]certdb.CertificateRecord, error) { return d.GetCertificate(hexSerial, "1020304") }},
+		{"Unprepared", func() ([]certdb.CertificateRecord, error) { return d.accessor.GetCertificate(hexSerial, "1020304") }},
+	} {
+		get := bench.get
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					crs, err := get()
+					if err != nil || len(crs) != 1 {
+						b.Fatalf("Failed to get certificate: %v", err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkCertDBSQLite(b *testing.B) {
+	dir := "certDBBenchmark"
+	os.RemoveAll(dir)
+	err := os.MkdirAll(dir, 0755)
+	fatalError(b, err, "Failed to create directory")
+	defer os.RemoveAll(dir)
+	db := newTestCertDB(b, dir, "sqlite3")
+	defer db.Close()
+	benchmarkCertDB(b, db)
+}
+
+// BenchmarkCertDBPostgres runs against the PostgreSQL database whose
+// datasource is FABRIC_CA_TEST_POSTGRES_DATASOURCE, for example:
+//
+//	FABRIC_CA_TEST_POSTGRES_DATASOURCE="host=localhost port=5432 user=postgres password=postgres dbname=fabric_ca_bench sslmode=disable" \
+//	    go test -run XXX -bench CertDBPostgres ./lib
+func BenchmarkCertDBPostgres(b *testing.B) {
+	datasource := os.Getenv("FABRIC_CA_TEST_POSTGRES_DATASOURCE")
+	if datasource == "" {
+		b.Skip("FABRIC_CA_TEST_POSTGRES_DATASOURCE is not set")
+	}
+	db, err := dbutil.NewUserRegistryPostgres(datasource, nil)
+	fatalError(b, err, "Failed to open the PostgreSQL database")
+	defer db.Close()
+	levels, err := metadata.GetLevels(metadata.GetVersion())
+	fatalError(b, err, "Failed to get the levels of the database")
+	err = dbutil.UpdateSchema(db, levels)
+	fatalError(b, err, "Failed to update the schema of the database")
+	benchmarkCertDB(b, db)
+}
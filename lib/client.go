@@ -8,7 +8,11 @@ package lib
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -28,14 +32,18 @@ import (
 	"github.com/cloudflare/cfssl/csr"
 	"github.com/cloudflare/cfssl/log"
 	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
 	"github.com/hyperledger/fabric-ca/lib/client/credential"
 	idemixcred "github.com/hyperledger/fabric-ca/lib/client/credential/idemix"
 	x509cred "github.com/hyperledger/fabric-ca/lib/client/credential/x509"
 	"github.com/hyperledger/fabric-ca/lib/common"
+	"github.com/hyperledger/fabric-ca/lib/metadata"
 	"github.com/hyperledger/fabric-ca/lib/streamer"
 	"github.com/hyperledger/fabric-ca/lib/tls"
 	"github.com/hyperledger/fabric-ca/util"
 	"github.com/hyperledger/fabric/bccsp"
+	cspsigner "github.com/hyperledger/fabric/bccsp/signer"
+	"github.com/hyperledger/fabric/bccsp/sw"
 	"github.com/hyperledger/fabric/idemix"
 	"github.com/mitchellh/mapstructure"
 )
@@ -52,10 +60,27 @@ type Client struct {
 	keyFile, certFile, idemixCredFile, idemixCredsDir, ipkFile, caCertsDir string
 	// The crypto service provider (BCCSP)
 	csp bccsp.BCCSP
+	// Context, if set, is the context of the client's requests; cancelling
+	// it cancels the requests in progress
+	Context context.Context `json:"-"`
 	// HTTP client associated with this Fabric CA client
 	httpClient *http.Client
 	// Public key of Idemix issuer
 	issuerPublicKey *idemix.IssuerPublicKey
+	// Denotes if the API version of the server has been checked
+	serverVersionChecked bool
+	// The API versions served by the server, once they are known
+	apiVersions *apiVersions
+	// KeyPassphrase, if set, returns the passphrase of the encrypted
+	// private key when it is not configured; 'newKey' is true when the
+	// passphrase is chosen for a new key
+	KeyPassphrase func(newKey bool) ([]byte, error) `json:"-"`
+	// The passphrase of the private key, once it has been obtained
+	passphrase []byte
+	// InMemory, if true, keeps the keys of the client in memory rather than
+	// in the keystore directory of the msp directory, which is neither
+	// created nor read; the identities of such a client can not be stored
+	InMemory bool `json:"-"`
 }
 
 // GetCAInfoResponse is the response from the GetCAInfo call
@@ -71,6 +96,58 @@ type GetCAInfoResponse struct {
 	IssuerRevocationPublicKey []byte
 	// Version of the server
 	Version string
+	// Versions of the REST API served by the server, oldest first, if the
+	// server reports them
+	APIVersions []string
+	// SPIFFE trust domain of the X.509-SVIDs issued by the CA, if any
+	SPIFFETrustDomain string
+	// Name of the signing profile of the X.509-SVIDs
+	SPIFFEProfile string
+	// ETag of the CA information
+	ETag string
+	// NotModified is true if the CA information is unchanged from that
+	// whose ETag was in the request, in which case the other fields are empty
+	NotModified bool
+}
+
+// VerifyCAChain verifies that the CA chain of the response has a root
+// certificate, that each root certificate is self-signed, and that each
+// intermediate certificate chains to a root certificate of the chain
+func (si *GetCAInfoResponse) VerifyCAChain() error {
+	opts, err := getVerifyOptions(si.CAChain)
+	if err != nil {
+		return err
+	}
+	if opts.Roots == nil {
+		return errors.New("The CA chain has no root certificate")
+	}
+	chain := si.CAChain
+	for len(chain) > 0 {
+		var block *pem.Block
+		block, chain = pem.Decode(chain)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return errors.Wrap(err, "Failed to parse CA chain certificate")
+		}
+		if len(cert.AuthorityKeyId) == 0 || bytes.Equal(cert.AuthorityKeyId, cert.SubjectKeyId) {
+			err = cert.CheckSignatureFrom(cert)
+			if err != nil {
+				return errors.Wrapf(err, "The root certificate '%s' of the CA chain is not self-signed", cert.Subject.CommonName)
+			}
+			continue
+		}
+		_, err = cert.Verify(*opts)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to verify the intermediate certificate '%s' of the CA chain", cert.Subject.CommonName)
+		}
+	}
+	return nil
 }
 
 // EnrollmentResponse is the response from Client.Enroll and Identity.Reenroll
@@ -79,72 +156,131 @@ type EnrollmentResponse struct {
 	CAInfo   GetCAInfoResponse
 }
 
+// VerifyCert verifies the enrollment certificate of the response against
+// the CA chain of the response
+func (er *EnrollmentResponse) VerifyCert() error {
+	ecert := er.Identity.GetECert()
+	if ecert == nil {
+		return errors.New("The enrollment response has no enrollment certificate")
+	}
+	opts, err := getVerifyOptions(er.CAInfo.CAChain)
+	if err != nil {
+		return err
+	}
+	if opts.Roots == nil {
+		return errors.New("The CA chain of the enrollment response has no root certificate")
+	}
+	_, err = ecert.GetX509Cert().Verify(*opts)
+	if err != nil {
+		return errors.Wrap(err, "Failed to verify the enrollment certificate against the CA chain")
+	}
+	return nil
+}
+
 // Init initializes the client
 func (c *Client) Init() error {
 	if !c.initialized {
 		cfg := c.Config
 		log.Debugf("Initializing client with config: %+v", cfg)
-		if cfg.MSPDir == "" {
-			cfg.MSPDir = "msp"
+		var err error
+		if c.InMemory {
+			c.csp, err = c.initInMemoryBCCSP()
+		} else {
+			err = c.initMSPDir()
 		}
-		mspDir, err := util.MakeFileAbs(cfg.MSPDir, c.HomeDir)
 		if err != nil {
 			return err
 		}
-		cfg.MSPDir = mspDir
-		// Key directory and file
-		keyDir := path.Join(mspDir, "keystore")
-		err = os.MkdirAll(keyDir, 0700)
-		if err != nil {
-			return errors.Wrap(err, "Failed to create keystore directory")
+		if c.apiVersions == nil {
+			c.apiVersions = &apiVersions{}
 		}
-		c.keyFile = path.Join(keyDir, "key.pem")
-
-		// Cert directory and file
-		certDir := path.Join(mspDir, "signcerts")
-		err = os.MkdirAll(certDir, 0755)
-		if err != nil {
-			return errors.Wrap(err, "Failed to create signcerts directory")
+		// Create http.Client object and associate it with this client,
+		// unless it shares the one of another client
+		if c.httpClient == nil {
+			err = c.initHTTPClient()
+			if err != nil {
+				return err
+			}
 		}
-		c.certFile = path.Join(certDir, "cert.pem")
 
-		// CA certs directory
-		c.caCertsDir = path.Join(mspDir, "cacerts")
-		err = os.MkdirAll(c.caCertsDir, 0755)
-		if err != nil {
-			return errors.Wrap(err, "Failed to create cacerts directory")
-		}
+		// Successfully initialized the client
+		c.initialized = true
+	}
+	return nil
+}
 
-		// CA's Idemix public key
-		c.ipkFile = filepath.Join(mspDir, "IssuerPublicKey")
+// initMSPDir creates the directories of the msp directory of the client and
+// initializes its BCCSP, whose keys are stored in the keystore directory
+func (c *Client) initMSPDir() error {
+	cfg := c.Config
+	if cfg.MSPDir == "" {
+		cfg.MSPDir = "msp"
+	}
+	mspDir, err := util.MakeFileAbs(cfg.MSPDir, c.HomeDir)
+	if err != nil {
+		return err
+	}
+	cfg.MSPDir = mspDir
+	// Key directory and file
+	keyDir := path.Join(mspDir, "keystore")
+	err = os.MkdirAll(keyDir, 0700)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create keystore directory")
+	}
+	c.keyFile = path.Join(keyDir, "key.pem")
 
-		// Idemix credentials directory
-		c.idemixCredsDir = path.Join(mspDir, "user")
-		err = os.MkdirAll(c.idemixCredsDir, 0755)
-		if err != nil {
-			return errors.Wrap(err, "Failed to create Idemix credentials directory 'user'")
-		}
-		c.idemixCredFile = path.Join(c.idemixCredsDir, "SignerConfig")
+	// Cert directory and file
+	certDir := path.Join(mspDir, "signcerts")
+	err = os.MkdirAll(certDir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create signcerts directory")
+	}
+	c.certFile = path.Join(certDir, "cert.pem")
 
-		// Initialize BCCSP (the crypto layer)
-		c.csp, err = util.InitBCCSP(&cfg.CSP, mspDir, c.HomeDir)
-		if err != nil {
-			return err
-		}
-		// Create http.Client object and associate it with this client
-		err = c.initHTTPClient()
+	// CA certs directory
+	c.caCertsDir = path.Join(mspDir, "cacerts")
+	err = os.MkdirAll(c.caCertsDir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create cacerts directory")
+	}
+
+	// CA's Idemix public key
+	c.ipkFile = filepath.Join(mspDir, "IssuerPublicKey")
+
+	// Idemix credentials directory
+	c.idemixCredsDir = path.Join(mspDir, "user")
+	err = os.MkdirAll(c.idemixCredsDir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create Idemix credentials directory 'user'")
+	}
+	c.idemixCredFile = path.Join(c.idemixCredsDir, "SignerConfig")
+
+	// Initialize BCCSP (the crypto layer)
+	c.csp, err = util.InitBCCSP(&cfg.CSP, mspDir, c.HomeDir)
+	return err
+}
+
+// initInMemoryBCCSP returns the BCCSP of a client which keeps its keys in
+// memory. The keys of a software BCCSP are stored in memory; those of an HSM
+// are kept by the HSM.
+func (c *Client) initInMemoryBCCSP() (bccsp.BCCSP, error) {
+	cfg := c.Config
+	err := util.ConfigureBCCSP(&cfg.CSP, "", c.HomeDir)
+	if err != nil {
+		return nil, err
+	}
+	if opts := cfg.CSP.SwOpts; strings.ToUpper(cfg.CSP.ProviderName) == "SW" && opts != nil {
+		csp, err := sw.NewWithParams(opts.SecLevel, opts.HashFamily, newMemKeyStore())
 		if err != nil {
-			return err
+			return nil, errors.Wrap(err, "Failed to initialize the software BCCSP")
 		}
-
-		// Successfully initialized the client
-		c.initialized = true
+		return csp, nil
 	}
-	return nil
+	return util.GetBCCSP(cfg.CSP, c.HomeDir)
 }
 
 func (c *Client) initHTTPClient() error {
-	tr := new(http.Transport)
+	tr := newHTTPTransport()
 	if c.Config.TLS.Enabled {
 		log.Info("TLS Enabled")
 
@@ -161,7 +297,28 @@ func (c *Client) initHTTPClient() error {
 		tlsConfig.CipherSuites = tls.DefaultCipherSuites
 		tr.TLSClientConfig = tlsConfig
 	}
-	c.httpClient = &http.Client{Transport: tr}
+	if path, ok := unixSocketPath(c.Config.URL); ok {
+		// Requests are sent over the Unix domain socket regardless of the
+		// host in their URL
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+	} else {
+		proxy, err := c.proxyFunc()
+		if err != nil {
+			return err
+		}
+		tr.Proxy = proxy
+		tr.OnProxyConnectResponse = onProxyConnectResponse
+	}
+	var base http.RoundTripper = tr
+	if c.Config.DisableCompression {
+		tr.DisableCompression = true
+	} else {
+		base = newGzipTransport(tr)
+	}
+	c.httpClient = &http.Client{Transport: newTraceTransport(base, c.Config.TraceFile)}
 	return nil
 }
 
@@ -179,12 +336,18 @@ func (c *Client) GetCAInfo(req *api.GetCAInfoRequest) (*GetCAInfoResponse, error
 	if err != nil {
 		return nil, err
 	}
+	// Getting the CA's information does not change it, so it can be retried
+	cainforeq = markIdempotent(cainforeq)
 	netSI := &common.CAInfoResponseNet{}
-	err = c.SendReq(cainforeq, netSI)
+	result := newConditionalResult(cainforeq, req.ETag, netSI)
+	err = c.SendReq(cainforeq, result)
 	if err != nil {
 		return nil, err
 	}
-	localSI := &GetCAInfoResponse{}
+	if result.notModified {
+		return &GetCAInfoResponse{ETag: result.etag, NotModified: true}, nil
+	}
+	localSI := &GetCAInfoResponse{ETag: result.etag}
 	err = c.net2LocalCAInfo(netSI, localSI)
 	if err != nil {
 		return nil, err
@@ -192,8 +355,42 @@ func (c *Client) GetCAInfo(req *api.GetCAInfoRequest) (*GetCAInfoResponse, error
 	return localSI, nil
 }
 
+// GetCAInfoAs returns the CA chain in the format 'format', as returned by
+// the server: the JSON response, the PEM certificates of the chain, or the
+// DER encoding of its first certificate
+func (c *Client) GetCAInfoAs(req *api.GetCAInfoRequest, format Format) ([]byte, error) {
+	mediaType, err := format.certMediaType()
+	if err != nil {
+		return nil, err
+	}
+	err = c.Init()
+	if err != nil {
+		return nil, err
+	}
+	body, err := util.Marshal(req, "GetCAInfo")
+	if err != nil {
+		return nil, err
+	}
+	cainforeq, err := c.newPost("cainfo", body)
+	if err != nil {
+		return nil, err
+	}
+	cainforeq = markIdempotent(cainforeq)
+	result := newEncodedResult(cainforeq, mediaType)
+	err = c.SendReq(cainforeq, result)
+	if err != nil {
+		return nil, err
+	}
+	return result.body, nil
+}
+
 // GenCSR generates a CSR (Certificate Signing Request)
 func (c *Client) GenCSR(req *api.CSRInfo, id string) ([]byte, bccsp.Key, error) {
+	return c.genCSR(req, id, nil)
+}
+
+// genCSR generates a CSR signed with 'key' or, if it is nil, with a new key
+func (c *Client) genCSR(req *api.CSRInfo, id string, key bccsp.Key) ([]byte, bccsp.Key, error) {
 	log.Debugf("GenCSR %+v", req)
 
 	err := c.Init()
@@ -208,10 +405,19 @@ func (c *Client) GenCSR(req *api.CSRInfo, id string) ([]byte, bccsp.Key, error)
 		cr.KeyRequest = newCfsslBasicKeyRequest(api.NewBasicKeyRequest())
 	}
 
-	key, cspSigner, err := util.BCCSPKeyRequestGenerate(cr, c.csp)
-	if err != nil {
-		log.Debugf("failed generating BCCSP key: %s", err)
-		return nil, nil, err
+	var cspSigner crypto.Signer
+	if key == nil {
+		key, cspSigner, err = util.BCCSPKeyRequestGenerate(cr, c.csp)
+		if err != nil {
+			log.Debugf("failed generating BCCSP key: %s", err)
+			return nil, nil, err
+		}
+	} else {
+		log.Debugf("Reusing key %x", key.SKI())
+		cspSigner, err = cspsigner.New(c.csp, key)
+		if err != nil {
+			return nil, nil, errors.WithMessage(err, "Failed initializing CryptoSigner")
+		}
 	}
 
 	csrPEM, err := csr.Generate(cspSigner, cr)
@@ -239,6 +445,34 @@ func (c *Client) Enroll(req *api.EnrollmentRequest) (*EnrollmentResponse, error)
 	return c.handleX509Enroll(req)
 }
 
+// svidProfile returns the signing profile of the X.509-SVIDs of the CA
+// 'caName', which must be 'profile' if it is set
+func (c *Client) svidProfile(caName, profile string) (string, error) {
+	info, err := c.GetCAInfo(&api.GetCAInfoRequest{CAName: caName})
+	if err != nil {
+		return "", errors.WithMessage(err, "Failed to get the SPIFFE signing profile of the CA")
+	}
+	if info.SPIFFETrustDomain == "" {
+		return "", errors.Errorf("The CA '%s' does not issue X.509-SVIDs", info.CAName)
+	}
+	if profile != "" && profile != info.SPIFFEProfile {
+		return "", errors.Errorf("The profile '%s' is not the SPIFFE signing profile '%s' of the CA", profile, info.SPIFFEProfile)
+	}
+	return info.SPIFFEProfile, nil
+}
+
+// svidCSRInfo returns the CSR information 'csr' of an X.509-SVID, which
+// identifies a workload by its SPIFFE ID rather than by the local hostname
+// or the other hosts of 'csr'
+func svidCSRInfo(csr *api.CSRInfo) *api.CSRInfo {
+	svid := api.CSRInfo{}
+	if csr != nil {
+		svid = *csr
+	}
+	svid.Hosts = []string{}
+	return &svid
+}
+
 // Convert from network to local CA information
 func (c *Client) net2LocalCAInfo(net *common.CAInfoResponseNet, local *GetCAInfoResponse) error {
 	caChain, err := util.B64Decode(net.CAChain)
@@ -262,12 +496,26 @@ func (c *Client) net2LocalCAInfo(net *common.CAInfoResponseNet, local *GetCAInfo
 	local.CAName = net.CAName
 	local.CAChain = caChain
 	local.Version = net.Version
+	local.APIVersions = net.APIVersions
+	local.SPIFFETrustDomain = net.SPIFFETrustDomain
+	local.SPIFFEProfile = net.SPIFFEProfile
 	return nil
 }
 
 func (c *Client) handleX509Enroll(req *api.EnrollmentRequest) (*EnrollmentResponse, error) {
+	csrInfo := req.CSR
+	profile := req.Profile
+	if req.SVID {
+		var err error
+		profile, err = c.svidProfile(req.CAName, req.Profile)
+		if err != nil {
+			return nil, err
+		}
+		csrInfo = svidCSRInfo(csrInfo)
+	}
+
 	// Generate the CSR
-	csrPEM, key, err := c.GenCSR(req.CSR, req.Name)
+	csrPEM, key, err := c.GenCSR(csrInfo, req.Name)
 	if err != nil {
 		return nil, errors.WithMessage(err, "Failure generating CSR")
 	}
@@ -277,11 +525,11 @@ func (c *Client) handleX509Enroll(req *api.EnrollmentRequest) (*EnrollmentRespon
 		AttrReqs: req.AttrReqs,
 	}
 
-	if req.CSR != nil {
-		reqNet.SignRequest.Hosts = req.CSR.Hosts
+	if csrInfo != nil {
+		reqNet.SignRequest.Hosts = csrInfo.Hosts
 	}
 	reqNet.SignRequest.Request = string(csrPEM)
-	reqNet.SignRequest.Profile = req.Profile
+	reqNet.SignRequest.Profile = profile
 	reqNet.SignRequest.Label = req.Label
 
 	body, err := util.Marshal(reqNet, "SignRequest")
@@ -289,20 +537,33 @@ func (c *Client) handleX509Enroll(req *api.EnrollmentRequest) (*EnrollmentRespon
 		return nil, err
 	}
 
-	// Send the CSR to the fabric-ca server with basic auth header
-	post, err := c.newPost("enroll", body)
-	if err != nil {
-		return nil, err
-	}
-	post.SetBasicAuth(req.Name, req.Secret)
-	var result common.EnrollmentResponseNet
-	err = c.SendReq(post, &result)
-	if err != nil {
-		return nil, err
-	}
-
-	// Create the enrollment response
-	return c.newEnrollmentResponse(&result, req.Name, key)
+	// Send the CSR to the fabric-ca server with basic auth header, to the
+	// v2 endpoint if the server serves it
+	var resp *EnrollmentResponse
+	err = c.sendAPIRequest("enroll", func(endpoint string) error {
+		post, err := c.newPost(endpoint, body)
+		if err != nil {
+			return err
+		}
+		post.SetBasicAuth(req.Name, req.Secret)
+		var result common.EnrollmentResponseNet
+		if endpoint == "enroll" {
+			err = c.SendReq(post, &result)
+		} else {
+			var resultV2 common.EnrollmentResponseNetV2
+			err = c.SendReq(post, &resultV2)
+			if err == nil {
+				err = enrollmentResponseFromV2(&resultV2, &result)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		// Create the enrollment response
+		resp, err = c.newEnrollmentResponse(&result, req.Name, key)
+		return err
+	})
+	return resp, err
 }
 
 // Handles enrollment request for an Idemix credential
@@ -559,6 +820,9 @@ func (c *Client) LoadMyIdentity() (*Identity, error) {
 	if err != nil {
 		return nil, err
 	}
+	if c.InMemory {
+		return nil, errors.New("A client which keeps its keys in memory has no identity to load")
+	}
 	return c.LoadIdentity(c.keyFile, c.certFile, c.idemixCredFile)
 }
 
@@ -577,6 +841,8 @@ func (c *Client) LoadIdentity(keyFile, certFile, idemixCredFile string) (*Identi
 	if err == nil {
 		x509Found = true
 		creds = append(creds, x509Cred)
+	} else if util.IsKeyDecryptionError(err) {
+		return nil, err
 	} else {
 		log.Debugf("No X509 credential found at %s, %s", keyFile, certFile)
 	}
@@ -667,7 +933,7 @@ func (c *Client) newGet(endpoint string) (*http.Request, error) {
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest("GET", curl, bytes.NewReader([]byte{}))
+	req, err := http.NewRequestWithContext(c.requestContext(), "GET", curl, bytes.NewReader([]byte{}))
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed creating GET request for %s", curl)
 	}
@@ -680,7 +946,7 @@ func (c *Client) newPut(endpoint string, reqBody []byte) (*http.Request, error)
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest("PUT", curl, bytes.NewReader(reqBody))
+	req, err := http.NewRequestWithContext(c.requestContext(), "PUT", curl, bytes.NewReader(reqBody))
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed creating PUT request for %s", curl)
 	}
@@ -693,7 +959,7 @@ func (c *Client) newDelete(endpoint string) (*http.Request, error) {
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest("DELETE", curl, bytes.NewReader([]byte{}))
+	req, err := http.NewRequestWithContext(c.requestContext(), "DELETE", curl, bytes.NewReader([]byte{}))
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed creating DELETE request for %s", curl)
 	}
@@ -706,73 +972,112 @@ func (c *Client) newPost(endpoint string, reqBody []byte) (*http.Request, error)
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest("POST", curl, bytes.NewReader(reqBody))
+	req, err := http.NewRequestWithContext(c.requestContext(), "POST", curl, bytes.NewReader(reqBody))
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed posting to %s", curl)
 	}
+	err = c.setIdempotencyKey(req, endpoint)
+	if err != nil {
+		return nil, err
+	}
 	return req, nil
 }
 
+// requestString returns a function which returns the string of the request
+// 'req' for an error message, so that it is only built if the request fails.
+// A request whose body can't be read again is described before it is sent.
+func requestString(req *http.Request) func() string {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		s := util.HTTPRequestToString(req)
+		return func() string { return s }
+	}
+	return func() string { return util.HTTPRequestToString(req) }
+}
+
 // SendReq sends a request to the fabric-ca-server and fills in the result
 func (c *Client) SendReq(req *http.Request, result interface{}) (err error) {
 
-	reqStr := util.HTTPRequestToString(req)
-	log.Debugf("Sending request\n%s", reqStr)
+	reqStr := requestString(req)
 
 	err = c.Init()
 	if err != nil {
 		return err
 	}
 
-	resp, err := c.httpClient.Do(req)
+	ctx, cancel := c.withDeadline(req.Context())
+	defer cancel()
+	req = req.WithContext(ctx)
+	resp, attempts, err := c.doWithRetry(req)
+	if attempts > 1 {
+		defer func() {
+			if err != nil {
+				err = errors.WithMessage(err, fmt.Sprintf("The request failed after %d attempts", attempts))
+			}
+		}()
+	}
 	if err != nil {
-		return errors.Wrapf(err, "%s failure of request: %s", req.Method, reqStr)
+		err = c.contextError(ctx, err)
+		if msg := tls.DescribeVerificationError(err); msg != "" {
+			return errors.Wrapf(err, "%s\n%s failure of request: %s", msg, req.Method, reqStr())
+		}
+		return errors.Wrapf(err, "%s failure of request: %s", req.Method, reqStr())
 	}
+	c.checkServerVersion(resp)
 	var respBody []byte
 	if resp.Body != nil {
 		respBody, err = ioutil.ReadAll(resp.Body)
-		defer func() {
-			err := resp.Body.Close()
-			if err != nil {
-				log.Debugf("Failed to close the response body: %s", err.Error())
-			}
-		}()
+		defer drainBody(resp.Body)
 		if err != nil {
-			return errors.Wrapf(err, "Failed to read response of request: %s", reqStr)
+			return errors.Wrapf(c.contextError(ctx, err), "Failed to read response of request: %s", reqStr())
 		}
-		log.Debugf("Received response\n%s", util.HTTPResponseToString(resp))
+	}
+	if cr, ok := result.(*conditionalResult); ok {
+		cr.etag = resp.Header.Get("ETag")
+		if resp.StatusCode == http.StatusNotModified {
+			cr.notModified = true
+			return nil
+		}
+		result = cr.result
+	}
+	if resp.StatusCode >= 400 {
+		if envelope := parseErrorEnvelope(respBody); envelope != nil {
+			return newEnvelopeError(resp.StatusCode, envelope)
+		}
+	}
+	if er, ok := result.(*encodedResult); ok && resp.StatusCode < 400 {
+		return er.read(resp, respBody)
 	}
 	var body *cfsslapi.Response
 	if respBody != nil && len(respBody) > 0 {
 		body = new(cfsslapi.Response)
 		err = json.Unmarshal(respBody, body)
+		if err != nil && resp.StatusCode >= 400 {
+			// Such as the response of a proxy, or of a server which does not
+			// serve the endpoint
+			return errors.WithStack(&ResponseError{StatusCode: resp.StatusCode,
+				Class: caerrors.ClassOf(resp.StatusCode, caerrors.ErrUnknown),
+				msg:   fmt.Sprintf("Failed with server status code %d for request:\n%s", resp.StatusCode, reqStr())})
+		}
 		if err != nil {
-			return errors.Wrapf(err, "Failed to parse response: %s", respBody)
+			return errors.Wrapf(err, "Failed to parse response: %s", util.RedactBody(respBody, util.BodyLogLimit()))
 		}
 		if len(body.Errors) > 0 {
-			var errorMsg string
-			for _, err := range body.Errors {
-				msg := fmt.Sprintf("Response from server: Error Code: %d - %s\n", err.Code, err.Message)
-				if errorMsg == "" {
-					errorMsg = msg
-				} else {
-					errorMsg = errorMsg + fmt.Sprintf("\n%s", msg)
-				}
-			}
-			return errors.Errorf(errorMsg)
+			return newResponseError(resp.StatusCode, body.Errors)
 		}
 	}
 	scode := resp.StatusCode
 	if scode >= 400 {
-		return errors.Errorf("Failed with server status code %d for request:\n%s", scode, reqStr)
+		return errors.WithStack(&ResponseError{StatusCode: scode,
+			Class: caerrors.ClassOf(scode, caerrors.ErrUnknown),
+			msg:   fmt.Sprintf("Failed with server status code %d for request:\n%s", scode, reqStr())})
 	}
 	if body == nil {
-		return errors.Errorf("Empty response body:\n%s", reqStr)
+		return errors.Errorf("Empty response body:\n%s", reqStr())
 	}
 	if !body.Success {
-		return errors.Errorf("Server returned failure for request:\n%s", reqStr)
+		return errors.WithStack(&ResponseError{StatusCode: scode, Class: caerrors.ClassInternal,
+			msg: fmt.Sprintf("Server returned failure for request:\n%s", reqStr())})
 	}
-	log.Debugf("Response body result: %+v", body.Result)
 	if result != nil {
 		return mapstructure.Decode(body.Result, result)
 	}
@@ -780,39 +1085,196 @@ func (c *Client) SendReq(req *http.Request, result interface{}) (err error) {
 }
 
 // StreamResponse reads the response as it comes back from the server
-func (c *Client) StreamResponse(req *http.Request, stream string, cb func(*json.Decoder) error) (err error) {
+func (c *Client) StreamResponse(req *http.Request, stream string, cb func(*json.Decoder) error) error {
+	results, err := c.streamResponse(req, stream, cb)
+	if err != nil {
+		return err
+	}
+	if !results {
+		fmt.Println("No results returned")
+	}
+	return nil
+}
 
-	reqStr := util.HTTPRequestToString(req)
-	log.Debugf("Sending request\n%s", reqStr)
+// streamResponse calls 'cb' with each element of the array 'stream' of the
+// response to 'req' as it comes back from the server, and returns true if
+// there were any
+func (c *Client) streamResponse(req *http.Request, stream string, cb func(*json.Decoder) error) (results bool, err error) {
+	reqStr := requestString(req)
 
 	err = c.Init()
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	resp, err := c.httpClient.Do(req)
+	ctx, cancel := c.withDeadline(req.Context())
+	defer cancel()
+	req = req.WithContext(ctx)
+	resp, attempts, err := c.doWithRetry(req)
+	if attempts > 1 {
+		defer func() {
+			if err != nil {
+				err = errors.WithMessage(err, fmt.Sprintf("The request failed after %d attempts", attempts))
+			}
+		}()
+	}
 	if err != nil {
-		return errors.Wrapf(err, "%s failure of request: %s", req.Method, reqStr)
+		err = c.contextError(ctx, err)
+		if msg := tls.DescribeVerificationError(err); msg != "" {
+			return false, errors.Wrapf(err, "%s\n%s failure of request: %s", msg, req.Method, reqStr())
+		}
+		return false, errors.Wrapf(err, "%s failure of request: %s", req.Method, reqStr())
 	}
-	defer resp.Body.Close()
+	c.checkServerVersion(resp)
+	// The stream may be left unread if the callback fails
+	defer drainBody(resp.Body)
 
 	dec := json.NewDecoder(resp.Body)
-	results, err := streamer.StreamJSONArray(dec, stream, cb)
-	if err != nil {
-		return err
+	// The server responds with an error before streaming anything
+	if resp.StatusCode >= 400 {
+		var raw json.RawMessage
+		if dec.Decode(&raw) == nil {
+			if envelope := parseErrorEnvelope(raw); envelope != nil {
+				return false, newEnvelopeError(resp.StatusCode, envelope)
+			}
+			body := new(cfsslapi.Response)
+			if json.Unmarshal(raw, body) == nil && len(body.Errors) > 0 {
+				return false, newResponseError(resp.StatusCode, body.Errors)
+			}
+		}
+		return false, errors.WithStack(&ResponseError{StatusCode: resp.StatusCode,
+			Class: caerrors.ClassOf(resp.StatusCode, caerrors.ErrUnknown),
+			msg:   fmt.Sprintf("Failed with server status code %d for request:\n%s", resp.StatusCode, reqStr())})
 	}
-	if !results {
-		fmt.Println("No results returned")
+	return streamer.StreamJSONArray(dec, stream, cb)
+}
+
+// ResponseError is the error returned when the server responds to a request
+// with an error, as opposed to a failure to send the request or to read its
+// response
+type ResponseError struct {
+	// StatusCode is the HTTP status code of the response
+	StatusCode int
+	// Class is the class of the error, which is the code of the error
+	// envelope of the response, or else is derived from the status code and
+	// the errors of a response in the legacy format
+	Class caerrors.Class
+	// Errors are the errors in the body of the response, if any; that of an
+	// error envelope has its message and the error code in its details
+	Errors []cfsslapi.ResponseMessage
+	msg    string
+}
+
+func (re *ResponseError) Error() string {
+	return re.msg
+}
+
+// IsAuthFailure returns true if the server could not authenticate the caller
+func (re *ResponseError) IsAuthFailure() bool {
+	return re.StatusCode == http.StatusUnauthorized
+}
+
+// IsAuthorizationFailure returns true if the server authenticated the caller
+// but did not authorize the request, such as when the identity or
+// affiliation which it is about is not visible to the caller
+func (re *ResponseError) IsAuthorizationFailure() bool {
+	return re.StatusCode == http.StatusForbidden
+}
+
+// newResponseError returns the error of a response of the server with
+// 'statusCode' and the errors 'errs' in its body
+func newResponseError(statusCode int, errs []cfsslapi.ResponseMessage) error {
+	class := caerrors.ClassOf(statusCode, caerrors.ErrUnknown)
+	if len(errs) > 0 {
+		class = caerrors.ClassOf(statusCode, errs[0].Code)
+	}
+	return errors.WithStack(&ResponseError{StatusCode: statusCode, Class: class, Errors: errs, msg: responseErrorMsg(errs)})
+}
+
+// responseErrorMsg returns the message of the error of a response with the
+// errors 'errs' in its body
+func responseErrorMsg(errs []cfsslapi.ResponseMessage) string {
+	var errorMsg string
+	for _, err := range errs {
+		msg := fmt.Sprintf("Response from server: Error Code: %d - %s\n", err.Code, err.Message)
+		if errorMsg == "" {
+			errorMsg = msg
+		} else {
+			errorMsg = errorMsg + fmt.Sprintf("\n%s", msg)
+		}
+	}
+	return errorMsg
+}
+
+// parseErrorEnvelope returns the error envelope in the body 'body' of a
+// response, or nil if the body is not an error envelope, such as the body of
+// a response of a server which returns errors in the legacy format
+func parseErrorEnvelope(body []byte) *caerrors.ErrorResponse {
+	envelope := new(caerrors.ErrorResponse)
+	if json.Unmarshal(body, envelope) != nil || envelope.Code == "" {
+		return nil
+	}
+	return envelope
+}
+
+// newEnvelopeError returns the error of a response of the server with
+// 'statusCode' and the error envelope 'envelope'
+func newEnvelopeError(statusCode int, envelope *caerrors.ErrorResponse) error {
+	errs := []cfsslapi.ResponseMessage{{Code: envelope.Details.ErrorCode, Message: envelope.Message}}
+	return errors.WithStack(&ResponseError{StatusCode: statusCode, Class: envelope.Code, Errors: errs, msg: responseErrorMsg(errs)})
+}
+
+// checkServerVersion records the API versions reported in the response
+// headers of the server, and warns once if none of them is an API version of
+// this client, or, for a server which reports only one API version, if it
+// differs from the API version of this client. Servers which don't report
+// their API version are not checked.
+func (c *Client) checkServerVersion(resp *http.Response) {
+	// A server which reports its API version but not its API versions
+	// serves only that version
+	if versions := parseAPIVersions(resp.Header.Get(apiVersionsHeader)); len(versions) > 0 {
+		c.apiVersions.set(versions)
+	} else if version := resp.Header.Get(apiVersionHeader); version != "" {
+		c.apiVersions.set([]string{version})
+	}
+	if c.serverVersionChecked {
+		return
+	}
+	serverAPIVersion := resp.Header.Get(apiVersionHeader)
+	if serverAPIVersion == "" {
+		return
+	}
+	c.serverVersionChecked = true
+	log.Debugf("Server version is %s, API version %s", resp.Header.Get(versionHeader), serverAPIVersion)
+	if versions := parseAPIVersions(resp.Header.Get(apiVersionsHeader)); len(versions) > 0 {
+		if latestCommonAPIVersion(versions) == "" {
+			log.Warningf("None of the API versions of the server (%s, version %s) is an API version of this client (%s, version %s); some requests may fail",
+				strings.Join(versions, ", "), resp.Header.Get(versionHeader), strings.Join(metadata.APIVersions, ", "), metadata.GetVersion())
+		}
+		return
+	}
+	if serverAPIVersion != metadata.APIVersion {
+		log.Warningf("The API version of the server (%s, version %s) differs from the API version of this client (%s, version %s); some requests may fail",
+			serverAPIVersion, resp.Header.Get(versionHeader), metadata.APIVersion, metadata.GetVersion())
 	}
-	return nil
 }
 
 func (c *Client) getURL(endpoint string) (string, error) {
+	if _, ok := unixSocketPath(c.Config.URL); ok {
+		return fmt.Sprintf("http://localhost/%s", endpoint), nil
+	}
 	nurl, err := NormalizeURL(c.Config.URL)
 	if err != nil {
 		return "", err
 	}
-	rtn := fmt.Sprintf("%s/%s", nurl, endpoint)
+	// The endpoint is joined to the path of the URL, such as that of a
+	// reverse proxy which forwards a path prefix to the server
+	prefix := path.Clean("/" + nurl.EscapedPath())
+	if prefix == "/" {
+		prefix = ""
+	}
+	nurl.Path, nurl.RawPath, nurl.RawQuery, nurl.Fragment = "", "", "", ""
+	rtn := fmt.Sprintf("%s%s/%s", nurl, prefix, strings.TrimLeft(endpoint, "/"))
 	return rtn, nil
 }
 
@@ -908,7 +1370,7 @@ func newCfsslBasicKeyRequest(bkr *api.BasicKeyRequest) *csr.BasicKeyRequest {
 	return &csr.BasicKeyRequest{A: bkr.Algo, S: bkr.Size}
 }
 
-// NormalizeURL normalizes a URL (from cfssl)
+// NormalizeURL normalizes a URL (from cfssl); the path of the URL is kept
 func NormalizeURL(addr string) (*url.URL, error) {
 	addr = strings.TrimSpace(addr)
 	u, err := url.Parse(addr)
@@ -916,12 +1378,22 @@ func NormalizeURL(addr string) (*url.URL, error) {
 		return nil, err
 	}
 	if u.Opaque != "" {
-		u.Host = net.JoinHostPort(u.Scheme, u.Opaque)
+		// A URL without a scheme, such as host:7054/ca
+		port := u.Opaque
+		if i := strings.Index(port, "/"); i >= 0 {
+			u.Path, err = url.PathUnescape(port[i:])
+			if err != nil {
+				return nil, err
+			}
+			u.RawPath = port[i:]
+			port = port[:i]
+		}
+		u.Host = net.JoinHostPort(u.Scheme, port)
 		u.Opaque = ""
-	} else if u.Path != "" && !strings.Contains(u.Path, ":") {
+	} else if u.Host == "" && u.Path != "" && !strings.Contains(u.Path, ":") {
 		u.Host = net.JoinHostPort(u.Path, util.GetServerPort())
 		u.Path = ""
-	} else if u.Scheme == "" {
+	} else if u.Host == "" && u.Scheme == "" {
 		u.Host = u.Path
 		u.Path = ""
 	}
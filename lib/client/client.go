@@ -0,0 +1,215 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package client is a client of the Fabric CA server for Go programs, on
+// which the fabric-ca-client command is built.
+//
+// A Client is created from a configuration, which has the fields of the
+// configuration file of fabric-ca-client but is not read from any file or
+// environment variable, and sends each request with the context passed to
+// its method. It writes nothing to stdout. It touches the file system only
+// where its configuration asks it to: if the msp directory of the
+// configuration is empty, the keys of the client are kept in memory and
+// nothing is read from or written to disk; otherwise the keys are stored in
+// the keystore directory of the msp directory, as by fabric-ca-client, and
+// the identities of the client can be loaded from and stored to it.
+//
+// The errors returned by the requests of a Client have one of the following
+// causes, as returned by errors.Cause of the github.com/pkg/errors package,
+// if the request failed for one of these reasons:
+//
+//	*lib.ResponseError   the server rejected the request
+//	*lib.TimeoutError    the request did not complete in time
+//	*lib.ProxyError      the request could not be sent through the proxy
+//	context.Canceled     the context of the request was canceled
+//	net.Error            the request could not be sent to the server
+package client
+
+import (
+	"context"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib"
+	"github.com/pkg/errors"
+)
+
+// Config is the configuration of a Client
+type Config struct {
+	// ClientConfig is the configuration of the client, with the fields of
+	// the configuration file of fabric-ca-client; its URL is the URL of the
+	// server. If its MSPDir is empty, the keys of the client are kept in
+	// memory. It is initialized by New, which makes its file names absolute.
+	ClientConfig *lib.ClientConfig
+	// HomeDir is the directory against which the relative file names of
+	// ClientConfig are resolved; they are relative to the current directory
+	// if it is empty
+	HomeDir string
+	// KeyPassphrase, if set, returns the passphrase of the encrypted private
+	// key of an identity stored in or loaded from the msp directory, when
+	// the passphrase is not configured; 'newKey' is true when the
+	// passphrase is chosen for a new key
+	KeyPassphrase func(newKey bool) ([]byte, error)
+	// Connections, if set, is a client whose connections to the server are
+	// reused by the new client, which then sends its requests with the TLS
+	// and proxy settings of that client rather than those of ClientConfig
+	Connections *Client
+}
+
+// Client is a client of a Fabric CA server. Its methods may be called
+// concurrently, and its connections to the server are kept open and reused
+// by its requests.
+type Client struct {
+	client *lib.Client
+}
+
+// New returns the client of the server with the configuration 'cfg'
+func New(cfg *Config) (*Client, error) {
+	if cfg == nil || cfg.ClientConfig == nil {
+		return nil, errors.New("The configuration of the client is required")
+	}
+	if cfg.ClientConfig.URL == "" {
+		return nil, errors.New("The URL of the server is required")
+	}
+	client := &lib.Client{
+		HomeDir:       cfg.HomeDir,
+		Config:        cfg.ClientConfig,
+		KeyPassphrase: cfg.KeyPassphrase,
+		InMemory:      cfg.ClientConfig.MSPDir == "",
+	}
+	if cfg.Connections != nil {
+		err := client.ShareConnections(cfg.Connections.client)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := client.Init()
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to initialize the client")
+	}
+	return &Client{client: client}, nil
+}
+
+// Enroll enrolls the identity of the enrollment request 'req' with its
+// enrollment ID and secret, and returns its credentials and the CA's
+// information. The credentials are not stored; the identity of the
+// response is stored in the msp directory by its Store method.
+func (c *Client) Enroll(ctx context.Context, req *api.EnrollmentRequest) (*lib.EnrollmentResponse, error) {
+	if req == nil || req.Name == "" {
+		return nil, errors.New("The enrollment ID of the enrollment request is required")
+	}
+	client, err := c.client.WithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.Enroll(req)
+}
+
+// Reenroll reenrolls the identity 'id', which is one of the identities of
+// the client, and returns its new credentials. The credentials are not
+// stored, and they replace the current ones once stored.
+func (c *Client) Reenroll(ctx context.Context, id *lib.Identity, req *api.ReenrollmentRequest) (*lib.EnrollmentResponse, error) {
+	id, err := c.withContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return id.Reenroll(req)
+}
+
+// Register registers a new identity on behalf of the registrar 'registrar'
+// and returns its enrollment secret
+func (c *Client) Register(ctx context.Context, registrar *lib.Identity, req *api.RegistrationRequest) (*api.RegistrationResponse, error) {
+	registrar, err := c.withContext(ctx, registrar)
+	if err != nil {
+		return nil, err
+	}
+	return registrar.Register(req)
+}
+
+// Revoke revokes a certificate, or all certificates of an identity, on
+// behalf of the identity 'revoker', and returns the revoked certificates
+// and, if requested, the CRL of the CA
+func (c *Client) Revoke(ctx context.Context, revoker *lib.Identity, req *api.RevocationRequest) (*api.RevocationResponse, error) {
+	revoker, err := c.withContext(ctx, revoker)
+	if err != nil {
+		return nil, err
+	}
+	return revoker.Revoke(req)
+}
+
+// GetCACert returns the CA's information, including its CA chain, which is
+// verified to have a self-signed root certificate to which each
+// intermediate certificate chains. Nothing is stored. If the request has the
+// ETag of the CA information, which is unchanged, the response only has its
+// ETag and NotModified set.
+func (c *Client) GetCACert(ctx context.Context, req *api.GetCAInfoRequest) (*lib.GetCAInfoResponse, error) {
+	if req == nil {
+		req = &api.GetCAInfoRequest{}
+	}
+	client, err := c.client.WithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.GetCAInfo(req)
+	if err != nil || resp.NotModified {
+		return resp, err
+	}
+	err = resp.VerifyCAChain()
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// GenCRL returns the CRL of the certificates revoked as selected by 'req',
+// generated by the CA on behalf of the identity 'id'
+func (c *Client) GenCRL(ctx context.Context, id *lib.Identity, req *api.GenCRLRequest) (*api.GenCRLResponse, error) {
+	id, err := c.withContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return id.GenCRL(req)
+}
+
+// GetCACertAs returns the CA chain in the format 'format' as returned by the
+// server, which is not verified
+func (c *Client) GetCACertAs(ctx context.Context, req *api.GetCAInfoRequest, format lib.Format) ([]byte, error) {
+	if req == nil {
+		req = &api.GetCAInfoRequest{}
+	}
+	client, err := c.client.WithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.GetCAInfoAs(req, format)
+}
+
+// GenCRLAs returns the CRL in the format 'format' as returned by the server,
+// which is not verified
+func (c *Client) GenCRLAs(ctx context.Context, id *lib.Identity, req *api.GenCRLRequest, format lib.Format) ([]byte, error) {
+	id, err := c.withContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return id.GenCRLAs(req, format)
+}
+
+// LoadIdentity loads the identity whose credentials are stored in the msp
+// directory of the client
+func (c *Client) LoadIdentity() (*lib.Identity, error) {
+	return c.client.LoadMyIdentity()
+}
+
+// withContext returns a copy of 'id' whose requests are sent with 'ctx', or
+// an error if it is not an identity of the client
+func (c *Client) withContext(ctx context.Context, id *lib.Identity) (*lib.Identity, error) {
+	if id == nil {
+		return nil, errors.New("The identity of the caller is required")
+	}
+	if client := id.GetClient(); client == nil || client.Config != c.client.Config {
+		return nil, errors.Errorf("Identity '%s' is not an identity of this client", id.GetName())
+	}
+	return id.WithContext(ctx)
+}
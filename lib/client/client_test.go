@@ -0,0 +1,189 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package client_test
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib"
+	"github.com/hyperledger/fabric-ca/lib/client"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+const serverPort = 7122
+
+var serverURL = fmt.Sprintf("http://localhost:%d", serverPort)
+
+// startServer starts a server with the bootstrap identity admin:adminpw,
+// whose home directory is in 'dir'
+func startServer(t *testing.T, dir string) *lib.Server {
+	srv := lib.TestGetServer(serverPort, filepath.Join(dir, "server"), "", -1, t)
+	err := srv.RegisterBootstrapUser("admin", "adminpw", "")
+	util.FatalError(t, err, "Failed to register the bootstrap identity")
+	err = srv.Start()
+	util.FatalError(t, err, "Failed to start the server")
+	return srv
+}
+
+// newClient returns a client of the server whose keys are in memory
+func newClient(t *testing.T, homeDir string) *client.Client {
+	c, err := client.New(&client.Config{ClientConfig: &lib.ClientConfig{URL: serverURL}, HomeDir: homeDir})
+	util.FatalError(t, err, "Failed to create the client")
+	return c
+}
+
+func TestClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libclient")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(dir)
+	srv := startServer(t, dir)
+	defer srv.Stop()
+	homeDir := filepath.Join(dir, "client")
+	err = os.Mkdir(homeDir, 0755)
+	util.FatalError(t, err, "Failed to create the home directory of the client")
+	ctx := context.Background()
+	c := newClient(t, homeDir)
+
+	// Enroll
+	resp, err := c.Enroll(ctx, &api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll the admin")
+	admin := resp.Identity
+	assert.Equal(t, "admin", admin.GetName())
+	assert.NoError(t, resp.VerifyCert(), "The certificate should verify against the CA chain")
+	assert.Equal(t, "admin", admin.GetECert().GetX509Cert().Subject.CommonName)
+
+	// GetCACert
+	info, err := c.GetCACert(ctx, nil)
+	util.FatalError(t, err, "Failed to get the CA's information")
+	assert.Equal(t, resp.CAInfo.CAChain, info.CAChain)
+
+	// Register
+	rr, err := c.Register(ctx, admin, &api.RegistrationRequest{Name: "user1", Affiliation: "org1"})
+	util.FatalError(t, err, "Failed to register user1")
+	assert.NotEmpty(t, rr.Secret, "The enrollment secret should be generated")
+	resp, err = c.Enroll(ctx, &api.EnrollmentRequest{Name: "user1", Secret: rr.Secret})
+	util.FatalError(t, err, "Failed to enroll user1")
+	user1 := resp.Identity
+
+	// Reenroll
+	resp, err = c.Reenroll(ctx, user1, &api.ReenrollmentRequest{ReuseKey: true})
+	util.FatalError(t, err, "Failed to reenroll user1")
+	cert := resp.Identity.GetECert()
+	assert.NotEqual(t, user1.GetECert().GetX509Cert().SerialNumber, cert.GetX509Cert().SerialNumber)
+	assert.Equal(t, user1.GetECert().Key().SKI(), cert.Key().SKI(), "The key should be reused")
+
+	// Revoke
+	serial := util.GetSerialAsHex(cert.GetX509Cert().SerialNumber)
+	aki := fmt.Sprintf("%x", cert.GetX509Cert().AuthorityKeyId)
+	rev, err := c.Revoke(ctx, admin, &api.RevocationRequest{Serial: serial, AKI: aki, Reason: "keycompromise", GenCRL: true})
+	util.FatalError(t, err, "Failed to revoke the certificate of user1")
+	if assert.Len(t, rev.RevokedCerts, 1) {
+		assert.Equal(t, serial, rev.RevokedCerts[0].Serial)
+	}
+	assert.NotEmpty(t, rev.CRL, "The CRL should be generated")
+
+	// GenCRL
+	crl, err := c.GenCRL(ctx, admin, &api.GenCRLRequest{})
+	util.FatalError(t, err, "Failed to generate the CRL")
+	list, err := x509.ParseCRL(crl.CRL)
+	util.FatalError(t, err, "Failed to parse the CRL")
+	if assert.Len(t, list.TBSCertList.RevokedCertificates, 1) {
+		assert.Equal(t, cert.GetX509Cert().SerialNumber, list.TBSCertList.RevokedCertificates[0].SerialNumber)
+	}
+
+	// The keys are in memory, so nothing is stored
+	err = admin.Store()
+	util.ErrorContains(t, err, "keeps its keys in memory", "An identity in memory should not be stored")
+	_, err = c.LoadIdentity()
+	assert.Error(t, err, "A client in memory has no identity to load")
+	files, err := ioutil.ReadDir(homeDir)
+	util.FatalError(t, err, "Failed to read the home directory of the client")
+	assert.Empty(t, files, "The client should not write to the file system")
+	_, err = os.Stat("msp")
+	assert.True(t, os.IsNotExist(err), "The client should not create the msp directory")
+}
+
+func TestClientErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libclienterrors")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(dir)
+	srv := startServer(t, dir)
+	defer srv.Stop()
+	ctx := context.Background()
+	c := newClient(t, dir)
+
+	_, err = client.New(&client.Config{ClientConfig: &lib.ClientConfig{}})
+	util.ErrorContains(t, err, "The URL of the server is required", "A client requires the URL of the server")
+	_, err = c.Enroll(ctx, &api.EnrollmentRequest{})
+	util.ErrorContains(t, err, "The enrollment ID of the enrollment request is required", "Enrolling requires the enrollment ID")
+
+	// A rejected request fails with the server's response
+	_, err = c.Enroll(ctx, &api.EnrollmentRequest{Name: "admin", Secret: "badpw"})
+	re, ok := errors.Cause(err).(*lib.ResponseError)
+	if assert.True(t, ok, "The error should be the server's response: %v", err) {
+		assert.True(t, re.IsAuthFailure(), "The server should not authenticate a bad secret")
+	}
+
+	// A canceled request fails with the error of its context
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = c.GetCACert(canceled, nil)
+	assert.Equal(t, context.Canceled, errors.Cause(err), "The request should be canceled: %v", err)
+
+	// The canceled context of a request does not affect the identity which
+	// it returned nor the other requests
+	resp, err := c.Enroll(ctx, &api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll the admin")
+	_, err = c.Register(canceled, resp.Identity, &api.RegistrationRequest{Name: "user1", Affiliation: "org1"})
+	assert.Equal(t, context.Canceled, errors.Cause(err), "The request should be canceled: %v", err)
+	_, err = c.Register(ctx, resp.Identity, &api.RegistrationRequest{Name: "user1", Affiliation: "org1"})
+	assert.NoError(t, err, "The identity should be usable with another context")
+
+	// The identities of a client are only used by that client
+	_, err = newClient(t, dir).Register(ctx, resp.Identity, &api.RegistrationRequest{Name: "user2", Affiliation: "org1"})
+	util.ErrorContains(t, err, "Identity 'admin' is not an identity of this client", "Another client's identity should be refused")
+	_, err = c.GenCRL(ctx, nil, &api.GenCRLRequest{})
+	util.ErrorContains(t, err, "The identity of the caller is required", "An identity is required")
+}
+
+func TestClientMSPDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libclientmsp")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(dir)
+	srv := startServer(t, dir)
+	defer srv.Stop()
+	ctx := context.Background()
+	cfg := &client.Config{ClientConfig: &lib.ClientConfig{URL: serverURL, MSPDir: "msp"}, HomeDir: dir}
+	c, err := client.New(cfg)
+	util.FatalError(t, err, "Failed to create the client")
+	assert.Equal(t, filepath.Join(dir, "msp"), cfg.ClientConfig.MSPDir, "The msp directory should be absolute")
+
+	resp, err := c.Enroll(ctx, &api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll the admin")
+	_, err = c.LoadIdentity()
+	assert.Error(t, err, "The identity should not be stored until asked to")
+	err = resp.Identity.Store()
+	util.FatalError(t, err, "Failed to store the identity of the admin")
+
+	// A new client of the same msp directory loads the stored identity
+	c, err = client.New(&client.Config{ClientConfig: &lib.ClientConfig{URL: serverURL, MSPDir: "msp"}, HomeDir: dir})
+	util.FatalError(t, err, "Failed to create the client")
+	admin, err := c.LoadIdentity()
+	util.FatalError(t, err, "Failed to load the identity of the admin")
+	assert.Equal(t, "admin", admin.GetName())
+	_, err = c.Register(ctx, admin, &api.RegistrationRequest{Name: "user1", Affiliation: "org1"})
+	assert.NoError(t, err, "The loaded identity should register")
+}
@@ -28,6 +28,8 @@ const (
 type Client interface {
 	NewX509Identity(name string, creds []credential.Credential) Identity
 	GetCSP() bccsp.BCCSP
+	// GetKeyPassphrase returns the passphrase of an encrypted private key
+	GetKeyPassphrase() ([]byte, error)
 }
 
 // Identity represents an identity
@@ -94,9 +96,17 @@ func (cred *Credential) Load() error {
 	csp := cred.getCSP()
 	key, _, _, err := util.GetSignerFromCertFile(cred.certFile, csp)
 	if err != nil {
-		// Fallback: attempt to read out of keyFile and import
+		// Fallback: attempt to read out of keyFile, which may be encrypted,
+		// and import
 		log.Debugf("No key found in the BCCSP keystore, attempting fallback")
-		key, err = util.ImportBCCSPKeyFromPEM(cred.keyFile, csp, true)
+		var passphrase func() ([]byte, error)
+		if cred.client != nil {
+			passphrase = cred.client.GetKeyPassphrase
+		}
+		key, err = util.ImportBCCSPKeyFromEncryptedPEM(cred.keyFile, csp, true, passphrase)
+		if util.IsKeyDecryptionError(err) {
+			return err
+		}
 		if err != nil {
 			return errors.WithMessage(err, fmt.Sprintf("Could not find the private key in the BCCSP keystore nor in the keyfile %s", cred.keyFile))
 		}
@@ -109,12 +119,13 @@ func (cred *Credential) Load() error {
 }
 
 // Store stores the certificate associated with this X509 credential to the location
-// specified by certFile attribute
+// specified by certFile attribute, replacing any certificate there only once
+// the new one is completely written
 func (cred *Credential) Store() error {
 	if cred.val == nil {
 		return errors.New("X509 Credential value is not set")
 	}
-	err := util.WriteFile(cred.certFile, cred.val.Cert(), 0644)
+	err := util.WriteFileAtomic(cred.certFile, cred.val.Cert(), 0644)
 	if err != nil {
 		return errors.WithMessage(err, "Failed to store the certificate")
 	}
@@ -122,14 +122,16 @@ func TestX509Credential(t *testing.T) {
 	err = x509Cred.Load()
 	assert.NoError(t, err, "Load should not fail as both cert and key files exist and are valid")
 
-	// Should error if it fails to write cert to the specified file
-	if err = os.Chmod(certFile, 0000); err != nil {
-		t.Fatalf("Failed to chmod certificate file %s: %s", certFile, err.Error())
+	// Should error if it fails to write cert to the specified file, which is
+	// replaced by a temporary file in its directory
+	certDir := filepath.Dir(certFile)
+	if err = os.Chmod(certDir, 0555); err != nil {
+		t.Fatalf("Failed to chmod certificate directory %s: %s", certDir, err.Error())
 	}
 	err = x509Cred.Store()
-	assert.Error(t, err, "Store should fail as %s is not writable", certFile)
-	if err = os.Chmod(certFile, 0644); err != nil {
-		t.Fatalf("Failed to chmod certificate file %s: %s", certFile, err.Error())
+	assert.Error(t, err, "Store should fail as %s is not writable", certDir)
+	if err = os.Chmod(certDir, 0755); err != nil {
+		t.Fatalf("Failed to chmod certificate directory %s: %s", certDir, err.Error())
 	}
 
 	// Success cases
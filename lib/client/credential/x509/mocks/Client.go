@@ -33,6 +33,29 @@ func (_m *Client) GetCSP() bccsp.BCCSP {
 	return r0
 }
 
+// GetKeyPassphrase provides a mock function with given fields:
+func (_m *Client) GetKeyPassphrase() ([]byte, error) {
+	ret := _m.Called()
+
+	var r0 []byte
+	if rf, ok := ret.Get(0).(func() []byte); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]byte)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // NewX509Identity provides a mock function with given fields: name, creds
 func (_m *Client) NewX509Identity(name string, creds []credential.Credential) x509.Identity {
 	ret := _m.Called(name, creds)
@@ -0,0 +1,117 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib"
+	"github.com/hyperledger/fabric-ca/lib/client"
+	"github.com/pkg/errors"
+)
+
+// The keys of a client without an msp directory are kept in memory
+func ExampleNew() {
+	c, err := client.New(&client.Config{
+		ClientConfig: &lib.ClientConfig{URL: "http://localhost:7054"},
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	info, err := c.GetCACert(ctx, &api.GetCAInfoRequest{})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("CA %s runs version %s\n", info.CAName, info.Version)
+}
+
+func ExampleClient_Enroll() {
+	c, err := client.New(&client.Config{
+		ClientConfig: &lib.ClientConfig{URL: "http://localhost:7054"},
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	resp, err := c.Enroll(context.Background(), &api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	if re, ok := errors.Cause(err).(*lib.ResponseError); ok && re.IsAuthFailure() {
+		fmt.Println("The enrollment ID or secret is wrong")
+		return
+	} else if err != nil {
+		fmt.Println(err)
+		return
+	}
+	cert := resp.Identity.GetECert().GetX509Cert()
+	fmt.Printf("Enrolled %s until %s\n", cert.Subject.CommonName, cert.NotAfter)
+}
+
+func ExampleClient_Register() {
+	c, err := client.New(&client.Config{
+		ClientConfig: &lib.ClientConfig{URL: "http://localhost:7054"},
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	ctx := context.Background()
+	resp, err := c.Enroll(ctx, &api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	rr, err := c.Register(ctx, resp.Identity, &api.RegistrationRequest{Name: "peer1", Type: "peer", Affiliation: "org1"})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	peer, err := c.Enroll(ctx, &api.EnrollmentRequest{Name: "peer1", Secret: rr.Secret})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("Enrolled", peer.Identity.GetName())
+}
+
+// The identity of a client with an msp directory is stored in it, as by the
+// fabric-ca-client command, only when asked to
+func ExampleClient_LoadIdentity() {
+	c, err := client.New(&client.Config{
+		ClientConfig: &lib.ClientConfig{URL: "http://localhost:7054", MSPDir: "msp"},
+		HomeDir:      "/etc/myservice/fabric-ca",
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	id, err := c.LoadIdentity()
+	if err != nil {
+		resp, err := c.Enroll(context.Background(), &api.EnrollmentRequest{Name: "myservice", Secret: "myservicepw"})
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		err = resp.Identity.Store()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		id = resp.Identity
+	}
+	crl, err := c.GenCRL(context.Background(), id, &api.GenCRLRequest{})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("The CRL has %d bytes\n", len(crl.CRL))
+}
@@ -10,7 +10,6 @@ import (
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"path"
 	"testing"
@@ -145,7 +144,7 @@ func TestCWBTLSClientAuth(t *testing.T) {
 	// server's transport can only be changed from ssl to non-ssl or vice-versa
 	// by restarting the server, in which case connections in the client's
 	// connection pool are invalidated and it is forced to create new connection.
-	client.httpClient.Transport.(*http.Transport).CloseIdleConnections()
+	client.httpTransport().CloseIdleConnections()
 
 	// Try to reenroll over HTTP and it should fail because server is listening on HTTPS
 	_, err = id.Reenroll(&api.ReenrollmentRequest{})
@@ -187,7 +186,7 @@ func TestCWBTLSClientAuth(t *testing.T) {
 		t.Fatalf("Failed to start server with HTTPS and client auth: %s", err)
 	}
 	// Close all idle connections
-	client.httpClient.Transport.(*http.Transport).CloseIdleConnections()
+	client.httpTransport().CloseIdleConnections()
 
 	// Try to reenroll and it should fail because client has no client cert
 	_, err = id.Reenroll(&api.ReenrollmentRequest{})
@@ -712,3 +711,25 @@ func masqueradeReenroll(c *Client, id string, identity *Identity, passInSubject
 	// Create the enrollment response
 	return c.newEnrollmentResponse(&result, identity.GetName(), key)
 }
+
+func TestClientGetURL(t *testing.T) {
+	// The endpoints are joined to the path of the server URL, whose trailing
+	// and repeated slashes are removed
+	for url, expected := range map[string]string{
+		"http://localhost:7054":             "http://localhost:7054/enroll",
+		"http://localhost:7054/":            "http://localhost:7054/enroll",
+		"https://gw.example.com/ca":         "https://gw.example.com/ca/enroll",
+		"https://gw.example.com:443/ca/":    "https://gw.example.com:443/ca/enroll",
+		"https://gw.example.com:443//ca//":  "https://gw.example.com:443/ca/enroll",
+		"https://gw.example.com:443/a/b/":   "https://gw.example.com:443/a/b/enroll",
+		"https://gw.example.com:443/a%2Fb/": "https://gw.example.com:443/a%2Fb/enroll",
+		"localhost:7054/ca/":                "http://localhost:7054/ca/enroll",
+		"localhost":                         "http://localhost:7054/enroll",
+	} {
+		c := &Client{Config: &ClientConfig{URL: url}}
+		u, err := c.getURL("enroll")
+		if assert.NoError(t, err, "Failed to get the URL of an endpoint of %s", url) {
+			assert.Equal(t, expected, u, "Unexpected URL of an endpoint of %s", url)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/lib/common"
+	"github.com/hyperledger/fabric-ca/lib/metadata"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+)
+
+// endpointAPIVersions are the API versions of the endpoints which this client
+// sends to an API version after metadata.APIVersion, latest first, if the
+// server serves it
+var endpointAPIVersions = map[string][]string{
+	"enroll": {"v2"},
+}
+
+// apiVersions is what a client has learned of the API versions served by
+// its server, which is shared by the copies of the client
+type apiVersions struct {
+	mutex sync.Mutex
+	// served are the API versions served by the server, or nil until a
+	// response of the server reports them
+	served []string
+}
+
+// set records the API versions 'versions' served by the server
+func (av *apiVersions) set(versions []string) {
+	if av == nil {
+		return
+	}
+	av.mutex.Lock()
+	av.served = versions
+	av.mutex.Unlock()
+}
+
+// serves returns true if the server serves the API version 'version' or if
+// its API versions are not known
+func (av *apiVersions) serves(version string) bool {
+	if av == nil {
+		return true
+	}
+	av.mutex.Lock()
+	defer av.mutex.Unlock()
+	return av.served == nil || util.StrContained(version, av.served)
+}
+
+// apiEndpoint returns the path of the endpoint 'endpoint' in the latest API
+// version which both the client and the server serve, such as api/v2/enroll,
+// or 'endpoint' itself in metadata.APIVersion
+func (c *Client) apiEndpoint(endpoint string) string {
+	for _, version := range endpointAPIVersions[endpoint] {
+		if c.apiVersions.serves(version) {
+			return strings.TrimPrefix(apiVersionPrefix(version), "/") + endpoint
+		}
+	}
+	return endpoint
+}
+
+// endpointNotServed returns true if the request of 'err' failed because the
+// server does not serve its endpoint, as a server which does not serve a
+// later API version of the endpoint. Such a response, unlike an error of the
+// endpoint, has no errors in its body.
+func endpointNotServed(err error) bool {
+	re, ok := errors.Cause(err).(*ResponseError)
+	return ok && re.StatusCode == http.StatusNotFound && len(re.Errors) == 0
+}
+
+// sendAPIRequest calls 'send' with the path of the endpoint 'endpoint' in
+// the latest API version which both the client and the server serve. If the
+// server turns out not to serve that version, which is remembered, 'send' is
+// called again with 'endpoint' itself.
+func (c *Client) sendAPIRequest(endpoint string, send func(path string) error) error {
+	path := c.apiEndpoint(endpoint)
+	err := send(path)
+	if path == endpoint || !endpointNotServed(err) {
+		return err
+	}
+	log.Debugf("The server does not serve %s; sending the request to %s", path, endpoint)
+	c.apiVersions.set([]string{metadata.APIVersion})
+	return send(endpoint)
+}
+
+// endpointName returns the name of the endpoint of the path 'path', which is
+// 'path' without its API version prefix
+func endpointName(path string) string {
+	for _, version := range metadata.APIVersions {
+		prefix := strings.TrimPrefix(apiVersionPrefix(version), "/")
+		if strings.HasPrefix(path, prefix) {
+			return strings.TrimPrefix(path, prefix)
+		}
+	}
+	return path
+}
+
+// enrollmentResponseFromV2 fills in the enroll response 'resp' with the v2
+// enroll response 'v2'
+func enrollmentResponseFromV2(v2 *common.EnrollmentResponseNetV2, resp *common.EnrollmentResponseNet) error {
+	if v2.Certificate == "" {
+		return errors.New("Invalid response format from server: the response has no certificate")
+	}
+	resp.Cert = util.B64Encode([]byte(v2.Certificate))
+	resp.ServerInfo = common.CAInfoResponseNet{
+		CAName:                    v2.CA.Name,
+		CAChain:                   util.B64Encode([]byte(strings.Join(v2.CA.Chain, ""))),
+		IssuerPublicKey:           v2.CA.IssuerPublicKey,
+		IssuerRevocationPublicKey: v2.CA.IssuerRevocationPublicKey,
+		Version:                   v2.CA.Version,
+	}
+	return nil
+}
+
+// parseAPIVersions returns the API versions of the value 'header' of the API
+// versions header
+func parseAPIVersions(header string) []string {
+	var versions []string
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			versions = append(versions, v)
+		}
+	}
+	return versions
+}
+
+// latestCommonAPIVersion returns the latest of the API versions of the
+// client which is in 'versions', or "" if there is none
+func latestCommonAPIVersion(versions []string) string {
+	for i := len(metadata.APIVersions) - 1; i >= 0; i-- {
+		if util.StrContained(metadata.APIVersions[i], versions) {
+			return metadata.APIVersions[i]
+		}
+	}
+	return ""
+}
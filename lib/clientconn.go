@@ -0,0 +1,82 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+const (
+	// maxIdleConnsPerHost is the number of idle connections to the server
+	// kept open by a client, which is enough for the concurrent enrollments
+	// of enroll-batch
+	maxIdleConnsPerHost = 16
+	// idleConnTimeout is the time after which an idle connection is closed
+	idleConnTimeout = 90 * time.Second
+	// maxDrainBytes is the number of bytes of an unread response body which
+	// are read so that its connection can be reused; the connection of a
+	// longer body is closed instead
+	maxDrainBytes = 64 << 10
+)
+
+// newHTTPTransport returns the transport of the HTTP client of a client,
+// which keeps the connections to the server open between requests
+func newHTTPTransport() *http.Transport {
+	return &http.Transport{
+		MaxIdleConns:        maxIdleConnsPerHost,
+		MaxIdleConnsPerHost: maxIdleConnsPerHost,
+		IdleConnTimeout:     idleConnTimeout,
+	}
+}
+
+// httpTransport returns the HTTP transport of the initialized client, which
+// may be wrapped by the transports which trace the requests and compress
+// their bodies, or nil if it is not an HTTP transport
+func (c *Client) httpTransport() *http.Transport {
+	rt := c.httpClient.Transport
+	if tt, ok := rt.(*traceTransport); ok {
+		rt = tt.base
+	}
+	if gt, ok := rt.(*gzipTransport); ok {
+		rt = gt.base
+	}
+	tr, _ := rt.(*http.Transport)
+	return tr
+}
+
+// ShareConnections makes the client send its requests with the HTTP client
+// of 'from', which is initialized if it is not, rather than with its own.
+// The connections to the server are then reused by both clients, whose
+// requests have the TLS and proxy settings of 'from'. It must be called
+// before the client is initialized.
+func (c *Client) ShareConnections(from *Client) error {
+	err := from.Init()
+	if err != nil {
+		return err
+	}
+	c.httpClient = from.httpClient
+	return nil
+}
+
+// drainBody reads what is left of the response body 'body', up to
+// maxDrainBytes, and closes it, so that its connection returns to the pool
+// of idle connections
+func drainBody(body io.ReadCloser) {
+	if body == nil {
+		return
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(body, maxDrainBytes))
+	err := body.Close()
+	if err != nil {
+		log.Debugf("Failed to close the response body: %s", err)
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// connServer is a test server which counts the connections opened to it
+type connServer struct {
+	*httptest.Server
+	mutex sync.Mutex
+	conns int
+}
+
+// newConnServer returns a server which responds to /cainfo with success, to
+// /busy with 503 once in two requests, to /stream with a long array of
+// results and to any other path with an error
+func newConnServer() *connServer {
+	cs := &connServer{}
+	busy := false
+	cs.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/cainfo":
+			w.Write([]byte(`{"success":true,"result":null,"errors":[],"messages":[]}`))
+		case "/busy":
+			cs.mutex.Lock()
+			busy = !busy
+			fail := busy
+			cs.mutex.Unlock()
+			if fail {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(`{"success":false,"result":null,"errors":[{"code":503,"message":"busy"}],"messages":[]}`))
+				return
+			}
+			w.Write([]byte(`{"success":true,"result":null,"errors":[],"messages":[]}`))
+		case "/stream":
+			w.Write([]byte(`{"success":true,"result":{"identities":[`))
+			for i := 0; i < 1000; i++ {
+				if i > 0 {
+					w.Write([]byte(","))
+				}
+				fmt.Fprintf(w, `{"id":"user%d"}`, i)
+			}
+			w.Write([]byte(`]},"errors":[],"messages":[]}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"success":false,"result":null,"errors":[{"code":400,"message":"` + strings.Repeat("x", 8192) + `"}],"messages":[]}`))
+		}
+	}))
+	cs.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			cs.mutex.Lock()
+			cs.conns++
+			cs.mutex.Unlock()
+		}
+	}
+	cs.Start()
+	return cs
+}
+
+func (cs *connServer) connections() int {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	return cs.conns
+}
+
+// newConnClient returns an initialized client of 'url' whose keys are kept
+// in memory
+func newConnClient(url string) (*Client, error) {
+	client := &Client{Config: &ClientConfig{URL: url, Retry: RetryConfig{MaxAttempts: 2, BaseDelay: time.Millisecond}}, InMemory: true}
+	return client, client.Init()
+}
+
+// send sends a request to 'endpoint' of the server of 'client'
+func send(client *Client, endpoint string) error {
+	req, err := client.newGet(endpoint)
+	if err != nil {
+		return err
+	}
+	return client.SendReq(markIdempotent(req), nil)
+}
+
+func TestClientConnectionReuse(t *testing.T) {
+	srv := newConnServer()
+	defer srv.Close()
+	client, err := newConnClient(srv.URL)
+	util.FatalError(t, err, "Failed to initialize client")
+
+	for i := 0; i < 5; i++ {
+		err := send(client, "cainfo")
+		util.FatalError(t, err, "Failed to send request")
+	}
+	assert.Equal(t, 1, srv.connections(), "Sequential requests should reuse the connection")
+
+	// The connection is reused after an error response
+	err = send(client, "unknown")
+	assert.Error(t, err, "The server should respond with an error")
+	err = send(client, "cainfo")
+	util.FatalError(t, err, "Failed to send request")
+	assert.Equal(t, 1, srv.connections(), "The connection should be reused after an error response")
+
+	// and after a retried response
+	err = send(client, "busy")
+	util.FatalError(t, err, "The request should be retried")
+	assert.Equal(t, 1, srv.connections(), "The connection should be reused by the retry")
+
+	// The body of a stream which is not read to its end is drained
+	req, err := client.newGet("stream")
+	util.FatalError(t, err, "Failed to create request")
+	_, err = client.streamResponse(req, "result.identities", func(dec *json.Decoder) error {
+		return errors.New("stop")
+	})
+	assert.Error(t, err, "The callback should stop the stream")
+	err = send(client, "cainfo")
+	util.FatalError(t, err, "Failed to send request")
+	assert.Equal(t, 1, srv.connections(), "The connection should be reused after an unread stream")
+
+	// A client which shares the connections of another one reuses them
+	other := &Client{Config: &ClientConfig{URL: srv.URL}, InMemory: true}
+	err = other.ShareConnections(client)
+	util.FatalError(t, err, "Failed to share the connections")
+	err = send(other, "cainfo")
+	util.FatalError(t, err, "Failed to send request")
+	assert.Equal(t, 1, srv.connections(), "The connections of the other client should be reused")
+	other, err = newConnClient(srv.URL)
+	util.FatalError(t, err, "Failed to initialize client")
+	err = send(other, "cainfo")
+	util.FatalError(t, err, "Failed to send request")
+	assert.Equal(t, 2, srv.connections(), "A client which does not share connections should open its own")
+}
+
+func BenchmarkClientSequentialRequests(b *testing.B) {
+	srv := newConnServer()
+	defer srv.Close()
+	client, err := newConnClient(srv.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := send(client, "cainfo")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(srv.connections()), "conns")
+}
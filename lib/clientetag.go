@@ -0,0 +1,29 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import "net/http"
+
+// conditionalResult is the result of a conditional request, which the server
+// does not return if it is unchanged from the client's copy
+type conditionalResult struct {
+	result interface{}
+	// ETag of the response
+	etag string
+	// True if the server returned 304 (Not Modified)
+	notModified bool
+}
+
+// newConditionalResult sets the If-None-Match header of 'req' to 'etag', if
+// it is not empty, and returns the result in which the response to it is
+// read into 'result' unless it is unchanged
+func newConditionalResult(req *http.Request, etag string, result interface{}) *conditionalResult {
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	return &conditionalResult{result: result}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// minRequestCompressionSize is the size below which a request body is not
+// compressed
+const minRequestCompressionSize = 1024
+
+// gzipTransport compresses the request bodies with gzip once the server has
+// advertised, with the Accept-Encoding header of a response, that it accepts
+// them. The authorization token of a request is computed over its body
+// before it reaches the transport, so it is always over the uncompressed
+// body, which is what the server verifies it over.
+type gzipTransport struct {
+	base http.RoundTripper
+	// Set to 1 once the server has advertised that it accepts gzip bodies
+	serverAccepts int32
+}
+
+// newGzipTransport returns 'base', wrapped so that the request bodies are
+// compressed once the server accepts it
+func newGzipTransport(base http.RoundTripper) *gzipTransport {
+	return &gzipTransport{base: base}
+}
+
+// RoundTrip sends 'req' with the base transport, with its body compressed if
+// it is large enough and the server accepts it
+func (t *gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	out := req
+	if atomic.LoadInt32(&t.serverAccepts) == 1 && req.Body != nil &&
+		req.ContentLength >= minRequestCompressionSize && req.Header.Get("Content-Encoding") == "" {
+		var err error
+		out, err = compressRequest(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp, err := t.base.RoundTrip(out)
+	if err == nil && acceptsGzip(resp.Header.Get("Accept-Encoding")) {
+		atomic.StoreInt32(&t.serverAccepts, 1)
+	}
+	return resp, err
+}
+
+// compressRequest returns a copy of 'req' whose body is the body of 'req'
+// compressed with gzip. A round tripper must not modify the request, so only
+// the copy has the Content-Encoding header.
+func compressRequest(req *http.Request) (*http.Request, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read the request body")
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err = zw.Write(body)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to compress the request body")
+	}
+	compressed := buf.Bytes()
+	out := new(http.Request)
+	*out = *req
+	out.Header = req.Header.Clone()
+	out.Header.Set("Content-Encoding", "gzip")
+	out.ContentLength = int64(len(compressed))
+	out.Body = ioutil.NopCloser(bytes.NewReader(compressed))
+	out.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(compressed)), nil
+	}
+	return out, nil
+}
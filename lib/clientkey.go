@@ -0,0 +1,178 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/hyperledger/fabric/bccsp"
+	"github.com/pkg/errors"
+)
+
+// KeyPassphraseEnvVar is the environment variable which contains the
+// passphrase of the client's encrypted private key, if no passphrase file
+// is configured
+const KeyPassphraseEnvVar = "FABRIC_CA_CLIENT_KEY_PASSPHRASE"
+
+// KeyEncryptionConfig is the configuration of the encryption of the private
+// keys generated by the client
+type KeyEncryptionConfig struct {
+	Enabled        bool   `help:"Encrypt the private key generated by enroll and reenroll with a passphrase, as PKCS #8"`
+	PassphraseFile string `help:"File containing the passphrase of the private key; if not set, the passphrase is read from the FABRIC_CA_CLIENT_KEY_PASSPHRASE environment variable or prompted for"`
+}
+
+// GetKeyPassphrase returns the passphrase of the client's encrypted private
+// key, which is read from the configured passphrase file, the
+// FABRIC_CA_CLIENT_KEY_PASSPHRASE environment variable or, if neither is
+// set, the client's KeyPassphrase function
+func (c *Client) GetKeyPassphrase() ([]byte, error) {
+	return c.keyPassphrase(false)
+}
+
+// keyPassphrase returns the passphrase of the private key; 'newKey' is true
+// if the passphrase is the one of a key to encrypt, which should be
+// confirmed when it is prompted for
+func (c *Client) keyPassphrase(newKey bool) ([]byte, error) {
+	if c.passphrase != nil {
+		return c.passphrase, nil
+	}
+	var passphrase []byte
+	if file := c.Config.KeyEncryption.PassphraseFile; file != "" {
+		file, err := util.MakeFileAbs(file, c.HomeDir)
+		if err != nil {
+			return nil, err
+		}
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read the passphrase of the private key from '%s'", file)
+		}
+		passphrase = []byte(strings.TrimRight(string(buf), "\r\n"))
+	} else if env := os.Getenv(KeyPassphraseEnvVar); env != "" {
+		passphrase = []byte(env)
+	} else if c.KeyPassphrase != nil {
+		var err error
+		passphrase, err = c.KeyPassphrase(newKey)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, errors.WithStack(util.ErrNoPassphrase)
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("The passphrase of the private key is empty")
+	}
+	c.passphrase = passphrase
+	return passphrase, nil
+}
+
+// storeEncryptedKey replaces the file of 'key' in the keystore of the BCCSP
+// by the client's key file, which contains the key encrypted with the
+// passphrase. A key which is not in the keystore, such as a reused key
+// which was loaded from the key file, is left alone.
+func (c *Client) storeEncryptedKey(key bccsp.Key) error {
+	cfg := c.Config.CSP
+	if cfg == nil || cfg.SwOpts == nil || cfg.SwOpts.FileKeystore == nil {
+		return errors.New("Encrypting the private key requires the SW BCCSP with a file keystore")
+	}
+	plainFile := filepath.Join(cfg.SwOpts.FileKeystore.KeyStorePath, hex.EncodeToString(key.SKI())+"_sk")
+	buf, err := ioutil.ReadFile(plainFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read the private key from '%s'", plainFile)
+	}
+	der, err := privateKeyToPKCS8(buf)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to encrypt the private key")
+	}
+	passphrase, err := c.keyPassphrase(true)
+	if err != nil {
+		return err
+	}
+	block, err := util.EncryptPKCS8PrivateKey(der, passphrase)
+	if err != nil {
+		return err
+	}
+	err = util.WriteFileAtomic(c.keyFile, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to store the encrypted private key")
+	}
+	err = os.Remove(plainFile)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to remove the unencrypted private key '%s'", plainFile)
+	}
+	log.Infof("Stored the encrypted private key at %s", c.keyFile)
+	return nil
+}
+
+// privateKeyToPKCS8 returns the PKCS #8 DER encoding of the PEM-encoded
+// private key 'buf'
+func privateKeyToPKCS8(buf []byte) ([]byte, error) {
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.New("The private key is not PEM-encoded")
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		return block.Bytes, nil
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to parse the EC private key")
+		}
+		return x509.MarshalPKCS8PrivateKey(key)
+	}
+	return nil, errors.Errorf("Unsupported private key type '%s'", block.Type)
+}
+
+// memKeyStore is the key store of the software BCCSP of a client which keeps
+// its keys in memory
+type memKeyStore struct {
+	mutex sync.Mutex
+	keys  map[string]bccsp.Key
+}
+
+func newMemKeyStore() *memKeyStore {
+	return &memKeyStore{keys: map[string]bccsp.Key{}}
+}
+
+// ReadOnly returns false, as keys can be stored in the key store
+func (ks *memKeyStore) ReadOnly() bool {
+	return false
+}
+
+// GetKey returns the key whose subject key identifier is 'ski'
+func (ks *memKeyStore) GetKey(ski []byte) (bccsp.Key, error) {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	key, ok := ks.keys[hex.EncodeToString(ski)]
+	if !ok {
+		return nil, errors.Errorf("Key with SKI %x not found in memory", ski)
+	}
+	return key, nil
+}
+
+// StoreKey stores 'key' in memory
+func (ks *memKeyStore) StoreKey(key bccsp.Key) error {
+	if key == nil {
+		return errors.New("Invalid key; it must not be nil")
+	}
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	ks.keys[hex.EncodeToString(key.SKI())] = key
+	return nil
+}
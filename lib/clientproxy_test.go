@@ -0,0 +1,245 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// testProxy is an HTTP proxy which records the requests it receives. It
+// tunnels CONNECT requests and forwards other requests.
+type testProxy struct {
+	*httptest.Server
+	mutex sync.Mutex
+	// auth is the expected Proxy-Authorization header, if any
+	auth     string
+	requests []string
+}
+
+func newTestProxy(auth string) *testProxy {
+	p := &testProxy{auth: auth}
+	p.Server = httptest.NewServer(http.HandlerFunc(p.serveHTTP))
+	return p
+}
+
+func (p *testProxy) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	p.requests = append(p.requests, r.Method+" "+r.Host)
+	p.mutex.Unlock()
+	if p.auth != "" && r.Header.Get("Proxy-Authorization") != p.auth {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+		return
+	}
+	r.RequestURI = ""
+	r.Header.Del("Proxy-Authorization")
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func (p *testProxy) received() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]string(nil), p.requests...)
+}
+
+func newProxyClient(t *testing.T, caURL string, proxy ProxyConfig) (*Client, func()) {
+	client, cleanup := newRetryClient(t, caURL, RetryConfig{})
+	client.Config.Proxy = proxy
+	return client, cleanup
+}
+
+func sendCAInfo(t *testing.T, client *Client) error {
+	req, err := client.newGet("cainfo")
+	util.FatalError(t, err, "Failed to create request")
+	return client.SendReq(req, nil)
+}
+
+func caHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"success":true,"result":null,"errors":[],"messages":[]}`))
+	})
+}
+
+func TestClientProxyTLS(t *testing.T) {
+	ca := httptest.NewTLSServer(caHandler())
+	defer ca.Close()
+	proxy := newTestProxy("")
+	defer proxy.Close()
+
+	client, cleanup := newProxyClient(t, ca.URL, ProxyConfig{URL: proxy.URL})
+	defer cleanup()
+	caFile := filepath.Join(client.HomeDir, "ca.pem")
+	err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate().Raw}), 0644)
+	util.FatalError(t, err, "Failed to write the CA's TLS certificate")
+	client.Config.TLS.Enabled = true
+	client.Config.TLS.CertFiles = []string{caFile}
+
+	err = sendCAInfo(t, client)
+	assert.NoError(t, err, "The request should be tunneled through the proxy")
+	caHost := strings.TrimPrefix(ca.URL, "https://")
+	assert.Equal(t, []string{"CONNECT " + caHost}, proxy.received(), "A CONNECT request should be sent to the proxy for a TLS endpoint")
+}
+
+func TestClientProxyHTTP(t *testing.T) {
+	ca := httptest.NewServer(caHandler())
+	defer ca.Close()
+	proxy := newTestProxy("")
+	defer proxy.Close()
+	caHost := strings.TrimPrefix(ca.URL, "http://")
+
+	client, cleanup := newProxyClient(t, ca.URL, ProxyConfig{URL: proxy.URL})
+	defer cleanup()
+	err := sendCAInfo(t, client)
+	assert.NoError(t, err, "The request should be forwarded by the proxy")
+	assert.Equal(t, []string{"GET " + caHost}, proxy.received())
+
+	// The CA's host matches the list of hosts which are not proxied
+	for _, noProxy := range []string{"127.0.0.1", "example.com," + caHost, "127.0.0.0/8", "*"} {
+		client, cleanup := newProxyClient(t, ca.URL, ProxyConfig{URL: proxy.URL, NoProxy: noProxy})
+		err = sendCAInfo(t, client)
+		cleanup()
+		assert.NoError(t, err, "The request should be sent directly to the CA")
+		assert.Len(t, proxy.received(), 1, "The proxy should not be used when NoProxy is '%s'", noProxy)
+	}
+}
+
+func TestClientProxyAuth(t *testing.T) {
+	ca := httptest.NewTLSServer(caHandler())
+	defer ca.Close()
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	proxy := newTestProxy(auth)
+	defer proxy.Close()
+	dir, err := ioutil.TempDir("", "proxyauth")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	err = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate().Raw}), 0644)
+	util.FatalError(t, err, "Failed to write the CA's TLS certificate")
+
+	// Without credentials, the proxy refuses the CONNECT request
+	client, cleanup := newProxyClient(t, ca.URL, ProxyConfig{URL: proxy.URL})
+	defer cleanup()
+	client.Config.TLS.Enabled = true
+	client.Config.TLS.CertFiles = []string{caFile}
+	err = sendCAInfo(t, client)
+	if assert.Error(t, err, "The request should fail without the proxy's credentials") {
+		_, ok := errors.Cause(err).(*ProxyError)
+		assert.True(t, ok, "The cause should be a ProxyError, not %T: %s", errors.Cause(err), err)
+		assert.Contains(t, err.Error(), "407")
+	}
+
+	// The credentials in the proxy's URL are sent, but not reported in errors
+	authURL := strings.Replace(proxy.URL, "http://", "http://user:secret@", 1)
+	client, cleanup = newProxyClient(t, ca.URL, ProxyConfig{URL: authURL})
+	defer cleanup()
+	client.Config.TLS.Enabled = true
+	client.Config.TLS.CertFiles = []string{caFile}
+	err = sendCAInfo(t, client)
+	assert.NoError(t, err, "The request should succeed with the proxy's credentials")
+
+	// A plain HTTP request is also refused without credentials
+	httpCA := httptest.NewServer(caHandler())
+	defer httpCA.Close()
+	badAuthURL := strings.Replace(proxy.URL, "http://", "http://user:wrong@", 1)
+	client, cleanup = newProxyClient(t, httpCA.URL, ProxyConfig{URL: badAuthURL})
+	defer cleanup()
+	err = sendCAInfo(t, client)
+	if assert.Error(t, err, "The request should fail with the wrong credentials") {
+		_, ok := errors.Cause(err).(*ProxyError)
+		assert.True(t, ok, "The cause should be a ProxyError, not %T: %s", errors.Cause(err), err)
+		assert.NotContains(t, err.Error(), "wrong", "The proxy's password should not be reported")
+	}
+}
+
+func TestClientProxyUnreachable(t *testing.T) {
+	ca := httptest.NewServer(caHandler())
+	defer ca.Close()
+	proxy := newTestProxy("")
+	proxyURL := proxy.URL
+	proxy.Close()
+
+	client, cleanup := newProxyClient(t, ca.URL, ProxyConfig{URL: proxyURL})
+	defer cleanup()
+	err := sendCAInfo(t, client)
+	if assert.Error(t, err, "The request should fail when the proxy is not listening") {
+		_, ok := errors.Cause(err).(*ProxyError)
+		assert.True(t, ok, "The cause should be a ProxyError, not %T: %s", errors.Cause(err), err)
+		assert.Contains(t, err.Error(), "through the proxy "+proxyURL)
+	}
+
+	client, cleanup = newProxyClient(t, ca.URL, ProxyConfig{URL: "socks5://localhost:1080"})
+	defer cleanup()
+	err = client.Init()
+	assert.Error(t, err, "A proxy URL with an unsupported scheme should fail")
+}
+
+func TestMatchesNoProxy(t *testing.T) {
+	tests := []struct {
+		host    string
+		noProxy string
+		match   bool
+	}{
+		{"ca.example.com:7054", "", false},
+		{"ca.example.com:7054", "*", true},
+		{"ca.example.com:7054", "example.com", true},
+		{"ca.example.com:7054", ".example.com", true},
+		{"ca.example.com:7054", "CA.Example.com", true},
+		{"ca.example.com:7054", "ample.com", false},
+		{"ca.example.com:7054", "other.com, ca.example.com:7054", true},
+		{"ca.example.com:7054", "ca.example.com:7055", false},
+		{"10.1.2.3:7054", "10.0.0.0/8", true},
+		{"10.1.2.3:7054", "10.1.2.3", true},
+		{"10.1.2.3:7054", "192.168.0.0/16", false},
+		{"[::1]:7054", "::1", true},
+		{"[::1]:7054", "[::1]:7054", true},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.match, matchesNoProxy(test.host, test.noProxy), "matchesNoProxy(%q, %q)", test.host, test.noProxy)
+	}
+}
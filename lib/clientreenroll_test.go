@@ -0,0 +1,77 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReenrollReuseKey(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	c := TestGetRootClient()
+	resp, err := c.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin'")
+	id := resp.Identity
+	assert.NoError(t, resp.VerifyCert(), "The enrollment certificate should verify against the CA chain")
+
+	resp, err = id.Reenroll(&api.ReenrollmentRequest{ReuseKey: true})
+	util.FatalError(t, err, "Failed to reenroll reusing the key")
+	assert.True(t, samePublicKey(t, id, resp.Identity), "The key of the current certificate should be reused")
+	assert.NotEqual(t, id.GetECert().GetX509Cert().SerialNumber, resp.Identity.GetECert().GetX509Cert().SerialNumber,
+		"A new certificate should be issued")
+	assert.NoError(t, resp.VerifyCert())
+
+	resp, err = id.Reenroll(&api.ReenrollmentRequest{})
+	util.FatalError(t, err, "Failed to reenroll with a new key")
+	assert.False(t, samePublicKey(t, id, resp.Identity), "A new key should be generated")
+}
+
+func TestEnrollmentResponseVerifyCert(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	resp, err := TestGetRootClient().Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin'")
+
+	otherCA, err := util.ReadFile(filepath.Join(testdataDir, "root.pem"))
+	util.FatalError(t, err, "Failed to read CA certificate")
+	resp.CAInfo.CAChain = otherCA
+	assert.Error(t, resp.VerifyCert(), "A certificate should not verify against the chain of another CA")
+	resp.CAInfo.CAChain = nil
+	assert.Error(t, resp.VerifyCert(), "A certificate should not verify against an empty chain")
+}
+
+// samePublicKey returns true if the enrollment certificates of 'id1' and
+// 'id2' have the same public key
+func samePublicKey(t *testing.T, id1, id2 *Identity) bool {
+	pub := func(id *Identity) []byte {
+		buf, err := x509.MarshalPKIXPublicKey(id.GetECert().GetX509Cert().PublicKey)
+		util.FatalError(t, err, "Failed to marshal public key")
+		return buf
+	}
+	return bytes.Equal(pub(id1), pub(id2))
+}
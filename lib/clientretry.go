@@ -0,0 +1,256 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/lib/tls"
+	"github.com/pkg/errors"
+)
+
+// IdempotencyKeyHeader is the header of a request which identifies it so
+// that the server can recognize a retry of a request it already handled
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// The defaults of the retry configuration
+const (
+	defaultRetryBaseDelay = 500 * time.Millisecond
+	defaultRetryMaxDelay  = 10 * time.Second
+)
+
+// defaultRetryStatusCodes are the HTTP status codes of the responses which
+// are retried if no status codes are configured
+var defaultRetryStatusCodes = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// idempotencyKeyEndpoints are the endpoints whose requests may be sent with an
+// idempotency key, and so can be retried. The requests to the endpoints mapped
+// to true, whose idempotency keys the server stores, have one whenever
+// retries are enabled; the others only when idempotency keys are enabled.
+var idempotencyKeyEndpoints = map[string]bool{
+	"enroll":   false,
+	"register": true,
+	"revoke":   true,
+}
+
+// RetryConfig is the configuration of the retries of requests which fail
+// because the server is temporarily unavailable
+type RetryConfig struct {
+	MaxAttempts     int           `def:"1" help:"Maximum number of attempts of a request which fails with a retryable error; 1 disables retries"`
+	BaseDelay       time.Duration `def:"500ms" help:"Delay before the first retry, which doubles after each retry"`
+	MaxDelay        time.Duration `def:"10s" help:"Maximum delay before a retry, including one requested by the server's Retry-After header"`
+	StatusCodes     []int         `help:"HTTP status codes of the responses which are retried (default 502, 503 and 504)"`
+	IdempotencyKeys bool          `help:"Send an idempotency key with enroll requests so that they are also retried, as register and revoke requests are whenever retries are enabled; the server must support idempotency keys"`
+}
+
+// idempotentRequestKey is the context key which marks a request as
+// idempotent regardless of its method
+type idempotentRequestKey struct{}
+
+// markIdempotent returns 'req' marked as idempotent, such as a POST request
+// which only reads from the server
+func markIdempotent(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), idempotentRequestKey{}, true))
+}
+
+// isIdempotent returns true if 'req' can be sent again without changing its
+// effect on the server
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	if req.Header.Get(IdempotencyKeyHeader) != "" {
+		return true
+	}
+	marked, _ := req.Context().Value(idempotentRequestKey{}).(bool)
+	return marked
+}
+
+// setIdempotencyKey sets a random idempotency key on a request to 'endpoint'
+// if idempotency keys are enabled for it
+func (c *Client) setIdempotencyKey(req *http.Request, endpoint string) error {
+	stored, ok := idempotencyKeyEndpoints[endpointName(endpoint)]
+	cfg := c.Config.Retry
+	if !ok || !cfg.IdempotencyKeys && !(stored && cfg.MaxAttempts > 1) {
+		return nil
+	}
+	key := make([]byte, 16)
+	_, err := rand.Read(key)
+	if err != nil {
+		return errors.Wrap(err, "Failed to generate an idempotency key")
+	}
+	req.Header.Set(IdempotencyKeyHeader, hex.EncodeToString(key))
+	return nil
+}
+
+// doWithRetry sends 'req', retrying it with exponential backoff while it
+// fails with a retryable error and attempts remain. It returns the last
+// response or error and the number of attempts made.
+func (c *Client) doWithRetry(req *http.Request) (*http.Response, int, error) {
+	cfg := c.Config.Retry
+	maxAttempts := cfg.MaxAttempts
+	if maxAttempts < 1 || !isIdempotent(req) {
+		maxAttempts = 1
+	}
+	baseDelay := cfg.BaseDelay
+	if baseDelay <= 0 {
+		baseDelay = defaultRetryBaseDelay
+	}
+	maxDelay := cfg.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultRetryMaxDelay
+	}
+	statusCodes := cfg.StatusCodes
+	if len(statusCodes) == 0 {
+		statusCodes = defaultRetryStatusCodes
+	}
+
+	delay := baseDelay
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	ctx := req.Context()
+	for attempt := 1; ; attempt++ {
+		resp, err := c.doAttempt(req)
+		if err != nil && ctx.Err() != nil {
+			// The request was canceled or its deadline expired
+			return nil, attempt, err
+		}
+		if attempt == maxAttempts {
+			return resp, attempt, err
+		}
+		wait := delay
+		if err != nil {
+			if !isRetryableError(err) {
+				return nil, attempt, err
+			}
+			log.Debugf("Attempt %d of %d of %s %s failed; retrying in %s: %s", attempt, maxAttempts, req.Method, req.URL, wait, err)
+		} else {
+			if !containsInt(statusCodes, resp.StatusCode) {
+				return resp, attempt, nil
+			}
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				wait = retryAfter
+			}
+			if wait > maxDelay {
+				wait = maxDelay
+			}
+			log.Debugf("Attempt %d of %d of %s %s failed with status code %d; retrying in %s", attempt, maxAttempts, req.Method, req.URL, resp.StatusCode, wait)
+			drainBody(resp.Body)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, attempt, ctx.Err()
+		}
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, attempt, errors.Wrap(err, "Failed to get the body of the request to retry it")
+			}
+			req.Body = body
+		}
+	}
+}
+
+// doAttempt sends 'req' once, with the configured timeout of an attempt. A
+// failure to send the request through the proxy is returned as a ProxyError.
+func (c *Client) doAttempt(req *http.Request) (*http.Response, error) {
+	resp, err := c.doWithTimeout(req)
+	if err != nil {
+		if pe := c.proxyDialError(req, err); pe != nil {
+			return nil, errors.WithStack(pe)
+		}
+		return nil, err
+	}
+	if pe := c.proxyResponseError(req, resp); pe != nil {
+		drainBody(resp.Body)
+		return nil, errors.WithStack(pe)
+	}
+	return resp, nil
+}
+
+// doWithTimeout sends 'req' with the configured timeout of an attempt
+func (c *Client) doWithTimeout(req *http.Request) (*http.Response, error) {
+	timeout := c.Config.Timeout.Request
+	if timeout <= 0 {
+		return c.httpClient.Do(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		if ctx.Err() == context.DeadlineExceeded && req.Context().Err() == nil {
+			return nil, errors.WithStack(&TimeoutError{Duration: timeout})
+		}
+		return nil, err
+	}
+	resp.Body = &timeoutBody{ReadCloser: resp.Body, ctx: ctx, parent: req.Context(), cancel: cancel, timeout: timeout}
+	return resp, nil
+}
+
+// isRetryableError returns true if 'err', returned by an HTTP client, is a
+// network error which may not recur, such as a refused or reset connection
+func isRetryableError(err error) bool {
+	if tls.DescribeVerificationError(err) != "" {
+		return false
+	}
+	cause := errors.Cause(err)
+	if _, ok := cause.(*TimeoutError); ok {
+		return true
+	}
+	if ue, ok := cause.(*url.Error); ok {
+		cause = ue.Err
+	}
+	if cause == io.EOF || cause == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := cause.(net.Error)
+	return ok
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either
+// a number of seconds or an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+func containsInt(list []int, i int) bool {
+	for _, v := range list {
+		if v == i {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,227 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyServer is a test server which responds with 503 and the Retry-After
+// header until its Nth request, which succeeds
+type flakyServer struct {
+	*httptest.Server
+	mutex      sync.Mutex
+	succeedOn  int
+	retryAfter string
+	requests   []*http.Request
+}
+
+func newFlakyServer(succeedOn int, retryAfter string) *flakyServer {
+	fs := &flakyServer{succeedOn: succeedOn, retryAfter: retryAfter}
+	fs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fs.mutex.Lock()
+		fs.requests = append(fs.requests, r)
+		n := len(fs.requests)
+		fs.mutex.Unlock()
+		ioutil.ReadAll(r.Body)
+		if n < fs.succeedOn {
+			if fs.retryAfter != "" {
+				w.Header().Set("Retry-After", fs.retryAfter)
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"success":false,"result":null,"errors":[{"code":503,"message":"The server is busy; retry later"}],"messages":[]}`))
+			return
+		}
+		w.Write([]byte(`{"success":true,"result":{"attempt":"ok"},"errors":[],"messages":[]}`))
+	}))
+	return fs
+}
+
+func (fs *flakyServer) attempts() int {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return len(fs.requests)
+}
+
+func newRetryClient(t *testing.T, url string, retry RetryConfig) (*Client, func()) {
+	homeDir, err := ioutil.TempDir("", "retryclient")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	client := &Client{HomeDir: homeDir, Config: &ClientConfig{URL: url, Retry: retry}}
+	return client, func() { os.RemoveAll(homeDir) }
+}
+
+func TestClientRetrySucceedsOnNthAttempt(t *testing.T) {
+	fs := newFlakyServer(3, "0")
+	defer fs.Close()
+	client, cleanup := newRetryClient(t, fs.URL, RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond})
+	defer cleanup()
+
+	req, err := client.newGet("cainfo")
+	util.FatalError(t, err, "Failed to create request")
+	result := map[string]string{}
+	err = client.SendReq(req, &result)
+	assert.NoError(t, err, "The request should succeed on the third attempt")
+	assert.Equal(t, 3, fs.attempts())
+	assert.Equal(t, "ok", result["attempt"])
+
+	// A POST which only reads from the server is retried
+	fs.requests = nil
+	req, err = client.newPost("cainfo", []byte(`{"caname":""}`))
+	util.FatalError(t, err, "Failed to create request")
+	err = client.SendReq(markIdempotent(req), nil)
+	assert.NoError(t, err, "The idempotent POST should succeed on the third attempt")
+	assert.Equal(t, 3, fs.attempts())
+}
+
+func TestClientRetryExhausted(t *testing.T) {
+	fs := newFlakyServer(5, "")
+	defer fs.Close()
+	client, cleanup := newRetryClient(t, fs.URL, RetryConfig{MaxAttempts: 2, BaseDelay: time.Millisecond})
+	defer cleanup()
+
+	req, err := client.newGet("cainfo")
+	util.FatalError(t, err, "Failed to create request")
+	err = client.SendReq(req, nil)
+	if assert.Error(t, err, "The request should fail when the attempts are exhausted") {
+		assert.Contains(t, err.Error(), "The request failed after 2 attempts")
+		re, ok := errors.Cause(err).(*ResponseError)
+		if assert.True(t, ok, "The cause should be the server's response") {
+			assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+		}
+	}
+	assert.Equal(t, 2, fs.attempts())
+}
+
+func TestClientRetryNonIdempotent(t *testing.T) {
+	fs := newFlakyServer(2, "0")
+	defer fs.Close()
+	client, cleanup := newRetryClient(t, fs.URL, RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond})
+	defer cleanup()
+
+	// An enroll request is not retried by default
+	req, err := client.newPost("enroll", []byte("{}"))
+	util.FatalError(t, err, "Failed to create request")
+	err = client.SendReq(req, nil)
+	assert.Error(t, err, "A request which is not idempotent should not be retried")
+	assert.NotContains(t, err.Error(), "attempts")
+	assert.Equal(t, 1, fs.attempts())
+
+	// An enroll request with an idempotency key is retried with the same key
+	fs.requests = nil
+	client.Config.Retry.IdempotencyKeys = true
+	req, err = client.newPost("enroll", []byte("{}"))
+	util.FatalError(t, err, "Failed to create request")
+	err = client.SendReq(req, nil)
+	assert.NoError(t, err, "A request with an idempotency key should be retried")
+	if assert.Equal(t, 2, fs.attempts()) {
+		key := fs.requests[0].Header.Get(IdempotencyKeyHeader)
+		assert.NotEmpty(t, key, "The request should have an idempotency key")
+		assert.Equal(t, key, fs.requests[1].Header.Get(IdempotencyKeyHeader), "The retry should have the same idempotency key")
+	}
+
+	// Idempotency keys are only sent to the endpoints which support them
+	req, err = client.newPost("gencrl", []byte("{}"))
+	util.FatalError(t, err, "Failed to create request")
+	assert.Empty(t, req.Header.Get(IdempotencyKeyHeader))
+
+	// Register and revoke requests have one whenever retries are enabled
+	client.Config.Retry.IdempotencyKeys = false
+	for _, endpoint := range []string{"register", "revoke"} {
+		req, err = client.newPost(endpoint, []byte("{}"))
+		util.FatalError(t, err, "Failed to create request")
+		assert.NotEmpty(t, req.Header.Get(IdempotencyKeyHeader), "A %s request should have an idempotency key", endpoint)
+	}
+	client.Config.Retry.MaxAttempts = 1
+	req, err = client.newPost("register", []byte("{}"))
+	util.FatalError(t, err, "Failed to create request")
+	assert.Empty(t, req.Header.Get(IdempotencyKeyHeader), "Without retries, a request should not have an idempotency key")
+}
+
+func TestClientRetryAfter(t *testing.T) {
+	fs := newFlakyServer(2, "1")
+	defer fs.Close()
+	client, cleanup := newRetryClient(t, fs.URL, RetryConfig{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Second})
+	defer cleanup()
+
+	req, err := client.newGet("cainfo")
+	util.FatalError(t, err, "Failed to create request")
+	start := time.Now()
+	err = client.SendReq(req, nil)
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) >= time.Second, "The client should wait as requested by the Retry-After header")
+
+	// The delay requested by the server is capped by the maximum delay
+	fs = newFlakyServer(2, "60")
+	defer fs.Close()
+	client.Config.URL = fs.URL
+	client.Config.Retry.MaxDelay = 10 * time.Millisecond
+	req, err = client.newGet("cainfo")
+	util.FatalError(t, err, "Failed to create request")
+	start = time.Now()
+	err = client.SendReq(req, nil)
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second, "The delay should be capped by the maximum delay")
+
+	d, ok := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	assert.True(t, ok, "An HTTP date should be accepted")
+	assert.True(t, d > 59*time.Minute && d <= time.Hour)
+	_, ok = parseRetryAfter("soon")
+	assert.False(t, ok, "An invalid value should be ignored")
+}
+
+func TestClientRetryNetworkError(t *testing.T) {
+	// The connection is closed without a response on the first attempt
+	var mutex sync.Mutex
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		attempts++
+		n := attempts
+		mutex.Unlock()
+		if n == 1 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		w.Write([]byte(`{"success":true,"result":null,"errors":[],"messages":[]}`))
+	}))
+	defer srv.Close()
+	client, cleanup := newRetryClient(t, srv.URL, RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond})
+	defer cleanup()
+	err := client.Init()
+	util.FatalError(t, err, "Failed to initialize client")
+	client.httpTransport().DisableKeepAlives = true
+
+	req, err := client.newGet("cainfo")
+	util.FatalError(t, err, "Failed to create request")
+	err = client.SendReq(req, nil)
+	assert.NoError(t, err, "The request should be retried after the connection was closed")
+	assert.Equal(t, 2, attempts)
+
+	// A refused connection is retried until the attempts are exhausted
+	url := srv.URL
+	srv.Close()
+	client.Config.URL = url
+	req, err = client.newGet("cainfo")
+	util.FatalError(t, err, "Failed to create request")
+	err = client.SendReq(req, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "The request failed after 3 attempts")
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TimeoutConfig is the configuration of the timeouts of the client's requests
+type TimeoutConfig struct {
+	Request  time.Duration `help:"Maximum time to wait for the server to respond to each attempt of a request; 0 means no timeout"`
+	Deadline time.Duration `help:"Maximum time for a request to complete, including its retries; 0 means no deadline"`
+}
+
+// TimeoutError is the error returned when a request to the server does not
+// complete in time
+type TimeoutError struct {
+	// Duration is the timeout which expired
+	Duration time.Duration
+	// Deadline is true if the deadline of the request expired, rather than
+	// the timeout of one of its attempts
+	Deadline bool
+}
+
+func (te *TimeoutError) Error() string {
+	if te.Deadline {
+		if te.Duration == 0 {
+			return "The request did not complete before the deadline of its context"
+		}
+		return fmt.Sprintf("The request did not complete within its deadline of %s", te.Duration)
+	}
+	return fmt.Sprintf("The server did not respond within the request timeout of %s", te.Duration)
+}
+
+// Timeout returns true, so that a TimeoutError can be recognized as a
+// timeout in the same way as a net.Error
+func (te *TimeoutError) Timeout() bool {
+	return true
+}
+
+// requestContext returns the context of the requests of the client
+func (c *Client) requestContext() context.Context {
+	if c.Context != nil {
+		return c.Context
+	}
+	return context.Background()
+}
+
+// WithContext returns a copy of the client whose requests are sent with
+// 'ctx'. The copy shares the BCCSP and the HTTP client of the client, which
+// is initialized first, so that the requests of the client can each be sent
+// with their own context concurrently.
+func (c *Client) WithContext(ctx context.Context) (*Client, error) {
+	err := c.Init()
+	if err != nil {
+		return nil, err
+	}
+	cc := *c
+	cc.Context = ctx
+	return &cc, nil
+}
+
+// withDeadline returns 'ctx' with the configured deadline of a request, if
+// any, and the function which releases its resources
+func (c *Client) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.Config.Timeout.Deadline > 0 {
+		return context.WithTimeout(ctx, c.Config.Timeout.Deadline)
+	}
+	return context.WithCancel(ctx)
+}
+
+// contextError returns the error of a request whose context 'ctx', which
+// has the configured deadline, is done, or 'err' if it is not done
+func (c *Client) contextError(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return errors.WithStack(&TimeoutError{Duration: c.Config.Timeout.Deadline, Deadline: true})
+	case context.Canceled:
+		return errors.Wrap(context.Canceled, "The request was canceled")
+	}
+	return err
+}
+
+// timeoutBody is the body of a response to an attempt with a timeout, which
+// also applies to reading the body. Closing the body releases the resources
+// of the context of the attempt.
+type timeoutBody struct {
+	io.ReadCloser
+	// The context of the attempt and of the request
+	ctx, parent context.Context
+	cancel      context.CancelFunc
+	timeout     time.Duration
+}
+
+func (tb *timeoutBody) Read(p []byte) (int, error) {
+	n, err := tb.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && tb.ctx.Err() == context.DeadlineExceeded && tb.parent.Err() == nil {
+		err = &TimeoutError{Duration: tb.timeout}
+	}
+	return n, err
+}
+
+func (tb *timeoutBody) Close() error {
+	err := tb.ReadCloser.Close()
+	tb.cancel()
+	return err
+}
@@ -0,0 +1,139 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// newStallingServer returns a test server which does not respond to a
+// request until 'stall' has elapsed or the test server is closed, and the
+// function which returns the number of requests it received
+func newStallingServer(stall time.Duration) (*httptest.Server, chan struct{}, func() int) {
+	var mutex sync.Mutex
+	requests := 0
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests++
+		mutex.Unlock()
+		select {
+		case <-time.After(stall):
+		case <-done:
+		case <-r.Context().Done():
+		}
+		w.Write([]byte(`{"success":true,"result":null,"errors":[],"messages":[]}`))
+	}))
+	return srv, done, func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return requests
+	}
+}
+
+func TestClientRequestTimeout(t *testing.T) {
+	srv, done, requests := newStallingServer(time.Minute)
+	defer srv.Close()
+	defer close(done)
+	client, cleanup := newRetryClient(t, srv.URL, RetryConfig{})
+	defer cleanup()
+	client.Config.Timeout.Request = 200 * time.Millisecond
+
+	req, err := client.newGet("cainfo")
+	util.FatalError(t, err, "Failed to create request")
+	start := time.Now()
+	err = client.SendReq(req, nil)
+	elapsed := time.Since(start)
+	if assert.Error(t, err, "The request should time out") {
+		te, ok := errors.Cause(err).(*TimeoutError)
+		if assert.True(t, ok, "The cause should be a TimeoutError, not %T: %s", errors.Cause(err), err) {
+			assert.False(t, te.Deadline)
+			assert.Equal(t, 200*time.Millisecond, te.Duration)
+		}
+		assert.Contains(t, err.Error(), "request timeout of 200ms")
+	}
+	assert.True(t, elapsed >= 200*time.Millisecond, "The request timed out too early, after %s", elapsed)
+	assert.True(t, elapsed < 5*time.Second, "The request timed out too late, after %s", elapsed)
+	assert.Equal(t, 1, requests())
+
+	// An attempt which times out is retried
+	client.Config.Retry = RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond}
+	req, err = client.newGet("cainfo")
+	util.FatalError(t, err, "Failed to create request")
+	err = client.SendReq(req, nil)
+	if assert.Error(t, err, "The request should time out") {
+		assert.Contains(t, err.Error(), "The request failed after 3 attempts")
+		_, ok := errors.Cause(err).(*TimeoutError)
+		assert.True(t, ok, "The cause should be a TimeoutError")
+	}
+	assert.Equal(t, 4, requests())
+}
+
+func TestClientRequestDeadline(t *testing.T) {
+	srv, done, requests := newStallingServer(time.Minute)
+	defer srv.Close()
+	defer close(done)
+	client, cleanup := newRetryClient(t, srv.URL, RetryConfig{MaxAttempts: 10, BaseDelay: time.Millisecond})
+	defer cleanup()
+	client.Config.Timeout = TimeoutConfig{Request: 200 * time.Millisecond, Deadline: 500 * time.Millisecond}
+
+	req, err := client.newGet("cainfo")
+	util.FatalError(t, err, "Failed to create request")
+	start := time.Now()
+	err = client.SendReq(req, nil)
+	elapsed := time.Since(start)
+	if assert.Error(t, err, "The request should not complete within its deadline") {
+		te, ok := errors.Cause(err).(*TimeoutError)
+		if assert.True(t, ok, "The cause should be a TimeoutError, not %T: %s", errors.Cause(err), err) {
+			assert.True(t, te.Deadline)
+			assert.Equal(t, 500*time.Millisecond, te.Duration)
+		}
+	}
+	assert.True(t, elapsed >= 500*time.Millisecond, "The deadline expired too early, after %s", elapsed)
+	assert.True(t, elapsed < 5*time.Second, "The deadline expired too late, after %s", elapsed)
+	assert.True(t, requests() < 10, "The retries should stop at the deadline")
+
+	// A server which responds within the timeout is not affected
+	fast, fastDone, _ := newStallingServer(0)
+	defer fast.Close()
+	defer close(fastDone)
+	client.Config.URL = fast.URL
+	req, err = client.newGet("cainfo")
+	util.FatalError(t, err, "Failed to create request")
+	err = client.SendReq(req, nil)
+	assert.NoError(t, err, "A request which completes in time should succeed")
+}
+
+func TestClientRequestCanceled(t *testing.T) {
+	srv, done, _ := newStallingServer(time.Minute)
+	defer srv.Close()
+	defer close(done)
+	client, cleanup := newRetryClient(t, srv.URL, RetryConfig{})
+	defer cleanup()
+	ctx, cancel := context.WithCancel(context.Background())
+	client.Context = ctx
+
+	req, err := client.newGet("cainfo")
+	util.FatalError(t, err, "Failed to create request")
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start := time.Now()
+	err = client.SendReq(req, nil)
+	if assert.Error(t, err, "The request should be canceled") {
+		assert.Equal(t, context.Canceled, errors.Cause(err))
+		assert.Contains(t, err.Error(), "The request was canceled")
+	}
+	assert.True(t, time.Since(start) < 5*time.Second, "The request should stop when it is canceled")
+}
@@ -0,0 +1,112 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+)
+
+// traceTransport logs the HTTP exchanges of a client at debug level, with
+// the authorization headers and secrets redacted and the bodies truncated,
+// and writes them in full to the trace file, if any
+type traceTransport struct {
+	base http.RoundTripper
+	// traceFile is the file to which the full exchanges are appended
+	traceFile string
+}
+
+// newTraceTransport returns 'base', wrapped so that the exchanges are logged
+// if debug logging is enabled or written to 'traceFile' if it is set
+func newTraceTransport(base http.RoundTripper, traceFile string) http.RoundTripper {
+	if log.Level > log.LevelDebug && traceFile == "" {
+		return base
+	}
+	return &traceTransport{base: base, traceFile: traceFile}
+}
+
+// RoundTrip sends 'req' with the base transport and logs the exchange
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A round tripper must not modify the request, so a copy of it is sent
+	// with the body which was read
+	out := new(http.Request)
+	*out = *req
+	reqBody, err := readRequestBody(out)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := t.base.RoundTrip(out)
+	elapsed := time.Since(start)
+	var respBody []byte
+	if err == nil {
+		respBody, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read the response body")
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+	}
+	url := util.GetMaskedURL(req.URL.String())
+	if log.Level <= log.LevelDebug {
+		log.Debugf("HTTP request: %s %s\n%s%s", req.Method, url,
+			util.RedactHeader(req.Header), util.RedactBody(reqBody, util.BodyLogLimit()))
+		if err != nil {
+			log.Debugf("HTTP request %s %s failed after %s: %s", req.Method, url, elapsed, err)
+		} else {
+			log.Debugf("HTTP response: %s to %s %s in %s\n%s%s", resp.Status, req.Method, url, elapsed,
+				util.RedactHeader(resp.Header), util.RedactBody(respBody, util.BodyLogLimit()))
+		}
+	}
+	if t.traceFile != "" {
+		t.trace(start, elapsed, req, reqBody, resp, respBody, err)
+	}
+	return resp, err
+}
+
+// trace appends the full exchange to the trace file; failing to write it
+// does not fail the request
+func (t *traceTransport) trace(start time.Time, elapsed time.Duration, req *http.Request, reqBody []byte,
+	resp *http.Response, respBody []byte, err error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "=== %s %s %s (%s)\n", start.UTC().Format(time.RFC3339Nano), req.Method, req.URL, elapsed)
+	writeHeader(&buf, req.Header)
+	fmt.Fprintf(&buf, "\n%s\n", reqBody)
+	if err != nil {
+		fmt.Fprintf(&buf, "--- error: %s\n", err)
+	} else {
+		fmt.Fprintf(&buf, "--- %s %s\n", resp.Proto, resp.Status)
+		writeHeader(&buf, resp.Header)
+		fmt.Fprintf(&buf, "\n%s\n", respBody)
+	}
+	f, ferr := os.OpenFile(t.traceFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if ferr == nil {
+		_, ferr = f.Write(buf.Bytes())
+		if cerr := f.Close(); ferr == nil {
+			ferr = cerr
+		}
+	}
+	if ferr != nil {
+		log.Warningf("Failed to write the HTTP exchange to the trace file %s: %s", t.traceFile, ferr)
+	}
+}
+
+// writeHeader writes the header 'h' to 'buf' without redacting it
+func writeHeader(buf *bytes.Buffer, h http.Header) {
+	for name, values := range h {
+		fmt.Fprintf(buf, "%s: %s\n", name, strings.Join(values, ", "))
+	}
+}
@@ -23,6 +23,12 @@ type CAInfoResponseNet struct {
 	IssuerRevocationPublicKey string
 	// Version of the server
 	Version string
+	// Versions of the REST API served by the server, oldest first
+	APIVersions []string `json:",omitempty"`
+	// SPIFFE trust domain of the X.509-SVIDs issued by the CA, if any
+	SPIFFETrustDomain string `json:",omitempty"`
+	// Name of the signing profile of the X.509-SVIDs
+	SPIFFEProfile string `json:",omitempty"`
 }
 
 // EnrollmentResponseNet is the response to the /enroll request
@@ -46,3 +52,33 @@ type IdemixEnrollmentResponseNet struct {
 	// The CA information
 	CAInfo CAInfoResponseNet
 }
+
+// EnrollmentResponseNetV2 is the response to the v2 /enroll request, whose
+// certificates are PEM-encoded rather than base64 encoded, and which has the
+// fields of the enrollment certificate which its holder usually needs
+type EnrollmentResponseNetV2 struct {
+	// PEM-encoded enrollment certificate
+	Certificate string `json:"certificate"`
+	// Serial number of the certificate, in lower case hex
+	SerialNumber string `json:"serialnumber"`
+	// Validity period of the certificate, in RFC 3339 format
+	NotBefore string `json:"notbefore"`
+	NotAfter  string `json:"notafter"`
+	// The CA information
+	CA CAInfoResponseNetV2 `json:"ca"`
+}
+
+// CAInfoResponseNetV2 is the CA information of the v2 responses
+type CAInfoResponseNetV2 struct {
+	// Name of the CA
+	Name string `json:"name"`
+	// PEM-encoded certificates of the CA chain, starting with the root CA
+	// certificate
+	Chain []string `json:"chain"`
+	// Base64 encoding of Idemix issuer public key
+	IssuerPublicKey string `json:"issuerpublickey,omitempty"`
+	// Base64 encoding of PEM-encoded Idemix issuer revocation public key
+	IssuerRevocationPublicKey string `json:"issuerrevocationpublickey,omitempty"`
+	// Version of the server
+	Version string `json:"version"`
+}
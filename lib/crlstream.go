@@ -0,0 +1,472 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cfssl/certdb"
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+)
+
+// The DER tags of the ASN.1 types of a CRL
+const (
+	derTagSequence  = 0x30
+	derTagBitString = 0x03
+)
+
+// The PEM block header and footer of a CRL
+const (
+	crlPEMHeader = "-----BEGIN " + crlPemType + "-----\n"
+	crlPEMFooter = "-----END " + crlPemType + "-----\n"
+	// The length of the base64 lines of a PEM block
+	pemLineLength = 64
+)
+
+// crlFlushSize is the number of bytes of a streamed CRL after which the
+// response is flushed
+const crlFlushSize = 256 << 10
+
+// The object identifiers of the signature algorithms of CRLs and of the
+// authority key identifier extension
+var (
+	oidSignatureSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSignatureECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidSignatureECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidSignatureECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	oidExtensionAuthorityKeyID  = asn1.ObjectIdentifier{2, 5, 29, 35}
+)
+
+// crlStream is a signed CRL whose revoked certificate entries are kept in a
+// temporary file rather than in memory, so that the CRL of any number of
+// revoked certificates is generated and written with bounded memory. It is
+// the DER encoding of an X.509 v2 CRL, as crypto/x509 creates it.
+type crlStream struct {
+	// The DER encoding of the CRL up to its entries
+	head []byte
+	// The file of the DER-encoded entries
+	entries *os.File
+	// The DER encoding of the CRL after its entries
+	tail []byte
+	// The size of the DER encoding of the CRL
+	size int64
+	// The number of entries
+	count int
+	// The time at which the CRL was generated
+	thisUpdate time.Time
+	// The digest of the issuer's certificate and of the entries, which
+	// identifies the revoked certificates which the CRL lists
+	digest []byte
+}
+
+// newCRLStream generates the CRL, signed by 'signer' with the certificate
+// 'caCert', of the revoked certificates of the cursor 'rows', which is read
+// once. If 'aki' is not empty, only the certificates with this authority key
+// identifier are listed.
+func newCRLStream(rows crlRows, caCert *x509.Certificate, signer crypto.Signer, aki string, expiry time.Duration) (_ *crlStream, err error) {
+	sigAlg, hash, err := crlSignatureAlgorithm(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile("", "crl")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create the temporary file of the CRL entries")
+	}
+	c := &crlStream{entries: f, thisUpdate: time.Now().UTC()}
+	defer func() {
+		if err != nil {
+			c.Close()
+		}
+	}()
+
+	// The entries are written to the file, and their length counted, so
+	// that the length of the sequence which holds them is known before it
+	// is written
+	var entriesLen int64
+	bw := bufio.NewWriter(f)
+	digest := sha256.New()
+	digest.Write(caCert.Raw)
+	for rows.Next() {
+		var rec certdb.CertificateRecord
+		err = rows.StructScan(&rec)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read revoked certificate")
+		}
+		// Once the CA has been rekeyed, each CRL lists only the certificates
+		// issued under the key which signs it
+		if aki != "" && !strings.EqualFold(rec.AKI, aki) {
+			continue
+		}
+		entry, err := crlEntry(&rec)
+		if err != nil {
+			return nil, err
+		}
+		_, err = bw.Write(entry)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to write CRL entry")
+		}
+		digest.Write(entry)
+		entriesLen += int64(len(entry))
+		c.count++
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read revoked certificates")
+	}
+	err = bw.Flush()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to write CRL entries")
+	}
+	c.digest = digest.Sum(nil)
+
+	// The fields of the TBSCertList before and after its entries
+	fields, err := crlFields(caCert, sigAlg, c.thisUpdate, c.thisUpdate.Add(expiry))
+	if err != nil {
+		return nil, err
+	}
+	var entriesHeader []byte
+	if c.count > 0 {
+		entriesHeader = derHeader(derTagSequence, entriesLen)
+	}
+	extensions, err := crlExtensions(caCert)
+	if err != nil {
+		return nil, err
+	}
+	tbsLen := int64(len(fields)+len(entriesHeader)) + entriesLen + int64(len(extensions))
+	tbsHeader := derHeader(derTagSequence, tbsLen)
+
+	// The TBSCertList is signed as it is read back from the file
+	h := hash.New()
+	h.Write(tbsHeader)
+	h.Write(fields)
+	h.Write(entriesHeader)
+	_, err = f.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = io.Copy(h, f)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read CRL entries")
+	}
+	h.Write(extensions)
+	signature, err := signer.Sign(rand.Reader, h.Sum(nil), hash)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to sign CRL")
+	}
+	sigAlgDER, err := asn1.Marshal(sigAlg)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to marshal CRL signature algorithm")
+	}
+	sigDER, err := asn1.Marshal(asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to marshal CRL signature")
+	}
+	if sigDER[0] != derTagBitString {
+		return nil, errors.New("Failed to marshal CRL signature")
+	}
+
+	crlLen := int64(len(tbsHeader)) + tbsLen + int64(len(sigAlgDER)+len(sigDER))
+	c.head = concatBytes(derHeader(derTagSequence, crlLen), tbsHeader, fields, entriesHeader)
+	c.tail = concatBytes(extensions, sigAlgDER, sigDER)
+	c.size = int64(len(c.head)) + entriesLen + int64(len(c.tail))
+	return c, nil
+}
+
+// crlRows is a cursor over revoked certificate records
+type crlRows interface {
+	Next() bool
+	StructScan(dest interface{}) error
+	Err() error
+}
+
+// crlEntry returns the DER encoding of the CRL entry of the revoked
+// certificate 'rec'
+func crlEntry(rec *certdb.CertificateRecord) ([]byte, error) {
+	serial := new(big.Int)
+	_, ok := serial.SetString(rec.Serial, 16)
+	if !ok {
+		return nil, errors.Errorf("Invalid serial number '%s' of revoked certificate", rec.Serial)
+	}
+	entry := pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: rec.RevokedAt.UTC()}
+	// RFC 5280 recommends leaving out the reason code if it is unspecified
+	if rec.Reason != util.RevocationReasonCodes["unspecified"] {
+		ext, err := util.CRLReasonCodeExtension(rec.Reason)
+		if err != nil {
+			return nil, err
+		}
+		entry.Extensions = []pkix.Extension{ext}
+	}
+	der, err := asn1.Marshal(entry)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to marshal CRL entry of certificate '%s'", rec.Serial)
+	}
+	return der, nil
+}
+
+// crlFields returns the DER encoding of the fields of a TBSCertList which
+// precede its entries: the version, the signature algorithm, the issuer and
+// the update times
+func crlFields(caCert *x509.Certificate, sigAlg pkix.AlgorithmIdentifier, thisUpdate, nextUpdate time.Time) ([]byte, error) {
+	var fields []byte
+	for _, field := range []interface{}{
+		1, // v2
+		sigAlg,
+		asn1.RawValue{FullBytes: caCert.RawSubject},
+		thisUpdate,
+		nextUpdate.UTC(),
+	} {
+		der, err := asn1.Marshal(field)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to marshal CRL field")
+		}
+		fields = append(fields, der...)
+	}
+	return fields, nil
+}
+
+// crlExtensions returns the DER encoding of the extensions of a CRL signed
+// with the certificate 'caCert', which is empty if there are none
+func crlExtensions(caCert *x509.Certificate) ([]byte, error) {
+	if len(caCert.SubjectKeyId) == 0 {
+		return nil, nil
+	}
+	aki, err := asn1.Marshal(struct {
+		ID []byte `asn1:"optional,tag:0"`
+	}{caCert.SubjectKeyId})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to marshal CRL authority key identifier")
+	}
+	der, err := asn1.MarshalWithParams([]pkix.Extension{{Id: oidExtensionAuthorityKeyID, Value: aki}}, "tag:0,explicit")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to marshal CRL extensions")
+	}
+	return der, nil
+}
+
+// crlSignatureAlgorithm returns the signature algorithm and hash function of
+// a CRL signed by the key whose public key is 'pub', which are those which
+// crypto/x509 selects
+func crlSignatureAlgorithm(pub crypto.PublicKey) (pkix.AlgorithmIdentifier, crypto.Hash, error) {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidSignatureSHA256WithRSA, Parameters: asn1.NullRawValue}, crypto.SHA256, nil
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return pkix.AlgorithmIdentifier{Algorithm: oidSignatureECDSAWithSHA256}, crypto.SHA256, nil
+		case elliptic.P384():
+			return pkix.AlgorithmIdentifier{Algorithm: oidSignatureECDSAWithSHA384}, crypto.SHA384, nil
+		case elliptic.P521():
+			return pkix.AlgorithmIdentifier{Algorithm: oidSignatureECDSAWithSHA512}, crypto.SHA512, nil
+		}
+	}
+	return pkix.AlgorithmIdentifier{}, 0, errors.Errorf("Unsupported CRL signing key of type %T", pub)
+}
+
+// derHeader returns the DER tag and length octets of a value with the tag
+// 'tag' and 'length' bytes of content
+func derHeader(tag byte, length int64) []byte {
+	if length < 0x80 {
+		return []byte{tag, byte(length)}
+	}
+	var octets []byte
+	for l := length; l > 0; l >>= 8 {
+		octets = append([]byte{byte(l)}, octets...)
+	}
+	return append([]byte{tag, 0x80 | byte(len(octets))}, octets...)
+}
+
+// concatBytes returns the concatenation of 'parts'
+func concatBytes(parts ...[]byte) []byte {
+	var b []byte
+	for _, part := range parts {
+		b = append(b, part...)
+	}
+	return b
+}
+
+// Size returns the size of the DER encoding of the CRL
+func (c *crlStream) Size() int64 {
+	return c.size
+}
+
+// PEMSize returns the size of the PEM encoding of the CRL
+func (c *crlStream) PEMSize() int64 {
+	b64 := (c.size + 2) / 3 * 4
+	lines := (b64 + pemLineLength - 1) / pemLineLength
+	return int64(len(crlPEMHeader)) + b64 + lines + int64(len(crlPEMFooter))
+}
+
+// WriteDER writes the DER encoding of the CRL to 'w'
+func (c *crlStream) WriteDER(w io.Writer) error {
+	_, err := w.Write(c.head)
+	if err != nil {
+		return err
+	}
+	_, err = c.entries.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.Wrap(err, "Failed to read CRL entries")
+	}
+	_, err = io.Copy(w, c.entries)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(c.tail)
+	return err
+}
+
+// WritePEM writes the PEM encoding of the CRL to 'w'
+func (c *crlStream) WritePEM(w io.Writer) error {
+	_, err := io.WriteString(w, crlPEMHeader)
+	if err != nil {
+		return err
+	}
+	lw := &lineWriter{w: w, lineLength: pemLineLength}
+	enc := base64.NewEncoder(base64.StdEncoding, lw)
+	err = c.WriteDER(enc)
+	if err == nil {
+		err = enc.Close()
+	}
+	if err == nil {
+		err = lw.Close()
+	}
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, crlPEMFooter)
+	return err
+}
+
+// Publish writes the DER encoding of the CRL to the file 'file', which is
+// replaced atomically, with the time at which the CRL was generated as its
+// modification time
+func (c *crlStream) Publish(file string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "Failed to create the published CRL file")
+	}
+	defer os.Remove(tmp.Name())
+	bw := bufio.NewWriter(tmp)
+	err = c.WriteDER(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Chtimes(tmp.Name(), c.thisUpdate, c.thisUpdate)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Failed to publish the CRL to %s", file)
+	}
+	log.Debugf("Published the CRL of %d revoked certificates to %s", c.count, file)
+	return nil
+}
+
+// ETag returns the weak ETag of the CRL in the media type 'mediaType'. The
+// CRLs of a CA which list the same revoked certificates have the same ETag,
+// whenever they are generated.
+func (c *crlStream) ETag(mediaType string) string {
+	return "W/" + strongETag([]byte(mediaType), c.digest)
+}
+
+// Close removes the temporary file of the entries of the CRL
+func (c *crlStream) Close() error {
+	c.entries.Close()
+	return os.Remove(c.entries.Name())
+}
+
+// lineWriter writes what is written to it to 'w' in lines of 'lineLength'
+// bytes, the last of which is terminated by Close
+type lineWriter struct {
+	w          io.Writer
+	lineLength int
+	// The number of bytes of the current line
+	n int
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if rest := lw.lineLength - lw.n; len(chunk) > rest {
+			chunk = chunk[:rest]
+		}
+		n, err := lw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		lw.n += n
+		p = p[n:]
+		if lw.n == lw.lineLength {
+			_, err = lw.w.Write([]byte{'\n'})
+			if err != nil {
+				return written, err
+			}
+			lw.n = 0
+		}
+	}
+	return written, nil
+}
+
+// Close terminates the last line, if it is not empty
+func (lw *lineWriter) Close() error {
+	if lw.n == 0 {
+		return nil
+	}
+	lw.n = 0
+	_, err := lw.w.Write([]byte{'\n'})
+	return err
+}
+
+// flushWriter flushes the response 'w' each time 'size' more bytes have been
+// written to it, so that a large response is sent as it is written
+type flushWriter struct {
+	w    http.ResponseWriter
+	size int
+	// The number of bytes written since the last flush
+	n int
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.n += n
+	if fw.n >= fw.size {
+		if f, ok := fw.w.(http.Flusher); ok {
+			f.Flush()
+		}
+		fw.n = 0
+	}
+	return n, err
+}
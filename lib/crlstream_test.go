@@ -0,0 +1,214 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cfssl/certdb"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// syntheticRevokedRows is a cursor over 'n' synthetic revoked certificate
+// records, which are generated as they are read rather than held in memory
+type syntheticRevokedRows struct {
+	n   int
+	i   int
+	aki string
+	// Called after each record is read
+	onRow func(i int)
+}
+
+func (r *syntheticRevokedRows) Next() bool {
+	r.i++
+	return r.i <= r.n
+}
+
+func (r *syntheticRevokedRows) StructScan(dest interface{}) error {
+	rec := dest.(*certdb.CertificateRecord)
+	rec.Serial = fmt.Sprintf("%x", 1<<40+r.i)
+	rec.AKI = r.aki
+	rec.Reason = r.i % 3
+	rec.RevokedAt = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(r.i) * time.Second)
+	if r.onRow != nil {
+		r.onRow(r.i)
+	}
+	return nil
+}
+
+func (r *syntheticRevokedRows) Err() error {
+	return nil
+}
+
+// heapSampler records the largest heap, after a garbage collection, above
+// the heap at its creation
+type heapSampler struct {
+	base uint64
+	max  uint64
+}
+
+func newHeapSampler() *heapSampler {
+	return &heapSampler{base: heapAlloc()}
+}
+
+func (h *heapSampler) sample() {
+	if alloc := heapAlloc(); alloc > h.base && alloc-h.base > h.max {
+		h.max = alloc - h.base
+	}
+}
+
+func heapAlloc() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// samplingWriter counts the bytes written to it, sampling the heap every
+// 'every' bytes, and keeps them only if 'keep' is true
+type samplingWriter struct {
+	heap  *heapSampler
+	every int64
+	n     int64
+	keep  bool
+	buf   bytes.Buffer
+}
+
+func (w *samplingWriter) Write(p []byte) (int, error) {
+	if w.n/w.every != (w.n+int64(len(p)))/w.every {
+		w.heap.sample()
+	}
+	w.n += int64(len(p))
+	if w.keep {
+		w.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+// newTestCRLSigner returns a CA certificate which may sign CRLs and its key
+func newTestCRLSigner(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	util.FatalError(t, err, "Failed to generate key")
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "crl-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SubjectKeyId:          []byte{1, 2, 3, 4},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	util.FatalError(t, err, "Failed to create certificate")
+	cert, err := x509.ParseCertificate(der)
+	util.FatalError(t, err, "Failed to parse certificate")
+	return cert, key
+}
+
+func TestCRLStream(t *testing.T) {
+	caCert, key := newTestCRLSigner(t)
+	aki := hex.EncodeToString(caCert.SubjectKeyId)
+	rows := &syntheticRevokedRows{n: 10, aki: aki}
+	crl, err := newCRLStream(rows, caCert, key, "", time.Hour)
+	util.FatalError(t, err, "Failed to generate CRL")
+	defer crl.Close()
+
+	var der bytes.Buffer
+	util.FatalError(t, crl.WriteDER(&der), "Failed to write DER CRL")
+	assert.Equal(t, crl.Size(), int64(der.Len()))
+	parsed, err := x509.ParseRevocationList(der.Bytes())
+	util.FatalError(t, err, "Failed to parse CRL")
+	assert.NoError(t, parsed.CheckSignatureFrom(caCert), "The signature of the CRL should verify")
+	assert.Equal(t, caCert.RawSubject, parsed.RawIssuer)
+	assert.Equal(t, caCert.SubjectKeyId, parsed.AuthorityKeyId)
+	assert.Equal(t, 10, len(parsed.RevokedCertificateEntries))
+	for i, entry := range parsed.RevokedCertificateEntries {
+		assert.Equal(t, big.NewInt(1<<40+int64(i+1)), entry.SerialNumber)
+		assert.Equal(t, (i+1)%3, entry.ReasonCode)
+	}
+	assert.WithinDuration(t, time.Now().Add(time.Hour), parsed.NextUpdate, time.Minute)
+
+	var pemCRL bytes.Buffer
+	util.FatalError(t, crl.WritePEM(&pemCRL), "Failed to write PEM CRL")
+	assert.Equal(t, crl.PEMSize(), int64(pemCRL.Len()))
+	block, rest := pem.Decode(pemCRL.Bytes())
+	if assert.NotNil(t, block) {
+		assert.Equal(t, crlPemType, block.Type)
+		assert.Equal(t, der.Bytes(), block.Bytes)
+		assert.Empty(t, rest)
+	}
+
+	// Once the CA has been rekeyed, only the certificates issued under the
+	// signing key are listed
+	rows = &syntheticRevokedRows{n: 10, aki: "abcd"}
+	other, err := newCRLStream(rows, caCert, key, aki, time.Hour)
+	util.FatalError(t, err, "Failed to generate CRL")
+	defer other.Close()
+	der.Reset()
+	util.FatalError(t, other.WriteDER(&der), "Failed to write DER CRL")
+	parsed, err = x509.ParseRevocationList(der.Bytes())
+	util.FatalError(t, err, "Failed to parse CRL")
+	assert.Empty(t, parsed.RevokedCertificateEntries)
+
+	// An empty CRL is valid
+	empty, err := newCRLStream(&syntheticRevokedRows{}, caCert, key, "", time.Hour)
+	util.FatalError(t, err, "Failed to generate empty CRL")
+	defer empty.Close()
+	der.Reset()
+	util.FatalError(t, empty.WriteDER(&der), "Failed to write DER CRL")
+	parsed, err = x509.ParseRevocationList(der.Bytes())
+	util.FatalError(t, err, "Failed to parse empty CRL")
+	assert.NoError(t, parsed.CheckSignatureFrom(caCert))
+}
+
+func TestCRLStreamBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping the generation of a large CRL in short mode")
+	}
+	const revoked = 500000
+	caCert, key := newTestCRLSigner(t)
+	heap := newHeapSampler()
+	rows := &syntheticRevokedRows{n: revoked, onRow: func(i int) {
+		if i%20000 == 0 {
+			heap.sample()
+		}
+	}}
+	crl, err := newCRLStream(rows, caCert, key, "", time.Hour)
+	util.FatalError(t, err, "Failed to generate CRL")
+	defer crl.Close()
+
+	// The CRL is several times larger than the memory used to generate and
+	// write it
+	w := &samplingWriter{heap: heap, every: 1 << 20}
+	util.FatalError(t, crl.WritePEM(w), "Failed to write PEM CRL")
+	assert.Equal(t, crl.PEMSize(), w.n)
+	t.Logf("Generated a CRL of %d revoked certificates, %d bytes in PEM, with at most %d bytes of heap", revoked, w.n, heap.max)
+	assert.True(t, crl.Size() > 16<<20, "The CRL should be large")
+	assert.True(t, heap.max < 4<<20, "Generating and writing a CRL of %d bytes used %d bytes of heap", crl.Size(), heap.max)
+
+	// What is written is the valid CRL
+	w = &samplingWriter{heap: heap, every: 1 << 20, keep: true}
+	util.FatalError(t, crl.WriteDER(w), "Failed to write DER CRL")
+	parsed, err := x509.ParseRevocationList(w.buf.Bytes())
+	util.FatalError(t, err, "Failed to parse CRL")
+	assert.Equal(t, revoked, len(parsed.RevokedCertificateEntries))
+	assert.NoError(t, parsed.CheckSignatureFrom(caCert))
+}
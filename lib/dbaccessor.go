@@ -7,6 +7,7 @@ SPDX-License-Identifier: Apache-2.0
 package lib
 
 import (
+	"database/sql"
 	"encoding/json"
 	"strings"
 
@@ -100,13 +101,16 @@ type AffiliationRecord struct {
 // Accessor implements db.Accessor interface.
 type Accessor struct {
 	db *dbutil.DB
+	// The prepared statements of the queries of 'db' which are made for
+	// each request
+	stmts *certDBStatements
 }
 
 // NewDBAccessor is a constructor for the database API
 func NewDBAccessor(db *dbutil.DB) *Accessor {
-	return &Accessor{
-		db: db,
-	}
+	accessor := new(Accessor)
+	accessor.SetDB(db)
+	return accessor
 }
 
 func (d *Accessor) checkDB() error {
@@ -118,7 +122,14 @@ func (d *Accessor) checkDB() error {
 
 // SetDB changes the underlying sql.DB object Accessor is manipulating.
 func (d *Accessor) SetDB(db *dbutil.DB) {
+	if d.stmts != nil {
+		d.stmts.close()
+		d.stmts = nil
+	}
 	d.db = db
+	if db != nil {
+		d.stmts = newCertDBStatements(db.DB)
+	}
 }
 
 // InsertUser inserts user into database
@@ -133,28 +144,16 @@ func (d *Accessor) InsertUser(user *spi.UserInfo) error {
 		return err
 	}
 
-	attrBytes, err := json.Marshal(user.Attributes)
+	rec, err := newUserRecord(user)
 	if err != nil {
 		return err
 	}
 
-	// Hash the password before storing it
-	pwd := []byte(user.Pass)
-	pwd, err = bcrypt.GenerateFromPassword(pwd, bcrypt.DefaultCost)
-	if err != nil {
-		return errors.Wrap(err, "Failed to hash password")
-	}
-
 	// Store the user record in the DB
-	res, err := d.db.NamedExec(insertUser, &UserRecord{
-		Name:           user.Name,
-		Pass:           pwd,
-		Type:           user.Type,
-		Affiliation:    user.Affiliation,
-		Attributes:     string(attrBytes),
-		State:          user.State,
-		MaxEnrollments: user.MaxEnrollments,
-		Level:          user.Level,
+	var res sql.Result
+	err = withDB(d.db, func() (err error) {
+		res, err = d.db.NamedExec(insertUser, rec)
+		return err
 	})
 
 	if err != nil {
@@ -180,6 +179,107 @@ func (d *Accessor) InsertUser(user *spi.UserInfo) error {
 
 }
 
+// newUserRecord returns the record of the identity 'user', whose password is
+// hashed
+func newUserRecord(user *spi.UserInfo) (*UserRecord, error) {
+	attrBytes, err := json.Marshal(user.Attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hash the password before storing it
+	pwd, err := bcrypt.GenerateFromPassword([]byte(user.Pass), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to hash password")
+	}
+
+	return &UserRecord{
+		Name:           user.Name,
+		Pass:           pwd,
+		Type:           user.Type,
+		Affiliation:    user.Affiliation,
+		Attributes:     string(attrBytes),
+		State:          user.State,
+		MaxEnrollments: user.MaxEnrollments,
+		Level:          user.Level,
+	}, nil
+}
+
+// register registers the identities of 'reg' in a single transaction, which
+// checks their affiliations and that they are not registered, hashes their
+// secrets and inserts them
+func (d *Accessor) register(reg *registration) ([]*spi.UserInfo, error) {
+	result, err := d.doTransaction(d.registerTx, reg)
+	if err != nil {
+		// An identity which was registered by a concurrent request fails
+		// the insertion rather than the check that it is not registered
+		if caerrors.AsHTTPErr(err) == nil && !reg.skipRegistered {
+			for _, user := range reg.users {
+				_, err2 := d.GetUser(user.Name, nil)
+				if err2 == nil {
+					return nil, identityExistsErr(user.Name)
+				}
+			}
+		}
+		return nil, err
+	}
+	return result.([]*spi.UserInfo), nil
+}
+
+func (d *Accessor) registerTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	reg := args[0].(*registration)
+	registered := []*spi.UserInfo{}
+	for _, user := range reg.users {
+		var count int
+		if reg.checkAffiliations && user.Affiliation != "" {
+			err := tx.Get(&count, tx.Rebind("SELECT COUNT(*) FROM affiliations WHERE (name = ?)"), user.Affiliation)
+			if err != nil {
+				return nil, getError(err, "Affiliation")
+			}
+			if count == 0 {
+				return nil, affiliationNotFoundErr(user.Affiliation)
+			}
+		}
+		err := reg.step(regStepAffiliation)
+		if err != nil {
+			return nil, err
+		}
+		err = tx.Get(&count, tx.Rebind("SELECT COUNT(*) FROM users WHERE (id = ?)"), user.Name)
+		if err != nil {
+			return nil, getError(err, "User")
+		}
+		if count > 0 {
+			if reg.skipRegistered {
+				log.Debugf("Identity '%s' already registered, loaded identity", user.Name)
+				continue
+			}
+			return nil, identityExistsErr(user.Name)
+		}
+		err = reg.step(regStepRegistered)
+		if err != nil {
+			return nil, err
+		}
+		rec, err := newUserRecord(user)
+		if err != nil {
+			return nil, err
+		}
+		err = reg.step(regStepSecret)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.NamedExec(insertUser, rec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error adding identity '%s' to the database", user.Name)
+		}
+		registered = append(registered, user)
+		err = reg.step(regStepInsert)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return registered, nil
+}
+
 // DeleteUser deletes user from database
 func (d *Accessor) DeleteUser(id string) (spi.User, error) {
 	log.Debugf("DB: Delete identity %s", id)
@@ -250,7 +350,7 @@ func (d *Accessor) UpdateUser(user *spi.UserInfo, updatePass bool) error {
 	}
 
 	// Store the updated user entry
-	res, err := d.db.NamedExec(updateUser, &UserRecord{
+	rec := &UserRecord{
 		Name:           user.Name,
 		Pass:           pwd,
 		Type:           user.Type,
@@ -259,6 +359,11 @@ func (d *Accessor) UpdateUser(user *spi.UserInfo, updatePass bool) error {
 		State:          user.State,
 		MaxEnrollments: user.MaxEnrollments,
 		Level:          user.Level,
+	}
+	var res sql.Result
+	err = withDB(d.db, func() (err error) {
+		res, err = d.db.NamedExec(updateUser, rec)
+		return err
 	})
 
 	if err != nil {
@@ -289,7 +394,11 @@ func (d *Accessor) GetUser(id string, attrs []string) (spi.User, error) {
 	}
 
 	var userRec UserRecord
-	err = d.db.Get(&userRec, d.db.Rebind(getUser), id)
+	err = withDB(d.db, func() error {
+		return d.stmts.run(getUser, func(stmt *sqlx.Stmt) error {
+			return stmt.Get(&userRec, id)
+		})
+	})
 	if err != nil {
 		return nil, getError(err, "User")
 	}
@@ -317,7 +426,10 @@ func (d *Accessor) InsertAffiliation(name string, prekey string, level int) erro
 			return nil
 		}
 	}
-	_, err = d.db.Exec(d.db.Rebind(insertAffiliation), name, prekey, level)
+	err = withDB(d.db, func() error {
+		_, err := d.db.Exec(d.db.Rebind(insertAffiliation), name, prekey, level)
+		return err
+	})
 	if err != nil {
 		if (!strings.Contains(err.Error(), "UNIQUE constraint failed") && dbType == "sqlite3") || (!strings.Contains(err.Error(), "duplicate key value") && dbType == "postgres") {
 			return err
@@ -459,7 +571,9 @@ func (d *Accessor) GetAffiliation(name string) (spi.Affiliation, error) {
 
 	var affiliationRecord AffiliationRecord
 
-	err = d.db.Get(&affiliationRecord, d.db.Rebind(getAffiliationQuery), name)
+	err = withDB(d.db, func() error {
+		return d.db.Get(&affiliationRecord, d.db.Rebind(getAffiliationQuery), name)
+	})
 	if err != nil {
 		return nil, getError(err, "Affiliation")
 	}
@@ -539,7 +653,9 @@ func (d *Accessor) GetProperties(names []string) (map[string]string, error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed to construct query '%s' for properties '%s'", query, names)
 	}
-	err = d.db.Select(&properties, d.db.Rebind(inQuery), args...)
+	err = withDB(d.db, func() error {
+		return d.db.Select(&properties, d.db.Rebind(inQuery), args...)
+	})
 	if err != nil {
 		return nil, getError(err, "Properties")
 	}
@@ -559,7 +675,7 @@ func (d *Accessor) GetUserLessThanLevel(level int) ([]spi.User, error) {
 		return []spi.User{}, nil
 	}
 
-	rows, err := d.db.Queryx(d.db.Rebind("SELECT * FROM users WHERE (level < ?) OR (level IS NULL)"), level)
+	rows, err := d.queryx(d.db.Rebind("SELECT * FROM users WHERE (level < ?) OR (level IS NULL)"), level)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to get identities that need to be updated")
 	}
@@ -585,14 +701,14 @@ func (d *Accessor) GetAllAffiliations(name string) (*sqlx.Rows, error) {
 	}
 
 	if name == "" { // Requesting all affiliations
-		rows, err := d.db.Queryx(d.db.Rebind("SELECT * FROM affiliations"))
+		rows, err := d.queryx(d.db.Rebind("SELECT * FROM affiliations"))
 		if err != nil {
 			return nil, err
 		}
 		return rows, nil
 	}
 
-	rows, err := d.db.Queryx(d.db.Rebind(getAllAffiliationsQuery), name, name+".%")
+	rows, err := d.queryx(d.db.Rebind(getAllAffiliationsQuery), name, name+".%")
 	if err != nil {
 		return nil, err
 	}
@@ -617,7 +733,7 @@ func (d *Accessor) GetFilteredUsers(affiliation, types string) (*sqlx.Rows, erro
 	if affiliation == "" {
 		if util.ListContains(types, "*") { // If type is '*', allowed to get back of all types
 			query := "SELECT * FROM users"
-			rows, err := d.db.Queryx(d.db.Rebind(query))
+			rows, err := d.queryx(d.db.Rebind(query))
 			if err != nil {
 				return nil, errors.Wrapf(err, "Failed to execute query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
 			}
@@ -629,7 +745,7 @@ func (d *Accessor) GetFilteredUsers(affiliation, types string) (*sqlx.Rows, erro
 		if err != nil {
 			return nil, errors.Wrapf(err, "Failed to construct query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
 		}
-		rows, err := d.db.Queryx(d.db.Rebind(query), args...)
+		rows, err := d.queryx(d.db.Rebind(query), args...)
 		if err != nil {
 			return nil, errors.Wrapf(err, "Failed to execute query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
 		}
@@ -639,7 +755,7 @@ func (d *Accessor) GetFilteredUsers(affiliation, types string) (*sqlx.Rows, erro
 	subAffiliation := affiliation + ".%"
 	if util.ListContains(types, "*") { // If type is '*', allowed to get back of all types for requested affiliation
 		query := "SELECT * FROM users WHERE ((affiliation = ?) OR (affiliation LIKE ?))"
-		rows, err := d.db.Queryx(d.db.Rebind(query))
+		rows, err := d.queryx(d.db.Rebind(query), affiliation, subAffiliation)
 		if err != nil {
 			return nil, errors.Wrapf(err, "Failed to execute query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
 		}
@@ -651,7 +767,7 @@ func (d *Accessor) GetFilteredUsers(affiliation, types string) (*sqlx.Rows, erro
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed to construct query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
 	}
-	rows, err := d.db.Queryx(d.db.Rebind(inQuery), args...)
+	rows, err := d.queryx(d.db.Rebind(inQuery), args...)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed to execute query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
 	}
@@ -678,7 +794,7 @@ func (d *Accessor) ModifyAffiliation(oldAffiliation, newAffiliation string, forc
 	// Check to see if the new affiliation being requested exists in the affiliation table
 	_, err = d.GetAffiliation(newAffiliation)
 	if err == nil {
-		return nil, caerrors.NewHTTPErr(400, caerrors.ErrUpdateConfigModifyAff, "Affiliation '%s' already exists", newAffiliation)
+		return nil, caerrors.NewHTTPErr(409, caerrors.ErrAffiliationExists, "Affiliation '%s' already exists", newAffiliation)
 	}
 
 	result, err := d.doTransaction(d.modifyAffiliationTx, oldAffiliation, newAffiliation, force, isRegistrar)
@@ -834,23 +950,53 @@ func (d *Accessor) doTransaction(doit func(tx *sqlx.Tx, args ...interface{}) (in
 	if err != nil {
 		return nil, err
 	}
-	tx := d.db.MustBegin()
-	result, err := doit(tx, args...)
-	if err != nil {
-		err2 := tx.Rollback()
-		if err2 != nil {
-			log.Errorf("Error encounted while rolling back transaction: %s", err2)
-			return nil, err
+	// A transaction which fails because the connection was lost is rolled
+	// back by the database, so it is done again with a new connection
+	var result interface{}
+	err = withDB(d.db, func() error {
+		tx, err := d.db.Beginx()
+		if err != nil {
+			return caerrors.NewUnavailableErr(caerrors.ErrConnectingDB, err, "Failed to begin database transaction")
+		}
+		result, err = doit(tx, args...)
+		if err != nil {
+			err2 := tx.Rollback()
+			if err2 != nil {
+				log.Errorf("Error encounted while rolling back transaction: %s", err2)
+			}
+			return err
 		}
+		err = tx.Commit()
+		if err != nil {
+			return errors.Wrap(err, "Error encountered while committing transaction")
+		}
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
+	return result, nil
+}
 
-	err = tx.Commit()
+// queryx runs the query 'query' with the arguments 'args' and returns its
+// rows, running it once more with a new connection if the connection to
+// the database was lost
+func (d *Accessor) queryx(query string, args ...interface{}) (rows *sqlx.Rows, err error) {
+	err = withDB(d.db, func() error {
+		rows, err = d.db.Queryx(query, args...)
+		return err
+	})
+	return rows, err
+}
+
+// Ping checks that the database can be reached, reconnecting to it if the
+// connection was lost
+func (d *Accessor) Ping() error {
+	err := d.checkDB()
 	if err != nil {
-		return nil, errors.Wrap(err, "Error encountered while committing transaction")
+		return err
 	}
-
-	return result, nil
+	return withDB(d.db, d.db.Ping)
 }
 
 // Returns the identities and affiliations that were modified
@@ -930,11 +1076,21 @@ func (u *DBUser) GetLevel() int {
 	return u.Level
 }
 
+// exec executes the statement 'query' with the arguments 'args', once more
+// with a new connection if the connection to the database was lost
+func (u *DBUser) exec(query string, args ...interface{}) (res sql.Result, err error) {
+	err = withDB(u.db, func() error {
+		res, err = u.db.Exec(query, args...)
+		return err
+	})
+	return res, err
+}
+
 // SetLevel sets the level of the user
 func (u *DBUser) SetLevel(level int) error {
 	query := "UPDATE users SET level = ? where (id = ?)"
 	id := u.GetName()
-	res, err := u.db.Exec(u.db.Rebind(query), level, id)
+	res, err := u.exec(u.db.Rebind(query), level, id)
 	if err != nil {
 		return err
 	}
@@ -1006,7 +1162,7 @@ func (u *DBUser) LoginComplete() error {
 		stateUpdateSQL = "UPDATE users SET state = state + 1 WHERE (id = ? AND state < ?)"
 		args = append(args, u.MaxEnrollments)
 	}
-	res, err := u.db.Exec(u.db.Rebind(stateUpdateSQL), args...)
+	res, err := u.exec(u.db.Rebind(stateUpdateSQL), args...)
 	if err != nil {
 		return errors.Wrapf(err, "Failed to update state of identity %s to %d", u.Name, state)
 	}
@@ -1069,7 +1225,7 @@ func (u *DBUser) GetAttributes(attrNames []string) ([]api.Attribute, error) {
 func (u *DBUser) Revoke() error {
 	stateUpdateSQL := "UPDATE users SET state = -1 WHERE (id = ?)"
 
-	res, err := u.db.Exec(u.db.Rebind(stateUpdateSQL), u.GetName())
+	res, err := u.exec(u.db.Rebind(stateUpdateSQL), u.GetName())
 	if err != nil {
 		return errors.Wrapf(err, "Failed to update state of identity %s to -1", u.Name)
 	}
@@ -1113,7 +1269,7 @@ func (u *DBUser) ModifyAttributes(newAttrs []api.Attribute) error {
 
 	query := "UPDATE users SET attributes = ? where (id = ?)"
 	id := u.GetName()
-	res, err := u.db.Exec(u.db.Rebind(query), string(attrBytes), id)
+	res, err := u.exec(u.db.Rebind(query), string(attrBytes), id)
 	if err != nil {
 		return err
 	}
@@ -1135,7 +1291,7 @@ func (u *DBUser) ModifyAttributes(newAttrs []api.Attribute) error {
 
 func getError(err error, getType string) error {
 	if err.Error() == "sql: no rows in result set" {
-		return caerrors.NewHTTPErr(404, caerrors.ErrDBGet, "Failed to get %s: %s", getType, err)
+		return caerrors.NewNotFoundErr(caerrors.ErrDBGet, "Failed to get %s", getType)
 	}
-	return caerrors.NewHTTPErr(504, caerrors.ErrConnectingDB, "Failed to process database request: %s", err)
+	return caerrors.NewUnavailableErr(caerrors.ErrConnectingDB, err, "Failed to process database request")
 }
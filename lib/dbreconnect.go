@@ -0,0 +1,36 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/lib/dbutil"
+)
+
+// withDB calls 'f', an operation on the database 'db', once more with a new
+// connection if the connection to the database was lost. If the database
+// still can't be reached, the error is an unavailable error, so that the
+// request fails with 503 and can be retried later, rather than with the
+// error of the operation, such as an authentication failure.
+func withDB(db *dbutil.DB, f func() error) error {
+	err := db.Retry(f)
+	if dbutil.IsConnectionError(err) && !caerrors.Is(err, caerrors.ClassBackendUnavailable) {
+		return caerrors.NewUnavailableErr(caerrors.ErrConnectingDB, err, "The database is unavailable")
+	}
+	return err
+}
+
+// dbAvailabilityChanged runs the health checks of the server when the
+// database of the CA becomes unavailable or available again, so that the
+// readiness of the server changes right away rather than at the next
+// periodic run of the checks
+func (ca *CA) dbAvailabilityChanged(available bool) {
+	if ca.server == nil || ca.server.healthChecker == nil {
+		return
+	}
+	go ca.server.healthChecker.run()
+}
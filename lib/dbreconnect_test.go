@@ -0,0 +1,222 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/lib/dbutil"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// dbProxy stands between a CA and its SQLite database like a TCP proxy in
+// front of a database server: it can sever the connections opened through
+// it, which then fail as if reset by the database server, and refuse new
+// connections until it is restored
+type dbProxy struct {
+	driver     driver.Driver
+	datasource string
+	mutex      sync.Mutex
+	generation int
+	down       bool
+}
+
+// Connect implements driver.Connector
+func (p *dbProxy) Connect(context.Context) (driver.Conn, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.down {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	}
+	conn, err := p.driver.Open(p.datasource)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, proxy: p, generation: p.generation}, nil
+}
+
+// Driver implements driver.Connector
+func (p *dbProxy) Driver() driver.Driver {
+	return p.driver
+}
+
+// sever breaks the connections opened so far and, if 'down', refuses new
+// connections until restore is called
+func (p *dbProxy) sever(down bool) {
+	p.mutex.Lock()
+	p.generation++
+	p.down = down
+	p.mutex.Unlock()
+}
+
+func (p *dbProxy) restore() {
+	p.mutex.Lock()
+	p.down = false
+	p.mutex.Unlock()
+}
+
+// check returns an error if the connection of 'generation' was severed
+func (p *dbProxy) check(generation int) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if generation != p.generation {
+		return &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	}
+	return nil
+}
+
+type proxyConn struct {
+	driver.Conn
+	proxy      *dbProxy
+	generation int
+}
+
+func (c *proxyConn) Prepare(query string) (driver.Stmt, error) {
+	err := c.proxy.check(c.generation)
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyStmt{Stmt: stmt, conn: c}, nil
+}
+
+func (c *proxyConn) Begin() (driver.Tx, error) {
+	err := c.proxy.check(c.generation)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := c.Conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyTx{Tx: tx, conn: c}, nil
+}
+
+// Ping implements driver.Pinger
+func (c *proxyConn) Ping(context.Context) error {
+	return c.proxy.check(c.generation)
+}
+
+type proxyStmt struct {
+	driver.Stmt
+	conn *proxyConn
+}
+
+func (s *proxyStmt) Exec(args []driver.Value) (driver.Result, error) {
+	err := s.conn.proxy.check(s.conn.generation)
+	if err != nil {
+		return nil, err
+	}
+	return s.Stmt.Exec(args)
+}
+
+func (s *proxyStmt) Query(args []driver.Value) (driver.Rows, error) {
+	err := s.conn.proxy.check(s.conn.generation)
+	if err != nil {
+		return nil, err
+	}
+	return s.Stmt.Query(args)
+}
+
+type proxyTx struct {
+	driver.Tx
+	conn *proxyConn
+}
+
+func (tx *proxyTx) Commit() error {
+	err := tx.conn.proxy.check(tx.conn.generation)
+	if err != nil {
+		tx.Tx.Rollback()
+		return err
+	}
+	return tx.Tx.Commit()
+}
+
+// proxyCADB makes 'ca' connect to its database through a proxy, which is
+// returned
+func proxyCADB(t *testing.T, ca *CA) *dbProxy {
+	sqlite, err := sql.Open("sqlite3", "")
+	util.FatalError(t, err, "Failed to get the SQLite driver")
+	proxy := &dbProxy{driver: sqlite.Driver(), datasource: ca.Config.DB.Datasource + "?_busy_timeout=5000"}
+	sqlite.Close()
+	db := &dbutil.DB{DB: sqlx.NewDb(sql.OpenDB(proxy), "sqlite3"), IsDBInitialized: true}
+	db.SetMaxOpenConns(1)
+	db.OnAvailabilityChange = ca.dbAvailabilityChanged
+	prev := ca.db
+	ca.db = db
+	ca.registry.(*Accessor).SetDB(db)
+	ca.certDBAccessor.SetDB(db)
+	prev.Close()
+	return proxy
+}
+
+// waitReadiness waits for the readiness of 's' to become 'status'
+func waitReadiness(t *testing.T, s *Server, status string) {
+	for i := 0; i < 50 && s.healthChecker.get().Status != status; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, status, s.healthChecker.get().Status, "The readiness of the server should be '%s'", status)
+}
+
+func TestDBReconnect(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	proxy := proxyCADB(t, &srv.CA)
+	admin, _ := enrollDebugIdentities(t)
+	client := newAdminTestClient("")
+	url := fmt.Sprintf("http://localhost:%d/api/v1/identities/debuguser", rootPort)
+
+	// The connections are lost, but the database can be reached again: the
+	// requests succeed with new connections
+	proxy.sever(false)
+	status, body := adminRequest(t, client, "GET", url, admin, "")
+	assert.Equal(t, http.StatusOK, status, "A request should succeed after the connections were lost: %s", body)
+	assert.True(t, srv.CA.db.Available())
+
+	// The database can't be reached: the requests fail as unavailable rather
+	// than as authentication failures, and the server is not ready
+	proxy.sever(true)
+	status, body = adminRequest(t, client, "GET", url, admin, "")
+	assert.Equal(t, http.StatusServiceUnavailable, status, "A request should fail while the database can't be reached: %s", body)
+	_, err = srv.CA.registry.GetUser("admin", nil)
+	assert.True(t, caerrors.Is(err, caerrors.ClassBackendUnavailable), "%v should be an unavailable error", err)
+	_, err = srv.CA.certDBAccessor.GetCertificatesByID("admin")
+	assert.True(t, caerrors.Is(errors.Cause(err), caerrors.ClassBackendUnavailable), "%v should be an unavailable error", err)
+	assert.False(t, srv.CA.db.Available())
+	waitReadiness(t, srv, healthStatusUnavailable)
+
+	// The database can be reached again: the server recovers without a
+	// restart
+	proxy.restore()
+	status, body = adminRequest(t, client, "GET", url, admin, "")
+	assert.Equal(t, http.StatusOK, status, "A request should succeed once the database can be reached again: %s", body)
+	assert.True(t, srv.CA.db.Available())
+	waitReadiness(t, srv, healthStatusOK)
+}
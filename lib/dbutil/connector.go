@@ -0,0 +1,196 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dbutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// connectionErrorMessages are the messages of the errors of the drivers
+// which are returned when the connection to the database is lost, such as
+// when the error is only known by its message
+var connectionErrorMessages = []string{
+	"bad connection",
+	"invalid connection",
+	"connection refused",
+	"connection reset by peer",
+	"broken pipe",
+	"server has gone away",
+	"connection is already closed",
+	"the database system is shutting down",
+}
+
+// connector opens the connections of a database with a datasource which
+// can be changed while the database is open, such as when the credentials
+// in it are rotated
+type connector struct {
+	driver     driver.Driver
+	mutex      sync.RWMutex
+	datasource string
+}
+
+// Connect implements driver.Connector
+func (c *connector) Connect(context.Context) (driver.Conn, error) {
+	c.mutex.RLock()
+	datasource := c.datasource
+	c.mutex.RUnlock()
+	return c.driver.Open(datasource)
+}
+
+// Driver implements driver.Connector
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+// openDB opens the database of 'datasource' with the driver 'driverName'
+// such that its datasource can be changed by Reconnect
+func openDB(driverName, datasource string) (*DB, error) {
+	db, err := sql.Open(driverName, "")
+	if err != nil {
+		return nil, err
+	}
+	drv := db.Driver()
+	db.Close()
+	c := &connector{driver: drv, datasource: datasource}
+	return &DB{DB: sqlx.NewDb(sql.OpenDB(c), driverName), connector: c}, nil
+}
+
+// Reconnect makes 'db' open its new connections with the datasource of
+// 'next', a newly opened connection to the same database, such as with
+// rotated credentials, which it then closes. The idle connections of 'db'
+// are closed; the connections in use are closed when they reach the
+// maximum lifetime set with SetConnMaxLifetime.
+func (db *DB) Reconnect(next *DB) error {
+	defer next.Close()
+	if db.connector == nil || next.connector == nil {
+		return errors.New("The database can't be reconnected")
+	}
+	if db.DriverName() != next.DriverName() {
+		return errors.Errorf("Can't reconnect a %s database to a %s database", db.DriverName(), next.DriverName())
+	}
+	next.connector.mutex.RLock()
+	datasource := next.connector.datasource
+	next.connector.mutex.RUnlock()
+	db.connector.mutex.Lock()
+	db.connector.datasource = datasource
+	db.connector.mutex.Unlock()
+	db.ResetConnections()
+	return nil
+}
+
+// ResetConnections closes the idle connections of 'db', so that its next
+// operations open new connections. The connections in use are closed when
+// they are returned if they were lost.
+func (db *DB) ResetConnections() {
+	db.SetMaxIdleConns(0)
+	db.SetMaxIdleConns(maxIdleConns)
+}
+
+// Retry calls 'f', an operation on 'db'. If it fails because the connection
+// to the database was lost, such as when the database server restarts or
+// fails over, the idle connections, which were likely lost too, are closed
+// and 'f' is called once more with a new connection. The database is marked
+// unavailable while its operations fail because it can't be reached, and
+// available again as soon as one succeeds.
+func (db *DB) Retry(f func() error) error {
+	err := f()
+	if IsConnectionError(err) {
+		log.Warningf("Lost the connection to the database; reconnecting: %s", err)
+		db.ResetConnections()
+		err = f()
+	}
+	db.setAvailable(!IsConnectionError(err), err)
+	return err
+}
+
+// Available returns false if the last operation on 'db' failed because the
+// database can't be reached
+func (db *DB) Available() bool {
+	return atomic.LoadInt32(&db.unavailable) == 0
+}
+
+func (db *DB) setAvailable(available bool, err error) {
+	var unavailable int32
+	if !available {
+		unavailable = 1
+	}
+	if atomic.SwapInt32(&db.unavailable, unavailable) == unavailable {
+		return
+	}
+	if available {
+		log.Info("The database is available again")
+	} else {
+		log.Errorf("The database is unavailable: %s", err)
+	}
+	if db.OnAvailabilityChange != nil {
+		db.OnAvailabilityChange(available)
+	}
+}
+
+// IsConnectionError returns true if 'err', or an error which caused it, is
+// returned when the connection to the database is lost or can't be opened,
+// in which case the operation may succeed with a new connection
+func IsConnectionError(err error) bool {
+	for err != nil {
+		if isConnectionError(err) {
+			return true
+		}
+		switch e := err.(type) {
+		case interface{ Cause() error }:
+			err = e.Cause()
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			err = nil
+		}
+	}
+	return false
+}
+
+func isConnectionError(err error) bool {
+	switch err {
+	case driver.ErrBadConn, sql.ErrConnDone, mysql.ErrInvalidConn, io.ErrUnexpectedEOF:
+		return true
+	}
+	switch e := err.(type) {
+	case net.Error:
+		return true
+	case *pq.Error:
+		return isPostgresConnectionError(e)
+	case pq.Error:
+		return isPostgresConnectionError(&e)
+	case *mysql.MySQLError:
+		// ER_SERVER_SHUTDOWN and ER_CONNECTION_KILLED
+		return e.Number == 1053 || e.Number == 1927
+	}
+	msg := strings.ToLower(err.Error())
+	for _, m := range connectionErrorMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPostgresConnectionError returns true for the errors of class 08,
+// connection exception, and those returned when the server shuts down
+func isPostgresConnectionError(e *pq.Error) bool {
+	return e.Code.Class() == "08" || e.Code == "57P01" || e.Code == "57P02" || e.Code == "57P03"
+}
@@ -9,6 +9,7 @@ package dbutil
 import (
 	"database/sql"
 	"fmt"
+	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -55,8 +56,19 @@ type DB struct {
 	*sqlx.DB
 	// Indicates if database was successfully initialized
 	IsDBInitialized bool
+	// Opens the connections of the database, if it can be reconnected
+	connector *connector
+	// OnAvailabilityChange, if set, is called when the database becomes
+	// unavailable because it can't be reached, and when it is available again
+	OnAvailabilityChange func(available bool)
+	// Is 1 while the database can't be reached
+	unavailable int32
 }
 
+// maxIdleConns is the maximum number of idle connections of a database,
+// which is the default of database/sql
+const maxIdleConns = 2
+
 // Levels contains the levels of identities, affiliations, and certificates
 type Levels struct {
 	Identity    int
@@ -86,7 +98,7 @@ func NewUserRegistrySQLLite3(datasource string) (*DB, error) {
 		return nil, errors.WithMessage(err, "Failed to create SQLite3 database")
 	}
 
-	db, err := sqlx.Open("sqlite3", datasource+"?_busy_timeout=5000")
+	db, err := openDB("sqlite3", datasource+"?_busy_timeout=5000")
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to open sqlite3 DB")
 	}
@@ -104,7 +116,7 @@ func NewUserRegistrySQLLite3(datasource string) (*DB, error) {
 	db.SetMaxOpenConns(1)
 	log.Debug("Successfully opened sqlite3 DB")
 
-	return &DB{db, false}, nil
+	return db, nil
 }
 
 func createSQLiteDBTables(datasource string) error {
@@ -113,7 +125,7 @@ func createSQLiteDBTables(datasource string) error {
 	if err != nil {
 		return errors.Wrap(err, "Failed to open SQLite database")
 	}
-	db := &DB{sqldb, false}
+	db := &DB{DB: sqldb}
 	defer db.Close()
 
 	err = doTransaction(db, createAllSQLiteTables)
@@ -159,6 +171,10 @@ func createAllSQLiteTables(tx *sqlx.Tx, args ...interface{}) error {
 	if err != nil {
 		return err
 	}
+	err = createSQLiteIdempotencyKeysTable(tx)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -210,15 +226,51 @@ func createSQLiteNoncesTable(tx *sqlx.Tx) error {
 	return nil
 }
 
+func createSQLiteIdempotencyKeysTable(tx *sqlx.Tx) error {
+	log.Debug("Creating idempotency_keys table if it does not exist")
+	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS idempotency_keys (idem_key VARCHAR(255) NOT NULL, request_hash VARCHAR(64) NOT NULL, status INTEGER, response TEXT, expiry timestamp, PRIMARY KEY(idem_key))"); err != nil {
+		return errors.Wrap(err, "Error creating idempotency_keys table")
+	}
+	return nil
+}
+
 // NewUserRegistryPostgres opens a connection to a postgres database
 func NewUserRegistryPostgres(datasource string, clientTLSConfig *tls.ClientTLSConfig) (*DB, error) {
 	log.Debugf("Using postgres database, connecting to database...")
 
+	db, dbName, datasource, err := connectPostgres(datasource, clientTLSConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createPostgresDatabase(dbName, db)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create Postgres database")
+	}
+
+	log.Debugf("Connecting to database '%s', using connection string: '%s'", dbName, MaskDBCred(datasource))
+	pgdb, err := openDB("postgres", datasource)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to open database '%s' in Postgres server", dbName)
+	}
+
+	err = createPostgresTables(dbName, pgdb.DB)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create Postgres tables")
+	}
+
+	return pgdb, nil
+}
+
+// connectPostgres connects to the Postgres server of 'datasource', returning
+// the connection, the name of the database and the datasource with the
+// settings of 'clientTLSConfig'
+func connectPostgres(datasource string, clientTLSConfig *tls.ClientTLSConfig) (*sqlx.DB, string, string, error) {
 	dbName := getDBName(datasource)
 	log.Debugf("Database Name: %s", dbName)
 
 	if strings.Contains(dbName, "-") || strings.HasSuffix(dbName, ".db") {
-		return nil, errors.Errorf("Database name '%s' cannot contain any '-' or end with '.db'", dbName)
+		return nil, "", "", errors.Errorf("Database name '%s' cannot contain any '-' or end with '.db'", dbName)
 	}
 
 	if clientTLSConfig.Enabled {
@@ -242,7 +294,7 @@ func NewUserRegistryPostgres(datasource string, clientTLSConfig *tls.ClientTLSCo
 
 		db, err = sqlx.Open("postgres", connStr)
 		if err != nil {
-			return nil, errors.Wrap(err, "Failed to open Postgres database")
+			return nil, "", "", errors.Wrap(err, "Failed to open Postgres database")
 		}
 
 		pingErr = db.Ping()
@@ -253,26 +305,9 @@ func NewUserRegistryPostgres(datasource string, clientTLSConfig *tls.ClientTLSCo
 	}
 
 	if pingErr != nil {
-		return nil, errors.Errorf("Failed to connect to Postgres database. Postgres requires connecting to a specific database, the following databases were tried: %s. Please create one of these database before continuing", dbNames)
-	}
-
-	err = createPostgresDatabase(dbName, db)
-	if err != nil {
-		return nil, errors.Wrap(err, "Failed to create Postgres database")
-	}
-
-	log.Debugf("Connecting to database '%s', using connection string: '%s'", dbName, MaskDBCred(datasource))
-	db, err = sqlx.Open("postgres", datasource)
-	if err != nil {
-		return nil, errors.Wrapf(err, "Failed to open database '%s' in Postgres server", dbName)
+		return nil, "", "", errors.Errorf("Failed to connect to Postgres database. Postgres requires connecting to a specific database, the following databases were tried: %s. Please create one of these database before continuing", dbNames)
 	}
-
-	err = createPostgresTables(dbName, db)
-	if err != nil {
-		return nil, errors.Wrap(err, "Failed to create Postgres tables")
-	}
-
-	return &DB{db, false}, nil
+	return db, dbName, datasource, nil
 }
 
 func createPostgresDatabase(dbName string, db *sqlx.DB) error {
@@ -315,6 +350,10 @@ func createPostgresTables(dbName string, db *sqlx.DB) error {
 	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS nonces (val VARCHAR(255) NOT NULL UNIQUE, expiry timestamp, level INTEGER DEFAULT 0, PRIMARY KEY (val))"); err != nil {
 		return errors.Wrap(err, "Error creating nonces table")
 	}
+	log.Debug("Creating idempotency_keys table if it does not exist")
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS idempotency_keys (idem_key VARCHAR(255) NOT NULL, request_hash VARCHAR(64) NOT NULL, status INTEGER, response TEXT, expiry timestamp, PRIMARY KEY (idem_key))"); err != nil {
+		return errors.Wrap(err, "Error creating idempotency_keys table")
+	}
 	log.Debug("Creating properties table if it does not exist")
 	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS properties (property VARCHAR(255), value VARCHAR(256), PRIMARY KEY(property))"); err != nil {
 		return errors.Wrap(err, "Error creating properties table")
@@ -332,6 +371,33 @@ func createPostgresTables(dbName string, db *sqlx.DB) error {
 func NewUserRegistryMySQL(datasource string, clientTLSConfig *tls.ClientTLSConfig, csp bccsp.BCCSP) (*DB, error) {
 	log.Debugf("Using MySQL database, connecting to database...")
 
+	db, dbName, err := connectMySQL(datasource, clientTLSConfig, csp)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createMySQLDatabase(dbName, db)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create MySQL database")
+	}
+
+	log.Debugf("Connecting to database '%s', using connection string: '%s'", dbName, MaskDBCred(datasource))
+	mysqldb, err := openDB("mysql", datasource)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to open database (%s) in MySQL server", dbName)
+	}
+
+	err = createMySQLTables(dbName, mysqldb.DB)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create MySQL tables")
+	}
+
+	return mysqldb, nil
+}
+
+// connectMySQL connects to the MySQL server of 'datasource', returning the
+// connection and the name of the database
+func connectMySQL(datasource string, clientTLSConfig *tls.ClientTLSConfig, csp bccsp.BCCSP) (*sqlx.DB, string, error) {
 	dbName := getDBName(datasource)
 	log.Debugf("Database Name: %s", dbName)
 
@@ -341,7 +407,7 @@ func NewUserRegistryMySQL(datasource string, clientTLSConfig *tls.ClientTLSConfi
 	if clientTLSConfig.Enabled {
 		tlsConfig, err := tls.GetClientTLSConfig(clientTLSConfig, csp)
 		if err != nil {
-			return nil, errors.WithMessage(err, "Failed to get client TLS for MySQL")
+			return nil, "", errors.WithMessage(err, "Failed to get client TLS for MySQL")
 		}
 
 		mysql.RegisterTLSConfig("custom", tlsConfig)
@@ -350,31 +416,47 @@ func NewUserRegistryMySQL(datasource string, clientTLSConfig *tls.ClientTLSConfi
 	log.Debugf("Connecting to MySQL server, using connection string: %s", MaskDBCred(connStr))
 	db, err := sqlx.Open("mysql", connStr)
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to open MySQL database")
+		return nil, "", errors.Wrap(err, "Failed to open MySQL database")
 	}
 
 	err = db.Ping()
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to connect to MySQL database")
-	}
-
-	err = createMySQLDatabase(dbName, db)
-	if err != nil {
-		return nil, errors.Wrap(err, "Failed to create MySQL database")
+		return nil, "", errors.Wrap(err, "Failed to connect to MySQL database")
 	}
+	return db, dbName, nil
+}
 
-	log.Debugf("Connecting to database '%s', using connection string: '%s'", dbName, MaskDBCred(datasource))
-	db, err = sqlx.Open("mysql", datasource)
-	if err != nil {
-		return nil, errors.Wrapf(err, "Failed to open database (%s) in MySQL server", dbName)
+// Ping checks that a connection can be established to the database of type
+// 'dbType' at 'datasource', without creating the database or its tables. A
+// SQLite database which does not exist yet is not an error, since the server
+// creates it.
+func Ping(dbType, datasource string, clientTLSConfig *tls.ClientTLSConfig, csp bccsp.BCCSP) error {
+	var db *sqlx.DB
+	var err error
+	switch dbType {
+	case "sqlite3":
+		if _, err = os.Stat(datasource); os.IsNotExist(err) {
+			return nil
+		}
+		db, err = sqlx.Open("sqlite3", datasource)
+		if err != nil {
+			return errors.Wrap(err, "Failed to open sqlite3 DB")
+		}
+		err = db.Ping()
+		if err != nil {
+			err = errors.Wrap(err, "Failed to connect to sqlite3 DB")
+		}
+	case "postgres":
+		db, _, _, err = connectPostgres(datasource, clientTLSConfig)
+	case "mysql":
+		db, _, err = connectMySQL(datasource, clientTLSConfig, csp)
+	default:
+		return errors.Errorf("Invalid db.type '%s'; must be 'sqlite3', 'postgres', or 'mysql'", dbType)
 	}
-
-	err = createMySQLTables(dbName, db)
-	if err != nil {
-		return nil, errors.Wrap(err, "Failed to create MySQL tables")
+	if db != nil {
+		db.Close()
 	}
-
-	return &DB{db, false}, nil
+	return err
 }
 
 func createMySQLDatabase(dbName string, db *sqlx.DB) error {
@@ -419,6 +501,10 @@ func createMySQLTables(dbName string, db *sqlx.DB) error {
 	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS nonces (val VARCHAR(255) NOT NULL, expiry timestamp, level INTEGER DEFAULT 0, PRIMARY KEY (val))"); err != nil {
 		return errors.Wrap(err, "Error creating nonces table")
 	}
+	log.Debug("Creating idempotency_keys table if it does not exist")
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS idempotency_keys (idem_key VARCHAR(255) NOT NULL, request_hash VARCHAR(64) NOT NULL, status INTEGER, response LONGTEXT, expiry timestamp NULL, PRIMARY KEY (idem_key)) DEFAULT CHARSET=utf8 COLLATE utf8_bin"); err != nil {
+		return errors.Wrap(err, "Error creating idempotency_keys table")
+	}
 	log.Debug("Creating properties table if it does not exist")
 	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS properties (property VARCHAR(255), value VARCHAR(256), PRIMARY KEY(property))"); err != nil {
 		return errors.Wrap(err, "Error creating properties table")
@@ -0,0 +1,82 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"mime"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Format is a format in which the server returns the certificates of the
+// cainfo, enroll and reenroll endpoints, or the CRL of the gencrl endpoint
+type Format string
+
+const (
+	// FormatJSON is the JSON response of the endpoint
+	FormatJSON Format = "json"
+	// FormatPEM is the PEM encoding of the certificates or of the CRL
+	FormatPEM Format = "pem"
+	// FormatDER is the DER encoding of the first certificate or of the CRL
+	FormatDER Format = "der"
+)
+
+// The media types of the Accept header of a request which select a format
+const (
+	mediaTypeJSON = "application/json"
+	mediaTypePEM  = "application/x-pem-file"
+	mediaTypeCert = "application/pkix-cert"
+	mediaTypeCRL  = "application/pkix-crl"
+)
+
+// certMediaType returns the media type of the certificates of a result in
+// the format 'f'
+func (f Format) certMediaType() (string, error) {
+	switch f {
+	case FormatJSON:
+		return mediaTypeJSON, nil
+	case FormatPEM:
+		return mediaTypePEM, nil
+	case FormatDER:
+		return mediaTypeCert, nil
+	}
+	return "", errors.Errorf("Invalid format '%s'; it must be 'json', 'pem' or 'der'", f)
+}
+
+// crlMediaType returns the media type of a CRL in the format 'f'
+func (f Format) crlMediaType() (string, error) {
+	if f == FormatDER {
+		return mediaTypeCRL, nil
+	}
+	return f.certMediaType()
+}
+
+// encodedResult is the result of a request whose body is returned as is,
+// which must have the media type of the request's Accept header
+type encodedResult struct {
+	mediaType string
+	body      []byte
+}
+
+// newEncodedResult sets the Accept header of 'req' to 'mediaType' and
+// returns the result in which the response to it is read
+func newEncodedResult(req *http.Request, mediaType string) *encodedResult {
+	req.Header.Set("Accept", mediaType)
+	return &encodedResult{mediaType: mediaType}
+}
+
+// read sets the body of the result to the body of the response 'resp'
+func (er *encodedResult) read(resp *http.Response, body []byte) error {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != er.mediaType {
+		return errors.Errorf("The server returned '%s' rather than '%s'; it may not support this format",
+			mediaType, er.mediaType)
+	}
+	er.body = body
+	return nil
+}
@@ -0,0 +1,34 @@
+// +build ignore
+
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// This program writes the API document of the server to the file named by its
+// argument; it is run by go generate
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/hyperledger/fabric-ca/lib"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: go run gen_openapi.go <file>")
+		os.Exit(2)
+	}
+	doc, err := lib.OpenAPIDocument()
+	if err == nil {
+		err = ioutil.WriteFile(os.Args[1], doc, 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write the API document: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,210 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	healthStatusOK           = "OK"
+	healthStatusUnavailable  = "unavailable"
+	healthStatusShuttingDown = "shutting down"
+	defaultHealthInterval    = 10 * time.Second
+)
+
+// healthCheck is a check of a component on which the server depends
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// ComponentHealth is the status of a component in the response of the
+// readiness endpoint
+type ComponentHealth struct {
+	// Name of the component
+	Name string `json:"name"`
+	// Status is "OK" or "unavailable"
+	Status string `json:"status"`
+	// Error is the reason the component is unavailable
+	Error string `json:"error,omitempty"`
+}
+
+// ReadinessResponse is the response of the readiness endpoint
+type ReadinessResponse struct {
+	// Status is "OK" if all components are available
+	Status string `json:"status"`
+	// Components is the status of each of the components checked
+	Components []ComponentHealth `json:"components,omitempty"`
+}
+
+// healthChecker periodically runs the health checks of the server and
+// caches the result, so that the frequency of readiness probes does not
+// put load on the components being checked
+type healthChecker struct {
+	checks   []healthCheck
+	interval time.Duration
+	mutex    sync.RWMutex
+	result   *ReadinessResponse
+	done     chan struct{}
+}
+
+func newHealthChecker(checks []healthCheck, interval time.Duration) *healthChecker {
+	if interval <= 0 {
+		interval = defaultHealthInterval
+	}
+	return &healthChecker{checks: checks, interval: interval}
+}
+
+// start runs the checks once and then every interval until stopped
+func (hc *healthChecker) start() {
+	hc.run()
+	hc.done = make(chan struct{})
+	go func(done chan struct{}) {
+		ticker := time.NewTicker(hc.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				hc.run()
+			case <-done:
+				return
+			}
+		}
+	}(hc.done)
+}
+
+func (hc *healthChecker) stop() {
+	if hc.done != nil {
+		close(hc.done)
+		hc.done = nil
+	}
+}
+
+// run runs all of the checks and caches the result
+func (hc *healthChecker) run() {
+	res := &ReadinessResponse{Status: healthStatusOK}
+	for _, c := range hc.checks {
+		ch := ComponentHealth{Name: c.name, Status: healthStatusOK}
+		err := c.check()
+		if err != nil {
+			ch.Status = healthStatusUnavailable
+			ch.Error = err.Error()
+			res.Status = healthStatusUnavailable
+		}
+		res.Components = append(res.Components, ch)
+	}
+	hc.mutex.Lock()
+	prev := hc.result
+	hc.result = res
+	hc.mutex.Unlock()
+	if prev != nil && prev.Status != res.Status {
+		log.Infof("Server readiness changed from '%s' to '%s'", prev.Status, res.Status)
+	}
+}
+
+// get returns the result of the last run of the checks
+func (hc *healthChecker) get() *ReadinessResponse {
+	hc.mutex.RLock()
+	defer hc.mutex.RUnlock()
+	return hc.result
+}
+
+// healthChecks returns the checks of the user registry, certificate
+// database, and signer of each CA of the server, and of the leases of the
+// secrets read from Vault
+func (s *Server) healthChecks() []healthCheck {
+	names := make([]string, 0, len(s.caMap))
+	for name := range s.caMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	checks := []healthCheck{}
+	for _, name := range names {
+		ca := s.caMap[name]
+		checks = append(checks,
+			healthCheck{name: name + "/registry", check: ca.checkRegistry},
+			healthCheck{name: name + "/certdb", check: ca.checkCertDB},
+			healthCheck{name: name + "/signer", check: ca.checkSigner},
+		)
+	}
+	if s.vault != nil {
+		checks = append(checks, healthCheck{name: "vault", check: s.checkVault})
+	}
+	return checks
+}
+
+func (ca *CA) checkRegistry() error {
+	registry := ca.registry
+	if registry == nil {
+		return errors.New("User registry is not initialized")
+	}
+	if p, ok := registry.(interface {
+		Ping() error
+	}); ok {
+		return p.Ping()
+	}
+	return nil
+}
+
+func (ca *CA) checkCertDB() error {
+	db := ca.db
+	if db == nil || !db.IsDBInitialized || ca.certDBAccessor == nil {
+		return errors.New("Certificate database is not initialized")
+	}
+	return withDB(db, db.Ping)
+}
+
+func (ca *CA) checkSigner() error {
+	if ca.enrollSigner == nil {
+		return errors.New("Signer is not initialized")
+	}
+	return nil
+}
+
+// healthzHandler reports that the server process is alive
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, &ReadinessResponse{Status: healthStatusOK})
+}
+
+// readyzHandler reports whether the server is ready to serve requests,
+// using the result of the last run of the health checks
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.shuttingDown) == 1 {
+		writeHealth(w, http.StatusServiceUnavailable, &ReadinessResponse{Status: healthStatusShuttingDown})
+		return
+	}
+	hc := s.healthChecker
+	if hc == nil {
+		writeHealth(w, http.StatusServiceUnavailable, &ReadinessResponse{Status: healthStatusUnavailable})
+		return
+	}
+	res := hc.get()
+	code := http.StatusOK
+	if res.Status != healthStatusOK {
+		code = http.StatusServiceUnavailable
+	}
+	writeHealth(w, code, res)
+}
+
+func writeHealth(w http.ResponseWriter, code int, res *ReadinessResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(res)
+	if err != nil {
+		log.Warningf("Failed to write health response: %s", err)
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthCheckerTransitions(t *testing.T) {
+	var dbErr error
+	checks := []healthCheck{
+		{name: "ca/registry", check: func() error { return nil }},
+		{name: "ca/certdb", check: func() error { return dbErr }},
+	}
+	s := &Server{healthChecker: newHealthChecker(checks, 0)}
+	s.healthChecker.run()
+
+	res := getReadiness(t, s, http.StatusOK)
+	assert.Equal(t, healthStatusOK, res.Status)
+	assert.Len(t, res.Components, 2)
+
+	// The cached result is returned until the checks are run again
+	dbErr = errors.New("connection refused")
+	getReadiness(t, s, http.StatusOK)
+	s.healthChecker.run()
+	res = getReadiness(t, s, http.StatusServiceUnavailable)
+	assert.Equal(t, healthStatusUnavailable, res.Status)
+	if assert.Len(t, res.Components, 2) {
+		assert.Equal(t, ComponentHealth{Name: "ca/registry", Status: healthStatusOK}, res.Components[0])
+		assert.Equal(t, ComponentHealth{Name: "ca/certdb", Status: healthStatusUnavailable, Error: "connection refused"},
+			res.Components[1])
+	}
+
+	// Recovery
+	dbErr = nil
+	s.healthChecker.run()
+	res = getReadiness(t, s, http.StatusOK)
+	assert.Equal(t, healthStatusOK, res.Status)
+
+	// Not ready as soon as shutdown starts
+	s.shuttingDown = 1
+	res = getReadiness(t, s, http.StatusServiceUnavailable)
+	assert.Equal(t, healthStatusShuttingDown, res.Status)
+
+	// The liveness endpoint does not depend on the checks
+	w := httptest.NewRecorder()
+	s.healthzHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestCAHealthChecks(t *testing.T) {
+	ca := &CA{}
+	assert.Error(t, ca.checkRegistry())
+	assert.Error(t, ca.checkCertDB())
+	assert.Error(t, ca.checkSigner())
+}
+
+func TestOperationsListener(t *testing.T) {
+	home := "opshometest"
+	defer func() {
+		err := os.RemoveAll(home)
+		if err != nil {
+			t.Errorf("RemoveAll failed: %s", err)
+		}
+	}()
+	srv := getServer(serverPort, home, "", -1, t)
+	if srv == nil {
+		t.Fatal("Failed to create server")
+	}
+	srv.Config.Operations.ListenAddress = fmt.Sprintf("localhost:%d", serverPort+2)
+	err := srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	defer func() {
+		err = srv.Stop()
+		if err != nil {
+			t.Errorf("Failed to stop server: %s", err)
+		}
+	}()
+
+	// Don't leave connections open to this server for the tests that follow
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%d/readyz", serverPort+2))
+	if err != nil {
+		t.Fatalf("Readiness request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	res := &ReadinessResponse{}
+	err = json.NewDecoder(resp.Body).Decode(res)
+	assert.NoError(t, err)
+	assert.Equal(t, healthStatusOK, res.Status)
+	assert.Len(t, res.Components, 3, "Registry, certificate DB and signer of the default CA")
+
+	resp2, err := client.Get(fmt.Sprintf("http://localhost:%d/healthz", serverPort+2))
+	if assert.NoError(t, err) {
+		resp2.Body.Close()
+		assert.Equal(t, http.StatusOK, resp2.StatusCode)
+	}
+
+	// Not served on the server's port when there is an operations listener
+	resp3, err := client.Get(fmt.Sprintf("http://localhost:%d/readyz", serverPort))
+	if assert.NoError(t, err) {
+		resp3.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp3.StatusCode)
+	}
+}
+
+func getReadiness(t *testing.T, s *Server, code int) *ReadinessResponse {
+	w := httptest.NewRecorder()
+	s.readyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, code, w.Code)
+	res := &ReadinessResponse{}
+	err := json.Unmarshal(w.Body.Bytes(), res)
+	assert.NoError(t, err)
+	return res
+}
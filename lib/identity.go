@@ -7,6 +7,7 @@ SPDX-License-Identifier: Apache-2.0
 package lib
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -21,6 +22,7 @@ import (
 	"github.com/hyperledger/fabric-ca/lib/client/credential/x509"
 	"github.com/hyperledger/fabric-ca/lib/common"
 	"github.com/hyperledger/fabric-ca/util"
+	"github.com/hyperledger/fabric/bccsp"
 )
 
 // Identity is fabric-ca's implementation of an identity
@@ -49,6 +51,19 @@ func (i *Identity) GetClient() *Client {
 	return i.client
 }
 
+// WithContext returns a copy of the identity whose requests are sent with
+// 'ctx', with a copy of its client as returned by the client's WithContext
+func (i *Identity) WithContext(ctx context.Context) (*Identity, error) {
+	if i.client == nil {
+		return nil, errors.New("No client is associated with this identity")
+	}
+	client, err := i.client.WithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewIdentity(client, i.name, i.creds), nil
+}
+
 // GetIdemixCredential returns Idemix credential of this identity
 func (i *Identity) GetIdemixCredential() credential.Credential {
 	for _, cred := range i.creds {
@@ -119,6 +134,11 @@ func (i *Identity) Register(req *api.RegistrationRequest) (rr *api.RegistrationR
 	if err != nil {
 		return nil, err
 	}
+	// The response to a retry of the request, which the server replays,
+	// does not have the secret
+	if resp.Secret == "" {
+		resp.Secret = req.Secret
+	}
 
 	log.Debug("The register request completed successfully")
 	return resp, nil
@@ -148,7 +168,25 @@ func (i *Identity) RegisterAndEnroll(req *api.RegistrationRequest) (*Identity, e
 func (i *Identity) Reenroll(req *api.ReenrollmentRequest) (*EnrollmentResponse, error) {
 	log.Debugf("Reenrolling %s", util.StructToString(req))
 
-	csrPEM, key, err := i.client.GenCSR(req.CSR, i.GetName())
+	var reuseKey bccsp.Key
+	if req.ReuseKey {
+		ecert := i.GetECert()
+		if ecert == nil {
+			return nil, errors.Errorf("Identity '%s' has no enrollment certificate whose key can be reused", i.GetName())
+		}
+		reuseKey = ecert.Key()
+	}
+	csrInfo := req.CSR
+	profile := req.Profile
+	if req.SVID {
+		var err error
+		profile, err = i.client.svidProfile(req.CAName, req.Profile)
+		if err != nil {
+			return nil, err
+		}
+		csrInfo = svidCSRInfo(csrInfo)
+	}
+	csrPEM, key, err := i.client.genCSR(csrInfo, i.GetName(), reuseKey)
 	if err != nil {
 		return nil, err
 	}
@@ -159,11 +197,11 @@ func (i *Identity) Reenroll(req *api.ReenrollmentRequest) (*EnrollmentResponse,
 	}
 
 	// Get the body of the request
-	if req.CSR != nil {
-		reqNet.SignRequest.Hosts = req.CSR.Hosts
+	if csrInfo != nil {
+		reqNet.SignRequest.Hosts = csrInfo.Hosts
 	}
 	reqNet.SignRequest.Request = string(csrPEM)
-	reqNet.SignRequest.Profile = req.Profile
+	reqNet.SignRequest.Profile = profile
 	reqNet.SignRequest.Label = req.Label
 
 	body, err := util.Marshal(reqNet, "SignRequest")
@@ -185,7 +223,7 @@ func (i *Identity) Revoke(req *api.RevocationRequest) (*api.RevocationResponse,
 	if err != nil {
 		return nil, err
 	}
-	var result revocationResponseNet
+	var result api.RevocationResponseNet
 	err = i.Post("revoke", reqBody, &result, nil)
 	if err != nil {
 		return nil, err
@@ -215,17 +253,58 @@ func (i *Identity) GenCRL(req *api.GenCRLRequest) (*api.GenCRLResponse, error) {
 	if err != nil {
 		return nil, err
 	}
-	var result genCRLResponseNet
-	err = i.Post("gencrl", reqBody, &result, nil)
+	httpReq, err := i.client.newPost("gencrl", reqBody)
+	if err != nil {
+		return nil, err
+	}
+	err = i.addTokenAuthHdr(httpReq, reqBody)
 	if err != nil {
 		return nil, err
 	}
+	var result api.GenCRLResponseNet
+	cr := newConditionalResult(httpReq, req.ETag, &result)
+	err = i.client.SendReq(httpReq, cr)
+	if err != nil {
+		return nil, err
+	}
+	if cr.notModified {
+		log.Debugf("The CRL is unchanged: %+v", req)
+		return &api.GenCRLResponse{ETag: cr.etag, NotModified: true}, nil
+	}
 	log.Debugf("Successfully generated CRL: %+v", req)
 	crl, err := util.B64Decode(result.CRL)
 	if err != nil {
 		return nil, err
 	}
-	return &api.GenCRLResponse{CRL: crl}, nil
+	return &api.GenCRLResponse{CRL: crl, ETag: cr.etag}, nil
+}
+
+// GenCRLAs generates a CRL and returns it in the format 'format', as
+// returned by the server: the JSON response, or the PEM or DER CRL
+func (i *Identity) GenCRLAs(req *api.GenCRLRequest, format Format) ([]byte, error) {
+	log.Debugf("Entering identity.GenCRLAs %+v", req)
+	mediaType, err := format.crlMediaType()
+	if err != nil {
+		return nil, err
+	}
+	reqBody, err := util.Marshal(req, "GenCRLRequest")
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := i.client.newPost("gencrl", reqBody)
+	if err != nil {
+		return nil, err
+	}
+	err = i.addTokenAuthHdr(httpReq, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	result := newEncodedResult(httpReq, mediaType)
+	err = i.client.SendReq(httpReq, result)
+	if err != nil {
+		return nil, err
+	}
+	return result.body, nil
 }
 
 // GetCRI gets Idemix credential revocation information (CRI)
@@ -244,6 +323,45 @@ func (i *Identity) GetCRI(req *api.GetCRIRequest) (*api.GetCRIResponse, error) {
 	return &result, nil
 }
 
+// GetLogLevel returns the log level of the server
+func (i *Identity) GetLogLevel() (*api.LogLevelResponse, error) {
+	log.Debug("Entering identity.GetLogLevel")
+	result := &api.LogLevelResponse{}
+	err := i.Get("loglevel", "", result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SetLogLevel sets the log level of the server
+func (i *Identity) SetLogLevel(req *api.LogLevelRequest) (*api.LogLevelResponse, error) {
+	log.Debugf("Entering identity.SetLogLevel %+v", req)
+	reqBody, err := util.Marshal(req, "LogLevelRequest")
+	if err != nil {
+		return nil, err
+	}
+	result := &api.LogLevelResponse{}
+	err = i.Put("loglevel", reqBody, nil, result)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Successfully set log level to '%s'", result.Level)
+	return result, nil
+}
+
+// SelfTest runs the self-test of the signing and verification path of each
+// CA of the server and returns the result
+func (i *Identity) SelfTest() (*api.SelfTestResponse, error) {
+	log.Debug("Entering identity.SelfTest")
+	result := &api.SelfTestResponse{}
+	err := i.Post("selftest", nil, result, nil)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
 // GetIdentity returns information about the requested identity
 func (i *Identity) GetIdentity(id, caname string) (*api.GetIDResponse, error) {
 	log.Debugf("Entering identity.GetIdentity %s", id)
@@ -270,6 +388,28 @@ func (i *Identity) GetAllIdentities(caname string, cb func(*json.Decoder) error)
 	return nil
 }
 
+// GetFilteredIdentities calls 'cb' with each of the identities of the type
+// and affiliation of 'req' that the caller is authorized to see. Unlike
+// GetAllIdentities, it prints nothing if there are none.
+func (i *Identity) GetFilteredIdentities(req *api.GetAllIDsRequest, cb func(*json.Decoder) error) error {
+	log.Debugf("Entering identity.GetFilteredIdentities with request: %+v", req)
+	queryParam := map[string]string{
+		"ca":          req.CAName,
+		"type":        req.Type,
+		"affiliation": req.Affiliation,
+	}
+	httpReq, err := i.newStreamRequest("identities", queryParam)
+	if err != nil {
+		return err
+	}
+	_, err = i.client.streamResponse(httpReq, "result.identities", cb)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Successfully retrieved identities")
+	return nil
+}
+
 // AddIdentity adds a new identity to the server
 func (i *Identity) AddIdentity(req *api.AddIdentityRequest) (*api.IdentityResponse, error) {
 	log.Debugf("Entering identity.AddIdentity with request: %+v", req)
@@ -468,12 +608,29 @@ func (i *Identity) Store() error {
 	if i.client == nil {
 		return errors.New("An identity with no client may not be stored")
 	}
+	if i.client.InMemory {
+		return errors.New("The identity of a client which keeps its keys in memory may not be stored")
+	}
+	var key bccsp.Key
+	if i.client.Config.KeyEncryption.Enabled {
+		if signer := i.GetECert(); signer != nil {
+			key = signer.Key()
+			// Nothing is stored if the passphrase can't be obtained
+			_, err := i.client.keyPassphrase(true)
+			if err != nil {
+				return err
+			}
+		}
+	}
 	for _, cred := range i.creds {
 		err := cred.Store()
 		if err != nil {
 			return err
 		}
 	}
+	if key != nil {
+		return i.client.storeEncryptedKey(key)
+	}
 	return nil
 }
 
@@ -495,22 +652,30 @@ func (i *Identity) Get(endpoint, caname string, result interface{}) error {
 
 // GetStreamResponse sends a request to an endpoint and streams the response
 func (i *Identity) GetStreamResponse(endpoint string, queryParam map[string]string, stream string, cb func(*json.Decoder) error) error {
-	req, err := i.client.newGet(endpoint)
+	req, err := i.newStreamRequest(endpoint, queryParam)
 	if err != nil {
 		return err
 	}
-	if queryParam != nil {
-		for key, value := range queryParam {
-			if value != "" {
-				addQueryParm(req, key, value)
-			}
+	return i.client.StreamResponse(req, stream, cb)
+}
+
+// newStreamRequest returns the authorized get request of an endpoint which
+// streams its response, with the non-empty query parameters 'queryParam'
+func (i *Identity) newStreamRequest(endpoint string, queryParam map[string]string) (*http.Request, error) {
+	req, err := i.client.newGet(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range queryParam {
+		if value != "" {
+			addQueryParm(req, key, value)
 		}
 	}
 	err = i.addTokenAuthHdr(req, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return i.client.StreamResponse(req, stream, cb)
+	return req, nil
 }
 
 // Put sends a put request to an endpoint
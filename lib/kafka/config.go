@@ -0,0 +1,113 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package kafka implements a producer which publishes messages to a topic
+// of an Apache Kafka cluster. It speaks the subset of the Kafka protocol
+// which producing requires, Metadata and Produce with record batches, over
+// plain TCP or TLS, with SASL PLAIN or SCRAM authentication, so that
+// publishing events does not depend on a Kafka client library.
+//
+// The producer is only built with the 'kafka' tag, so that it is left out of
+// the default binaries; its configuration is always built.
+package kafka
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	stls "github.com/hyperledger/fabric-ca/lib/tls"
+	"github.com/pkg/errors"
+)
+
+// The SASL mechanisms with which the producer may authenticate
+const (
+	SASLPlain       = "PLAIN"
+	SASLSCRAMSHA256 = "SCRAM-SHA-256"
+	SASLSCRAMSHA512 = "SCRAM-SHA-512"
+)
+
+// The defaults of the configuration
+const (
+	defaultClientID = "fabric-ca-server"
+	defaultTimeout  = 10 * time.Second
+)
+
+// Config is the configuration of a producer
+type Config struct {
+	// Addresses (host:port) of the brokers from which the cluster is discovered
+	Brokers []string
+	// Topic to which the messages are published
+	Topic string
+	// Client ID of the requests to the brokers
+	ClientID string
+	// Acknowledgements which the leader of a partition waits for before
+	// answering: -1 (the default) for all in-sync replicas, or 1 for the leader only
+	RequiredAcks int
+	// Maximum time of each request to a broker
+	Timeout time.Duration
+	// TLS configuration of the connections to the brokers
+	TLS stls.ClientTLSConfig
+	// SASL authentication of the connections to the brokers
+	SASL SASLConfig
+}
+
+// SASLConfig is the SASL authentication of the connections to the brokers
+type SASLConfig struct {
+	// PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512; if not set, the connections are
+	// not authenticated
+	Mechanism string
+	Username  string
+	Password  string `mask:"password"`
+}
+
+// Validate checks the configuration, setting the defaults of the settings
+// which are not set
+func (c *Config) Validate() error {
+	if len(c.Brokers) == 0 {
+		return errors.New("No Kafka brokers are configured")
+	}
+	for _, b := range c.Brokers {
+		_, port, err := net.SplitHostPort(b)
+		if err == nil {
+			_, err = strconv.Atoi(port)
+		}
+		if err != nil {
+			return errors.Errorf("Invalid Kafka broker address '%s'; it must be <host>:<port>", b)
+		}
+	}
+	if c.Topic == "" {
+		return errors.New("The Kafka topic is not set")
+	}
+	switch c.RequiredAcks {
+	case 0:
+		c.RequiredAcks = -1
+	case -1, 1:
+	default:
+		return errors.Errorf("Invalid Kafka required acknowledgements %d; it must be -1 or 1", c.RequiredAcks)
+	}
+	if c.Timeout < 0 {
+		return errors.New("The Kafka timeout must not be negative")
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultTimeout
+	}
+	if c.ClientID == "" {
+		c.ClientID = defaultClientID
+	}
+	c.SASL.Mechanism = strings.ToUpper(c.SASL.Mechanism)
+	switch c.SASL.Mechanism {
+	case "":
+	case SASLPlain, SASLSCRAMSHA256, SASLSCRAMSHA512:
+		if c.SASL.Username == "" {
+			return errors.New("The Kafka SASL username is not set")
+		}
+	default:
+		return errors.Errorf("Invalid Kafka SASL mechanism '%s'; it must be %s, %s or %s", c.SASL.Mechanism, SASLPlain, SASLSCRAMSHA256, SASLSCRAMSHA512)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigValidate(t *testing.T) {
+	for _, cfg := range []Config{
+		{Topic: "events"},
+		{Brokers: []string{"localhost"}, Topic: "events"},
+		{Brokers: []string{"localhost:9092"}},
+		{Brokers: []string{"localhost:9092"}, Topic: "events", RequiredAcks: 2},
+		{Brokers: []string{"localhost:9092"}, Topic: "events", Timeout: -time.Second},
+		{Brokers: []string{"localhost:9092"}, Topic: "events", SASL: SASLConfig{Mechanism: "GSSAPI", Username: "ca"}},
+		{Brokers: []string{"localhost:9092"}, Topic: "events", SASL: SASLConfig{Mechanism: "PLAIN"}},
+	} {
+		assert.Error(t, cfg.Validate(), "The configuration %+v should be invalid", cfg)
+	}
+	cfg := &Config{Brokers: []string{"localhost:9092"}, Topic: "events"}
+	assert.NoError(t, cfg.Validate())
+	assert.Equal(t, -1, cfg.RequiredAcks)
+	assert.Equal(t, defaultTimeout, cfg.Timeout)
+	assert.Equal(t, defaultClientID, cfg.ClientID)
+}
@@ -0,0 +1,267 @@
+// +build kafka
+
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	stls "github.com/hyperledger/fabric-ca/lib/tls"
+	"github.com/hyperledger/fabric/bccsp"
+	"github.com/pkg/errors"
+)
+
+// Message is a message published to the topic
+type Message struct {
+	// Key of the message, which selects its partition; messages with the
+	// same key are kept in order
+	Key []byte
+	// Value of the message
+	Value []byte
+	// Headers of the message
+	Headers []Header
+	// Time of the message; if zero, the time at which it is published
+	Time time.Time
+}
+
+// Header is a header of a message
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// Producer publishes messages to the topic of its configuration. It
+// connects to the brokers when it first publishes, and discovers the leaders
+// of the partitions of the topic again after a failure.
+type Producer struct {
+	cfg       Config
+	tlsConfig *tls.Config
+	// Guards the following, and serializes the requests to the brokers
+	mutex sync.Mutex
+	// Addresses of the brokers by node ID
+	brokers map[int32]string
+	// Node ID of the leader of each partition
+	leaders []int32
+	// Connections to the brokers by address
+	conns         map[string]*brokerConn
+	correlationID int32
+}
+
+// New returns a producer with the configuration 'cfg', which has been
+// validated; relative file names are relative to 'homeDir'
+func New(cfg *Config, homeDir string, csp bccsp.BCCSP) (*Producer, error) {
+	p := &Producer{cfg: *cfg, conns: map[string]*brokerConn{}}
+	if !cfg.TLS.Enabled {
+		return p, nil
+	}
+	// The certificates of the brokers are verified with the trusted
+	// certificate files, or else the system's roots
+	tlsCfg := cfg.TLS
+	if len(tlsCfg.CertFiles) == 0 && tlsCfg.Client.CertFile == "" && !tlsCfg.Insecure {
+		p.tlsConfig = &tls.Config{ServerName: tlsCfg.ServerName}
+		return p, nil
+	}
+	err := stls.AbsTLSClient(&tlsCfg, homeDir)
+	if err != nil {
+		return nil, err
+	}
+	p.tlsConfig, err = stls.GetClientTLSConfig(&tlsCfg, csp)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to get the TLS configuration of the Kafka brokers")
+	}
+	return p, nil
+}
+
+// String returns the brokers and topic of the producer
+func (p *Producer) String() string {
+	return "kafka://" + strings.Join(p.cfg.Brokers, ",") + "/" + p.cfg.Topic
+}
+
+// Send publishes 'msgs' to the topic, returning once the leaders of their
+// partitions have acknowledged them as configured. If it fails, some of the
+// messages may have been published.
+func (p *Producer) Send(ctx context.Context, msgs []*Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	err := p.send(ctx, msgs)
+	if err != nil {
+		// The cluster is discovered again by the next attempt, in case the
+		// leaders of the partitions changed
+		p.leaders = nil
+		p.closeConns()
+	}
+	return err
+}
+
+func (p *Producer) send(ctx context.Context, msgs []*Message) error {
+	if p.leaders == nil {
+		err := p.refreshMetadata(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	// Group the messages by partition and the partitions by leader
+	byPartition := map[int32][]*Message{}
+	for _, m := range msgs {
+		part := partition(m.Key, len(p.leaders))
+		byPartition[part] = append(byPartition[part], m)
+	}
+	byLeader := map[int32]map[int32][]*Message{}
+	for part, pmsgs := range byPartition {
+		leader := p.leaders[part]
+		if leader < 0 {
+			return errors.Errorf("Partition %d of Kafka topic '%s' has no leader", part, p.cfg.Topic)
+		}
+		if byLeader[leader] == nil {
+			byLeader[leader] = map[int32][]*Message{}
+		}
+		byLeader[leader][part] = pmsgs
+	}
+	for leader, parts := range byLeader {
+		addr, ok := p.brokers[leader]
+		if !ok {
+			return errors.Errorf("The leader %d of Kafka topic '%s' is not a known broker", leader, p.cfg.Topic)
+		}
+		conn, err := p.conn(ctx, addr)
+		if err != nil {
+			return err
+		}
+		err = p.produce(ctx, conn, parts)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to publish to Kafka broker "+addr)
+		}
+	}
+	return nil
+}
+
+// refreshMetadata discovers the brokers of the cluster and the leaders of
+// the partitions of the topic from the first broker which answers
+func (p *Producer) refreshMetadata(ctx context.Context) error {
+	var lastErr error
+	for _, addr := range p.cfg.Brokers {
+		conn, err := p.conn(ctx, addr)
+		if err == nil {
+			err = p.metadata(ctx, conn)
+			if err == nil {
+				return nil
+			}
+		}
+		log.Debugf("Failed to get the metadata of Kafka topic '%s' from %s: %s", p.cfg.Topic, addr, err)
+		lastErr = err
+		p.closeConn(addr)
+	}
+	return errors.WithMessage(lastErr, "Failed to get the metadata of Kafka topic '"+p.cfg.Topic+"'")
+}
+
+// conn returns the connection to the broker at 'addr', connecting and
+// authenticating if it is not connected
+func (p *Producer) conn(ctx context.Context, addr string) (*brokerConn, error) {
+	if c, ok := p.conns[addr]; ok {
+		return c, nil
+	}
+	dialer := &net.Dialer{Timeout: p.cfg.Timeout}
+	var nc net.Conn
+	var err error
+	if p.tlsConfig != nil {
+		tlsCfg := p.tlsConfig.Clone()
+		if tlsCfg.ServerName == "" {
+			tlsCfg.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		nc, err = tls.DialWithDialer(dialer, "tcp", addr, tlsCfg)
+	} else {
+		nc, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to connect to Kafka broker %s", addr)
+	}
+	c := &brokerConn{Conn: nc, addr: addr}
+	if p.cfg.SASL.Mechanism != "" {
+		err = p.authenticate(ctx, c)
+		if err != nil {
+			nc.Close()
+			return nil, errors.WithMessage(err, "Failed to authenticate to Kafka broker "+addr)
+		}
+	}
+	p.conns[addr] = c
+	return c, nil
+}
+
+func (p *Producer) closeConn(addr string) {
+	if c, ok := p.conns[addr]; ok {
+		c.Close()
+		delete(p.conns, addr)
+	}
+}
+
+func (p *Producer) closeConns() {
+	for addr := range p.conns {
+		p.closeConn(addr)
+	}
+}
+
+// Close closes the connections to the brokers
+func (p *Producer) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closeConns()
+}
+
+// partition returns the partition of a message with the key 'key' among
+// 'n' partitions, as chosen by the default partitioner of the Java client,
+// so that the messages of a key are in the same partition whichever client
+// publishes them
+func partition(key []byte, n int) int32 {
+	if len(key) == 0 || n <= 1 {
+		return 0
+	}
+	return int32((murmur2(key) & 0x7fffffff) % uint32(n))
+}
+
+// murmur2 is the hash of the keys of messages of the Java client
+func murmur2(data []byte) uint32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
@@ -0,0 +1,62 @@
+// +build kafka
+
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package kafka
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBroker publishes to a local Kafka cluster, whose brokers are listed
+// in FABRIC_CA_TEST_KAFKA_BROKERS, for example:
+//
+//	FABRIC_CA_TEST_KAFKA_BROKERS=localhost:9092 go test -tags kafka ./lib/kafka
+//
+// The topic, FABRIC_CA_TEST_KAFKA_TOPIC or fabric-ca-test, is created by the
+// first request if the cluster creates topics automatically.
+func TestBroker(t *testing.T) {
+	brokers := os.Getenv("FABRIC_CA_TEST_KAFKA_BROKERS")
+	if brokers == "" {
+		t.Skip("FABRIC_CA_TEST_KAFKA_BROKERS is not set")
+	}
+	topic := os.Getenv("FABRIC_CA_TEST_KAFKA_TOPIC")
+	if topic == "" {
+		topic = "fabric-ca-test"
+	}
+	cfg := &Config{
+		Brokers: strings.Split(brokers, ","),
+		Topic:   topic,
+		SASL: SASLConfig{
+			Mechanism: os.Getenv("FABRIC_CA_TEST_KAFKA_SASL_MECHANISM"),
+			Username:  os.Getenv("FABRIC_CA_TEST_KAFKA_SASL_USERNAME"),
+			Password:  os.Getenv("FABRIC_CA_TEST_KAFKA_SASL_PASSWORD"),
+		},
+	}
+	p := newTestProducer(t, cfg)
+	defer p.Close()
+
+	msgs := []*Message{
+		{Key: []byte("user1"), Value: []byte(`{"type":"cert.issued"}`), Headers: []Header{{Key: "X-Fabric-CA-Event-Type", Value: []byte("cert.issued")}}},
+		{Key: []byte("user1"), Value: []byte(`{"type":"cert.revoked"}`)},
+		{Key: []byte("user2"), Value: []byte(`{"type":"identity.registered"}`)},
+	}
+	// The leaders of the partitions of a new topic are elected after a while
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		err = p.Send(context.Background(), msgs)
+		if err == nil {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	t.Fatalf("Failed to publish to %s: %s", p, err)
+}
@@ -0,0 +1,436 @@
+// +build kafka
+
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package kafka
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBroker is a Kafka broker which is the only broker of its cluster and
+// the leader of every partition of its topic. It records the messages
+// published to each partition.
+type fakeBroker struct {
+	t          *testing.T
+	ln         net.Listener
+	topic      string
+	partitions int
+	// SASL mechanism and credentials which are required, if set
+	mechanism string
+	username  string
+	password  string
+	mutex     sync.Mutex
+	// Error code of the next produce requests, which fail
+	failProduce []int16
+	metadata    int
+	messages    map[int32][]*Message
+}
+
+// newFakeBroker returns a started broker which requires the SASL mechanism
+// 'mechanism', if not empty, with the credentials 'username' and 'password'
+func newFakeBroker(t *testing.T, topic string, partitions int, mechanism, username, password string) *fakeBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	b := &fakeBroker{t: t, ln: ln, topic: topic, partitions: partitions, messages: map[int32][]*Message{},
+		mechanism: mechanism, username: username, password: password}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(c)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) addr() string {
+	return b.ln.Addr().String()
+}
+
+func (b *fakeBroker) close() {
+	b.ln.Close()
+}
+
+// failNext makes the next produce requests fail with the error codes 'codes'
+func (b *fakeBroker) failNext(codes ...int16) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failProduce = codes
+}
+
+func (b *fakeBroker) metadataRequests() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.metadata
+}
+
+func (b *fakeBroker) published(part int32) []*Message {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.messages[part]
+}
+
+// serve answers the requests of a connection
+func (b *fakeBroker) serve(c net.Conn) {
+	defer c.Close()
+	authenticated := b.mechanism == ""
+	var scram *fakeSCRAM
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(c, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(c, req); err != nil {
+			return
+		}
+		d := &decoder{buf: req}
+		key := d.int16()
+		version := d.int16()
+		id := d.int32()
+		d.string() // client ID
+		resp := &encoder{}
+		resp.int32(0)
+		resp.int32(id)
+		switch {
+		case key == apiSaslHandshake && version == saslHandshakeVersion:
+			mechanism := d.string()
+			if mechanism == b.mechanism {
+				resp.int16(0)
+			} else {
+				resp.int16(33)
+			}
+			resp.int32(1)
+			resp.string(b.mechanism)
+		case key == apiSaslAuthenticate:
+			msg := d.bytes()
+			var reply []byte
+			ok := false
+			if b.mechanism == SASLPlain {
+				ok = string(msg) == "\x00"+b.username+"\x00"+b.password
+				authenticated = ok
+			} else if scram == nil {
+				scram = &fakeSCRAM{broker: b}
+				reply, ok = scram.first(string(msg))
+			} else {
+				reply, ok = scram.final(string(msg))
+				authenticated = ok
+			}
+			if ok {
+				resp.int16(0)
+				resp.nullString()
+			} else {
+				resp.int16(58)
+				resp.string("Authentication failed: Invalid username or password")
+			}
+			resp.bytes(reply)
+		case !authenticated:
+			return
+		case key == apiMetadata && version == metadataVersion:
+			b.mutex.Lock()
+			b.metadata++
+			b.mutex.Unlock()
+			host, port, _ := net.SplitHostPort(b.addr())
+			p, _ := strconv.Atoi(port)
+			resp.int32(1)
+			resp.int32(1)
+			resp.string(host)
+			resp.int32(int32(p))
+			resp.nullString()
+			resp.int32(1) // controller
+			resp.int32(1)
+			resp.int16(0)
+			resp.string(b.topic)
+			resp.int8(0)
+			resp.int32(int32(b.partitions))
+			for i := 0; i < b.partitions; i++ {
+				resp.int16(0)
+				resp.int32(int32(i))
+				resp.int32(1)
+				resp.int32(1)
+				resp.int32(1)
+				resp.int32(1)
+				resp.int32(1)
+			}
+		case key == apiProduce && version == produceVersion:
+			resp.buf = append(resp.buf, b.produce(d)...)
+		default:
+			b.t.Errorf("Unexpected request %d version %d", key, version)
+			return
+		}
+		binary.BigEndian.PutUint32(resp.buf, uint32(len(resp.buf)-4))
+		if _, err := c.Write(resp.buf); err != nil {
+			return
+		}
+	}
+}
+
+// produce records the messages of a produce request and returns its response
+func (b *fakeBroker) produce(d *decoder) []byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var code int16
+	if len(b.failProduce) > 0 {
+		code = b.failProduce[0]
+		b.failProduce = b.failProduce[1:]
+	}
+	if d.string() != "" {
+		b.t.Error("The transactional ID should be null")
+	}
+	assert.Equal(b.t, int16(-1), d.int16(), "All replicas should acknowledge")
+	d.int32() // timeout
+	resp := &encoder{}
+	resp.int32(int32(d.arrayLen()))
+	topic := d.string()
+	assert.Equal(b.t, b.topic, topic)
+	resp.string(topic)
+	n := d.arrayLen()
+	resp.int32(int32(n))
+	for i := 0; i < n; i++ {
+		part := d.int32()
+		msgs := b.decodeBatch(d.bytes())
+		if code == 0 {
+			b.messages[part] = append(b.messages[part], msgs...)
+		}
+		resp.int32(part)
+		resp.int16(code)
+		resp.int64(0)
+		resp.int64(-1)
+	}
+	resp.int32(0) // throttle time
+	return resp.buf
+}
+
+// decodeBatch verifies a record batch and returns its messages
+func (b *fakeBroker) decodeBatch(batch []byte) []*Message {
+	d := &decoder{buf: batch}
+	d.int64() // base offset
+	length := d.int32()
+	assert.Equal(b.t, int(length), len(d.buf), "Invalid batch length")
+	d.int32() // partition leader epoch
+	assert.Equal(b.t, []byte{2}, d.next(1), "The magic should be 2")
+	crc := uint32(d.int32())
+	assert.Equal(b.t, crc32.Checksum(d.buf, castagnoli), crc, "Invalid CRC of the batch")
+	d.int16() // attributes
+	d.int32() // last offset delta
+	firstTS := d.int64()
+	d.int64()
+	d.next(14) // producer ID, epoch and base sequence
+	count := d.int32()
+	msgs := []*Message{}
+	for i := int32(0); i < count; i++ {
+		varint(d) // length
+		d.next(1)
+		ts := firstTS + varint(d)
+		assert.Equal(b.t, int64(i), varint(d), "Invalid offset delta")
+		m := &Message{Key: varbytes(d), Value: varbytes(d), Time: time.Unix(0, ts*int64(time.Millisecond))}
+		headers := varint(d)
+		for j := int64(0); j < headers; j++ {
+			m.Headers = append(m.Headers, Header{Key: string(varbytes(d)), Value: varbytes(d)})
+		}
+		msgs = append(msgs, m)
+	}
+	assert.NoError(b.t, d.err)
+	assert.Empty(b.t, d.buf, "The batch should have no trailing bytes")
+	return msgs
+}
+
+func varint(d *decoder) int64 {
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func varbytes(d *decoder) []byte {
+	n := varint(d)
+	if n < 0 {
+		return nil
+	}
+	return d.next(int(n))
+}
+
+// fakeSCRAM is the broker's side of a SCRAM-SHA-256 authentication
+type fakeSCRAM struct {
+	broker      *fakeBroker
+	clientFirst string
+	serverFirst string
+	nonce       string
+	salt        []byte
+}
+
+func (s *fakeSCRAM) first(msg string) ([]byte, bool) {
+	if !strings.HasPrefix(msg, "n,,") {
+		return nil, false
+	}
+	s.clientFirst = msg[3:]
+	attrs := scramAttributes(s.clientFirst)
+	if attrs["n"] != s.broker.username {
+		return nil, false
+	}
+	s.nonce = attrs["r"] + "servernonce"
+	s.salt = []byte("salt")
+	s.serverFirst = "r=" + s.nonce + ",s=" + base64.StdEncoding.EncodeToString(s.salt) + ",i=4096"
+	return []byte(s.serverFirst), true
+}
+
+func (s *fakeSCRAM) final(msg string) ([]byte, bool) {
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, false
+	}
+	finalBare := msg[:i]
+	proof, _ := base64.StdEncoding.DecodeString(msg[i+3:])
+	salted := pbkdf2([]byte(s.broker.password), s.salt, 4096, sha256.New)
+	clientKey := hmacSum(sha256.New, salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	authMessage := s.clientFirst + "," + s.serverFirst + "," + finalBare
+	signature := hmacSum(sha256.New, storedKey[:], []byte(authMessage))
+	if len(proof) != len(signature) || finalBare != "c=biws,r="+s.nonce {
+		return nil, false
+	}
+	for j := range proof {
+		if proof[j]^signature[j] != clientKey[j] {
+			return nil, false
+		}
+	}
+	serverKey := hmacSum(sha256.New, salted, []byte("Server Key"))
+	return []byte("v=" + base64.StdEncoding.EncodeToString(hmacSum(sha256.New, serverKey, []byte(authMessage)))), true
+}
+
+func newTestProducer(t *testing.T, cfg *Config) *Producer {
+	err := cfg.Validate()
+	if err != nil {
+		t.Fatalf("Invalid configuration: %s", err)
+	}
+	p, err := New(cfg, "", nil)
+	if err != nil {
+		t.Fatalf("Failed to create the producer: %s", err)
+	}
+	return p
+}
+
+func TestSend(t *testing.T) {
+	b := newFakeBroker(t, "events", 3, "", "", "")
+	defer b.close()
+	p := newTestProducer(t, &Config{Brokers: []string{"127.0.0.1:1", b.addr()}, Topic: "events"})
+	defer p.Close()
+	assert.Equal(t, "kafka://127.0.0.1:1,"+b.addr()+"/events", p.String())
+
+	// The messages of a key are published to the same partition, in order
+	ts := time.Unix(1500000000, 0)
+	msgs := []*Message{}
+	for i := 0; i < 4; i++ {
+		msgs = append(msgs, &Message{
+			Key:     []byte("user1"),
+			Value:   []byte(strconv.Itoa(i)),
+			Headers: []Header{{Key: "type", Value: []byte("cert.issued")}},
+			Time:    ts.Add(time.Duration(i) * time.Second),
+		})
+	}
+	msgs = append(msgs, &Message{Key: []byte("admin"), Value: []byte("admin")})
+	err := p.Send(context.Background(), msgs)
+	if err != nil {
+		t.Fatalf("Failed to publish the messages: %s", err)
+	}
+	user1 := b.published(partition([]byte("user1"), 3))
+	if assert.Len(t, user1, 4) {
+		for i, m := range user1 {
+			assert.Equal(t, "user1", string(m.Key))
+			assert.Equal(t, strconv.Itoa(i), string(m.Value))
+			assert.Equal(t, []Header{{Key: "type", Value: []byte("cert.issued")}}, m.Headers)
+			assert.True(t, msgs[i].Time.Equal(m.Time), "The time of the message should be kept")
+		}
+	}
+	admin := b.published(partition([]byte("admin"), 3))
+	if assert.NotEmpty(t, admin) {
+		assert.Equal(t, "admin", string(admin[len(admin)-1].Value))
+	}
+
+	// A failure makes the next attempt discover the leaders again
+	b.failNext(6)
+	err = p.Send(context.Background(), []*Message{{Key: []byte("user1"), Value: []byte("4")}})
+	assert.Contains(t, err.Error(), "NOT_LEADER_OR_FOLLOWER")
+	err = p.Send(context.Background(), []*Message{{Key: []byte("user1"), Value: []byte("4")}})
+	assert.NoError(t, err)
+	assert.Len(t, b.published(partition([]byte("user1"), 3)), 5)
+	assert.Equal(t, 2, b.metadataRequests())
+
+	// The topic must exist
+	p = newTestProducer(t, &Config{Brokers: []string{b.addr()}, Topic: "other"})
+	defer p.Close()
+	err = p.Send(context.Background(), msgs)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "has no partitions")
+	}
+}
+
+func TestSASL(t *testing.T) {
+	for _, mechanism := range []string{SASLPlain, SASLSCRAMSHA256} {
+		b := newFakeBroker(t, "events", 1, mechanism, "fabric-ca", "kafkapw")
+		p := newTestProducer(t, &Config{Brokers: []string{b.addr()}, Topic: "events",
+			SASL: SASLConfig{Mechanism: strings.ToLower(mechanism), Username: "fabric-ca", Password: "kafkapw"}})
+		err := p.Send(context.Background(), []*Message{{Value: []byte("event")}})
+		assert.NoError(t, err, "Authentication with %s should succeed", mechanism)
+		assert.Len(t, b.published(0), 1)
+		p.Close()
+
+		p = newTestProducer(t, &Config{Brokers: []string{b.addr()}, Topic: "events",
+			SASL: SASLConfig{Mechanism: mechanism, Username: "fabric-ca", Password: "wrong"}})
+		err = p.Send(context.Background(), []*Message{{Value: []byte("event")}})
+		if assert.Error(t, err, "Authentication with %s and a wrong password should fail", mechanism) {
+			assert.Contains(t, err.Error(), "SASL_AUTHENTICATION_FAILED")
+		}
+		p.Close()
+
+		p = newTestProducer(t, &Config{Brokers: []string{b.addr()}, Topic: "events",
+			SASL: SASLConfig{Mechanism: SASLSCRAMSHA512, Username: "fabric-ca", Password: "kafkapw"}})
+		err = p.Send(context.Background(), []*Message{{Value: []byte("event")}})
+		if assert.Error(t, err, "An unsupported mechanism should fail") {
+			assert.Contains(t, err.Error(), "UNSUPPORTED_SASL_MECHANISM")
+		}
+		p.Close()
+		b.close()
+	}
+}
+
+func TestPartition(t *testing.T) {
+	// The hashes of the Java client
+	for key, hash := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		assert.Equal(t, hash, int32(murmur2([]byte(key))), "Invalid hash of '%s'", key)
+	}
+	assert.Equal(t, int32(0), partition(nil, 3))
+	assert.Equal(t, int32(0), partition([]byte("user1"), 1))
+}
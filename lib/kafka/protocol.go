@@ -0,0 +1,410 @@
+// +build kafka
+
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The keys and versions of the requests of the Kafka protocol which are made
+const (
+	apiProduce          = 0
+	apiMetadata         = 3
+	apiSaslHandshake    = 17
+	apiSaslAuthenticate = 36
+
+	produceVersion          = 3
+	metadataVersion         = 1
+	saslHandshakeVersion    = 1
+	saslAuthenticateVersion = 0
+)
+
+// The maximum size of a response which is read
+const maxResponseSize = 16 << 20
+
+// errorNames are the names of the error codes of the Kafka protocol which a
+// producer may get
+var errorNames = map[int16]string{
+	2:  "CORRUPT_MESSAGE",
+	3:  "UNKNOWN_TOPIC_OR_PARTITION",
+	5:  "LEADER_NOT_AVAILABLE",
+	6:  "NOT_LEADER_OR_FOLLOWER",
+	7:  "REQUEST_TIMED_OUT",
+	10: "MESSAGE_TOO_LARGE",
+	19: "NOT_ENOUGH_REPLICAS",
+	20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	29: "TOPIC_AUTHORIZATION_FAILED",
+	33: "UNSUPPORTED_SASL_MECHANISM",
+	34: "ILLEGAL_SASL_STATE",
+	35: "UNSUPPORTED_VERSION",
+	58: "SASL_AUTHENTICATION_FAILED",
+}
+
+// kafkaError returns the error of the error code 'code', or nil if it is 0
+func kafkaError(code int16) error {
+	if code == 0 {
+		return nil
+	}
+	name, ok := errorNames[code]
+	if !ok {
+		name = "error " + strconv.Itoa(int(code))
+	}
+	return errors.Errorf("Kafka error %s (%d)", name, code)
+}
+
+// brokerConn is a connection to a broker
+type brokerConn struct {
+	net.Conn
+	addr string
+}
+
+// roundTrip sends a request with the key 'key' and version 'version' whose
+// body is 'body', and returns the body of its response
+func (p *Producer) roundTrip(ctx context.Context, c *brokerConn, key, version int16, body []byte) (*decoder, error) {
+	p.correlationID++
+	id := p.correlationID
+	e := &encoder{}
+	e.int32(0)
+	e.int16(key)
+	e.int16(version)
+	e.int32(id)
+	e.string(p.cfg.ClientID)
+	e.buf = append(e.buf, body...)
+	binary.BigEndian.PutUint32(e.buf, uint32(len(e.buf)-4))
+
+	deadline := time.Now().Add(p.cfg.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.SetDeadline(deadline)
+	_, err := c.Write(e.buf)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to send the request")
+	}
+	var header [8]byte
+	_, err = io.ReadFull(c, header[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read the response")
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if size < 4 || size > maxResponseSize {
+		return nil, errors.Errorf("Invalid size %d of the response", size)
+	}
+	if got := int32(binary.BigEndian.Uint32(header[4:])); got != id {
+		return nil, errors.Errorf("The correlation ID %d of the response is not %d", got, id)
+	}
+	resp := make([]byte, size-4)
+	_, err = io.ReadFull(c, resp)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read the response")
+	}
+	return &decoder{buf: resp}, nil
+}
+
+// metadata gets the brokers and the leaders of the partitions of the topic
+func (p *Producer) metadata(ctx context.Context, c *brokerConn) error {
+	e := &encoder{}
+	e.int32(1)
+	e.string(p.cfg.Topic)
+	d, err := p.roundTrip(ctx, c, apiMetadata, metadataVersion, e.buf)
+	if err != nil {
+		return err
+	}
+	brokers := map[int32]string{}
+	n := d.arrayLen()
+	for i := 0; i < n; i++ {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.int32() // controller ID
+	var leaders []int32
+	n = d.arrayLen()
+	for i := 0; i < n; i++ {
+		code := d.int16()
+		name := d.string()
+		d.bool() // internal
+		parts := d.arrayLen()
+		topicLeaders := make([]int32, parts)
+		for j := 0; j < parts; j++ {
+			d.int16() // error code of the partition
+			id := d.int32()
+			leader := d.int32()
+			d.int32Array() // replicas
+			d.int32Array() // in-sync replicas
+			if id >= 0 && int(id) < parts {
+				topicLeaders[id] = leader
+			}
+		}
+		if name != p.cfg.Topic {
+			continue
+		}
+		if err := kafkaError(code); err != nil {
+			return err
+		}
+		leaders = topicLeaders
+	}
+	if d.err != nil {
+		return errors.WithMessage(d.err, "Invalid metadata response")
+	}
+	if len(leaders) == 0 {
+		return errors.Errorf("Kafka topic '%s' has no partitions", p.cfg.Topic)
+	}
+	p.brokers = brokers
+	p.leaders = leaders
+	return nil
+}
+
+// produce publishes the messages of each partition of 'parts' to their
+// leader, to which 'c' is connected
+func (p *Producer) produce(ctx context.Context, c *brokerConn, parts map[int32][]*Message) error {
+	e := &encoder{}
+	e.nullString()
+	e.int16(int16(p.cfg.RequiredAcks))
+	e.int32(int32(p.cfg.Timeout / time.Millisecond))
+	e.int32(1)
+	e.string(p.cfg.Topic)
+	e.int32(int32(len(parts)))
+	for part, msgs := range parts {
+		e.int32(part)
+		e.bytes(recordBatch(msgs, time.Now()))
+	}
+	d, err := p.roundTrip(ctx, c, apiProduce, produceVersion, e.buf)
+	if err != nil {
+		return err
+	}
+	var failed error
+	n := d.arrayLen()
+	for i := 0; i < n; i++ {
+		d.string() // topic
+		m := d.arrayLen()
+		for j := 0; j < m; j++ {
+			part := d.int32()
+			code := d.int16()
+			d.int64() // base offset
+			d.int64() // log append time
+			if err := kafkaError(code); err != nil && failed == nil {
+				failed = errors.WithMessage(err, fmt.Sprintf("Failed to publish to partition %d", part))
+			}
+		}
+	}
+	if d.err != nil {
+		return errors.WithMessage(d.err, "Invalid produce response")
+	}
+	return failed
+}
+
+// castagnoli is the table of the CRC of record batches
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// recordBatch returns the record batch (version 2) of 'msgs'
+func recordBatch(msgs []*Message, now time.Time) []byte {
+	first := msgs[0].Time
+	if first.IsZero() {
+		first = now
+	}
+	firstTS := first.UnixNano() / int64(time.Millisecond)
+	maxTS := firstTS
+	records := &encoder{}
+	for i, m := range msgs {
+		ts := firstTS
+		if !m.Time.IsZero() {
+			ts = m.Time.UnixNano() / int64(time.Millisecond)
+		}
+		if ts > maxTS {
+			maxTS = ts
+		}
+		r := &encoder{}
+		r.int8(0) // attributes
+		r.varint(ts - firstTS)
+		r.varint(int64(i))
+		r.varbytes(m.Key)
+		r.varbytes(m.Value)
+		r.varint(int64(len(m.Headers)))
+		for _, h := range m.Headers {
+			r.varbytes([]byte(h.Key))
+			r.varbytes(h.Value)
+		}
+		records.varint(int64(len(r.buf)))
+		records.buf = append(records.buf, r.buf...)
+	}
+
+	// The fields which follow the CRC, over which it is computed
+	tail := &encoder{}
+	tail.int16(0) // attributes: no compression
+	tail.int32(int32(len(msgs) - 1))
+	tail.int64(firstTS)
+	tail.int64(maxTS)
+	tail.int64(-1) // producer ID
+	tail.int16(-1) // producer epoch
+	tail.int32(-1) // base sequence
+	tail.int32(int32(len(msgs)))
+	tail.buf = append(tail.buf, records.buf...)
+
+	b := &encoder{}
+	b.int64(0) // base offset
+	b.int32(int32(4 + 1 + 4 + len(tail.buf)))
+	b.int32(-1) // partition leader epoch
+	b.int8(2)   // magic
+	b.int32(int32(crc32.Checksum(tail.buf, castagnoli)))
+	b.buf = append(b.buf, tail.buf...)
+	return b.buf
+}
+
+// encoder encodes the fields of requests
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) int8(v int8) {
+	e.buf = append(e.buf, byte(v))
+}
+
+func (e *encoder) int16(v int16) {
+	e.buf = append(e.buf, byte(v>>8), byte(v))
+}
+
+func (e *encoder) int32(v int32) {
+	e.buf = append(e.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *encoder) int64(v int64) {
+	e.int32(int32(v >> 32))
+	e.int32(int32(v))
+}
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) nullString() {
+	e.int16(-1)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) varint(v int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	e.buf = append(e.buf, tmp[:n]...)
+}
+
+// varbytes encodes 'b' with its length as a varint; nil is encoded as null
+func (e *encoder) varbytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// decoder decodes the fields of responses. The first failure is kept in
+// err, after which zero values are returned.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.buf) < n {
+		d.err = errors.New("The response is truncated")
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) bool() bool {
+	b := d.next(1)
+	return b != nil && b[0] != 0
+}
+
+func (d *decoder) int16() int16 {
+	b := d.next(2)
+	if b == nil {
+		return 0
+	}
+	return int16(binary.BigEndian.Uint16(b))
+}
+
+func (d *decoder) int32() int32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(b))
+}
+
+func (d *decoder) int64() int64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+// string decodes a string, which is empty if it is null
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+// bytes decodes bytes, which are nil if they are null
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.next(int(n))
+}
+
+// arrayLen decodes the length of an array, which is 0 if it is null
+func (d *decoder) arrayLen() int {
+	n := d.int32()
+	if n < 0 || d.err != nil {
+		return 0
+	}
+	if int(n) > len(d.buf) {
+		d.err = errors.New("The response is truncated")
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) int32Array() []int32 {
+	n := d.arrayLen()
+	a := make([]int32, 0, n)
+	for i := 0; i < n; i++ {
+		a = append(a, d.int32())
+	}
+	return a
+}
@@ -0,0 +1,166 @@
+// +build kafka
+
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package kafka
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// authenticate authenticates the connection 'c' with the SASL mechanism
+// of the configuration
+func (p *Producer) authenticate(ctx context.Context, c *brokerConn) error {
+	sasl := &p.cfg.SASL
+	e := &encoder{}
+	e.string(sasl.Mechanism)
+	d, err := p.roundTrip(ctx, c, apiSaslHandshake, saslHandshakeVersion, e.buf)
+	if err != nil {
+		return err
+	}
+	code := d.int16()
+	mechanisms := []string{}
+	n := d.arrayLen()
+	for i := 0; i < n; i++ {
+		mechanisms = append(mechanisms, d.string())
+	}
+	if err := kafkaError(code); err != nil {
+		return errors.WithMessage(err, "The broker supports the SASL mechanisms "+strings.Join(mechanisms, ", "))
+	}
+	if sasl.Mechanism == SASLPlain {
+		_, err = p.saslAuthenticate(ctx, c, []byte("\x00"+sasl.Username+"\x00"+sasl.Password))
+		return err
+	}
+	newHash := sha256.New
+	if sasl.Mechanism == SASLSCRAMSHA512 {
+		newHash = sha512.New
+	}
+	return p.scram(ctx, c, newHash)
+}
+
+// saslAuthenticate sends the SASL message 'msg' and returns the response
+func (p *Producer) saslAuthenticate(ctx context.Context, c *brokerConn, msg []byte) ([]byte, error) {
+	e := &encoder{}
+	e.bytes(msg)
+	d, err := p.roundTrip(ctx, c, apiSaslAuthenticate, saslAuthenticateVersion, e.buf)
+	if err != nil {
+		return nil, err
+	}
+	code := d.int16()
+	reason := d.string()
+	resp := d.bytes()
+	if err := kafkaError(code); err != nil {
+		if reason != "" {
+			return nil, errors.WithMessage(err, reason)
+		}
+		return nil, err
+	}
+	return resp, d.err
+}
+
+// scram authenticates with the SCRAM mechanism of RFC 5802 whose hash is
+// created by 'newHash'
+func (p *Producer) scram(ctx context.Context, c *brokerConn, newHash func() hash.Hash) error {
+	sasl := &p.cfg.SASL
+	var nonce [24]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		return errors.Wrap(err, "Failed to create the SCRAM nonce")
+	}
+	clientNonce := base64.RawStdEncoding.EncodeToString(nonce[:])
+	user := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(sasl.Username)
+	clientFirstBare := "n=" + user + ",r=" + clientNonce
+	serverFirst, err := p.saslAuthenticate(ctx, c, []byte("n,,"+clientFirstBare))
+	if err != nil {
+		return err
+	}
+	attrs := scramAttributes(string(serverFirst))
+	serverNonce, salt64, iterations := attrs["r"], attrs["s"], attrs["i"]
+	if !strings.HasPrefix(serverNonce, clientNonce) || len(serverNonce) == len(clientNonce) {
+		return errors.New("Invalid SCRAM nonce of the broker")
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return errors.Wrap(err, "Invalid SCRAM salt of the broker")
+	}
+	iter, err := strconv.Atoi(iterations)
+	if err != nil || iter < 1 {
+		return errors.Errorf("Invalid SCRAM iteration count '%s' of the broker", iterations)
+	}
+
+	saltedPassword := pbkdf2([]byte(sasl.Password), salt, iter, newHash)
+	clientKey := hmacSum(newHash, saltedPassword, []byte("Client Key"))
+	storedKey := newHash()
+	storedKey.Write(clientKey)
+	clientFinalBare := "c=biws,r=" + serverNonce
+	authMessage := clientFirstBare + "," + string(serverFirst) + "," + clientFinalBare
+	signature := hmacSum(newHash, storedKey.Sum(nil), []byte(authMessage))
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	serverFinal, err := p.saslAuthenticate(ctx, c, []byte(clientFinalBare+",p="+base64.StdEncoding.EncodeToString(proof)))
+	if err != nil {
+		return err
+	}
+	attrs = scramAttributes(string(serverFinal))
+	if reason, ok := attrs["e"]; ok {
+		return errors.Errorf("SCRAM authentication failed: %s", reason)
+	}
+	serverKey := hmacSum(newHash, saltedPassword, []byte("Server Key"))
+	expected := base64.StdEncoding.EncodeToString(hmacSum(newHash, serverKey, []byte(authMessage)))
+	if !hmac.Equal([]byte(attrs["v"]), []byte(expected)) {
+		return errors.New("Invalid SCRAM signature of the broker")
+	}
+	return nil
+}
+
+// scramAttributes returns the attributes of the SCRAM message 'msg' by name
+func scramAttributes(msg string) map[string]string {
+	attrs := map[string]string{}
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) > 2 && attr[1] == '=' {
+			attrs[attr[:1]] = attr[2:]
+		}
+	}
+	return attrs
+}
+
+func hmacSum(newHash func() hash.Hash, key, msg []byte) []byte {
+	mac := hmac.New(newHash, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+// pbkdf2 returns the key derived from 'password' by PBKDF2 (RFC 8018) with
+// one block of the size of the hash, which is the salted password of SCRAM
+func pbkdf2(password, salt []byte, iter int, newHash func() hash.Hash) []byte {
+	mac := hmac.New(newHash, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	key := append([]byte{}, u...)
+	for i := 1; i < iter; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
@@ -0,0 +1,355 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package kms
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	awsService = "kms"
+	// The addresses of the credentials endpoints of ECS containers and of
+	// the instance metadata service of EC2
+	awsContainerCredentialsHost = "http://169.254.170.2"
+	awsInstanceMetadataEndpoint = "http://169.254.169.254"
+	// Credentials are refreshed this long before they expire
+	awsCredentialsRefreshMargin = 5 * time.Minute
+)
+
+// awsTransientErrors are the types of the errors of AWS KMS after which a
+// request may be retried
+var awsTransientErrors = map[string]bool{
+	"ThrottlingException":        true,
+	"KMSInternalException":       true,
+	"DependencyTimeoutException": true,
+	"KeyUnavailableException":    true,
+}
+
+// awsCredentials are AWS credentials, which are temporary if they expire
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	SessionToken    string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// awsBackend is the API of AWS KMS
+type awsBackend struct {
+	cfg      *Config
+	client   *http.Client
+	region   string
+	endpoint string
+	now      func() time.Time
+	mutex    sync.Mutex
+	creds    *awsCredentials
+}
+
+func newAWSBackend(cfg *Config, client *http.Client) (*awsBackend, error) {
+	region := cfg.Region
+	if region == "" {
+		// arn:aws:kms:<region>:<account>:key/<id>
+		if parts := strings.Split(cfg.KeyID, ":"); len(parts) > 3 && parts[0] == "arn" {
+			region = parts[3]
+		}
+	}
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		return nil, errors.Errorf("The AWS region of the KMS key '%s' is not set; set 'kms.region' or use the key's ARN", cfg.KeyID)
+	}
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://kms." + region + ".amazonaws.com"
+	}
+	return &awsBackend{
+		cfg:      cfg,
+		client:   client,
+		region:   region,
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/",
+		now:      time.Now,
+	}, nil
+}
+
+func (b *awsBackend) publicKey(ctx context.Context) (crypto.PublicKey, error) {
+	var resp struct {
+		PublicKey []byte
+	}
+	err := b.call(ctx, "GetPublicKey", map[string]interface{}{"KeyId": b.cfg.KeyID}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(resp.PublicKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the public key returned by AWS KMS")
+	}
+	return pub, nil
+}
+
+func (b *awsBackend) sign(ctx context.Context, pub crypto.PublicKey, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash, err := hashName(opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+	var algorithm string
+	switch pub.(type) {
+	case *ecdsa.PublicKey:
+		algorithm = "ECDSA_" + hash
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			algorithm = "RSASSA_PSS_" + hash
+		} else {
+			algorithm = "RSASSA_PKCS1_V1_5_" + hash
+		}
+	}
+	var resp struct {
+		Signature []byte
+	}
+	err = b.call(ctx, "Sign", map[string]interface{}{
+		"KeyId":            b.cfg.KeyID,
+		"Message":          digest,
+		"MessageType":      "DIGEST",
+		"SigningAlgorithm": algorithm,
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Signature, nil
+}
+
+// call calls the action 'action' of AWS KMS with the request 'req' and
+// decodes its response into 'result'
+func (b *awsBackend) call(ctx context.Context, action string, req, result interface{}) error {
+	creds, err := b.credentials(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal the request to AWS KMS")
+	}
+	httpReq, err := http.NewRequest("POST", b.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "Failed to create the request to AWS KMS")
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	httpReq.Header.Set("X-Amz-Target", "TrentService."+action)
+	signV4(httpReq, body, creds, awsService, b.region, b.now())
+	resp, respBody, err := doHTTP(b.client, httpReq)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var awsErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(respBody, &awsErr)
+		// The type may be prefixed with its namespace
+		errType := awsErr.Type[strings.LastIndex(awsErr.Type, "#")+1:]
+		err = errors.Errorf("AWS KMS returned %d %s: %s", resp.StatusCode, errType, awsErr.Message)
+		if awsTransientErrors[errType] {
+			return &transientError{err}
+		}
+		return statusError(resp.StatusCode, err)
+	}
+	err = json.Unmarshal(respBody, result)
+	if err != nil {
+		return errors.Wrap(err, "Failed to parse the response of AWS KMS")
+	}
+	return nil
+}
+
+// credentials returns the AWS credentials, found as the AWS SDKs do: in the
+// environment, then in the shared credentials file, then from the
+// credentials endpoint of an ECS container and then from the instance
+// metadata service of EC2. Temporary credentials are cached until shortly
+// before they expire.
+func (b *awsBackend) credentials(ctx context.Context) (*awsCredentials, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.creds != nil && (b.creds.Expiration.IsZero() || b.now().Add(awsCredentialsRefreshMargin).Before(b.creds.Expiration)) {
+		return b.creds, nil
+	}
+	creds, err := b.findCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b.creds = creds
+	return creds, nil
+}
+
+func (b *awsBackend) findCredentials(ctx context.Context) (*awsCredentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return &awsCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	creds, err := awsSharedCredentials()
+	if creds != nil || err != nil {
+		return creds, err
+	}
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		return b.fetchCredentials(ctx, awsContainerCredentialsHost+uri, nil)
+	}
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); uri != "" {
+		var headers map[string]string
+		if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+			headers = map[string]string{"Authorization": token}
+		}
+		return b.fetchCredentials(ctx, uri, headers)
+	}
+	if strings.ToLower(os.Getenv("AWS_EC2_METADATA_DISABLED")) == "true" {
+		return nil, errors.New("No AWS credentials were found in the environment, the shared credentials file or the container credentials endpoint")
+	}
+	return b.instanceCredentials(ctx)
+}
+
+// awsSharedCredentials returns the credentials of the profile AWS_PROFILE, or
+// 'default', of the shared credentials file, or nil if there is no such file
+// or profile
+func awsSharedCredentials() (*awsCredentials, error) {
+	file := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if file == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return nil, nil
+		}
+		file = filepath.Join(home, ".aws", "credentials")
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil
+	}
+	defer f.Close()
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	var creds awsCredentials
+	inProfile := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			inProfile = strings.TrimSpace(strings.Trim(line, "[]")) == profile
+			continue
+		}
+		if !inProfile {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = value
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = value
+		case "aws_session_token":
+			creds.SessionToken = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "Failed to read the AWS shared credentials file '%s'", file)
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, nil
+	}
+	return &creds, nil
+}
+
+// instanceCredentials returns the credentials of the IAM role of the EC2
+// instance, from its instance metadata service (IMDSv2)
+func (b *awsBackend) instanceCredentials(ctx context.Context) (*awsCredentials, error) {
+	endpoint := os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT")
+	if endpoint == "" {
+		endpoint = awsInstanceMetadataEndpoint
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	req, err := http.NewRequest("PUT", endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create the request to the EC2 instance metadata service")
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	resp, token, err := doHTTP(b.client, req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.WithMessage(err, "No AWS credentials were found in the environment, the shared credentials file or the instance metadata service")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp.StatusCode, errors.Errorf("The EC2 instance metadata service returned %d to the token request", resp.StatusCode))
+	}
+	headers := map[string]string{"X-aws-ec2-metadata-token": string(token)}
+	rolesURL := endpoint + "/latest/meta-data/iam/security-credentials/"
+	role, err := b.get(ctx, rolesURL, headers)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(strings.SplitN(string(role), "\n", 2)[0])
+	if name == "" {
+		return nil, errors.New("The EC2 instance has no IAM role")
+	}
+	return b.fetchCredentials(ctx, rolesURL+name, headers)
+}
+
+// fetchCredentials returns the temporary credentials returned by 'url'
+func (b *awsBackend) fetchCredentials(ctx context.Context, url string, headers map[string]string) (*awsCredentials, error) {
+	body, err := b.get(ctx, url, headers)
+	if err != nil {
+		return nil, err
+	}
+	var creds awsCredentials
+	err = json.Unmarshal(body, &creds)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse the AWS credentials returned by '%s'", url)
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, errors.Errorf("'%s' did not return AWS credentials", url)
+	}
+	return &creds, nil
+}
+
+// get returns the body of the response to a GET request of 'url'
+func (b *awsBackend) get(ctx context.Context, url string, headers map[string]string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create the request of '%s'", url)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, body, err := doHTTP(b.client, req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp.StatusCode, errors.Errorf("'%s' returned %d", url, resp.StatusCode))
+	}
+	return body, nil
+}
@@ -0,0 +1,325 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	gcpEndpoint         = "https://cloudkms.googleapis.com"
+	gcpMetadataHost     = "metadata.google.internal"
+	gcpTokenURL         = "https://oauth2.googleapis.com/token"
+	gcpScope            = "https://www.googleapis.com/auth/cloudkms"
+	gcpJWTBearerGrant   = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	gcpTokenLifetime    = time.Hour
+	gcpTokenRefreshTime = time.Minute
+)
+
+// gcpCredentialsFile is an application default credentials file of Google
+// Cloud, of a service account or of a user
+type gcpCredentialsFile struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// gcpToken is an OAuth2 access token
+type gcpToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	expiry      time.Time
+}
+
+// gcpBackend is the API of GCP Cloud KMS
+type gcpBackend struct {
+	cfg      *Config
+	client   *http.Client
+	endpoint string
+	now      func() time.Time
+	// The signing algorithm of the key version
+	algorithm string
+	mutex     sync.Mutex
+	token     *gcpToken
+}
+
+func newGCPBackend(cfg *Config, client *http.Client) (*gcpBackend, error) {
+	if !strings.HasPrefix(cfg.KeyID, "projects/") || !strings.Contains(cfg.KeyID, "/cryptoKeyVersions/") {
+		return nil, errors.Errorf("The GCP KMS key '%s' must be the resource name of a key version, projects/<project>/locations/<location>/keyRings/<key ring>/cryptoKeys/<key>/cryptoKeyVersions/<version>", cfg.KeyID)
+	}
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = gcpEndpoint
+	}
+	return &gcpBackend{
+		cfg:      cfg,
+		client:   client,
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		now:      time.Now,
+	}, nil
+}
+
+func (b *gcpBackend) publicKey(ctx context.Context) (crypto.PublicKey, error) {
+	var resp struct {
+		PEM       string `json:"pem"`
+		Algorithm string `json:"algorithm"`
+	}
+	err := b.call(ctx, "GET", "/v1/"+b.cfg.KeyID+"/publicKey", nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(resp.PEM))
+	if block == nil {
+		return nil, errors.New("GCP KMS did not return a PEM public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the public key returned by GCP KMS")
+	}
+	b.algorithm = resp.Algorithm
+	return pub, nil
+}
+
+func (b *gcpBackend) sign(ctx context.Context, pub crypto.PublicKey, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	// The algorithm of a key version is fixed, such as EC_SIGN_P256_SHA256
+	// or RSA_SIGN_PSS_2048_SHA256, so the request must match it
+	hash, err := hashName(opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+	hash = strings.Replace(hash, "_", "", -1)
+	_, pss := opts.(*rsa.PSSOptions)
+	if !strings.HasSuffix(b.algorithm, "_"+hash) || pss != strings.HasPrefix(b.algorithm, "RSA_SIGN_PSS_") {
+		return nil, errors.Errorf("The GCP KMS key version '%s' has the algorithm %s, which does not match the requested signature",
+			b.cfg.KeyID, b.algorithm)
+	}
+	req := map[string]interface{}{
+		"digest": map[string][]byte{strings.ToLower(hash): digest},
+	}
+	var resp struct {
+		Signature []byte `json:"signature"`
+	}
+	err = b.call(ctx, "POST", "/v1/"+b.cfg.KeyID+":asymmetricSign", req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Signature, nil
+}
+
+// call sends the request 'method' 'path' with the body 'req' to GCP KMS and
+// decodes its response into 'result'
+func (b *gcpBackend) call(ctx context.Context, method, path string, req, result interface{}) error {
+	token, err := b.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	var body []byte
+	if req != nil {
+		body, err = json.Marshal(req)
+		if err != nil {
+			return errors.Wrap(err, "Failed to marshal the request to GCP KMS")
+		}
+	}
+	httpReq, err := http.NewRequest(method, b.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "Failed to create the request to GCP KMS")
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+	if req != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	resp, respBody, err := doHTTP(b.client, httpReq)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var gcpErr struct {
+			Error struct {
+				Message string `json:"message"`
+				Status  string `json:"status"`
+			} `json:"error"`
+		}
+		json.Unmarshal(respBody, &gcpErr)
+		return statusError(resp.StatusCode, errors.Errorf("GCP KMS returned %d %s: %s",
+			resp.StatusCode, gcpErr.Error.Status, gcpErr.Error.Message))
+	}
+	err = json.Unmarshal(respBody, result)
+	if err != nil {
+		return errors.Wrap(err, "Failed to parse the response of GCP KMS")
+	}
+	return nil
+}
+
+// accessToken returns an OAuth2 access token of the application default
+// credentials, as the Google Cloud SDKs find them: the file named by
+// GOOGLE_APPLICATION_CREDENTIALS, then the file created by
+// 'gcloud auth application-default login', and then the service account of
+// the Compute Engine instance. The token is cached until shortly before it
+// expires.
+func (b *gcpBackend) accessToken(ctx context.Context) (string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.token != nil && b.now().Add(gcpTokenRefreshTime).Before(b.token.expiry) {
+		return b.token.AccessToken, nil
+	}
+	token, err := b.newToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	token.expiry = b.now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	b.token = token
+	return token.AccessToken, nil
+}
+
+func (b *gcpBackend) newToken(ctx context.Context) (*gcpToken, error) {
+	file := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if file == "" {
+		dir := os.Getenv("CLOUDSDK_CONFIG")
+		if dir == "" {
+			if home := os.Getenv("HOME"); home != "" {
+				dir = filepath.Join(home, ".config", "gcloud")
+			}
+		}
+		if dir != "" && util.FileExists(filepath.Join(dir, "application_default_credentials.json")) {
+			file = filepath.Join(dir, "application_default_credentials.json")
+		}
+	}
+	if file == "" {
+		return b.metadataToken(ctx)
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read the Google Cloud credentials file '%s'", file)
+	}
+	var creds gcpCredentialsFile
+	err = json.Unmarshal(buf, &creds)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse the Google Cloud credentials file '%s'", file)
+	}
+	form := url.Values{}
+	tokenURL := gcpTokenURL
+	switch creds.Type {
+	case "service_account":
+		if creds.TokenURI != "" {
+			tokenURL = creds.TokenURI
+		}
+		assertion, err := b.jwtAssertion(&creds, tokenURL)
+		if err != nil {
+			return nil, err
+		}
+		form.Set("grant_type", gcpJWTBearerGrant)
+		form.Set("assertion", assertion)
+	case "authorized_user":
+		form.Set("grant_type", "refresh_token")
+		form.Set("client_id", creds.ClientID)
+		form.Set("client_secret", creds.ClientSecret)
+		form.Set("refresh_token", creds.RefreshToken)
+	default:
+		return nil, errors.Errorf("The Google Cloud credentials file '%s' has the unsupported type '%s'", file, creds.Type)
+	}
+	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create the token request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b.fetchToken(req.WithContext(ctx))
+}
+
+// jwtAssertion returns the JWT signed by the service account of 'creds' with
+// which it requests an access token from 'tokenURL'
+func (b *gcpBackend) jwtAssertion(creds *gcpCredentialsFile, tokenURL string) (string, error) {
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return "", errors.New("The private key of the Google Cloud service account is not PEM-encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to parse the private key of the Google Cloud service account")
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("The private key of the Google Cloud service account is not an RSA key")
+	}
+	now := b.now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": creds.PrivateKeyID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   creds.ClientEmail,
+		"scope": gcpScope,
+		"aud":   tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(gcpTokenLifetime).Unix(),
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to sign the token request")
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// metadataToken returns an access token of the service account of the
+// Compute Engine instance from its metadata server
+func (b *gcpBackend) metadataToken(ctx context.Context) (*gcpToken, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = gcpMetadataHost
+	}
+	req, err := http.NewRequest("GET", "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token?scopes="+url.QueryEscape(gcpScope), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create the request to the metadata server")
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	token, err := b.fetchToken(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.WithMessage(err, "No Google Cloud credentials file was found, and the metadata server did not return a token")
+	}
+	return token, nil
+}
+
+// fetchToken returns the access token returned by 'req'
+func (b *gcpBackend) fetchToken(req *http.Request) (*gcpToken, error) {
+	resp, body, err := doHTTP(b.client, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp.StatusCode, errors.Errorf("The token request to '%s' returned %d: %s", req.URL, resp.StatusCode, body))
+	}
+	var token gcpToken
+	err = json.Unmarshal(body, &token)
+	if err != nil || token.AccessToken == "" {
+		return nil, errors.Errorf("'%s' did not return an access token", req.URL)
+	}
+	return &token, nil
+}
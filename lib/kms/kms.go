@@ -0,0 +1,246 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package kms implements a crypto.Signer whose private key is held by a cloud
+// key management service, AWS KMS or GCP Cloud KMS, so that the CA's key never
+// leaves the KMS. The key is created in the KMS with its own tools; only its
+// public key and signatures are requested from it.
+package kms
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/pkg/errors"
+)
+
+// The providers of the KMS
+const (
+	ProviderAWS = "aws"
+	ProviderGCP = "gcp"
+)
+
+// The operations of the KMS, as reported to the Observer
+const (
+	OpGetPublicKey = "GetPublicKey"
+	OpSign         = "Sign"
+)
+
+// The defaults of the configuration
+const (
+	defaultTimeout     = 10 * time.Second
+	defaultMaxAttempts = 3
+	defaultBaseDelay   = 200 * time.Millisecond
+	// The maximum size of a response of the KMS which is read
+	maxResponseSize = 1 << 20
+)
+
+// Config is the configuration of the cloud KMS which holds a CA's private key
+type Config struct {
+	Provider    string        `help:"Cloud KMS which holds the CA's private key, aws or gcp; if not set, the key is held by BCCSP"`
+	KeyID       string        `help:"ARN of the AWS KMS key, or resource name of the GCP Cloud KMS key version, with which the CA signs"`
+	Region      string        `help:"AWS region of the key if it is not in the key's ARN"`
+	Endpoint    string        `help:"URL of the KMS API if it is not the provider's public endpoint"`
+	Timeout     time.Duration `def:"10s" help:"Maximum time of each attempt of a request to the KMS"`
+	MaxAttempts int           `def:"3" help:"Maximum number of attempts of a request to the KMS which fails with a transient error"`
+	BaseDelay   time.Duration `def:"200ms" help:"Delay before the first retry of a request to the KMS, which doubles after each retry"`
+}
+
+// Enabled returns true if the configuration selects a KMS
+func (c *Config) Enabled() bool {
+	return c.Provider != ""
+}
+
+// Validate checks the configuration of an enabled KMS
+func (c *Config) Validate() error {
+	switch c.Provider {
+	case ProviderAWS, ProviderGCP:
+	default:
+		return errors.Errorf("Invalid KMS provider '%s'; it must be '%s' or '%s'", c.Provider, ProviderAWS, ProviderGCP)
+	}
+	if c.KeyID == "" {
+		return errors.New("The ID of the KMS key is not set")
+	}
+	if c.Timeout < 0 || c.MaxAttempts < 0 || c.BaseDelay < 0 {
+		return errors.New("The timeout, maximum attempts and base delay of the KMS requests must not be negative")
+	}
+	return nil
+}
+
+// Observer is called after each attempt of a request to the KMS with its
+// operation, its duration and its error, if it failed
+type Observer func(operation string, duration time.Duration, err error)
+
+// backend is the API of a provider's KMS
+type backend interface {
+	// publicKey returns the public key of the key
+	publicKey(ctx context.Context) (crypto.PublicKey, error)
+	// sign signs 'digest' with the key, whose public key is 'pub', as
+	// specified by 'opts' and returns the signature in the encoding of
+	// crypto.Signer
+	sign(ctx context.Context, pub crypto.PublicKey, digest []byte, opts crypto.SignerOpts) ([]byte, error)
+}
+
+// transientError is the error of a request which may succeed if retried
+type transientError struct {
+	error
+}
+
+// Signer signs with a key held by a cloud KMS
+type Signer struct {
+	cfg     Config
+	backend backend
+	public  crypto.PublicKey
+	observe Observer
+}
+
+// New returns the signer of the key selected by 'cfg', whose public key it
+// gets from the KMS. 'observe', if not nil, is called after each request.
+func New(cfg *Config, observe Observer) (*Signer, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	s := &Signer{cfg: *cfg, observe: observe}
+	if s.cfg.Timeout == 0 {
+		s.cfg.Timeout = defaultTimeout
+	}
+	if s.cfg.MaxAttempts == 0 {
+		s.cfg.MaxAttempts = defaultMaxAttempts
+	}
+	if s.cfg.BaseDelay == 0 {
+		s.cfg.BaseDelay = defaultBaseDelay
+	}
+	httpClient := &http.Client{}
+	switch cfg.Provider {
+	case ProviderAWS:
+		s.backend, err = newAWSBackend(&s.cfg, httpClient)
+	case ProviderGCP:
+		s.backend, err = newGCPBackend(&s.cfg, httpClient)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = s.do(OpGetPublicKey, func(ctx context.Context) error {
+		pub, err := s.backend.publicKey(ctx)
+		s.public = pub
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch s.public.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+	default:
+		return nil, errors.Errorf("The KMS key '%s' is not an ECDSA or RSA key", cfg.KeyID)
+	}
+	log.Infof("Using the %s KMS key '%s'", cfg.Provider, cfg.KeyID)
+	return s, nil
+}
+
+// Provider returns the provider of the KMS
+func (s *Signer) Provider() string {
+	return s.cfg.Provider
+}
+
+// KeyID returns the ID of the key in the KMS
+func (s *Signer) KeyID() string {
+	return s.cfg.KeyID
+}
+
+// Public returns the public key of the key
+func (s *Signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign signs 'digest' with the key in the KMS; 'rand' is not used
+func (s *Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts == nil || opts.HashFunc() == 0 {
+		return nil, errors.New("The KMS only signs digests; a hash function must be specified")
+	}
+	if len(digest) != opts.HashFunc().Size() {
+		return nil, errors.Errorf("The digest is %d bytes rather than the %d bytes of its hash function", len(digest), opts.HashFunc().Size())
+	}
+	var sig []byte
+	err := s.do(OpSign, func(ctx context.Context) error {
+		var err error
+		sig, err = s.backend.sign(ctx, s.public, digest, opts)
+		return err
+	})
+	return sig, err
+}
+
+// do performs the request 'op' of the KMS with 'f', retrying it after a
+// transient error until it has been attempted MaxAttempts times
+func (s *Signer) do(op string, f func(ctx context.Context) error) error {
+	delay := s.cfg.BaseDelay
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeout)
+		start := time.Now()
+		err := f(ctx)
+		cancel()
+		if s.observe != nil {
+			s.observe(op, time.Since(start), err)
+		}
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*transientError); !ok || attempt >= s.cfg.MaxAttempts {
+			return errors.WithMessage(err, fmt.Sprintf("%s request for the %s KMS key '%s' failed after %d attempts",
+				op, s.cfg.Provider, s.cfg.KeyID, attempt))
+		}
+		log.Debugf("%s request for the %s KMS key '%s' failed, retrying in %s: %s", op, s.cfg.Provider, s.cfg.KeyID, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// doHTTP sends 'req' with 'client' and returns the response and its body.
+// The errors of sending the request and reading the response are transient.
+func doHTTP(client *http.Client, req *http.Request) (*http.Response, []byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, &transientError{errors.Wrap(err, "Failed to send the request to the KMS")}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, nil, &transientError{errors.Wrap(err, "Failed to read the response of the KMS")}
+	}
+	return resp, body, nil
+}
+
+// statusError returns the error of a response of the KMS with the status
+// 'status' which failed with 'err', which is transient if the status is
+// 429 or 5xx
+func statusError(status int, err error) error {
+	if status == http.StatusTooManyRequests || status >= 500 {
+		return &transientError{err}
+	}
+	return err
+}
+
+// hashName returns the name of the hash function 'h' in the signing
+// algorithms of the KMS
+func hashName(h crypto.Hash) (string, error) {
+	switch h {
+	case crypto.SHA256:
+		return "SHA_256", nil
+	case crypto.SHA384:
+		return "SHA_384", nil
+	case crypto.SHA512:
+		return "SHA_512", nil
+	}
+	return "", errors.Errorf("The KMS does not support the hash function %v", h)
+}
@@ -0,0 +1,602 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package kms
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The credentials of the AWS stub
+const (
+	testAccessKeyID     = "AKIDTEST"
+	testSecretAccessKey = "testsecret"
+)
+
+// setEnv sets the environment variables 'vars', unsetting those whose value
+// is empty, and returns the function which restores them
+func setEnv(vars map[string]string) func() {
+	old := map[string]*string{}
+	for name, value := range vars {
+		if v, ok := os.LookupEnv(name); ok {
+			old[name] = &v
+		} else {
+			old[name] = nil
+		}
+		if value == "" {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, value)
+		}
+	}
+	return func() {
+		for name, value := range old {
+			if value != nil {
+				os.Setenv(name, *value)
+			} else {
+				os.Unsetenv(name)
+			}
+		}
+	}
+}
+
+// kmsStub is a stub of the API of a KMS which holds 'key'. The first
+// 'failures' requests fail with a transient error.
+type kmsStub struct {
+	t        *testing.T
+	key      crypto.Signer
+	mutex    sync.Mutex
+	failures int
+	signs    int
+}
+
+// fail returns true if the request is to fail
+func (s *kmsStub) fail() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return true
+	}
+	return false
+}
+
+func (s *kmsStub) signDigest(digest []byte, opts crypto.SignerOpts) []byte {
+	s.mutex.Lock()
+	s.signs++
+	s.mutex.Unlock()
+	sig, err := s.key.Sign(rand.Reader, digest, opts)
+	assert.NoError(s.t, err)
+	return sig
+}
+
+// awsHandler serves the GetPublicKey and Sign actions of AWS KMS, checking
+// the signature of each request
+func (s *kmsStub) awsHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	assert.NoError(s.t, err)
+	// The request is signed as it is received
+	check, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.Path, nil)
+	assert.NoError(s.t, err)
+	for _, name := range []string{"Content-Type", "X-Amz-Target"} {
+		check.Header.Set(name, r.Header.Get(name))
+	}
+	date, err := time.Parse(amzDateFormat, r.Header.Get("X-Amz-Date"))
+	assert.NoError(s.t, err)
+	signV4(check, body, &awsCredentials{AccessKeyID: testAccessKeyID, SecretAccessKey: testSecretAccessKey,
+		SessionToken: r.Header.Get("X-Amz-Security-Token")}, "kms", "us-east-1", date)
+	if check.Header.Get("Authorization") != r.Header.Get("Authorization") {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"InvalidSignatureException","message":"The signature does not match"}`))
+		return
+	}
+	if s.fail() {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"com.amazonaws.kms#ThrottlingException","message":"Rate exceeded"}`))
+		return
+	}
+	var req struct {
+		KeyID            string `json:"KeyId"`
+		Message          []byte
+		MessageType      string
+		SigningAlgorithm string
+	}
+	assert.NoError(s.t, json.Unmarshal(body, &req))
+	if req.KeyID != "arn:aws:kms:us-east-1:111122223333:key/test" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"NotFoundException","message":"Key not found"}`))
+		return
+	}
+	var resp interface{}
+	switch r.Header.Get("X-Amz-Target") {
+	case "TrentService.GetPublicKey":
+		der, err := x509.MarshalPKIXPublicKey(s.key.Public())
+		assert.NoError(s.t, err)
+		resp = map[string]interface{}{"KeyId": req.KeyID, "PublicKey": der}
+	case "TrentService.Sign":
+		assert.Equal(s.t, "DIGEST", req.MessageType)
+		assert.Equal(s.t, "ECDSA_SHA_256", req.SigningAlgorithm)
+		resp = map[string]interface{}{"KeyId": req.KeyID, "Signature": s.signDigest(req.Message, crypto.SHA256)}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+const testGCPKey = "projects/p/locations/global/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1"
+
+// gcpHandler serves the token endpoint and the getPublicKey and
+// asymmetricSign methods of GCP Cloud KMS
+func (s *kmsStub) gcpHandler(saKey *rsa.PrivateKey) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			assert.NoError(s.t, r.ParseForm())
+			assert.Equal(s.t, gcpJWTBearerGrant, r.Form.Get("grant_type"))
+			parts := strings.Split(r.Form.Get("assertion"), ".")
+			if !assert.Len(s.t, parts, 3) {
+				return
+			}
+			sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+			assert.NoError(s.t, err)
+			digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			if rsa.VerifyPKCS1v15(&saKey.PublicKey, crypto.SHA256, digest[:], sig) != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"access_token":"test-token","expires_in":3600,"token_type":"Bearer"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":{"code":401,"message":"Unauthenticated","status":"UNAUTHENTICATED"}}`))
+			return
+		}
+		if s.fail() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":{"code":503,"message":"Unavailable","status":"UNAVAILABLE"}}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/" + testGCPKey + "/publicKey":
+			der, err := x509.MarshalPKIXPublicKey(s.key.Public())
+			assert.NoError(s.t, err)
+			json.NewEncoder(w).Encode(map[string]string{
+				"pem":       string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+				"algorithm": "EC_SIGN_P256_SHA256",
+			})
+		case "/v1/" + testGCPKey + ":asymmetricSign":
+			var req struct {
+				Digest map[string][]byte `json:"digest"`
+			}
+			assert.NoError(s.t, json.NewDecoder(r.Body).Decode(&req))
+			json.NewEncoder(w).Encode(map[string][]byte{"signature": s.signDigest(req.Digest["sha256"], crypto.SHA256)})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":404,"message":"Not found","status":"NOT_FOUND"}}`))
+		}
+	}
+}
+
+// verify checks that 'sig' is a signature of 'digest' by 'pub'
+func verify(t *testing.T, pub crypto.PublicKey, digest, sig []byte) {
+	var ecSig struct {
+		R, S *big.Int
+	}
+	_, err := asn1.Unmarshal(sig, &ecSig)
+	if assert.NoError(t, err, "The signature should be ASN.1 encoded") {
+		assert.True(t, ecdsa.Verify(pub.(*ecdsa.PublicKey), digest, ecSig.R, ecSig.S), "The signature should verify")
+	}
+}
+
+func TestAWSSigner(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &kmsStub{t: t, key: key}
+	srv := httptest.NewServer(http.HandlerFunc(stub.awsHandler))
+	defer srv.Close()
+	defer setEnv(map[string]string{
+		"AWS_ACCESS_KEY_ID":     testAccessKeyID,
+		"AWS_SECRET_ACCESS_KEY": testSecretAccessKey,
+		"AWS_SESSION_TOKEN":     "session",
+	})()
+
+	var ops []string
+	observe := func(op string, d time.Duration, err error) {
+		ops = append(ops, op)
+	}
+	// The region is that of the key's ARN
+	cfg := &Config{Provider: ProviderAWS, KeyID: "arn:aws:kms:us-east-1:111122223333:key/test", Endpoint: srv.URL, BaseDelay: time.Millisecond}
+	signer, err := New(cfg, observe)
+	if err != nil {
+		t.Fatalf("Failed to create the AWS KMS signer: %s", err)
+	}
+	assert.Equal(t, &key.PublicKey, signer.Public())
+	assert.Equal(t, []string{OpGetPublicKey}, ops)
+
+	digest := sha256.Sum256([]byte("message"))
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Failed to sign with the AWS KMS signer: %s", err)
+	}
+	verify(t, signer.Public(), digest[:], sig)
+
+	// A throttled request is retried
+	stub.failures = 2
+	ops = nil
+	sig, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("The throttled request should be retried: %s", err)
+	}
+	verify(t, signer.Public(), digest[:], sig)
+	assert.Equal(t, []string{OpSign, OpSign, OpSign}, ops)
+	// until it has been attempted the maximum number of times
+	stub.failures = 3
+	_, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "ThrottlingException")
+		assert.Contains(t, err.Error(), "after 3 attempts")
+	}
+	stub.failures = 0
+
+	// The digest must be of the hash function
+	_, err = signer.Sign(rand.Reader, digest[:20], crypto.SHA256)
+	assert.Error(t, err)
+
+	// A request which fails with a permanent error is not retried
+	cfg.KeyID = "arn:aws:kms:us-east-1:111122223333:key/other"
+	ops = nil
+	_, err = New(cfg, observe)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "NotFoundException")
+	}
+	assert.Equal(t, []string{OpGetPublicKey}, ops)
+
+	// Requests signed with other credentials are rejected
+	defer setEnv(map[string]string{"AWS_SECRET_ACCESS_KEY": "wrong"})()
+	cfg.KeyID = "arn:aws:kms:us-east-1:111122223333:key/test"
+	_, err = New(cfg, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "InvalidSignatureException")
+	}
+
+	// The credentials may be in the shared credentials file
+	dir, err := ioutil.TempDir("", "kmstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	credsFile := filepath.Join(dir, "credentials")
+	err = ioutil.WriteFile(credsFile, []byte("[default]\naws_access_key_id = other\naws_secret_access_key = other\n\n"+
+		"[ca]\naws_access_key_id = "+testAccessKeyID+"\naws_secret_access_key = "+testSecretAccessKey+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer setEnv(map[string]string{
+		"AWS_ACCESS_KEY_ID":           "",
+		"AWS_SECRET_ACCESS_KEY":       "",
+		"AWS_SESSION_TOKEN":           "",
+		"AWS_SHARED_CREDENTIALS_FILE": credsFile,
+		"AWS_PROFILE":                 "ca",
+	})()
+	_, err = New(cfg, nil)
+	assert.NoError(t, err, "The credentials of the shared credentials file should be used")
+
+	// or be those of the EC2 instance's role
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "PUT" && r.URL.Path == "/latest/api/token":
+			w.Write([]byte("imds-token"))
+		case r.Header.Get("X-aws-ec2-metadata-token") != "imds-token":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/":
+			w.Write([]byte("ca-role"))
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/ca-role":
+			json.NewEncoder(w).Encode(&awsCredentials{AccessKeyID: testAccessKeyID, SecretAccessKey: testSecretAccessKey,
+				SessionToken: "instance", Expiration: time.Now().Add(time.Hour)})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer imds.Close()
+	defer setEnv(map[string]string{
+		"AWS_SHARED_CREDENTIALS_FILE":       filepath.Join(dir, "none"),
+		"AWS_EC2_METADATA_SERVICE_ENDPOINT": imds.URL,
+	})()
+	signer, err = New(cfg, nil)
+	if err != nil {
+		t.Fatalf("The credentials of the instance metadata service should be used: %s", err)
+	}
+	sig, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify(t, signer.Public(), digest[:], sig)
+
+	// A region is required
+	defer setEnv(map[string]string{"AWS_REGION": "", "AWS_DEFAULT_REGION": ""})()
+	_, err = New(&Config{Provider: ProviderAWS, KeyID: "alias/ca", Endpoint: srv.URL}, nil)
+	assert.Error(t, err)
+}
+
+func TestGCPSigner(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &kmsStub{t: t, key: key}
+	srv := httptest.NewServer(stub.gcpHandler(saKey))
+	defer srv.Close()
+
+	// The credentials are those of a service account
+	dir, err := ioutil.TempDir("", "kmstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	der, err := x509.MarshalPKCS8PrivateKey(saKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credsFile := filepath.Join(dir, "sa.json")
+	creds, err := json.Marshal(&gcpCredentialsFile{
+		Type:        "service_account",
+		ClientEmail: "ca@p.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:    srv.URL + "/token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(credsFile, creds, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer setEnv(map[string]string{"GOOGLE_APPLICATION_CREDENTIALS": credsFile})()
+
+	var ops []string
+	observe := func(op string, d time.Duration, err error) {
+		ops = append(ops, op)
+	}
+	cfg := &Config{Provider: ProviderGCP, KeyID: testGCPKey, Endpoint: srv.URL, BaseDelay: time.Millisecond}
+	stub.failures = 1
+	signer, err := New(cfg, observe)
+	if err != nil {
+		t.Fatalf("Failed to create the GCP KMS signer: %s", err)
+	}
+	assert.Equal(t, &key.PublicKey, signer.Public())
+	assert.Equal(t, []string{OpGetPublicKey, OpGetPublicKey}, ops, "The unavailable KMS should be retried")
+
+	digest := sha256.Sum256([]byte("message"))
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Failed to sign with the GCP KMS signer: %s", err)
+	}
+	verify(t, signer.Public(), digest[:], sig)
+
+	// The key version only signs SHA-256 digests
+	digest384 := make([]byte, crypto.SHA384.Size())
+	_, err = signer.Sign(rand.Reader, digest384, crypto.SHA384)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "EC_SIGN_P256_SHA256")
+	}
+	assert.Equal(t, 1, stub.signs, "A signature which the key can't make should not be requested")
+
+	// The token of the metadata server is used without a credentials file
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"access_token":"test-token","expires_in":3600}`))
+	}))
+	defer metadata.Close()
+	defer setEnv(map[string]string{
+		"GOOGLE_APPLICATION_CREDENTIALS": "",
+		"CLOUDSDK_CONFIG":                dir,
+		"GCE_METADATA_HOST":              strings.TrimPrefix(metadata.URL, "http://"),
+	})()
+	signer, err = New(cfg, nil)
+	if err != nil {
+		t.Fatalf("The token of the metadata server should be used: %s", err)
+	}
+	sig, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify(t, signer.Public(), digest[:], sig)
+
+	// The key must be a key version
+	_, err = New(&Config{Provider: ProviderGCP, KeyID: "projects/p/locations/global/keyRings/r/cryptoKeys/k"}, nil)
+	assert.Error(t, err)
+}
+
+// signV4Vectors are examples of the AWS Signature Version 4 test suite, which
+// sign requests to example.amazonaws.com with the credentials AKIDEXAMPLE at
+// 20150830T123600Z for the service 'service' in us-east-1
+var signV4Vectors = []struct {
+	name    string
+	method  string
+	path    string
+	headers [][2]string
+	body    string
+	token   string
+	// The SignedHeaders and Signature of the Authorization header
+	signed    string
+	signature string
+}{
+	{name: "get-vanilla", method: "GET", path: "/",
+		signed: "host;x-amz-date", signature: "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+	{name: "post-vanilla", method: "POST", path: "/",
+		signed: "host;x-amz-date", signature: "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+	{name: "get-vanilla-query-order-key-case", method: "GET", path: "/?Param2=value2&Param1=value1",
+		signed: "host;x-amz-date", signature: "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+	{name: "get-vanilla-empty-query-key", method: "GET", path: "/?Param1=value1",
+		signed: "host;x-amz-date", signature: "a67d582fa61cc504c4bae71f336f98b97f1ea3c7a6bfe1b6e45aec72011b9aeb"},
+	{name: "get-vanilla-query-unreserved", method: "GET",
+		path:   "/?-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz=-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz",
+		signed: "host;x-amz-date", signature: "9c3e54bfcdf0b19771a7f523ee5669cdf59bc7cc0884027167c21bb143a40197"},
+	{name: "get-vanilla-utf8-query", method: "GET", path: "/?\u1234=bar",
+		signed: "host;x-amz-date", signature: "2cdec8eed098649ff3a119c94853b13c643bcf08f8b0a1d91e12c9027818dd04"},
+	{name: "post-vanilla-query", method: "POST", path: "/?Param1=value1",
+		signed: "host;x-amz-date", signature: "28038455d6de14eafc1f9222cf5aa6f1a96197d7deb8263271d420d138af7f11"},
+	{name: "get-utf8", method: "GET", path: "/\u1234",
+		signed: "host;x-amz-date", signature: "8318018e0b0f223aa2bbf98705b62bb787dc9c0e678f255a891fd03141be5d85"},
+	{name: "get-space", method: "GET", path: "/example space/",
+		signed: "host;x-amz-date", signature: "652487583200325589f1fba4c7e578f72c47cb61beeca81406b39ddec1366741"},
+	{name: "normalize-path/get-slash", method: "GET", path: "//",
+		signed: "host;x-amz-date", signature: "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+	{name: "normalize-path/get-slashes", method: "GET", path: "//example//",
+		signed: "host;x-amz-date", signature: "9a624bd73a37c9a373b5312afbebe7a714a789de108f0bdfe846570885f57e84"},
+	{name: "normalize-path/get-slash-pointless-dot", method: "GET", path: "/./example",
+		signed: "host;x-amz-date", signature: "ef75d96142cf21edca26f06005da7988e4f8dc83a165a80865db7089db637ec5"},
+	{name: "normalize-path/get-relative", method: "GET", path: "/example/..",
+		signed: "host;x-amz-date", signature: "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+	{name: "normalize-path/get-relative-relative", method: "GET", path: "/example1/example2/../..",
+		signed: "host;x-amz-date", signature: "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+	{name: "get-header-key-duplicate", method: "GET", path: "/",
+		headers: [][2]string{{"My-Header1", "value2"}, {"My-Header1", "value2"}, {"My-Header1", "value1"}},
+		signed:  "host;my-header1;x-amz-date", signature: "c9d5ea9f3f72853aea855b47ea873832890dbdd183b4468f858259531a5138ea"},
+	{name: "get-header-value-order", method: "GET", path: "/",
+		headers: [][2]string{{"My-Header1", "value4"}, {"My-Header1", "value1"}, {"My-Header1", "value3"}, {"My-Header1", "value2"}},
+		signed:  "host;my-header1;x-amz-date", signature: "08c7e5a9acfcfeb3ab6b2185e75ce8b1deb5e634ec47601a50643f830c755c01"},
+	{name: "get-header-value-trim", method: "GET", path: "/",
+		headers: [][2]string{{"My-Header1", " value1"}, {"My-Header2", ` "a   b   c"`}},
+		signed:  "host;my-header1;my-header2;x-amz-date", signature: "acc3ed3afb60bb290fc8d2dd0098b9911fcaa05412b367055dee359757a9c736"},
+	{name: "post-x-www-form-urlencoded", method: "POST", path: "/", body: "Param1=value1",
+		headers: [][2]string{{"Content-Type", "application/x-www-form-urlencoded"}},
+		signed:  "content-type;host;x-amz-date", signature: "ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a"},
+	{name: "post-x-www-form-urlencoded-parameters", method: "POST", path: "/", body: "Param1=value1",
+		headers: [][2]string{{"Content-Type", "application/x-www-form-urlencoded; charset=utf8"}},
+		signed:  "content-type;host;x-amz-date", signature: "1a72ec8f64bd914b0e42e42607c7fbce7fb2c7465f63e3092b3b0d39fa77a6fe"},
+	{name: "post-sts-token/post-sts-header-before", method: "POST", path: "/",
+		token:  "AQoDYXdzEPT//////////wEXAMPLEtc764bNrC9SAPBSM22wDOk4x4HIZ8j4FZTwdQWLWsKWHGBuFqwAeMicRXmxfpSPfIeoIYRqTflfKD8YUuwthAx7mSEI/qkPpKPi/kMcGdQrmGdeehM4IC1NtBmUpp2wUE8phUZampKsburEDy0KPkyQDYwT7WZ0wq5VSXDvp75YU9HFvlRd8Tx6q6fE8YQcHNVXAkiY9q6d+xo0rKwT38xVqr7ZD0u0iPPkUL64lIZbqBAz+scqKmlzm8FDrypNC9Yjc8fPOLn9FX9KSYvKTr4rvx3iSIlTJabIQwj2ICCR/oLxBA==",
+		signed: "host;x-amz-date;x-amz-security-token", signature: "85d96828115b5dc0cfc3bd16ad9e210dd772bbebba041836c64533a82be05ead"},
+}
+
+func TestSignV4(t *testing.T) {
+	for _, v := range signV4Vectors {
+		req, err := http.NewRequest(v.method, "https://example.amazonaws.com"+v.path, strings.NewReader(v.body))
+		if err != nil {
+			t.Fatalf("%s: %s", v.name, err)
+		}
+		for _, h := range v.headers {
+			req.Header.Add(h[0], h[1])
+		}
+		creds := &awsCredentials{
+			AccessKeyID:     "AKIDEXAMPLE",
+			SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+			SessionToken:    v.token,
+		}
+		signV4(req, []byte(v.body), creds, "service", "us-east-1", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+		assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+			"SignedHeaders="+v.signed+", Signature="+v.signature, req.Header.Get("Authorization"), v.name)
+	}
+}
+
+func TestJWTAssertion(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := &gcpCredentialsFile{
+		Type:         "service_account",
+		ClientEmail:  "ca@p.iam.gserviceaccount.com",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		PrivateKeyID: "key1",
+	}
+	now := time.Unix(1500000000, 0)
+	b := &gcpBackend{now: func() time.Time { return now }}
+	assertion, err := b.jwtAssertion(creds, gcpTokenURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The assertion is a JWT signed with RS256, whose claims are those of
+	// the OAuth 2.0 flow of service accounts
+	parts := strings.Split(assertion, ".")
+	if !assert.Len(t, parts, 3) {
+		return
+	}
+	decode := func(part string) map[string]interface{} {
+		buf, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := map[string]interface{}{}
+		if err = json.Unmarshal(buf, &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	assert.Equal(t, map[string]interface{}{"alg": "RS256", "typ": "JWT", "kid": "key1"}, decode(parts[0]))
+	assert.Equal(t, map[string]interface{}{
+		"iss":   "ca@p.iam.gserviceaccount.com",
+		"scope": gcpScope,
+		"aud":   gcpTokenURL,
+		"iat":   float64(1500000000),
+		"exp":   float64(1500003600),
+	}, decode(parts[1]))
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig))
+
+	// Only RSA keys can sign the assertion
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err = x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	_, err = b.jwtAssertion(creds, gcpTokenURL)
+	assert.Error(t, err)
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.False(t, (&Config{}).Enabled())
+	assert.Error(t, (&Config{Provider: "azure", KeyID: "k"}).Validate())
+	assert.Error(t, (&Config{Provider: ProviderAWS}).Validate())
+	assert.Error(t, (&Config{Provider: ProviderAWS, KeyID: "k", MaxAttempts: -1}).Validate())
+	assert.NoError(t, (&Config{Provider: ProviderGCP, KeyID: "k"}).Validate())
+}
@@ -0,0 +1,126 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package kms
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The formats of the timestamps of AWS Signature Version 4
+const (
+	amzDateFormat  = "20060102T150405Z"
+	amzScopeFormat = "20060102"
+)
+
+// signV4 signs the request 'req' with the body 'body' for the AWS service
+// 'service' in 'region' with 'creds' at the time 'now', as specified by
+// AWS Signature Version 4
+func signV4(req *http.Request, body []byte, creds *awsCredentials, service, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(amzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	payloadHash := sha256.Sum256(body)
+
+	// The canonical headers are the host and the headers set on the request
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = trimAll(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL),
+		canonicalQuery(req.URL),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := now.Format(amzScopeFormat) + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), now.Format(amzScopeFormat))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// canonicalPath returns the path of 'u' without empty, '.' and '..'
+// segments, keeping its trailing slash
+func canonicalPath(u *url.URL) string {
+	escaped := u.EscapedPath()
+	p := path.Clean("/" + escaped)
+	if p != "/" && strings.HasSuffix(escaped, "/") {
+		p += "/"
+	}
+	return p
+}
+
+// canonicalQuery returns the query parameters of 'u' sorted by name and then
+// by value, with their names and values URI-encoded
+func canonicalQuery(u *url.URL) string {
+	type param struct{ name, value string }
+	var params []param
+	for name, values := range u.Query() {
+		for _, value := range values {
+			params = append(params, param{uriEncode(name), uriEncode(value)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i].name != params[j].name {
+			return params[i].name < params[j].name
+		}
+		return params[i].value < params[j].value
+	})
+	pairs := make([]string, len(params))
+	for i, p := range params {
+		pairs[i] = p.name + "=" + p.value
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode encodes 's' as Signature Version 4 requires: every byte but the
+// unreserved characters is percent-encoded, including the space
+func uriEncode(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// trimAll removes the spaces around 'value' and replaces each sequence of
+// spaces in it, such as the folding of a header value, with one space
+func trimAll(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
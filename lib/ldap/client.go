@@ -309,6 +309,16 @@ func (lc *Client) GetAffiliationTree(name string) (*spi.DbTxResult, error) {
 	return nil, errNotSupported
 }
 
+// Ping checks that a connection can be established to the LDAP server
+func (lc *Client) Ping() error {
+	conn, err := lc.newConnection()
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
 // Connect to the LDAP server and bind as user as admin user as specified in LDAP URL
 func (lc *Client) newConnection() (conn *ldap.Conn, err error) {
 	address := fmt.Sprintf("%s:%d", lc.Host, lc.Port)
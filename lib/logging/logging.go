@@ -0,0 +1,337 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	stdlog "log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/util"
+	gologging "github.com/op/go-logging"
+	"github.com/pkg/errors"
+)
+
+const (
+	// FormatText is the format of log messages which is used by default
+	FormatText = "text"
+	// FormatJSON is the format which writes each log message as a JSON object on one line
+	FormatJSON = "json"
+	// FormatJournal is the format of log messages written to the systemd
+	// journal, which prefixes each message with its syslog priority rather
+	// than a timestamp
+	FormatJournal = "journal"
+
+	textTimeFormat = "2006/01/02 15:04:05"
+)
+
+var levels = map[string]int{
+	"debug":    log.LevelDebug,
+	"info":     log.LevelInfo,
+	"warning":  log.LevelWarning,
+	"error":    log.LevelError,
+	"critical": log.LevelCritical,
+	"fatal":    log.LevelFatal,
+}
+
+// bccspLevels maps cfssl log levels to the levels of the BCCSP loggers
+var bccspLevels = map[int]gologging.Level{
+	log.LevelDebug:    gologging.DEBUG,
+	log.LevelInfo:     gologging.INFO,
+	log.LevelWarning:  gologging.WARNING,
+	log.LevelError:    gologging.ERROR,
+	log.LevelCritical: gologging.CRITICAL,
+	log.LevelFatal:    gologging.CRITICAL,
+}
+
+var bccspModules = []string{"bccsp", "bccsp_p11", "bccsp_sw"}
+
+// journalPriorities maps cfssl log levels to syslog priorities
+var journalPriorities = map[int]int{
+	log.LevelDebug:    7,
+	log.LevelInfo:     6,
+	log.LevelWarning:  4,
+	log.LevelError:    3,
+	log.LevelCritical: 2,
+	log.LevelFatal:    0,
+}
+
+var levelNames = map[int]string{
+	log.LevelDebug:    "DEBUG",
+	log.LevelInfo:     "INFO",
+	log.LevelWarning:  "WARNING",
+	log.LevelError:    "ERROR",
+	log.LevelCritical: "CRITICAL",
+	log.LevelFatal:    "FATAL",
+}
+
+// Config is the logging configuration
+type Config struct {
+	// Format of log messages
+	Format string `def:"text" help:"Format of log messages: text, json, or journal for the systemd journal"`
+	// Level of log messages; if not set, the level is not changed
+	Level string `help:"Log level: debug, info, warning, error, critical or fatal"`
+	// File to which log messages are written; standard error if not set
+	File string `help:"File to which log messages are written; if not set, standard error"`
+	// Maximum number of bytes of a request or response body which are logged
+	BodyLimit int `def:"2048" help:"Maximum number of bytes of a request or response body which are logged or included in an error message"`
+	// Syslog endpoint to which log messages and audit events are forwarded
+	Syslog SyslogConfig
+}
+
+// Fields are the key/value pairs of a structured log message
+type Fields map[string]interface{}
+
+// logger writes the log messages of the cfssl log package, and the
+// structured log messages logged by Log, in the configured format
+type logger struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	file   *os.File
+	format string
+	syslog *syslogForwarder
+}
+
+var (
+	mutex   sync.RWMutex
+	current *logger
+	// Installs writer as the writer of the cfssl log package
+	installWriter sync.Once
+)
+
+// Configure sets the format, level and output of log messages according
+// to 'cfg'; a relative file name is relative to 'homeDir'
+func Configure(cfg *Config, homeDir string) error {
+	err := Validate(cfg)
+	if err != nil {
+		return err
+	}
+	format := strings.ToLower(cfg.Format)
+	if format == "" {
+		format = FormatText
+	}
+	var l *logger
+	if cfg.File != "" || format != FormatText || cfg.Syslog.Address != "" {
+		l = &logger{out: os.Stderr, format: format}
+		if cfg.File != "" {
+			file, err := util.MakeFileAbs(cfg.File, homeDir)
+			if err != nil {
+				return err
+			}
+			f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to open log file '%s'", file)
+			}
+			l.out = f
+			l.file = f
+		}
+		if cfg.Syslog.Address != "" {
+			l.syslog, err = newSyslogForwarder(&cfg.Syslog, homeDir, func(msg string) {
+				l.writeLocal(time.Now(), log.LevelError, msg, nil)
+			})
+			if err != nil {
+				if l.file != nil {
+					l.file.Close()
+				}
+				return err
+			}
+		}
+	}
+	if cfg.Level != "" {
+		level, _ := ParseLevel(cfg.Level)
+		SetLevel(level)
+	}
+	util.SetBodyLogLimit(cfg.BodyLimit)
+	setLogger(l)
+	return nil
+}
+
+// Validate returns an error if the format, level or syslog endpoint of 'cfg' is invalid
+func Validate(cfg *Config) error {
+	format := strings.ToLower(cfg.Format)
+	if format != "" && format != FormatText && format != FormatJSON && format != FormatJournal {
+		return errors.Errorf("Invalid log format '%s'; must be '%s', '%s' or '%s'", cfg.Format, FormatText, FormatJSON, FormatJournal)
+	}
+	if cfg.Level != "" {
+		_, err := ParseLevel(cfg.Level)
+		if err != nil {
+			return err
+		}
+	}
+	return validateSyslog(&cfg.Syslog)
+}
+
+// ParseLevel returns the cfssl log level with the specified name
+func ParseLevel(name string) (int, error) {
+	level, ok := levels[strings.ToLower(name)]
+	if !ok {
+		return 0, errors.Errorf("Invalid log level '%s'; must be debug, info, warning, error, critical or fatal", name)
+	}
+	return level, nil
+}
+
+// SetLevel sets the level of the cfssl log package, which is used for
+// all of the server's log messages, and of the BCCSP loggers
+func SetLevel(level int) {
+	if level < log.LevelDebug {
+		level = log.LevelDebug
+	} else if level > log.LevelFatal {
+		level = log.LevelFatal
+	}
+	// The level is read without synchronization by the cfssl log package,
+	// so it is only written when it changes
+	if log.Level != level {
+		log.Level = level
+	}
+	for _, module := range bccspModules {
+		gologging.SetLevel(bccspLevels[level], module)
+	}
+}
+
+// LevelName returns the name of a cfssl log level
+func LevelName(level int) string {
+	return strings.ToLower(levelNames[level])
+}
+
+// Log logs a message with the specified fields at the specified level.
+// In text format the fields are omitted, so 'msg' should be complete.
+func Log(level int, msg string, fields Fields) {
+	if level < log.Level {
+		return
+	}
+	mutex.RLock()
+	l := current
+	mutex.RUnlock()
+	if l != nil {
+		l.write(level, msg, fields)
+		return
+	}
+	switch level {
+	case log.LevelDebug:
+		log.Debug(msg)
+	case log.LevelInfo:
+		log.Info(msg)
+	case log.LevelWarning:
+		log.Warning(msg)
+	case log.LevelError:
+		log.Error(msg)
+	default:
+		log.Critical(msg)
+	}
+}
+
+// Audit logs the audit event 'event' with the specified fields at the
+// specified level. Audit events are forwarded to syslog with the message ID
+// "audit" whatever the log level, and are otherwise logged like by Log.
+func Audit(level int, event, msg string, fields Fields) {
+	f := make(Fields, len(fields)+1)
+	for k, v := range fields {
+		f[k] = v
+	}
+	f["event"] = event
+	mutex.RLock()
+	l := current
+	mutex.RUnlock()
+	if l == nil {
+		Log(level, msg, f)
+		return
+	}
+	now := time.Now()
+	if level >= log.Level {
+		l.writeLocal(now, level, msg, f)
+	}
+	if l.syslog != nil {
+		l.syslog.send(now, level, auditMsgID, msg, f)
+	}
+}
+
+// setLogger puts 'l' into service, or the default output of the cfssl log
+// package if 'l' is nil
+func setLogger(l *logger) {
+	mutex.Lock()
+	prev := current
+	current = l
+	mutex.Unlock()
+	if l != nil {
+		// The cfssl log package reads its writer without synchronization,
+		// so it is set once and the logger in service is looked up by the
+		// writer for each message
+		installWriter.Do(func() { log.SetLogger(writer{}) })
+	}
+	if prev != nil && prev.syslog != nil {
+		prev.syslog.stop()
+	}
+	if prev != nil && prev.file != nil {
+		prev.file.Close()
+	}
+}
+
+// write writes the log message, and forwards it to syslog if configured
+func (l *logger) write(level int, msg string, fields Fields) {
+	now := time.Now()
+	l.writeLocal(now, level, msg, fields)
+	if l.syslog != nil {
+		l.syslog.send(now, level, "", msg, fields)
+	}
+}
+
+// writeLocal writes the log message to the log file or standard error
+func (l *logger) writeLocal(now time.Time, level int, msg string, fields Fields) {
+	var line []byte
+	if l.format == FormatJSON {
+		entry := make(map[string]interface{}, len(fields)+3)
+		for k, v := range fields {
+			entry[k] = v
+		}
+		entry["ts"] = now.UTC().Format(time.RFC3339Nano)
+		entry["level"] = LevelName(level)
+		entry["msg"] = msg
+		var err error
+		line, err = json.Marshal(entry)
+		if err != nil {
+			line = []byte(fmt.Sprintf(`{"ts":%q,"level":"error","msg":%q}`,
+				now.UTC().Format(time.RFC3339Nano), "Failed to marshal log message: "+err.Error()))
+		}
+		line = append(line, '\n')
+	} else if l.format == FormatJournal {
+		line = []byte(fmt.Sprintf("<%d>[%s] %s\n", journalPriorities[level], levelNames[level], msg))
+	} else {
+		line = []byte(fmt.Sprintf("%s [%s] %s\n", now.Format(textTimeFormat), levelNames[level], msg))
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.out.Write(line)
+}
+
+// writer is the writer of the cfssl log package once a logger is configured.
+// It writes each message with the logger in service, or as the cfssl log
+// package does by default if there is none.
+type writer struct{}
+
+func (writer) print(level int, msg string) {
+	mutex.RLock()
+	l := current
+	mutex.RUnlock()
+	if l != nil {
+		l.write(level, msg, nil)
+		return
+	}
+	stdlog.Printf("[%s] %s", levelNames[level], msg)
+}
+
+func (w writer) Debug(msg string)   { w.print(log.LevelDebug, msg) }
+func (w writer) Info(msg string)    { w.print(log.LevelInfo, msg) }
+func (w writer) Warning(msg string) { w.print(log.LevelWarning, msg) }
+func (w writer) Err(msg string)     { w.print(log.LevelError, msg) }
+func (w writer) Crit(msg string)    { w.print(log.LevelCritical, msg) }
+func (w writer) Emerg(msg string)   { w.print(log.LevelFatal, msg) }
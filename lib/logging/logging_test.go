@@ -0,0 +1,142 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package logging
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer resetLogging(t)
+
+	err = Configure(&Config{Format: "json", Level: "debug", File: "server.log"}, dir)
+	if err != nil {
+		t.Fatalf("Failed to configure logging: %s", err)
+	}
+	assert.Equal(t, log.LevelDebug, log.Level)
+	log.Debugf("debug %s", "message")
+	log.Warning(`message with "quotes"`)
+	Log(log.LevelInfo, "request", Fields{"request_id": "abc", "identity": "admin", "path": "/api/v1/enroll", "status": 201})
+
+	f, err := os.Open(filepath.Join(dir, "server.log"))
+	if err != nil {
+		t.Fatalf("Failed to open log file: %s", err)
+	}
+	defer f.Close()
+	entries := []map[string]interface{}{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := map[string]interface{}{}
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if assert.NoError(t, err, "Log line is not valid JSON: %s", scanner.Text()) {
+			assert.Contains(t, entry, "ts")
+			entries = append(entries, entry)
+		}
+	}
+	if !assert.Len(t, entries, 3) {
+		return
+	}
+	assert.Equal(t, "debug", entries[0]["level"])
+	assert.Equal(t, "debug message", entries[0]["msg"])
+	assert.Equal(t, "warning", entries[1]["level"])
+	assert.Equal(t, `message with "quotes"`, entries[1]["msg"])
+	assert.Equal(t, "info", entries[2]["level"])
+	assert.Equal(t, "abc", entries[2]["request_id"])
+	assert.Equal(t, "admin", entries[2]["identity"])
+	assert.Equal(t, "/api/v1/enroll", entries[2]["path"])
+	assert.Equal(t, float64(201), entries[2]["status"])
+}
+
+func TestTextFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer resetLogging(t)
+
+	file := filepath.Join(dir, "server.log")
+	err = Configure(&Config{File: file}, "")
+	if err != nil {
+		t.Fatalf("Failed to configure logging: %s", err)
+	}
+	log.Info("text message")
+	Log(log.LevelInfo, "request", Fields{"request_id": "abc"})
+	Log(log.LevelDebug, "not logged", nil)
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Failed to read log file: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.True(t, strings.HasSuffix(lines[0], " [INFO] text message"), lines[0])
+		assert.True(t, strings.HasSuffix(lines[1], " [INFO] request"), lines[1])
+	}
+}
+
+func TestJournalFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer resetLogging(t)
+
+	file := filepath.Join(dir, "client.log")
+	err = Configure(&Config{Format: "journal", File: file}, "")
+	if err != nil {
+		t.Fatalf("Failed to configure logging: %s", err)
+	}
+	log.Info("renewed")
+	log.Warning("retrying")
+	log.Error("failed")
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Failed to read log file: %s", err)
+	}
+	assert.Equal(t, "<6>[INFO] renewed\n<4>[WARNING] retrying\n<3>[ERROR] failed\n", string(buf))
+}
+
+func TestConfigureErrors(t *testing.T) {
+	defer resetLogging(t)
+	err := Configure(&Config{Format: "xml"}, "")
+	assert.Error(t, err, "Invalid format should fail")
+	err = Configure(&Config{Level: "verbose"}, "")
+	assert.Error(t, err, "Invalid level should fail")
+	err = Configure(&Config{File: "/nonexistent/dir/server.log"}, "")
+	assert.Error(t, err, "Unwritable log file should fail")
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, name := range []string{"debug", "info", "warning", "error", "critical", "fatal"} {
+		level, err := ParseLevel(strings.ToUpper(name))
+		assert.NoError(t, err)
+		assert.Equal(t, name, LevelName(level))
+	}
+}
+
+func resetLogging(t *testing.T) {
+	err := Configure(&Config{}, "")
+	if err != nil {
+		t.Errorf("Failed to reset logging: %s", err)
+	}
+	log.Level = log.LevelInfo
+}
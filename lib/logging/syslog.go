@@ -0,0 +1,395 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package logging
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	stls "github.com/hyperledger/fabric-ca/lib/tls"
+	"github.com/pkg/errors"
+)
+
+const (
+	// The version of the syslog protocol of RFC 5424
+	syslogVersion = 1
+	// The timestamp format of RFC 5424
+	syslogTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+	// The ID of the structured data element of the fields of a message,
+	// whose enterprise number is reserved for documentation by RFC 5612
+	syslogSDID = "fabric-ca@32473"
+	// The message ID of audit events
+	auditMsgID = "audit"
+
+	defaultSyslogQueueSize = 1000
+	syslogWriteTimeout     = 5 * time.Second
+	syslogMaxRetryDelay    = 5 * time.Second
+	// The time for which the messages still queued are forwarded when the
+	// forwarding is stopped
+	syslogStopTimeout = 2 * time.Second
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// SyslogConfig is the configuration of the forwarding of log messages to a
+// syslog endpoint
+type SyslogConfig struct {
+	Address   string `help:"Syslog endpoint to which log messages are forwarded: unix:///dev/log, udp://host:514, tcp://host:514 or tls://host:6514; if not set, they are not forwarded"`
+	Facility  string `def:"local0" help:"Syslog facility of the forwarded log messages: kern, user, daemon, auth, authpriv, syslog, or local0 to local7"`
+	AppName   string `def:"fabric-ca-server" help:"Application name of the forwarded log messages"`
+	QueueSize int    `def:"1000" help:"Maximum number of log messages waiting to be forwarded to syslog; further messages are dropped"`
+	TLS       stls.ClientTLSConfig
+}
+
+var (
+	// The number of log messages dropped because the queue of messages
+	// waiting to be forwarded to syslog was full
+	syslogDropped uint64
+	dropObserver  atomic.Value
+)
+
+// SyslogDropped returns the number of log messages which were not forwarded
+// to syslog because the queue of messages waiting to be forwarded was full
+// or they could not be sent
+func SyslogDropped() uint64 {
+	return atomic.LoadUint64(&syslogDropped)
+}
+
+// SetSyslogDropObserver sets the function which is called each time a log
+// message is not forwarded to syslog
+func SetSyslogDropObserver(f func()) {
+	dropObserver.Store(f)
+}
+
+func dropSyslogMessage() {
+	atomic.AddUint64(&syslogDropped, 1)
+	if f, ok := dropObserver.Load().(func()); ok && f != nil {
+		f()
+	}
+}
+
+// parseSyslogAddress returns the network and address of the syslog
+// endpoint 'address', and whether it is connected to with TLS
+func parseSyslogAddress(address string) (string, string, bool, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", "", false, errors.Wrapf(err, "Invalid syslog address '%s'", address)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "unix":
+		if u.Path == "" {
+			return "", "", false, errors.Errorf("Invalid syslog address '%s'; the socket path is missing", address)
+		}
+		return "unix", u.Path, false, nil
+	case "udp", "tcp", "tls":
+		if u.Host == "" {
+			return "", "", false, errors.Errorf("Invalid syslog address '%s'; the host is missing", address)
+		}
+		host := u.Host
+		if u.Port() == "" {
+			port := "514"
+			if u.Scheme == "tls" {
+				port = "6514"
+			}
+			host = net.JoinHostPort(u.Hostname(), port)
+		}
+		if u.Scheme == "tls" {
+			return "tcp", host, true, nil
+		}
+		return u.Scheme, host, false, nil
+	}
+	return "", "", false, errors.Errorf("Invalid syslog address '%s'; must be unix://<path>, udp://<host>[:<port>], tcp://<host>[:<port>] or tls://<host>[:<port>]", address)
+}
+
+// validateSyslog returns an error if the syslog configuration is invalid
+func validateSyslog(cfg *SyslogConfig) error {
+	if cfg.Address == "" {
+		return nil
+	}
+	_, _, _, err := parseSyslogAddress(cfg.Address)
+	if err != nil {
+		return err
+	}
+	if cfg.Facility != "" {
+		if _, ok := syslogFacilities[strings.ToLower(cfg.Facility)]; !ok {
+			return errors.Errorf("Invalid syslog facility '%s'", cfg.Facility)
+		}
+	}
+	if cfg.QueueSize < 0 {
+		return errors.Errorf("Invalid syslog queue size %d; may not be negative", cfg.QueueSize)
+	}
+	return nil
+}
+
+// syslogForwarder forwards log messages to a syslog endpoint in the format
+// of RFC 5424. The messages are queued, so that logging is not blocked by
+// the endpoint; when the queue is full, further messages are dropped.
+type syslogForwarder struct {
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	facility  int
+	hostname  string
+	appName   string
+	pid       int
+	// Reports a failure to forward the messages, other than by forwarding it
+	report func(msg string)
+	mutex  sync.RWMutex
+	queue  chan []byte
+	closed bool
+	done   chan struct{}
+	conn   net.Conn
+}
+
+// newSyslogForwarder starts forwarding log messages to the syslog endpoint
+// of 'cfg'; relative file names are relative to 'homeDir'
+func newSyslogForwarder(cfg *SyslogConfig, homeDir string, report func(msg string)) (*syslogForwarder, error) {
+	network, address, useTLS, err := parseSyslogAddress(cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	facility := "local0"
+	if cfg.Facility != "" {
+		facility = strings.ToLower(cfg.Facility)
+	}
+	appName := cfg.AppName
+	if appName == "" {
+		appName = "fabric-ca-server"
+	}
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultSyslogQueueSize
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	f := &syslogForwarder{
+		network:  network,
+		address:  address,
+		facility: syslogFacilities[facility],
+		hostname: syslogName(hostname, 255),
+		appName:  syslogName(appName, 48),
+		pid:      os.Getpid(),
+		report:   report,
+		queue:    make(chan []byte, queueSize),
+		done:     make(chan struct{}),
+	}
+	if useTLS {
+		// The certificate of the endpoint is verified with the trusted
+		// certificate files, or else the system's roots
+		tlsCfg := cfg.TLS
+		tlsCfg.Enabled = true
+		if len(tlsCfg.CertFiles) > 0 || tlsCfg.Client.CertFile != "" || tlsCfg.Insecure {
+			err = stls.AbsTLSClient(&tlsCfg, homeDir)
+			if err != nil {
+				return nil, err
+			}
+			f.tlsConfig, err = stls.GetClientTLSConfig(&tlsCfg, nil)
+			if err != nil {
+				return nil, errors.WithMessage(err, "Failed to get the TLS configuration of the syslog endpoint")
+			}
+		} else {
+			f.tlsConfig = &tls.Config{ServerName: tlsCfg.ServerName}
+		}
+		if f.tlsConfig.ServerName == "" {
+			f.tlsConfig.ServerName, _, _ = net.SplitHostPort(address)
+		}
+	}
+	go f.run()
+	return f, nil
+}
+
+// syslogName returns 'name' as a header field of RFC 5424: printable
+// characters other than space, of at most 'max' characters
+func syslogName(name string, max int) string {
+	name = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, name)
+	if len(name) > max {
+		name = name[:max]
+	}
+	return name
+}
+
+// send queues the log message 'msg' with the message ID 'msgID' and the
+// structured data 'fields' to be forwarded, or drops it if the queue is full
+func (f *syslogForwarder) send(now time.Time, level int, msgID, msg string, fields Fields) {
+	line := f.format(now, level, msgID, msg, fields)
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if f.closed {
+		return
+	}
+	select {
+	case f.queue <- line:
+	default:
+		dropSyslogMessage()
+	}
+}
+
+// format returns the log message in the format of RFC 5424
+func (f *syslogForwarder) format(now time.Time, level int, msgID, msg string, fields Fields) []byte {
+	if msgID == "" {
+		msgID = "-"
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>%d %s %s %s %d %s ", f.facility*8+journalPriorities[level], syslogVersion,
+		now.UTC().Format(syslogTimeFormat), f.hostname, f.appName, f.pid, msgID)
+	if len(fields) == 0 {
+		b.WriteByte('-')
+	} else {
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		b.WriteString("[" + syslogSDID)
+		for _, name := range names {
+			fmt.Fprintf(&b, ` %s="%s"`, syslogName(name, 32), escapeSDValue(fmt.Sprint(fields[name])))
+		}
+		b.WriteByte(']')
+	}
+	if msg != "" {
+		b.WriteByte(' ')
+		b.WriteString(msg)
+	}
+	return b.Bytes()
+}
+
+// escapeSDValue escapes the characters of a structured data parameter value
+// which RFC 5424 requires to be escaped
+func escapeSDValue(v string) string {
+	var b strings.Builder
+	for _, r := range v {
+		if r == '"' || r == '\\' || r == ']' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// run forwards the queued messages until the forwarder is stopped
+func (f *syslogForwarder) run() {
+	defer close(f.done)
+	failing := false
+	delay := 100 * time.Millisecond
+	for line := range f.queue {
+		err := f.write(line)
+		if err != nil {
+			// The message is sent again once reconnected
+			f.closeConn()
+			err = f.write(line)
+		}
+		if err == nil {
+			failing = false
+			delay = 100 * time.Millisecond
+			continue
+		}
+		f.closeConn()
+		dropSyslogMessage()
+		if !failing {
+			failing = true
+			f.report(fmt.Sprintf("Failed to forward log messages to syslog at %s: %s", f.address, err))
+		}
+		// Wait before reconnecting, unless the forwarder is stopped
+		f.mutex.RLock()
+		closed := f.closed
+		f.mutex.RUnlock()
+		if !closed {
+			time.Sleep(delay)
+			delay *= 2
+			if delay > syslogMaxRetryDelay {
+				delay = syslogMaxRetryDelay
+			}
+		}
+	}
+	f.closeConn()
+}
+
+// write sends 'line' to the endpoint, connecting to it if not connected
+func (f *syslogForwarder) write(line []byte) error {
+	if f.conn == nil {
+		conn, err := f.dial()
+		if err != nil {
+			return err
+		}
+		f.conn = conn
+	}
+	var msg []byte
+	switch {
+	case f.network == "tcp":
+		// Messages are framed by octet counting over TCP (RFC 6587)
+		msg = append([]byte(fmt.Sprintf("%d ", len(line))), line...)
+	case f.network == "unix" && f.conn.LocalAddr().Network() == "unix":
+		// A stream socket of the local syslog daemon separates messages by newlines
+		msg = append(line, '\n')
+	default:
+		msg = line
+	}
+	f.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	_, err := f.conn.Write(msg)
+	return err
+}
+
+// dial connects to the endpoint; a local socket is connected to as a
+// datagram socket, or else as a stream socket
+func (f *syslogForwarder) dial() (net.Conn, error) {
+	if f.network == "unix" {
+		conn, err := net.DialTimeout("unixgram", f.address, syslogWriteTimeout)
+		if err == nil {
+			return conn, nil
+		}
+		return net.DialTimeout("unix", f.address, syslogWriteTimeout)
+	}
+	if f.tlsConfig != nil {
+		return tls.DialWithDialer(&net.Dialer{Timeout: syslogWriteTimeout}, f.network, f.address, f.tlsConfig)
+	}
+	return net.DialTimeout(f.network, f.address, syslogWriteTimeout)
+}
+
+func (f *syslogForwarder) closeConn() {
+	if f.conn != nil {
+		f.conn.Close()
+		f.conn = nil
+	}
+}
+
+// stop stops forwarding log messages, after forwarding those which are
+// queued for at most syslogStopTimeout
+func (f *syslogForwarder) stop() {
+	f.mutex.Lock()
+	if f.closed {
+		f.mutex.Unlock()
+		return
+	}
+	f.closed = true
+	close(f.queue)
+	f.mutex.Unlock()
+	select {
+	case <-f.done:
+	case <-time.After(syslogStopTimeout):
+	}
+}
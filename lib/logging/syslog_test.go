@@ -0,0 +1,181 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package logging
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// syslogPattern matches a message of RFC 5424, capturing its priority,
+// message ID, structured data and message
+var syslogPattern = regexp.MustCompile(`^<(\d+)>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}Z \S+ fabric-ca-server \d+ (\S+) (-|\[.*\]) ?(.*)$`)
+
+func TestSyslogUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen for syslog messages: %s", err)
+	}
+	defer conn.Close()
+	defer resetLogging(t)
+
+	err = Configure(&Config{Syslog: SyslogConfig{Address: "udp://" + conn.LocalAddr().String(), Facility: "auth"}}, "")
+	if err != nil {
+		t.Fatalf("Failed to configure logging: %s", err)
+	}
+	log.Warning("disk almost full")
+	Log(log.LevelInfo, "request", Fields{"request_id": "abc", "path": `/a"b]`})
+	log.Level = log.LevelError
+	Audit(log.LevelInfo, "authentication_success", "Authenticated 'admin'", Fields{"identity": "admin"})
+
+	msgs := make([][]string, 0, 3)
+	buf := make([]byte, 4096)
+	for i := 0; i < 3; i++ {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Failed to receive syslog message %d: %s", i, err)
+		}
+		m := syslogPattern.FindStringSubmatch(string(buf[:n]))
+		if !assert.NotNil(t, m, "Invalid syslog message: %s", buf[:n]) {
+			return
+		}
+		msgs = append(msgs, m[1:])
+	}
+	// The priority is the facility auth (4) * 8 + the severity
+	assert.Equal(t, []string{"36", "-", "-", "disk almost full"}, msgs[0])
+	assert.Equal(t, []string{"38", "-", `[fabric-ca@32473 path="/a\"b\]" request_id="abc"]`, "request"}, msgs[1])
+	// Audit events are forwarded whatever the log level
+	assert.Equal(t, []string{"38", "audit", `[fabric-ca@32473 event="authentication_success" identity="admin"]`, "Authenticated 'admin'"}, msgs[2])
+}
+
+func TestSyslogTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen for syslog messages: %s", err)
+	}
+	defer ln.Close()
+	defer resetLogging(t)
+
+	err = Configure(&Config{Syslog: SyslogConfig{Address: "tcp://" + ln.Addr().String(), AppName: "fabric-ca-server"}}, "")
+	if err != nil {
+		t.Fatalf("Failed to configure logging: %s", err)
+	}
+	Audit(log.LevelWarning, "authorization_failure", "Authorization failure of 'user1'", Fields{"code": 71})
+	log.Error("failed")
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept the syslog connection: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for _, expected := range [][]string{
+		{"132", "audit", `[fabric-ca@32473 code="71" event="authorization_failure"]`, "Authorization failure of 'user1'"},
+		{"131", "-", "-", "failed"},
+	} {
+		// Each message is framed by its length
+		prefix, err := r.ReadString(' ')
+		if err != nil {
+			t.Fatalf("Failed to read the length of the syslog message: %s", err)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(prefix))
+		if err != nil {
+			t.Fatalf("Invalid length of the syslog message '%s'", prefix)
+		}
+		msg := make([]byte, n)
+		_, err = io.ReadFull(r, msg)
+		if err != nil {
+			t.Fatalf("Failed to read the syslog message: %s", err)
+		}
+		m := syslogPattern.FindStringSubmatch(string(msg))
+		if assert.NotNil(t, m, "Invalid syslog message: %s", msg) {
+			assert.Equal(t, expected, m[1:])
+		}
+	}
+}
+
+func TestSyslogUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer resetLogging(t)
+
+	sock := filepath.Join(dir, "log")
+	conn, err := net.ListenPacket("unixgram", sock)
+	if err != nil {
+		t.Fatalf("Failed to listen for syslog messages: %s", err)
+	}
+	defer conn.Close()
+	err = Configure(&Config{Syslog: SyslogConfig{Address: "unix://" + sock}}, "")
+	if err != nil {
+		t.Fatalf("Failed to configure logging: %s", err)
+	}
+	log.Info("started")
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Failed to receive the syslog message: %s", err)
+	}
+	m := syslogPattern.FindStringSubmatch(string(buf[:n]))
+	if assert.NotNil(t, m, "Invalid syslog message: %s", buf[:n]) {
+		// The default facility is local0 (16)
+		assert.Equal(t, []string{"134", "-", "-", "started"}, m[1:])
+	}
+}
+
+func TestSyslogDrop(t *testing.T) {
+	dropped := 0
+	SetSyslogDropObserver(func() { dropped++ })
+	defer SetSyslogDropObserver(nil)
+	before := SyslogDropped()
+
+	// The messages which don't fit in the queue are dropped rather than
+	// blocking while none are forwarded
+	f := &syslogForwarder{appName: "fabric-ca-server", hostname: "host", queue: make(chan []byte, 2)}
+	for i := 0; i < 5; i++ {
+		f.send(time.Now(), log.LevelInfo, "", "message", nil)
+	}
+	assert.Len(t, f.queue, 2)
+	assert.Equal(t, uint64(3), SyslogDropped()-before)
+	assert.Equal(t, 3, dropped)
+}
+
+func TestSyslogConfigErrors(t *testing.T) {
+	defer resetLogging(t)
+	for _, cfg := range []SyslogConfig{
+		{Address: "http://localhost:514"},
+		{Address: "udp://"},
+		{Address: "unix://"},
+		{Address: "udp://localhost", Facility: "local9"},
+		{Address: "udp://localhost", QueueSize: -1},
+	} {
+		err := Configure(&Config{Syslog: cfg}, "")
+		assert.Error(t, err, "Invalid syslog configuration %+v should fail", cfg)
+	}
+	network, address, useTLS, err := parseSyslogAddress("tls://syslog.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp", network)
+	assert.Equal(t, "syslog.example.com:6514", address)
+	assert.True(t, useTLS)
+}
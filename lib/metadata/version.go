@@ -31,15 +31,56 @@ const (
 // It is defined by the Makefile and passed in with ldflags
 var Version = "1.3.1"
 
+// Commit is the git commit from which fabric-ca-client/fabric-ca-server was built.
+// It is defined by the Makefile and passed in with ldflags
+var Commit string
+
+// BuildDate is the date at which fabric-ca-client/fabric-ca-server was built.
+// It is defined by the Makefile and passed in with ldflags
+var BuildDate string
+
+// APIVersion is the version of the REST API which is served by
+// fabric-ca-server and used by fabric-ca-client, whose endpoints are also
+// served without a version prefix
+var APIVersion = "v1"
+
+// APIVersions are the versions of the REST API which are served by
+// fabric-ca-server and used by fabric-ca-client, oldest first. An endpoint
+// of a later version supersedes the endpoint of the same path of APIVersion.
+var APIVersions = []string{APIVersion, "v2"}
+
 // GetVersionInfo returns version information for the fabric-ca-client/fabric-ca-server
 func GetVersionInfo(prgName string) string {
 	if Version == "" {
 		Version = "development build"
 	}
 
-	return fmt.Sprintf("%s:\n Version: %s\n Go version: %s\n OS/Arch: %s\n",
-		prgName, Version, runtime.Version(),
-		fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH))
+	info := fmt.Sprintf("%s:\n Version: %s\n", prgName, Version)
+	if Commit != "" {
+		info += fmt.Sprintf(" Commit: %s\n", Commit)
+	}
+	if BuildDate != "" {
+		info += fmt.Sprintf(" Build date: %s\n", BuildDate)
+	}
+	info += fmt.Sprintf(" API versions: %s\n Go version: %s\n OS/Arch: %s\n",
+		strings.Join(APIVersions, ", "), runtime.Version(), fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH))
+	return info
+}
+
+// GetBuildInfo returns a short description of the version and build
+func GetBuildInfo() string {
+	info := GetVersion()
+	var build []string
+	if Commit != "" {
+		build = append(build, "commit "+Commit)
+	}
+	if BuildDate != "" {
+		build = append(build, "built "+BuildDate)
+	}
+	if len(build) > 0 {
+		info += " (" + strings.Join(build, ", ") + ")"
+	}
+	return info
 }
 
 // GetVersion returns the version
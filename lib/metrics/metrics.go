@@ -0,0 +1,220 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package metrics is a registry of the counters, gauges and summaries which
+// the fabric-ca server maintains about itself, exposed in the Prometheus text
+// exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The kinds of metrics
+const (
+	kindCounter = "counter"
+	kindGauge   = "gauge"
+	kindSummary = "summary"
+)
+
+// Registry holds the families of metrics of the server
+type Registry struct {
+	mutex    sync.Mutex
+	families map[string]*Family
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*Family{}}
+}
+
+// NewCounter registers and returns the family of counters with the specified
+// name and label names. A counter only increases.
+func (r *Registry) NewCounter(name, help string, labelNames ...string) *Family {
+	return r.register(name, help, kindCounter, labelNames)
+}
+
+// NewGauge registers and returns the family of gauges with the specified name
+// and label names. A gauge may increase and decrease.
+func (r *Registry) NewGauge(name, help string, labelNames ...string) *Family {
+	return r.register(name, help, kindGauge, labelNames)
+}
+
+// NewSummary registers and returns the family of summaries with the specified
+// name and label names. A summary tracks the count and sum of observations.
+func (r *Registry) NewSummary(name, help string, labelNames ...string) *Family {
+	return r.register(name, help, kindSummary, labelNames)
+}
+
+// register returns the family named 'name', creating it if needed
+func (r *Registry) register(name, help, kind string, labelNames []string) *Family {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	f := r.families[name]
+	if f == nil {
+		f = &Family{
+			name:       name,
+			help:       help,
+			kind:       kind,
+			labelNames: labelNames,
+			metrics:    map[string]*Metric{},
+		}
+		r.families[name] = f
+	}
+	return f
+}
+
+// Get returns the family named 'name', or nil if there is none
+func (r *Registry) Get(name string) *Family {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.families[name]
+}
+
+// Write writes all metrics in the Prometheus text exposition format
+func (r *Registry) Write(w io.Writer) error {
+	r.mutex.Lock()
+	families := make([]*Family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mutex.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
+
+// Family is a set of metrics with the same name which are distinguished by
+// the values of their labels
+type Family struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	mutex      sync.Mutex
+	metrics    map[string]*Metric
+}
+
+// With returns the metric of the family with the specified label values,
+// which are in the order of the family's label names
+func (f *Family) With(labelValues ...string) *Metric {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric '%s' has %d labels but %d values were given",
+			f.name, len(f.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	m := f.metrics[key]
+	if m == nil {
+		m = &Metric{labels: f.formatLabels(labelValues)}
+		f.metrics[key] = m
+	}
+	return m
+}
+
+func (f *Family) formatLabels(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(values))
+	for i, v := range values {
+		pairs[i] = fmt.Sprintf("%s=%s", f.labelNames[i], strconv.Quote(v))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (f *Family) write(w io.Writer) {
+	f.mutex.Lock()
+	metrics := make([]*Metric, 0, len(f.metrics))
+	for _, m := range f.metrics {
+		metrics = append(metrics, m)
+	}
+	f.mutex.Unlock()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].labels < metrics[j].labels })
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+	for _, m := range metrics {
+		value, count := m.get()
+		if f.kind == kindSummary {
+			fmt.Fprintf(w, "%s_sum%s %s\n", f.name, m.labels, formatValue(value))
+			fmt.Fprintf(w, "%s_count%s %d\n", f.name, m.labels, count)
+		} else {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, m.labels, formatValue(value))
+		}
+	}
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Metric is a single counter, gauge or summary
+type Metric struct {
+	labels string
+	mutex  sync.Mutex
+	value  float64
+	count  uint64
+}
+
+// Add adds 'v' to the value of a counter or gauge
+func (m *Metric) Add(v float64) {
+	m.mutex.Lock()
+	m.value += v
+	m.mutex.Unlock()
+}
+
+// Set sets the value of a gauge
+func (m *Metric) Set(v float64) {
+	m.mutex.Lock()
+	m.value = v
+	m.mutex.Unlock()
+}
+
+// Observe adds an observation to a summary
+func (m *Metric) Observe(v float64) {
+	m.mutex.Lock()
+	m.value += v
+	m.count++
+	m.mutex.Unlock()
+}
+
+// Value returns the value of a counter or gauge, or the sum of the
+// observations of a summary
+func (m *Metric) Value() float64 {
+	v, _ := m.get()
+	return v
+}
+
+// Count returns the number of observations of a summary
+func (m *Metric) Count() uint64 {
+	_, c := m.get()
+	return c
+}
+
+func (m *Metric) get() (float64, uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.value, m.count
+}
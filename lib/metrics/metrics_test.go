@@ -0,0 +1,69 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("requests_total", "Number of requests", "method", "status")
+	inFlight := r.NewGauge("in_flight", "Requests in progress")
+	duration := r.NewSummary("duration_seconds", "Duration of requests", "method")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			requests.With("GET", "200").Add(1)
+			duration.With("GET").Observe(0.5)
+		}()
+	}
+	wg.Wait()
+	requests.With("POST", "401").Add(2)
+	inFlight.With().Add(3)
+	inFlight.With().Add(-1)
+
+	assert.Equal(t, float64(100), requests.With("GET", "200").Value())
+	assert.Equal(t, float64(2), inFlight.With().Value())
+	assert.Equal(t, uint64(100), duration.With("GET").Count())
+	assert.Equal(t, float64(50), duration.With("GET").Value())
+	assert.True(t, requests == r.NewCounter("requests_total", "Number of requests", "method", "status"),
+		"Registering a family twice should return the same family")
+	assert.Nil(t, r.Get("unknown"))
+
+	var buf bytes.Buffer
+	err := r.Write(&buf)
+	assert.NoError(t, err)
+	expected := `# HELP duration_seconds Duration of requests
+# TYPE duration_seconds summary
+duration_seconds_sum{method="GET"} 50
+duration_seconds_count{method="GET"} 100
+# HELP in_flight Requests in progress
+# TYPE in_flight gauge
+in_flight 2
+# HELP requests_total Number of requests
+# TYPE requests_total counter
+requests_total{method="GET",status="200"} 100
+requests_total{method="POST",status="401"} 2
+`
+	assert.Equal(t, expected, buf.String())
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, expected, w.Body.String())
+
+	assert.Panics(t, func() { requests.With("GET") }, "Wrong number of label values should panic")
+}
@@ -2,6 +2,7 @@
 package mocks
 
 import http "net/http"
+import x509 "crypto/x509"
 
 import mock "github.com/stretchr/testify/mock"
 import server "github.com/hyperledger/fabric-ca/lib/server"
@@ -196,6 +197,22 @@ func (_m *ServerRequestContext) GetResp() http.ResponseWriter {
 	return r0
 }
 
+// GetTLSPeerCertificate provides a mock function with given fields:
+func (_m *ServerRequestContext) GetTLSPeerCertificate() *x509.Certificate {
+	ret := _m.Called()
+
+	var r0 *x509.Certificate
+	if rf, ok := ret.Get(0).(func() *x509.Certificate); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*x509.Certificate)
+		}
+	}
+
+	return r0
+}
+
 // HasRole provides a mock function with given fields: role
 func (_m *ServerRequestContext) HasRole(role string) error {
 	ret := _m.Called(role)
@@ -0,0 +1,157 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package openapi
+
+import (
+	"encoding"
+	"encoding/json"
+	"math/big"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	bigIntType        = reflect.TypeOf(big.Int{})
+	timeType          = reflect.TypeOf(time.Time{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// Schemas builds the schemas of Go types as they are encoded by
+// encoding/json. The schema of a named struct type is added to the schema
+// components, and a reference to it is returned in its place.
+type Schemas struct {
+	components map[string]*Schema
+	// names are the names of the components of the struct types
+	names map[reflect.Type]string
+}
+
+// NewSchemas returns a builder which adds the schemas of struct types to
+// 'components'
+func NewSchemas(components map[string]*Schema) *Schemas {
+	return &Schemas{components: components, names: map[reflect.Type]string{}}
+}
+
+// For returns the schema of the type of 'v'
+func (s *Schemas) For(v interface{}) *Schema {
+	if v == nil {
+		return &Schema{}
+	}
+	return s.schema(reflect.TypeOf(v))
+}
+
+func (s *Schemas) schema(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == bigIntType:
+		return &Schema{Type: "integer"}
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType):
+		// The encoding of the type is its own
+		return &Schema{}
+	case t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType):
+		return &Schema{Type: "string"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// encoding/json encodes a byte slice as base64
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: s.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: s.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		return s.component(t)
+	}
+	// An interface, whose value may be anything
+	return &Schema{}
+}
+
+// component returns a reference to the schema component of the named struct
+// type 't', adding the component if it is not yet added
+func (s *Schemas) component(t reflect.Type) *Schema {
+	name, ok := s.names[t]
+	if !ok {
+		name = t.Name()
+		if _, taken := s.components[name]; taken {
+			// Another package has a type of the same name
+			name = strings.Title(path.Base(t.PkgPath())) + name
+		}
+		s.names[t] = name
+		// The component is added before its properties, which may refer to it
+		s.components[name] = &Schema{}
+		*s.components[name] = *s.object(t)
+	}
+	return SchemaRef(name)
+}
+
+// object returns the schema of the struct type 't', which has a property for
+// each field encoded by encoding/json
+func (s *Schemas) object(t reflect.Type) *Schema {
+	obj := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	s.addProperties(obj, t)
+	return obj
+}
+
+// addProperties adds the properties of the fields of the struct type 't' to
+// the schema 'obj', including those of its embedded structs
+func (s *Schemas) addProperties(obj *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			// The fields of an embedded struct are encoded as those of 't'
+			s.addProperties(obj, ft)
+			continue
+		}
+		if f.PkgPath != "" {
+			// Unexported
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		prop := s.schema(f.Type)
+		if strings.Contains(tag, ",string") {
+			prop = &Schema{Type: "string"}
+		}
+		// The siblings of a reference are ignored, so it is not described
+		if help := f.Tag.Get("help"); help != "" && prop.Ref == "" {
+			prop.Description = help
+		}
+		obj.Properties[name] = prop
+	}
+}
@@ -0,0 +1,61 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package openapi
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type embedded struct {
+	Inner string `json:"inner"`
+}
+
+type node struct {
+	embedded
+	Name     string            `json:"name" help:"Name of the node"`
+	Children []*node           `json:"children,omitempty"`
+	Data     []byte            `json:"data"`
+	Count    int64             `json:"count,string"`
+	Labels   map[string]string `json:"labels"`
+	Created  time.Time         `json:"created"`
+	ID       *big.Int          `json:"id"`
+	Any      interface{}       `json:"any"`
+	Untagged bool
+	Skipped  string `json:"-"`
+	private  string
+}
+
+func TestSchemas(t *testing.T) {
+	components := map[string]*Schema{}
+	s := NewSchemas(components)
+	assert.Equal(t, SchemaRef("node"), s.For(&node{}), "A named struct should be a reference")
+	assert.Equal(t, &Schema{Type: "array", Items: SchemaRef("node")}, s.For([]node{}))
+	assert.Equal(t, &Schema{}, s.For(nil))
+
+	n := components["node"]
+	if !assert.NotNil(t, n, "The struct should be a component") {
+		return
+	}
+	assert.Equal(t, "object", n.Type)
+	assert.Equal(t, &Schema{Type: "string"}, n.Properties["inner"], "The fields of an embedded struct should be flattened")
+	assert.Equal(t, &Schema{Type: "string", Description: "Name of the node"}, n.Properties["name"])
+	assert.Equal(t, &Schema{Type: "array", Items: SchemaRef("node")}, n.Properties["children"], "A recursive type should refer to itself")
+	assert.Equal(t, &Schema{Type: "string", Format: "byte"}, n.Properties["data"])
+	assert.Equal(t, &Schema{Type: "string"}, n.Properties["count"])
+	assert.Equal(t, &Schema{Type: "object", AdditionalProperties: &Schema{Type: "string"}}, n.Properties["labels"])
+	assert.Equal(t, &Schema{Type: "string", Format: "date-time"}, n.Properties["created"])
+	assert.Equal(t, &Schema{Type: "integer"}, n.Properties["id"])
+	assert.Equal(t, &Schema{}, n.Properties["any"])
+	assert.Equal(t, &Schema{Type: "boolean"}, n.Properties["Untagged"])
+	for _, name := range []string{"Skipped", "-", "private", "embedded"} {
+		assert.NotContains(t, n.Properties, name)
+	}
+}
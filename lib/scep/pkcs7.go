@@ -0,0 +1,531 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package scep
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The object identifiers of the PKCS #7 content types, attributes and
+// algorithms used by SCEP
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+
+	oidAttributeContentType       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttributeMessageDigest     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttributeSigningTime       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidAttributeChallengePassword = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA256WithRSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidAES128CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES256CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDES3CBC   = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+// digestAlgorithms are the hash functions of the digest algorithms
+var digestAlgorithms = []struct {
+	oid  asn1.ObjectIdentifier
+	hash crypto.Hash
+}{
+	{oidSHA1, crypto.SHA1},
+	{oidSHA256, crypto.SHA256},
+	{oidSHA384, crypto.SHA384},
+	{oidSHA512, crypto.SHA512},
+}
+
+// contentInfo is a PKCS #7 content of any type
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     issuerAndSerialNumber
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+type envelopedData struct {
+	Version              int
+	RecipientInfos       []recipientInfo `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type recipientInfo struct {
+	Version                int
+	IssuerAndSerialNumber  issuerAndSerialNumber
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// signedContent is a parsed signed data with one signer
+type signedContent struct {
+	// The content which is signed, if any
+	content      []byte
+	certificates []*x509.Certificate
+	signer       *x509.Certificate
+	// The hash function of the signature
+	hash       crypto.Hash
+	attributes []attribute
+}
+
+// explicitContent returns the explicitly tagged content of a contentInfo
+func explicitContent(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// unmarshalDER parses the DER encoding 'der' into 'v', which must be all of 'der'
+func unmarshalDER(der []byte, v interface{}, what string) error {
+	rest, err := asn1.Unmarshal(der, v)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to parse %s", what)
+	}
+	if len(rest) > 0 {
+		return errors.Errorf("Trailing data after %s", what)
+	}
+	return nil
+}
+
+func newIssuerAndSerialNumber(cert *x509.Certificate) issuerAndSerialNumber {
+	return issuerAndSerialNumber{Issuer: asn1.RawValue{FullBytes: cert.RawIssuer}, SerialNumber: cert.SerialNumber}
+}
+
+// identifies returns true if 'ias' identifies 'cert'
+func (ias issuerAndSerialNumber) identifies(cert *x509.Certificate) bool {
+	return bytes.Equal(ias.Issuer.FullBytes, cert.RawIssuer) && ias.SerialNumber != nil &&
+		ias.SerialNumber.Cmp(cert.SerialNumber) == 0
+}
+
+// newAttribute returns the attribute of type 'typ' whose value is 'value',
+// encoded with the ASN.1 marshaling parameters 'params'
+func newAttribute(typ asn1.ObjectIdentifier, value interface{}, params string) (attribute, error) {
+	der, err := asn1.MarshalWithParams(value, params)
+	if err != nil {
+		return attribute{}, errors.Wrapf(err, "Failed to encode attribute %s", typ)
+	}
+	return attribute{Type: typ, Values: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: der}}, nil
+}
+
+// findAttribute parses the first value of the attribute of type 'typ' into
+// 'v', returning false if there is no such attribute
+func findAttribute(attrs []attribute, typ asn1.ObjectIdentifier, v interface{}) (bool, error) {
+	for _, attr := range attrs {
+		if !attr.Type.Equal(typ) {
+			continue
+		}
+		_, err := asn1.Unmarshal(attr.Values.Bytes, v)
+		if err != nil {
+			return true, errors.Wrapf(err, "Failed to parse attribute %s", typ)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func digestAlgorithmHash(alg pkix.AlgorithmIdentifier) (crypto.Hash, error) {
+	for _, da := range digestAlgorithms {
+		if alg.Algorithm.Equal(da.oid) {
+			return da.hash, nil
+		}
+	}
+	return 0, errors.Errorf("Unsupported digest algorithm %s", alg.Algorithm)
+}
+
+func digestAlgorithmIdentifier(hash crypto.Hash) (pkix.AlgorithmIdentifier, error) {
+	for _, da := range digestAlgorithms {
+		if da.hash == hash {
+			return pkix.AlgorithmIdentifier{Algorithm: da.oid, Parameters: asn1.NullRawValue}, nil
+		}
+	}
+	return pkix.AlgorithmIdentifier{}, errors.Errorf("Unsupported hash function %s", hash)
+}
+
+func digest(hash crypto.Hash, data []byte) []byte {
+	h := hash.New()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// signData returns the DER encoding of the signed data whose content is
+// 'content', signed by 'cert' and 'key' with the authenticated attributes
+// 'attrs' in addition to the content type and message digest
+func signData(content []byte, cert *x509.Certificate, key *rsa.PrivateKey, hash crypto.Hash, attrs []attribute) ([]byte, error) {
+	digestAlg, err := digestAlgorithmIdentifier(hash)
+	if err != nil {
+		return nil, err
+	}
+	contentType, err := newAttribute(oidAttributeContentType, oidData, "")
+	if err != nil {
+		return nil, err
+	}
+	messageDigest, err := newAttribute(oidAttributeMessageDigest, digest(hash, content), "")
+	if err != nil {
+		return nil, err
+	}
+	signingTime, err := newAttribute(oidAttributeSigningTime, time.Now().UTC(), "utc")
+	if err != nil {
+		return nil, err
+	}
+	attrs = append([]attribute{contentType, messageDigest, signingTime}, attrs...)
+	// The signature is over the DER encoding of the attributes as a SET OF,
+	// which are sent with the implicit tag [0] instead
+	signed, err := asn1.MarshalWithParams(attrs, "set")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to encode authenticated attributes")
+	}
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, hash, digest(hash, signed))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to sign")
+	}
+	authAttrs := append([]byte{0xa0}, signed[1:]...)
+	econtent, err := asn1.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{digestAlg},
+		ContentInfo:      contentInfo{ContentType: oidData, Content: explicitContent(econtent)},
+		Certificates:     certificatesValue([]*x509.Certificate{cert}),
+		SignerInfos: []signerInfo{{
+			Version:                   1,
+			IssuerAndSerialNumber:     newIssuerAndSerialNumber(cert),
+			DigestAlgorithm:           digestAlg,
+			AuthenticatedAttributes:   asn1.RawValue{FullBytes: authAttrs},
+			DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+			EncryptedDigest:           sig,
+		}},
+	}
+	return marshalContentInfo(oidSignedData, sd)
+}
+
+// verifySignedData parses the signed data 'der', which must have one signer
+// whose certificate is in the signed data, and verifies its signature
+func verifySignedData(der []byte) (*signedContent, error) {
+	sd, err := parseSignedData(der)
+	if err != nil {
+		return nil, err
+	}
+	sc := &signedContent{}
+	sc.certificates, err = x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the certificates of the signed data")
+	}
+	if len(sd.ContentInfo.Content.Bytes) > 0 {
+		err = unmarshalDER(sd.ContentInfo.Content.Bytes, &sc.content, "signed content")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, errors.Errorf("The signed data has %d signers instead of one", len(sd.SignerInfos))
+	}
+	si := sd.SignerInfos[0]
+	for _, cert := range sc.certificates {
+		if si.IssuerAndSerialNumber.identifies(cert) {
+			sc.signer = cert
+			break
+		}
+	}
+	if sc.signer == nil {
+		return nil, errors.New("The certificate of the signer is not in the signed data")
+	}
+	pub, ok := sc.signer.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("The key of the signer is not an RSA key")
+	}
+	hash, err := digestAlgorithmHash(si.DigestAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	sc.hash = hash
+	if len(si.AuthenticatedAttributes.FullBytes) == 0 {
+		return nil, errors.New("The signer has no authenticated attributes")
+	}
+	signed := append([]byte{0x31}, si.AuthenticatedAttributes.FullBytes[1:]...)
+	_, err = asn1.UnmarshalWithParams(signed, &sc.attributes, "set")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the authenticated attributes")
+	}
+	err = rsa.VerifyPKCS1v15(pub, hash, digest(hash, signed), si.EncryptedDigest)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid signature")
+	}
+	var md []byte
+	found, err := findAttribute(sc.attributes, oidAttributeMessageDigest, &md)
+	if err != nil {
+		return nil, err
+	}
+	if !found || !bytes.Equal(md, digest(hash, sc.content)) {
+		return nil, errors.New("The message digest does not match the signed content")
+	}
+	return sc, nil
+}
+
+func parseSignedData(der []byte) (*signedData, error) {
+	var ci contentInfo
+	err := unmarshalDER(der, &ci, "content info")
+	if err != nil {
+		return nil, err
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, errors.Errorf("The content type %s is not signed data", ci.ContentType)
+	}
+	sd := new(signedData)
+	err = unmarshalDER(ci.Content.Bytes, sd, "signed data")
+	if err != nil {
+		return nil, err
+	}
+	return sd, nil
+}
+
+// certificatesValue returns the implicitly tagged certificates of a signed data
+func certificatesValue(certs []*x509.Certificate) asn1.RawValue {
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		buf.Write(cert.Raw)
+	}
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: buf.Bytes()}
+}
+
+func marshalContentInfo(typ asn1.ObjectIdentifier, content interface{}) ([]byte, error) {
+	der, err := asn1.Marshal(content)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to encode content of type %s", typ)
+	}
+	return asn1.Marshal(contentInfo{ContentType: typ, Content: explicitContent(der)})
+}
+
+// DegenerateCertificates returns the DER encoding of a signed data without
+// content or signers, which conveys the certificates 'certs'
+func DegenerateCertificates(certs []*x509.Certificate) ([]byte, error) {
+	return marshalContentInfo(oidSignedData, signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{},
+		ContentInfo:      contentInfo{ContentType: oidData},
+		Certificates:     certificatesValue(certs),
+		SignerInfos:      []signerInfo{},
+	})
+}
+
+// ParseDegenerateCertificates returns the certificates of the signed data
+// 'der', such as the response to GetCACert
+func ParseDegenerateCertificates(der []byte) ([]*x509.Certificate, error) {
+	sd, err := parseSignedData(der)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the certificates of the signed data")
+	}
+	return certs, nil
+}
+
+// contentCipher is a content encryption algorithm
+type contentCipher struct {
+	oid     asn1.ObjectIdentifier
+	keySize int
+	block   func(key []byte) (cipher.Block, error)
+}
+
+var contentCiphers = map[string]contentCipher{
+	"AES":    {oidAES128CBC, 16, aes.NewCipher},
+	"AES256": {oidAES256CBC, 32, aes.NewCipher},
+	"DES3":   {oidDES3CBC, 24, des.NewTripleDESCipher},
+}
+
+func findContentCipher(oid asn1.ObjectIdentifier) (contentCipher, error) {
+	for _, c := range contentCiphers {
+		if c.oid.Equal(oid) {
+			return c, nil
+		}
+	}
+	return contentCipher{}, errors.Errorf("Unsupported content encryption algorithm %s", oid)
+}
+
+// envelopeData returns the DER encoding of the enveloped data whose content
+// is 'content' encrypted with 'cc' for the recipient 'cert'
+func envelopeData(content []byte, cert *x509.Certificate, cc contentCipher) ([]byte, error) {
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("The key of the recipient is not an RSA key")
+	}
+	key := make([]byte, cc.keySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := cc.block(key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, block.BlockSize())
+	_, err = rand.Read(iv)
+	if err != nil {
+		return nil, err
+	}
+	// PKCS #7 padding
+	pad := block.BlockSize() - len(content)%block.BlockSize()
+	encrypted := append(append([]byte{}, content...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+	encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to encrypt the content encryption key")
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	return marshalContentInfo(oidEnvelopedData, envelopedData{
+		Version: 0,
+		RecipientInfos: []recipientInfo{{
+			Version:                0,
+			IssuerAndSerialNumber:  newIssuerAndSerialNumber(cert),
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+			EncryptedKey:           encryptedKey,
+		}},
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType:                oidData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: cc.oid, Parameters: asn1.RawValue{FullBytes: ivParam}},
+			EncryptedContent:           asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: encrypted},
+		},
+	})
+}
+
+// openEnvelopedData decrypts the enveloped data 'der' with the key of its
+// recipient 'cert', returning the content and its encryption algorithm
+func openEnvelopedData(der []byte, cert *x509.Certificate, key *rsa.PrivateKey) ([]byte, contentCipher, error) {
+	var ci contentInfo
+	var ed envelopedData
+	err := unmarshalDER(der, &ci, "content info")
+	if err != nil {
+		return nil, contentCipher{}, err
+	}
+	if !ci.ContentType.Equal(oidEnvelopedData) {
+		return nil, contentCipher{}, errors.Errorf("The content type %s is not enveloped data", ci.ContentType)
+	}
+	err = unmarshalDER(ci.Content.Bytes, &ed, "enveloped data")
+	if err != nil {
+		return nil, contentCipher{}, err
+	}
+	var ri *recipientInfo
+	for i := range ed.RecipientInfos {
+		if ed.RecipientInfos[i].IssuerAndSerialNumber.identifies(cert) {
+			ri = &ed.RecipientInfos[i]
+			break
+		}
+	}
+	if ri == nil {
+		return nil, contentCipher{}, errors.New("The enveloped data is not encrypted for the certificate")
+	}
+	eci := ed.EncryptedContentInfo
+	cc, err := findContentCipher(eci.ContentEncryptionAlgorithm.Algorithm)
+	if err != nil {
+		return nil, cc, err
+	}
+	cek, err := rsa.DecryptPKCS1v15(rand.Reader, key, ri.EncryptedKey)
+	if err != nil {
+		return nil, cc, errors.Wrap(err, "Failed to decrypt the content encryption key")
+	}
+	if len(cek) != cc.keySize {
+		return nil, cc, errors.New("The content encryption key has the wrong size")
+	}
+	block, err := cc.block(cek)
+	if err != nil {
+		return nil, cc, err
+	}
+	var iv []byte
+	err = unmarshalDER(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv, "initialization vector")
+	if err != nil {
+		return nil, cc, err
+	}
+	encrypted := eci.EncryptedContent.Bytes
+	if eci.EncryptedContent.IsCompound {
+		// A constructed octet string, whose segments are concatenated
+		encrypted, err = concatOctetStrings(encrypted)
+		if err != nil {
+			return nil, cc, err
+		}
+	}
+	bs := block.BlockSize()
+	if len(iv) != bs || len(encrypted) == 0 || len(encrypted)%bs != 0 {
+		return nil, cc, errors.New("Invalid encrypted content")
+	}
+	content := make([]byte, len(encrypted))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(content, encrypted)
+	pad := int(content[len(content)-1])
+	if pad == 0 || pad > bs || !bytes.Equal(content[len(content)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, cc, errors.New("Invalid padding of the encrypted content")
+	}
+	return content[:len(content)-pad], cc, nil
+}
+
+func concatOctetStrings(der []byte) ([]byte, error) {
+	var buf []byte
+	for len(der) > 0 {
+		var segment []byte
+		var err error
+		der, err = asn1.Unmarshal(der, &segment)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to parse encrypted content")
+		}
+		buf = append(buf, segment...)
+	}
+	return buf, nil
+}
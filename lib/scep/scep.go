@@ -0,0 +1,398 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package scep implements the messages of the Simple Certificate Enrollment
+// Protocol (RFC 8894) with RSA keys, and the subset of PKCS #7 which they use
+package scep
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+
+	"github.com/pkg/errors"
+)
+
+// The object identifiers of the SCEP attributes
+var (
+	oidAttributeMessageType    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 2}
+	oidAttributePKIStatus      = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 3}
+	oidAttributeFailInfo       = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 4}
+	oidAttributeSenderNonce    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 5}
+	oidAttributeRecipientNonce = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 6}
+	oidAttributeTransactionID  = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 7}
+)
+
+// MessageType is the type of a PKI message
+type MessageType string
+
+// The types of PKI messages
+const (
+	// CertRep is the response to a request
+	CertRep MessageType = "3"
+	// RenewalReq requests a certificate to replace the certificate of the signer
+	RenewalReq MessageType = "17"
+	// PKCSReq requests a certificate
+	PKCSReq MessageType = "19"
+	// CertPoll polls for the certificate of a pending request
+	CertPoll MessageType = "20"
+	// GetCert requests a certificate by its issuer and serial number
+	GetCert MessageType = "21"
+	// GetCRL requests the CRL of the issuer of a certificate
+	GetCRL MessageType = "22"
+)
+
+// PKIStatus is the status of a CertRep
+type PKIStatus string
+
+// The statuses of a CertRep
+const (
+	Success PKIStatus = "0"
+	Failure PKIStatus = "2"
+	Pending PKIStatus = "3"
+)
+
+// FailInfo is the reason for the failure of a request
+type FailInfo string
+
+// The reasons for the failure of a request
+const (
+	// BadAlg is an unrecognized or unsupported algorithm
+	BadAlg FailInfo = "0"
+	// BadMessageCheck is a failed integrity check, such as an invalid signature
+	BadMessageCheck FailInfo = "1"
+	// BadRequest is a transaction which is not permitted or supported
+	BadRequest FailInfo = "2"
+	// BadTime is a signing time which is not close enough to the system time
+	BadTime FailInfo = "3"
+	// BadCertID is a certificate which could not be identified
+	BadCertID FailInfo = "4"
+)
+
+// PKIMessage is a SCEP request or response: a signed data whose content, if
+// any, is an enveloped data
+type PKIMessage struct {
+	// The DER encoding of the message
+	Raw            []byte
+	MessageType    MessageType
+	TransactionID  string
+	SenderNonce    []byte
+	RecipientNonce []byte
+	// The status and failure reason of a CertRep
+	PKIStatus PKIStatus
+	FailInfo  FailInfo
+	// The certificate of the signer of the message
+	SignerCert *x509.Certificate
+	// The certificates of the signed data
+	Certificates []*x509.Certificate
+	// The DER encoding of the enveloped data of the message
+	envelope []byte
+	// The algorithms of the message, which a response also uses
+	hash   crypto.Hash
+	cipher contentCipher
+}
+
+// ParsePKIMessage parses the PKI message 'der' and verifies its signature
+// with the certificate of its signer, which is in the message. The caller
+// decides whether the signer is trusted.
+func ParsePKIMessage(der []byte) (*PKIMessage, error) {
+	sc, err := verifySignedData(der)
+	if err != nil {
+		return nil, err
+	}
+	m := &PKIMessage{
+		Raw:          der,
+		SignerCert:   sc.signer,
+		Certificates: sc.certificates,
+		envelope:     sc.content,
+		hash:         sc.hash,
+		cipher:       contentCiphers["AES"],
+	}
+	var mt string
+	found, err := findAttribute(sc.attributes, oidAttributeMessageType, &mt)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("The message has no message type")
+	}
+	m.MessageType = MessageType(mt)
+	found, err = findAttribute(sc.attributes, oidAttributeTransactionID, &m.TransactionID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("The message has no transaction ID")
+	}
+	_, err = findAttribute(sc.attributes, oidAttributeSenderNonce, &m.SenderNonce)
+	if err != nil {
+		return nil, err
+	}
+	_, err = findAttribute(sc.attributes, oidAttributeRecipientNonce, &m.RecipientNonce)
+	if err != nil {
+		return nil, err
+	}
+	if m.MessageType == CertRep {
+		var status, info string
+		_, err = findAttribute(sc.attributes, oidAttributePKIStatus, &status)
+		if err != nil {
+			return nil, err
+		}
+		_, err = findAttribute(sc.attributes, oidAttributeFailInfo, &info)
+		if err != nil {
+			return nil, err
+		}
+		m.PKIStatus, m.FailInfo = PKIStatus(status), FailInfo(info)
+	}
+	return m, nil
+}
+
+// DecryptEnvelope returns the content of the enveloped data of the message,
+// decrypted with the key of its recipient 'cert': the DER encoding of the
+// CSR of a PKCSReq or RenewalReq, or of the degenerate signed data of the
+// certificates of a successful CertRep
+func (m *PKIMessage) DecryptEnvelope(cert *x509.Certificate, key *rsa.PrivateKey) ([]byte, error) {
+	if len(m.envelope) == 0 {
+		return nil, errors.New("The message has no content")
+	}
+	content, cc, err := openEnvelopedData(m.envelope, cert, key)
+	if err != nil {
+		return nil, err
+	}
+	m.cipher = cc
+	return content, nil
+}
+
+// NewPKIRequest returns a PKCSReq or RenewalReq of the CSR 'csr', encrypted
+// with the content encryption algorithm 'capability' ("AES", "AES256" or
+// "DES3") for the certificate 'recipient' of the CA or RA, and signed by
+// 'signerCert' and 'signerKey': a self-signed certificate of the key of the
+// CSR for a PKCSReq, or the certificate to be renewed for a RenewalReq
+func NewPKIRequest(typ MessageType, csr *x509.CertificateRequest, recipient, signerCert *x509.Certificate,
+	signerKey *rsa.PrivateKey, capability string) (*PKIMessage, error) {
+	cc, ok := contentCiphers[capability]
+	if !ok {
+		return nil, errors.Errorf("Unsupported content encryption algorithm '%s'", capability)
+	}
+	envelope, err := envelopeData(csr.Raw, recipient, cc)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	// The transaction ID is derived from the key which is certified
+	sum := sha256.Sum256(csr.RawSubjectPublicKeyInfo)
+	m := &PKIMessage{
+		MessageType:   typ,
+		TransactionID: hex.EncodeToString(sum[:]),
+		SenderNonce:   nonce,
+		SignerCert:    signerCert,
+		Certificates:  []*x509.Certificate{signerCert},
+		envelope:      envelope,
+		hash:          crypto.SHA256,
+		cipher:        cc,
+	}
+	attrs, err := m.attributes()
+	if err != nil {
+		return nil, err
+	}
+	m.Raw, err = signData(envelope, signerCert, signerKey, m.hash, attrs)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// NewCertRep returns the successful response to the request 'req', which
+// issues the certificates 'certs', signed by 'cert' and 'key' of the CA or
+// RA. The certificates are encrypted for the signer of the request with the
+// content encryption algorithm of the request.
+func NewCertRep(req *PKIMessage, certs []*x509.Certificate, cert *x509.Certificate, key *rsa.PrivateKey) (*PKIMessage, error) {
+	degenerate, err := DegenerateCertificates(certs)
+	if err != nil {
+		return nil, err
+	}
+	envelope, err := envelopeData(degenerate, req.SignerCert, req.cipher)
+	if err != nil {
+		return nil, err
+	}
+	return newResponse(req, Success, "", envelope, cert, key)
+}
+
+// NewFailureRep returns the response to the request 'req' which rejects it
+// for the reason 'info', signed by 'cert' and 'key' of the CA or RA
+func NewFailureRep(req *PKIMessage, info FailInfo, cert *x509.Certificate, key *rsa.PrivateKey) (*PKIMessage, error) {
+	return newResponse(req, Failure, info, nil, cert, key)
+}
+
+func newResponse(req *PKIMessage, status PKIStatus, info FailInfo, envelope []byte,
+	cert *x509.Certificate, key *rsa.PrivateKey) (*PKIMessage, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	m := &PKIMessage{
+		MessageType:    CertRep,
+		TransactionID:  req.TransactionID,
+		SenderNonce:    nonce,
+		RecipientNonce: req.SenderNonce,
+		PKIStatus:      status,
+		FailInfo:       info,
+		SignerCert:     cert,
+		Certificates:   []*x509.Certificate{cert},
+		envelope:       envelope,
+		hash:           req.hash,
+		cipher:         req.cipher,
+	}
+	if m.hash == 0 {
+		m.hash = crypto.SHA256
+	}
+	attrs, err := m.attributes()
+	if err != nil {
+		return nil, err
+	}
+	m.Raw, err = signData(envelope, cert, key, m.hash, attrs)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// attributes returns the SCEP authenticated attributes of the message
+func (m *PKIMessage) attributes() ([]attribute, error) {
+	type value struct {
+		oid    asn1.ObjectIdentifier
+		value  interface{}
+		params string
+	}
+	values := []value{
+		{oidAttributeMessageType, string(m.MessageType), "printable"},
+		{oidAttributeTransactionID, m.TransactionID, "printable"},
+		{oidAttributeSenderNonce, m.SenderNonce, ""},
+	}
+	if m.MessageType == CertRep {
+		values = append(values, value{oidAttributePKIStatus, string(m.PKIStatus), "printable"})
+		if m.PKIStatus == Failure {
+			values = append(values, value{oidAttributeFailInfo, string(m.FailInfo), "printable"})
+		}
+		if len(m.RecipientNonce) > 0 {
+			values = append(values, value{oidAttributeRecipientNonce, m.RecipientNonce, ""})
+		}
+	}
+	attrs := []attribute{}
+	for _, v := range values {
+		attr, err := newAttribute(v.oid, v.value, v.params)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs, nil
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to generate nonce")
+	}
+	return nonce, nil
+}
+
+// certificationRequest is a PKCS #10 certificate signing request
+type certificationRequest struct {
+	Info               certificationRequestInfo
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+}
+
+type certificationRequestInfo struct {
+	Version    int
+	Subject    asn1.RawValue
+	PublicKey  asn1.RawValue
+	Attributes []asn1.RawValue `asn1:"tag:0"`
+}
+
+// NewCSR returns a CSR of the template 'template', signed with SHA-256 by
+// the RSA key 'key', with the challenge password 'challenge' if it is not
+// empty, which x509.CreateCertificateRequest can't encode
+func NewCSR(template *x509.CertificateRequest, key *rsa.PrivateKey, challenge string) (*x509.CertificateRequest, error) {
+	tpl := *template
+	tpl.SignatureAlgorithm = x509.SHA256WithRSA
+	der, err := x509.CreateCertificateRequest(rand.Reader, &tpl, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create CSR")
+	}
+	if challenge != "" {
+		var cr certificationRequest
+		err = unmarshalDER(der, &cr, "CSR")
+		if err != nil {
+			return nil, err
+		}
+		attr, err := newAttribute(oidAttributeChallengePassword, challenge, "utf8")
+		if err != nil {
+			return nil, err
+		}
+		attrDER, err := asn1.Marshal(attr)
+		if err != nil {
+			return nil, err
+		}
+		cr.Info.Attributes = append(cr.Info.Attributes, asn1.RawValue{FullBytes: attrDER})
+		info, err := asn1.Marshal(cr.Info)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to encode CSR")
+		}
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest(crypto.SHA256, info))
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to sign CSR")
+		}
+		der, err = asn1.Marshal(struct {
+			Info               asn1.RawValue
+			SignatureAlgorithm pkix.AlgorithmIdentifier
+			Signature          asn1.BitString
+		}{
+			asn1.RawValue{FullBytes: info},
+			pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1.NullRawValue},
+			asn1.BitString{Bytes: sig, BitLength: len(sig) * 8},
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to encode CSR")
+		}
+	}
+	return x509.ParseCertificateRequest(der)
+}
+
+// ChallengePassword returns the challenge password of the CSR 'csr', or an
+// empty string if it has none
+func ChallengePassword(csr *x509.CertificateRequest) (string, error) {
+	var info certificationRequestInfo
+	err := unmarshalDER(csr.RawTBSCertificateRequest, &info, "CSR")
+	if err != nil {
+		return "", err
+	}
+	attrs := []attribute{}
+	for _, raw := range info.Attributes {
+		var attr attribute
+		err = unmarshalDER(raw.FullBytes, &attr, "CSR attribute")
+		if err != nil {
+			return "", err
+		}
+		attrs = append(attrs, attr)
+	}
+	var challenge string
+	_, err = findAttribute(attrs, oidAttributeChallengePassword, &challenge)
+	if err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
@@ -0,0 +1,135 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package scep
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// newCert returns a certificate of a new RSA key with the common name 'cn',
+// issued by 'issuer' and 'issuerKey' or self-signed if they are nil
+func newCert(t *testing.T, cn string, issuer *x509.Certificate, issuerKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	util.FatalError(t, err, "Unexpected error")
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if issuer == nil {
+		issuer, issuerKey = tpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, issuer, &key.PublicKey, issuerKey)
+	util.FatalError(t, err, "Unexpected error")
+	cert, err := x509.ParseCertificate(der)
+	util.FatalError(t, err, "Unexpected error")
+	return cert, key
+}
+
+func TestPKIOperation(t *testing.T) {
+	raCert, raKey := newCert(t, "ra", nil, nil)
+	deviceCert, deviceKey := newCert(t, "device", nil, nil)
+	for _, capability := range []string{"AES", "AES256", "DES3"} {
+		csr, err := NewCSR(&x509.CertificateRequest{Subject: pkix.Name{CommonName: "device"}}, deviceKey, "devicepw")
+		util.FatalError(t, err, "Unexpected error")
+		challenge, err := ChallengePassword(csr)
+		util.FatalError(t, err, "Unexpected error")
+		assert.Equal(t, "devicepw", challenge)
+		assert.NoError(t, csr.CheckSignature(), "The CSR with the challenge password should be signed")
+
+		req, err := NewPKIRequest(PKCSReq, csr, raCert, deviceCert, deviceKey, capability)
+		util.FatalError(t, err, "Unexpected error")
+
+		// The RA decrypts the CSR of the request
+		received, err := ParsePKIMessage(req.Raw)
+		util.FatalError(t, err, "Unexpected error")
+		assert.Equal(t, PKCSReq, received.MessageType)
+		assert.Equal(t, req.TransactionID, received.TransactionID)
+		assert.Equal(t, req.SenderNonce, received.SenderNonce)
+		assert.Equal(t, deviceCert.Raw, received.SignerCert.Raw)
+		content, err := received.DecryptEnvelope(raCert, raKey)
+		util.FatalError(t, err, "Unexpected error")
+		assert.Equal(t, csr.Raw, content)
+		_, err = received.DecryptEnvelope(deviceCert, deviceKey)
+		assert.Error(t, err, "The request should not be encrypted for the device")
+
+		// The device decrypts the certificate of the response
+		issued, _ := newCert(t, "device", raCert, raKey)
+		rep, err := NewCertRep(received, []*x509.Certificate{issued}, raCert, raKey)
+		util.FatalError(t, err, "Unexpected error")
+		resp, err := ParsePKIMessage(rep.Raw)
+		util.FatalError(t, err, "Unexpected error")
+		assert.Equal(t, CertRep, resp.MessageType)
+		assert.Equal(t, Success, resp.PKIStatus)
+		assert.Equal(t, req.TransactionID, resp.TransactionID)
+		assert.Equal(t, req.SenderNonce, resp.RecipientNonce)
+		assert.Equal(t, raCert.Raw, resp.SignerCert.Raw)
+		content, err = resp.DecryptEnvelope(deviceCert, deviceKey)
+		util.FatalError(t, err, "Unexpected error")
+		certs, err := ParseDegenerateCertificates(content)
+		util.FatalError(t, err, "Unexpected error")
+		if assert.Len(t, certs, 1) {
+			assert.Equal(t, issued.Raw, certs[0].Raw)
+		}
+		assert.Equal(t, contentCiphers[capability].oid, resp.cipher.oid, "The response should use the cipher of the request")
+	}
+
+	csr, err := NewCSR(&x509.CertificateRequest{Subject: pkix.Name{CommonName: "device"}}, deviceKey, "")
+	util.FatalError(t, err, "Unexpected error")
+	challenge, err := ChallengePassword(csr)
+	util.FatalError(t, err, "Unexpected error")
+	assert.Empty(t, challenge)
+	req, err := NewPKIRequest(RenewalReq, csr, raCert, deviceCert, deviceKey, "AES")
+	util.FatalError(t, err, "Unexpected error")
+	received, err := ParsePKIMessage(req.Raw)
+	util.FatalError(t, err, "Unexpected error")
+	rep, err := NewFailureRep(received, BadRequest, raCert, raKey)
+	util.FatalError(t, err, "Unexpected error")
+	resp, err := ParsePKIMessage(rep.Raw)
+	util.FatalError(t, err, "Unexpected error")
+	assert.Equal(t, Failure, resp.PKIStatus)
+	assert.Equal(t, BadRequest, resp.FailInfo)
+	_, err = resp.DecryptEnvelope(deviceCert, deviceKey)
+	assert.Error(t, err, "A failure has no content")
+
+	// A message whose signature or content is changed is rejected
+	for _, i := range []int{len(req.Raw) - 10, len(req.Raw) / 2} {
+		tampered := append([]byte{}, req.Raw...)
+		tampered[i] ^= 0xff
+		_, err = ParsePKIMessage(tampered)
+		assert.Error(t, err, "A message changed at byte %d should be rejected", i)
+	}
+	_, err = NewPKIRequest(PKCSReq, csr, raCert, deviceCert, deviceKey, "RC2")
+	assert.Error(t, err)
+}
+
+func TestDegenerateCertificates(t *testing.T) {
+	ca, caKey := newCert(t, "ca", nil, nil)
+	ra, _ := newCert(t, "ra", ca, caKey)
+	der, err := DegenerateCertificates([]*x509.Certificate{ra, ca})
+	util.FatalError(t, err, "Unexpected error")
+	certs, err := ParseDegenerateCertificates(der)
+	util.FatalError(t, err, "Unexpected error")
+	if assert.Len(t, certs, 2) {
+		assert.Equal(t, ra.Raw, certs[0].Raw)
+		assert.Equal(t, ca.Raw, certs[1].Raw)
+	}
+	_, err = ParsePKIMessage(der)
+	assert.Error(t, err, "A signed data without signers is not a PKI message")
+	_, err = ParseDegenerateCertificates(ca.Raw)
+	assert.Error(t, err)
+}
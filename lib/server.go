@@ -7,8 +7,11 @@ SPDX-License-Identifier: Apache-2.0
 package lib
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -17,10 +20,14 @@ import (
 	_ "net/http/pprof" // import to support profiling
 
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
@@ -32,10 +39,14 @@ import (
 	"github.com/hyperledger/fabric-ca/lib/attr"
 	"github.com/hyperledger/fabric-ca/lib/caerrors"
 	"github.com/hyperledger/fabric-ca/lib/dbutil"
+	"github.com/hyperledger/fabric-ca/lib/logging"
 	"github.com/hyperledger/fabric-ca/lib/metadata"
+	"github.com/hyperledger/fabric-ca/lib/metrics"
 	stls "github.com/hyperledger/fabric-ca/lib/tls"
+	"github.com/hyperledger/fabric-ca/lib/vault"
 	"github.com/hyperledger/fabric-ca/util"
 	"github.com/spf13/viper"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -43,6 +54,11 @@ const (
 	fabricCAServerProfilePort = "FABRIC_CA_SERVER_PROFILE_PORT"
 	allRoles                  = "peer,orderer,client,user"
 	apiPathPrefix             = "/api/v1/"
+	defaultShutdownTimeout    = 30 * time.Second
+	defaultReadHeaderTimeout  = 10 * time.Second
+	defaultReadTimeout        = 60 * time.Second
+	defaultWriteTimeout       = 5 * time.Minute
+	defaultIdleTimeout        = 120 * time.Second
 )
 
 // Server is the fabric-ca server
@@ -52,8 +68,27 @@ type Server struct {
 	// BlockingStart if true makes the Start function blocking;
 	// It is non-blocking by default.
 	BlockingStart bool
+	// OnListen, if set, is called with the addresses on which the server
+	// listens once its listeners are bound, before it serves requests
+	OnListen func(addrs *ListenAddresses)
+	// SkipSelfTest if true makes the Start function skip the self-test of
+	// the CAs, which should only be done in an emergency
+	SkipSelfTest bool
+	// HandleSignals if true makes the Start function install the handlers
+	// of the signals sent to the server process: SIGTERM and SIGINT shut
+	// the server down, SIGHUP reloads it, and SIGUSR1 and SIGUSR2 change
+	// the log level. It is set by fabric-ca-server; a server which is
+	// embedded in another process is shut down with Shutdown instead.
+	HandleSignals bool
 	// The server's configuration
 	Config *ServerConfig
+	// The source of each setting of the server's configuration, if it was
+	// loaded by fabric-ca-server; replaced by a reload of the configuration
+	ConfigProvenance ConfigProvenance
+	// The settings of the server's configuration which are set by command
+	// line flags, if it was loaded by fabric-ca-server; they are applied
+	// again when the configuration is reloaded
+	FlagOverrides FlagOverrides
 	// The server mux
 	mux *gmux.Router
 	// The current listener for this server
@@ -72,6 +107,68 @@ type Server struct {
 	mutex sync.Mutex
 	// The server's current levels
 	levels *dbutil.Levels
+	// Holds the certificate of the TLS listening endpoint
+	tlsCertReloader *stls.CertReloader
+	// Channel on which SIGHUP is received to reload the TLS certificate and configuration
+	sigHup chan os.Signal
+	// Held for writing while a configuration is put into service and, on a
+	// reload, copied into the configurations of the server and its CAs.
+	// Requests do not read the reloadable settings of these configurations,
+	// but the configuration snapshot which they were received with.
+	configMutex sync.RWMutex
+	// The configuration in service, a *configSnapshot
+	configSnap atomic.Value
+	// The HTTP server which serves requests received by the listener
+	httpServer *http.Server
+	// Closed when a graceful shutdown of the server has completed
+	drained chan struct{}
+	// Set to 1 when a graceful shutdown of the server has started
+	shuttingDown int32
+	// Channel on which SIGTERM and SIGINT are received to shut down the server
+	sigTerm chan os.Signal
+	// Channel on which SIGUSR1 and SIGUSR2 are received to change the log level
+	sigUsr chan os.Signal
+	// The mux of the operations endpoints when they have their own listener
+	opsMux *gmux.Router
+	// The listener of the operations endpoints
+	opsListener net.Listener
+	// The listeners of the additional listening addresses
+	extraListeners []net.Listener
+	// The mux of the administration endpoints when they have their own listener
+	adminMux *gmux.Router
+	// The listener of the administration endpoints
+	adminListener net.Listener
+	// The gRPC server of the gRPC service and its listener
+	grpcServer   *grpc.Server
+	grpcListener net.Listener
+	// Held while the TLS certificate and configuration are reloaded
+	reloadMutex sync.Mutex
+	// The metrics of the requests handled by the server
+	metrics *metrics.Registry
+	// The concurrency limiters of the endpoints, by endpoint
+	limiters map[string]*concurrencyLimiter
+	// The maximum body sizes of the endpoints which override that of the
+	// server, by endpoint
+	bodyLimits map[string]int64
+	// The latest API version of each endpoint which is superseded by an
+	// endpoint of a later API version, by path
+	successors map[string]string
+	// The endpoints of the server's API in the order they are registered,
+	// from which the API document is generated
+	registrations []endpointRegistration
+	// Checks the components reported by the readiness endpoint
+	healthChecker *healthChecker
+	// Sends the events of the server to its event subscriptions
+	events *eventDispatcher
+	// The addresses on which the server listens while it is started
+	listenAddrs *ListenAddresses
+	// The CORS policy of the endpoints, or nil if CORS is not enabled
+	cors *corsPolicy
+	// The client of the Vault server from which the secrets referenced in
+	// the configuration are read, or nil if none is configured
+	vault *vault.Client
+	// The key which authenticates the next tokens of the list endpoints
+	listTokenKey []byte
 }
 
 // Init initializes a fabric-ca server
@@ -87,13 +184,20 @@ func (s *Server) Init(renew bool) (err error) {
 // init initializses the server leaving the DB open
 func (s *Server) init(renew bool) (err error) {
 	serverVersion := metadata.GetVersion()
-	log.Infof("Server Version: %s", serverVersion)
+	log.Infof("Server Version: %s", metadata.GetBuildInfo())
 	s.levels, err = metadata.GetLevels(serverVersion)
 	if err != nil {
 		return err
 	}
 	log.Infof("Server Levels: %+v", s.levels)
 
+	// The list tokens remain valid when the server is restarted
+	if s.listTokenKey == nil {
+		s.listTokenKey, err = newListTokenKey()
+		if err != nil {
+			return err
+		}
+	}
 	// Initialize the config
 	err = s.initConfig()
 	if err != nil {
@@ -104,6 +208,7 @@ func (s *Server) init(renew bool) (err error) {
 	if err != nil {
 		return err
 	}
+	s.publishConfig(newConfigSnapshot(s))
 	// Successful initialization
 	return nil
 }
@@ -133,6 +238,16 @@ func (s *Server) Start() (err error) {
 
 	log.Debugf("%d CA instance(s) running on server", len(s.caMap))
 
+	// Test that each CA can sign and verify before accepting requests
+	err = s.runSelfTest()
+	if err != nil {
+		err2 := s.closeDB()
+		if err2 != nil {
+			log.Errorf("Close DB failed: %s", err2)
+		}
+		return err
+	}
+
 	// Start listening and serving
 	err = s.listenAndServe()
 	if err != nil {
@@ -148,12 +263,17 @@ func (s *Server) Start() (err error) {
 // Stop the server
 // WARNING: This forcefully closes the listening socket and may cause
 // requests in transit to fail, and so is only used for testing.
-// A graceful shutdown will be supported with golang 1.8.
+// Use Shutdown to wait for requests in transit to complete.
 func (s *Server) Stop() error {
 	err := s.closeListener()
 	if err != nil {
 		return err
 	}
+	if s.httpServer != nil {
+		// Also close the connections which are kept alive, so that they are
+		// not served by the stopped server
+		s.httpServer.Close()
+	}
 	if s.wait == nil {
 		return nil
 	}
@@ -181,6 +301,47 @@ func (s *Server) Stop() error {
 	return nil
 }
 
+// Shutdown gracefully shuts down the server. It stops accepting new
+// connections, waits up to the configured shutdown timeout for requests
+// in progress to complete, and then closes the server's databases.
+func (s *Server) Shutdown() error {
+	httpServer := s.httpServer
+	if httpServer == nil {
+		return errors.New("server is not started")
+	}
+	if !atomic.CompareAndSwapInt32(&s.shuttingDown, 0, 1) {
+		return errors.New("server is already shutting down")
+	}
+	timeout := s.configSnapshot().shutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	log.Infof("Shutting down server; waiting up to %s for requests in progress to complete", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if gs := s.grpcServer; gs != nil {
+		// The gRPC calls in progress may complete meanwhile; those which do
+		// not are ended when the listeners are closed
+		go gs.GracefulStop()
+	}
+	err := httpServer.Shutdown(ctx)
+	if err != nil {
+		log.Warningf("Requests in progress did not complete within %s, closing their connections: %s", timeout, err)
+		httpServer.Close()
+	}
+	// The listener was closed by the HTTP server, so just release it
+	s.closeListener()
+	err2 := s.closeDB()
+	if err2 != nil {
+		log.Errorf("Close DB failed: %s", err2)
+	}
+	close(s.drained)
+	if err != nil {
+		return errors.Wrap(err, "Failed to gracefully shut down server")
+	}
+	return err2
+}
+
 // RegisterBootstrapUser registers the bootstrap user with appropriate privileges
 func (s *Server) RegisterBootstrapUser(user, pass, affiliation string) error {
 	// Initialize the config, setting defaults, etc
@@ -204,6 +365,7 @@ func (s *Server) RegisterBootstrapUser(user, pass, affiliation string) error {
 			attr.GenCRL:         "true",
 			attr.RegistrarAttr:  "*",
 			attr.AffiliationMgr: "true",
+			attr.Admin:          "true",
 		},
 	}
 
@@ -231,13 +393,45 @@ func (s *Server) initConfig() (err error) {
 	s.HomeDir = absoluteHomeDir
 	// Create config if not set
 	if s.Config == nil {
-		s.Config = new(ServerConfig)
+		s.Config = &ServerConfig{Port: DefaultServerPort}
 	}
 	cfg := s.Config
+	err = logging.Configure(&cfg.Log, s.HomeDir)
+	if err != nil {
+		return err
+	}
 	// Set log level if debug is true
 	if cfg.Debug {
 		log.Level = log.LevelDebug
 	}
+	err = s.initConcurrencyLimits()
+	if err != nil {
+		return err
+	}
+	err = s.initBodyLimits()
+	if err != nil {
+		return err
+	}
+	err = checkProfilingConfig(cfg)
+	if err != nil {
+		return err
+	}
+	err = checkAdminConfig(cfg)
+	if err != nil {
+		return err
+	}
+	err = checkEventsConfig(&cfg.Events)
+	if err != nil {
+		return err
+	}
+	s.cors, err = newCORSPolicy(&cfg.CORS)
+	if err != nil {
+		return err
+	}
+	err = s.initVault()
+	if err != nil {
+		return err
+	}
 	s.CA.server = s
 	s.CA.HomeDir = s.HomeDir
 	err = s.initMultiCAConfig()
@@ -308,53 +502,64 @@ func (s *Server) loadCA(caFile string, renew bool) error {
 		return errors.Errorf("%s file does not exist", caFile)
 	}
 
+	cfg, err := readCAConfig(caFile, s.CA.Config)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("CA configuration after checking for missing values: %+v", cfg)
+
+	ca, err := newCA(caFile, cfg, s, renew)
+	if err != nil {
+		return err
+	}
+	err = s.addCA(ca)
+	if err != nil {
+		err2 := ca.closeDB()
+		if err2 != nil {
+			log.Errorf("Close DB failed: %s", err2)
+		}
+	}
+	return err
+}
+
+// readCAConfig reads the configuration of a non-default CA from 'caFile',
+// replacing values which are missing in the file with those of 'defaultCfg'
+func readCAConfig(caFile string, defaultCfg *CAConfig) (*CAConfig, error) {
 	// Creating new Viper instance, to prevent any server level environment variables or
 	// flags from overridding the configuration options specified in the
 	// CA config file
 	cfg := &CAConfig{}
 	caViper := viper.New()
-	err = UnmarshalConfig(cfg, caViper, caFile, false)
+	err := UnmarshalConfig(cfg, caViper, caFile, false)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Need to error if no CA name provided in config file, we cannot revert to using
 	// the name of default CA cause CA names must be unique
 	caName := cfg.CA.Name
 	if caName == "" {
-		return errors.Errorf("No CA name provided in CA configuration file. CA name is required in %s", caFile)
+		return nil, errors.Errorf("No CA name provided in CA configuration file. CA name is required in %s", caFile)
 	}
 
 	// Replace missing values in CA configuration values with values from the
 	// defaut CA configuration
-	util.CopyMissingValues(s.CA.Config, cfg)
+	util.CopyMissingValues(defaultCfg, cfg)
 
 	// Integers and boolean values are handled outside the util.CopyMissingValues
 	// because there is no way through reflect to detect if a value was explicitly
 	// set to 0 or false, or it is using the default value for its type. Viper is
 	// employed here to help detect.
 	if !caViper.IsSet("registry.maxenrollments") {
-		cfg.Registry.MaxEnrollments = s.CA.Config.Registry.MaxEnrollments
+		cfg.Registry.MaxEnrollments = defaultCfg.Registry.MaxEnrollments
 	}
 
 	if !caViper.IsSet("db.tls.enabled") {
-		cfg.DB.TLS.Enabled = s.CA.Config.DB.TLS.Enabled
+		cfg.DB.TLS.Enabled = defaultCfg.DB.TLS.Enabled
 	}
 
-	log.Debugf("CA configuration after checking for missing values: %+v", cfg)
-
-	ca, err := newCA(caFile, cfg, s, renew)
-	if err != nil {
-		return err
-	}
-	err = s.addCA(ca)
-	if err != nil {
-		err2 := ca.closeDB()
-		if err2 != nil {
-			log.Errorf("Close DB failed: %s", err2)
-		}
-	}
-	return err
+	return cfg, nil
 }
 
 // DN is the distinguished name inside a certificate
@@ -376,6 +581,10 @@ func (s *Server) addCA(ca *CA) error {
 		if err != nil {
 			return err
 		}
+		err = s.compareSKI(c.Config.CA.Certfile, ca.Config.CA.Certfile)
+		if err != nil {
+			return err
+		}
 	}
 	// no conflicts, so add it
 	s.caMap[caName] = ca
@@ -455,6 +664,20 @@ func (s *Server) GetCA(name string) (*CA, error) {
 // Register all endpoint handlers
 func (s *Server) registerHandlers() {
 	s.mux = gmux.NewRouter()
+	s.successors = nil
+	s.registrations = nil
+	s.metrics = metrics.NewRegistry()
+	newRequestMetrics(s.metrics)
+	newKMSMetrics(s.metrics)
+	newCertDBMetrics(s.metrics)
+	newEventMetrics(s.metrics)
+	newCAChainMetrics(s.metrics)
+	s.newLogMetrics(s.metrics)
+	for _, ca := range s.caMap {
+		if certs, ok := ca.certs.Load().(*caCerts); ok {
+			ca.observeCAChain(certs)
+		}
+	}
 	s.registerHandler("cainfo", newCAInfoEndpoint(s))
 	s.registerHandler("register", newRegisterEndpoint(s))
 	s.registerHandler("enroll", newEnrollEndpoint(s))
@@ -464,23 +687,74 @@ func (s *Server) registerHandlers() {
 	s.registerHandler("revoke", newRevokeEndpoint(s))
 	s.registerHandler("tcert", newTCertEndpoint(s))
 	s.registerHandler("gencrl", newGenCRLEndpoint(s))
+	s.registerHandler("crl", newPublishedCRLEndpoint(s))
 	s.registerHandler("identities", newIdentitiesStreamingEndpoint(s))
 	s.registerHandler("identities/{id}", newIdentitiesEndpoint(s))
 	s.registerHandler("affiliations", newAffiliationsStreamingEndpoint(s))
 	s.registerHandler("affiliations/{affiliation}", newAffiliationsEndpoint(s))
 	s.registerHandler("certificates", newCertificateEndpoint(s))
+	s.registerHandler("cfssl/version", newVersionEndpoint(s))
+	s.registerAPIHandler("v2", "enroll", newEnrollV2Endpoint(s))
+	s.registerSCEPHandlers()
+	s.registerESTHandlers()
+	s.registerAdminHandlers()
+	s.registerOperationsHandlers()
+	s.registerDebugHandlers()
+	s.registerOpenAPIHandlers()
 }
 
-// Register a handler
-func (s *Server) registerHandler(path string, se *serverEndpoint) {
-	s.mux.Handle("/"+path, se)
-	s.mux.Handle(apiPathPrefix+path, se)
+// registerOperationsHandlers registers the handlers of the operations endpoints,
+// which do not require authentication, on the server's mux or, if a separate
+// operations listening address is configured, on the operations mux
+func (s *Server) registerOperationsHandlers() {
+	mux := s.mux
+	if s.Config.Operations.ListenAddress != "" {
+		s.opsMux = gmux.NewRouter()
+		mux = s.opsMux
+	}
+	prefix := ""
+	if mux == s.mux {
+		prefix = s.basePath()
+	}
+	mux.HandleFunc(prefix+"/healthz", s.healthzHandler).Methods("GET")
+	mux.HandleFunc(prefix+"/readyz", s.readyzHandler).Methods("GET")
+	mux.Handle(prefix+"/metrics", s.metrics).Methods("GET")
+}
+
+// Register a handler of an endpoint of metadata.APIVersion
+func (s *Server) registerHandler(path string, se http.Handler) {
+	s.registrations = append(s.registrations, endpointRegistration{version: metadata.APIVersion, path: path, handler: se})
+	h := s.wrapEndpoint(path, s.deprecateSuperseded(path, se))
+	s.mux.Handle(s.basePath()+"/"+path, h)
+	s.mux.Handle(s.basePath()+apiPathPrefix+path, h)
+}
+
+// basePath returns the path prefix under which the endpoints are served on
+// the server's port, which is empty unless the server is behind a reverse
+// proxy which forwards a path prefix to it
+func (s *Server) basePath() string {
+	if s == nil || s.Config == nil {
+		return ""
+	}
+	return normalizeBasePath(s.Config.BasePath)
+}
+
+// normalizeBasePath returns the base path 'p' with a leading slash, without
+// a trailing slash and with repeated slashes removed; the base path of the
+// root, such as "" or "/", is returned as ""
+func normalizeBasePath(p string) string {
+	p = path.Clean("/" + strings.TrimSpace(p))
+	if p == "/" {
+		return ""
+	}
+	return p
 }
 
 // Starting listening and serving
 func (s *Server) listenAndServe() (err error) {
 
 	var listener net.Listener
+	var tlsConfig *tls.Config
 	var clientAuth tls.ClientAuthType
 	var ok bool
 
@@ -490,8 +764,8 @@ func (s *Server) listenAndServe() (err error) {
 	if c.Address == "" {
 		c.Address = DefaultServerAddr
 	}
-	if c.Port == 0 {
-		c.Port = DefaultServerPort
+	if c.Listeners.SocketMode == "" {
+		c.Listeners.SocketMode = defaultSocketMode
 	}
 	addr := net.JoinHostPort(c.Address, strconv.Itoa(c.Port))
 	var addrStr string
@@ -504,7 +778,13 @@ func (s *Server) listenAndServe() (err error) {
 		// then need to return error and not start the server. The TLS key file is specified when the user
 		// wants the server to use custom tls key and cert and don't want server to auto generate its own. So,
 		// when the key file is specified, it must exist on the file system
-		if c.TLS.KeyFile != "" {
+		err = checkTLSVaultRef(&c.TLS)
+		if err != nil {
+			return err
+		}
+		if isTLSVaultRef(&c.TLS) {
+			log.Debug("The TLS certificate and key are read from Vault")
+		} else if c.TLS.KeyFile != "" {
 			if !util.FileExists(c.TLS.KeyFile) {
 				return fmt.Errorf("File specified by 'tls.keyfile' does not exist: %s", c.TLS.KeyFile)
 			}
@@ -520,7 +800,10 @@ func (s *Server) listenAndServe() (err error) {
 		}
 		log.Debugf("TLS Certificate: %s, TLS Key: %s", c.TLS.CertFile, c.TLS.KeyFile)
 
-		cer, err := util.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile, s.csp)
+		// Loading the key pair also verifies that the key matches the certificate
+		certReloader, err := stls.NewCertReloader(func() (*tls.Certificate, error) {
+			return s.loadTLSKeyPair(&c.TLS)
+		})
 		if err != nil {
 			return err
 		}
@@ -536,36 +819,80 @@ func (s *Server) listenAndServe() (err error) {
 			return errors.New("Invalid client auth type provided")
 		}
 
+		// Client certificates can't be verified without trusted certificates
+		verifyClientCert := clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert
+		if verifyClientCert && len(c.TLS.ClientAuth.CertFiles) == 0 {
+			return errors.Errorf("Client authentication type '%s' requires trusted certificate files to be specified by 'tls.clientauth.certfiles'",
+				c.TLS.ClientAuth.Type)
+		}
+
 		var certPool *x509.CertPool
-		if authType != defaultClientAuth {
+		if clientAuth != tls.NoClientCert {
 			certPool, err = LoadPEMCertPool(c.TLS.ClientAuth.CertFiles)
 			if err != nil {
 				return err
 			}
 		}
 
-		config := &tls.Config{
-			Certificates: []tls.Certificate{*cer},
-			ClientAuth:   clientAuth,
-			ClientCAs:    certPool,
-			MinVersion:   tls.VersionTLS12,
-			MaxVersion:   tls.VersionTLS12,
-			CipherSuites: stls.DefaultCipherSuites,
+		minVersion, err := stls.GetVersion(c.TLS.MinVersion, tls.VersionTLS12)
+		if err != nil {
+			return errors.WithMessage(err, "Invalid 'tls.minversion'")
+		}
+		maxVersion, err := stls.GetVersion(c.TLS.MaxVersion, tls.VersionTLS12)
+		if err != nil {
+			return errors.WithMessage(err, "Invalid 'tls.maxversion'")
+		}
+		if minVersion > maxVersion {
+			return errors.Errorf("The value of 'tls.minversion' (%s) is greater than 'tls.maxversion' (%s)",
+				c.TLS.MinVersion, c.TLS.MaxVersion)
+		}
+		cipherSuites, err := stls.GetCipherSuites(c.TLS.CipherSuites)
+		if err != nil {
+			return errors.WithMessage(err, "Invalid 'tls.ciphersuites'")
+		}
+		curvePreferences, err := stls.GetCurvePreferences(c.TLS.CurvePreferences)
+		if err != nil {
+			return errors.WithMessage(err, "Invalid 'tls.curvepreferences'")
+		}
+
+		tlsConfig = &tls.Config{
+			GetCertificate:   certReloader.GetCertificate,
+			ClientAuth:       clientAuth,
+			ClientCAs:        certPool,
+			MinVersion:       minVersion,
+			MaxVersion:       maxVersion,
+			CipherSuites:     cipherSuites,
+			CurvePreferences: curvePreferences,
 		}
 
-		listener, err = tls.Listen("tcp", addr, config)
+		listener, err = tls.Listen("tcp", addr, tlsConfig)
 		if err != nil {
 			return errors.Wrapf(err, "TLS listen failed for %s", addrStr)
 		}
+		s.tlsCertReloader = certReloader
 	} else {
+		log.Warning("TLS is disabled; enrollment secrets and authorization tokens sent to this server are not encrypted")
 		addrStr = fmt.Sprintf("http://%s", addr)
+		s.tlsCertReloader = nil
 		listener, err = net.Listen("tcp", addr)
 		if err != nil {
 			return errors.Wrapf(err, "TCP listen failed for %s", addrStr)
 		}
 	}
 	s.listener = listener
-	log.Infof("Listening on %s", addrStr)
+	err = s.listenOnAddresses(tlsConfig)
+	if err != nil {
+		s.closeListener()
+		return err
+	}
+	s.httpServer = s.newHTTPServer(s.mux)
+	s.drained = make(chan struct{})
+	atomic.StoreInt32(&s.shuttingDown, 0)
+	if s.HandleSignals {
+		s.shutdownOnSignal()
+		s.adjustLogLevelOnSignal()
+		s.reloadOnSignal()
+	}
 
 	err = s.checkAndEnableProfiling()
 	if err != nil {
@@ -573,7 +900,40 @@ func (s *Server) listenAndServe() (err error) {
 		return errors.WithMessage(err, "TCP listen for profiling failed")
 	}
 
+	s.healthChecker = newHealthChecker(s.healthChecks(), c.Operations.HealthCheckInterval)
+	s.healthChecker.start()
+	if s.vault != nil {
+		s.vault.Start()
+	}
+	err = s.startEvents()
+	if err != nil {
+		s.closeListener()
+		return err
+	}
+	err = s.listenAndServeOperations()
+	if err != nil {
+		s.closeListener()
+		return err
+	}
+	err = s.listenAndServeAdmin()
+	if err != nil {
+		s.closeListener()
+		return err
+	}
+	err = s.listenAndServeGRPC(tlsConfig)
+	if err != nil {
+		s.closeListener()
+		return err
+	}
+	err = s.reportListenAddresses()
+	if err != nil {
+		s.closeListener()
+		return err
+	}
+	log.Infof("Listening on %s", s.listenAddrs.URL)
+
 	// Start serving requests, either blocking or non-blocking
+	s.serveAdditional()
 	if s.BlockingStart {
 		return s.serve()
 	}
@@ -593,9 +953,25 @@ func (s *Server) serve() error {
 		// 3) the go routine runs and calls this function
 		// So this prevents the panic which was reported in
 		// in https://jira.hyperledger.org/browse/FAB-3100.
+		// Close the DBs, as s.Stop does not once it is told that this go
+		// routine is done, so that it does not wait for it to time out.
+		err := s.closeDB()
+		if err != nil {
+			log.Errorf("Close DB failed: %s", err)
+		}
+		if s.wait != nil {
+			s.wait <- true
+		}
+		return nil
+	}
+	s.serveError = s.httpServer.Serve(listener)
+	if s.serveError == http.ErrServerClosed {
+		// Shutdown was called; wait for it to finish draining requests
+		// and closing the DBs so that a blocking Start does not return early
+		<-s.drained
+		log.Info("Server has shut down")
 		return nil
 	}
-	s.serveError = http.Serve(listener, s.mux)
 	log.Errorf("Server has stopped serving: %s", s.serveError)
 	s.closeListener()
 	err := s.closeDB()
@@ -636,21 +1012,188 @@ func (s *Server) checkAndEnableProfiling() error {
 	return nil
 }
 
+// listenAndServeOperations starts serving the operations endpoints if a
+// separate operations listening address is configured
+func (s *Server) listenAndServeOperations() error {
+	addr := s.Config.Operations.ListenAddress
+	if addr == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "TCP listen failed for operations address %s", addr)
+	}
+	s.opsListener = listener
+	log.Infof("Listening for operations requests on http://%s", listener.Addr())
+	go func(httpServer *http.Server) {
+		err := httpServer.Serve(listener)
+		log.Debugf("Stopped serving operations requests on %s: %s", addr, err)
+	}(s.newHTTPServer(s.opsMux))
+	return nil
+}
+
+// newHTTPServer returns an HTTP server for 'handler' with the timeouts and
+// header size limit of the server's configuration. A setting which is not
+// set gets its default value, so that a connection which never completes a
+// request can't be held open forever.
+func (s *Server) newHTTPServer(handler http.Handler) *http.Server {
+	c := &s.Config.HTTP
+	if c.ReadHeaderTimeout == 0 {
+		c.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = defaultReadTimeout
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = defaultWriteTimeout
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = defaultIdleTimeout
+	}
+	if c.MaxHeaderBytes == 0 {
+		c.MaxHeaderBytes = http.DefaultMaxHeaderBytes
+	}
+	return &http.Server{
+		Handler:           addVersionHeaders(handler),
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		ReadTimeout:       c.ReadTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		MaxHeaderBytes:    c.MaxHeaderBytes,
+	}
+}
+
 // Make all file names in the config absolute
 func (s *Server) makeFileNamesAbsolute() error {
 	log.Debug("Making server filenames absolute")
-	err := stls.AbsTLSServer(&s.Config.TLS, s.HomeDir)
+	err := absTLSServer(&s.Config.TLS, s.HomeDir)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// reloadOnSignal reloads the certificate of the TLS listening endpoint, the
+// certificate chains of the CAs and the configuration file each time the
+// server process receives a SIGHUP, so that a renewed certificate or changed
+// settings can be put into service without restarting the server
+func (s *Server) reloadOnSignal() {
+	s.sigHup = make(chan os.Signal, 1)
+	signal.Notify(s.sigHup, syscall.SIGHUP)
+	go func(sigHup chan os.Signal) {
+		for range sigHup {
+			log.Info("Received SIGHUP")
+			s.reload()
+		}
+	}(s.sigHup)
+}
+
+// reload reloads the certificate of the TLS listening endpoint, the
+// certificate chains of the CAs and the configuration file. A failure to
+// reload any of them is logged and the current one is kept; the error of
+// reloading the configuration is returned.
+func (s *Server) reload() error {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+	if s.vault != nil {
+		// The secrets are read from Vault again as they are resolved
+		s.vault.Refresh()
+	}
+	if s.tlsCertReloader != nil {
+		log.Infof("Reloading TLS certificate %s", s.Config.TLS.CertFile)
+		err := s.tlsCertReloader.Reload()
+		if err != nil {
+			log.Errorf("Failed to reload TLS certificate; continuing to use the current certificate: %s", err)
+		} else {
+			log.Info("Successfully reloaded TLS certificate")
+		}
+	}
+	s.refreshCAChains()
+	err := s.reloadConfig()
+	if err != nil {
+		log.Errorf("Failed to reload configuration; continuing to use the current configuration: %s", err)
+	}
+	return err
+}
+
+// shutdownOnSignal gracefully shuts down the server when the server process
+// receives a SIGTERM or SIGINT
+func (s *Server) shutdownOnSignal() {
+	s.sigTerm = make(chan os.Signal, 1)
+	signal.Notify(s.sigTerm, syscall.SIGTERM, syscall.SIGINT)
+	go func(sigTerm chan os.Signal) {
+		sig, ok := <-sigTerm
+		if !ok {
+			return
+		}
+		log.Infof("Received %s; shutting down server", sig)
+		err := s.Shutdown()
+		if err != nil {
+			log.Errorf("%s", err)
+		}
+	}(s.sigTerm)
+}
+
+// adjustLogLevelOnSignal makes logging more verbose each time the server
+// process receives a SIGUSR1 and less verbose each time it receives a SIGUSR2
+func (s *Server) adjustLogLevelOnSignal() {
+	s.sigUsr = make(chan os.Signal, 1)
+	signal.Notify(s.sigUsr, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func(sigUsr chan os.Signal) {
+		for sig := range sigUsr {
+			if sig == syscall.SIGUSR1 {
+				adjustLogLevel(1)
+			} else {
+				adjustLogLevel(-1)
+			}
+		}
+	}(s.sigUsr)
+}
+
 // closeListener closes the listening endpoint
 func (s *Server) closeListener() error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	port := s.Config.Port
+	if s.sigHup != nil {
+		signal.Stop(s.sigHup)
+		close(s.sigHup)
+		s.sigHup = nil
+	}
+	if s.sigTerm != nil {
+		signal.Stop(s.sigTerm)
+		close(s.sigTerm)
+		s.sigTerm = nil
+	}
+	if s.sigUsr != nil {
+		signal.Stop(s.sigUsr)
+		close(s.sigUsr)
+		s.sigUsr = nil
+	}
+	if s.healthChecker != nil {
+		s.healthChecker.stop()
+	}
+	if s.vault != nil {
+		s.vault.Stop()
+	}
+	s.stopEvents()
+	if s.opsListener != nil {
+		err := s.opsListener.Close()
+		if err != nil {
+			log.Debugf("Stop: failed to close operations listener: %s", err)
+		}
+		s.opsListener = nil
+	}
+	if s.adminListener != nil {
+		err := s.adminListener.Close()
+		if err != nil {
+			log.Debugf("Stop: failed to close admin listener: %s", err)
+		}
+		s.adminListener = nil
+	}
+	s.stopGRPC()
+	s.closeAdditionalListeners()
+	s.removeAddressFile()
 	if s.listener == nil {
 		msg := fmt.Sprintf("Stop: listener was already closed on port %d", port)
 		log.Debugf(msg)
@@ -685,9 +1228,29 @@ func (s *Server) compareDN(existingCACertFile, newCACertFile string) error {
 	return nil
 }
 
+// compareSKI returns an error if the certificates of two CAs have the same
+// subject key identifier, in which case the certificates issued by the CAs
+// could not be told apart by their authority key identifier
+func (s *Server) compareSKI(existingCACertFile, newCACertFile string) error {
+	log.Debugf("Comparing subject key identifiers of certificates: %s and %s", existingCACertFile, newCACertFile)
+	existingCert, err := util.GetX509CertificateFromPEMFile(existingCACertFile)
+	if err != nil {
+		return err
+	}
+	newCert, err := util.GetX509CertificateFromPEMFile(newCACertFile)
+	if err != nil {
+		return err
+	}
+	if len(newCert.SubjectKeyId) > 0 && bytes.Equal(existingCert.SubjectKeyId, newCert.SubjectKeyId) {
+		return errors.Errorf("The certificates '%s' and '%s' have the same subject key identifier '%s'; each CA must have its own key",
+			existingCACertFile, newCACertFile, hex.EncodeToString(newCert.SubjectKeyId))
+	}
+	return nil
+}
+
 // Read the CRL from body of http response
 func (s *Server) fetchCRL(r io.Reader) ([]byte, error) {
-	crlSizeLimit := s.Config.CRLSizeLimit
+	crlSizeLimit := s.configSnapshot().crlSizeLimit
 	log.Debugf("CRL size limit is %d bytes", crlSizeLimit)
 
 	crl := make([]byte, crlSizeLimit)
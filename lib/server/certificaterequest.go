@@ -154,7 +154,7 @@ func getTimes(ctx RequestContext) (*TimeFilters, error) {
 
 	times.revokedStart, err = getTime(ctx.GetQueryParm("revoked_start"))
 	if err != nil {
-		return nil, errors.WithMessage(err, "Invalid 'revoked_begin' value")
+		return nil, errors.WithMessage(err, "Invalid 'revoked_start' value")
 	}
 
 	times.revokedEnd, err = getTime(ctx.GetQueryParm("revoked_end"))
@@ -164,7 +164,7 @@ func getTimes(ctx RequestContext) (*TimeFilters, error) {
 
 	times.expiredStart, err = getTime(ctx.GetQueryParm("expired_start"))
 	if err != nil {
-		return nil, errors.WithMessage(err, "Invalid 'expired_begin' value")
+		return nil, errors.WithMessage(err, "Invalid 'expired_start' value")
 	}
 
 	times.expiredEnd, err = getTime(ctx.GetQueryParm("expired_end"))
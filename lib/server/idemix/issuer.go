@@ -235,6 +235,10 @@ func (i *issuer) VerifyToken(authHdr string, body []byte) (string, error) {
 	if err != nil {
 		return "", errors.WithMessage(err, "Failed to unmarshal signature bytes specified in the token")
 	}
+	err = checkSignature(sig)
+	if err != nil {
+		return "", err
+	}
 	err = sig.Ver(disclosure, issuerKey.Ipk, digest, attrs, 3, ra.PublicKey(), epoch)
 	if err != nil {
 		return "", errors.WithMessage(err, "Failed to verify the token")
@@ -345,6 +349,30 @@ func getTokenParts(token string) []string {
 	return nil
 }
 
+// checkSignature checks that the Idemix signature 'sig' of a token has every
+// element which its verification decodes, each of the size of its encoding,
+// as a signature whose elements are missing or truncated can't be verified
+func checkSignature(sig *idemix.Signature) error {
+	isBig := func(b []byte) bool {
+		return len(b) == idemix.FieldBytes
+	}
+	isECP := func(p *idemix.ECP) bool {
+		return p != nil && isBig(p.X) && isBig(p.Y)
+	}
+	valid := isECP(sig.APrime) && isECP(sig.ABar) && isECP(sig.BPrime) && isECP(sig.Nym) &&
+		isBig(sig.ProofC) && isBig(sig.ProofSSk) && isBig(sig.ProofSE) && isBig(sig.ProofSR2) &&
+		isBig(sig.ProofSR3) && isBig(sig.ProofSSPrime) && isBig(sig.ProofSRNym) && isBig(sig.Nonce) &&
+		sig.RevocationEpochPk != nil && isBig(sig.RevocationEpochPk.Xa) && isBig(sig.RevocationEpochPk.Xb) &&
+		isBig(sig.RevocationEpochPk.Ya) && isBig(sig.RevocationEpochPk.Yb) && sig.NonRevocationProof != nil
+	for _, attr := range sig.ProofSAttrs {
+		valid = valid && isBig(attr)
+	}
+	if !valid {
+		return errors.New("Invalid Idemix signature specified in the token; it is missing or has truncated elements")
+	}
+	return nil
+}
+
 // IsToken returns true if the specified token has the format expected of an authorization token
 // that is created using an Idemix credential
 func IsToken(token string) bool {
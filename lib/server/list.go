@@ -0,0 +1,374 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package server
+
+import (
+	"container/heap"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultListLimit is the number of items of a page when the request
+	// does not specify a limit
+	DefaultListLimit = 100
+	// MaxListLimit is the largest number of items of a page
+	MaxListLimit = 1000
+)
+
+// The query parameters of a request to a list endpoint which select a page
+const (
+	limitParm     = "limit"
+	nextTokenParm = "next_token"
+	sortParm      = "sort"
+	orderParm     = "order"
+	totalParm     = "total"
+)
+
+// ListQueryDocs are the descriptions of the pagination and sorting query
+// parameters of a list endpoint
+var ListQueryDocs = map[string]string{
+	limitParm:     "Return a page of at most this many items, 100 by default and 1000 at most",
+	nextTokenParm: "Return the page which follows the page whose next_token this is",
+	sortParm:      "Sort the items by this field",
+	orderParm:     "Sort the items in 'asc' (the default) or 'desc' order",
+	totalParm:     "Also return the total number of items",
+}
+
+// FilterKind is the kind of value of a filter query parameter
+type FilterKind int
+
+const (
+	// FilterString is a filter whose value is any string
+	FilterString FilterKind = iota
+	// FilterBool is a filter whose value is a boolean
+	FilterBool
+)
+
+// ListSpec describes the sorting and filtering of a list endpoint
+type ListSpec struct {
+	// SortFields are the fields by which the items may be sorted, the
+	// first of which is the default
+	SortFields []string
+	// Filters are the kinds of the filter query parameters by name
+	Filters map[string]FilterKind
+}
+
+// ListContext is the request context of a list request
+type ListContext interface {
+	GetQueryParm(string) string
+}
+
+// ListParams are the pagination, sorting and filtering parameters of a
+// request to a list endpoint
+type ListParams struct {
+	// Paged is true if the request asks for a page of items in a list
+	// envelope rather than for the whole list
+	Paged bool
+	// Limit is the largest number of items of the page
+	Limit int
+	// Sort is the field by which the items are sorted
+	Sort string
+	// Descending is true if the items are sorted in descending order
+	Descending bool
+	// Total is true if the total number of items is returned
+	Total bool
+	// The values of the filters by name
+	filters map[string]string
+	// The position in the list after which the page starts, or nil for the
+	// first page
+	after *listCursor
+	// The key which authenticates the next tokens
+	key []byte
+}
+
+// listCursor is the content of a next token
+type listCursor struct {
+	// The sort field and order of the list
+	Sort       string `json:"s"`
+	Descending bool   `json:"d,omitempty"`
+	// The digest of the filters of the list
+	Filters string `json:"f"`
+	// The sort key and the ID of the last item of the previous page
+	Key string `json:"k"`
+	ID  string `json:"i"`
+}
+
+// ParseListParams parses and validates the list query parameters of the
+// request 'ctx' to an endpoint described by 'spec'. The next tokens are
+// authenticated with 'key', so that a client cannot forge a position in a
+// list, and an error is returned if 'key' is empty. Otherwise the error
+// names the invalid parameter.
+func ParseListParams(ctx ListContext, spec *ListSpec, key []byte) (*ListParams, error) {
+	if len(key) == 0 {
+		return nil, errors.New("No key to authenticate the next tokens")
+	}
+	p := &ListParams{Limit: DefaultListLimit, filters: map[string]string{}, key: key}
+	if len(spec.SortFields) > 0 {
+		p.Sort = spec.SortFields[0]
+	}
+	for name, kind := range spec.Filters {
+		value := ctx.GetQueryParm(name)
+		if value != "" && kind == FilterBool {
+			b, err := strconv.ParseBool(strings.ToLower(value))
+			if err != nil {
+				return nil, errors.Errorf("Invalid '%s' query parameter '%s': it must be true or false", name, value)
+			}
+			value = strconv.FormatBool(b)
+		}
+		p.filters[name] = value
+	}
+	if v := ctx.GetQueryParm(limitParm); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > MaxListLimit {
+			return nil, errors.Errorf("Invalid '%s' query parameter '%s': it must be an integer from 1 to %d", limitParm, v, MaxListLimit)
+		}
+		p.Limit = limit
+		p.Paged = true
+	}
+	if v := ctx.GetQueryParm(sortParm); v != "" {
+		if !containsString(spec.SortFields, v) {
+			return nil, errors.Errorf("Invalid '%s' query parameter '%s': it must be one of %s", sortParm, v, strings.Join(spec.SortFields, ", "))
+		}
+		p.Sort = v
+		p.Paged = true
+	}
+	if v := ctx.GetQueryParm(orderParm); v != "" {
+		switch strings.ToLower(v) {
+		case "asc":
+		case "desc":
+			p.Descending = true
+		default:
+			return nil, errors.Errorf("Invalid '%s' query parameter '%s': it must be asc or desc", orderParm, v)
+		}
+		p.Paged = true
+	}
+	if v := ctx.GetQueryParm(totalParm); v != "" {
+		total, err := strconv.ParseBool(strings.ToLower(v))
+		if err != nil {
+			return nil, errors.Errorf("Invalid '%s' query parameter '%s': it must be true or false", totalParm, v)
+		}
+		p.Total = total
+		p.Paged = true
+	}
+	if v := ctx.GetQueryParm(nextTokenParm); v != "" {
+		cursor, err := p.parseToken(v)
+		if err != nil {
+			return nil, errors.WithMessage(err, "Invalid 'next_token' query parameter")
+		}
+		p.after = cursor
+		p.Paged = true
+	}
+	return p, nil
+}
+
+// Filter returns the value of the filter 'name', or "" if the request does
+// not set it
+func (p *ListParams) Filter(name string) string {
+	return p.filters[name]
+}
+
+// BoolFilter returns the value of the boolean filter 'name', which is false
+// if the request does not set it
+func (p *ListParams) BoolFilter(name string) bool {
+	return p.filters[name] == "true"
+}
+
+// filtersDigest returns the digest of the filters, which binds a next token
+// to the list of the request which returned it
+func (p *ListParams) filtersDigest() string {
+	names := make([]string, 0, len(p.filters))
+	for name := range p.filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		h.Write([]byte(name + "=" + p.filters[name] + "\n"))
+	}
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:12])
+}
+
+// newToken returns the next token of the page which ends with 'item'
+func (p *ListParams) newToken(item *ListItem) (string, error) {
+	payload, err := json.Marshal(&listCursor{
+		Sort:       p.Sort,
+		Descending: p.Descending,
+		Filters:    p.filtersDigest(),
+		Key:        item.Keys[p.Sort],
+		ID:         item.ID,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to marshal next token")
+	}
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// parseToken returns the cursor of the next token 'token', which must have
+// been returned for the same list
+func (p *ListParams) parseToken(token string) (*listCursor, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("it is malformed")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("it is malformed")
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("it is malformed")
+	}
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write(payload)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return nil, errors.New("it was not issued by this server or has been modified")
+	}
+	cursor := new(listCursor)
+	err = json.Unmarshal(payload, cursor)
+	if err != nil {
+		return nil, errors.New("it is malformed")
+	}
+	if cursor.Filters != p.filtersDigest() {
+		return nil, errors.New("it was returned for different filters")
+	}
+	if cursor.Sort != p.Sort || cursor.Descending != p.Descending {
+		return nil, errors.New("it was returned for a different sort order")
+	}
+	return cursor, nil
+}
+
+// ListItem is an item of a list endpoint
+type ListItem struct {
+	// Keys are the values of the sort fields of the item by field name,
+	// which are compared as strings
+	Keys map[string]string
+	// ID identifies the item among the items of the list, and orders the
+	// items with the same sort key
+	ID string
+	// Value is the item as returned to the client
+	Value interface{}
+}
+
+// ListPage is the envelope in which a list endpoint returns a page of items
+type ListPage struct {
+	// Items are the items of the page
+	Items []interface{} `json:"items"`
+	// NextToken is set if there are more items, which the request for the
+	// next page passes in the 'next_token' query parameter
+	NextToken string `json:"next_token,omitempty"`
+	// Total is the number of items of the list, if the request asked for it
+	Total *int `json:"total,omitempty"`
+}
+
+// Pager collects the items of a page of a list, keeping only as many items
+// as the page holds
+type Pager struct {
+	params *ListParams
+	// The items of the page, the last of which in the sort order is on top
+	items pageHeap
+	// The number of items of the list
+	total int
+}
+
+// NewPager returns a pager of the page of the list which 'p' selects
+func (p *ListParams) NewPager() *Pager {
+	return &Pager{params: p, items: pageHeap{params: p}}
+}
+
+// Add adds an item of the list, in any order
+func (pg *Pager) Add(item *ListItem) {
+	pg.total++
+	p := pg.params
+	if p.after != nil && p.compare(item, p.after.Key, p.after.ID) <= 0 {
+		return
+	}
+	heap.Push(&pg.items, item)
+	// One more item than the page holds tells whether there is a next page
+	if pg.items.Len() > p.Limit+1 {
+		heap.Pop(&pg.items)
+	}
+}
+
+// Page returns the page of the items which were added
+func (pg *Pager) Page() (*ListPage, error) {
+	p := pg.params
+	items := pg.items.items
+	sort.Slice(items, func(i, j int) bool {
+		return p.compare(items[i], items[j].Keys[p.Sort], items[j].ID) < 0
+	})
+	page := &ListPage{Items: []interface{}{}}
+	if len(items) > p.Limit {
+		items = items[:p.Limit]
+		token, err := p.newToken(items[len(items)-1])
+		if err != nil {
+			return nil, err
+		}
+		page.NextToken = token
+	}
+	for _, item := range items {
+		page.Items = append(page.Items, item.Value)
+	}
+	if p.Total {
+		total := pg.total
+		page.Total = &total
+	}
+	return page, nil
+}
+
+// compare returns a negative number if 'item' comes before the position
+// 'key' and 'id' in the list, 0 if it is at it, or a positive number
+func (p *ListParams) compare(item *ListItem, key, id string) int {
+	c := strings.Compare(item.Keys[p.Sort], key)
+	if c == 0 {
+		c = strings.Compare(item.ID, id)
+	}
+	if p.Descending {
+		return -c
+	}
+	return c
+}
+
+// pageHeap is a heap of the items of a page whose top is the last item
+type pageHeap struct {
+	params *ListParams
+	items  []*ListItem
+}
+
+func (h *pageHeap) Len() int { return len(h.items) }
+
+func (h *pageHeap) Less(i, j int) bool {
+	return h.params.compare(h.items[i], h.items[j].Keys[h.params.Sort], h.items[j].ID) > 0
+}
+
+func (h *pageHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *pageHeap) Push(x interface{}) { h.items = append(h.items, x.(*ListItem)) }
+
+func (h *pageHeap) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
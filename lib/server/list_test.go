@@ -0,0 +1,150 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// queryContext is a list request whose query parameters are in the map
+type queryContext map[string]string
+
+func (q queryContext) GetQueryParm(name string) string {
+	return q[name]
+}
+
+var testListSpec = &ListSpec{
+	SortFields: []string{"name", "size"},
+	Filters: map[string]FilterKind{
+		"color": FilterString,
+		"big":   FilterBool,
+	},
+}
+
+var testListKey = []byte("test list key")
+
+// testListPage returns the page of the items 'items' for the query 'q'
+func testListPage(t *testing.T, items []*ListItem, q queryContext) *ListPage {
+	p, err := ParseListParams(q, testListSpec, testListKey)
+	util.FatalError(t, err, "Failed to parse list parameters")
+	pager := p.NewPager()
+	for _, item := range items {
+		pager.Add(item)
+	}
+	page, err := pager.Page()
+	util.FatalError(t, err, "Failed to get page")
+	return page
+}
+
+func TestParseListParams(t *testing.T) {
+	p, err := ParseListParams(queryContext{}, testListSpec, testListKey)
+	util.FatalError(t, err, "Failed to parse empty query")
+	assert.False(t, p.Paged, "A query without list parameters should not be paged")
+	assert.Equal(t, DefaultListLimit, p.Limit)
+	assert.Equal(t, "name", p.Sort)
+
+	p, err = ParseListParams(queryContext{"limit": "5", "sort": "size", "order": "DESC", "total": "true", "color": "red", "big": "True"}, testListSpec, testListKey)
+	util.FatalError(t, err, "Failed to parse query")
+	assert.True(t, p.Paged)
+	assert.Equal(t, 5, p.Limit)
+	assert.Equal(t, "size", p.Sort)
+	assert.True(t, p.Descending)
+	assert.True(t, p.Total)
+	assert.Equal(t, "red", p.Filter("color"))
+	assert.True(t, p.BoolFilter("big"))
+
+	badQueries := []struct {
+		query queryContext
+		parm  string
+	}{
+		{queryContext{"limit": "0"}, "limit"},
+		{queryContext{"limit": "1001"}, "limit"},
+		{queryContext{"limit": "ten"}, "limit"},
+		{queryContext{"sort": "weight"}, "sort"},
+		{queryContext{"order": "up"}, "order"},
+		{queryContext{"total": "maybe"}, "total"},
+		{queryContext{"big": "maybe"}, "big"},
+		{queryContext{"next_token": "garbage"}, "next_token"},
+	}
+	for _, bad := range badQueries {
+		_, err = ParseListParams(bad.query, testListSpec, testListKey)
+		util.ErrorContains(t, err, fmt.Sprintf("'%s' query parameter", bad.parm), "The error should name the invalid parameter of %v", bad.query)
+	}
+}
+
+func TestListPages(t *testing.T) {
+	var items []*ListItem
+	for i := 0; i < 7; i++ {
+		name := fmt.Sprintf("item%d", i)
+		items = append(items, &ListItem{
+			Keys:  map[string]string{"name": name, "size": fmt.Sprintf("%d", i%3)},
+			ID:    name,
+			Value: name,
+		})
+	}
+
+	// The pages of 3 items cover every item once, in order
+	var got []interface{}
+	q := queryContext{"limit": "3", "sort": "size", "order": "desc", "total": "true"}
+	for pages := 0; ; pages++ {
+		page := testListPage(t, items, q)
+		assert.Equal(t, 7, *page.Total)
+		got = append(got, page.Items...)
+		if page.NextToken == "" {
+			assert.Equal(t, 2, pages, "There should be 3 pages")
+			break
+		}
+		assert.Len(t, page.Items, 3)
+		q["next_token"] = page.NextToken
+	}
+	assert.Equal(t, []interface{}{"item5", "item2", "item4", "item1", "item6", "item3", "item0"}, got)
+
+	// Without the total, it is not returned
+	page := testListPage(t, items, queryContext{"limit": "10"})
+	assert.Nil(t, page.Total)
+	assert.Empty(t, page.NextToken)
+	assert.Len(t, page.Items, 7)
+
+	// An empty list has an empty page
+	page = testListPage(t, nil, queryContext{"limit": "10"})
+	assert.NotNil(t, page.Items)
+	assert.Empty(t, page.Items)
+}
+
+func TestListTokens(t *testing.T) {
+	items := []*ListItem{
+		{Keys: map[string]string{"name": "a"}, ID: "a", Value: "a"},
+		{Keys: map[string]string{"name": "b"}, ID: "b", Value: "b"},
+	}
+	page := testListPage(t, items, queryContext{"limit": "1", "color": "red"})
+	token := page.NextToken
+	assert.NotEmpty(t, token)
+
+	// A token is only valid for the list for which it was returned
+	_, err := ParseListParams(queryContext{"next_token": token, "color": "blue"}, testListSpec, testListKey)
+	util.ErrorContains(t, err, "different filters", "A token of different filters should be rejected")
+	_, err = ParseListParams(queryContext{"next_token": token, "color": "red", "order": "desc"}, testListSpec, testListKey)
+	util.ErrorContains(t, err, "different sort order", "A token of a different sort order should be rejected")
+	_, err = ParseListParams(queryContext{"next_token": token, "color": "red"}, testListSpec, []byte("other key"))
+	util.ErrorContains(t, err, "not issued by this server", "A token of another key should be rejected")
+	_, err = ParseListParams(queryContext{"next_token": token, "color": "red"}, testListSpec, nil)
+	util.ErrorContains(t, err, "No key", "A token should be rejected without a key")
+
+	// A token which is modified is rejected
+	tampered := []byte(token)
+	tampered[len(tampered)/4] ^= 1
+	_, err = ParseListParams(queryContext{"next_token": string(tampered), "color": "red"}, testListSpec, testListKey)
+	util.ErrorContains(t, err, "'next_token' query parameter", "A modified token should be rejected")
+
+	p, err := ParseListParams(queryContext{"next_token": token, "color": "red"}, testListSpec, testListKey)
+	util.FatalError(t, err, "Failed to parse valid token")
+	assert.True(t, p.Paged, "A query with a token should be paged")
+}
@@ -16,6 +16,7 @@ limitations under the License.
 package lib
 
 import (
+	"bytes"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -23,6 +24,7 @@ import (
 	"strconv"
 	"testing"
 
+	"github.com/cloudflare/cfssl/log"
 	"github.com/hyperledger/fabric-ca/api"
 	"github.com/hyperledger/fabric-ca/util"
 )
@@ -254,6 +256,56 @@ func BenchmarkReenroll(b *testing.B) {
 	}
 }
 
+// BenchmarkTokenAuthentication authenticates the token of an enrolled
+// identity, as the server does for each request of an endpoint which
+// requires a token
+func BenchmarkTokenAuthentication(b *testing.B) {
+	b.StopTimer()
+	srv := getServerForBenchmark(serverbPort, rootDir, "", -1, b)
+	err := srv.Start()
+	if err != nil {
+		b.Fatalf("Server failed to start: %v", err)
+	}
+	defer cleanup(srv)
+
+	client := getTestClient(serverbPort)
+	eresp, err := client.Enroll(&api.EnrollmentRequest{
+		Name:   "admin",
+		Secret: "adminpw",
+	})
+	if err != nil {
+		b.Fatalf("Failed to enroll admin/adminpw: %s", err)
+	}
+	req, err := createReenrollRequest(eresp.Identity)
+	if err != nil {
+		b.Fatalf("Failed to create reenroll request: %s", err)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		b.Fatalf("Failed to read the request body: %s", err)
+	}
+	se := &serverEndpoint{Server: srv}
+	// The server logs at debug level, which would measure the writes of the
+	// log rather than the authentication
+	log.Level = log.LevelInfo
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r := httptest.NewRequest("POST", req.URL.String(), bytes.NewReader(body))
+		r.Header = req.Header
+		ctx := newServerRequestContext(r, nil, se)
+		b.StartTimer()
+		id, err := ctx.TokenAuthentication()
+		b.StopTimer()
+		if err != nil {
+			b.Fatalf("Failed to authenticate the token: %s", err)
+		}
+		if id != "admin" {
+			b.Fatalf("Authenticated '%s' rather than 'admin'", id)
+		}
+		ctx.releaseBody()
+	}
+}
+
 func BenchmarkRevokeUserCert(b *testing.B) {
 	b.StopTimer()
 	revokeUserCertOrig := os.Getenv(revokeUserCertEnv)
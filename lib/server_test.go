@@ -8,10 +8,16 @@ package lib_test
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"math/rand"
 	"net/http"
 	"os"
@@ -19,6 +25,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -710,6 +717,236 @@ func TestSRVRunningTLSServer(t *testing.T) {
 	}
 }
 
+func TestSRVTLSVersionAndCipherPolicy(t *testing.T) {
+	testDir := "tlsPolicyTestDir"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	srv := TestGetServer(rootPort, testDir, "", -1, t)
+	srv.Config.TLS.Enabled = true
+	srv.Config.TLS.CertFile = "../../testdata/tls_server-cert.pem"
+	srv.Config.TLS.KeyFile = "../../testdata/tls_server-key.pem"
+	srv.Config.TLS.MinVersion = "1.3"
+	srv.Config.TLS.MaxVersion = "1.2"
+	err := srv.Start()
+	if assert.Error(t, err, "Server should not start with a minimum TLS version greater than the maximum") {
+		assert.Contains(t, err.Error(), "greater than 'tls.maxversion'")
+	}
+
+	srv.Config.TLS.MinVersion = "1.2"
+	srv.Config.TLS.MaxVersion = "1.2"
+	srv.Config.TLS.CipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"}
+	err = srv.Start()
+	assert.Error(t, err, "Server should not start with an insecure cipher suite")
+
+	srv.Config.TLS.MaxVersion = "1.3"
+	srv.Config.TLS.CipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}
+	srv.Config.TLS.CurvePreferences = []string{"P384"}
+	err = srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	defer func() {
+		err = srv.Stop()
+		if err != nil {
+			t.Errorf("Failed to stop server: %s", err)
+		}
+	}()
+
+	addr := fmt.Sprintf("localhost:%d", rootPort)
+
+	// A TLS 1.2 client negotiates the only configured cipher suite
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+	})
+	if assert.NoError(t, err, "Should have connected using TLS 1.2") {
+		state := conn.ConnectionState()
+		assert.Equal(t, uint16(tls.VersionTLS12), state.Version)
+		assert.Equal(t, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, state.CipherSuite)
+		conn.Close()
+	}
+	// A TLS 1.2 client which does not offer the configured cipher suite is refused
+	_, err = tls.Dial("tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites:       []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	assert.Error(t, err, "Should not have connected without a common cipher suite")
+	// A client which does not offer the configured curve is refused
+	_, err = tls.Dial("tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CurvePreferences:   []tls.CurveID{tls.CurveP256},
+	})
+	assert.Error(t, err, "Should not have connected without a common curve")
+	// TLS 1.3 is negotiated when both sides support it
+	conn, err = tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if assert.NoError(t, err, "Should have connected using TLS 1.3") {
+		assert.Equal(t, uint16(tls.VersionTLS13), conn.ConnectionState().Version)
+		conn.Close()
+	}
+}
+
+func TestSRVTLSCertReloadOnSIGHUP(t *testing.T) {
+	testDir := "tlsReloadTestDir"
+	defer os.RemoveAll(testDir)
+
+	srv := TestGetServer(rootPort, testDir, "", -1, t)
+	err := os.MkdirAll(testDir, 0755)
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	certFile := filepath.Join(testDir, "tls-cert.pem")
+	keyFile := filepath.Join(testDir, "tls-key.pem")
+	assert.NoError(t, CopyFile("../testdata/tls_server-cert.pem", certFile))
+	assert.NoError(t, CopyFile("../testdata/tls_server-key.pem", keyFile))
+	srv.Config.TLS.Enabled = true
+	srv.Config.TLS.CertFile = "tls-cert.pem"
+	srv.Config.TLS.KeyFile = "tls-key.pem"
+	srv.HandleSignals = true
+	err = srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	defer func() {
+		err = srv.Stop()
+		if err != nil {
+			t.Errorf("Failed to stop server: %s", err)
+		}
+	}()
+
+	getServerCert := func() []byte {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("localhost:%d", rootPort), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("Failed to connect: %s", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Raw
+	}
+	before := getServerCert()
+
+	// Renew the certificate on disk and signal the server to pick it up
+	assert.NoError(t, CopyFile("../testdata/ec256-1-cert.pem", certFile))
+	assert.NoError(t, CopyFile("../testdata/ec256-1-key.pem", keyFile))
+	proc, err := os.FindProcess(os.Getpid())
+	assert.NoError(t, err)
+	assert.NoError(t, proc.Signal(syscall.SIGHUP))
+
+	var after []byte
+	for i := 0; i < 50; i++ {
+		after = getServerCert()
+		if !bytes.Equal(before, after) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.NotEqual(t, before, after, "Server should serve the renewed certificate after SIGHUP")
+}
+
+func TestSRVTLSClientAuth(t *testing.T) {
+	testDir := "tlsClientAuthTestDir"
+	defer os.RemoveAll(testDir)
+
+	srv := TestGetServer(rootPort, testDir, "", -1, t)
+	err := os.MkdirAll(testDir, 0755)
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	trustedCA, trustedCAKey := genTLSTestCert(t, "trusted-ca", nil, nil)
+	untrustedCA, untrustedCAKey := genTLSTestCert(t, "untrusted-ca", nil, nil)
+	trustedCAFile := filepath.Join(testDir, "trusted-ca.pem")
+	err = ioutil.WriteFile(trustedCAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: trustedCA.Raw}), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write trusted CA certificate: %s", err)
+	}
+	trustedClient, trustedClientKey := genTLSTestCert(t, "trusted-client", trustedCA, trustedCAKey)
+	untrustedClient, untrustedClientKey := genTLSTestCert(t, "untrusted-client", untrustedCA, untrustedCAKey)
+
+	srv.Config.TLS.Enabled = true
+	srv.Config.TLS.CertFile = "../../testdata/tls_server-cert.pem"
+	srv.Config.TLS.KeyFile = "../../testdata/tls_server-key.pem"
+	srv.Config.TLS.ClientAuth.Type = "require-and-verify"
+
+	// A mode which verifies client certificates requires trusted certificates
+	err = srv.Start()
+	if assert.Error(t, err, "Server should not start without trusted client CA certificates") {
+		assert.Contains(t, err.Error(), "tls.clientauth.certfiles")
+	}
+
+	srv.Config.TLS.ClientAuth.CertFiles = []string{"trusted-ca.pem"}
+	err = srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	defer func() {
+		err = srv.Stop()
+		if err != nil {
+			t.Errorf("Failed to stop server: %s", err)
+		}
+	}()
+
+	getCAInfo := func(certs []tls.Certificate) error {
+		httpClient := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+					Certificates:       certs,
+				},
+			},
+		}
+		resp, err := httpClient.Get(fmt.Sprintf("https://localhost:%d/api/v1/cainfo", rootPort))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("Unexpected status code %d", resp.StatusCode)
+		}
+		return nil
+	}
+
+	err = getCAInfo([]tls.Certificate{{Certificate: [][]byte{trustedClient.Raw}, PrivateKey: trustedClientKey}})
+	assert.NoError(t, err, "Client with a certificate from a trusted CA should have been accepted")
+	err = getCAInfo([]tls.Certificate{{Certificate: [][]byte{untrustedClient.Raw}, PrivateKey: untrustedClientKey}})
+	assert.Error(t, err, "Client with a certificate from an untrusted CA should have been rejected")
+	err = getCAInfo(nil)
+	assert.Error(t, err, "Client without a certificate should have been rejected")
+}
+
+// genTLSTestCert generates a certificate and key; the certificate is a
+// self-signed CA certificate if 'parent' is nil
+func genTLSTestCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent = template
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %s", err)
+	}
+	return cert, key
+}
+
 func TestSRVDefaultDatabase(t *testing.T) {
 	cleanTestSlateSRV(t)
 	defer func() {
@@ -762,6 +999,7 @@ func TestSRVDefaultAddrPort(t *testing.T) {
 		}
 	}()
 
+	// Port 0 is a free port on the default address
 	srv1 := getServer(rootPort, testdataDir, "", -1, t)
 	srv1.Config.Address = ""
 	srv1.Config.Port = 0
@@ -776,39 +1014,25 @@ func TestSRVDefaultAddrPort(t *testing.T) {
 			t.Errorf("Failed to stop server: %s", err)
 		}
 	}()
+	addrs := srv1.ListenAddresses()
+	if addrs == nil || addrs.Port == 0 {
+		t.Fatalf("Server should report the free port it listens on: %+v", addrs)
+	}
+	assert.Equal(t, DefaultServerAddr, srv1.Config.Address, "Server should listen on the default address")
 
-	// Start server with default port (already in use)
+	// Another server with port 0 gets another free port
 	srv := getServer(rootPort, testdataDir, "", -1, t)
 	srv.Config.Address = ""
 	srv.Config.Port = 0
 	err = srv.Start()
 	t.Logf("srv.Start err: %v", err)
-	if err == nil {
-		t.Errorf("Root server start should have failed (port unavailable)")
-		err = srv.Stop()
-		if err != nil {
-			t.Errorf("Failed to stop server: %s", err)
-		}
+	if err != nil {
+		t.Fatalf("Second server with port 0 should have started: %s", err)
 	}
-
-	// Again with TLS
-	srv = getServer(rootPort, testdataDir, "", -1, t)
-	srv.Config.TLS.Enabled = true
-	srv.Config.TLS.CertFile = "../testdata/tls_server-cert.pem"
-	srv.Config.TLS.KeyFile = "../testdata/tls_server-key.pem"
-	srv.Config.TLS.ClientAuth.Type = "RequireAndVerifyClientCert"
-	srv.Config.TLS.ClientAuth.CertFiles = []string{"../testdata/root.pem"}
-	srv.Config.Address = ""
-	srv.Config.Port = 0
-
-	err = srv.Start()
-	t.Logf("srv.Start err: %v", err)
-	if err == nil {
-		t.Errorf("Root server start should have failed (port unavailable)")
-		err = srv.Stop()
-		if err != nil {
-			t.Errorf("Failed to stop server: %s", err)
-		}
+	assert.NotEqual(t, addrs.Port, srv.ListenAddresses().Port, "Servers with port 0 should listen on different ports")
+	err = srv.Stop()
+	if err != nil {
+		t.Errorf("Failed to stop server: %s", err)
 	}
 }
 
@@ -1181,6 +1405,101 @@ func TestSRVMultiCAConfigs(t *testing.T) {
 
 }
 
+func TestSRVMultiCAIssueAndRevoke(t *testing.T) {
+	defer func() {
+		cleanMultiCADir(t)
+		cleanTestSlateSRV(t)
+	}()
+	srv := TestGetServer(rootPort, testdataDir, "", -1, t)
+	srv.Config.CAfiles = []string{"ca/rootca/ca1/fabric-ca-server-config.yaml", "ca/rootca/ca2/fabric-ca-server-config.yaml"}
+	err := srv.Start()
+	if err != nil {
+		t.Fatal("Failed to start server:", err)
+	}
+	defer func() {
+		err = srv.Stop()
+		if err != nil {
+			t.Errorf("Failed to stop server: %s", err)
+		}
+	}()
+
+	// Register and enroll the same user name with each of the CAs
+	enroll := func(caName, registrar, secret string) (*Identity, *Identity) {
+		resp, err := getRootClient().Enroll(&api.EnrollmentRequest{Name: registrar, Secret: secret, CAName: caName})
+		util.FatalError(t, err, fmt.Sprintf("Failed to enroll '%s' with CA '%s'", registrar, caName))
+		admin := resp.Identity
+		_, err = admin.Register(&api.RegistrationRequest{Name: "multicauser", Secret: "multicauserpw", CAName: caName})
+		util.FatalError(t, err, fmt.Sprintf("Failed to register 'multicauser' with CA '%s'", caName))
+		resp, err = getRootClient().Enroll(&api.EnrollmentRequest{Name: "multicauser", Secret: "multicauserpw", CAName: caName})
+		util.FatalError(t, err, fmt.Sprintf("Failed to enroll 'multicauser' with CA '%s'", caName))
+		return admin, resp.Identity
+	}
+	admin1, user1 := enroll("rootca1", "adminca1", "adminca1pw")
+	admin2, user2 := enroll("rootca2", "admin", "adminpw")
+
+	// Revoking the user in one CA doesn't affect the other CA
+	_, err = admin1.Revoke(&api.RevocationRequest{Name: "multicauser", CAName: "rootca1"})
+	util.FatalError(t, err, "Failed to revoke 'multicauser' in CA 'rootca1'")
+	_, err = user1.Reenroll(&api.ReenrollmentRequest{CAName: "rootca1"})
+	assert.Error(t, err, "Revoked identity should not be able to reenroll with CA 'rootca1'")
+	_, err = user2.Reenroll(&api.ReenrollmentRequest{CAName: "rootca2"})
+	assert.NoError(t, err, "Identity of CA 'rootca2' should not be revoked")
+
+	revokedCount := func(admin *Identity, caName string) int {
+		resp, err := admin.GenCRL(&api.GenCRLRequest{CAName: caName})
+		util.FatalError(t, err, fmt.Sprintf("Failed to generate CRL of CA '%s'", caName))
+		crl, err := x509.ParseCRL(resp.CRL)
+		util.FatalError(t, err, fmt.Sprintf("Failed to parse CRL of CA '%s'", caName))
+		return len(crl.TBSCertList.RevokedCertificates)
+	}
+	assert.Equal(t, 0, revokedCount(admin2, "rootca2"), "CRL of CA 'rootca2' should not contain certificates revoked by 'rootca1'")
+
+	_, err = admin2.Revoke(&api.RevocationRequest{Name: "multicauser", CAName: "rootca2"})
+	util.FatalError(t, err, "Failed to revoke 'multicauser' in CA 'rootca2'")
+	assert.Equal(t, 2, revokedCount(admin2, "rootca2"), "Both certificates of 'multicauser' issued by 'rootca2' should be revoked")
+}
+
+func TestSRVMultiCASameKey(t *testing.T) {
+	defer func() {
+		cleanMultiCADir(t)
+		cleanTestSlateSRV(t)
+	}()
+	// Create two CA certificates with different subjects but the same key
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	util.FatalError(t, err, "Failed to generate key")
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	util.FatalError(t, err, "Failed to marshal key")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for i, dir := range []string{"ca1", "ca2"} {
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(int64(i + 1)),
+			Subject:               pkix.Name{CommonName: "samekey" + dir},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			SubjectKeyId:          []byte{1, 2, 3, 4},
+		}
+		certDER, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+		util.FatalError(t, err, "Failed to create certificate")
+		caDir := filepath.Join("../testdata/ca/rootca", dir)
+		err = ioutil.WriteFile(filepath.Join(caDir, "ca-cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644)
+		util.FatalError(t, err, "Failed to write certificate")
+		err = ioutil.WriteFile(filepath.Join(caDir, "ca-key.pem"), keyPEM, 0600)
+		util.FatalError(t, err, "Failed to write key")
+	}
+
+	srv := TestGetServer(rootPort, testdataDir, "", -1, t)
+	srv.Config.CAfiles = []string{"ca/rootca/ca1/fabric-ca-server-config.yaml", "ca/rootca/ca2/fabric-ca-server-config.yaml"}
+	err = srv.Start()
+	if err == nil {
+		srv.Stop()
+		t.Fatal("Server start should have failed because two CAs have the same key")
+	}
+	assert.Contains(t, err.Error(), "same subject key identifier")
+}
+
 func TestSRVDefaultCAWithSetCAName(t *testing.T) {
 	defer func() {
 		err := os.RemoveAll("../testdata/ca-cert.pem")
@@ -1566,6 +1885,7 @@ func TestSRVMaxEnrollmentDisabled(t *testing.T) {
 	}
 	// Disable enrollment
 	srv.CA.Config.Registry.MaxEnrollments = 0
+	srv.ApplyConfig()
 	// Make sure both registration and enrollment fail
 	_, err = id.Identity.Register(&api.RegistrationRequest{
 		Name:        "me_0_0",
@@ -16,8 +16,19 @@ limitations under the License.
 package lib
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 const (
@@ -79,3 +90,156 @@ func TestGetAffliation(t *testing.T) {
 		t.Fatalf("Found 0 or more than one record for the affiliation %s in the database, expected 1 record", affiliationName)
 	}
 }
+
+func TestGetTLSPeerCertificate(t *testing.T) {
+	req, err := http.NewRequest("GET", "/cainfo", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %s", err)
+	}
+	ctx := newServerRequestContext(req, nil, nil)
+	assert.Nil(t, ctx.GetTLSPeerCertificate(), "Request not received over TLS")
+
+	req.TLS = &tls.ConnectionState{}
+	assert.Nil(t, ctx.GetTLSPeerCertificate(), "No verified client certificate")
+
+	cert := &x509.Certificate{}
+	req.TLS.VerifiedChains = [][]*x509.Certificate{{cert, &x509.Certificate{}}}
+	assert.Equal(t, cert, ctx.GetTLSPeerCertificate())
+}
+
+func TestGracefulShutdownOnSignal(t *testing.T) {
+	home := "shutdowntest"
+	defer func() {
+		err := os.RemoveAll(home)
+		if err != nil {
+			t.Errorf("RemoveAll failed: %s", err)
+		}
+	}()
+	srv := getServer(serverPort, home, "", -1, t)
+	if srv == nil {
+		t.Fatal("Failed to create server")
+	}
+	srv.Config.ShutdownTimeout = 10 * time.Second
+	srv.HandleSignals = true
+	err := srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	started := make(chan struct{})
+	srv.mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(2 * time.Second)
+		w.Write([]byte("done"))
+	})
+
+	url := fmt.Sprintf("http://localhost:%d/slow", serverPort)
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		results <- result{body: string(body), err: err}
+	}()
+	select {
+	case <-started:
+	case res := <-results:
+		t.Fatalf("Request completed before shutdown: %+v", res)
+	}
+
+	start := time.Now()
+	proc, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatalf("Failed to find own process: %s", err)
+	}
+	err = proc.Signal(syscall.SIGTERM)
+	if err != nil {
+		t.Fatalf("Failed to send SIGTERM: %s", err)
+	}
+
+	res := <-results
+	if assert.NoError(t, res.err, "Request in progress should complete during shutdown") {
+		assert.Equal(t, "done", res.body)
+	}
+	select {
+	case <-srv.drained:
+	case <-time.After(srv.Config.ShutdownTimeout):
+		t.Fatal("Server did not shut down within the shutdown timeout")
+	}
+	assert.True(t, time.Since(start) < srv.Config.ShutdownTimeout)
+
+	_, err = http.Get(url)
+	assert.Error(t, err, "Server should not accept new connections after shutdown")
+	assert.Error(t, srv.Shutdown(), "Shutdown of a shut down server should fail")
+}
+
+func TestHTTPTimeouts(t *testing.T) {
+	home := "httptimeoutstest"
+	defer func() {
+		err := os.RemoveAll(home)
+		if err != nil {
+			t.Errorf("RemoveAll failed: %s", err)
+		}
+	}()
+	srv := getServer(serverPort, home, "", -1, t)
+	if srv == nil {
+		t.Fatal("Failed to create server")
+	}
+	srv.Config.HTTP.ReadHeaderTimeout = 500 * time.Millisecond
+	srv.Config.HTTP.MaxHeaderBytes = 4096
+	err := srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	defer srv.Stop()
+	addr := fmt.Sprintf("localhost:%d", serverPort)
+
+	// A client which never completes the headers of its request is cut off
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %s", err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	_, err = conn.Write([]byte("GET /api/v1/cainfo HTTP/1.1\r\nHost: localhost\r\n"))
+	if err != nil {
+		t.Fatalf("Failed to write to server: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = ioutil.ReadAll(conn)
+	elapsed := time.Since(start)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatal("The server did not close the connection of a slow client")
+	}
+	assert.True(t, elapsed >= 400*time.Millisecond, "Connection closed before the read header timeout: %s", elapsed)
+	assert.True(t, elapsed < 3*time.Second, "Connection not closed at the read header timeout: %s", elapsed)
+
+	// Headers larger than the limit are rejected
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/api/v1/cainfo", addr), nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %s", err)
+	}
+	req.Header.Set("X-Large", strings.Repeat("a", 8192))
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, resp.StatusCode)
+
+	// Requests which complete in time are served
+	resp, err = client.Get(fmt.Sprintf("http://%s/api/v1/cainfo", addr))
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
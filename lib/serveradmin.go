@@ -0,0 +1,338 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	gmux "github.com/gorilla/mux"
+	"github.com/hyperledger/fabric-ca/lib/attr"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/lib/metadata"
+	"github.com/hyperledger/fabric-ca/lib/server/idemix"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	// adminSecretHeader is the request header containing the shared secret
+	// of the admin listener
+	adminSecretHeader = "X-Fabric-CA-Admin-Secret"
+	// adminListenerInvoker identifies the invoker of a request received by
+	// the admin listener in the server's log
+	adminListenerInvoker = "<admin listener>"
+)
+
+// adminListenerKey is the key of the request context value which is set for
+// requests received by the admin listener
+type adminListenerKey struct{}
+
+// checkAdminConfig returns an error if the admin listener is a TCP address
+// which is not a loopback address, unless that is allowed, or has no secret,
+// or if the Swagger UI URL is invalid or there is no admin listener to serve it
+func checkAdminConfig(c *ServerConfig) error {
+	addr := c.Admin.ListenAddress
+	if ui := c.Admin.SwaggerUI; ui != "" {
+		if addr == "" {
+			return errors.New("'admin.swaggerui' requires an admin listener, which 'admin.listenaddress' configures")
+		}
+		u, err := url.Parse(ui)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.Errorf("Invalid 'admin.swaggerui' URL '%s'; it must be an http or https URL", ui)
+		}
+	}
+	if addr == "" {
+		return nil
+	}
+	if _, ok := unixSocketPath(addr); ok {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid admin listening address '%s'", addr)
+	}
+	if !isLoopbackHost(host) && !c.Admin.AllowRemote {
+		return errors.Errorf("The admin listener must listen on a loopback address or a Unix domain socket, not '%s', unless 'admin.allowremote' is true", addr)
+	}
+	if c.Admin.Secret == "" {
+		return errors.Errorf("'admin.secret' is required because the admin listener '%s' is not a Unix domain socket", addr)
+	}
+	return nil
+}
+
+// registerAdminHandler registers the handler of an endpoint which administers
+// the server on the admin mux if there is an admin listener, in which case
+// the endpoint is not served on the server's port; otherwise it is
+// registered on the server's mux
+func (s *Server) registerAdminHandler(path string, h http.Handler) {
+	if s.adminMux == nil {
+		s.registerHandler(path, h)
+		return
+	}
+	s.registrations = append(s.registrations, endpointRegistration{version: metadata.APIVersion, path: path, handler: h, admin: true})
+	h = s.wrapEndpoint(path, h)
+	s.adminMux.Handle("/"+path, h)
+	s.adminMux.Handle(apiPathPrefix+path, h)
+}
+
+// registerAdminHandlers registers the handlers of the endpoints which
+// administer the server
+func (s *Server) registerAdminHandlers() {
+	if s.Config.Admin.ListenAddress != "" {
+		s.adminMux = gmux.NewRouter()
+	}
+	s.registerAdminHandler("loglevel", newLogLevelEndpoint(s))
+	s.registerAdminHandler("selftest", newSelfTestEndpoint(s))
+	s.registerAdminHandler("reload", newReloadEndpoint(s))
+	s.registerAdminHandler("config", newConfigEndpoint(s))
+	s.registerAdminHandler("purge", newPurgeEndpoint(s))
+	s.registerAdminHandler("backup", &rawAdminEndpoint{
+		server:  s,
+		action:  "back up the database",
+		handler: backupHandler,
+		doc: operationDoc{
+			summary:     "Get an archive of the database of a CA",
+			query:       map[string]string{"compress": "Compress the archive with gzip"},
+			contentType: "application/octet-stream",
+		},
+	})
+}
+
+// listenAndServeAdmin starts serving the endpoints which administer the
+// server if an admin listening address is configured
+func (s *Server) listenAndServeAdmin() error {
+	addr := s.Config.Admin.ListenAddress
+	if addr == "" {
+		return nil
+	}
+	var listener net.Listener
+	if path, ok := unixSocketPath(addr); ok {
+		mode, err := strconv.ParseUint(s.Config.Listeners.SocketMode, 8, 32)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid 'listeners.socketmode' value '%s'", s.Config.Listeners.SocketMode)
+		}
+		path, err = util.MakeFileAbs(path, s.HomeDir)
+		if err != nil {
+			return err
+		}
+		listener, err = listenOnUnixSocket(path, os.FileMode(mode))
+		if err != nil {
+			return err
+		}
+		log.Infof("Listening for administration requests on %s%s", unixSocketPrefix, path)
+	} else {
+		var err error
+		listener, err = net.Listen("tcp", addr)
+		if err != nil {
+			return errors.Wrapf(err, "TCP listen failed for admin address %s", addr)
+		}
+		log.Infof("Listening for administration requests on http://%s", listener.Addr())
+		if s.Config.Admin.AllowRemote {
+			log.Warning("The admin listener may listen on an address which is not a loopback address; administration requests sent to it are not encrypted")
+		}
+	}
+	s.adminListener = listener
+	go func(httpServer *http.Server) {
+		err := httpServer.Serve(listener)
+		log.Debugf("Stopped serving administration requests on %s: %s", addr, err)
+	}(s.newHTTPServer(s.authorizeAdminListener(s.adminMux)))
+	return nil
+}
+
+// authorizeAdminListener authorizes each request received by the admin
+// listener with its policy before passing it to 'next': the request must
+// have the shared secret, if one is configured; otherwise the listener is a
+// Unix domain socket and access to it is controlled by its file permissions
+func (s *Server) authorizeAdminListener(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if secret := s.Config.Admin.Secret; secret != "" {
+			given := r.Header.Get(adminSecretHeader)
+			if subtle.ConstantTimeCompare([]byte(given), []byte(secret)) != 1 {
+				log.Warningf("Rejected administration request for %s with a missing or invalid secret", r.URL.Path)
+				s.writeError(w, caerrors.CreateHTTPErr(http.StatusUnauthorized, caerrors.ErrInvalidAdminSecret, "Authentication failure"))
+				return
+			}
+		}
+		r = r.WithContext(context.WithValue(r.Context(), adminListenerKey{}, true))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminAuthorization authorizes the invoker of an endpoint which administers
+// the server to 'action' and returns the invoker. A request received by the
+// admin listener has been authorized by the listener's policy; any other
+// request must be authenticated with a token of an identity with the
+// "hf.Admin" attribute.
+func (ctx *serverRequestContextImpl) adminAuthorization(action string) (string, error) {
+	if viaAdmin, _ := ctx.req.Context().Value(adminListenerKey{}).(bool); viaAdmin {
+		return adminListenerInvoker, nil
+	}
+	// Authenticate the invoker
+	id, err := ctx.TokenAuthentication()
+	if err != nil {
+		return "", err
+	}
+	ca, err := ctx.GetCA()
+	if err != nil {
+		return "", err
+	}
+	// Server administration requires the "hf.Admin" attribute
+	err = ca.attributeIsTrue(id, attr.Admin)
+	if err != nil {
+		return "", caerrors.NewAuthorizationErr(caerrors.ErrNoAdminAuth,
+			"The identity '%s' does not have authority to %s: %s", id, action, err)
+	}
+	return id, nil
+}
+
+// rawAdminEndpoint serves an endpoint which administers the server and
+// whose response is not JSON, such as a profile or a backup archive
+type rawAdminEndpoint struct {
+	server *Server
+	// What the endpoint does, for the message of an authorization failure
+	action string
+	// Writes the response once the invoker is authorized
+	handler func(ctx *serverRequestContextImpl) error
+	// The GET operation of the endpoint in the API document
+	doc operationDoc
+}
+
+func (ae *rawAdminEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	se := &serverEndpoint{Methods: []string{"GET"}, Server: ae.server}
+	ctx := newServerRequestContext(r, w, se)
+	defer ctx.releaseBody()
+	err := se.validateMethod(r)
+	var id string
+	if err == nil {
+		id, err = ctx.adminAuthorization(ae.action)
+	}
+	info := getRequestInfo(r)
+	if info != nil {
+		info.identity = id
+	}
+	if err == nil {
+		log.Infof("Administration endpoint %s invoked by '%s'", r.URL.Path, id)
+		err = ae.handler(ctx)
+	}
+	if err != nil {
+		he := getHTTPErr(err)
+		if info != nil {
+			info.code = he.GetLocalCode()
+			info.msg = he.GetLocalMsg()
+		}
+		ae.server.writeError(w, he)
+	}
+}
+
+// rawHandler returns the handler of a rawAdminEndpoint which serves 'h'
+func rawHandler(h http.Handler) func(ctx *serverRequestContextImpl) error {
+	return func(ctx *serverRequestContextImpl) error {
+		h.ServeHTTP(ctx.resp, ctx.req)
+		return nil
+	}
+}
+
+func newReloadEndpoint(s *Server) *serverEndpoint {
+	return &serverEndpoint{
+		Methods: []string{"POST"},
+		Handler: reloadHandler,
+		Server:  s,
+		auth:    authAdmin,
+		docs: map[string]operationDoc{
+			"POST": {summary: "Reload the configuration and TLS certificate of the server"},
+		},
+	}
+}
+
+// Handle a request to reload the TLS certificate and configuration of the
+// server, as is done when it receives a SIGHUP
+func reloadHandler(ctx *serverRequestContextImpl) (interface{}, error) {
+	id, err := ctx.adminAuthorization("reload the configuration")
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Reload requested by '%s'", id)
+	err = ctx.endpoint.Server.reload()
+	if err != nil {
+		return nil, caerrors.NewHTTPErr(400, caerrors.ErrReloadFailed, "Failed to reload the configuration: %s", err)
+	}
+	return nil, nil
+}
+
+func newPurgeEndpoint(s *Server) *serverEndpoint {
+	return &serverEndpoint{
+		Methods: []string{"POST"},
+		Handler: purgeHandler,
+		Server:  s,
+		auth:    authAdmin,
+		docs: map[string]operationDoc{
+			"POST": {summary: "Remove the expired Idemix nonces and idempotency keys of a CA"},
+		},
+	}
+}
+
+// Handle a request to remove the expired Idemix nonces and idempotency keys
+// from the database of a CA now rather than at their next sweep
+func purgeHandler(ctx *serverRequestContextImpl) (interface{}, error) {
+	id, err := ctx.adminAuthorization("purge expired records")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ctx.GetCA()
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Purge of the expired records of CA '%s' requested by '%s'", ca.Config.CA.Name, id)
+	err = ca.sweepIdempotencyKeys(time.Now().UTC())
+	if err != nil {
+		return nil, caerrors.NewHTTPErr(500, caerrors.ErrPurgeFailed, "Failed to purge the expired idempotency keys: %s", err)
+	}
+	issuer, ok := ca.issuer.(idemix.MyIssuer)
+	if !ok || issuer.NonceManager() == nil {
+		return nil, nil
+	}
+	err = issuer.NonceManager().SweepExpiredNonces()
+	if err != nil {
+		return nil, caerrors.NewHTTPErr(500, caerrors.ErrPurgeFailed, "Failed to purge the expired nonces: %s", err)
+	}
+	return nil, nil
+}
+
+// backupHandler writes an archive of the database of the CA, as is written
+// by the backup command, gzip compressed if the 'compress' query parameter is true
+func backupHandler(ctx *serverRequestContextImpl) error {
+	ca, err := ctx.GetCA()
+	if err != nil {
+		return err
+	}
+	compress, _ := strconv.ParseBool(ctx.req.URL.Query().Get("compress"))
+	w := ctx.resp
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if !compress {
+		err = ca.backup(w, ctx.endpoint.Server.levels)
+	} else {
+		zw := gzip.NewWriter(w)
+		err = ca.backup(zw, ctx.endpoint.Server.levels)
+		if err == nil {
+			err = zw.Close()
+		}
+	}
+	if err != nil {
+		// The response has been started, so the failure can only be logged
+		log.Errorf("Failed to back up the database of CA '%s': %s", ca.Config.CA.Name, err)
+	}
+	return nil
+}
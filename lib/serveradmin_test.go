@@ -0,0 +1,193 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminEndpointsPublic(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	admin, user := enrollDebugIdentities(t)
+	assert.Empty(t, srv.ListenAddresses().Admin, "There should be no admin listener")
+
+	client := newAdminTestClient("")
+	url := fmt.Sprintf("http://localhost:%d/api/v1/", rootPort)
+	for _, ep := range []string{"reload", "purge", "selftest"} {
+		status, body := adminRequest(t, client, "POST", url+ep, admin, "")
+		assert.Equal(t, http.StatusOK, status, "An admin should be able to invoke %s: %s", ep, body)
+		status, body = adminRequest(t, client, "POST", url+ep, user, "")
+		assert.Equal(t, http.StatusForbidden, status, "An identity without hf.Admin should not be able to invoke %s", ep)
+		assert.Contains(t, string(body), "Authorization failure")
+		status, _ = adminRequest(t, client, "POST", url+ep, nil, "")
+		assert.Equal(t, http.StatusUnauthorized, status, "An unauthenticated request for %s should fail", ep)
+	}
+	status, body := adminRequest(t, client, "GET", url+"backup", admin, "")
+	assert.Equal(t, http.StatusOK, status, "An admin should be able to back up the database: %s", body)
+	assert.NotEmpty(t, body)
+	status, _ = adminRequest(t, client, "GET", url+"backup", user, "")
+	assert.Equal(t, http.StatusForbidden, status, "An identity without hf.Admin should not be able to back up the database")
+}
+
+func TestAdminListenerTCP(t *testing.T) {
+	srv := TestGetRootServer(t)
+	srv.Config.Admin.ListenAddress = "127.0.0.1:0"
+	srv.Config.Admin.Secret = "adminsecret"
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	admin, _ := enrollDebugIdentities(t)
+
+	client := newAdminTestClient("")
+	adminURL := fmt.Sprintf("http://%s/api/v1/", srv.ListenAddresses().Admin)
+	url := fmt.Sprintf("http://localhost:%d/api/v1/", rootPort)
+	for _, ep := range []string{"reload", "purge", "selftest"} {
+		status, body := adminRequest(t, client, "POST", adminURL+ep, nil, "adminsecret")
+		assert.Equal(t, http.StatusOK, status, "%s should be served on the admin listener: %s", ep, body)
+		status, body = adminRequest(t, client, "POST", adminURL+ep, admin, "")
+		assert.Equal(t, http.StatusUnauthorized, status, "A request for %s without the secret should fail", ep)
+		assert.Contains(t, string(body), "Authentication failure")
+		status, _ = adminRequest(t, client, "POST", adminURL+ep, admin, "wrongsecret")
+		assert.Equal(t, http.StatusUnauthorized, status, "A request for %s with the wrong secret should fail", ep)
+		status, _ = adminRequest(t, client, "POST", url+ep, admin, "adminsecret")
+		assert.Equal(t, http.StatusNotFound, status, "%s should not be served on the server's port", ep)
+	}
+	status, body := adminRequest(t, client, "GET", adminURL+"loglevel", nil, "adminsecret")
+	assert.Equal(t, http.StatusOK, status, "The log level should be served on the admin listener: %s", body)
+	status, _ = adminRequest(t, client, "GET", url+"loglevel", admin, "")
+	assert.Equal(t, http.StatusNotFound, status, "The log level should not be served on the server's port")
+	status, _ = adminRequest(t, client, "GET", url+"cainfo", nil, "")
+	assert.Equal(t, http.StatusOK, status, "The other endpoints should still be served on the server's port")
+	status, _ = adminRequest(t, client, "GET", adminURL+"cainfo", nil, "adminsecret")
+	assert.Equal(t, http.StatusNotFound, status, "The other endpoints should not be served on the admin listener")
+}
+
+func TestAdminListenerUnixSocket(t *testing.T) {
+	srv := TestGetRootServer(t)
+	srv.Config.Admin.ListenAddress = "unix://admin.sock"
+	srv.Config.Profiling.Enabled = true
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	sock, err := filepath.Abs(filepath.Join(rootDir, "admin.sock"))
+	util.FatalError(t, err, "Failed to get socket path")
+	assert.Equal(t, "unix://"+sock, srv.ListenAddresses().Admin)
+
+	client := newAdminTestClient(sock)
+	status, body := adminRequest(t, client, "POST", "http://localhost/api/v1/selftest", nil, "")
+	assert.Equal(t, http.StatusOK, status, "The self-test should be served on the admin socket without a secret: %s", body)
+	assert.Contains(t, string(body), `"passed":true`)
+
+	status, body = adminRequest(t, client, "GET", "http://localhost/api/v1/backup?compress=true", nil, "")
+	if assert.Equal(t, http.StatusOK, status, "The backup should be served on the admin socket: %s", body) {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if assert.NoError(t, err, "The backup should be compressed") {
+			archive, err := ioutil.ReadAll(zr)
+			assert.NoError(t, err)
+			assert.NotEmpty(t, archive)
+		}
+	}
+	status, _ = adminRequest(t, client, "GET", "http://localhost/api/v1/debug/vars", nil, "")
+	assert.Equal(t, http.StatusOK, status, "The profiling endpoints should be served on the admin socket")
+	status, _ = adminRequest(t, newAdminTestClient(""), "GET", fmt.Sprintf("http://localhost:%d/api/v1/debug/vars", rootPort), nil, "")
+	assert.Equal(t, http.StatusNotFound, status, "The profiling endpoints should not be served on the server's port")
+}
+
+func TestCheckAdminConfig(t *testing.T) {
+	cfg := &ServerConfig{}
+	assert.NoError(t, checkAdminConfig(cfg), "The admin listener is optional")
+	cfg.Admin.ListenAddress = "unix:///var/run/ca-admin.sock"
+	assert.NoError(t, checkAdminConfig(cfg), "A Unix domain socket does not need a secret")
+	cfg.Admin.ListenAddress = "127.0.0.1:7055"
+	err := checkAdminConfig(cfg)
+	util.ErrorContains(t, err, "admin.secret", "A TCP admin listener requires a secret")
+	cfg.Admin.Secret = "adminsecret"
+	for _, addr := range []string{"localhost:7055", "127.0.0.1:7055", "[::1]:7055"} {
+		cfg.Admin.ListenAddress = addr
+		assert.NoError(t, checkAdminConfig(cfg), "%s is a loopback address", addr)
+	}
+	cfg.Admin.ListenAddress = "0.0.0.0:7055"
+	err = checkAdminConfig(cfg)
+	util.ErrorContains(t, err, "admin.allowremote", "A non-loopback admin listener should be refused")
+	cfg.Admin.AllowRemote = true
+	assert.NoError(t, checkAdminConfig(cfg), "A non-loopback admin listener is allowed by admin.allowremote")
+	cfg.Admin.ListenAddress = "7055"
+	assert.Error(t, checkAdminConfig(cfg), "An address without a port should fail")
+}
+
+func TestAdminListenerRefusesRemoteAddress(t *testing.T) {
+	srv := TestGetRootServer(t)
+	srv.Config.Admin.ListenAddress = "0.0.0.0:0"
+	srv.Config.Admin.Secret = "adminsecret"
+	defer os.RemoveAll(rootDir)
+	err := srv.Start()
+	if !assert.Error(t, err, "The server should not start with a non-loopback admin listener") {
+		srv.Stop()
+		return
+	}
+	assert.True(t, strings.Contains(err.Error(), "admin.allowremote"), "Unexpected error: %s", err)
+}
+
+// newAdminTestClient returns an HTTP client which connects to the Unix domain
+// socket 'sock', if not empty, and opens a new connection for each request
+func newAdminTestClient(sock string) *http.Client {
+	tr := &http.Transport{DisableKeepAlives: true}
+	if sock != "" {
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		}
+	}
+	return &http.Client{Transport: tr}
+}
+
+// adminRequest sends a request for 'url' with the token of 'id', if not nil,
+// and the admin secret, if not empty, and returns the status and body of the response
+func adminRequest(t *testing.T, client *http.Client, method, url string, id *Identity, secret string) (int, []byte) {
+	req, err := http.NewRequest(method, url, nil)
+	util.FatalError(t, err, "Failed to create request")
+	if id != nil {
+		err = id.addTokenAuthHdr(req, nil)
+		util.FatalError(t, err, "Failed to add token")
+	}
+	if secret != "" {
+		req.Header.Set(adminSecretHeader, secret)
+	}
+	resp, err := client.Do(req)
+	util.FatalError(t, err, "Failed to send request to "+url)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	util.FatalError(t, err, "Failed to read response")
+	return resp.StatusCode, body
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/hyperledger/fabric-ca/api"
 	"github.com/hyperledger/fabric-ca/lib/attr"
 	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/lib/server"
 	"github.com/hyperledger/fabric-ca/lib/spi"
 	"github.com/pkg/errors"
 )
@@ -25,6 +26,14 @@ func newAffiliationsEndpoint(s *Server) *serverEndpoint {
 		Handler:   affiliationsHandler,
 		Server:    s,
 		successRC: 200,
+		auth:      authToken,
+		docs: map[string]operationDoc{
+			"GET": {summary: "Get an affiliation and its sub-affiliations", response: &api.AffiliationResponse{}},
+			"DELETE": {summary: "Remove an affiliation", response: &api.AffiliationResponse{},
+				query: map[string]string{"force": "Also remove the sub-affiliations and identities of the affiliation"}},
+			"PUT": {summary: "Rename an affiliation", request: &api.ModifyAffiliationRequest{}, response: &api.AffiliationResponse{},
+				query: map[string]string{"force": "Also update the identities of the affiliation"}},
+		},
 	}
 }
 
@@ -34,6 +43,13 @@ func newAffiliationsStreamingEndpoint(s *Server) *serverEndpoint {
 		Handler:   affiliationsStreamingHandler,
 		Server:    s,
 		successRC: 200,
+		auth:      authToken,
+		docs: map[string]operationDoc{
+			"GET": {summary: "Get the affiliations which the invoker may see", response: &api.AffiliationResponse{},
+				query: listQueryDocs(affiliationListSpec, nil)},
+			"POST": {summary: "Add an affiliation", request: &api.AddAffiliationRequest{}, response: &api.AffiliationResponse{},
+				query: map[string]string{"force": "Also add the parent affiliations which do not exist"}},
+		},
 	}
 }
 
@@ -128,9 +144,18 @@ func processAffiliationRequest(ctx *serverRequestContextImpl, caname string, cal
 	}
 }
 
-func processGetAllAffiliationsRequest(ctx *serverRequestContextImpl, caller spi.User, caname string) (*api.AffiliationResponse, error) {
+func processGetAllAffiliationsRequest(ctx *serverRequestContextImpl, caller spi.User, caname string) (interface{}, error) {
 	log.Debug("Processing GET all affiliations request")
 
+	params, err := parseListParams(ctx, affiliationListSpec)
+	if err != nil {
+		return nil, err
+	}
+	// A request for a page of affiliations gets the page in a list envelope
+	if params.Paged {
+		return getAffiliationsPage(ctx, caller, params)
+	}
+
 	resp, err := getAffiliations(ctx, caller, caname)
 	if err != nil {
 		return nil, err
@@ -191,6 +216,38 @@ func getAffiliations(ctx *serverRequestContextImpl, caller spi.User, caname stri
 	return resp, nil
 }
 
+// getAffiliationsPage returns the page of the affiliations which the caller
+// is authorized to view which 'params' selects
+func getAffiliationsPage(ctx *serverRequestContextImpl, caller spi.User, params *server.ListParams) (*server.ListPage, error) {
+	log.Debug("Requesting a page of the affiliations that the caller is authorized view")
+
+	registry := ctx.ca.registry
+	rows, err := registry.GetAllAffiliations(GetUserAffiliation(caller))
+	if err != nil {
+		return nil, caerrors.NewHTTPErr(500, caerrors.ErrGettingAffiliation, "Failed to get affiliation: %s", err)
+	}
+	defer rows.Close()
+
+	pager := params.NewPager()
+	for rows.Next() {
+		var aff AffiliationRecord
+		err := rows.StructScan(&aff)
+		if err != nil {
+			return nil, caerrors.NewHTTPErr(500, caerrors.ErrGettingAffiliation, "Failed to get read row: %s", err)
+		}
+		pager.Add(&server.ListItem{
+			Keys:  map[string]string{"name": aff.Name},
+			ID:    aff.Name,
+			Value: api.AffiliationInfo{Name: aff.Name},
+		})
+	}
+	page, err := pager.Page()
+	if err != nil {
+		return nil, caerrors.NewHTTPErr(500, caerrors.ErrGettingAffiliation, "Failed to get page of affiliations: %s", err)
+	}
+	return page, nil
+}
+
 func getAffiliation(ctx *serverRequestContextImpl, caller spi.User, requestedAffiliation, caname string) (*api.AffiliationResponse, error) {
 	log.Debugf("Requesting affiliation '%s'", requestedAffiliation)
 
@@ -216,7 +273,7 @@ func getAffiliation(ctx *serverRequestContextImpl, caller spi.User, requestedAff
 func processAffiliationDeleteRequest(ctx *serverRequestContextImpl, caname string) (*api.AffiliationResponse, error) {
 	log.Debug("Processing DELETE request")
 
-	if !ctx.ca.Config.Cfg.Affiliations.AllowRemove {
+	if !ctx.caConfig(ctx.ca).cfg.Affiliations.AllowRemove {
 		return nil, caerrors.NewAuthorizationErr(caerrors.ErrUpdateConfigRemoveAff, "Affiliation removal is disabled")
 	}
 
@@ -249,7 +306,7 @@ func processAffiliationDeleteRequest(ctx *serverRequestContextImpl, caname strin
 		}
 	}
 
-	identityRemoval := ctx.ca.Config.Cfg.Identities.AllowRemove
+	identityRemoval := ctx.caConfig(ctx.ca).cfg.Identities.AllowRemove
 	result, err := ctx.ca.registry.DeleteAffiliation(removeAffiliation, force, identityRemoval, isRegistrar)
 	if err != nil {
 		return nil, err
@@ -280,7 +337,7 @@ func processAffiliationPostRequest(ctx *serverRequestContextImpl, caname string)
 	registry := ctx.ca.registry
 	_, err = registry.GetAffiliation(addAffiliation)
 	if err == nil {
-		return nil, caerrors.NewHTTPErr(400, caerrors.ErrUpdateConfigAddAff, "Affiliation already exists")
+		return nil, caerrors.NewHTTPErr(409, caerrors.ErrAffiliationExists, "Affiliation already exists")
 	}
 
 	err = ctx.ContainsAffiliation(addAffiliation)
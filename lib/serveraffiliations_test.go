@@ -326,6 +326,7 @@ func TestDynamicRemoveAffiliation(t *testing.T) {
 	assert.Error(t, err, "Should have failed, affiliation removal not allowed")
 
 	srv.CA.Config.Cfg.Affiliations.AllowRemove = true
+	srv.ApplyConfig()
 
 	_, err = admin2.RemoveAffiliation(removeAffReq)
 	assert.Error(t, err, "Should have failed, can't remove affiliation as the same level as caller")
@@ -338,6 +339,7 @@ func TestDynamicRemoveAffiliation(t *testing.T) {
 	assert.Error(t, err, "Should have failed, there is an identity associated with affiliation but identity removal is not allowed")
 
 	srv.CA.Config.Cfg.Identities.AllowRemove = true
+	srv.ApplyConfig()
 
 	_, err = notRegistrar.RemoveAffiliation(removeAffReq)
 	if assert.Error(t, err, "Should have failed, there is an identity associated with affiliation but caller is not a registrar") {
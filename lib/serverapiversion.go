@@ -0,0 +1,106 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/lib/metadata"
+)
+
+const (
+	// apiVersionsHeader is the response header listing the versions of the
+	// REST API served by the server, oldest first
+	apiVersionsHeader = "X-Fabric-CA-API-Versions"
+	// deprecationHeader and sunsetHeader are the response headers of an
+	// endpoint which is superseded by the endpoint of a later API version
+	deprecationHeader = "Deprecation"
+	sunsetHeader      = "Sunset"
+	// sunsetDateFormat is the format of the sunset date of the configuration
+	sunsetDateFormat = "2006-01-02"
+)
+
+// apiVersionPrefix returns the path prefix of the endpoints of the API
+// version 'version', such as /api/v2/
+func apiVersionPrefix(version string) string {
+	return "/api/" + version + "/"
+}
+
+// registerAPIHandler registers the handler of the endpoint 'path' of the
+// API version 'version', a version after metadata.APIVersion. The endpoint
+// of the same path of metadata.APIVersion, if any, is then deprecated.
+func (s *Server) registerAPIHandler(version, path string, se http.Handler) {
+	if s.successors == nil {
+		s.successors = map[string]string{}
+	}
+	s.successors[path] = version
+	s.registrations = append(s.registrations, endpointRegistration{version: version, path: path, handler: se})
+	// The endpoint shares the concurrency limit and metrics of its path
+	h := s.wrapEndpoint(path, withAPIVersion(version, se))
+	s.mux.Handle(s.basePath()+apiVersionPrefix(version)+path, h)
+}
+
+// withAPIVersion sets the API version header of the responses of 'next' to
+// 'version'
+func withAPIVersion(version string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(apiVersionHeader, version)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deprecateSuperseded adds the deprecation headers to the responses of the
+// endpoint 'path' of metadata.APIVersion if an endpoint of a later API
+// version supersedes it, with a link to that endpoint
+func (s *Server) deprecateSuperseded(path string, next http.Handler) http.Handler {
+	var sunset string
+	if s.Config != nil && s.Config.API.Sunset != "" {
+		t, err := time.Parse(sunsetDateFormat, s.Config.API.Sunset)
+		if err == nil {
+			sunset = t.Format(http.TimeFormat)
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The endpoints of later versions are registered after those of
+		// metadata.APIVersion, but before the server serves any request
+		version := s.successors[path]
+		if version != "" {
+			w.Header().Set(deprecationHeader, "true")
+			if sunset != "" {
+				w.Header().Set(sunsetHeader, sunset)
+			}
+			rel := strings.TrimPrefix(r.URL.Path, s.basePath())
+			if strings.HasPrefix(rel, apiPathPrefix) {
+				rel = strings.TrimPrefix(rel, apiPathPrefix)
+			} else {
+				rel = strings.TrimPrefix(rel, "/")
+			}
+			w.Header().Add("Link", fmt.Sprintf(`<%s%s%s>; rel="successor-version"`, s.basePath(), apiVersionPrefix(version), rel))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validateAPI checks the configuration of the API versions
+func (s *Server) validateAPI(v configValidator) {
+	sunset := s.Config.API.Sunset
+	if sunset == "" {
+		return
+	}
+	_, err := time.Parse(sunsetDateFormat, sunset)
+	if err != nil {
+		v.addf("api.sunset", "Invalid sunset date '%s'; it must be formatted as YYYY-MM-DD", sunset)
+	}
+}
+
+// apiVersionsHeaderValue returns the value of the API versions header
+func apiVersionsHeaderValue() string {
+	return strings.Join(metadata.APIVersions, ", ")
+}
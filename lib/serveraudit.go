@@ -0,0 +1,79 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/lib/logging"
+	"github.com/hyperledger/fabric-ca/lib/metrics"
+)
+
+// The audit events of the authentication and authorization of requests
+const (
+	auditAuthnSuccess = "authentication_success"
+	auditAuthnFailure = "authentication_failure"
+	auditAuthzFailure = "authorization_failure"
+)
+
+// auditIdentityRegistered is the audit event of the registration of an
+// identity
+const auditIdentityRegistered = "identity_registered"
+
+// metricLogDropped is the name of the metric of the log messages which
+// were not forwarded to syslog
+const metricLogDropped = "fabric_ca_log_messages_dropped_total"
+
+// newLogMetrics registers the metrics of the forwarding of log messages
+func (s *Server) newLogMetrics(reg *metrics.Registry) {
+	reg.NewCounter(metricLogDropped, "Number of log messages which were dropped rather than forwarded to syslog")
+	// Messages dropped before the registry was created are counted too
+	reg.Get(metricLogDropped).With().Add(float64(logging.SyslogDropped()))
+	logging.SetSyslogDropObserver(func() {
+		reg.Get(metricLogDropped).With().Add(1)
+	})
+}
+
+// audit logs the audit event of the authentication or authorization of the
+// request 'r', whose handling failed with 'he' if not nil. Failures are
+// logged as warnings and successful authentications as information.
+func (se *serverEndpoint) audit(r *http.Request, ctx *serverRequestContextImpl, info *requestInfo, he *caerrors.HTTPErr) {
+	identity := ctx.enrollmentID
+	if identity == "" {
+		identity, _, _ = r.BasicAuth()
+	}
+	fields := logging.Fields{
+		"request_id": info.id,
+		"remote":     r.RemoteAddr,
+		"method":     r.Method,
+		"path":       r.URL.Path,
+		"identity":   identity,
+	}
+	var event, what string
+	level := log.LevelWarning
+	switch {
+	case he != nil && he.GetStatusCode() == http.StatusUnauthorized:
+		event, what = auditAuthnFailure, "Authentication failure of"
+	case he != nil && he.GetStatusCode() == http.StatusForbidden:
+		event, what = auditAuthzFailure, "Authorization failure of"
+	case ctx.enrollmentID != "":
+		event, what = auditAuthnSuccess, "Authenticated"
+		level = log.LevelInfo
+	default:
+		return
+	}
+	msg := fmt.Sprintf("%s '%s' for %s %s from %s", what, identity, r.Method, r.URL.Path, r.RemoteAddr)
+	if he != nil {
+		fields["code"] = he.GetLocalCode()
+		fields["reason"] = he.GetLocalMsg()
+		msg += ": " + he.GetLocalMsg()
+	}
+	logging.Audit(level, event, msg, fields)
+}
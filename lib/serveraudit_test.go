@@ -0,0 +1,95 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"net"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib/logging"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// auditPattern matches an audit event forwarded to syslog, capturing its
+// priority, event and identity
+var auditPattern = regexp.MustCompile(`^<(\d+)>1 \S+ \S+ fabric-ca-server \d+ audit \[fabric-ca@32473 .*event="(\w+)" identity="(\w*)"`)
+
+func TestAuditSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	util.FatalError(t, err, "Failed to listen for syslog messages")
+	defer conn.Close()
+
+	// The audit events are read while the requests are made, so that the
+	// other log messages don't overflow the receive buffer
+	events := make(chan []string, 100)
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				close(events)
+				return
+			}
+			if m := auditPattern.FindStringSubmatch(string(buf[:n])); m != nil {
+				events <- m[1:]
+			}
+		}
+	}()
+
+	srv := TestGetRootServer(t)
+	srv.Config.Log.Syslog.Address = "udp://" + conn.LocalAddr().String()
+	err = srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		logging.Configure(&logging.Config{}, "")
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+
+	c := TestGetRootClient()
+	_, err = c.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "wrongpw"})
+	assert.Error(t, err, "Enrollment with a wrong secret should fail")
+	enrollResp, err := c.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin'")
+	_, err = enrollResp.Identity.Register(&api.RegistrationRequest{Name: "audituser", Secret: "audituserpw"})
+	util.FatalError(t, err, "Failed to register 'audituser'")
+	enrollResp, err = c.Enroll(&api.EnrollmentRequest{Name: "audituser", Secret: "audituserpw"})
+	util.FatalError(t, err, "Failed to enroll 'audituser'")
+	_, err = enrollResp.Identity.GetLogLevel()
+	assert.Error(t, err, "An identity without hf.Admin should not get the log level")
+
+	// The events are forwarded with the facility local0 (16) and the
+	// severities warning (4) for failures and informational (6) for successes.
+	// The registration is audited when it is committed, before the
+	// authentication of the request which is audited when it completes.
+	expected := [][]string{
+		{"132", auditAuthnFailure, "admin"},
+		{"134", auditAuthnSuccess, "admin"},
+		{"134", auditIdentityRegistered, "admin"},
+		{"134", auditAuthnSuccess, "admin"},
+		{"134", auditAuthnSuccess, "audituser"},
+		{"132", auditAuthzFailure, "audituser"},
+	}
+	received := [][]string{}
+	timeout := time.After(5 * time.Second)
+	for len(received) < len(expected) {
+		select {
+		case e := <-events:
+			received = append(received, e)
+		case <-timeout:
+			t.Fatalf("Failed to receive the audit events %v; received %v", expected, received)
+		}
+	}
+	assert.Equal(t, expected, received)
+	assert.NotNil(t, srv.metrics.Get(metricLogDropped), "The dropped log messages should be counted")
+}
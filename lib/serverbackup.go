@@ -0,0 +1,400 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/lib/dbutil"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// A backup archive is a stream of JSON objects, one per line: a header, then
+// a record for each affiliation, identity and certificate of the CA's
+// database, and then a trailer with the number of records, which detects a
+// truncated archive. The archive may be gzip compressed.
+const (
+	backupFormat  = "fabric-ca-backup"
+	backupVersion = 1
+)
+
+// The types of the records of a backup archive
+const (
+	backupAffiliation = "affiliation"
+	backupIdentity    = "identity"
+	backupCertificate = "certificate"
+	backupEnd         = "end"
+)
+
+// backupHeader is the first object of a backup archive
+type backupHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	CAName  string    `json:"caname"`
+	Created time.Time `json:"created"`
+	// The schema levels of the server which created the archive
+	Levels *dbutil.Levels `json:"levels"`
+}
+
+// backupRecord is a record of a backup archive; only the field for its type is set
+type backupRecord struct {
+	Type        string                 `json:"type"`
+	Affiliation *backupAffiliationData `json:"affiliation,omitempty"`
+	Identity    *backupIdentityData    `json:"identity,omitempty"`
+	Certificate *backupCertificateData `json:"certificate,omitempty"`
+	// The number of records before the trailer
+	Count int `json:"count,omitempty"`
+}
+
+type backupAffiliationData struct {
+	Name   string `json:"name"`
+	Prekey string `json:"prekey"`
+	Level  int    `json:"level"`
+}
+
+type backupIdentityData struct {
+	Name string `json:"id"`
+	// The hashed secret, exactly as stored in the database
+	Pass           []byte `json:"token"`
+	Type           string `json:"type"`
+	Affiliation    string `json:"affiliation"`
+	Attributes     string `json:"attributes"`
+	State          int    `json:"state"`
+	MaxEnrollments int    `json:"max_enrollments"`
+	Level          int    `json:"level"`
+}
+
+type backupCertificateData struct {
+	ID        string    `json:"id"`
+	Serial    string    `json:"serial_number"`
+	AKI       string    `json:"authority_key_identifier"`
+	CALabel   string    `json:"ca_label"`
+	Status    string    `json:"status"`
+	Reason    int       `json:"reason"`
+	Expiry    time.Time `json:"expiry"`
+	RevokedAt time.Time `json:"revoked_at"`
+	PEM       string    `json:"pem"`
+	Level     int       `json:"level"`
+}
+
+// Backup writes an archive of the affiliations, identities and certificates
+// in the database of the CA named 'caName', or of the default CA if it is
+// empty, to 'w'. If 'compress' is true, the archive is gzip compressed.
+func (s *Server) Backup(caName string, w io.Writer, compress bool) error {
+	ca, err := s.initForBackup(caName)
+	defer s.closeDBForBackup()
+	if err != nil {
+		return err
+	}
+	if compress {
+		zw := gzip.NewWriter(w)
+		err = ca.backup(zw, s.levels)
+		if err != nil {
+			return err
+		}
+		return errors.Wrap(zw.Close(), "Failed to compress backup archive")
+	}
+	return ca.backup(w, s.levels)
+}
+
+// Restore loads an archive written by Backup from 'r' into the database of
+// the CA named 'caName', or of the default CA if it is empty. The records in
+// the database are replaced by those of the archive unless 'merge' is true,
+// in which case the records of the archive which are not in the database are
+// added. Either all of the archive is loaded or none of it.
+func (s *Server) Restore(caName string, r io.Reader, merge bool) error {
+	ca, err := s.initForBackup(caName)
+	defer s.closeDBForBackup()
+	if err != nil {
+		return err
+	}
+	return ca.restore(r, merge, s.levels)
+}
+
+// initForBackup initializes the server and returns the CA named 'caName'
+func (s *Server) initForBackup(caName string) (*CA, error) {
+	err := s.init(false)
+	if err != nil {
+		return nil, err
+	}
+	if caName == "" {
+		return &s.CA, nil
+	}
+	return s.GetCA(caName)
+}
+
+func (s *Server) closeDBForBackup() {
+	err := s.closeDB()
+	if err != nil {
+		log.Errorf("Close DB failed: %s", err)
+	}
+}
+
+// backup writes the archive of the CA's database to 'w'
+func (ca *CA) backup(w io.Writer, levels *dbutil.Levels) error {
+	if ca.db == nil || !ca.db.IsInitialized() {
+		return errors.Errorf("The database of CA '%s' is not initialized", ca.Config.CA.Name)
+	}
+	enc := json.NewEncoder(w)
+	err := enc.Encode(&backupHeader{
+		Format:  backupFormat,
+		Version: backupVersion,
+		CAName:  ca.Config.CA.Name,
+		Created: time.Now().UTC(),
+		Levels:  levels,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to write backup archive")
+	}
+	count := 0
+	write := func(rec *backupRecord) error {
+		count++
+		return errors.Wrap(enc.Encode(rec), "Failed to write backup archive")
+	}
+
+	accessor := NewDBAccessor(ca.db)
+	rows, err := accessor.GetAllAffiliations("")
+	if err != nil {
+		return errors.Wrap(err, "Failed to get affiliations")
+	}
+	err = forEachRow(rows, func() error {
+		var aff AffiliationRecord
+		err := rows.StructScan(&aff)
+		if err != nil {
+			return errors.Wrap(err, "Failed to read affiliation")
+		}
+		return write(&backupRecord{Type: backupAffiliation, Affiliation: &backupAffiliationData{
+			Name:   aff.Name,
+			Prekey: aff.Prekey,
+			Level:  aff.Level,
+		}})
+	})
+	if err != nil {
+		return err
+	}
+
+	rows, err = accessor.GetFilteredUsers("", "*")
+	if err != nil {
+		return errors.Wrap(err, "Failed to get identities")
+	}
+	err = forEachRow(rows, func() error {
+		var user UserRecord
+		err := rows.StructScan(&user)
+		if err != nil {
+			return errors.Wrap(err, "Failed to read identity")
+		}
+		return write(&backupRecord{Type: backupIdentity, Identity: &backupIdentityData{
+			Name:           user.Name,
+			Pass:           user.Pass,
+			Type:           user.Type,
+			Affiliation:    user.Affiliation,
+			Attributes:     user.Attributes,
+			State:          user.State,
+			MaxEnrollments: user.MaxEnrollments,
+			Level:          user.Level,
+		}})
+	})
+	if err != nil {
+		return err
+	}
+
+	rows, err = ca.certDBAccessor.GetAllCertificates()
+	if err != nil {
+		return errors.Wrap(err, "Failed to get certificates")
+	}
+	err = forEachRow(rows, func() error {
+		var cert CertRecord
+		err := rows.StructScan(&cert)
+		if err != nil {
+			return errors.Wrap(err, "Failed to read certificate")
+		}
+		return write(&backupRecord{Type: backupCertificate, Certificate: &backupCertificateData{
+			ID:        cert.ID,
+			Serial:    cert.Serial,
+			AKI:       cert.AKI,
+			CALabel:   cert.CALabel,
+			Status:    cert.Status,
+			Reason:    cert.Reason,
+			Expiry:    cert.Expiry.UTC(),
+			RevokedAt: cert.RevokedAt.UTC(),
+			PEM:       cert.PEM,
+			Level:     cert.Level,
+		}})
+	})
+	if err != nil {
+		return err
+	}
+
+	err = enc.Encode(&backupRecord{Type: backupEnd, Count: count})
+	if err != nil {
+		return errors.Wrap(err, "Failed to write backup archive")
+	}
+	log.Infof("Backed up %d records of CA '%s'", count, ca.Config.CA.Name)
+	return nil
+}
+
+// forEachRow calls 'f' for each of 'rows' and closes them
+func forEachRow(rows *sqlx.Rows, f func() error) error {
+	defer rows.Close()
+	for rows.Next() {
+		err := f()
+		if err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(rows.Err(), "Failed to read database")
+}
+
+// restore loads the archive in 'r' into the CA's database
+func (ca *CA) restore(r io.Reader, merge bool, levels *dbutil.Levels) error {
+	if ca.db == nil || !ca.db.IsInitialized() {
+		return errors.Errorf("The database of CA '%s' is not initialized", ca.Config.CA.Name)
+	}
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return errors.Wrap(err, "Failed to decompress backup archive")
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+	dec := json.NewDecoder(r)
+	var hdr backupHeader
+	err := dec.Decode(&hdr)
+	if err != nil || hdr.Format != backupFormat {
+		return errors.New("The file is not a fabric-ca backup archive")
+	}
+	if hdr.Version != backupVersion {
+		return errors.Errorf("Unsupported backup archive version %d; this server supports version %d",
+			hdr.Version, backupVersion)
+	}
+	if hdr.Levels == nil || hdr.Levels.Identity > levels.Identity || hdr.Levels.Affiliation > levels.Affiliation ||
+		hdr.Levels.Certificate > levels.Certificate {
+		return errors.Errorf("The backup archive was created by a server with a newer database schema (%+v) than this server's (%+v)",
+			hdr.Levels, levels)
+	}
+	if hdr.CAName != ca.Config.CA.Name {
+		log.Warningf("Restoring a backup of CA '%s' into CA '%s'", hdr.CAName, ca.Config.CA.Name)
+	}
+
+	_, err = NewDBAccessor(ca.db).doTransaction(restoreTx, dec, merge)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// restoreTx loads the records from the backup archive decoder in args[0]
+// using 'tx'; if args[1] is false, the existing records are deleted first
+func restoreTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	dec := args[0].(*json.Decoder)
+	merge := args[1].(bool)
+	if !merge {
+		for _, table := range []string{"certificates", "users", "affiliations"} {
+			_, err := tx.Exec("DELETE FROM " + table)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed to delete the records of table '%s'", table)
+			}
+		}
+	}
+	count, added := 0, 0
+	for {
+		var rec backupRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return nil, errors.New("The backup archive is truncated")
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read backup archive")
+		}
+		if rec.Type == backupEnd {
+			if rec.Count != count {
+				return nil, errors.Errorf("The backup archive has %d records but its trailer says %d", count, rec.Count)
+			}
+			log.Infof("Restored %d records, of which %d were added", count, added)
+			return nil, nil
+		}
+		count++
+		ok, err := restoreRecord(tx, &rec, merge)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			added++
+		}
+	}
+}
+
+// restoreRecord inserts 'rec' using 'tx' and returns true, or, if 'merge' is
+// true and the record is already in the database, returns false
+func restoreRecord(tx *sqlx.Tx, rec *backupRecord, merge bool) (bool, error) {
+	var exists int
+	var err error
+	switch {
+	case rec.Type == backupAffiliation && rec.Affiliation != nil:
+		a := rec.Affiliation
+		if merge {
+			err = tx.Get(&exists, tx.Rebind("SELECT COUNT(*) FROM affiliations WHERE (name = ?)"), a.Name)
+			if err != nil || exists > 0 {
+				return false, errors.Wrapf(err, "Failed to look up affiliation '%s'", a.Name)
+			}
+		}
+		_, err = tx.Exec(tx.Rebind(insertAffiliation), a.Name, a.Prekey, a.Level)
+		return true, errors.Wrapf(err, "Failed to restore affiliation '%s'", a.Name)
+	case rec.Type == backupIdentity && rec.Identity != nil:
+		u := rec.Identity
+		if merge {
+			err = tx.Get(&exists, tx.Rebind("SELECT COUNT(*) FROM users WHERE (id = ?)"), u.Name)
+			if err != nil || exists > 0 {
+				return false, errors.Wrapf(err, "Failed to look up identity '%s'", u.Name)
+			}
+		}
+		_, err = tx.NamedExec(insertUser, &UserRecord{
+			Name:           u.Name,
+			Pass:           u.Pass,
+			Type:           u.Type,
+			Affiliation:    u.Affiliation,
+			Attributes:     u.Attributes,
+			State:          u.State,
+			MaxEnrollments: u.MaxEnrollments,
+			Level:          u.Level,
+		})
+		return true, errors.Wrapf(err, "Failed to restore identity '%s'", u.Name)
+	case rec.Type == backupCertificate && rec.Certificate != nil:
+		c := rec.Certificate
+		if merge {
+			err = tx.Get(&exists, tx.Rebind("SELECT COUNT(*) FROM certificates WHERE (serial_number = ? AND authority_key_identifier = ?)"),
+				c.Serial, c.AKI)
+			if err != nil || exists > 0 {
+				return false, errors.Wrapf(err, "Failed to look up certificate '%s'", c.Serial)
+			}
+		}
+		cr := &CertRecord{ID: c.ID, Level: c.Level}
+		cr.Serial = c.Serial
+		cr.AKI = c.AKI
+		cr.CALabel = c.CALabel
+		cr.Status = c.Status
+		cr.Reason = c.Reason
+		cr.Expiry = c.Expiry
+		cr.RevokedAt = c.RevokedAt
+		cr.PEM = c.PEM
+		_, err = tx.NamedExec(insertSQL, cr)
+		return true, errors.Wrapf(err, "Failed to restore certificate '%s'", c.Serial)
+	default:
+		return false, errors.Errorf("Invalid record of type '%s' in backup archive", rec.Type)
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib/spi"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+const restoreDir = "restoreDir"
+
+func TestBackupRestore(t *testing.T) {
+	defer func() {
+		os.RemoveAll(rootDir)
+		os.RemoveAll(restoreDir)
+		os.RemoveAll(rootClientDir)
+	}()
+
+	// Seed the store with an identity, an affiliation and certificates
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	client := TestGetRootClient()
+	resp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin'")
+	admin := resp.Identity
+	_, err = admin.AddAffiliation(&api.AddAffiliationRequest{Name: "org3.dept1", Force: true})
+	util.FatalError(t, err, "Failed to add affiliation")
+	_, err = admin.Register(&api.RegistrationRequest{Name: "user1", Secret: "user1pw", Affiliation: "org3.dept1"})
+	util.FatalError(t, err, "Failed to register 'user1'")
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "user1", Secret: "user1pw"})
+	util.FatalError(t, err, "Failed to enroll 'user1'")
+	_, err = admin.Revoke(&api.RevocationRequest{Name: "user1"})
+	util.FatalError(t, err, "Failed to revoke 'user1'")
+	err = srv.Shutdown()
+	util.FatalError(t, err, "Failed to shut down server")
+
+	var archive bytes.Buffer
+	srv = TestGetServer2(false, rootPort, rootDir, "", -1, t)
+	err = srv.Backup("", &archive, true)
+	util.FatalError(t, err, "Failed to back up the database")
+	original := backupRecords(t, archive.Bytes())
+	assert.True(t, len(original) > 5, "The backup archive should contain the seeded records")
+	assert.NotContains(t, strings.Join(original, "\n"), "user1pw", "Secrets should remain hashed in the backup archive")
+
+	// Restore into a fresh store and compare its records with the original ones
+	srv = TestGetServer(rootPort, restoreDir, "", -1, t)
+	err = srv.Restore("", bytes.NewReader(archive.Bytes()), false)
+	util.FatalError(t, err, "Failed to restore the database")
+	var restored bytes.Buffer
+	srv = TestGetServer2(false, rootPort, restoreDir, "", -1, t)
+	err = srv.Backup("", &restored, false)
+	util.FatalError(t, err, "Failed to back up the restored database")
+	assert.Equal(t, original, backupRecords(t, restored.Bytes()), "The restored records should be the original ones")
+
+	// The restored identities log in with their original secrets
+	srv = TestGetServer2(false, rootPort, restoreDir, "", -1, t)
+	err = srv.Start()
+	util.FatalError(t, err, "Failed to start server with the restored database")
+	_, err = TestGetRootClient().Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	assert.NoError(t, err, "Failed to enroll 'admin' after the restore")
+	_, err = TestGetRootClient().Enroll(&api.EnrollmentRequest{Name: "user1", Secret: "user1pw"})
+	util.ErrorContains(t, err, "Authentication failure", "The restored 'user1' should still be revoked")
+	err = srv.Shutdown()
+	util.FatalError(t, err, "Failed to shut down server")
+}
+
+func TestRestoreMerge(t *testing.T) {
+	defer func() {
+		os.RemoveAll(rootDir)
+		os.RemoveAll(restoreDir)
+	}()
+	registerUser := func(home, name string) {
+		srv := TestGetServer2(false, rootPort, home, "", -1, t)
+		err := srv.init(false)
+		util.FatalError(t, err, "Failed to initialize server")
+		defer srv.closeDB()
+		err = srv.CA.registry.InsertUser(&spi.UserInfo{Name: name, Pass: "pw", Type: "client", Affiliation: "org1"})
+		util.FatalError(t, err, "Failed to insert identity")
+	}
+	os.RemoveAll(rootDir)
+	os.RemoveAll(restoreDir)
+	registerUser(rootDir, "fromarchive")
+	registerUser(restoreDir, "existing")
+
+	var archive bytes.Buffer
+	srv := TestGetServer2(false, rootPort, rootDir, "", -1, t)
+	err := srv.Backup("", &archive, false)
+	util.FatalError(t, err, "Failed to back up the database")
+
+	srv = TestGetServer2(false, rootPort, restoreDir, "", -1, t)
+	err = srv.Restore("", bytes.NewReader(archive.Bytes()), true)
+	util.FatalError(t, err, "Failed to merge the backup archive")
+	srv = TestGetServer2(false, rootPort, restoreDir, "", -1, t)
+	err = srv.init(false)
+	util.FatalError(t, err, "Failed to initialize server")
+	defer srv.closeDB()
+	_, err = srv.CA.registry.GetUser("existing", nil)
+	assert.NoError(t, err, "Merging should keep the existing identities")
+	_, err = srv.CA.registry.GetUser("fromarchive", nil)
+	assert.NoError(t, err, "Merging should add the identities of the archive")
+}
+
+func TestRestoreInvalidArchive(t *testing.T) {
+	defer os.RemoveAll(rootDir)
+	var archive bytes.Buffer
+	srv := TestGetRootServer(t)
+	err := srv.Backup("", &archive, false)
+	util.FatalError(t, err, "Failed to back up the database")
+	lines := strings.Split(strings.TrimSpace(archive.String()), "\n")
+
+	restore := func(data string) error {
+		srv := TestGetServer2(false, rootPort, rootDir, "", -1, t)
+		return srv.Restore("", strings.NewReader(data), false)
+	}
+	err = restore("not an archive")
+	util.ErrorContains(t, err, "not a fabric-ca backup archive", "Restoring a file which is not an archive should fail")
+	err = restore(strings.Replace(archive.String(), `"version":1`, `"version":99`, 1))
+	util.ErrorContains(t, err, "Unsupported backup archive version 99", "Restoring an archive of an unknown version should fail")
+	err = restore(strings.Join(lines[:len(lines)-1], "\n"))
+	util.ErrorContains(t, err, "truncated", "Restoring a truncated archive should fail")
+
+	// A failed restore leaves the database unchanged
+	var after bytes.Buffer
+	srv = TestGetServer2(false, rootPort, rootDir, "", -1, t)
+	err = srv.Backup("", &after, false)
+	util.FatalError(t, err, "Failed to back up the database")
+	assert.Equal(t, backupRecords(t, archive.Bytes()), backupRecords(t, after.Bytes()))
+}
+
+// backupRecords returns the sorted records of a backup archive, without
+// its header and trailer
+func backupRecords(t *testing.T, archive []byte) []string {
+	if len(archive) > 2 && archive[0] == 0x1f && archive[1] == 0x8b {
+		zr, err := gzip.NewReader(bytes.NewReader(archive))
+		util.FatalError(t, err, "Failed to decompress backup archive")
+		archive, err = ioutil.ReadAll(zr)
+		util.FatalError(t, err, "Failed to decompress backup archive")
+	}
+	lines := strings.Split(strings.TrimSpace(string(archive)), "\n")
+	if !assert.True(t, len(lines) >= 2, "The backup archive should have a header and a trailer") {
+		return nil
+	}
+	var hdr backupHeader
+	err := json.Unmarshal([]byte(lines[0]), &hdr)
+	util.FatalError(t, err, "Failed to parse the header of the backup archive")
+	assert.Equal(t, backupFormat, hdr.Format)
+	records := lines[1 : len(lines)-1]
+	sort.Strings(records)
+	return records
+}
@@ -0,0 +1,277 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/pkg/errors"
+)
+
+// The default maximum size of a request body
+const defaultMaxBodySize = 10 << 20
+
+// The default maximum time to read a request body
+const defaultBodyReadTimeout = 30 * time.Second
+
+// The names of the metrics of the limits of request bodies
+const (
+	metricBodyTooLarge    = "fabric_ca_requests_body_too_large_total"
+	metricBodyReadTimeout = "fabric_ca_requests_body_timeout_total"
+)
+
+// bodyBufferClasses are the capacities of the pooled buffers of request
+// bodies, smallest first. A body which does not fit in the largest is read
+// into a buffer which is not pooled.
+var bodyBufferClasses = []int{4 << 10, 64 << 10, 1 << 20}
+
+// bodyBufferPools are the pools of the buffers of each class
+var bodyBufferPools = func() []*sync.Pool {
+	pools := make([]*sync.Pool, len(bodyBufferClasses))
+	for i := range bodyBufferClasses {
+		size := bodyBufferClasses[i]
+		class := i
+		pools[i] = &sync.Pool{New: func() interface{} {
+			return &bodyBuffer{buf: make([]byte, 0, size), class: class}
+		}}
+	}
+	return pools
+}()
+
+// bodyBuffer is the buffer into which a request body is read, which is
+// returned to its pool once the request is handled
+type bodyBuffer struct {
+	buf []byte
+	// The index of the pool of the buffer, or -1 if it is not pooled
+	class int
+}
+
+// getBodyBuffer returns an empty buffer with a capacity of at least 'size'
+func getBodyBuffer(size int) *bodyBuffer {
+	for i, c := range bodyBufferClasses {
+		if size <= c {
+			b := bodyBufferPools[i].Get().(*bodyBuffer)
+			b.buf = b.buf[:0]
+			return b
+		}
+	}
+	return &bodyBuffer{buf: make([]byte, 0, size), class: -1}
+}
+
+// release returns the buffer to its pool; it may not be used afterwards
+func (b *bodyBuffer) release() {
+	if b.class >= 0 {
+		b.buf = b.buf[:0]
+		bodyBufferPools[b.class].Put(b)
+	}
+}
+
+// grow returns a buffer with the content of 'b' and a larger capacity, of
+// at most 'max' beyond the largest class, and releases 'b'
+func (b *bodyBuffer) grow(max int) *bodyBuffer {
+	size := 2 * cap(b.buf)
+	if size > max && max > cap(b.buf) {
+		size = max
+	}
+	nb := getBodyBuffer(size)
+	nb.buf = append(nb.buf, b.buf...)
+	b.release()
+	return nb
+}
+
+// readBody reads the request body 'r', whose length is 'size' or -1 if it
+// is not known, into a pooled buffer. It fails with an errBodyTooLarge,
+// without allocating a buffer if 'size' is known, if the body is larger
+// than 'limit'. An empty body is not read into a buffer.
+func readBody(r io.Reader, size, limit int64) (*bodyBuffer, error) {
+	if size > limit {
+		return nil, &errBodyTooLarge{limit: limit}
+	}
+	if size == 0 {
+		return &bodyBuffer{class: -1}, nil
+	}
+	// One byte more than the length of the body lets the read of its end
+	// complete without growing the buffer
+	initial := bodyBufferClasses[0]
+	if size > 0 {
+		initial = int(size) + 1
+	}
+	b := getBodyBuffer(initial)
+	for {
+		if len(b.buf) == cap(b.buf) {
+			b = b.grow(int(limit) + 1)
+		}
+		// No more than one byte beyond the limit is read
+		end := cap(b.buf)
+		if int64(end) > limit+1 {
+			end = int(limit) + 1
+		}
+		n, err := r.Read(b.buf[len(b.buf):end])
+		b.buf = b.buf[:len(b.buf)+n]
+		if int64(len(b.buf)) > limit {
+			b.release()
+			return nil, &errBodyTooLarge{limit: limit}
+		}
+		if err == io.EOF {
+			return b, nil
+		}
+		if err != nil {
+			b.release()
+			return nil, err
+		}
+	}
+}
+
+// maxBodySize returns the maximum size of a request body
+func (s *Server) maxBodySize() int64 {
+	if s == nil || s.Config == nil || s.Config.HTTP.MaxBodySize <= 0 {
+		return defaultMaxBodySize
+	}
+	return int64(s.Config.HTTP.MaxBodySize)
+}
+
+// initBodyLimits validates the configured maximum body sizes of the endpoints
+func (s *Server) initBodyLimits() error {
+	s.bodyLimits = map[string]int64{}
+	for path, size := range s.Config.HTTP.MaxBodySizes {
+		path = strings.Trim(path, "/")
+		if size <= 0 {
+			return errors.Errorf("Invalid maximum body size for '%s': must be greater than 0", path)
+		}
+		s.bodyLimits[path] = int64(size)
+		log.Debugf("Maximum body size of '%s': %d", path, size)
+	}
+	if s.Config.HTTP.BodyReadTimeout < 0 {
+		return errors.New("Invalid body read timeout: must not be negative")
+	}
+	return nil
+}
+
+// endpointMaxBodySize returns the maximum size of the body of a request to
+// the endpoint registered at 'path'
+func (s *Server) endpointMaxBodySize(path string) int64 {
+	if size, ok := s.bodyLimits[path]; ok {
+		return size
+	}
+	return s.maxBodySize()
+}
+
+// bodyReadTimeout returns the maximum time to read a request body
+func (s *Server) bodyReadTimeout() time.Duration {
+	if s.Config == nil || s.Config.HTTP.BodyReadTimeout <= 0 {
+		return defaultBodyReadTimeout
+	}
+	return s.Config.HTTP.BodyReadTimeout
+}
+
+// errBodyReadTimeout is the error of reading a request body which is not
+// received within the body read timeout
+type errBodyReadTimeout struct {
+	timeout time.Duration
+}
+
+func (e *errBodyReadTimeout) Error() string {
+	return "the request body was not received within " + e.timeout.String()
+}
+
+// limitBody applies the maximum body size of the endpoint registered at
+// 'path' and the body read timeout to the requests to 'next'. A request whose
+// Content-Length is larger than the maximum is rejected before its body is
+// read. Otherwise, reading its body fails once more than the maximum is read
+// or once the timeout expires, so that a client can neither send an unbounded
+// body nor hold a request open by sending its body at a trickle. A client
+// which sends nothing at all is cut off by the read timeout of the server.
+func (s *Server) limitBody(path string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := s.endpointMaxBodySize(path)
+		info := getRequestInfo(r)
+		if info != nil {
+			info.maxBodySize = limit
+		}
+		if r.ContentLength > limit {
+			s.metricWith(metricBodyTooLarge, path).Add(1)
+			he := caerrors.CreateHTTPErr(http.StatusRequestEntityTooLarge, caerrors.ErrReqBodyTooLarge,
+				"Request body too large: %s", &errBodyTooLarge{limit: limit})
+			if info != nil {
+				info.code = he.GetLocalCode()
+				info.msg = he.GetLocalMsg()
+			}
+			// The body is not read, so the connection can't be used for
+			// another request
+			w.Header().Set("Connection", "close")
+			s.writeError(w, he)
+			return
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			// Until the body is received in full, the response closes the
+			// connection, so that the server does not read the rest of the
+			// body at the pace of the client to reuse it
+			w.Header().Set("Connection", "close")
+			timeout := s.bodyReadTimeout()
+			r.Body = &limitedRequestBody{
+				body:     http.MaxBytesReader(w, r.Body, limit),
+				w:        w,
+				limit:    limit,
+				timeout:  timeout,
+				deadline: time.Now().Add(timeout),
+				server:   s,
+				path:     path,
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitedRequestBody is a request body which fails with an errBodyTooLarge
+// once more than 'limit' bytes are read, or with an errBodyReadTimeout if it
+// is still being read after 'deadline'. Once it fails, it keeps failing.
+type limitedRequestBody struct {
+	body     io.ReadCloser
+	w        http.ResponseWriter
+	limit    int64
+	read     int64
+	timeout  time.Duration
+	deadline time.Time
+	err      error
+	// The server and the endpoint whose metrics count the failures
+	server *Server
+	path   string
+}
+
+func (b *limitedRequestBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.body.Read(p)
+	b.read += int64(n)
+	switch {
+	case err == io.EOF:
+		b.w.Header().Del("Connection")
+		return n, err
+	case err != nil && b.read >= b.limit:
+		// http.MaxBytesReader fails once the limit is reached and more
+		// of the body remains
+		b.err = &errBodyTooLarge{limit: b.limit}
+		b.server.metricWith(metricBodyTooLarge, b.path).Add(1)
+	case time.Now().After(b.deadline):
+		b.err = &errBodyReadTimeout{timeout: b.timeout}
+		b.server.metricWith(metricBodyReadTimeout, b.path).Add(1)
+	default:
+		return n, err
+	}
+	return n, b.err
+}
+
+func (b *limitedRequestBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,350 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/lib/metrics"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingReader counts the bytes read from a reader
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestReadBody(t *testing.T) {
+	for _, size := range []int{1, 100, 4095, 4096, 4097, 70000, 1 << 20, 3<<20 + 17} {
+		body := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+		// Whether or not the length is known, and however the body is
+		// split into reads, the whole body is read
+		for _, length := range []int64{int64(size), -1} {
+			b, err := readBody(iotest.OneByteReader(bytes.NewReader(body)), length, defaultMaxBodySize)
+			if assert.NoError(t, err, "Failed to read a body of %d bytes", size) {
+				assert.True(t, bytes.Equal(body, b.buf), "The body of %d bytes is not read intact", size)
+				b.release()
+			}
+			b, err = readBody(bytes.NewReader(body), length, defaultMaxBodySize)
+			if assert.NoError(t, err, "Failed to read a body of %d bytes", size) {
+				assert.True(t, bytes.Equal(body, b.buf), "The body of %d bytes is not read intact", size)
+				b.release()
+			}
+		}
+	}
+
+	b, err := readBody(http.NoBody, 0, defaultMaxBodySize)
+	assert.NoError(t, err)
+	assert.Empty(t, b.buf)
+
+	// A body whose length exceeds the limit is not read at all
+	r := &countingReader{r: bytes.NewReader(make([]byte, 101))}
+	_, err = readBody(r, 101, 100)
+	if assert.IsType(t, &errBodyTooLarge{}, err) {
+		assert.Equal(t, "the request body is larger than 100 bytes", err.Error())
+	}
+	assert.Equal(t, 0, r.n, "A body whose length exceeds the limit should not be read")
+	// A body of unknown length is read up to one byte beyond the limit
+	r = &countingReader{r: bytes.NewReader(make([]byte, 10000))}
+	_, err = readBody(r, -1, 5000)
+	assert.IsType(t, &errBodyTooLarge{}, err)
+	assert.True(t, r.n <= 5001, "%d bytes of a body larger than the limit were read", r.n)
+	b, err = readBody(bytes.NewReader(make([]byte, 5000)), -1, 5000)
+	if assert.NoError(t, err, "A body of the maximum size should be read") {
+		assert.Len(t, b.buf, 5000)
+		b.release()
+	}
+
+	// A failure to read the body is returned
+	_, err = readBody(iotest.TimeoutReader(bytes.NewReader(make([]byte, 10000))), -1, defaultMaxBodySize)
+	assert.Equal(t, iotest.ErrTimeout, err)
+}
+
+func TestReadBodyBytes(t *testing.T) {
+	srv := &Server{Config: &ServerConfig{}}
+	srv.Config.HTTP.MaxBodySize = 1000
+	se := &serverEndpoint{Server: srv}
+
+	body := strings.Repeat("a", 1000)
+	ctx := newServerRequestContext(httptest.NewRequest("POST", "/api/v1/enroll", strings.NewReader(body)), nil, se)
+	buf, err := ctx.ReadBodyBytes()
+	assert.NoError(t, err)
+	assert.Equal(t, body, string(buf))
+	// The body is read once
+	buf, err = ctx.ReadBodyBytes()
+	assert.NoError(t, err)
+	assert.Equal(t, body, string(buf))
+	ctx.releaseBody()
+	assert.Nil(t, ctx.body.buf, "The body should not be used once its buffer is released")
+
+	ctx = newServerRequestContext(httptest.NewRequest("POST", "/api/v1/enroll", strings.NewReader(body+"a")), nil, se)
+	_, err = ctx.ReadBodyBytes()
+	if assert.Error(t, err) {
+		he := getHTTPErr(err)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, he.GetStatusCode())
+		assert.Equal(t, caerrors.ErrReqBodyTooLarge, he.GetLocalCode())
+	}
+	ctx.releaseBody()
+}
+
+// TestServerBodyLimit checks that the server rejects a request whose body
+// is larger than http.maxbodysize
+func TestServerBodyLimit(t *testing.T) {
+	srv := TestGetRootServer(t)
+	srv.Config.HTTP.MaxBodySize = 4096
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		cleanTestSlateSE(t)
+	}()
+	client := getTestClient(rootPort)
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll with a body smaller than the limit")
+
+	req := &api.EnrollmentRequestNet{}
+	req.Request = strings.Repeat("a", 4096)
+	body, err := json.Marshal(req)
+	util.FatalError(t, err, "Failed to marshal request")
+	post, err := client.newPost("enroll", body)
+	util.FatalError(t, err, "Failed to create request")
+	post.SetBasicAuth("admin", "adminpw")
+	// The connection is not kept alive for the tests which follow
+	post.Close = true
+	resp, err := http.DefaultClient.Do(post)
+	util.FatalError(t, err, "Failed to send request")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(respBody), "the request body is larger than 4096 bytes")
+	assert.Equal(t, float64(1), srv.metrics.Get(metricBodyTooLarge).With("enroll").Value())
+}
+
+// bodyLimitedServer returns a server whose endpoints "small" and "large" have
+// maximum body sizes of 10 and 100 bytes, and which read their request bodies
+func bodyLimitedServer(t *testing.T) (*Server, map[string]http.Handler, *int) {
+	s := &Server{Config: &ServerConfig{}, metrics: metrics.NewRegistry()}
+	s.Config.HTTP.MaxBodySize = 10
+	s.Config.HTTP.MaxBodySizes = map[string]int{"/large/": 100}
+	newRequestMetrics(s.metrics)
+	err := s.initBodyLimits()
+	util.FatalError(t, err, "Failed to initialize body limits")
+	handled := 0
+	handlers := map[string]http.Handler{}
+	for _, path := range []string{"small", "large"} {
+		handlers[path] = s.wrapEndpoint(path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handled++
+			ctx := newServerRequestContext(r, w, &serverEndpoint{Server: s})
+			defer ctx.releaseBody()
+			_, err := ctx.ReadBodyBytes()
+			if err != nil {
+				s.writeError(w, getHTTPErr(err))
+				return
+			}
+			w.Write([]byte("ok"))
+		}))
+	}
+	return s, handlers, &handled
+}
+
+func TestLimitBody(t *testing.T) {
+	s, handlers, handled := bodyLimitedServer(t)
+	send := func(path string, size int, lengthKnown bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/"+path, strings.NewReader(strings.Repeat("a", size)))
+		if !lengthKnown {
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		handlers[path].ServeHTTP(w, req)
+		return w
+	}
+
+	for _, lengthKnown := range []bool{true, false} {
+		assert.Equal(t, http.StatusOK, send("small", 10, lengthKnown).Code, "A body of the maximum size should be accepted")
+		assert.Equal(t, http.StatusOK, send("large", 100, lengthKnown).Code, "The maximum of the endpoint should override that of the server")
+		assert.Equal(t, http.StatusRequestEntityTooLarge, send("large", 101, lengthKnown).Code)
+	}
+	w := send("small", 10, true)
+	assert.Empty(t, w.Header().Get("Connection"), "The connection of a request whose body is read should be kept alive")
+	*handled = 0
+	w = send("small", 11, true)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, 0, *handled, "A body whose length is too large should be rejected before it is read")
+	assert.Equal(t, "close", w.Header().Get("Connection"))
+	w = send("small", 11, false)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, 1, *handled, "A body whose length is not known should be rejected once it is read")
+	assert.Contains(t, w.Body.String(), "the request body is larger than 10 bytes")
+
+	assert.Equal(t, float64(2), s.metrics.Get(metricBodyTooLarge).With("small").Value())
+	assert.Equal(t, float64(2), s.metrics.Get(metricBodyTooLarge).With("large").Value())
+	assert.Equal(t, float64(2), s.metrics.Get(metricRequests).With("POST", "small", "413").Value())
+
+	s.Config.HTTP.MaxBodySizes = map[string]int{"enroll": 0}
+	err := s.initBodyLimits()
+	util.ErrorContains(t, err, "Invalid maximum body size for 'enroll'", "A maximum body size of 0 should fail")
+}
+
+// slowReader returns one byte of 'body' at a time, after 'delay'
+type slowReader struct {
+	body  []byte
+	delay time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(r.body) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	p[0] = r.body[0]
+	r.body = r.body[1:]
+	return 1, nil
+}
+
+func TestLimitBodyReadTimeout(t *testing.T) {
+	s, handlers, _ := bodyLimitedServer(t)
+	s.Config.HTTP.BodyReadTimeout = 100 * time.Millisecond
+
+	req := httptest.NewRequest("POST", "/api/v1/large", &slowReader{body: bytes.Repeat([]byte("a"), 50), delay: 10 * time.Millisecond})
+	req.ContentLength = 50
+	w := httptest.NewRecorder()
+	start := time.Now()
+	handlers["large"].ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestTimeout, w.Code, "A body which is sent slowly should be cut off")
+	assert.True(t, time.Since(start) < 400*time.Millisecond, "The body should be cut off once the timeout expires")
+	assert.Equal(t, "close", w.Header().Get("Connection"))
+	assert.Contains(t, w.Body.String(), "the request body was not received within 100ms")
+	assert.Equal(t, float64(1), s.metrics.Get(metricBodyReadTimeout).With("large").Value())
+
+	// A body which is sent in time is read
+	req = httptest.NewRequest("POST", "/api/v1/large", &slowReader{body: []byte("abc"), delay: 10 * time.Millisecond})
+	w = httptest.NewRecorder()
+	handlers["large"].ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+// TestServerSlowBody checks that the server cuts off a client which sends the
+// body of its request at a trickle
+func TestServerSlowBody(t *testing.T) {
+	srv := TestGetRootServer(t)
+	srv.Config.HTTP.BodyReadTimeout = 500 * time.Millisecond
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		cleanTestSlateSE(t)
+	}()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", rootPort))
+	util.FatalError(t, err, "Failed to connect to the server")
+	defer conn.Close()
+	// Sending the body a byte every 100ms would take 20s
+	body := strings.Repeat("a", 200)
+	auth := base64.StdEncoding.EncodeToString([]byte("admin:adminpw"))
+	_, err = fmt.Fprintf(conn, "POST /api/v1/enroll HTTP/1.1\r\nHost: localhost\r\nAuthorization: Basic %s\r\n"+
+		"Content-Type: application/json\r\nContent-Length: %d\r\n\r\n", auth, len(body))
+	util.FatalError(t, err, "Failed to send the request headers")
+	go func() {
+		for i := range body {
+			if _, err := conn.Write([]byte{body[i]}); err != nil {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(10 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	util.FatalError(t, err, "Failed to read the response")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+	assert.True(t, time.Since(start) < 5*time.Second, "The client should be cut off once the body read timeout expires")
+	assert.Equal(t, float64(1), srv.metrics.Get(metricBodyReadTimeout).With("enroll").Value())
+}
+
+// benchmarkEnrollBody is the body of a simulated enroll request, whose
+// CSR is the size of that of a P-256 key
+var benchmarkEnrollBody = func() []byte {
+	req := &api.EnrollmentRequestNet{}
+	req.Request = "-----BEGIN CERTIFICATE REQUEST-----\n" + strings.Repeat("MIIBSzCB8gIBADBjMQswCQYDVQQGEwJVUzEXMBUGA1UECBMOTm9ydGggQ2Fyb2xp\n", 7) + "-----END CERTIFICATE REQUEST-----\n"
+	req.Profile = "tls"
+	req.Hosts = []string{"peer1.org1.example.com"}
+	body, _ := json.Marshal(req)
+	return body
+}()
+
+// BenchmarkReadBodyReadAll reads the body of a simulated enroll request as
+// the server did before its body buffers were pooled
+func BenchmarkReadBodyReadAll(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkEnrollBody)))
+	for i := 0; i < b.N; i++ {
+		r := bytes.NewReader(benchmarkEnrollBody)
+		buf, err := ioutil.ReadAll(r)
+		if err != nil || len(buf) != len(benchmarkEnrollBody) {
+			b.Fatalf("Failed to read the body: %v", err)
+		}
+	}
+}
+
+// BenchmarkReadBodyPooled reads the body of a simulated enroll request into
+// a pooled buffer, which is released once the request is handled
+func BenchmarkReadBodyPooled(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkEnrollBody)))
+	size := int64(len(benchmarkEnrollBody))
+	for i := 0; i < b.N; i++ {
+		r := bytes.NewReader(benchmarkEnrollBody)
+		buf, err := readBody(r, size, defaultMaxBodySize)
+		if err != nil || len(buf.buf) != len(benchmarkEnrollBody) {
+			b.Fatalf("Failed to read the body: %v", err)
+		}
+		buf.release()
+	}
+}
+
+// BenchmarkReadBodyBytes reads the body of a simulated enroll request as the
+// token authentication of the server does
+func BenchmarkReadBodyBytes(b *testing.B) {
+	se := &serverEndpoint{Server: &Server{Config: &ServerConfig{}}}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkEnrollBody)))
+	for i := 0; i < b.N; i++ {
+		r := bytes.NewReader(benchmarkEnrollBody)
+		req := &http.Request{Method: "POST", Body: ioutil.NopCloser(r), ContentLength: int64(len(benchmarkEnrollBody))}
+		ctx := newServerRequestContext(req, nil, se)
+		_, err := ctx.ReadBodyBytes()
+		if err != nil {
+			b.Fatalf("Failed to read the body: %v", err)
+		}
+		ctx.releaseBody()
+	}
+}
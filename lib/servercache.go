@@ -0,0 +1,154 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultCacheMaxAge is the time for which clients may cache the CA
+// information and the published CRL if it is not configured
+const defaultCacheMaxAge = time.Minute
+
+// gzipETagSuffix is appended to the ETag of a response which is compressed
+// with gzip, since a strong ETag identifies the bytes of the response
+const gzipETagSuffix = "-gzip"
+
+// publishedCRLETag is the ETag of the published CRL file, which is only
+// computed again when the file is replaced
+type publishedCRLETag struct {
+	fi   os.FileInfo
+	etag string
+}
+
+// cacheMaxAge returns the time for which clients may cache the responses of
+// the cacheable endpoints
+func (s *Server) cacheMaxAge() time.Duration {
+	if s == nil || s.Config == nil || s.Config.HTTP.CacheMaxAge <= 0 {
+		return defaultCacheMaxAge
+	}
+	return s.Config.HTTP.CacheMaxAge
+}
+
+// setCacheControl allows any cache to keep the response of the request for
+// the configured max-age
+func (ctx *serverRequestContextImpl) setCacheControl() {
+	maxAge := int64(ctx.endpoint.Server.cacheMaxAge() / time.Second)
+	ctx.resp.Header().Set("Cache-Control", "public, max-age="+strconv.FormatInt(maxAge, 10))
+}
+
+// notModified sets the ETag of the response to 'etag' and, if the request's
+// If-None-Match header matches it, writes a 304 response and returns true
+func (ctx *serverRequestContextImpl) notModified(etag string) bool {
+	ctx.resp.Header().Set("ETag", etag)
+	if !etagMatches(ctx.req.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	hrw := ctx.resp.(*httpResponseWriter)
+	hrw.encoded = true
+	hrw.writeHeaderCalled = true
+	hrw.w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches returns true if the If-None-Match header 'header' matches
+// 'etag', comparing them weakly as RFC 7232 specifies for this header
+func etagMatches(header, etag string) bool {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return false
+	}
+	if header == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// stripGzipETags removes the suffix which the server appends to the ETags
+// of compressed responses from the ETags of the conditional headers of 'r',
+// so that a client's copy of a compressed response matches the ETag of the
+// uncompressed one. It returns true if it removed any.
+func stripGzipETags(r *http.Request) bool {
+	stripped := false
+	for _, name := range []string{"If-None-Match", "If-Range"} {
+		if value := r.Header.Get(name); strings.Contains(value, gzipETagSuffix+`"`) {
+			r.Header.Set(name, strings.Replace(value, gzipETagSuffix+`"`, `"`, -1))
+			stripped = true
+		}
+	}
+	return stripped
+}
+
+// strongETag returns the strong ETag of a response with the parts 'parts'
+func strongETag(parts ...[]byte) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write([]byte(strconv.Itoa(len(part))))
+		h.Write([]byte{':'})
+		h.Write(part)
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// resultETag returns the strong ETag of the response with the result
+// 'result' in the encoding which the request of 'ctx' accepts
+func (ctx *serverRequestContextImpl) resultETag(result interface{}) (string, error) {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to marshal result")
+	}
+	return strongETag([]byte(ctx.responseMediaType()), body), nil
+}
+
+// responseMediaType returns the media type of the response to the request,
+// which is that of the encoding which the request accepts
+func (ctx *serverRequestContextImpl) responseMediaType() string {
+	if enc := ctx.endpoint.negotiateEncoding(ctx.req); enc != nil {
+		return enc.mediaType
+	}
+	return mediaTypeJSON
+}
+
+// publishedCRLETag returns the strong ETag of the published CRL file 'f',
+// whose information is 'fi'. It is computed once for each published file.
+func (ca *CA) publishedCRLETag(f *os.File, fi os.FileInfo) (string, error) {
+	ca.mutex.Lock()
+	cached := ca.crlETag
+	ca.mutex.Unlock()
+	if cached != nil && os.SameFile(cached.fi, fi) && cached.fi.ModTime().Equal(fi.ModTime()) && cached.fi.Size() == fi.Size() {
+		return cached.etag, nil
+	}
+	h := sha256.New()
+	_, err := io.Copy(h, f)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to read the published CRL")
+	}
+	etag := `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+	ca.mutex.Lock()
+	ca.crlETag = &publishedCRLETag{fi: fi, etag: etag}
+	ca.mutex.Unlock()
+	return etag, nil
+}
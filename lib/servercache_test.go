@@ -0,0 +1,141 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCAInfoETag(t *testing.T) {
+	srv := TestGetRootServer(t)
+	srv.Config.HTTP.CacheMaxAge = 5 * time.Minute
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+
+	get := func(headers map[string]string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/api/v1/cainfo", rootPort), nil)
+		util.FatalError(t, err, "Failed to create request")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		util.FatalError(t, err, "Failed to get the CA information")
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		util.FatalError(t, err, "Failed to read the CA information")
+		return resp, body
+	}
+
+	resp, first := get(nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "public, max-age=300", resp.Header.Get("Cache-Control"))
+	etag := resp.Header.Get("ETag")
+	if assert.NotEmpty(t, etag) {
+		assert.NotContains(t, etag, "W/", "The ETag of the CA information should be strong")
+	}
+	resp, again := get(nil)
+	assert.Equal(t, etag, resp.Header.Get("ETag"), "The ETag of unchanged CA information should not change")
+	assert.Equal(t, first, again)
+
+	// The CA information is not returned again if it is unchanged
+	resp, body := get(map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	assert.Empty(t, body)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+	resp, _ = get(map[string]string{"If-None-Match": `"other", ` + etag})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode, "Any ETag of the list may match")
+	resp, body = get(map[string]string{"If-None-Match": `"other"`})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, first, body)
+
+	// Each encoding of the CA chain has its own ETag
+	resp, _ = get(map[string]string{"Accept": mediaTypePEM})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	pemETag := resp.Header.Get("ETag")
+	assert.NotEqual(t, etag, pemETag)
+	resp, _ = get(map[string]string{"Accept": mediaTypePEM, "If-None-Match": etag})
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "The ETag of the JSON response should not match the PEM one")
+	resp, _ = get(map[string]string{"Accept": mediaTypePEM, "If-None-Match": pemETag})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	// The client reports unchanged CA information
+	client := TestGetRootClient()
+	si, err := client.GetCAInfo(&api.GetCAInfoRequest{})
+	util.FatalError(t, err, "Failed to get the CA information")
+	assert.False(t, si.NotModified)
+	assert.NotEmpty(t, si.CAChain)
+	si, err = client.GetCAInfo(&api.GetCAInfoRequest{ETag: si.ETag})
+	util.FatalError(t, err, "Failed to get the CA information")
+	assert.True(t, si.NotModified, "The CA information should be unchanged")
+	assert.Empty(t, si.CAChain)
+}
+
+func TestGenCRLETag(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	client := TestGetRootClient()
+	eresp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin'")
+	admin := eresp.Identity
+	revoke := func(name string) {
+		rresp, err := admin.Register(&api.RegistrationRequest{Name: name, Affiliation: "org1"})
+		util.FatalError(t, err, "Failed to register "+name)
+		_, err = client.Enroll(&api.EnrollmentRequest{Name: name, Secret: rresp.Secret})
+		util.FatalError(t, err, "Failed to enroll "+name)
+		_, err = admin.Revoke(&api.RevocationRequest{Name: name})
+		util.FatalError(t, err, "Failed to revoke "+name)
+	}
+	revoke("etaguser1")
+
+	first, err := admin.GenCRL(&api.GenCRLRequest{})
+	util.FatalError(t, err, "Failed to generate CRL")
+	assert.False(t, first.NotModified)
+	assert.NotEmpty(t, first.CRL)
+	assert.NotEmpty(t, first.ETag)
+
+	// A CRL of the same revoked certificates is not returned again
+	resp, err := admin.GenCRL(&api.GenCRLRequest{ETag: first.ETag})
+	util.FatalError(t, err, "Failed to generate CRL")
+	assert.True(t, resp.NotModified, "The CRL of the same revoked certificates should not be returned")
+	assert.Empty(t, resp.CRL)
+	assert.Equal(t, first.ETag, resp.ETag)
+
+	// A revocation changes the ETag of the CRL
+	revoke("etaguser2")
+	resp, err = admin.GenCRL(&api.GenCRLRequest{ETag: first.ETag})
+	util.FatalError(t, err, "Failed to generate CRL")
+	assert.False(t, resp.NotModified, "The CRL should be returned once another certificate is revoked")
+	assert.NotEqual(t, first.ETag, resp.ETag)
+	assert.False(t, bytes.Equal(first.CRL, resp.CRL))
+
+	// A CRL of other revoked certificates has another ETag
+	filtered, err := admin.GenCRL(&api.GenCRLRequest{RevokedAfter: time.Now().Add(time.Hour), ETag: resp.ETag})
+	util.FatalError(t, err, "Failed to generate CRL")
+	assert.False(t, filtered.NotModified)
+	assert.NotEqual(t, resp.ETag, filtered.ETag)
+}
@@ -10,8 +10,10 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/api"
 	"github.com/hyperledger/fabric-ca/lib/caerrors"
 	"github.com/hyperledger/fabric-ca/lib/server"
 	"github.com/hyperledger/fabric-ca/util"
@@ -20,6 +22,12 @@ import (
 
 type certPEM struct {
 	PEM string `db:"pem"`
+	// The columns by which a page of certificates is sorted
+	ID        string    `db:"id" json:"-"`
+	Serial    string    `db:"serial_number" json:"-"`
+	AKI       string    `db:"authority_key_identifier" json:"-"`
+	Expiry    time.Time `db:"expiry" json:"-"`
+	RevokedAt time.Time `db:"revoked_at" json:"-"`
 }
 
 func newCertificateEndpoint(s *Server) *serverEndpoint {
@@ -28,6 +36,23 @@ func newCertificateEndpoint(s *Server) *serverEndpoint {
 		Handler:   certificatesHandler,
 		Server:    s,
 		successRC: 200,
+		auth:      authToken,
+		encodings: certificateExportEncodings,
+		docs: map[string]operationDoc{
+			"GET": {summary: "Get the certificates which the invoker may see", response: &api.CertificateResponse{},
+				query: listQueryDocs(certificateListSpec, map[string]string{
+					"id":            "Get only the certificates of this enrollment ID",
+					"aki":           "Get only the certificates with this authority key identifier",
+					"serial":        "Get only the certificate with this serial number",
+					"notrevoked":    "Do not get revoked certificates",
+					"notexpired":    "Do not get expired certificates",
+					"revoked_start": "Get only the certificates revoked at or after this time",
+					"revoked_end":   "Get only the certificates revoked at or before this time",
+					"expired_start": "Get only the certificates which expire at or after this time",
+					"expired_end":   "Get only the certificates which expire at or before this time",
+				})},
+			"DELETE": {summary: "Not implemented"},
+		},
 	}
 }
 
@@ -95,11 +120,30 @@ func processGetCertificateRequest(ctx ServerRequestContext) error {
 	log.Debug("Processing GET certificate request")
 	var err error
 
+	params, err := parseListParams(ctx, certificateListSpec)
+	if err != nil {
+		return err
+	}
+
 	req, err := server.NewCertificateRequest(ctx)
 	if err != nil {
 		return caerrors.NewHTTPErr(400, caerrors.ErrGettingCert, "Invalid Request: %s", err)
 	}
 
+	// A request for a page of certificates gets the page in a list envelope
+	if params.Paged {
+		return getCertificatesPage(ctx, req, params)
+	}
+
+	// A request which accepts a PEM file gets the certificates as a bundle
+	// of PEM certificates
+	hrw, ok := ctx.GetResp().(*httpResponseWriter)
+	if ok {
+		if enc := hrw.se.negotiateEncoding(ctx.GetReq()); enc != nil {
+			return exportCertificates(ctx, req, hrw, enc)
+		}
+	}
+
 	// Execute DB query and stream response
 	err = getCertificates(ctx, req)
 	if err != nil {
@@ -109,6 +153,49 @@ func processGetCertificateRequest(ctx ServerRequestContext) error {
 	return nil
 }
 
+// getCertificatesPage executes the DB query and returns the page of the
+// certificates which 'params' selects
+func getCertificatesPage(ctx ServerRequestContext, req *server.CertificateRequestImpl, params *server.ListParams) error {
+	caller, err := ctx.GetCaller()
+	if err != nil {
+		return err
+	}
+	rows, err := ctx.GetCertificates(req, GetUserAffiliation(caller))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	pager := params.NewPager()
+	for rows.Next() {
+		var cert certPEM
+		err := rows.StructScan(&cert)
+		if err != nil {
+			return caerrors.NewHTTPErr(500, caerrors.ErrGettingCert, "Failed to get read row: %s", err)
+		}
+		pager.Add(&server.ListItem{
+			Keys: map[string]string{
+				"serial":     cert.Serial,
+				"id":         cert.ID,
+				"expiry":     listTimeKey(cert.Expiry),
+				"revoked_at": listTimeKey(cert.RevokedAt),
+			},
+			ID:    cert.Serial + ":" + cert.AKI,
+			Value: cert,
+		})
+	}
+	page, err := pager.Page()
+	if err != nil {
+		return caerrors.NewHTTPErr(500, caerrors.ErrGettingCert, "Failed to get page of certificates: %s", err)
+	}
+	resp, err := util.Marshal(page, "certificates page")
+	if err != nil {
+		return caerrors.NewHTTPErr(500, caerrors.ErrGettingCert, "Failed to marshal certificates page: %s", err)
+	}
+	ctx.GetResp().Write(resp)
+	return nil
+}
+
 // getCertificates executes the DB query and streams the results to client
 func getCertificates(ctx ServerRequestContext, req *server.CertificateRequestImpl) error {
 	w := ctx.GetResp()
@@ -170,3 +257,38 @@ func getCertificates(ctx ServerRequestContext, req *server.CertificateRequestImp
 
 	return nil
 }
+
+// exportCertificates executes the DB query and streams the PEM certificates
+// to the client in the encoding 'enc', flushing the response as it is written
+func exportCertificates(ctx ServerRequestContext, req *server.CertificateRequestImpl, hrw *httpResponseWriter, enc *resultEncoding) error {
+	caller, err := ctx.GetCaller()
+	if err != nil {
+		return err
+	}
+	rows, err := ctx.GetCertificates(req, GetUserAffiliation(caller))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := hrw.startEncoded(enc, -1)
+	if hrw.isHead() {
+		return nil
+	}
+	fw := &flushWriter{w: w, size: crlFlushSize}
+	count := 0
+	for rows.Next() {
+		var cert certPEM
+		err := rows.StructScan(&cert)
+		if err != nil {
+			return caerrors.NewHTTPErr(500, caerrors.ErrGettingCert, "Failed to get read row: %s", err)
+		}
+		_, err = fw.Write([]byte(cert.PEM))
+		if err != nil {
+			return caerrors.NewHTTPErr(500, caerrors.ErrGettingCert, "Failed to write certificate: %s", err)
+		}
+		count++
+	}
+	log.Debug("Number of certificates exported: ", count)
+	return nil
+}
@@ -16,7 +16,14 @@ limitations under the License.
 
 package lib
 
-import "github.com/hyperledger/fabric-ca/lib/tls"
+import (
+	"time"
+
+	"github.com/hyperledger/fabric-ca/lib/kafka"
+	"github.com/hyperledger/fabric-ca/lib/logging"
+	"github.com/hyperledger/fabric-ca/lib/tls"
+	"github.com/hyperledger/fabric-ca/lib/vault"
+)
 
 const (
 	// DefaultServerPort is the default listening port for the fabric-ca server
@@ -34,12 +41,18 @@ const (
 // "help" - the help message to display on the command line;
 // "skip" - to skip the field.
 type ServerConfig struct {
-	// Listening port for the server
-	Port int `def:"7054" opt:"p" help:"Listening port of fabric-ca-server"`
+	// Listening port for the server; if 0, a free port is chosen
+	Port int `def:"7054" opt:"p" help:"Listening port of fabric-ca-server; if 0, a free port is chosen"`
 	// Bind address for the server
 	Address string `def:"0.0.0.0" help:"Listening address of fabric-ca-server"`
+	// Additional listening addresses for the server
+	Listeners ListenersConfig
+	// Path prefix of the endpoints, for a server behind a reverse proxy
+	BasePath string `help:"Path prefix under which the endpoints are served, such as /ca when a reverse proxy forwards https://gw.example.com/ca/ to the server"`
 	// Enables debug logging
 	Debug bool `def:"false" opt:"d" help:"Enable debug level logging"`
+	// Format, level and output of log messages
+	Log logging.Config
 	// TLS for the server's listening endpoint
 	TLS tls.ServerTLSConfig
 	// Optional client config for an intermediate server which acts as a client
@@ -55,4 +68,218 @@ type ServerConfig struct {
 	CAcount int `def:"0" help:"Number of non-default CA instances"`
 	// Size limit of an acceptable CRL in bytes
 	CRLSizeLimit int `def:"512000" help:"Size limit of an acceptable CRL in bytes"`
+	// Maximum time to wait for in-flight requests to complete when shutting down
+	ShutdownTimeout time.Duration `def:"30s" help:"Maximum time to wait for in-flight requests to complete when shutting down"`
+	// The operations endpoints such as the liveness and readiness endpoints
+	Operations OperationsConfig
+	// The profiling and runtime debug endpoints
+	Profiling ProfilingConfig
+	// The listener of the endpoints which administer the server
+	Admin AdminConfig
+	// The listener of the gRPC service
+	GRPC GRPCConfig
+	// Timeouts and limits of the server's HTTP connections
+	HTTP HTTPConfig
+	// The versions of the REST API
+	API APIConfig
+	// Maximum numbers of requests handled at the same time, by endpoint
+	Concurrency map[string]ConcurrencyLimit `skip:"true"`
+	// The webhooks to which events such as the registration of identities
+	// and the issuance of certificates are sent
+	Events EventsConfig
+	// The origins from which browser-based clients may call the endpoints
+	CORS CORSConfig
+	// The Vault server from which the secrets referenced in the
+	// configuration as vault:<path>#<key> are read
+	Vault vault.Config
+}
+
+// OperationsConfig is the configuration of the operations endpoints
+type OperationsConfig struct {
+	// Address in host:port form of a separate listener for the operations
+	// endpoints; if empty, they are served on the server's listening port
+	ListenAddress string `help:"Listening address (host:port) of the operations endpoints; if not set, they are served on the server's port"`
+	// Interval at which the components reported by the readiness endpoint are checked
+	HealthCheckInterval time.Duration `def:"10s" help:"Interval at which the components reported by the readiness endpoint are checked"`
+}
+
+// ProfilingConfig is the configuration of the profiling and runtime debug
+// endpoints, which are only served to identities with the "hf.Admin" attribute
+type ProfilingConfig struct {
+	// Whether the profiling endpoints are served at all
+	Enabled bool `def:"false" help:"Serve the pprof, expvar and goroutine dump endpoints to identities with the hf.Admin attribute"`
+	// Whether the profiling endpoints are served on the operations listener,
+	// which must then listen on a loopback address, rather than on the server's port
+	Operations bool `def:"false" help:"Serve the profiling endpoints on operations.listenaddress, which must be a loopback address, rather than on the server's port"`
+}
+
+// AdminConfig is the configuration of the listener of the endpoints which
+// administer the server, such as those which reload its configuration or
+// change its log level. If it has a listening address, these endpoints are
+// only served on it and not on the server's port.
+type AdminConfig struct {
+	// Either host:port on a loopback address or unix://path for a Unix domain socket
+	ListenAddress string `help:"Listening address of the administration endpoints, either host:port on a loopback address or unix://path for a Unix domain socket; if not set, they are served on the server's port to identities with the hf.Admin attribute"`
+	// Shared secret which each request to the admin listener must have in its
+	// X-Fabric-CA-Admin-Secret header
+	Secret string `mask:"password" help:"Shared secret which requests to the admin listener must have in the X-Fabric-CA-Admin-Secret header; required unless the admin listener is a Unix domain socket"`
+	// Whether the admin listener may listen on an address which is not a loopback address
+	AllowRemote bool `def:"false" help:"Allow the admin listener to listen on an address which is not a loopback address"`
+	// URL of the Swagger UI distribution from which the admin listener's page
+	// which browses the API document loads its scripts and styles
+	SwaggerUI string `help:"URL of a Swagger UI distribution, such as https://unpkg.com/swagger-ui-dist@3, from which the admin listener's /swagger/ page loads its scripts and styles to browse the API document; if not set, the page is not served"`
+}
+
+// GRPCConfig is the configuration of the listener of the gRPC service, which
+// serves the core operations of the REST API to gRPC clients
+type GRPCConfig struct {
+	// Address in host:port form of the gRPC listener; if empty, the gRPC
+	// service is not served
+	ListenAddress string `help:"Listening address (host:port) of the gRPC service, which uses the server's TLS configuration; if not set, the gRPC service is not served"`
+}
+
+// HTTPConfig is the configuration of the timeouts and limits which protect the
+// server from clients which hold connections open without completing requests
+type HTTPConfig struct {
+	// Maximum time to read the headers of a request
+	ReadHeaderTimeout time.Duration `def:"10s" help:"Maximum time to read the headers of a request"`
+	// Maximum time to read a request, including its body
+	ReadTimeout time.Duration `def:"60s" help:"Maximum time to read a request, including its body"`
+	// Maximum time from the end of reading a request's headers to the end of
+	// writing its response
+	WriteTimeout time.Duration `def:"5m" help:"Maximum time from the end of reading the headers of a request to the end of writing its response"`
+	// Maximum time to wait for the next request on a keep-alive connection
+	IdleTimeout time.Duration `def:"120s" help:"Maximum time to wait for the next request on a keep-alive connection"`
+	// Maximum size of the headers of a request
+	MaxHeaderBytes int `def:"1048576" help:"Maximum size in bytes of the headers of a request"`
+	// Maximum size of the body of a request, which is rejected before it is
+	// read if its Content-Length is larger
+	MaxBodySize int `def:"10485760" help:"Maximum size in bytes of the body of a request"`
+	// Maximum sizes of the bodies of the requests to endpoints, by endpoint,
+	// which override MaxBodySize
+	MaxBodySizes map[string]int `skip:"true"`
+	// Maximum time to read the body of a request
+	BodyReadTimeout time.Duration `def:"30s" help:"Maximum time to read the body of a request, after which a client which is still sending it is cut off"`
+	// Whether gzip compression of responses and decompression of request
+	// bodies are disabled
+	DisableCompression bool `def:"false" help:"Disables the gzip compression of responses and the decompression of gzip request bodies"`
+	// Size below which a response is not compressed
+	CompressionMinSize int `def:"1024" help:"Minimum size in bytes of a response which is compressed with gzip"`
+	// Maximum size of a gzip request body once decompressed
+	MaxDecompressedBodySize int `def:"10485760" help:"Maximum size in bytes of a gzip request body once decompressed"`
+	// Time for which clients may use the CA information and the published
+	// CRL without revalidating them
+	CacheMaxAge time.Duration `def:"60s" help:"Time for which clients may cache the CA information and the published CRL without revalidating them"`
+}
+
+// APIConfig is the configuration of the REST API and its versions. The v1
+// endpoints which are superseded by v2 endpoints are deprecated.
+type APIConfig struct {
+	// Date after which the deprecated v1 endpoints may be removed
+	Sunset string `help:"Date, as YYYY-MM-DD, after which the deprecated v1 endpoints may be removed, which is sent in the Sunset header of their responses"`
+	// Return errors in the legacy format of the cfssl responses
+	LegacyErrors bool `def:"false" help:"Returns errors in the legacy format of the cfssl responses, as servers of previous versions do, rather than in error envelopes"`
+}
+
+// ConcurrencyLimit is the configuration of the maximum number of requests
+// which an endpoint handles at the same time
+type ConcurrencyLimit struct {
+	// Maximum number of requests handled at the same time
+	Max int
+	// What happens to requests beyond the maximum: "queue" or "reject"
+	Mode string
+	// Maximum number of requests waiting in queue mode; if 0, Max
+	QueueDepth int
+	// Maximum time that a request waits in queue mode
+	QueueTimeout time.Duration
+	// Time after which a rejected client is told to retry
+	RetryAfter time.Duration
+}
+
+// CORSConfig is the configuration of the CORS (Cross-Origin Resource Sharing)
+// headers which allow browser-based clients, such as an administration
+// console, to call the endpoints from web pages of other origins
+type CORSConfig struct {
+	// Whether the CORS headers are sent at all
+	Enabled bool `def:"false" help:"Send the CORS headers which allow browser-based clients of the allowed origins to call the server"`
+	// Origins from which requests are allowed, each of which may have a '*'
+	AllowedOrigins []string `help:"Origins, such as https://console.example.com, from which browsers may call the server; an origin may have a '*' matching any part of it, such as https://*.example.com, and '*' allows any origin"`
+	// Methods which may be used in cross-origin requests
+	AllowedMethods []string `help:"Methods which browsers may use in cross-origin requests (default: GET, HEAD, POST, PUT, DELETE)"`
+	// Headers which cross-origin requests may have
+	AllowedHeaders []string `help:"Headers which cross-origin requests may have (default: Authorization, Content-Type, Accept)"`
+	// Time for which browsers may cache the answer to a preflight request
+	MaxAge time.Duration `def:"10m" help:"Time for which browsers may cache the answer to a CORS preflight request"`
+	// Whether browsers may send credentials such as cookies and TLS client
+	// certificates in cross-origin requests
+	AllowCredentials bool `def:"false" help:"Allow browsers to send credentials such as cookies and TLS client certificates in cross-origin requests; may not be used with the origin '*'"`
+}
+
+// EventsConfig is the configuration of the webhooks to which the server sends
+// the events of changes to its identities and certificates
+type EventsConfig struct {
+	// Maximum number of events waiting to be sent to each subscription
+	QueueSize int `def:"1000" help:"Maximum number of events waiting to be sent to each event subscription; events beyond it are spooled"`
+	// Directory of the events which could not be delivered
+	SpoolDir string `def:"events" help:"Directory in which the events which could not be delivered are kept until they are sent again when the server starts"`
+	// The webhooks to which events are sent
+	Subscriptions []EventSubscription `skip:"true"`
+	// The Kafka topics to which events are published
+	Kafka []KafkaSubscription `skip:"true"`
+}
+
+// EventSubscription is a webhook to which events are sent
+type EventSubscription struct {
+	// URL to which each event is posted
+	URL string
+	// Types of the events which are sent, such as cert.issued; if empty, all
+	// events are sent
+	Events []string
+	// Secret with which the X-Fabric-CA-Signature header of each request is
+	// computed
+	Secret string `mask:"password"`
+	// Maximum time to wait for the response to a request
+	Timeout time.Duration
+	// Retries of the requests which fail
+	Retry EventRetryConfig
+}
+
+// KafkaSubscription is a Kafka topic to which events are published. The key
+// of each message is the enrollment ID of the identity of the event, so that
+// the events of an identity are in the same partition, in order.
+type KafkaSubscription struct {
+	// The brokers and topic, and the authentication of the connections
+	kafka.Config `mapstructure:",squash"`
+	// Types of the events which are published, such as cert.issued; if
+	// empty, all events are published
+	Events []string
+	// Maximum number of events published together
+	BatchSize int
+	// Maximum time to wait for a batch to fill before it is published
+	BatchTimeout time.Duration
+	// Retries of the batches which fail
+	Retry EventRetryConfig
+}
+
+// EventRetryConfig is the configuration of the retries of the requests which
+// send an event to a subscription. An event which is not delivered by the
+// last attempt is spooled.
+type EventRetryConfig struct {
+	// Maximum number of attempts to send an event
+	MaxAttempts int
+	// Delay before the first retry, which doubles after each retry
+	BaseDelay time.Duration
+	// Maximum delay before a retry
+	MaxDelay time.Duration
+}
+
+// ListenersConfig is the configuration of the listening addresses on which
+// the server accepts requests in addition to its address and port
+type ListenersConfig struct {
+	// Each address is either host:port or unix://path for a Unix domain socket
+	Addresses []string `help:"A list of comma-separated additional listening addresses of fabric-ca-server, each either host:port or unix://path for a Unix domain socket"`
+	// File permissions of the Unix domain sockets
+	SocketMode string `def:"0660" help:"File permissions (in octal) of the Unix domain sockets created for the listening addresses"`
+	// File to which the addresses on which the server listens are written
+	AddressFile string `help:"File to which the addresses on which fabric-ca-server listens are written as JSON once it is listening"`
 }
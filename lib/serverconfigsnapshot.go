@@ -0,0 +1,124 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"time"
+
+	"github.com/cloudflare/cfssl/config"
+	"github.com/cloudflare/cfssl/signer"
+)
+
+// configSnapshot is the configuration which a reload may change, as it was
+// put into service when the server was initialized or by a reload. A snapshot
+// is never modified once it is published; a reload publishes a new one which
+// is fully constructed. A request gets the snapshot in service when it is
+// received and uses it until it completes, so that it never sees part of the
+// configuration before a reload and part of it after.
+type configSnapshot struct {
+	crlSizeLimit    int
+	shutdownTimeout time.Duration
+	// The configuration of each CA of the server
+	cas map[*CA]*caConfigSnapshot
+}
+
+// caConfigSnapshot is the configuration of a CA which a reload may change
+type caConfigSnapshot struct {
+	cfg            CfgOptions
+	signing        *config.Signing
+	maxEnrollments int
+	crl            CRLConfig
+	idempotency    IdempotencyConfig
+	// The signer of the enrollment certificates with the signing profiles
+	enrollSigner signer.Signer
+}
+
+// newConfigSnapshot returns the snapshot of the current configuration of the
+// server 's' and its CAs
+func newConfigSnapshot(s *Server) *configSnapshot {
+	snap := &configSnapshot{cas: map[*CA]*caConfigSnapshot{}}
+	if s == nil {
+		return snap
+	}
+	if s.Config != nil {
+		snap.crlSizeLimit = s.Config.CRLSizeLimit
+		snap.shutdownTimeout = s.Config.ShutdownTimeout
+	}
+	for _, ca := range s.caMap {
+		snap.cas[ca] = newCAConfigSnapshot(ca.Config, ca.enrollSigner)
+	}
+	return snap
+}
+
+// newCAConfigSnapshot returns the snapshot of the CA configuration 'cfg' with
+// the enrollment signer 'enrollSigner' of its signing profiles
+func newCAConfigSnapshot(cfg *CAConfig, enrollSigner signer.Signer) *caConfigSnapshot {
+	snap := &caConfigSnapshot{enrollSigner: enrollSigner}
+	if cfg != nil {
+		snap.cfg = cfg.Cfg
+		snap.signing = cfg.Signing
+		snap.maxEnrollments = cfg.Registry.MaxEnrollments
+		snap.crl = cfg.CRL
+		snap.idempotency = cfg.Idempotency
+	}
+	return snap
+}
+
+// ca returns the configuration of the CA 'ca'. A CA which is not in the
+// snapshot, such as one which is used before the server publishes its
+// configuration, has its current configuration.
+func (snap *configSnapshot) ca(ca *CA) *caConfigSnapshot {
+	if c := snap.cas[ca]; c != nil {
+		return c
+	}
+	return newCAConfigSnapshot(ca.Config, ca.enrollSigner)
+}
+
+// publishConfig puts the configuration 'snap' into service for the requests
+// which are received afterwards
+func (s *Server) publishConfig(snap *configSnapshot) {
+	s.configSnap.Store(snap)
+}
+
+// ApplyConfig puts the reloadable settings of the server's configuration and
+// of its CAs' configurations into service. A running server does not see the
+// changes which are made to these settings in its configuration until it is
+// called or the configuration is reloaded.
+func (s *Server) ApplyConfig() {
+	s.configMutex.Lock()
+	defer s.configMutex.Unlock()
+	s.publishConfig(newConfigSnapshot(s))
+}
+
+// configSnapshot returns the configuration in service
+func (s *Server) configSnapshot() *configSnapshot {
+	if s == nil {
+		return newConfigSnapshot(nil)
+	}
+	if snap, ok := s.configSnap.Load().(*configSnapshot); ok {
+		return snap
+	}
+	// The server has not published its configuration, as when its endpoints
+	// are called before it is initialized
+	return newConfigSnapshot(s)
+}
+
+// caConfig returns the configuration of the CA 'ca' in the snapshot which
+// the request uses
+func (ctx *serverRequestContextImpl) caConfig(ca *CA) *caConfigSnapshot {
+	return ctx.config.ca(ca)
+}
+
+// requestCAConfig returns the configuration of the CA 'ca' which the request
+// 'ctx' uses, or the configuration in service if 'ctx' is not a request of
+// the server
+func requestCAConfig(ctx ServerRequestContext, ca *CA) *caConfigSnapshot {
+	if c, ok := ctx.(*serverRequestContextImpl); ok {
+		return c.caConfig(ca)
+	}
+	return ca.server.configSnapshot().ca(ca)
+}
@@ -0,0 +1,107 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+const snapshotConfigTemplate = `
+registry:
+  maxenrollments: -1
+signing:
+  default:
+    usage:
+      - digital signature
+    expiry: %s
+`
+
+// TestConfigSnapshotReload enrolls and queries identities while the
+// configuration is reloaded in a loop; run it with -race
+func TestConfigSnapshotReload(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	cfgFile := filepath.Join(rootDir, "reload.yaml")
+	srv.CA.ConfigFilePath = cfgFile
+	expiries := []string{"10h", "20h"}
+
+	before := srv.configSnapshot()
+	stop := make(chan struct{})
+	reloaded := make(chan int)
+	go func() {
+		n := 0
+		defer func() { reloaded <- n }()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			content := fmt.Sprintf(snapshotConfigTemplate, expiries[n%len(expiries)])
+			err := ioutil.WriteFile(cfgFile, []byte(content), 0644)
+			if err != nil {
+				t.Errorf("Failed to write config file: %s", err)
+				return
+			}
+			err = srv.reloadConfig()
+			if err != nil {
+				t.Errorf("Failed to reload config: %s", err)
+				return
+			}
+			n++
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := TestGetRootClient()
+			for j := 0; j < 5; j++ {
+				resp, err := c.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+				if !assert.NoError(t, err, "Failed to enroll while reloading config") {
+					return
+				}
+				// The certificate is signed with one of the profiles, never
+				// with a configuration which is partly reloaded
+				cert := resp.Identity.GetECert().GetX509Cert()
+				validity := cert.NotAfter.Sub(cert.NotBefore).Round(time.Hour)
+				assert.Contains(t, []time.Duration{10 * time.Hour, 20 * time.Hour}, validity)
+				_, err = resp.Identity.GetIdentity("admin", "")
+				assert.NoError(t, err, "Failed to get identity while reloading config")
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	n := <-reloaded
+	assert.True(t, n > 0, "The configuration should have been reloaded")
+
+	// Each reload publishes a new snapshot, and the one it replaced is not
+	// modified
+	after := srv.configSnapshot()
+	assert.False(t, before == after, "A reload should publish a new snapshot")
+	assert.Equal(t, defaultIssuedCertificateExpiration, before.ca(&srv.CA).signing.Default.Expiry)
+	assert.Equal(t, srv.CA.Config.Signing, after.ca(&srv.CA).signing)
+}
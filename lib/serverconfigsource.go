@@ -0,0 +1,439 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib/dbutil"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// ConfigSource is where the value of a setting of the server's configuration
+// comes from. A command line flag takes precedence over an environment
+// variable, which takes precedence over the configuration file, which takes
+// precedence over the default value.
+type ConfigSource string
+
+const (
+	// ConfigSourceDefault is the source of a setting which has its default value
+	ConfigSourceDefault ConfigSource = "default"
+	// ConfigSourceFile is the source of a setting which is set in the
+	// configuration file
+	ConfigSourceFile ConfigSource = "file"
+	// ConfigSourceEnv is the source of a setting which is set by an
+	// environment variable
+	ConfigSourceEnv ConfigSource = "env"
+	// ConfigSourceFlag is the source of a setting which is set by a command
+	// line flag
+	ConfigSourceFlag ConfigSource = "flag"
+)
+
+// maskedValue replaces the value of a secret setting
+const maskedValue = "****"
+
+// secretSettingNames are the names of the settings whose values are masked
+// even though they are not tagged as secrets, such as the PIN of a PKCS11 token
+var secretSettingNames = map[string]bool{
+	"pass":     true,
+	"password": true,
+	"secret":   true,
+	"token":    true,
+	"pin":      true,
+}
+
+// reloadableSettings are the settings, or the sections of settings, which
+// a reload of the configuration puts into service
+var reloadableSettings = []string{
+	"debug", "log", "crlsizelimit", "shutdowntimeout",
+	"cfg", "signing", "registry.maxenrollments", "crl", "idempotency",
+}
+
+// ConfigProvenance is the source of each setting of the server's
+// configuration and of its default CA's configuration, by path. It is not
+// modified once the server uses it.
+type ConfigProvenance map[string]ConfigSource
+
+// NewConfigProvenance returns the source of each setting of the server's
+// configuration read from 'file', in which the settings in 'env' are
+// overridden by environment variables and those for which
+// 'isSetOnCommandLine' returns true are set by command line flags.
+// 'isSetOnCommandLine' may be nil.
+func NewConfigProvenance(file string, env *EnvOverrides, isSetOnCommandLine func(path string) bool) (ConfigProvenance, error) {
+	inFile, err := configFileSettings(file)
+	if err != nil {
+		return nil, err
+	}
+	prov := ConfigProvenance{}
+	walkServerSettings(&ServerConfig{}, func(path string, f reflect.Value, tf reflect.StructField) {
+		switch {
+		case isSetOnCommandLine != nil && isSetOnCommandLine(path):
+			prov[path] = ConfigSourceFlag
+		case env != nil && env.isSet(path):
+			prov[path] = ConfigSourceEnv
+		case inFile.has(path):
+			prov[path] = ConfigSourceFile
+		default:
+			prov[path] = ConfigSourceDefault
+		}
+	})
+	return prov, nil
+}
+
+// withReloaded returns the provenance of the configuration after a reload
+// whose settings have the provenance 'reloaded': the reloadable settings have
+// their sources in 'reloaded', and the others keep theirs
+func (p ConfigProvenance) withReloaded(reloaded ConfigProvenance) ConfigProvenance {
+	prov := ConfigProvenance{}
+	for path, source := range p {
+		prov[path] = source
+	}
+	for path, source := range reloaded {
+		for _, r := range reloadableSettings {
+			if path == r || strings.HasPrefix(path, r+".") {
+				prov[path] = source
+				break
+			}
+		}
+	}
+	return prov
+}
+
+// UnknownConfigSettings returns the settings in the configuration file
+// 'file' which are not settings of the server's configuration, such as
+// misspelled ones, which are ignored
+func UnknownConfigSettings(file string) ([]string, error) {
+	inFile, err := configFileSettings(file)
+	if err != nil {
+		return nil, err
+	}
+	known := fileSettings{}
+	walkServerSettings(&ServerConfig{}, func(path string, f reflect.Value, tf reflect.StructField) {
+		known[path] = true
+	})
+	unknown := []string{}
+	for key := range inFile {
+		// A setting whose value is a list or a map, such as the signing
+		// profiles, has keys of its own
+		found := false
+		for p := key; p != ""; p = parentSetting(p) {
+			if known[p] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+// WarnUnknownConfigSettings logs a warning for each setting in the
+// configuration file 'file' which is not a setting of the server's
+// configuration
+func WarnUnknownConfigSettings(file string) error {
+	unknown, err := UnknownConfigSettings(file)
+	if err != nil {
+		return err
+	}
+	for _, key := range unknown {
+		log.Warningf("The setting '%s' in the configuration file '%s' is not a setting of the server's configuration and is ignored", key, file)
+	}
+	return nil
+}
+
+// EffectiveConfig returns the settings of the server's configuration 'cfg'
+// and of its default CA's configuration, sorted by path, with the values of
+// secrets masked and with their sources in 'prov'. The source of a setting is
+// empty if 'prov' is nil, as for a server whose configuration was not loaded
+// by fabric-ca-server.
+func EffectiveConfig(cfg *ServerConfig, prov ConfigProvenance) []api.ConfigSetting {
+	settings := []api.ConfigSetting{}
+	walkServerSettings(cfg, func(path string, f reflect.Value, tf reflect.StructField) {
+		settings = append(settings, api.ConfigSetting{
+			Setting: path,
+			Value:   maskSetting(path, f, tf),
+			Source:  string(prov[path]),
+		})
+	})
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Setting < settings[j].Setting })
+	return settings
+}
+
+// effectiveConfig returns the effective configuration of the server
+func (s *Server) effectiveConfig() *api.ConfigResponse {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	return &api.ConfigResponse{Settings: EffectiveConfig(s.Config, s.ConfigProvenance)}
+}
+
+func newConfigEndpoint(s *Server) *serverEndpoint {
+	return &serverEndpoint{
+		Methods: []string{"GET"},
+		Handler: configHandler,
+		Server:  s,
+		auth:    authAdmin,
+		docs: map[string]operationDoc{
+			"GET": {summary: "Get the effective configuration of the server and the source of each of its settings", response: &api.ConfigResponse{}},
+		},
+	}
+}
+
+// Handle a request to get the effective configuration of the server
+func configHandler(ctx *serverRequestContextImpl) (interface{}, error) {
+	id, err := ctx.adminAuthorization("get the configuration")
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Configuration requested by '%s'", id)
+	return ctx.endpoint.Server.effectiveConfig(), nil
+}
+
+// fileSettings are the settings in a configuration file, by path
+type fileSettings map[string]bool
+
+// configFileSettings returns the settings in the configuration file 'file'
+// which have values. A setting without a value, such as 'file:' in a YAML
+// file, has its default value.
+func configFileSettings(file string) (fileSettings, error) {
+	vp := viper.New()
+	vp.SetConfigFile(file)
+	err := vp.ReadInConfig()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read config file '%s'", file)
+	}
+	settings := fileSettings{}
+	for _, key := range vp.AllKeys() {
+		if vp.Get(key) != nil {
+			settings[key] = true
+		}
+	}
+	return settings, nil
+}
+
+// has returns true if the setting at 'path', or any of the keys of a setting
+// whose value is a map, is in the file
+func (fs fileSettings) has(path string) bool {
+	if fs[path] {
+		return true
+	}
+	for key := range fs {
+		if strings.HasPrefix(key, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// parentSetting returns the path of the section of the setting at 'path',
+// or an empty string if it is not in a section
+func parentSetting(path string) string {
+	idx := strings.LastIndex(path, ".")
+	if idx < 0 {
+		return ""
+	}
+	return path[:idx]
+}
+
+// walkServerSettings calls 'fn' with the path and value of each setting of
+// the server's configuration 'cfg' and of its default CA's configuration,
+// which are read from the same file. A setting of both is only walked as a
+// setting of the server.
+func walkServerSettings(cfg *ServerConfig, fn func(path string, f reflect.Value, tf reflect.StructField)) {
+	seen := map[string]bool{}
+	walkSettings(reflect.ValueOf(cfg).Elem(), "", func(path string, f reflect.Value, tf reflect.StructField) {
+		if path == "cacfg" {
+			return
+		}
+		seen[path] = true
+		fn(path, f, tf)
+	})
+	walkSettings(reflect.ValueOf(&cfg.CAcfg).Elem(), "", func(path string, f reflect.Value, tf reflect.StructField) {
+		if !seen[path] {
+			fn(path, f, tf)
+		}
+	})
+}
+
+// walkSettings calls 'fn' with the path and value of each setting of the
+// configuration struct 'v', by the names with which they are read from the
+// configuration file. The settings of a struct which is only reached through
+// a nil pointer are walked with their zero values. A struct with the "skip"
+// tag, such as the signing profiles, is a setting of its own, as are lists
+// and maps.
+func walkSettings(v reflect.Value, prefix string, fn func(path string, f reflect.Value, tf reflect.StructField)) {
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		tf := t.Field(i)
+		f := v.Field(i)
+		if tf.PkgPath != "" {
+			continue // skip unexported fields
+		}
+		name, squash := settingName(tf)
+		path := prefix
+		if !squash {
+			path = joinSettingPath(prefix, name)
+		}
+		skip := tf.Tag.Get(util.TagSkip) == "true"
+		switch {
+		case !skip && f.Kind() == reflect.Ptr && f.Type().Elem().Kind() == reflect.Struct:
+			if f.IsNil() {
+				f = reflect.New(f.Type().Elem())
+			}
+			walkSettings(f.Elem(), path, fn)
+		case !skip && f.Kind() == reflect.Struct && f.Type() != timeType:
+			walkSettings(f, path, fn)
+		default:
+			fn(path, f, tf)
+		}
+	}
+}
+
+// timeType is the type of the settings which are times
+var timeType = reflect.TypeOf(time.Time{})
+
+// settingName returns the name with which the field 'tf' is read from the
+// configuration file, and true if its fields are read as those of its struct
+func settingName(tf reflect.StructField) (string, bool) {
+	tag := strings.Split(tf.Tag.Get("mapstructure"), ",")
+	for _, opt := range tag[1:] {
+		if opt == "squash" {
+			return "", true
+		}
+	}
+	if tag[0] != "" {
+		return strings.ToLower(tag[0]), false
+	}
+	return strings.ToLower(tf.Name), false
+}
+
+func joinSettingPath(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// maskSetting returns the value of the setting at 'path' of the field 'tf',
+// whose value is 'f', with its secrets masked
+func maskSetting(path string, f reflect.Value, tf reflect.StructField) interface{} {
+	if strings.HasSuffix(path, ".datasource") && f.Kind() == reflect.String {
+		// The data source of a database may have its credentials
+		return dbutil.MaskDBCred(f.String())
+	}
+	return maskField(strings.ToLower(tf.Name), f, tf.Tag)
+}
+
+// maskField returns the value 'f' of the field named 'name' with the tags
+// 'tag', masked if it is a secret
+func maskField(name string, f reflect.Value, tag reflect.StructTag) interface{} {
+	if f.Kind() == reflect.String {
+		s := f.String()
+		switch tag.Get(util.SecretTag) {
+		case "password", "username":
+			if s != "" {
+				return maskedValue
+			}
+		case "url":
+			return util.GetMaskedURL(s)
+		}
+		if secretSettingNames[strings.ToLower(name)] && s != "" {
+			return maskedValue
+		}
+	}
+	return maskValue(f)
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// maskValue returns 'v' as a value which is marshalled as JSON, with the
+// secrets of the structs in it masked
+func maskValue(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	if v.Type() == durationType {
+		return time.Duration(v.Int()).String()
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return maskValue(v.Elem())
+	case reflect.Struct:
+		if v.Type().Implements(jsonMarshalerType) || v.Type().Implements(textMarshalerType) {
+			return v.Interface()
+		}
+		m := map[string]interface{}{}
+		maskStruct(v, m)
+		return m
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		m := map[string]interface{}{}
+		for _, k := range v.MapKeys() {
+			name := k.String()
+			if k.Kind() != reflect.String {
+				b, _ := json.Marshal(k.Interface())
+				name = string(b)
+			}
+			m[name] = maskField(name, v.MapIndex(k), "")
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Interface()
+		}
+		l := make([]interface{}, v.Len())
+		for i := range l {
+			l[i] = maskValue(v.Index(i))
+		}
+		return l
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return nil
+	}
+	return v.Interface()
+}
+
+// maskStruct sets the fields of the struct 'v' in 'm' by the names with
+// which they are read from the configuration file, with their secrets masked
+func maskStruct(v reflect.Value, m map[string]interface{}) {
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		tf := t.Field(i)
+		if tf.PkgPath != "" || tf.Tag.Get("json") == "-" {
+			continue
+		}
+		name, squash := settingName(tf)
+		if squash {
+			if f := v.Field(i); f.Kind() == reflect.Struct {
+				maskStruct(f, m)
+			}
+			continue
+		}
+		m[name] = maskField(name, v.Field(i), tf.Tag)
+	}
+}
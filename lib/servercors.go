@@ -0,0 +1,163 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+)
+
+// The methods and headers which browsers may use in cross-origin requests if
+// the CORS configuration does not list them
+var (
+	defaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE"}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", "Accept"}
+)
+
+// corsPolicy is the validated CORS configuration of the server
+type corsPolicy struct {
+	// The allowed origins, in lower case, each of which may have one '*'
+	// matching any part of an origin
+	origins []string
+	// The allowed methods, in upper case
+	methods []string
+	// The allowed request headers, in canonical form
+	headers []string
+	// The values of the response headers
+	allowMethods     string
+	allowHeaders     string
+	maxAge           string
+	allowCredentials bool
+}
+
+// newCORSPolicy validates the CORS configuration 'cfg' and returns the policy
+// which it describes, or nil if CORS is not enabled
+func newCORSPolicy(cfg *CORSConfig) (*corsPolicy, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if len(cfg.AllowedOrigins) == 0 {
+		return nil, errors.New("Invalid cors.allowedorigins: at least one origin must be allowed when CORS is enabled")
+	}
+	if cfg.MaxAge < 0 {
+		return nil, errors.New("Invalid cors.maxage: it must not be negative")
+	}
+	p := &corsPolicy{allowCredentials: cfg.AllowCredentials}
+	for _, origin := range util.NormalizeStringSlice(cfg.AllowedOrigins) {
+		origin = strings.ToLower(strings.TrimSpace(origin))
+		if strings.Count(origin, "*") > 1 {
+			return nil, errors.Errorf("Invalid cors.allowedorigins value '%s': an origin may have at most one '*'", origin)
+		}
+		if origin == "*" && cfg.AllowCredentials {
+			return nil, errors.New("Invalid cors configuration: the origin '*' may not be allowed together with cors.allowcredentials, which would let any web site make authenticated requests")
+		}
+		p.origins = append(p.origins, origin)
+	}
+	p.methods = defaultCORSMethods
+	if len(cfg.AllowedMethods) > 0 {
+		p.methods = nil
+		for _, method := range util.NormalizeStringSlice(cfg.AllowedMethods) {
+			p.methods = append(p.methods, strings.ToUpper(strings.TrimSpace(method)))
+		}
+	}
+	p.headers = defaultCORSHeaders
+	if len(cfg.AllowedHeaders) > 0 {
+		p.headers = nil
+		for _, header := range util.NormalizeStringSlice(cfg.AllowedHeaders) {
+			p.headers = append(p.headers, http.CanonicalHeaderKey(strings.TrimSpace(header)))
+		}
+	}
+	p.allowMethods = strings.Join(p.methods, ", ")
+	p.allowHeaders = strings.Join(p.headers, ", ")
+	p.maxAge = strconv.Itoa(int(cfg.MaxAge.Seconds()))
+	return p, nil
+}
+
+// allowsOrigin returns true if the policy allows requests from 'origin'
+func (p *corsPolicy) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range p.origins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		i := strings.Index(allowed, "*")
+		if i < 0 {
+			continue
+		}
+		prefix, suffix := allowed[:i], allowed[i+1:]
+		if len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHeaders returns true if the policy allows each of the comma-separated
+// request headers 'headers'
+func (p *corsPolicy) allowsHeaders(headers string) bool {
+	for _, header := range strings.Split(headers, ",") {
+		header = strings.TrimSpace(header)
+		if header != "" && !util.StrContained(header, p.headers) {
+			return false
+		}
+	}
+	return true
+}
+
+// setOriginHeaders sets the headers which allow the origin 'origin' to read
+// the response
+func (p *corsPolicy) setOriginHeaders(h http.Header, origin string) {
+	// The origin itself is returned rather than '*' so that the response is
+	// also readable by requests with credentials
+	h.Set("Access-Control-Allow-Origin", origin)
+	if p.allowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// handleCORS answers the CORS preflight requests of the browsers, without
+// passing them to 'next', which authenticates requests, and allows the
+// origins of the CORS policy to read the responses of the actual requests
+func (s *Server) handleCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := s.cors
+		origin := r.Header.Get("Origin")
+		if p == nil || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		reqMethod := r.Header.Get("Access-Control-Request-Method")
+		if r.Method == "OPTIONS" && reqMethod != "" {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			if !p.allowsOrigin(origin) || !util.StrContained(reqMethod, p.methods) ||
+				!p.allowsHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+				log.Debugf("Rejected CORS preflight request from origin '%s' for %s %s", origin, reqMethod, r.URL.Path)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			p.setOriginHeaders(h, origin)
+			h.Set("Access-Control-Allow-Methods", p.allowMethods)
+			h.Set("Access-Control-Allow-Headers", p.allowHeaders)
+			h.Set("Access-Control-Max-Age", p.maxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if p.allowsOrigin(origin) {
+			p.setOriginHeaders(h, origin)
+			h.Set("Access-Control-Expose-Headers", requestIDHeader)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
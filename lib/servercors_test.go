@@ -0,0 +1,122 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/lib/metrics"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORSConfig(t *testing.T) {
+	p, err := newCORSPolicy(&CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+	assert.NoError(t, err, "A disabled CORS configuration should not be validated")
+	assert.Nil(t, p)
+
+	_, err = newCORSPolicy(&CORSConfig{Enabled: true, AllowedOrigins: []string{"https://a.example.com", "*"}, AllowCredentials: true})
+	util.ErrorContains(t, err, "may not be allowed together with cors.allowcredentials", "The origin '*' with credentials should be rejected")
+	_, err = newCORSPolicy(&CORSConfig{Enabled: true})
+	util.ErrorContains(t, err, "cors.allowedorigins", "CORS without origins should be rejected")
+	_, err = newCORSPolicy(&CORSConfig{Enabled: true, AllowedOrigins: []string{"https://*.*.example.com"}})
+	util.ErrorContains(t, err, "at most one '*'", "An origin with two wildcards should be rejected")
+	_, err = newCORSPolicy(&CORSConfig{Enabled: true, AllowedOrigins: []string{"*"}, MaxAge: -time.Second})
+	util.ErrorContains(t, err, "cors.maxage", "A negative max age should be rejected")
+
+	p, err = newCORSPolicy(&CORSConfig{Enabled: true, AllowedOrigins: []string{"https://console.example.com,https://*.Example.org"}})
+	util.FatalError(t, err, "Failed to create CORS policy")
+	assert.True(t, p.allowsOrigin("https://console.example.com"))
+	assert.True(t, p.allowsOrigin("https://ops.example.org"))
+	assert.False(t, p.allowsOrigin("https://example.org"))
+	assert.False(t, p.allowsOrigin("https://evil.com"))
+	assert.False(t, p.allowsOrigin("http://console.example.com"))
+}
+
+func TestCORS(t *testing.T) {
+	cors, err := newCORSPolicy(&CORSConfig{
+		Enabled:          true,
+		AllowedOrigins:   []string{"https://*.example.com"},
+		MaxAge:           5 * time.Minute,
+		AllowCredentials: true,
+	})
+	util.FatalError(t, err, "Failed to create CORS policy")
+	s := &Server{metrics: metrics.NewRegistry(), cors: cors}
+	newRequestMetrics(s.metrics)
+	called := 0
+	h := s.wrapEndpoint("identities", &serverEndpoint{
+		Methods: []string{"GET", "POST"},
+		Handler: func(ctx *serverRequestContextImpl) (interface{}, error) {
+			called++
+			if ctx.req.Header.Get("Authorization") == "" {
+				return nil, caerrors.NewAuthenticationErr(caerrors.ErrNoAuthHdr, "No authorization header")
+			}
+			return "ok", nil
+		},
+	})
+	request := func(method, origin string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/v1/identities", nil)
+		r.Header.Set("Origin", origin)
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	preflight := map[string]string{
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "authorization, content-type",
+	}
+
+	// A preflight request is answered without authentication
+	w := request("OPTIONS", "https://console.example.com", preflight)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, 0, called, "A preflight request should not reach the endpoint")
+	assert.Equal(t, "https://console.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "GET, HEAD, POST, PUT, DELETE", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Authorization, Content-Type, Accept", w.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "300", w.Header().Get("Access-Control-Max-Age"))
+	assert.Contains(t, w.Header()["Vary"], "Origin")
+
+	// The actual request is still authenticated, and the origin may read
+	// the response
+	w = request("GET", "https://console.example.com", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "https://console.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	w = request("GET", "https://console.example.com", map[string]string{"Authorization": "token"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://console.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, requestIDHeader, w.Header().Get("Access-Control-Expose-Headers"))
+	assert.Equal(t, 2, called)
+
+	// A disallowed origin, method or header fails the preflight, and the
+	// responses to a disallowed origin have no CORS headers
+	w = request("OPTIONS", "https://evil.com", preflight)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	w = request("OPTIONS", "https://console.example.com", map[string]string{"Access-Control-Request-Method": "PATCH"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = request("OPTIONS", "https://console.example.com", map[string]string{"Access-Control-Request-Method": "GET", "Access-Control-Request-Headers": "X-Custom"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = request("GET", "https://evil.com", map[string]string{"Authorization": "token"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, 3, called)
+
+	// Without CORS, an OPTIONS request reaches the endpoint, which does not
+	// allow it
+	s.cors = nil
+	w = request("OPTIONS", "https://console.example.com", preflight)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
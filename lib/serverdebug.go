@@ -0,0 +1,124 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	rpprof "runtime/pprof"
+	"strings"
+
+	"github.com/cloudflare/cfssl/log"
+	gmux "github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// debugPath is the path under which the profiling and runtime debug
+// endpoints are served
+const debugPath = "debug/"
+
+// checkProfilingConfig returns an error if the profiling endpoints are to be
+// served on the operations listener but it does not listen on a loopback address
+func checkProfilingConfig(c *ServerConfig) error {
+	if !c.Profiling.Enabled || !c.Profiling.Operations {
+		return nil
+	}
+	addr := c.Operations.ListenAddress
+	if addr == "" {
+		return errors.New("The profiling endpoints can't be served on the operations listener because 'operations.listenaddress' is not set")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid operations listening address '%s'", addr)
+	}
+	if !isLoopbackHost(host) {
+		return errors.Errorf("The profiling endpoints can only be served on the operations listener if it listens on a loopback address, not '%s'", addr)
+	}
+	return nil
+}
+
+// isLoopbackHost returns true if 'host' is localhost or a loopback IP address
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// registerDebugHandlers registers the pprof, expvar and goroutine dump
+// endpoints if profiling is enabled, either on the server's mux or the admin
+// mux under the API path, or on the operations mux
+func (s *Server) registerDebugHandlers() {
+	c := &s.Config.Profiling
+	if !c.Enabled {
+		return
+	}
+	// The index of the profiles is last because it also serves each
+	// named profile under it
+	handlers := []struct {
+		name    string
+		handler http.Handler
+	}{
+		{"pprof/cmdline", http.HandlerFunc(pprof.Cmdline)},
+		{"pprof/profile", http.HandlerFunc(pprof.Profile)},
+		{"pprof/symbol", http.HandlerFunc(pprof.Symbol)},
+		{"pprof/trace", http.HandlerFunc(pprof.Trace)},
+		{"pprof/", http.HandlerFunc(pprofHandler)},
+		{"vars", expvar.Handler()},
+		{"goroutines", http.HandlerFunc(goroutinesHandler)},
+	}
+	for _, e := range handlers {
+		path := debugPath + e.name
+		h := e.handler
+		var route *gmux.Route
+		h = &rawAdminEndpoint{server: s, action: "profile the server", handler: rawHandler(h)}
+		switch {
+		case c.Operations && s.opsMux != nil:
+			route = s.opsMux.NewRoute()
+			path = "/" + path
+		case s.adminMux != nil:
+			route = s.adminMux.NewRoute()
+			h = s.wrapEndpoint(path, h)
+			path = apiPathPrefix + path
+		default:
+			route = s.mux.NewRoute()
+			h = s.wrapEndpoint(path, h)
+			path = s.basePath() + apiPathPrefix + path
+		}
+		if strings.HasSuffix(path, "/") {
+			route.PathPrefix(path).Handler(h)
+		} else {
+			route.Path(path).Handler(h)
+		}
+	}
+	log.Info("Profiling endpoints are enabled")
+}
+
+// pprofHandler serves the profile named by the last element of the path,
+// such as "heap", or the index of the profiles if there is none. pprof.Index
+// can't be used for the named profiles because it expects them under /debug/pprof/.
+func pprofHandler(w http.ResponseWriter, r *http.Request) {
+	idx := strings.LastIndex(r.URL.Path, "/pprof/")
+	name := ""
+	if idx >= 0 {
+		name = r.URL.Path[idx+len("/pprof/"):]
+	}
+	if name == "" {
+		pprof.Index(w, r)
+		return
+	}
+	pprof.Handler(name).ServeHTTP(w, r)
+}
+
+// goroutinesHandler writes the stack of every goroutine of the server
+func goroutinesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rpprof.Lookup("goroutine").WriteTo(w, 2)
+}
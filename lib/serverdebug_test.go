@@ -0,0 +1,149 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+var debugEndpoints = []string{
+	"debug/pprof/",
+	"debug/pprof/heap",
+	"debug/pprof/cmdline",
+	"debug/vars",
+	"debug/goroutines",
+}
+
+func TestDebugEndpoints(t *testing.T) {
+	srv := TestGetRootServer(t)
+	srv.Config.Profiling.Enabled = true
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	admin, user := enrollDebugIdentities(t)
+
+	url := fmt.Sprintf("http://localhost:%d/api/v1/", rootPort)
+	for _, ep := range debugEndpoints {
+		status, body := debugGet(t, admin, url+ep)
+		assert.Equal(t, http.StatusOK, status, "An admin should be able to get %s: %s", ep, body)
+		assert.NotEmpty(t, body)
+		status, body = debugGet(t, user, url+ep)
+		assert.Equal(t, http.StatusForbidden, status, "An identity without hf.Admin should not be able to get %s", ep)
+		assert.Contains(t, body, "Authorization failure")
+		status, _ = debugGet(t, nil, url+ep)
+		assert.Equal(t, http.StatusUnauthorized, status, "An unauthenticated request for %s should fail", ep)
+	}
+	_, body := debugGet(t, admin, url+"debug/goroutines")
+	assert.Contains(t, body, "goroutine ", "The goroutine dump should contain the stacks of the goroutines")
+	_, body = debugGet(t, admin, url+"debug/vars")
+	assert.Contains(t, body, "memstats")
+}
+
+func TestDebugEndpointsOperations(t *testing.T) {
+	srv := TestGetRootServer(t)
+	srv.Config.Profiling.Enabled = true
+	srv.Config.Profiling.Operations = true
+	srv.Config.Operations.ListenAddress = "127.0.0.1:0"
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	admin, user := enrollDebugIdentities(t)
+
+	opsURL := fmt.Sprintf("http://%s/", srv.ListenAddresses().Operations)
+	url := fmt.Sprintf("http://localhost:%d/api/v1/", rootPort)
+	for _, ep := range debugEndpoints {
+		status, body := debugGet(t, admin, opsURL+ep)
+		assert.Equal(t, http.StatusOK, status, "An admin should be able to get %s on the operations listener: %s", ep, body)
+		status, _ = debugGet(t, user, opsURL+ep)
+		assert.Equal(t, http.StatusForbidden, status, "An identity without hf.Admin should not be able to get %s", ep)
+		status, _ = debugGet(t, admin, url+ep)
+		assert.Equal(t, http.StatusNotFound, status, "%s should not be served on the server's port", ep)
+	}
+}
+
+func TestDebugEndpointsDisabled(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	admin, _ := enrollDebugIdentities(t)
+	url := fmt.Sprintf("http://localhost:%d/api/v1/", rootPort)
+	for _, ep := range debugEndpoints {
+		status, _ := debugGet(t, admin, url+ep)
+		assert.Equal(t, http.StatusNotFound, status, "%s should not be served unless profiling is enabled", ep)
+	}
+}
+
+func TestCheckProfilingConfig(t *testing.T) {
+	cfg := &ServerConfig{Profiling: ProfilingConfig{Enabled: true, Operations: true}}
+	err := checkProfilingConfig(cfg)
+	util.ErrorContains(t, err, "operations.listenaddress", "The operations listener is required")
+	cfg.Operations.ListenAddress = "0.0.0.0:9443"
+	err = checkProfilingConfig(cfg)
+	util.ErrorContains(t, err, "loopback", "The operations listener must listen on a loopback address")
+	for _, addr := range []string{"localhost:9443", "127.0.0.1:9443", "[::1]:9443"} {
+		cfg.Operations.ListenAddress = addr
+		assert.NoError(t, checkProfilingConfig(cfg), "%s is a loopback address", addr)
+	}
+	cfg.Operations.ListenAddress = "0.0.0.0:9443"
+	cfg.Profiling.Operations = false
+	assert.NoError(t, checkProfilingConfig(cfg))
+}
+
+// enrollDebugIdentities enrolls the bootstrap admin and registers and enrolls
+// an identity without the hf.Admin attribute
+func enrollDebugIdentities(t *testing.T) (*Identity, *Identity) {
+	c := TestGetRootClient()
+	enrollResp, err := c.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin'")
+	admin := enrollResp.Identity
+	_, err = admin.Register(&api.RegistrationRequest{Name: "debuguser", Secret: "debuguserpw"})
+	util.FatalError(t, err, "Failed to register 'debuguser'")
+	enrollResp, err = c.Enroll(&api.EnrollmentRequest{Name: "debuguser", Secret: "debuguserpw"})
+	util.FatalError(t, err, "Failed to enroll 'debuguser'")
+	return admin, enrollResp.Identity
+}
+
+// debugGet sends a GET request for 'url' with the token of 'id', if not nil,
+// and returns the status and body of the response
+func debugGet(t *testing.T, id *Identity, url string) (int, string) {
+	req, err := http.NewRequest("GET", url, nil)
+	util.FatalError(t, err, "Failed to create request")
+	if id != nil {
+		err = id.addTokenAuthHdr(req, nil)
+		util.FatalError(t, err, "Failed to add token")
+	}
+	// A new connection is used for each request so that none is left open
+	// to the server of a previous test
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Do(req)
+	util.FatalError(t, err, "Failed to get "+url)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	util.FatalError(t, err, "Failed to read response")
+	return resp.StatusCode, string(body)
+}
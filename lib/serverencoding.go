@@ -0,0 +1,149 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"encoding/pem"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/lib/common"
+	"github.com/hyperledger/fabric-ca/util"
+)
+
+// resultEncoding is an encoding other than JSON in which an endpoint returns
+// its result if the Accept header of the request asks for it
+type resultEncoding struct {
+	// The media type of the Accept header and of the response
+	mediaType string
+	// The name of the file of the Content-Disposition header
+	filename string
+	// Encodes the result of the handler, or nil if the handler writes the
+	// encoded result itself as it is generated
+	encode func(result interface{}) ([]byte, error)
+}
+
+// certEncodings returns the encodings of the result of an endpoint which
+// returns certificates: the PEM certificates, and the DER encoding of the
+// first of them, in files named 'name'
+func certEncodings(name string) []resultEncoding {
+	return []resultEncoding{
+		{mediaType: mediaTypePEM, filename: name + ".pem", encode: resultCertificates},
+		{mediaType: mediaTypeCert, filename: name + ".der", encode: func(result interface{}) ([]byte, error) {
+			certs, err := resultCertificates(result)
+			if err != nil {
+				return nil, err
+			}
+			return firstPEMBlock(certs)
+		}},
+	}
+}
+
+// crlEncodings are the encodings of the result of the gencrl endpoint: the
+// PEM and the DER encodings of the CRL, which the endpoint streams
+var crlEncodings = []resultEncoding{
+	{mediaType: mediaTypePEM, filename: "crl.pem"},
+	{mediaType: mediaTypeCRL, filename: "crl.der"},
+}
+
+// certificateExportEncodings are the encodings of the certificates of the
+// certificates endpoint other than JSON: a bundle of the PEM certificates,
+// which the endpoint streams
+var certificateExportEncodings = []resultEncoding{
+	{mediaType: mediaTypePEM, filename: "certificates.pem"},
+}
+
+// resultCertificates returns the PEM certificates of the result of an
+// enroll, reenroll or cainfo request: the enrollment certificate followed
+// by the CA chain, or the CA chain
+func resultCertificates(result interface{}) ([]byte, error) {
+	switch r := result.(type) {
+	case *common.EnrollmentResponseNet:
+		cert, err := util.B64Decode(r.Cert)
+		if err != nil {
+			return nil, err
+		}
+		chain, err := util.B64Decode(r.ServerInfo.CAChain)
+		if err != nil {
+			return nil, err
+		}
+		return append(cert, chain...), nil
+	case *common.EnrollmentResponseNetV2:
+		return []byte(r.Certificate + strings.Join(r.CA.Chain, "")), nil
+	case *common.CAInfoResponseNet:
+		return util.B64Decode(r.CAChain)
+	}
+	return nil, caerrors.NewHTTPErr(500, caerrors.ErrUnknown, "The result of type %T has no certificates", result)
+}
+
+// firstPEMBlock returns the DER bytes of the first PEM block of 'data'
+func firstPEMBlock(data []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, caerrors.NewHTTPErr(500, caerrors.ErrUnknown, "The result is not PEM-encoded")
+	}
+	return block.Bytes, nil
+}
+
+// negotiateEncoding returns the encoding of the endpoint's result which the
+// Accept header of 'r' prefers, or nil if it prefers JSON or accepts none of
+// the encodings, in which case the result is returned as JSON
+func (se *serverEndpoint) negotiateEncoding(r *http.Request) *resultEncoding {
+	var best *resultEncoding
+	bestQ := 0.0
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(accepted)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if q <= bestQ {
+			continue
+		}
+		if mediaType == mediaTypeJSON {
+			best, bestQ = nil, q
+			continue
+		}
+		for i := range se.encodings {
+			if se.encodings[i].mediaType == mediaType {
+				best, bestQ = &se.encodings[i], q
+			}
+		}
+	}
+	return best
+}
+
+// writeEncoded writes the result 'body' in the encoding 'enc' as the whole
+// response
+func (hrw *httpResponseWriter) writeEncoded(enc *resultEncoding, body []byte) {
+	hrw.startEncoded(enc, int64(len(body))).Write(body)
+}
+
+// startEncoded sends the header of a response whose whole body is a result
+// of 'size' bytes, or of unknown size if 'size' is negative, in the encoding
+// 'enc', and returns the writer of the body
+func (hrw *httpResponseWriter) startEncoded(enc *resultEncoding, size int64) http.ResponseWriter {
+	h := hrw.w.Header()
+	h.Set("Content-Type", enc.mediaType)
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": enc.filename}))
+	if size >= 0 {
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	hrw.w.WriteHeader(hrw.se.getSuccessRC())
+	hrw.writeHeaderCalled = true
+	hrw.encoded = true
+	return hrw.w
+}
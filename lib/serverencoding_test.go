@@ -0,0 +1,235 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	cfsslapi "github.com/cloudflare/cfssl/api"
+	"github.com/cloudflare/cfssl/signer"
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentNegotiation(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	client := TestGetRootClient()
+	eresp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin'")
+	id := eresp.Identity
+	caCert, err := getCACert(&srv.CA)
+	util.FatalError(t, err, "Failed to get the CA certificate")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	util.FatalError(t, err, "Failed to generate key")
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "admin"}}, key)
+	util.FatalError(t, err, "Failed to create CSR")
+	enrollBody, err := json.Marshal(&api.EnrollmentRequestNet{
+		SignRequest: signer.SignRequest{Request: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}))},
+	})
+	util.FatalError(t, err, "Failed to marshal enrollment request")
+
+	// newRequest returns a request to 'endpoint' which is authenticated as
+	// the endpoint requires
+	newRequest := func(method, endpoint string, body []byte, auth authPolicy) *http.Request {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://localhost:%d/api/%s", rootPort, endpoint), bytes.NewReader(body))
+		util.FatalError(t, err, "Failed to create request")
+		switch auth {
+		case authBasic:
+			req.SetBasicAuth("admin", "adminpw")
+		case authToken:
+			err = id.addTokenAuthHdr(req, body)
+			util.FatalError(t, err, "Failed to add token")
+		}
+		return req
+	}
+
+	const (
+		resultJSON = "json"
+		resultPEM  = "pem"
+		resultDER  = "der"
+	)
+	endpoints := []struct {
+		name     string
+		method   string
+		body     []byte
+		auth     authPolicy
+		crl      bool
+		filename string
+	}{
+		{"v1/cainfo", "GET", nil, authNone, false, "ca-chain"},
+		{"v1/cainfo", "POST", []byte("{}"), authNone, false, "ca-chain"},
+		{"v1/enroll", "POST", enrollBody, authBasic, false, "cert"},
+		{"v2/enroll", "POST", enrollBody, authBasic, false, "cert"},
+		{"v1/reenroll", "POST", enrollBody, authToken, false, "cert"},
+		{"v1/gencrl", "POST", []byte("{}"), authToken, true, "crl"},
+	}
+	accepts := []struct {
+		accept     string
+		certResult string
+		crlResult  string
+	}{
+		{"", resultJSON, resultJSON},
+		{"application/json", resultJSON, resultJSON},
+		{"text/html", resultJSON, resultJSON},
+		{"*/*", resultJSON, resultJSON},
+		{"application/x-pem-file", resultPEM, resultPEM},
+		{"application/pkix-cert", resultDER, resultJSON},
+		{"application/pkix-crl", resultJSON, resultDER},
+		{"application/x-pem-file;q=0.5, application/json", resultJSON, resultJSON},
+		{"application/json;q=0.1, application/pkix-cert, application/pkix-crl", resultDER, resultDER},
+		{"application/pkix-cert;q=0.4, application/x-pem-file;q=0.8", resultPEM, resultPEM},
+		{"application/x-pem-file;q=invalid, text/plain", resultJSON, resultJSON},
+	}
+	for _, ep := range endpoints {
+		for _, test := range accepts {
+			want := test.certResult
+			mediaType := map[string]string{resultJSON: mediaTypeJSON, resultPEM: mediaTypePEM, resultDER: mediaTypeCert}[want]
+			if ep.crl {
+				want = test.crlResult
+				mediaType = map[string]string{resultJSON: mediaTypeJSON, resultPEM: mediaTypePEM, resultDER: mediaTypeCRL}[want]
+			}
+			msg := fmt.Sprintf("%s %s with Accept '%s'", ep.method, ep.name, test.accept)
+			req := newRequest(ep.method, ep.name, ep.body, ep.auth)
+			if test.accept != "" {
+				req.Header.Set("Accept", test.accept)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			util.FatalError(t, err, "Failed to send "+msg)
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			util.FatalError(t, err, "Failed to read the response of "+msg)
+			if !assert.True(t, resp.StatusCode < 300, "%s failed: %s", msg, body) {
+				continue
+			}
+			assert.Equal(t, mediaType, resp.Header.Get("Content-Type"), msg)
+			assert.Contains(t, resp.Header["Vary"], "Accept", msg)
+			if want == resultJSON {
+				var result cfsslapi.Response
+				assert.NoError(t, json.Unmarshal(body, &result), msg)
+				assert.True(t, result.Success, msg)
+				assert.Empty(t, resp.Header.Get("Content-Disposition"), msg)
+				continue
+			}
+			assert.Equal(t, fmt.Sprintf(`attachment; filename=%s.%s`, ep.filename, want),
+				resp.Header.Get("Content-Disposition"), msg)
+			der := body
+			if want == resultPEM {
+				block, rest := pem.Decode(body)
+				if !assert.NotNil(t, block, "%s should return PEM", msg) {
+					continue
+				}
+				if ep.crl {
+					assert.Equal(t, "X509 CRL", block.Type, msg)
+				} else {
+					assert.Equal(t, "CERTIFICATE", block.Type, msg)
+					if ep.filename == "cert" {
+						chain, _ := pem.Decode(rest)
+						if assert.NotNil(t, chain, "%s should return the CA chain after the certificate", msg) {
+							assert.Equal(t, caCert.Raw, chain.Bytes, msg)
+						}
+					}
+				}
+				der = block.Bytes
+			}
+			if ep.crl {
+				crl, err := x509.ParseDERCRL(der)
+				if assert.NoError(t, err, msg) {
+					assert.NoError(t, caCert.CheckCRLSignature(crl), msg)
+				}
+				continue
+			}
+			cert, err := x509.ParseCertificate(der)
+			if !assert.NoError(t, err, msg) {
+				continue
+			}
+			if ep.filename == "cert" {
+				assert.Equal(t, "admin", cert.Subject.CommonName, msg)
+			} else {
+				assert.Equal(t, caCert.Raw, cert.Raw, msg)
+			}
+		}
+	}
+
+	// A HEAD request has no body in any encoding
+	req := newRequest("HEAD", "v1/cainfo", nil, authNone)
+	req.Header.Set("Accept", mediaTypePEM)
+	resp, err := http.DefaultClient.Do(req)
+	util.FatalError(t, err, "Failed to send HEAD request")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	// An error is returned in an error envelope whatever the Accept header
+	req = newRequest("POST", "v1/enroll", enrollBody, authNone)
+	req.Header.Set("Accept", mediaTypeCert)
+	resp, err = http.DefaultClient.Do(req)
+	util.FatalError(t, err, "Failed to send enroll request")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, mediaTypeJSON, resp.Header.Get("Content-Type"))
+
+	// The client requests each format
+	for _, format := range []Format{FormatJSON, FormatPEM, FormatDER} {
+		chain, err := client.GetCAInfoAs(&api.GetCAInfoRequest{}, format)
+		if assert.NoError(t, err, "Failed to get the CA chain as %s", format) {
+			switch format {
+			case FormatDER:
+				assert.Equal(t, caCert.Raw, chain)
+			case FormatPEM:
+				assert.Contains(t, string(chain), "BEGIN CERTIFICATE")
+			default:
+				assert.Contains(t, string(chain), `"CAChain"`)
+			}
+		}
+		crl, err := id.GenCRLAs(&api.GenCRLRequest{}, format)
+		if assert.NoError(t, err, "Failed to generate the CRL as %s", format) {
+			if format == FormatJSON {
+				assert.Contains(t, string(crl), `"CRL"`)
+			} else {
+				_, err = x509.ParseCRL(crl)
+				assert.NoError(t, err, "The CRL should be %s-encoded", format)
+			}
+		}
+	}
+	_, err = client.GetCAInfoAs(&api.GetCAInfoRequest{}, Format("txt"))
+	assert.Error(t, err, "An unknown format should fail")
+}
+
+func TestEncodedResultOfOldServer(t *testing.T) {
+	// A server which does not negotiate the content returns JSON
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"result":{"CAName":"ca"},"errors":[],"messages":[],"success":true}`))
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "encodedresult")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(dir)
+	client := &Client{Config: &ClientConfig{URL: ts.URL}, HomeDir: dir}
+	_, err = client.GetCAInfoAs(&api.GetCAInfoRequest{}, FormatPEM)
+	util.ErrorContains(t, err, "may not support this format", "A JSON response to a PEM request should fail")
+}
@@ -9,12 +9,18 @@ package lib
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/cloudflare/cfssl/api"
 	"github.com/cloudflare/cfssl/log"
 	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/util"
 )
 
+// requestIDHeader is the response header containing the ID which identifies
+// the request in the server's log
+const requestIDHeader = "X-Request-Id"
+
 // serverEndpoint represents a particular endpoint (e.g. to "/api/v1/enroll")
 type serverEndpoint struct {
 	// The HTTP methods ("GET", "POST", etc) which the function will handle
@@ -25,40 +31,142 @@ type serverEndpoint struct {
 	Handler func(ctx *serverRequestContextImpl) (interface{}, error)
 	// Server which hosts this endpoint
 	Server *Server
+	// How the handler authenticates the invoker, for the API document
+	auth authPolicy
+	// The operations of the endpoint in the API document by HTTP method
+	docs map[string]operationDoc
+	// The encodings other than JSON in which the result may be returned
+	encodings []resultEncoding
+	// True if a request may have an idempotency key, so that a retry of the
+	// request returns its stored response rather than being processed again
+	idempotent bool
+}
+
+// authPolicy is how an endpoint authenticates the invoker of a request
+type authPolicy int
+
+const (
+	// authNone is the policy of an endpoint which anyone may invoke
+	authNone authPolicy = iota
+	// authBasic is the policy of an endpoint which requires the enrollment ID
+	// and secret of the invoker
+	authBasic
+	// authToken is the policy of an endpoint which requires a token signed
+	// with the key of the invoker's enrollment certificate
+	authToken
+	// authBasicOrToken is the policy of an endpoint which requires either
+	authBasicOrToken
+	// authAdmin is the policy of an endpoint which administers the server: it
+	// requires the token of an identity with the "hf.Admin" attribute unless
+	// the request is received by the admin listener
+	authAdmin
+)
+
+// operationDoc describes a method of an endpoint in the API document
+type operationDoc struct {
+	// Summary of what the method does
+	summary string
+	// A value of the type of the request body, or nil if it has none
+	request interface{}
+	// A value of the type of the result of a successful response, or nil if
+	// it has none
+	response interface{}
+	// Descriptions of the query parameters by name
+	query map[string]string
+	// Content type of a successful response which is not a JSON result
+	contentType string
+}
+
+// handle calls the endpoint handler. The handler uses the configuration
+// snapshot of the request, so a reload during the request does not affect it.
+func (se *serverEndpoint) handle(ctx *serverRequestContextImpl) (interface{}, error) {
+	if key := ctx.req.Header.Get(IdempotencyKeyHeader); se.idempotent && key != "" {
+		return se.handleIdempotent(ctx, key)
+	}
+	return se.Handler(ctx)
 }
 
 // ServeHTTP encapsulates the call to underlying Handlers to handle the request
 // and return the response with a proper HTTP status code
 func (se *serverEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var resp interface{}
-	url := r.URL.String()
-	log.Debugf("Received request for %s", url)
+	info := getRequestInfo(r)
+	if info == nil {
+		// The endpoint was called directly rather than through the
+		// middleware, so identify the request here
+		info = &requestInfo{id: util.RandomString(16), start: time.Now()}
+		w.Header().Set(requestIDHeader, info.id)
+	}
+	if len(se.encodings) > 0 {
+		// Set before the handler may stream its result
+		w.Header().Add("Vary", "Accept")
+	}
 	w = newHTTPResponseWriter(r, w, se)
+	ctx := newServerRequestContext(r, w, se)
+	// The buffer of the body is reused once the response is written
+	defer ctx.releaseBody()
 	err := se.validateMethod(r)
 	if err == nil {
 		// Call the endpoint handler to handle the request.  The handler may
 		// a) return the response in the 'resp' variable below, or
 		// b) write the response one chunk at a time, which is appropriate if the response may be large
 		//    and we don't want the server to buffer the entire response in memory.
-		resp, err = se.Handler(newServerRequestContext(r, w, se))
+		resp, err = se.handle(ctx)
 	}
+	hrw := w.(*httpResponseWriter)
+	if hrw.encoded {
+		// The handler has written its result in an encoding other than JSON
+		info.identity = ctx.enrollmentID
+		he := getHTTPErr(err)
+		se.audit(r, ctx, info, he)
+		if he != nil {
+			info.code = he.GetLocalCode()
+			info.msg = he.GetLocalMsg()
+			log.Errorf("Failed to write the response of %s %s: %s", r.Method, r.URL.Path, he.GetLocalMsg())
+			// Abort the connection so that the client does not mistake the
+			// truncated response for a complete one
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+	if len(se.encodings) > 0 {
+		if enc := se.negotiateEncoding(r); enc != nil && enc.encode != nil && err == nil && resp != nil && !hrw.isHead() {
+			var body []byte
+			body, err = enc.encode(resp)
+			if err == nil {
+				info.identity = ctx.enrollmentID
+				se.audit(r, ctx, info, nil)
+				hrw.writeEncoded(enc, body)
+				return
+			}
+			resp = nil
+		}
+	}
+	// Record the caller and the outcome, which the middleware logs
+	info.identity = ctx.enrollmentID
 	he := getHTTPErr(err)
+	se.audit(r, ctx, info, he)
 	if he != nil {
 		// An error occurred
+		info.code = he.GetLocalCode()
+		info.msg = he.GetLocalMsg()
+		// Unless a streamed response has been started, the error is
+		// returned in an error envelope
+		if !hrw.writeCalled && !se.Server.legacyErrors() {
+			hrw.writeEnvelope(he)
+			return
+		}
 		w.WriteHeader(he.GetStatusCode())
-		log.Infof(`%s %s %s %d %d "%s"`, r.RemoteAddr, r.Method, r.URL, he.GetStatusCode(), he.GetLocalCode(), he.GetLocalMsg())
 	} else {
 		// No error occurred
-		scode := se.getSuccessRC()
-		w.WriteHeader(scode)
-		log.Infof(`%s %s %s %d 0 "OK"`, r.RemoteAddr, r.Method, r.URL, scode)
+		w.WriteHeader(se.getSuccessRC())
 	}
 	// If a response was returned by the handler, write it now.
 	if resp != nil {
 		writeJSON(resp, w)
 	}
 	// If nothing has been written, write an empty string for the response
-	if !w.(*httpResponseWriter).writeCalled {
+	if !hrw.writeCalled {
 		w.Write([]byte(`""`))
 	}
 	// If an error was returned by the handler, write it now.
@@ -100,21 +208,10 @@ func getHTTPErr(err error) *caerrors.HTTPErr {
 	if err == nil {
 		return nil
 	}
-	type causer interface {
-		Cause() error
-	}
-	curErr := err
-	for curErr != nil {
-		switch curErr.(type) {
-		case *caerrors.HTTPErr:
-			return curErr.(*caerrors.HTTPErr)
-		case causer:
-			curErr = curErr.(causer).Cause()
-		default:
-			return caerrors.CreateHTTPErr(500, caerrors.ErrUnknown, err.Error())
-		}
+	if he := caerrors.AsHTTPErr(err); he != nil {
+		return he
 	}
-	return caerrors.CreateHTTPErr(500, caerrors.ErrUnknown, "nil error")
+	return caerrors.CreateHTTPErr(500, caerrors.ErrUnknown, "%s", err)
 }
 
 func writeJSON(obj interface{}, w http.ResponseWriter) {
@@ -134,6 +231,8 @@ type httpResponseWriter struct {
 	se                *serverEndpoint
 	writeHeaderCalled bool
 	writeCalled       bool
+	// True once a result has been written in an encoding other than JSON
+	encoded bool
 }
 
 // Header returns the header map that will be sent by WriteHeader.
@@ -145,7 +244,11 @@ func (hrw *httpResponseWriter) Header() http.Header {
 func (hrw *httpResponseWriter) WriteHeader(scode int) {
 	if !hrw.writeHeaderCalled {
 		w := hrw.w
-		w.Header().Set("Connection", "Keep-Alive")
+		// The connection of a request whose body was not received in full
+		// is closed
+		if w.Header().Get("Connection") != "close" {
+			w.Header().Set("Connection", "Keep-Alive")
+		}
 		if hrw.isHead() {
 			w.Header().Set("Content-Length", "0")
 		} else {
@@ -182,6 +285,15 @@ func (hrw *httpResponseWriter) Write(buf []byte) (int, error) {
 	return w.Write(buf)
 }
 
+// writeEnvelope writes the error envelope of 'he' as the whole response
+func (hrw *httpResponseWriter) writeEnvelope(he *caerrors.HTTPErr) {
+	hrw.WriteHeader(he.GetEnvelopeStatusCode())
+	if !hrw.isHead() {
+		writeJSON(he.Envelope(), hrw.w)
+	}
+	hrw.Flush()
+}
+
 func (hrw *httpResponseWriter) Flush() {
 	hrw.w.(http.Flusher).Flush()
 }
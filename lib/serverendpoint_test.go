@@ -11,10 +11,15 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
 
-	"github.com/cloudflare/cfssl/api"
+	cfsslapi "github.com/cloudflare/cfssl/api"
+	"github.com/hyperledger/fabric-ca/api"
 	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/lib/spi"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -31,9 +36,57 @@ func TestServerEndpoint(t *testing.T) {
 	testEndpoint(t, "DELETE", url, 405, caerrors.ErrMethodNotAllowed)
 	handlerError = caerrors.NewAuthenticationErr(caerrors.ErrInvalidToken, "Invalid token")
 	testEndpoint(t, "GET", url, 401, caerrors.ErrAuthenticationFailure)
+	handlerError = nil
+}
+
+func TestServerEndpointErrorClasses(t *testing.T) {
+	url := "http://localhost:7054/api/v1/enroll"
+	defer func() { handlerError = nil }()
+	tests := []struct {
+		err          error
+		class        caerrors.Class
+		scode        int
+		legacyStatus int
+	}{
+		{caerrors.NewAuthenticationErr(caerrors.ErrInvalidPass, "Wrong password"), caerrors.ClassAuthentication, 401, 401},
+		{caerrors.NewAuthorizationErr(caerrors.ErrNoAdminAuth, "Not an admin"), caerrors.ClassAuthorization, 403, 403},
+		{caerrors.NewHTTPErr(404, caerrors.ErrCANotFound, "CA not found"), caerrors.ClassNotFound, 404, 404},
+		{caerrors.NewHTTPErr(404, caerrors.ErrCertAlreadyRevoked, "Already revoked"), caerrors.ClassAlreadyExists, 409, 404},
+		{caerrors.NewHTTPErr(409, caerrors.ErrIdentityExists, "Already registered"), caerrors.ClassAlreadyExists, 409, 409},
+		{caerrors.NewHTTPErr(403, caerrors.ErrInvalidLDAPAction, "Not with LDAP"), caerrors.ClassPolicyViolation, 422, 403},
+		{caerrors.NewHTTPErr(504, caerrors.ErrConnectingDB, "No database"), caerrors.ClassBackendUnavailable, 503, 504},
+		{caerrors.NewHTTPErr(400, caerrors.ErrBadReqBody, "Bad body"), caerrors.ClassValidation, 400, 400},
+		{caerrors.NewNotFoundErr(caerrors.ErrRevokeIDNotFound, "Identity not found"), caerrors.ClassNotFound, 404, 404},
+		{caerrors.NewConflictErr(caerrors.ErrIdentityExists, "Already registered"), caerrors.ClassAlreadyExists, 409, 409},
+		{caerrors.NewValidationErr(caerrors.ErrBadCSR, "Bad CSR"), caerrors.ClassValidation, 400, 400},
+		{caerrors.NewUnavailableErr(caerrors.ErrConnectingDB, errors.New("dial tcp: connection refused"), "No database"), caerrors.ClassBackendUnavailable, 503, 503},
+		{caerrors.NewInternalErr(caerrors.ErrRevokeFailure, errors.New("constraint failed"), "Revoke failed"), caerrors.ClassInternal, 500, 500},
+		{errors.New("Failure"), caerrors.ClassInternal, 500, 500},
+	}
+	for _, test := range tests {
+		handlerError = test.err
+		he := getHTTPErr(test.err)
+		body := testEndpoint(t, "POST", url, test.scode, he.GetRemoteCode())
+		assert.Equal(t, test.class, body.Code)
+		assert.Equal(t, he.GetRemoteMsg(), body.Message)
+		lbody := testLegacyEndpoint(t, "POST", url, test.legacyStatus)
+		if assert.Len(t, lbody.Errors, 1) {
+			assert.Equal(t, he.GetRemoteCode(), lbody.Errors[0].Code)
+			assert.Equal(t, he.GetRemoteMsg(), lbody.Errors[0].Message)
+		}
+		assert.False(t, lbody.Success)
+	}
+	handlerError = nil
+	// A disallowed method is an invalid request with status 405
+	body := testEndpoint(t, "DELETE", url, 405, caerrors.ErrMethodNotAllowed)
+	assert.Equal(t, caerrors.ClassValidation, body.Code)
 }
 
-func testEndpoint(t *testing.T, method, url string, scode, rcode int) {
+// testEndpoint sends a request to an endpoint which returns the result of
+// testEndpointHandler, checks that its response has the status code
+// 'scode' and, if it is an error, that it is the error envelope of an error
+// with the code 'rcode', which it returns
+func testEndpoint(t *testing.T, method, url string, scode, rcode int) *caerrors.ErrorResponse {
 	se := &serverEndpoint{
 		Methods: []string{"GET", "POST", "HEAD"},
 		Handler: testEndpointHandler,
@@ -43,22 +96,143 @@ func testEndpoint(t *testing.T, method, url string, scode, rcode int) {
 	w := httptest.NewRecorder()
 	se.ServeHTTP(w, r)
 	resp := w.Result()
-	assert.True(t, resp.StatusCode == scode)
+	assert.Equal(t, scode, resp.StatusCode)
 	buf, err := ioutil.ReadAll(resp.Body)
 	assert.NoError(t, err)
+	envelope := &caerrors.ErrorResponse{}
 	if method != "HEAD" {
-		var body api.Response
-		err = json.Unmarshal(buf, &body)
-		assert.NoError(t, err)
-		if rcode == 0 {
+		if scode < 400 {
+			var body cfsslapi.Response
+			err = json.Unmarshal(buf, &body)
+			assert.NoError(t, err)
 			assert.True(t, len(body.Errors) == 0)
 		} else {
-			assert.True(t, body.Errors[0].Code == rcode)
+			err = json.Unmarshal(buf, envelope)
+			assert.NoError(t, err)
+			assert.Equal(t, rcode, envelope.Details.ErrorCode)
 		}
 	} else {
 		// No response body
 		assert.True(t, len(buf) == 0)
 	}
+	return envelope
+}
+
+// testLegacyEndpoint sends a request to an endpoint of a server which returns
+// errors in the legacy format, checks that its response has the status code
+// 'scode' and returns the response
+func testLegacyEndpoint(t *testing.T, method, url string, scode int) *cfsslapi.Response {
+	se := &serverEndpoint{
+		Methods: []string{"GET", "POST", "HEAD"},
+		Handler: testEndpointHandler,
+		Server:  &Server{Config: &ServerConfig{API: APIConfig{LegacyErrors: true}}},
+	}
+	r, err := http.NewRequest(method, url, nil)
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	se.ServeHTTP(w, r)
+	resp := w.Result()
+	assert.Equal(t, scode, resp.StatusCode)
+	body := &cfsslapi.Response{}
+	err = json.NewDecoder(resp.Body).Decode(body)
+	assert.NoError(t, err)
+	return body
+}
+
+// The client returns the class of each error, whether the server returns it in
+// an error envelope or in the legacy format
+func TestResponseErrorClass(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		srv := TestGetRootServer(t)
+		srv.Config.API.LegacyErrors = legacy
+		err := srv.Start()
+		util.FatalError(t, err, "Failed to start server")
+		client := TestGetRootClient()
+		requireClass := func(err error, class caerrors.Class, scode, code int) {
+			re, ok := errors.Cause(err).(*ResponseError)
+			if !assert.True(t, ok, "Expected a response error but got: %v", err) {
+				return
+			}
+			assert.Equal(t, class, re.Class, "legacy errors: %v", legacy)
+			assert.Equal(t, scode, re.StatusCode, "legacy errors: %v", legacy)
+			if assert.Len(t, re.Errors, 1) {
+				assert.Equal(t, code, re.Errors[0].Code)
+			}
+		}
+
+		_, err = client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "wrongpw"})
+		requireClass(err, caerrors.ClassAuthentication, 401, caerrors.ErrAuthenticationFailure)
+		_, err = client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw", CAName: "unknownca"})
+		requireClass(err, caerrors.ClassNotFound, 404, caerrors.ErrCANotFound)
+		eresp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+		util.FatalError(t, err, "Failed to enroll 'admin'")
+		_, err = eresp.Identity.Register(&api.RegistrationRequest{Name: "admin", Affiliation: "org1"})
+		requireClass(err, caerrors.ClassAlreadyExists, 409, caerrors.ErrIdentityExists)
+
+		err = srv.Stop()
+		util.FatalError(t, err, "Failed to stop server")
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}
+}
+
+// failingRegistry is a user registry whose database fails to insert
+// identities, and fails to get the identity 'unavailable'
+type failingRegistry struct {
+	spi.UserRegistry
+}
+
+// failingDBErr is the error of the database of failingRegistry, which must
+// not be returned to clients
+var failingDBErr = errors.New("pq: password authentication failed for user \"fabric\" at 10.0.0.5:5432")
+
+func (r *failingRegistry) GetUser(id string, attrs []string) (spi.User, error) {
+	if id == "unavailable" {
+		return nil, caerrors.NewUnavailableErr(caerrors.ErrConnectingDB, failingDBErr, "Failed to process database request")
+	}
+	return r.UserRegistry.GetUser(id, attrs)
+}
+
+func (r *failingRegistry) InsertUser(user *spi.UserInfo) error {
+	return failingDBErr
+}
+
+// TestHandlerErrorsNotLeaked verifies that the enroll, register and revoke
+// handlers return the class of a failure of the database, but not its error
+func TestHandlerErrorsNotLeaked(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	client := TestGetRootClient()
+	eresp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin'")
+	admin := eresp.Identity
+	srv.CA.registry = &failingRegistry{UserRegistry: srv.CA.registry}
+
+	requireClass := func(err error, class caerrors.Class, scode int) {
+		re, ok := errors.Cause(err).(*ResponseError)
+		if !assert.True(t, ok, "Expected a response error but got: %v", err) {
+			return
+		}
+		assert.Equal(t, class, re.Class, "%s", re)
+		assert.Equal(t, scode, re.StatusCode, "%s", re)
+		for _, detail := range []string{"10.0.0.5", "pq:", "fabric"} {
+			assert.NotContains(t, re.Error(), detail, "The response should not have the database error")
+		}
+	}
+	_, err = admin.Register(&api.RegistrationRequest{Name: "user1", Affiliation: "org1"})
+	requireClass(err, caerrors.ClassInternal, 500)
+	_, err = admin.Revoke(&api.RevocationRequest{Name: "unavailable"})
+	requireClass(err, caerrors.ClassBackendUnavailable, 503)
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "unavailable", Secret: "secret"})
+	requireClass(err, caerrors.ClassBackendUnavailable, 503)
+	_, err = admin.Revoke(&api.RevocationRequest{Name: "nobody"})
+	requireClass(err, caerrors.ClassNotFound, 404)
 }
 
 func testEndpointHandler(ctx *serverRequestContextImpl) (interface{}, error) {
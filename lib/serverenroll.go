@@ -9,7 +9,9 @@ package lib
 import (
 	"crypto/x509"
 	"encoding/asn1"
+	"encoding/hex"
 	"encoding/pem"
+	"strings"
 	"time"
 
 	"github.com/cloudflare/cfssl/config"
@@ -20,6 +22,7 @@ import (
 	"github.com/hyperledger/fabric-ca/api"
 	"github.com/hyperledger/fabric-ca/lib/caerrors"
 	"github.com/hyperledger/fabric-ca/lib/common"
+	"github.com/hyperledger/fabric-ca/lib/metadata"
 	"github.com/hyperledger/fabric-ca/lib/spi"
 	"github.com/hyperledger/fabric-ca/util"
 	"github.com/pkg/errors"
@@ -53,6 +56,11 @@ func newEnrollEndpoint(s *Server) *serverEndpoint {
 		Handler:   enrollHandler,
 		Server:    s,
 		successRC: 201,
+		auth:      authBasic,
+		docs: map[string]operationDoc{
+			"POST": {summary: "Enroll an identity", request: &api.EnrollmentRequestNet{}, response: &common.EnrollmentResponseNet{}},
+		},
+		encodings: certEncodings("cert"),
 	}
 }
 
@@ -62,6 +70,25 @@ func newReenrollEndpoint(s *Server) *serverEndpoint {
 		Handler:   reenrollHandler,
 		Server:    s,
 		successRC: 201,
+		auth:      authToken,
+		docs: map[string]operationDoc{
+			"POST": {summary: "Reenroll an identity", request: &api.ReenrollmentRequestNet{}, response: &common.EnrollmentResponseNet{}},
+		},
+		encodings: certEncodings("cert"),
+	}
+}
+
+func newEnrollV2Endpoint(s *Server) *serverEndpoint {
+	return &serverEndpoint{
+		Methods:   []string{"POST"},
+		Handler:   enrollV2Handler,
+		Server:    s,
+		successRC: 201,
+		auth:      authBasic,
+		docs: map[string]operationDoc{
+			"POST": {summary: "Enroll an identity", request: &api.EnrollmentRequestNet{}, response: &common.EnrollmentResponseNetV2{}},
+		},
+		encodings: certEncodings("cert"),
 	}
 }
 
@@ -71,7 +98,7 @@ func enrollHandler(ctx *serverRequestContextImpl) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-	resp, err := handleEnroll(ctx, id)
+	resp, err := handleEnroll(ctx, id, EventCertIssued)
 	if err != nil {
 		return nil, err
 	}
@@ -89,11 +116,54 @@ func reenrollHandler(ctx *serverRequestContextImpl) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-	return handleEnroll(ctx, id)
+	return handleEnroll(ctx, id, EventCertReenrolled)
+}
+
+// Handle a v2 enroll request, whose response is an EnrollmentResponseNetV2
+func enrollV2Handler(ctx *serverRequestContextImpl) (interface{}, error) {
+	resp, err := enrollHandler(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newEnrollmentResponseV2(resp.(*common.EnrollmentResponseNet))
+}
+
+// newEnrollmentResponseV2 returns the v2 enroll response with the
+// certificate and CA information of the v1 response 'resp'
+func newEnrollmentResponseV2(resp *common.EnrollmentResponseNet) (*common.EnrollmentResponseNetV2, error) {
+	certPEM, err := util.B64Decode(resp.Cert)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := util.GetX509CertificateFromPEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	chainPEM, err := util.B64Decode(resp.ServerInfo.CAChain)
+	if err != nil {
+		return nil, err
+	}
+	chain := []string{}
+	for block, rest := pem.Decode(chainPEM); block != nil; block, rest = pem.Decode(rest) {
+		chain = append(chain, string(pem.EncodeToMemory(block)))
+	}
+	return &common.EnrollmentResponseNetV2{
+		Certificate:  string(certPEM),
+		SerialNumber: util.GetSerialAsHex(cert.SerialNumber),
+		NotBefore:    cert.NotBefore.UTC().Format(time.RFC3339),
+		NotAfter:     cert.NotAfter.UTC().Format(time.RFC3339),
+		CA: common.CAInfoResponseNetV2{
+			Name:                      resp.ServerInfo.CAName,
+			Chain:                     chain,
+			IssuerPublicKey:           resp.ServerInfo.IssuerPublicKey,
+			IssuerRevocationPublicKey: resp.ServerInfo.IssuerRevocationPublicKey,
+			Version:                   metadata.GetVersion(),
+		},
+	}, nil
 }
 
 // Handle the common processing for enroll and reenroll
-func handleEnroll(ctx *serverRequestContextImpl, id string) (interface{}, error) {
+func handleEnroll(ctx *serverRequestContextImpl, id, event string) (interface{}, error) {
 	var req api.EnrollmentRequestNet
 	err := ctx.ReadBody(&req)
 	if err != nil {
@@ -104,19 +174,40 @@ func handleEnroll(ctx *serverRequestContextImpl, id string) (interface{}, error)
 	if err != nil {
 		return nil, err
 	}
+	cert, err := enrollCertificate(ctx, ca, id, &req, event)
+	if err != nil {
+		return nil, err
+	}
+	// Add server info to the response
+	resp := &common.EnrollmentResponseNet{
+		Cert: util.B64Encode(cert),
+	}
+	err = ca.fillCAInfo(&resp.ServerInfo)
+	if err != nil {
+		return nil, err
+	}
+	// Success
+	return resp, nil
+}
+
+// enrollCertificate signs the enrollment request 'req' of the identity 'id'
+// with the CA 'ca', records the certificate, publishes the event 'event' and
+// returns the PEM-encoded certificate
+func enrollCertificate(ctx *serverRequestContextImpl, ca *CA, id string, req *api.EnrollmentRequestNet, event string) ([]byte, error) {
 	// If NotAfter is not set in the request, then set it to the expiry in the
 	// specified profile
+	cfg := ctx.caConfig(ca)
 	if req.NotAfter.IsZero() {
-		profile := ca.Config.Signing.Default
-		if req.Profile != "" && ca.Config.Signing != nil &&
-			ca.Config.Signing.Profiles != nil && ca.Config.Signing.Profiles[req.Profile] != nil {
-			profile = ca.Config.Signing.Profiles[req.Profile]
+		profile := cfg.signing.Default
+		if req.Profile != "" && cfg.signing != nil &&
+			cfg.signing.Profiles != nil && cfg.signing.Profiles[req.Profile] != nil {
+			profile = cfg.signing.Profiles[req.Profile]
 		}
 		req.NotAfter = time.Now().Round(time.Minute).Add(profile.Expiry).UTC()
 	}
 	caexpiry, err := ca.getCACertExpiry()
 	if err != nil {
-		return nil, errors.New("Failed to get CA certificate information")
+		return nil, caerrors.NewInternalErr(caerrors.ErrGetCACert, err, "Failed to get CA certificate information")
 	}
 
 	// Make sure requested expiration for enrollment certificate is not after CA certificate
@@ -133,6 +224,11 @@ func handleEnroll(ctx *serverRequestContextImpl, id string) (interface{}, error)
 	if err != nil {
 		return nil, err
 	}
+	// An X.509-SVID has the identity's SPIFFE ID and no conflicting names
+	err = ca.processSVIDRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
 	// Get an attribute extension if one is being requested
 	ext, err := ctx.GetAttrExtension(req.AttrReqs, req.Profile)
 	if err != nil {
@@ -144,20 +240,28 @@ func handleEnroll(ctx *serverRequestContextImpl, id string) (interface{}, error)
 		req.Extensions = append(req.Extensions, *ext)
 	}
 	// Sign the certificate
-	cert, err := ca.enrollSigner.Sign(req.SignRequest)
+	cert, err := cfg.enrollSigner.Sign(req.SignRequest)
 	if err != nil {
-		return nil, errors.WithMessage(err, "Certificate signing failure")
+		return nil, caerrors.NewCFSSLErr(caerrors.ErrSigningFailure, err, "Certificate signing failure")
 	}
-	// Add server info to the response
-	resp := &common.EnrollmentResponseNet{
-		Cert: util.B64Encode(cert),
-	}
-	err = ca.fillCAInfo(&resp.ServerInfo)
+	ca.server.publishEvent(event, ca.Config.CA.Name, issuedCertEventData(id, cert))
+	return cert, nil
+}
+
+// issuedCertEventData returns the data of the event of the issuance of the
+// PEM-encoded certificate 'cert' to the identity 'id'
+func issuedCertEventData(id string, cert []byte) *CertificateEventData {
+	data := &CertificateEventData{ID: id, Invoker: id}
+	x509Cert, err := util.GetX509CertificateFromPEM(cert)
 	if err != nil {
-		return nil, err
-	}
-	// Success
-	return resp, nil
+		log.Warningf("Failed to parse the certificate issued to '%s': %s", id, err)
+		return data
+	}
+	data.Serial = util.GetSerialAsHex(x509Cert.SerialNumber)
+	data.AKI = strings.TrimLeft(hex.EncodeToString(x509Cert.AuthorityKeyId), "0")
+	data.NotBefore = &x509Cert.NotBefore
+	data.NotAfter = &x509Cert.NotAfter
+	return data
 }
 
 // Process the sign request.
@@ -172,21 +276,21 @@ func processSignRequest(id string, req *signer.SignRequest, ca *CA, ctx *serverR
 	// Decode and parse the request into a CSR so we can make checks
 	block, _ := pem.Decode([]byte(req.Request))
 	if block == nil {
-		return cferr.New(cferr.CSRError, cferr.DecodeFailed)
+		return caerrors.NewCFSSLErr(caerrors.ErrBadCSR, cferr.New(cferr.CSRError, cferr.DecodeFailed), "Invalid certificate request")
 	}
 	if block.Type != "NEW CERTIFICATE REQUEST" && block.Type != "CERTIFICATE REQUEST" {
-		return cferr.Wrap(cferr.CSRError,
-			cferr.BadRequest, errors.New("not a certificate or csr"))
+		return caerrors.NewCFSSLErr(caerrors.ErrBadCSR, cferr.Wrap(cferr.CSRError,
+			cferr.BadRequest, errors.New("not a certificate or csr")), "Invalid certificate request")
 	}
 	csrReq, err := x509.ParseCertificateRequest(block.Bytes)
 	if err != nil {
-		return err
+		return caerrors.NewValidationErr(caerrors.ErrBadCSR, "Failed parsing CSR: %s", err)
 	}
 	log.Debugf("Processing sign request: id=%s, CommonName=%s, Subject=%+v", id, csrReq.Subject.CommonName, req.Subject)
 	if (req.Subject != nil && req.Subject.CN != id) || csrReq.Subject.CommonName != id {
-		return errors.New("The CSR subject common name must equal the enrollment ID")
+		return caerrors.NewValidationErr(caerrors.ErrBadCSR, "The CSR subject common name must equal the enrollment ID")
 	}
-	isForCACert, err := isRequestForCASigningCert(csrReq, ca, req.Profile)
+	isForCACert, err := isRequestForCASigningCert(csrReq, ctx.caConfig(ca).signing, req.Profile)
 	if err != nil {
 		return err
 	}
@@ -201,7 +305,7 @@ func processSignRequest(id string, req *signer.SignRequest, ca *CA, ctx *serverR
 	// Check the CSR input length
 	err = csrInputLengthCheck(csrReq)
 	if err != nil {
-		return err
+		return caerrors.NewValidationErr(caerrors.ErrBadCSR, "%s", err)
 	}
 	caller, err := ctx.GetCaller()
 	if err != nil {
@@ -216,11 +320,11 @@ func processSignRequest(id string, req *signer.SignRequest, ca *CA, ctx *serverR
 // Check to see if this is a request for a CA signing certificate.
 // This can occur if the profile or the CSR has the IsCA bit set.
 // See the X.509 BasicConstraints extension (RFC 5280, 4.2.1.9).
-func isRequestForCASigningCert(csrReq *x509.CertificateRequest, ca *CA, profile string) (bool, error) {
+func isRequestForCASigningCert(csrReq *x509.CertificateRequest, signing *config.Signing, profile string) (bool, error) {
 	// Check the profile to see if the IsCA bit is set
-	sp := getSigningProfile(ca, profile)
+	sp := getSigningProfile(signing, profile)
 	if sp == nil {
-		return false, errors.Errorf("Invalid profile: '%s'", profile)
+		return false, caerrors.NewValidationErr(caerrors.ErrBadReqBody, "Invalid profile: '%s'", profile)
 	}
 	if sp.CAConstraint.IsCA {
 		log.Debugf("Request is for a CA signing certificate as set in profile '%s'", profile)
@@ -233,9 +337,9 @@ func isRequestForCASigningCert(csrReq *x509.CertificateRequest, ca *CA, profile
 			var rest []byte
 			var err error
 			if rest, err = asn1.Unmarshal(val.Value, &constraints); err != nil {
-				return false, caerrors.NewHTTPErr(400, caerrors.ErrBadCSR, "Failed parsing CSR constraints: %s", err)
+				return false, caerrors.NewValidationErr(caerrors.ErrBadCSR, "Failed parsing CSR constraints: %s", err)
 			} else if len(rest) != 0 {
-				return false, caerrors.NewHTTPErr(400, caerrors.ErrBadCSR, "Trailing data after X.509 BasicConstraints")
+				return false, caerrors.NewValidationErr(caerrors.ErrBadCSR, "Trailing data after X.509 BasicConstraints")
 			}
 			if constraints.IsCA {
 				log.Debug("Request is for a CA signing certificate as indicated in the CSR")
@@ -248,11 +352,11 @@ func isRequestForCASigningCert(csrReq *x509.CertificateRequest, ca *CA, profile
 	return false, nil
 }
 
-func getSigningProfile(ca *CA, profile string) *config.SigningProfile {
+func getSigningProfile(signing *config.Signing, profile string) *config.SigningProfile {
 	if profile == "" {
-		return ca.Config.Signing.Default
+		return signing.Default
 	}
-	return ca.Config.Signing.Profiles[profile]
+	return signing.Profiles[profile]
 }
 
 // Checks to make sure that character limits are not exceeded for CSR fields
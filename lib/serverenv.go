@@ -0,0 +1,321 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+)
+
+// legacyEnvVarPrefix is the prefix of the environment variables of the
+// server's configuration from before the project was named fabric-ca
+const legacyEnvVarPrefix = "FABRIC_COP"
+
+// envVarPrefixes are the prefixes of the environment variables which
+// override the server's configuration, in order of precedence
+var envVarPrefixes = []string{serverEnvVarPrefix + "_", legacyEnvVarPrefix + "_"}
+
+// durationType is the type of the fields which are parsed as durations
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// EnvOverrides are the settings of the server's configuration which are
+// overridden by environment variables. The variable of a setting is its path
+// in the configuration file in upper case, with underscores rather than dots,
+// after the FABRIC_CA_SERVER_ prefix or the legacy FABRIC_COP_ prefix: for
+// example, FABRIC_CA_SERVER_DB_TLS_CLIENT_CERTFILE overrides db.tls.client.certfile.
+type EnvOverrides struct {
+	// The environment variable which overrides each setting, by path
+	vars map[string]string
+	// The value of each overridden setting, by path
+	values map[string]string
+}
+
+// GetEnvOverrides returns the settings of the server's configuration which
+// are overridden by the environment variables in 'environ', which is in the
+// form of os.Environ(). An error naming the variable is returned if the value
+// of a variable can't be parsed as the type of its setting.
+func GetEnvOverrides(environ []string) (*EnvOverrides, error) {
+	eo := &EnvOverrides{vars: map[string]string{}, values: map[string]string{}}
+	// The path of each setting, by environment variable key
+	paths := map[string]string{}
+	collect := func(path string, f reflect.Value) error {
+		paths[envKey(path)] = path
+		return nil
+	}
+	cfg := &ServerConfig{}
+	walkConfig(reflect.ValueOf(cfg).Elem(), "", collect, allocateAll)
+	walkConfig(reflect.ValueOf(&cfg.CAcfg).Elem(), "", collect, allocateAll)
+
+	// Variables with a prefix of lower precedence are looked at first, so
+	// that those with a prefix of higher precedence replace them
+	for i := len(envVarPrefixes) - 1; i >= 0; i-- {
+		prefix := envVarPrefixes[i]
+		for _, kv := range environ {
+			idx := strings.Index(kv, "=")
+			if idx < 0 || !strings.HasPrefix(kv[:idx], prefix) {
+				continue
+			}
+			name, value := kv[:idx], kv[idx+1:]
+			path, ok := paths[strings.ToUpper(strings.TrimPrefix(name, prefix))]
+			if !ok {
+				continue
+			}
+			eo.vars[path] = name
+			eo.values[path] = value
+		}
+	}
+
+	// Check that each value can be parsed
+	check := func(path string, f reflect.Value) error {
+		if _, ok := eo.values[path]; ok {
+			return eo.set(path, f)
+		}
+		return nil
+	}
+	err := walkConfig(reflect.ValueOf(cfg).Elem(), "", check, allocateAll)
+	if err != nil {
+		return nil, err
+	}
+	err = walkConfig(reflect.ValueOf(&cfg.CAcfg).Elem(), "", check, allocateAll)
+	if err != nil {
+		return nil, err
+	}
+	return eo, nil
+}
+
+// Apply sets the overridden settings in 'cfg', except those for which
+// 'isSetOnCommandLine' returns true, whose command line flags take precedence
+// over the environment. 'isSetOnCommandLine' may be nil.
+func (eo *EnvOverrides) Apply(cfg *ServerConfig, isSetOnCommandLine func(path string) bool) error {
+	if len(eo.values) == 0 {
+		return nil
+	}
+	apply := func(path string, f reflect.Value) error {
+		if _, ok := eo.values[path]; !ok {
+			return nil
+		}
+		if isSetOnCommandLine != nil && isSetOnCommandLine(path) {
+			log.Debugf("Ignoring environment variable %s because '%s' is set on the command line", eo.vars[path], path)
+			return nil
+		}
+		// The value is not logged because it may be a secret
+		log.Debugf("Setting '%s' from environment variable %s", path, eo.vars[path])
+		return eo.set(path, f)
+	}
+	err := walkConfig(reflect.ValueOf(cfg).Elem(), "", apply, eo.isOverridden)
+	if err != nil {
+		return err
+	}
+	return walkConfig(reflect.ValueOf(&cfg.CAcfg).Elem(), "", apply, eo.isOverridden)
+}
+
+// isSet returns true if the setting at 'path' is overridden
+func (eo *EnvOverrides) isSet(path string) bool {
+	_, ok := eo.values[path]
+	return ok
+}
+
+// isOverridden returns true if a setting under 'path' is overridden
+func (eo *EnvOverrides) isOverridden(path string) bool {
+	for p := range eo.values {
+		if strings.HasPrefix(p, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// set parses the overriding value of the setting at 'path' and sets 'f' to it
+func (eo *EnvOverrides) set(path string, f reflect.Value) error {
+	name, value := eo.vars[path], eo.values[path]
+	switch {
+	case f.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.Errorf("Invalid value '%s' of environment variable %s; a duration such as '10s' is required", value, name)
+		}
+		f.SetInt(int64(d))
+	case f.Kind() == reflect.String:
+		f.SetString(value)
+	case f.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.Errorf("Invalid value '%s' of environment variable %s; 'true' or 'false' is required", value, name)
+		}
+		f.SetBool(b)
+	case f.Kind() == reflect.Int || f.Kind() == reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.Errorf("Invalid value '%s' of environment variable %s; an integer is required", value, name)
+		}
+		f.SetInt(i)
+	case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String:
+		var list []string
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+		f.Set(reflect.ValueOf(list))
+	default:
+		return errors.Errorf("The setting '%s' can't be set by environment variable %s", path, name)
+	}
+	return nil
+}
+
+// walkConfig calls 'fn' with the path and value of each setting of the
+// configuration struct 'v'. Structs which are only reached through a nil
+// pointer are walked if 'allocate' returns true for their path, in which case
+// the pointer is set to a new struct. Structs and maps with the "skip" tag,
+// such as the signing profiles, are not walked.
+func walkConfig(v reflect.Value, prefix string, fn func(path string, f reflect.Value) error, allocate func(path string) bool) error {
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		tf := t.Field(i)
+		f := v.Field(i)
+		if tf.PkgPath != "" {
+			continue // skip unexported fields
+		}
+		name := strings.ToLower(tf.Name)
+		if tag := strings.Split(tf.Tag.Get("mapstructure"), ",")[0]; tag != "" {
+			name = strings.ToLower(tag)
+		}
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+		skip := tf.Tag.Get(util.TagSkip) == "true"
+		switch {
+		case f.Kind() == reflect.Ptr && f.Type().Elem().Kind() == reflect.Struct:
+			if skip {
+				continue
+			}
+			if f.IsNil() {
+				if !allocate(path) {
+					continue
+				}
+				f.Set(reflect.New(f.Type().Elem()))
+			}
+			err := walkConfig(f.Elem(), path, fn, allocate)
+			if err != nil {
+				return err
+			}
+		case f.Kind() == reflect.Struct:
+			if skip {
+				continue
+			}
+			err := walkConfig(f, path, fn, allocate)
+			if err != nil {
+				return err
+			}
+		case f.Kind() == reflect.Map || f.Kind() == reflect.Interface:
+			continue
+		default:
+			err := fn(path, f)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// FlagOverrides are the values of the settings of the server's configuration
+// which are set by command line flags, by path. They are recorded when the
+// server's configuration is loaded, so that the flags still take precedence
+// over the configuration file and the environment when it is reloaded.
+type FlagOverrides map[string]interface{}
+
+// GetFlagOverrides returns the values in 'cfg' of the settings for which
+// 'isSetOnCommandLine' returns true
+func GetFlagOverrides(cfg *ServerConfig, isSetOnCommandLine func(path string) bool) (FlagOverrides, error) {
+	fo := FlagOverrides{}
+	collect := func(path string, f reflect.Value) error {
+		if !isSetOnCommandLine(path) {
+			return nil
+		}
+		v := f
+		if f.Kind() == reflect.Slice && !f.IsNil() {
+			// The value is copied, so that it is not changed with 'cfg'
+			v = reflect.MakeSlice(f.Type(), f.Len(), f.Len())
+			reflect.Copy(v, f)
+		}
+		fo[path] = v.Interface()
+		return nil
+	}
+	err := walkConfig(reflect.ValueOf(cfg).Elem(), "", collect, allocateNone)
+	if err != nil {
+		return nil, err
+	}
+	err = walkConfig(reflect.ValueOf(&cfg.CAcfg).Elem(), "", collect, allocateNone)
+	if err != nil {
+		return nil, err
+	}
+	return fo, nil
+}
+
+// Apply sets the settings in 'cfg' which are set by command line flags to
+// the values of their flags
+func (fo FlagOverrides) Apply(cfg *ServerConfig) error {
+	if len(fo) == 0 {
+		return nil
+	}
+	apply := func(path string, f reflect.Value) error {
+		value, ok := fo[path]
+		if !ok {
+			return nil
+		}
+		v := reflect.ValueOf(value)
+		if v.Type() != f.Type() {
+			return nil
+		}
+		log.Debugf("Setting '%s' from its command line flag", path)
+		f.Set(v)
+		return nil
+	}
+	err := walkConfig(reflect.ValueOf(cfg).Elem(), "", apply, fo.isOverridden)
+	if err != nil {
+		return err
+	}
+	return walkConfig(reflect.ValueOf(&cfg.CAcfg).Elem(), "", apply, fo.isOverridden)
+}
+
+// isSet returns true if the setting at 'path' is set by a command line flag
+func (fo FlagOverrides) isSet(path string) bool {
+	_, ok := fo[path]
+	return ok
+}
+
+// isOverridden returns true if a setting under 'path' is set by a command
+// line flag
+func (fo FlagOverrides) isOverridden(path string) bool {
+	for p := range fo {
+		if strings.HasPrefix(p, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// envKey returns the key of the environment variables of the setting at 'path'
+func envKey(path string) string {
+	return strings.ToUpper(strings.Replace(path, ".", "_", -1))
+}
+
+func allocateAll(path string) bool {
+	return true
+}
+
+func allocateNone(path string) bool {
+	return false
+}
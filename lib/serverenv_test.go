@@ -0,0 +1,101 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvOverrides(t *testing.T) {
+	environ := []string{
+		"FABRIC_CA_SERVER_PORT=7999",
+		"FABRIC_CA_SERVER_DEBUG=true",
+		"FABRIC_CA_SERVER_DB_TLS_CLIENT_CERTFILE=client.pem",
+		"FABRIC_CA_SERVER_OPERATIONS_HEALTHCHECKINTERVAL=45s",
+		"FABRIC_CA_SERVER_CAFILES=ca1/fabric-ca-config.yaml, ca2/fabric-ca-config.yaml",
+		"FABRIC_COP_CA_NAME=legacyca",
+		"FABRIC_COP_BCCSP_SW_HASH=SHA3",
+		"FABRIC_CA_SERVER_BCCSP_SW_HASH=SHA2",
+		"FABRIC_CA_SERVER_UNKNOWN_SETTING=oops",
+		"PATH=/usr/bin",
+	}
+	overrides, err := GetEnvOverrides(environ)
+	util.FatalError(t, err, "Failed to get the environment overrides")
+
+	cfg := &ServerConfig{Port: 7054}
+	cfg.CAcfg.CA.Name = "fileca"
+	cfg.CAcfg.CA.Keyfile = "key.pem"
+	err = overrides.Apply(cfg, nil)
+	util.FatalError(t, err, "Failed to apply the environment overrides")
+	assert.Equal(t, 7999, cfg.Port)
+	assert.True(t, cfg.Debug)
+	assert.Equal(t, "client.pem", cfg.CAcfg.DB.TLS.Client.CertFile)
+	assert.Equal(t, 45*time.Second, cfg.Operations.HealthCheckInterval)
+	assert.Equal(t, []string{"ca1/fabric-ca-config.yaml", "ca2/fabric-ca-config.yaml"}, cfg.CAfiles)
+	assert.Equal(t, "legacyca", cfg.CAcfg.CA.Name, "The legacy FABRIC_COP_ prefix should be supported")
+	assert.Equal(t, "key.pem", cfg.CAcfg.CA.Keyfile, "Settings which are not overridden should be unchanged")
+	if assert.NotNil(t, cfg.CAcfg.CSP) && assert.NotNil(t, cfg.CAcfg.CSP.SwOpts) {
+		assert.Equal(t, "SHA2", cfg.CAcfg.CSP.SwOpts.HashFamily, "FABRIC_CA_SERVER_ should take precedence over FABRIC_COP_")
+	}
+	assert.Nil(t, cfg.CAcfg.CSP.PluginOpts, "Settings which are not overridden should not be allocated")
+
+	// Command line flags take precedence over the environment
+	cfg = &ServerConfig{Port: 7054}
+	err = overrides.Apply(cfg, func(path string) bool { return path == "port" })
+	util.FatalError(t, err, "Failed to apply the environment overrides")
+	assert.Equal(t, 7054, cfg.Port, "A setting on the command line should not be overridden")
+	assert.True(t, cfg.Debug)
+}
+
+func TestEnvOverridesInvalid(t *testing.T) {
+	invalid := map[string]string{
+		"FABRIC_CA_SERVER_DEBUG=yes":                         "FABRIC_CA_SERVER_DEBUG",
+		"FABRIC_CA_SERVER_PORT=70x4":                         "FABRIC_CA_SERVER_PORT",
+		"FABRIC_COP_REGISTRY_MAXENROLLMENTS=-1.5":            "FABRIC_COP_REGISTRY_MAXENROLLMENTS",
+		"FABRIC_CA_SERVER_OPERATIONS_HEALTHCHECKINTERVAL=10": "FABRIC_CA_SERVER_OPERATIONS_HEALTHCHECKINTERVAL",
+	}
+	for kv, name := range invalid {
+		_, err := GetEnvOverrides([]string{kv})
+		if assert.Error(t, err, "An invalid value of %s should fail", name) {
+			assert.Contains(t, err.Error(), name, "The error should name the environment variable")
+		}
+	}
+}
+
+func TestEnvOverridesConfigFile(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+	err := os.MkdirAll(rootDir, 0755)
+	util.FatalError(t, err, "Failed to create directory")
+	cfgFile := filepath.Join(rootDir, "fabric-ca-server-config.yaml")
+	cfgYaml := "port: 7060\ndebug: true\nca:\n  name: fileca\n  keyfile: key.pem\n"
+	err = ioutil.WriteFile(cfgFile, []byte(cfgYaml), 0644)
+	util.FatalError(t, err, "Failed to write config file")
+
+	os.Setenv("FABRIC_CA_SERVER_CA_NAME", "envca")
+	os.Setenv("FABRIC_COP_DEBUG", "false")
+	defer os.Unsetenv("FABRIC_CA_SERVER_CA_NAME")
+	defer os.Unsetenv("FABRIC_COP_DEBUG")
+	cfg, err := readServerConfig(cfgFile, nil)
+	util.FatalError(t, err, "Failed to read config file")
+	assert.Equal(t, "envca", cfg.CAcfg.CA.Name, "The environment should override the config file")
+	assert.False(t, cfg.Debug, "The legacy environment variables should override the config file")
+	assert.Equal(t, "key.pem", cfg.CAcfg.CA.Keyfile)
+	assert.Equal(t, 7060, cfg.Port)
+
+	os.Setenv("FABRIC_CA_SERVER_PORT", "not-a-port")
+	defer os.Unsetenv("FABRIC_CA_SERVER_PORT")
+	_, err = readServerConfig(cfgFile, nil)
+	util.ErrorContains(t, err, "FABRIC_CA_SERVER_PORT", "An invalid environment variable should fail")
+}
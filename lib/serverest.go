@@ -0,0 +1,200 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/cfssl/signer"
+	gmux "github.com/gorilla/mux"
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/lib/scep"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	// The path of the EST responder of the default CA (RFC 7030, 3.2.2); the
+	// responder of another CA is served under the path followed by the CA name
+	estPath = "/.well-known/est"
+	// The content types of EST requests and responses
+	estCSRMIME       = "application/pkcs10"
+	estCACertsMIME   = "application/pkcs7-mime"
+	estCertsOnlyMIME = "application/pkcs7-mime; smime-type=certs-only"
+	// The length of the lines of a base64-encoded response
+	estBase64LineLength = 76
+)
+
+// checkESTConfig checks that the signing profile of the CA's EST responder
+// exists if the responder is enabled
+func (ca *CA) checkESTConfig() error {
+	c := &ca.Config.EST
+	if c.Enabled && getSigningProfile(ca.Config.Signing, c.Profile) == nil {
+		return errors.Errorf("The EST signing profile '%s' does not exist", c.Profile)
+	}
+	return nil
+}
+
+// registerESTHandlers registers the handlers of the EST responders of the
+// server's CAs
+func (s *Server) registerESTHandlers() {
+	for _, prefix := range []string{s.basePath() + estPath, s.basePath() + estPath + "/{ca}"} {
+		s.mux.Handle(prefix+"/cacerts", s.wrapEndpoint("est/cacerts", http.HandlerFunc(s.estCACertsHandler))).Methods("GET")
+		s.mux.Handle(prefix+"/simpleenroll", s.wrapEndpoint("est/simpleenroll", s.estEnrollHandler(false))).Methods("POST")
+		s.mux.Handle(prefix+"/simplereenroll", s.wrapEndpoint("est/simplereenroll", s.estEnrollHandler(true))).Methods("POST")
+	}
+}
+
+// estCA returns the CA of the EST request 'r', or writes a 404 error if the
+// CA does not exist or its EST responder is not enabled
+func (s *Server) estCA(w http.ResponseWriter, r *http.Request) *CA {
+	name, ok := gmux.Vars(r)["ca"]
+	if !ok {
+		name = s.CA.Config.CA.Name
+	}
+	ca, err := s.GetCA(name)
+	if err != nil || !ca.Config.EST.Enabled {
+		http.Error(w, "EST is not enabled for the CA", http.StatusNotFound)
+		return nil
+	}
+	return ca
+}
+
+// estCACertsHandler writes the CA chain as a base64-encoded degenerate
+// PKCS #7 signed data
+func (s *Server) estCACertsHandler(w http.ResponseWriter, r *http.Request) {
+	ca := s.estCA(w, r)
+	if ca == nil {
+		return
+	}
+	certs, err := ca.getCAChainCertificates()
+	var chain []byte
+	if err == nil {
+		chain, err = scep.DegenerateCertificates(certs)
+	}
+	if err != nil {
+		log.Errorf("Failed to get the CA chain of the EST responder: %s", err)
+		http.Error(w, "Failed to get the CA chain", http.StatusInternalServerError)
+		return
+	}
+	writeESTResponse(w, estCACertsMIME, chain)
+}
+
+// estEnrollHandler returns the handler of the simpleenroll requests, which
+// are authenticated by the enrollment secret in the basic authorization
+// header, or of the simplereenroll requests, which are authenticated by the
+// TLS client certificate and follow the policy of reenroll
+func (s *Server) estEnrollHandler(reenroll bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ca := s.estCA(w, r)
+		if ca == nil {
+			return
+		}
+		ctx := &serverRequestContextImpl{req: r, resp: w, ca: ca, config: s.configSnapshot()}
+		defer ctx.releaseBody()
+		cert, err := handleESTEnroll(ctx, ca, reenroll)
+		if info := getRequestInfo(r); info != nil {
+			info.identity = ctx.enrollmentID
+		}
+		if err != nil {
+			he := getHTTPErr(err)
+			log.Infof("EST enrollment failed: %s", he.GetLocalMsg())
+			if he.GetStatusCode() == http.StatusUnauthorized && !reenroll {
+				w.Header().Set("WWW-Authenticate", `Basic realm="estrealm"`)
+			}
+			http.Error(w, he.GetRemoteMsg(), he.GetStatusCode())
+			return
+		}
+		certs, err := scep.DegenerateCertificates([]*x509.Certificate{cert})
+		if err != nil {
+			log.Errorf("Failed to encode the certificate of the EST response: %s", err)
+			http.Error(w, "Failed to encode the certificate", http.StatusInternalServerError)
+			return
+		}
+		writeESTResponse(w, estCertsOnlyMIME, certs)
+	})
+}
+
+// handleESTEnroll authenticates the EST enrollment request of the context
+// 'ctx' and issues a certificate for the base64-encoded PKCS #10 CSR in its
+// body
+func handleESTEnroll(ctx *serverRequestContextImpl, ca *CA, reenroll bool) (*x509.Certificate, error) {
+	mediaType, _, _ := mime.ParseMediaType(ctx.req.Header.Get("Content-Type"))
+	if mediaType != estCSRMIME {
+		return nil, caerrors.NewHTTPErr(http.StatusUnsupportedMediaType, caerrors.ErrBadCSR,
+			"The content type of the request must be '%s'", estCSRMIME)
+	}
+	var id string
+	var err error
+	if reenroll {
+		cert := ctx.GetTLSPeerCertificate()
+		if cert == nil {
+			return nil, caerrors.NewAuthenticationErr(caerrors.ErrNoAuthHdr, "A verified TLS client certificate is required")
+		}
+		id, err = ctx.authenticateCertificate(ca, cert)
+	} else {
+		id, err = ctx.BasicAuthentication()
+	}
+	if err != nil {
+		return nil, err
+	}
+	body, err := ctx.ReadBodyBytes()
+	if err != nil {
+		return nil, err
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+	if err != nil {
+		return nil, caerrors.NewHTTPErr(http.StatusBadRequest, caerrors.ErrBadCSR, "The CSR is not base64-encoded: %s", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, caerrors.NewHTTPErr(http.StatusBadRequest, caerrors.ErrBadCSR, "Invalid CSR: %s", err)
+	}
+	req := &api.EnrollmentRequestNet{
+		SignRequest: signer.SignRequest{
+			Request: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})),
+			Profile: ca.Config.EST.Profile,
+		},
+	}
+	event := EventCertIssued
+	if reenroll {
+		event = EventCertReenrolled
+	}
+	certPEM, err := enrollCertificate(ctx, ca, id, req, event)
+	if err != nil {
+		return nil, err
+	}
+	if !reenroll {
+		err = ctx.ui.LoginComplete()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return util.GetX509CertificateFromPEM(certPEM)
+}
+
+// writeESTResponse writes the DER encoding 'der' in base64 with the content
+// type 'contentType'
+func writeESTResponse(w http.ResponseWriter, contentType string, der []byte) {
+	encoded := base64.StdEncoding.EncodeToString(der)
+	lines := []string{}
+	for len(encoded) > estBase64LineLength {
+		lines = append(lines, encoded[:estBase64LineLength])
+		encoded = encoded[estBase64LineLength:]
+	}
+	lines = append(lines, encoded)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	w.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+}
@@ -0,0 +1,197 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib/scep"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// estTestClient is a minimal EST client
+type estTestClient struct {
+	t      *testing.T
+	url    string
+	client *http.Client
+}
+
+// newESTTestClient returns an EST client of the server at 'url' which
+// presents the TLS client certificate 'cert' with the key 'key' if not nil
+func newESTTestClient(t *testing.T, url string, cert *x509.Certificate, key crypto.PrivateKey) *estTestClient {
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if cert != nil {
+		tlsConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}
+	}
+	return &estTestClient{t: t, url: url, client: &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}}
+}
+
+// do sends the EST request 'req' and returns the status code and the
+// certificates of the response, which must have the content type 'mime'
+// if the request succeeds
+func (c *estTestClient) do(req *http.Request, mime string) (int, []*x509.Certificate) {
+	resp, err := c.client.Do(req)
+	util.FatalError(c.t, err, "Failed to send EST request")
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	util.FatalError(c.t, err, "Failed to read EST response")
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	assert.Equal(c.t, mime, resp.Header.Get("Content-Type"))
+	assert.Equal(c.t, "base64", resp.Header.Get("Content-Transfer-Encoding"))
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+	util.FatalError(c.t, err, "The EST response is not base64-encoded")
+	certs, err := scep.ParseDegenerateCertificates(der)
+	util.FatalError(c.t, err, "Invalid PKCS #7 in the EST response")
+	return resp.StatusCode, certs
+}
+
+func (c *estTestClient) cacerts() (int, []*x509.Certificate) {
+	req, err := http.NewRequest("GET", c.url+"/cacerts", nil)
+	util.FatalError(c.t, err, "Failed to create request")
+	return c.do(req, "application/pkcs7-mime")
+}
+
+// enroll sends a simpleenroll request, or a simplereenroll request if
+// 'reenroll' is true, for a CSR of 'key' with the common name 'cn'
+func (c *estTestClient) enroll(reenroll bool, cn string, key crypto.Signer, user, pass string) (int, *x509.Certificate) {
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}}, key)
+	util.FatalError(c.t, err, "Failed to create CSR")
+	op := "/simpleenroll"
+	if reenroll {
+		op = "/simplereenroll"
+	}
+	req, err := http.NewRequest("POST", c.url+op, strings.NewReader(base64.StdEncoding.EncodeToString(csr)))
+	util.FatalError(c.t, err, "Failed to create request")
+	req.Header.Set("Content-Type", "application/pkcs10")
+	if user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+	status, certs := c.do(req, "application/pkcs7-mime; smime-type=certs-only")
+	if status != http.StatusOK {
+		return status, nil
+	}
+	if !assert.Len(c.t, certs, 1) {
+		c.t.FailNow()
+	}
+	return status, certs[0]
+}
+
+func TestEST(t *testing.T) {
+	srv := TestGetRootServer(t)
+	srv.Config.TLS.Enabled = true
+	srv.Config.TLS.CertFile = "../../testdata/tls_server-cert.pem"
+	srv.Config.TLS.KeyFile = "../../testdata/tls_server-key.pem"
+	srv.Config.TLS.ClientAuth.Type = "VerifyClientCertIfGiven"
+	srv.Config.TLS.ClientAuth.CertFiles = []string{"ca-cert.pem"}
+	srv.CA.Config.EST.Enabled = true
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	estURL := fmt.Sprintf("https://localhost:%d/.well-known/est", rootPort)
+	c := newESTTestClient(t, estURL, nil, nil)
+
+	status, certs := c.cacerts()
+	assert.Equal(t, http.StatusOK, status)
+	caCert, err := getCACert(&srv.CA)
+	util.FatalError(t, err, "Failed to get the CA certificate")
+	if assert.Len(t, certs, 1) {
+		assert.Equal(t, caCert.Raw, certs[0].Raw)
+	}
+	status, _ = newESTTestClient(t, estURL+"/unknownca", nil, nil).cacerts()
+	assert.Equal(t, http.StatusNotFound, status)
+
+	err = srv.CA.addIdentity(&CAConfigIdentity{Name: "device1", Pass: "device1pw", Type: "client", Affiliation: "org1"}, true)
+	util.FatalError(t, err, "Failed to register 'device1'")
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	util.FatalError(t, err, "Failed to generate key")
+
+	status, _ = c.enroll(false, "device1", key, "", "")
+	assert.Equal(t, http.StatusUnauthorized, status, "An enrollment without basic authentication should fail")
+	status, _ = c.enroll(false, "device1", key, "device1", "wrongpw")
+	assert.Equal(t, http.StatusUnauthorized, status, "An enrollment with a wrong secret should fail")
+	status, _ = c.enroll(false, "device2", key, "device1", "device1pw")
+	assert.NotEqual(t, http.StatusOK, status, "The common name of the CSR must be the enrollment ID")
+	req, err := http.NewRequest("POST", estURL+"/simpleenroll", strings.NewReader("MIIB"))
+	util.FatalError(t, err, "Failed to create request")
+	req.SetBasicAuth("device1", "device1pw")
+	req.Header.Set("Content-Type", "application/json")
+	status, _ = c.do(req, "")
+	assert.Equal(t, http.StatusUnsupportedMediaType, status)
+
+	status, cert := c.enroll(false, "device1", key, "device1", "device1pw")
+	if !assert.Equal(t, http.StatusOK, status, "Enrollment with the enrollment secret should succeed") {
+		t.FailNow()
+	}
+	assert.Equal(t, "device1", cert.Subject.CommonName)
+	assert.NoError(t, cert.CheckSignatureFrom(caCert))
+	aki := strings.TrimLeft(hex.EncodeToString(cert.AuthorityKeyId), "0")
+	serial := strings.TrimLeft(util.GetSerialAsHex(cert.SerialNumber), "0")
+	record, err := srv.CA.certDBAccessor.GetCertificateWithID(serial, aki)
+	util.FatalError(t, err, "The certificate should be recorded")
+	assert.Equal(t, "device1", record.ID)
+
+	// A reenrollment is authenticated by the TLS client certificate
+	status, _ = c.enroll(true, "device1", key, "device1", "device1pw")
+	assert.Equal(t, http.StatusUnauthorized, status, "A reenrollment without a client certificate should fail")
+	status, renewed := newESTTestClient(t, estURL, cert, key).enroll(true, "device1", key, "", "")
+	if assert.Equal(t, http.StatusOK, status, "Reenrollment with the client certificate should succeed") {
+		assert.NotEqual(t, cert.SerialNumber, renewed.SerialNumber)
+	}
+	err = srv.CA.certDBAccessor.RevokeCertificate(serial, aki, 1)
+	util.FatalError(t, err, "Failed to revoke certificate")
+	status, _ = newESTTestClient(t, estURL, cert, key).enroll(true, "device1", key, "", "")
+	assert.Equal(t, http.StatusUnauthorized, status, "A reenrollment with a revoked certificate should fail")
+}
+
+func TestESTMaxEnrollments(t *testing.T) {
+	srv := TestGetRootServer(t)
+	srv.CA.Config.EST.Enabled = true
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	client := TestGetRootClient()
+	enrollResp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin'")
+	_, err = enrollResp.Identity.Register(&api.RegistrationRequest{
+		Name: "device1", Secret: "device1pw", Affiliation: "org1", MaxEnrollments: 1,
+	})
+	util.FatalError(t, err, "Failed to register 'device1'")
+
+	c := newESTTestClient(t, fmt.Sprintf("http://localhost:%d/.well-known/est", rootPort), nil, nil)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	util.FatalError(t, err, "Failed to generate key")
+	status, _ := c.enroll(false, "device1", key, "device1", "device1pw")
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = c.enroll(false, "device1", key, "device1", "device1pw")
+	assert.Equal(t, http.StatusUnauthorized, status, "An enrollment beyond the maximum enrollments should fail")
+}
@@ -0,0 +1,700 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/lib/metrics"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+)
+
+// The types of the events which are sent to the event subscriptions
+const (
+	// An identity was registered or added
+	EventIdentityRegistered = "identity.registered"
+	// An identity was modified
+	EventIdentityModified = "identity.modified"
+	// An identity was removed
+	EventIdentityRemoved = "identity.removed"
+	// A certificate was issued to an identity which enrolled
+	EventCertIssued = "cert.issued"
+	// A certificate was issued to an identity which reenrolled
+	EventCertReenrolled = "cert.reenrolled"
+	// A certificate was revoked
+	EventCertRevoked = "cert.revoked"
+)
+
+// eventTypes are the types of the events which may be subscribed to
+var eventTypes = map[string]bool{
+	EventIdentityRegistered: true,
+	EventIdentityModified:   true,
+	EventIdentityRemoved:    true,
+	EventCertIssued:         true,
+	EventCertReenrolled:     true,
+	EventCertRevoked:        true,
+}
+
+// The headers of the requests which send events
+const (
+	// EventIDHeader is the unique ID of the event, which is the same in each
+	// attempt to send it so that the receiver can discard duplicates
+	EventIDHeader = "X-Fabric-CA-Event-ID"
+	// EventTypeHeader is the type of the event
+	EventTypeHeader = "X-Fabric-CA-Event-Type"
+	// EventSignatureHeader is "sha256=" followed by the hex encoding of the
+	// HMAC-SHA256 of the request body with the secret of the subscription
+	EventSignatureHeader = "X-Fabric-CA-Signature"
+)
+
+// The defaults of an event subscription
+const (
+	defaultEventQueueSize   = 1000
+	defaultEventSpoolDir    = "events"
+	defaultEventTimeout     = 10 * time.Second
+	defaultEventMaxAttempts = 5
+	defaultEventBaseDelay   = time.Second
+	defaultEventMaxDelay    = time.Minute
+	// The defaults of the batches of a message bus subscription
+	defaultEventBatchSize    = 100
+	defaultEventBatchTimeout = 100 * time.Millisecond
+)
+
+// The names of the metrics of the delivery of events
+const (
+	metricEventsDelivered       = "fabric_ca_events_delivered_total"
+	metricEventDeliveryFailures = "fabric_ca_event_delivery_failures_total"
+	metricEventsSpooled         = "fabric_ca_events_spooled_total"
+)
+
+// newKafkaSink returns the sink of a Kafka subscription; it is nil if the
+// server is built without Kafka support
+var newKafkaSink func(sub *KafkaSubscription, homeDir string) (eventSink, error)
+
+// Event is the body of a request which sends an event to a subscription
+type Event struct {
+	// Unique ID of the event
+	ID string `json:"id"`
+	// Type of the event, such as cert.issued
+	Type string `json:"type"`
+	// Time at which the event occurred
+	Time time.Time `json:"time"`
+	// Name of the CA of the identity or certificate
+	CAName string `json:"caname"`
+	// An IdentityEventData or CertificateEventData, depending on the type
+	Data interface{} `json:"data"`
+}
+
+// IdentityEventData is the data of an identity.* event
+type IdentityEventData struct {
+	// Enrollment ID of the identity
+	ID          string `json:"id"`
+	Type        string `json:"type,omitempty"`
+	Affiliation string `json:"affiliation"`
+	// Enrollment ID of the identity which made the change
+	Invoker string `json:"invoker"`
+}
+
+// CertificateEventData is the data of a cert.* event
+type CertificateEventData struct {
+	// Enrollment ID of the owner of the certificate
+	ID     string `json:"id"`
+	Serial string `json:"serial"`
+	AKI    string `json:"aki"`
+	// Validity of an issued certificate
+	NotBefore *time.Time `json:"notbefore,omitempty"`
+	NotAfter  *time.Time `json:"notafter,omitempty"`
+	// Reason for the revocation of a revoked certificate
+	Reason string `json:"reason,omitempty"`
+	// Enrollment ID of the identity which enrolled or revoked
+	Invoker string `json:"invoker"`
+}
+
+// SignEvent returns the value of the signature header of a request whose
+// body is 'body' to a subscription whose secret is 'secret'
+func SignEvent(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyEventSignature returns true if 'signature', the value of the
+// signature header of a request whose body is 'body', was computed with the
+// secret 'secret'
+func VerifyEventSignature(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignEvent(secret, body)), []byte(signature))
+}
+
+// newEventMetrics registers the metrics of the delivery of events
+func newEventMetrics(reg *metrics.Registry) {
+	reg.NewCounter(metricEventsDelivered, "Number of events delivered to each event subscription", "subscription")
+	reg.NewCounter(metricEventDeliveryFailures, "Number of failed attempts to deliver events to each event subscription", "subscription")
+	reg.NewCounter(metricEventsSpooled, "Number of events spooled because they could not be delivered to each event subscription", "subscription")
+}
+
+// checkEventsConfig validates the event subscriptions, setting the defaults
+// of the settings which are not set
+func checkEventsConfig(cfg *EventsConfig) error {
+	if cfg.QueueSize < 0 {
+		return errors.New("Invalid events.queuesize: it must not be negative")
+	}
+	if cfg.QueueSize == 0 {
+		cfg.QueueSize = defaultEventQueueSize
+	}
+	if cfg.SpoolDir == "" {
+		cfg.SpoolDir = defaultEventSpoolDir
+	}
+	for i := range cfg.Subscriptions {
+		err := checkEventSubscription(&cfg.Subscriptions[i])
+		if err != nil {
+			return errors.WithMessage(err, fmt.Sprintf("Invalid event subscription %d", i))
+		}
+	}
+	if len(cfg.Kafka) > 0 && newKafkaSink == nil {
+		return errors.New("Kafka event subscriptions are not supported by this build of the server")
+	}
+	for i := range cfg.Kafka {
+		err := checkKafkaSubscription(&cfg.Kafka[i])
+		if err != nil {
+			return errors.WithMessage(err, fmt.Sprintf("Invalid Kafka event subscription %d", i))
+		}
+	}
+	return nil
+}
+
+func checkEventSubscription(sub *EventSubscription) error {
+	u, err := url.Parse(sub.URL)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid URL '%s'", sub.URL)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Errorf("Invalid URL '%s'; it must be an http or https URL", sub.URL)
+	}
+	err = checkEventTypes(sub.Events)
+	if err != nil {
+		return err
+	}
+	r := &sub.Retry
+	if sub.Timeout < 0 || r.MaxAttempts < 0 || r.BaseDelay < 0 || r.MaxDelay < 0 {
+		return errors.New("timeout, retry.maxattempts, retry.basedelay and retry.maxdelay must not be negative")
+	}
+	if sub.Timeout == 0 {
+		sub.Timeout = defaultEventTimeout
+	}
+	setEventRetryDefaults(r)
+	return nil
+}
+
+func checkKafkaSubscription(sub *KafkaSubscription) error {
+	err := sub.Config.Validate()
+	if err != nil {
+		return err
+	}
+	err = checkEventTypes(sub.Events)
+	if err != nil {
+		return err
+	}
+	r := &sub.Retry
+	if sub.BatchSize < 0 || sub.BatchTimeout < 0 || r.MaxAttempts < 0 || r.BaseDelay < 0 || r.MaxDelay < 0 {
+		return errors.New("batchsize, batchtimeout, retry.maxattempts, retry.basedelay and retry.maxdelay must not be negative")
+	}
+	if sub.BatchSize == 0 {
+		sub.BatchSize = defaultEventBatchSize
+	}
+	if sub.BatchTimeout == 0 {
+		sub.BatchTimeout = defaultEventBatchTimeout
+	}
+	setEventRetryDefaults(r)
+	return nil
+}
+
+// checkEventTypes checks the types of the events of a subscription,
+// converting them to lower case
+func checkEventTypes(types []string) error {
+	for i, typ := range types {
+		typ = strings.ToLower(typ)
+		if !eventTypes[typ] {
+			return errors.Errorf("Unknown event type '%s'", typ)
+		}
+		types[i] = typ
+	}
+	return nil
+}
+
+func setEventRetryDefaults(r *EventRetryConfig) {
+	if r.MaxAttempts == 0 {
+		r.MaxAttempts = defaultEventMaxAttempts
+	}
+	if r.BaseDelay == 0 {
+		r.BaseDelay = defaultEventBaseDelay
+	}
+	if r.MaxDelay == 0 {
+		r.MaxDelay = defaultEventMaxDelay
+	}
+}
+
+// eventDelivery is an event to be sent to a subscription
+type eventDelivery struct {
+	id  string
+	typ string
+	// Enrollment ID of the identity of the event, by which a message bus
+	// partitions the events
+	key  string
+	body []byte
+	// The spool file of the event, if it was redelivered from the spool
+	file string
+}
+
+// spooledEvent is the content of the spool file of an event which could not
+// be delivered to a subscription
+type spooledEvent struct {
+	// ID of the sink of the subscription; the URL of a webhook
+	URL   string          `json:"url"`
+	Type  string          `json:"type"`
+	Key   string          `json:"key,omitempty"`
+	Event json.RawMessage `json:"event"`
+}
+
+// eventSink delivers the events of a subscription to its destination, such
+// as a webhook or a message bus
+type eventSink interface {
+	// id identifies the destination in the spool
+	id() string
+	// name identifies the destination in log messages and metrics
+	name() string
+	// send makes one attempt to deliver a batch of events in order
+	send(ctx context.Context, eds []*eventDelivery) error
+	// close releases the connections to the destination
+	close()
+}
+
+// webhookSink posts each event to the URL of a subscription
+type webhookSink struct {
+	cfg    EventSubscription
+	client *http.Client
+}
+
+// eventDispatcher sends the events of the server to its subscriptions. Each
+// subscription has a queue of events which are sent in order by a goroutine
+// of its own, so that a slow subscription does not delay the others.
+type eventDispatcher struct {
+	subs []*eventSubscriber
+	// Called with the name of a subscription, the metric of an outcome of
+	// the delivery of its events and the number of events; may be nil
+	observe func(name, metric string, n int)
+	// Guards done, which is nil unless the dispatcher is started
+	mutex sync.RWMutex
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// eventSubscriber sends the events to which a subscription is subscribed
+type eventSubscriber struct {
+	sink  eventSink
+	retry EventRetryConfig
+	// Maximum number of events sent together, and maximum time to wait for
+	// a batch to fill
+	batchSize    int
+	batchTimeout time.Duration
+	// The types of the events which are sent; nil if all are
+	types map[string]bool
+	// Prefix of the names of the spool files of the subscription
+	key      string
+	queue    chan *eventDelivery
+	spoolDir string
+	observe  func(name, metric string, n int)
+}
+
+// newEventDispatcher returns the dispatcher of the event subscriptions of
+// 'cfg', which has been validated, spooling in a directory relative to 'homeDir'
+func newEventDispatcher(cfg *EventsConfig, homeDir string) (*eventDispatcher, error) {
+	spoolDir, err := util.MakeFileAbs(cfg.SpoolDir, homeDir)
+	if err != nil {
+		return nil, err
+	}
+	d := &eventDispatcher{}
+	add := func(sink eventSink, events []string, retry EventRetryConfig, batchSize int, batchTimeout time.Duration) {
+		es := &eventSubscriber{
+			sink:         sink,
+			retry:        retry,
+			batchSize:    batchSize,
+			batchTimeout: batchTimeout,
+			queue:        make(chan *eventDelivery, cfg.QueueSize),
+			spoolDir:     spoolDir,
+		}
+		sum := sha256.Sum256([]byte(sink.id()))
+		es.key = hex.EncodeToString(sum[:8])
+		if len(events) > 0 {
+			es.types = map[string]bool{}
+			for _, typ := range events {
+				es.types[typ] = true
+			}
+		}
+		d.subs = append(d.subs, es)
+	}
+	for _, sub := range cfg.Subscriptions {
+		add(&webhookSink{cfg: sub, client: &http.Client{Timeout: sub.Timeout}}, sub.Events, sub.Retry, 1, 0)
+	}
+	for i := range cfg.Kafka {
+		sub := &cfg.Kafka[i]
+		sink, err := newKafkaSink(sub, homeDir)
+		if err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("Failed to create Kafka event subscription %d", i))
+		}
+		add(sink, sub.Events, sub.Retry, sub.BatchSize, sub.BatchTimeout)
+	}
+	return d, nil
+}
+
+// start starts sending events, beginning with those in the spool
+func (d *eventDispatcher) start() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.done = make(chan struct{})
+	for _, es := range d.subs {
+		es.observe = d.observe
+		d.wg.Add(1)
+		go func(es *eventSubscriber, done chan struct{}) {
+			defer d.wg.Done()
+			es.run(done)
+		}(es, d.done)
+	}
+}
+
+// stop stops sending events, spooling those which are not yet sent
+func (d *eventDispatcher) stop() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.done == nil {
+		return
+	}
+	close(d.done)
+	d.wg.Wait()
+	d.done = nil
+	for _, es := range d.subs {
+		es.sink.close()
+	}
+}
+
+// publish queues an event of type 'typ' for each subscription to it, or
+// spools it if the dispatcher is stopped
+func (d *eventDispatcher) publish(typ, caname string, data interface{}) {
+	id, err := newEventID()
+	if err != nil {
+		log.Errorf("Failed to create the ID of a %s event: %s", typ, err)
+		return
+	}
+	body, err := json.Marshal(&Event{ID: id, Type: typ, Time: time.Now().UTC(), CAName: caname, Data: data})
+	if err != nil {
+		log.Errorf("Failed to encode %s event %s: %s", typ, id, err)
+		return
+	}
+	var key string
+	switch data := data.(type) {
+	case *IdentityEventData:
+		key = data.ID
+	case *CertificateEventData:
+		key = data.ID
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	for _, es := range d.subs {
+		if es.types != nil && !es.types[typ] {
+			continue
+		}
+		ed := &eventDelivery{id: id, typ: typ, key: key, body: body}
+		if d.done == nil {
+			es.spool(ed)
+			continue
+		}
+		select {
+		case es.queue <- ed:
+		default:
+			log.Warningf("The event queue of %s is full; spooling %s event %s", es.sink.name(), typ, id)
+			es.spool(ed)
+		}
+	}
+}
+
+// run sends the spooled events and then the queued events until 'done' is
+// closed, when the events remaining in the queue are spooled
+func (es *eventSubscriber) run(done chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-done
+		cancel()
+	}()
+	spooled := es.spooled()
+	for len(spooled) > 0 {
+		n := es.batchSize
+		if n > len(spooled) {
+			n = len(spooled)
+		}
+		if !es.deliver(ctx, spooled[:n]) {
+			// The subscription is still unavailable, so leave the rest of
+			// the spool for the next start
+			break
+		}
+		spooled = spooled[n:]
+	}
+	for {
+		select {
+		case ed := <-es.queue:
+			es.deliver(ctx, es.batch(ed, done))
+		case <-done:
+			for {
+				select {
+				case ed := <-es.queue:
+					es.spool(ed)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// batch returns the batch of events which begins with 'first', adding the
+// queued events until it is full or the batch timeout has elapsed
+func (es *eventSubscriber) batch(first *eventDelivery, done chan struct{}) []*eventDelivery {
+	eds := []*eventDelivery{first}
+	if es.batchSize <= 1 {
+		return eds
+	}
+	timer := time.NewTimer(es.batchTimeout)
+	defer timer.Stop()
+	for len(eds) < es.batchSize {
+		select {
+		case ed := <-es.queue:
+			eds = append(eds, ed)
+		case <-timer.C:
+			return eds
+		case <-done:
+			return eds
+		}
+	}
+	return eds
+}
+
+// deliver sends a batch of events, retrying with exponential backoff until
+// it is delivered or the attempts are exhausted, when its events are spooled.
+// It returns true if the events were delivered.
+func (es *eventSubscriber) deliver(ctx context.Context, eds []*eventDelivery) bool {
+	r := es.retry
+	delay := r.BaseDelay
+	desc := fmt.Sprintf("%s event %s", eds[0].typ, eds[0].id)
+	if len(eds) > 1 {
+		desc = fmt.Sprintf("%d events", len(eds))
+	}
+	for attempt := 1; ; attempt++ {
+		err := es.sink.send(ctx, eds)
+		if err == nil {
+			log.Debugf("Sent %s to %s", desc, es.sink.name())
+			es.record(metricEventsDelivered, len(eds))
+			for _, ed := range eds {
+				if ed.file != "" {
+					os.Remove(ed.file)
+				}
+			}
+			return true
+		}
+		es.record(metricEventDeliveryFailures, 1)
+		if attempt >= r.MaxAttempts || ctx.Err() != nil {
+			log.Warningf("Failed to send %s to %s after %d attempts: %s", desc, es.sink.name(), attempt, err)
+			for _, ed := range eds {
+				es.spool(ed)
+			}
+			return false
+		}
+		log.Debugf("Attempt %d to send %s to %s failed, retrying in %s: %s", attempt, desc, es.sink.name(), delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		delay *= 2
+		if delay > r.MaxDelay {
+			delay = r.MaxDelay
+		}
+	}
+}
+
+// record reports 'n' events with the outcome 'metric' to the observer
+func (es *eventSubscriber) record(metric string, n int) {
+	if es.observe != nil {
+		es.observe(es.sink.name(), metric, n)
+	}
+}
+
+func (ws *webhookSink) id() string {
+	return ws.cfg.URL
+}
+
+// name returns the URL without its user information
+func (ws *webhookSink) name() string {
+	u, err := url.Parse(ws.cfg.URL)
+	if err != nil {
+		return ws.cfg.URL
+	}
+	u.User = nil
+	return u.String()
+}
+
+// send posts the events one by one
+func (ws *webhookSink) send(ctx context.Context, eds []*eventDelivery) error {
+	for _, ed := range eds {
+		err := ws.post(ctx, ed)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ws *webhookSink) close() {}
+
+// post makes one attempt to post an event
+func (ws *webhookSink) post(ctx context.Context, ed *eventDelivery) error {
+	req, err := http.NewRequest("POST", ws.cfg.URL, bytes.NewReader(ed.body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventIDHeader, ed.id)
+	req.Header.Set(EventTypeHeader, ed.typ)
+	if ws.cfg.Secret != "" {
+		req.Header.Set(EventSignatureHeader, SignEvent(ws.cfg.Secret, ed.body))
+	}
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("Response status %s", resp.Status)
+	}
+	return nil
+}
+
+// spool writes an event which could not be sent to the spool, unless it is
+// already there
+func (es *eventSubscriber) spool(ed *eventDelivery) {
+	if ed.file != "" {
+		return
+	}
+	buf, err := json.Marshal(&spooledEvent{URL: es.sink.id(), Type: ed.typ, Key: ed.key, Event: ed.body})
+	if err == nil {
+		err = os.MkdirAll(es.spoolDir, 0700)
+	}
+	if err == nil {
+		name := fmt.Sprintf("%s-%d-%s.json", es.key, time.Now().UnixNano(), ed.id)
+		err = ioutil.WriteFile(filepath.Join(es.spoolDir, name), buf, 0600)
+	}
+	if err != nil {
+		log.Errorf("Failed to spool %s event %s of %s; it is lost: %s", ed.typ, ed.id, es.sink.name(), err)
+		return
+	}
+	es.record(metricEventsSpooled, 1)
+}
+
+// spooled returns the events in the spool of the subscription, oldest first
+func (es *eventSubscriber) spooled() []*eventDelivery {
+	files, err := filepath.Glob(filepath.Join(es.spoolDir, es.key+"-*.json"))
+	if err != nil || len(files) == 0 {
+		return nil
+	}
+	sort.Strings(files)
+	eds := []*eventDelivery{}
+	for _, file := range files {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Warningf("Failed to read spooled event '%s': %s", file, err)
+			continue
+		}
+		var se spooledEvent
+		var e Event
+		err = json.Unmarshal(buf, &se)
+		if err == nil {
+			err = json.Unmarshal(se.Event, &e)
+		}
+		if err != nil || se.URL != es.sink.id() {
+			log.Warningf("Ignoring spooled event '%s', which is not an event of %s", file, es.sink.name())
+			continue
+		}
+		eds = append(eds, &eventDelivery{id: e.ID, typ: se.Type, key: se.Key, body: se.Event, file: file})
+	}
+	if len(eds) > 0 {
+		log.Infof("Sending %d spooled events to %s", len(eds), es.sink.name())
+	}
+	return eds
+}
+
+// newEventID returns a random (version 4) UUID
+func newEventID() (string, error) {
+	var b [16]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// startEvents starts sending the events of the server to its subscriptions
+func (s *Server) startEvents() error {
+	if len(s.Config.Events.Subscriptions) == 0 && len(s.Config.Events.Kafka) == 0 {
+		return nil
+	}
+	d, err := newEventDispatcher(&s.Config.Events, s.HomeDir)
+	if err != nil {
+		return err
+	}
+	d.observe = func(name, metric string, n int) {
+		s.metricWith(metric, name).Add(float64(n))
+	}
+	d.start()
+	s.events = d
+	return nil
+}
+
+// stopEvents stops sending events, spooling those which are not yet sent or
+// which occur while the server is stopping
+func (s *Server) stopEvents() {
+	if s.events != nil {
+		s.events.stop()
+	}
+}
+
+// publishEvent sends an event of type 'typ' to the subscriptions to it
+func (s *Server) publishEvent(typ, caname string, data interface{}) {
+	if s == nil || s.events == nil {
+		return
+	}
+	s.events.publish(typ, caname, data)
+}
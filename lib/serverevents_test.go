@@ -0,0 +1,284 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventsFilterAndSignature(t *testing.T) {
+	all := NewTestEventReceiver("allsecret")
+	defer all.Close()
+	revoked := NewTestEventReceiver("revokedsecret")
+	defer revoked.Close()
+	wrongSecret := NewTestEventReceiver("othersecret")
+	defer wrongSecret.Close()
+
+	srv := TestGetRootServer(t)
+	srv.Config.Events.Subscriptions = []EventSubscription{
+		{URL: all.URL, Secret: "allsecret"},
+		{URL: revoked.URL, Secret: "revokedsecret", Events: []string{"CERT.REVOKED"}},
+		{URL: wrongSecret.URL, Secret: "allsecret", Retry: EventRetryConfig{MaxAttempts: 1}},
+	}
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+
+	c := TestGetRootClient()
+	enrollResp, err := c.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin'")
+	admin := enrollResp.Identity
+	_, err = admin.Register(&api.RegistrationRequest{Name: "eventuser", Secret: "eventuserpw", Affiliation: "org1"})
+	util.FatalError(t, err, "Failed to register 'eventuser'")
+	_, err = c.Enroll(&api.EnrollmentRequest{Name: "eventuser", Secret: "eventuserpw"})
+	util.FatalError(t, err, "Failed to enroll 'eventuser'")
+	_, err = admin.Revoke(&api.RevocationRequest{Name: "eventuser", Reason: "keycompromise"})
+	util.FatalError(t, err, "Failed to revoke 'eventuser'")
+
+	events := all.WaitForEvents(4, 10*time.Second)
+	if assert.Len(t, events, 4, "Every event should be sent to a subscription without a filter") {
+		types := []string{}
+		ids := map[string]bool{}
+		for _, e := range events {
+			types = append(types, e.Type)
+			ids[e.ID] = true
+			assert.Equal(t, srv.CA.Config.CA.Name, e.CAName)
+		}
+		assert.Equal(t, []string{EventCertIssued, EventIdentityRegistered, EventCertIssued, EventCertRevoked}, types)
+		assert.Len(t, ids, 4, "Each event should have a unique ID")
+		data := events[1].Data.(map[string]interface{})
+		assert.Equal(t, "eventuser", data["id"])
+		assert.Equal(t, "org1", data["affiliation"])
+		assert.Equal(t, "admin", data["invoker"])
+		data = events[3].Data.(map[string]interface{})
+		assert.Equal(t, "eventuser", data["id"])
+		assert.Equal(t, "keycompromise", data["reason"])
+		assert.NotEmpty(t, data["serial"])
+	}
+	events = revoked.WaitForEvents(1, 10*time.Second)
+	if assert.Len(t, events, 1, "Only the subscribed events should be sent") {
+		assert.Equal(t, EventCertRevoked, events[0].Type)
+	}
+	assert.Empty(t, wrongSecret.WaitForEvents(1, time.Second), "An event whose signature is not valid should be refused")
+	assert.Equal(t, 4, wrongSecret.Attempts())
+
+	body := []byte(`{"id":"1"}`)
+	assert.True(t, VerifyEventSignature("secret", body, SignEvent("secret", body)))
+	assert.False(t, VerifyEventSignature("secret", body, SignEvent("other", body)))
+	assert.False(t, VerifyEventSignature("secret", []byte(`{"id":"2"}`), SignEvent("secret", body)))
+}
+
+func TestEventsRedelivery(t *testing.T) {
+	home, err := ioutil.TempDir("", "events")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(home)
+	r := NewTestEventReceiver("secret")
+	defer r.Close()
+	cfg := &EventsConfig{Subscriptions: []EventSubscription{{
+		URL:    r.URL,
+		Secret: "secret",
+		Retry:  EventRetryConfig{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond},
+	}}}
+	err = checkEventsConfig(cfg)
+	util.FatalError(t, err, "The event subscription should be valid")
+	d, err := newEventDispatcher(cfg, home)
+	util.FatalError(t, err, "Failed to create event dispatcher")
+	d.start()
+
+	// An event is sent again after a transient failure
+	r.FailNext(2)
+	d.publish(EventIdentityRegistered, "ca", &IdentityEventData{ID: "user1"})
+	events := r.WaitForEvents(1, 5*time.Second)
+	assert.Len(t, events, 1, "The event should be delivered by the third attempt")
+	assert.Equal(t, 3, r.Attempts())
+
+	// An event which is not delivered by the last attempt is spooled
+	r.FailNext(3)
+	d.publish(EventIdentityModified, "ca", &IdentityEventData{ID: "user1"})
+	spoolDir := filepath.Join(home, "events")
+	spooled := func() []string {
+		files, _ := filepath.Glob(filepath.Join(spoolDir, "*.json"))
+		return files
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(spooled()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	d.stop()
+	assert.Len(t, spooled(), 1, "The undeliverable event should be spooled")
+	assert.Len(t, r.Events(), 1)
+
+	// Events which occur while the dispatcher is stopped are spooled too
+	d.publish(EventIdentityRemoved, "ca", &IdentityEventData{ID: "user1"})
+	assert.Len(t, spooled(), 2)
+
+	// The spooled events are sent when the dispatcher starts again
+	d, err = newEventDispatcher(cfg, home)
+	util.FatalError(t, err, "Failed to create event dispatcher")
+	d.start()
+	defer d.stop()
+	events = r.WaitForEvents(3, 5*time.Second)
+	if assert.Len(t, events, 3, "The spooled events should be delivered") {
+		assert.Equal(t, EventIdentityModified, events[1].Type)
+		assert.Equal(t, EventIdentityRemoved, events[2].Type)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for len(spooled()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Empty(t, spooled(), "The delivered events should be removed from the spool")
+}
+
+func TestEventsConfig(t *testing.T) {
+	for _, sub := range []EventSubscription{
+		{URL: "ftp://example.com/events"},
+		{URL: "example.com/events"},
+		{URL: "https://example.com/events", Events: []string{"cert.expired"}},
+		{URL: "https://example.com/events", Timeout: -time.Second},
+	} {
+		err := checkEventsConfig(&EventsConfig{Subscriptions: []EventSubscription{sub}})
+		assert.Error(t, err, "The event subscription %+v should be invalid", sub)
+	}
+	cfg := &EventsConfig{Subscriptions: []EventSubscription{{URL: "https://example.com/events"}}}
+	err := checkEventsConfig(cfg)
+	util.FatalError(t, err, "The event subscription should be valid")
+	assert.Equal(t, defaultEventQueueSize, cfg.QueueSize)
+	assert.Equal(t, defaultEventSpoolDir, cfg.SpoolDir)
+	assert.Equal(t, defaultEventMaxAttempts, cfg.Subscriptions[0].Retry.MaxAttempts)
+	assert.Equal(t, defaultEventTimeout, cfg.Subscriptions[0].Timeout)
+}
+
+// testSink is the sink of a Kafka subscription which records the batches of
+// events sent to it
+type testSink struct {
+	mutex    sync.Mutex
+	failures int
+	batches  [][]*eventDelivery
+}
+
+func (ts *testSink) id() string   { return "kafka://localhost:9092/events" }
+func (ts *testSink) name() string { return ts.id() }
+func (ts *testSink) close()       {}
+
+func (ts *testSink) send(ctx context.Context, eds []*eventDelivery) error {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	if ts.failures > 0 {
+		ts.failures--
+		return errors.New("LEADER_NOT_AVAILABLE")
+	}
+	ts.batches = append(ts.batches, eds)
+	return nil
+}
+
+func (ts *testSink) sent() [][]*eventDelivery {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	return append([][]*eventDelivery{}, ts.batches...)
+}
+
+func TestEventsKafka(t *testing.T) {
+	home, err := ioutil.TempDir("", "events")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(home)
+	sink := &testSink{}
+	defer func(f func(*KafkaSubscription, string) (eventSink, error)) { newKafkaSink = f }(newKafkaSink)
+	newKafkaSink = func(sub *KafkaSubscription, homeDir string) (eventSink, error) {
+		return sink, nil
+	}
+	sub := KafkaSubscription{Events: []string{EventCertIssued, EventCertRevoked}, BatchTimeout: time.Second}
+	sub.Brokers = []string{"localhost:9092"}
+	sub.Topic = "events"
+	sub.Retry = EventRetryConfig{MaxAttempts: 2, BaseDelay: 10 * time.Millisecond}
+	cfg := &EventsConfig{Kafka: []KafkaSubscription{sub}}
+	err = checkEventsConfig(cfg)
+	util.FatalError(t, err, "The Kafka event subscription should be valid")
+	assert.Equal(t, defaultEventBatchSize, cfg.Kafka[0].BatchSize)
+	d, err := newEventDispatcher(cfg, home)
+	util.FatalError(t, err, "Failed to create event dispatcher")
+	observed := map[string]int{}
+	var observedMutex sync.Mutex
+	observe := func(name, metric string, n int) {
+		observedMutex.Lock()
+		defer observedMutex.Unlock()
+		assert.Equal(t, sink.id(), name)
+		observed[metric] += n
+	}
+	d.observe = observe
+	d.start()
+
+	// The events published while a batch fills are sent together, keyed by
+	// the enrollment ID of their identity
+	d.publish(EventCertIssued, "ca", &CertificateEventData{ID: "user1"})
+	d.publish(EventIdentityRegistered, "ca", &IdentityEventData{ID: "user2"})
+	d.publish(EventCertRevoked, "ca", &CertificateEventData{ID: "user2"})
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.sent()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	batches := sink.sent()
+	if assert.Len(t, batches, 1) && assert.Len(t, batches[0], 2, "Only the subscribed events should be sent") {
+		assert.Equal(t, EventCertIssued, batches[0][0].typ)
+		assert.Equal(t, "user1", batches[0][0].key)
+		assert.Equal(t, EventCertRevoked, batches[0][1].typ)
+		assert.Equal(t, "user2", batches[0][1].key)
+	}
+
+	// A batch which can't be delivered is spooled with the keys of its
+	// events, and sent again when the dispatcher starts again
+	sink.mutex.Lock()
+	sink.failures = 2
+	sink.mutex.Unlock()
+	d.publish(EventCertIssued, "ca", &CertificateEventData{ID: "user3"})
+	spooled := func() []string {
+		files, _ := filepath.Glob(filepath.Join(home, "events", "*.json"))
+		return files
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for len(spooled()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	d.stop()
+	assert.Len(t, spooled(), 1, "The undeliverable event should be spooled")
+	d, err = newEventDispatcher(cfg, home)
+	util.FatalError(t, err, "Failed to create event dispatcher")
+	d.observe = observe
+	d.start()
+	defer d.stop()
+	deadline = time.Now().Add(5 * time.Second)
+	for len(sink.sent()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	batches = sink.sent()
+	if assert.Len(t, batches, 2) && assert.Len(t, batches[1], 1) {
+		assert.Equal(t, "user3", batches[1][0].key)
+		assert.NotEmpty(t, batches[1][0].file, "The event should be sent from the spool")
+	}
+	observedMutex.Lock()
+	assert.Equal(t, map[string]int{metricEventsDelivered: 3, metricEventDeliveryFailures: 2, metricEventsSpooled: 1}, observed)
+	observedMutex.Unlock()
+
+	// Kafka subscriptions are refused by a server built without them
+	newKafkaSink = nil
+	err = checkEventsConfig(&EventsConfig{Kafka: []KafkaSubscription{sub}})
+	util.ErrorContains(t, err, "not supported by this build", "A Kafka subscription should be refused")
+}
@@ -0,0 +1,61 @@
+// +build kafka,!caclient
+
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"context"
+
+	"github.com/hyperledger/fabric-ca/lib/kafka"
+)
+
+// Kafka event subscriptions are only supported if the server is built with
+// the 'kafka' tag; otherwise the Kafka producer is left out of the binary
+func init() {
+	newKafkaSink = func(sub *KafkaSubscription, homeDir string) (eventSink, error) {
+		p, err := kafka.New(&sub.Config, homeDir, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &kafkaSink{producer: p}, nil
+	}
+}
+
+// kafkaSink publishes events to a Kafka topic
+type kafkaSink struct {
+	producer *kafka.Producer
+}
+
+func (ks *kafkaSink) id() string {
+	return ks.producer.String()
+}
+
+func (ks *kafkaSink) name() string {
+	return ks.producer.String()
+}
+
+// send publishes the events as messages whose key is the enrollment ID of
+// the identity of the event and whose headers are its ID and type
+func (ks *kafkaSink) send(ctx context.Context, eds []*eventDelivery) error {
+	msgs := make([]*kafka.Message, 0, len(eds))
+	for _, ed := range eds {
+		msgs = append(msgs, &kafka.Message{
+			Key:   []byte(ed.key),
+			Value: ed.body,
+			Headers: []kafka.Header{
+				{Key: EventIDHeader, Value: []byte(ed.id)},
+				{Key: EventTypeHeader, Value: []byte(ed.typ)},
+			},
+		})
+	}
+	return ks.producer.Send(ctx, msgs)
+}
+
+func (ks *kafkaSink) close() {
+	ks.producer.Close()
+}
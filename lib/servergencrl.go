@@ -7,15 +7,16 @@ SPDX-License-Identifier: Apache-2.0
 package lib
 
 import (
+	"bytes"
 	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
-	"io/ioutil"
-	"math/big"
-	"time"
+	"io"
+	"net/http"
+	"os"
+	"strings"
 
-	"github.com/cloudflare/cfssl/crl"
 	"github.com/cloudflare/cfssl/log"
 	"github.com/hyperledger/fabric-ca/api"
 	"github.com/hyperledger/fabric-ca/lib/caerrors"
@@ -27,18 +28,68 @@ const (
 	crlPemType = "X509 CRL"
 )
 
-// The response to the POST /gencrl request
-type genCRLResponseNet struct {
-	// Base64 encoding of PEM-encoded CRL
-	CRL string
-}
-
 func newGenCRLEndpoint(s *Server) *serverEndpoint {
 	return &serverEndpoint{
 		Methods: []string{"POST"},
 		Handler: genCRLHandler,
 		Server:  s,
+		auth:    authToken,
+		docs: map[string]operationDoc{
+			"POST": {summary: "Generate a CRL", request: &api.GenCRLRequest{}, response: &api.GenCRLResponseNet{}},
+		},
+		encodings: crlEncodings,
+	}
+}
+
+func newPublishedCRLEndpoint(s *Server) *serverEndpoint {
+	return &serverEndpoint{
+		Methods: []string{"GET", "HEAD"},
+		Handler: publishedCRLHandler,
+		Server:  s,
+		docs: map[string]operationDoc{
+			"GET":  {summary: "Get the CRL which a CA last published", contentType: mediaTypeCRL},
+			"HEAD": {summary: "Check the CRL which a CA last published"},
+		},
+	}
+}
+
+// publishedCRLHandler serves the DER CRL which the CA last published to its
+// 'crl.publishfile'. Since the file is served with http.ServeContent, a
+// client may resume an interrupted download with a Range request and
+// revalidate its copy with If-None-Match or If-Modified-Since.
+func publishedCRLHandler(ctx *serverRequestContextImpl) (interface{}, error) {
+	ca, err := ctx.getCA()
+	if err != nil {
+		return nil, err
+	}
+	file := ctx.caConfig(ca).crl.PublishFile
+	if file == "" {
+		return nil, caerrors.NewHTTPErr(404, caerrors.ErrNoPublishedCRL, "The CA '%s' does not publish its CRL", ca.Config.CA.Name)
+	}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, caerrors.NewHTTPErr(404, caerrors.ErrNoPublishedCRL, "The CA '%s' has not published a CRL yet", ca.Config.CA.Name)
 	}
+	var fi os.FileInfo
+	if err == nil {
+		defer f.Close()
+		fi, err = f.Stat()
+	}
+	var etag string
+	if err == nil {
+		etag, err = ca.publishedCRLETag(f, fi)
+	}
+	if err != nil {
+		log.Errorf("Failed to read the published CRL %s: %s", file, err)
+		return nil, caerrors.NewHTTPErr(500, caerrors.ErrGenCRL, "Failed to read the published CRL of CA '%s'", ca.Config.CA.Name)
+	}
+	ctx.setCacheControl()
+	hrw := ctx.resp.(*httpResponseWriter)
+	hrw.encoded = true
+	hrw.w.Header().Set("Content-Type", mediaTypeCRL)
+	hrw.w.Header().Set("ETag", etag)
+	http.ServeContent(hrw.w, ctx.req, "crl.der", fi.ModTime(), f)
+	return nil, nil
 }
 
 // Handle an generate CRL request
@@ -71,19 +122,80 @@ func genCRLHandler(ctx *serverRequestContextImpl) (interface{}, error) {
 		return nil, caerrors.NewAuthorizationErr(caerrors.ErrNoGenCRLAuth, "The identity '%s' does not have authority to generate a CRL", id)
 	}
 
-	crl, err := genCRL(ca, req)
+	crl, err := generateCRL(ca, req, ctx.caConfig(ca).crl)
 	if err != nil {
 		return nil, err
 	}
-	log.Debugf("Successfully generated CRL")
+	defer crl.Close()
+	log.Debugf("Successfully generated CRL of %d revoked certificates", crl.count)
 
-	resp := &genCRLResponseNet{CRL: util.B64Encode(crl)}
-	return resp, nil
+	// A client whose CRL lists the same revoked certificates keeps it
+	if ctx.notModified(crl.ETag(ctx.responseMediaType())) {
+		log.Debugf("The CRL of CA '%s' is unchanged", ca.Config.CA.Name)
+		return nil, nil
+	}
+	return nil, writeCRL(ctx, crl)
 }
 
-// GenCRL will generate CRL
-func genCRL(ca *CA, req api.GenCRLRequest) ([]byte, error) {
+// writeCRL streams the CRL 'crl' as the response of the gencrl request of
+// 'ctx', in the encoding which the request accepts, flushing the response
+// as it is written
+func writeCRL(ctx *serverRequestContextImpl, crl *crlStream) error {
+	hrw := ctx.resp.(*httpResponseWriter)
 	var err error
+	switch enc := ctx.endpoint.negotiateEncoding(ctx.req); {
+	case enc == nil:
+		// The JSON result is {"CRL":"<base64 of the PEM CRL>"}
+		w := &flushWriter{w: hrw, size: crlFlushSize}
+		_, err = io.WriteString(w, `{"CRL":"`)
+		if err == nil {
+			b64 := base64.NewEncoder(base64.StdEncoding, w)
+			err = crl.WritePEM(b64)
+			if err == nil {
+				err = b64.Close()
+			}
+		}
+		if err == nil {
+			_, err = io.WriteString(w, `"}`)
+		}
+	case enc.mediaType == mediaTypeCRL:
+		w := hrw.startEncoded(enc, crl.Size())
+		if !hrw.isHead() {
+			err = crl.WriteDER(&flushWriter{w: w, size: crlFlushSize})
+		}
+	default:
+		w := hrw.startEncoded(enc, crl.PEMSize())
+		if !hrw.isHead() {
+			err = crl.WritePEM(&flushWriter{w: w, size: crlFlushSize})
+		}
+	}
+	if err != nil {
+		return caerrors.NewHTTPErr(500, caerrors.ErrGenCRL, "Failed to write CRL: %s", err)
+	}
+	return nil
+}
+
+// genCRL returns the PEM encoding of the CRL of the request 'req'
+func genCRL(ca *CA, req api.GenCRLRequest, cfg CRLConfig) ([]byte, error) {
+	crl, err := generateCRL(ca, req, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer crl.Close()
+	var buf bytes.Buffer
+	err = crl.WritePEM(&buf)
+	if err != nil {
+		return nil, caerrors.NewHTTPErr(500, caerrors.ErrGenCRL, "Failed to generate CRL for CA '%s': %s", ca.HomeDir, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// generateCRL generates the CRL of the request 'req' with the CRL
+// configuration 'cfg', reading the revoked certificates from the database
+// with a cursor so that memory use does not grow with their number. The CRL
+// of all the revoked certificates is also published to the file
+// 'crl.publishfile' if it is configured.
+func generateCRL(ca *CA, req api.GenCRLRequest, cfg CRLConfig) (*crlStream, error) {
 	if !req.RevokedBefore.IsZero() && req.RevokedAfter.After(req.RevokedBefore) {
 		return nil, caerrors.NewHTTPErr(400, caerrors.ErrInvalidRevokedAfter,
 			"Invalid 'revokedafter' value. It must not be a timestamp greater than 'revokedbefore'")
@@ -94,18 +206,26 @@ func genCRL(ca *CA, req api.GenCRLRequest) ([]byte, error) {
 			"Invalid 'expireafter' value. It must not be a timestamp greater than 'expirebefore'")
 	}
 
-	// Get revoked certificates from the database
-	certs, err := ca.certDBAccessor.GetRevokedCertificates(req.ExpireAfter, req.ExpireBefore, req.RevokedAfter, req.RevokedBefore)
-	if err != nil {
-		log.Errorf("Failed to get revoked certificates from the database: %s", err)
-		return nil, caerrors.NewHTTPErr(500, caerrors.ErrRevokedCertsFromDB, "Failed to get revoked certificates")
+	certs, err := ca.getCACerts()
+	if err == nil && certs.cert == nil {
+		err = errors.New("The CA has no certificate")
 	}
-
-	caCert, err := getCACert(ca)
 	if err != nil {
 		log.Errorf("Failed to get certficate for CA '%s': %s", ca.HomeDir, err)
 		return nil, caerrors.NewHTTPErr(500, caerrors.ErrGetCACert, "Failed to get certficate for CA '%s'", ca.HomeDir)
 	}
+	caCert, aki := certs.cert, certs.aki
+
+	// During a key rollover, the CRL of the certificates issued under the
+	// CA's previous key is signed with the previous key
+	if req.PreviousKey {
+		if ca.previousCert == nil {
+			return nil, caerrors.NewHTTPErr(400, caerrors.ErrNoKeyRollover,
+				"The CA '%s' does not have a previous key; 'rollover.cutover' is not configured", ca.Config.CA.Name)
+		}
+		caCert = ca.previousCert
+		aki = strings.TrimLeft(hex.EncodeToString(caCert.SubjectKeyId), "0")
+	}
 
 	if !canSignCRL(caCert) {
 		return nil, caerrors.NewHTTPErr(500, caerrors.ErrNoCrlSignAuth,
@@ -113,44 +233,57 @@ func genCRL(ca *CA, req api.GenCRLRequest) ([]byte, error) {
 	}
 
 	// Get the signer for the CA
-	_, signer, err := util.GetSignerFromCert(caCert, ca.csp)
+	signer, err := ca.getCASigner(caCert)
 	if err != nil {
 		log.Errorf("Failed to get signer for CA '%s': %s", ca.HomeDir, err)
 		return nil, caerrors.NewHTTPErr(500, caerrors.ErrGetCASigner, "Failed to get signer for CA '%s'", ca.HomeDir)
 	}
 
-	expiry := time.Now().UTC().Add(ca.Config.CRL.Expiry)
-	var revokedCerts []pkix.RevokedCertificate
+	// Once the CA has been rekeyed, each CRL lists only the certificates
+	// issued under the key which signs it
+	if ca.previousCert == nil {
+		aki = ""
+	}
 
-	// For every record, create a new revokedCertificate and add it to slice
-	for _, certRecord := range certs {
-		serialInt := new(big.Int)
-		serialInt.SetString(certRecord.Serial, 16)
-		revokedCert := pkix.RevokedCertificate{
-			SerialNumber:   serialInt,
-			RevocationTime: certRecord.RevokedAt,
-		}
-		revokedCerts = append(revokedCerts, revokedCert)
+	// Get revoked certificates from the database
+	rows, err := ca.certDBAccessor.GetRevokedCertificateRows(req.ExpireAfter, req.ExpireBefore, req.RevokedAfter, req.RevokedBefore)
+	if err != nil {
+		log.Errorf("Failed to get revoked certificates from the database: %s", err)
+		return nil, caerrors.NewHTTPErr(500, caerrors.ErrRevokedCertsFromDB, "Failed to get revoked certificates")
 	}
+	defer rows.Close()
 
-	crl, err := crl.CreateGenericCRL(revokedCerts, signer, caCert, expiry)
+	crl, err := newCRLStream(rows, caCert, signer, aki, cfg.Expiry)
 	if err != nil {
 		log.Errorf("Failed to generate CRL for CA '%s': %s", ca.HomeDir, err)
 		return nil, caerrors.NewHTTPErr(500, caerrors.ErrGenCRL, "Failed to generate CRL for CA '%s'", ca.HomeDir)
 	}
-	blk := &pem.Block{Bytes: crl, Type: crlPemType}
-	return pem.EncodeToMemory(blk), nil
+
+	// Only the CRL of all the certificates revoked under the current key is
+	// published
+	file := cfg.PublishFile
+	if file != "" && !req.PreviousKey && req.RevokedAfter.IsZero() && req.RevokedBefore.IsZero() &&
+		req.ExpireAfter.IsZero() && req.ExpireBefore.IsZero() {
+		err = crl.Publish(file)
+		if err != nil {
+			crl.Close()
+			log.Errorf("Failed to publish CRL for CA '%s': %s", ca.HomeDir, err)
+			return nil, caerrors.NewHTTPErr(500, caerrors.ErrGenCRL, "Failed to publish CRL for CA '%s'", ca.HomeDir)
+		}
+		log.Infof("Published CRL of %d revoked certificates to %s", crl.count, file)
+	}
+	return crl, nil
 }
 
+// getCACert returns the certificate of the CA, which is read from its file
+// when the CA is initialized
 func getCACert(ca *CA) (*x509.Certificate, error) {
-	// Get CA certificate
-	caCertBytes, err := ioutil.ReadFile(ca.Config.CA.Certfile)
-	if err != nil {
-		return nil, errors.WithMessage(err, fmt.Sprintf("Failed to read certificate for the CA '%s'", ca.HomeDir))
-	}
-	caCert, err := BytesToX509Cert(caCertBytes)
+	certs, err := ca.getCACerts()
 	if err != nil {
 		return nil, errors.WithMessage(err, fmt.Sprintf("Failed to get certificate for the CA '%s'", ca.HomeDir))
 	}
-	return caCert, nil
+	if certs.cert == nil {
+		return nil, errors.Errorf("The CA '%s' has no certificate", ca.HomeDir)
+	}
+	return certs.cert, nil
 }
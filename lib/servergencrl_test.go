@@ -0,0 +1,168 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishedCRL(t *testing.T) {
+	srv := TestGetRootServer(t)
+	srv.CA.Config.CRL.PublishFile = "crl.der"
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	client := TestGetRootClient()
+	eresp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin'")
+	admin := eresp.Identity
+	rresp, err := admin.Register(&api.RegistrationRequest{Name: "crluser", Affiliation: "org1"})
+	util.FatalError(t, err, "Failed to register 'crluser'")
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "crluser", Secret: rresp.Secret})
+	util.FatalError(t, err, "Failed to enroll 'crluser'")
+	_, err = admin.Revoke(&api.RevocationRequest{Name: "crluser"})
+	util.FatalError(t, err, "Failed to revoke 'crluser'")
+
+	u := fmt.Sprintf("http://localhost:%d/api/v1/crl", rootPort)
+	get := func(headers map[string]string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", u, nil)
+		util.FatalError(t, err, "Failed to create request")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		util.FatalError(t, err, "Failed to get the published CRL")
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		util.FatalError(t, err, "Failed to read the published CRL")
+		return resp, body
+	}
+
+	resp, _ := get(nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "No CRL should be published before one is generated")
+
+	// Generating the CRL of all the revoked certificates publishes it
+	gresp, err := admin.GenCRL(&api.GenCRLRequest{})
+	util.FatalError(t, err, "Failed to generate CRL")
+	file := filepath.Join(srv.CA.HomeDir, "crl.der")
+	published, err := ioutil.ReadFile(file)
+	util.FatalError(t, err, "The CRL should be published")
+	block, _ := pem.Decode(gresp.CRL)
+	if assert.NotNil(t, block, "The generated CRL should be PEM-encoded") {
+		assert.Equal(t, block.Bytes, published, "The published CRL should be the generated one")
+	}
+
+	resp, crl := get(nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, mediaTypeCRL, resp.Header.Get("Content-Type"))
+	assert.Equal(t, published, crl)
+	parsed, err := x509.ParseRevocationList(crl)
+	if assert.NoError(t, err, "Failed to parse the published CRL") {
+		assert.Equal(t, 1, len(parsed.RevokedCertificateEntries))
+	}
+
+	// An interrupted download is resumed with a Range request
+	resp, part := get(map[string]string{"Range": "bytes=100-"})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, crl[100:], part)
+	// and an unchanged CRL is not downloaded again
+	lastModified := resp.Header.Get("Last-Modified")
+	assert.NotEmpty(t, lastModified)
+	resp, body := get(map[string]string{"If-Modified-Since": lastModified})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	assert.Empty(t, body)
+	etag := resp.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.NotEmpty(t, resp.Header.Get("Cache-Control"))
+	resp, body = get(map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	assert.Empty(t, body)
+
+	// A CRL of some of the revoked certificates is not published
+	_, err = admin.GenCRL(&api.GenCRLRequest{RevokedAfter: parsed.ThisUpdate.AddDate(0, 0, 1)})
+	util.FatalError(t, err, "Failed to generate CRL")
+	again, err := ioutil.ReadFile(file)
+	util.FatalError(t, err, "Failed to read the published CRL")
+	assert.Equal(t, published, again, "A filtered CRL should not be published")
+
+	// Once another certificate is revoked, the CRL published next has
+	// another ETag
+	rresp, err = admin.Register(&api.RegistrationRequest{Name: "crluser2", Affiliation: "org1"})
+	util.FatalError(t, err, "Failed to register 'crluser2'")
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "crluser2", Secret: rresp.Secret})
+	util.FatalError(t, err, "Failed to enroll 'crluser2'")
+	_, err = admin.Revoke(&api.RevocationRequest{Name: "crluser2"})
+	util.FatalError(t, err, "Failed to revoke 'crluser2'")
+	_, err = admin.GenCRL(&api.GenCRLRequest{})
+	util.FatalError(t, err, "Failed to generate CRL")
+	resp, crl = get(map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "The new CRL should be returned")
+	assert.NotEqual(t, etag, resp.Header.Get("ETag"))
+	parsed, err = x509.ParseRevocationList(crl)
+	if assert.NoError(t, err, "Failed to parse the published CRL") {
+		assert.Equal(t, 2, len(parsed.RevokedCertificateEntries))
+	}
+
+	req, err := http.NewRequest("GET", u+"?ca=nonexistent", nil)
+	util.FatalError(t, err, "Failed to create request")
+	resp, err = http.DefaultClient.Do(req)
+	util.FatalError(t, err, "Failed to send request")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "The CRL of a CA which does not exist should not be found")
+}
+
+func TestExportCertificates(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	client := TestGetRootClient()
+	eresp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin'")
+	admin := eresp.Identity
+	_, err = admin.Reenroll(&api.ReenrollmentRequest{})
+	util.FatalError(t, err, "Failed to reenroll 'admin'")
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/api/v1/certificates", rootPort), nil)
+	util.FatalError(t, err, "Failed to create request")
+	req.Header.Set("Accept", mediaTypePEM)
+	err = admin.addTokenAuthHdr(req, nil)
+	util.FatalError(t, err, "Failed to add token")
+	resp, err := http.DefaultClient.Do(req)
+	util.FatalError(t, err, "Failed to export certificates")
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	util.FatalError(t, err, "Failed to read certificates")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Failed to export certificates: %s", body)
+	assert.Equal(t, mediaTypePEM, resp.Header.Get("Content-Type"))
+	assert.Contains(t, resp.Header.Get("Content-Disposition"), "certificates.pem")
+	certs := 0
+	for block, rest := pem.Decode(body); block != nil; block, rest = pem.Decode(rest) {
+		assert.Equal(t, "CERTIFICATE", block.Type)
+		certs++
+	}
+	assert.Equal(t, 2, certs, "Both certificates of 'admin' should be exported")
+}
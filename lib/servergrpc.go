@@ -0,0 +1,522 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	cfsslapi "github.com/cloudflare/cfssl/api"
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/cfssl/signer"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/api/capb"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/lib/common"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcAuthMetadata is the metadata of a gRPC call which has its credentials,
+// as the authorization header has those of a REST request
+const grpcAuthMetadata = "authorization"
+
+// The gRPC status codes of the HTTP status codes of the errors of the handlers
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:            codes.InvalidArgument,
+	http.StatusUnauthorized:          codes.Unauthenticated,
+	http.StatusForbidden:             codes.PermissionDenied,
+	http.StatusNotFound:              codes.NotFound,
+	http.StatusRequestTimeout:        codes.DeadlineExceeded,
+	http.StatusConflict:              codes.AlreadyExists,
+	http.StatusPreconditionFailed:    codes.FailedPrecondition,
+	http.StatusRequestEntityTooLarge: codes.ResourceExhausted,
+	http.StatusTooManyRequests:       codes.ResourceExhausted,
+	http.StatusNotImplemented:        codes.Unimplemented,
+	http.StatusServiceUnavailable:    codes.Unavailable,
+	http.StatusGatewayTimeout:        codes.DeadlineExceeded,
+}
+
+// listenAndServeGRPC starts serving the gRPC service if a gRPC listening
+// address is configured. The listener uses the TLS configuration of the
+// server's listener, if any, so that it has the same certificate and client
+// authentication.
+func (s *Server) listenAndServeGRPC(tlsConfig *tls.Config) error {
+	addr := s.Config.GRPC.ListenAddress
+	if addr == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "TCP listen failed for gRPC address %s", addr)
+	}
+	svc := newGRPCService(s)
+	opts := []grpc.ServerOption{grpc.UnaryInterceptor(svc.authInterceptor)}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	gs := grpc.NewServer(opts...)
+	capb.RegisterCAServer(gs, svc)
+	s.grpcListener = listener
+	s.grpcServer = gs
+	log.Infof("Listening for gRPC requests on %s", listener.Addr())
+	go func() {
+		err := gs.Serve(listener)
+		log.Debugf("Stopped serving gRPC requests on %s: %v", addr, err)
+	}()
+	return nil
+}
+
+// stopGRPC stops the gRPC service, which closes its listener and connections
+func (s *Server) stopGRPC() {
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+		s.grpcServer = nil
+		s.grpcListener = nil
+	}
+}
+
+// grpcService is the gRPC service of the server. Each of its operations is
+// handled by the REST endpoint of the operation, with its middleware, as a
+// request whose body is the JSON encoding of the REST request, so that the
+// service has the same authentication, authorization, limits and behavior as
+// the REST API.
+type grpcService struct {
+	server *Server
+	// The REST endpoints of the operations by full method name
+	endpoints map[string]*grpcEndpoint
+}
+
+// grpcEndpoint is the REST endpoint of an operation of the gRPC service
+type grpcEndpoint struct {
+	// Path of the endpoint, which is that of the requests in the server's log
+	path string
+	*serverEndpoint
+	// The handler of the calls, which is the endpoint with the middleware of
+	// the server's endpoints
+	handler http.Handler
+}
+
+// grpcCall is a gRPC call which the handler of a REST endpoint handles
+type grpcCall struct {
+	endpoint *grpcEndpoint
+	// The REST request of the call, whose header and TLS connection state
+	// have the credentials of the call
+	req *http.Request
+	// True once the handler of the endpoint has returned, with its result and
+	// error
+	handled bool
+	resp    interface{}
+	he      *caerrors.HTTPErr
+}
+
+// grpcCallKey is the key of the context value of a gRPC call
+type grpcCallKey struct{}
+
+// newGRPCService returns the gRPC service of 's'
+func newGRPCService(s *Server) *grpcService {
+	g := &grpcService{server: s, endpoints: map[string]*grpcEndpoint{}}
+	for method, e := range map[string]*grpcEndpoint{
+		"/capb.CA/Enroll":    {path: "enroll", serverEndpoint: newEnrollEndpoint(s)},
+		"/capb.CA/Reenroll":  {path: "reenroll", serverEndpoint: newReenrollEndpoint(s)},
+		"/capb.CA/Register":  {path: "register", serverEndpoint: newRegisterEndpoint(s)},
+		"/capb.CA/Revoke":    {path: "revoke", serverEndpoint: newRevokeEndpoint(s)},
+		"/capb.CA/GetCACert": {path: "cainfo", serverEndpoint: newCAInfoEndpoint(s)},
+		"/capb.CA/GenCRL":    {path: "gencrl", serverEndpoint: newGenCRLEndpoint(s)},
+	} {
+		e.handler = s.wrapEndpoint(e.path, http.HandlerFunc(e.serveCall))
+		g.endpoints[method] = e
+	}
+	return g
+}
+
+// GRPCTokenBody returns what the token of a gRPC call with the request
+// message 'msg' signs, which is the JSON body of the REST request that the
+// call is handled as. Unlike the serialized message, it depends only on the
+// values of the fields of the message.
+func GRPCTokenBody(msg proto.Message) ([]byte, error) {
+	req, err := grpcRESTRequest(msg)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(req)
+}
+
+// authInterceptor makes the REST request of a call, which carries the
+// credentials of the call to the handler which verifies them as it does
+// those of a REST request: the "authorization" metadata is the authorization
+// header, and the TLS client certificate of the call is that of the request.
+// A call without credentials to an operation which requires them is rejected.
+func (g *grpcService) authInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	e, ok := g.endpoints[info.FullMethod]
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "Unknown method %s", info.FullMethod)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	auth := md.Get(grpcAuthMetadata)
+	if len(auth) == 0 && e.auth != authNone {
+		return nil, grpcError(caerrors.CreateHTTPErr(http.StatusUnauthorized, caerrors.ErrNoAuthHdr, "No authorization metadata"))
+	}
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "Unexpected request message %T", req)
+	}
+	body, err := GRPCTokenBody(msg)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid request message: %s", err)
+	}
+	call := &grpcCall{endpoint: e}
+	ctx = context.WithValue(ctx, grpcCallKey{}, call)
+	r, err := http.NewRequest("POST", apiPathPrefix+e.path, bytes.NewReader(body))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to create the request of the call: %s", err)
+	}
+	r = r.WithContext(ctx)
+	r.Header.Set("Content-Type", "application/json")
+	if len(auth) > 0 {
+		r.Header.Set("Authorization", auth[0])
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			r.TLS = &tlsInfo.State
+		}
+	}
+	call.req = r
+	return handler(ctx, req)
+}
+
+// serveCall handles the REST request of a gRPC call with the handler of the
+// endpoint, recording its result and error in the call rather than writing
+// them, except for a result which the handler streams
+func (e *grpcEndpoint) serveCall(w http.ResponseWriter, r *http.Request) {
+	call := r.Context().Value(grpcCallKey{}).(*grpcCall)
+	info := getRequestInfo(r)
+	hrw := newHTTPResponseWriter(r, w, e.serverEndpoint)
+	ctx := newServerRequestContext(r, hrw, e.serverEndpoint)
+	defer ctx.releaseBody()
+	resp, err := e.handle(ctx)
+	// Record the caller and the outcome, which the middleware logs
+	info.identity = ctx.enrollmentID
+	he := getHTTPErr(err)
+	e.audit(r, ctx, info, he)
+	if he != nil {
+		info.code = he.GetLocalCode()
+		info.msg = he.GetLocalMsg()
+		if !hrw.writeCalled {
+			w.WriteHeader(he.GetStatusCode())
+		}
+	}
+	call.handled, call.resp, call.he = true, resp, he
+}
+
+// handle handles the call of 'ctx' with the REST endpoint of its operation
+// and decodes the result of the handler into 'result'
+func (g *grpcService) handle(ctx context.Context, result interface{}) (err error) {
+	call, ok := ctx.Value(grpcCallKey{}).(*grpcCall)
+	if !ok {
+		return status.Error(codes.Internal, "The call was not received through the authentication interceptor")
+	}
+	rec := &grpcResponseRecorder{header: http.Header{}}
+	func() {
+		// The middleware aborts a response which the handler has started
+		// when the handler panics
+		defer func() {
+			if p := recover(); p != nil {
+				log.Errorf("Aborted gRPC call to %s: %v", call.endpoint.path, p)
+				err = status.Error(codes.Internal, "Internal server error")
+			}
+		}()
+		call.endpoint.handler.ServeHTTP(rec, call.req)
+	}()
+	if err != nil {
+		return err
+	}
+	if !call.handled {
+		// The middleware rejected the request or the handler panicked
+		return grpcError(rec.httpErr())
+	}
+	if call.he != nil {
+		return grpcError(call.he)
+	}
+	// A handler which streams its result writes it, after the start of the
+	// response envelope, rather than returning it
+	var buf []byte
+	if call.resp != nil {
+		buf, err = json.Marshal(call.resp)
+		if err != nil {
+			return status.Errorf(codes.Internal, "Failed to encode the result: %s", err)
+		}
+	} else {
+		buf = bytes.TrimPrefix(rec.body.Bytes(), []byte(`{"result":`))
+	}
+	err = json.NewDecoder(bytes.NewReader(buf)).Decode(result)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to decode the result: %s", err)
+	}
+	return nil
+}
+
+// grpcError returns the gRPC status of the error 'he' of a handler, whose
+// message has the error code of the REST API as that of the REST response
+func grpcError(he *caerrors.HTTPErr) error {
+	code, ok := grpcCodes[he.GetStatusCode()]
+	if !ok {
+		code = codes.Unknown
+		if he.GetStatusCode() >= 500 {
+			code = codes.Internal
+		}
+	}
+	return status.Errorf(code, "Error Code: %d - %s", he.GetRemoteCode(), he.GetRemoteMsg())
+}
+
+// grpcRESTRequest returns the REST request of the request message 'msg'
+func grpcRESTRequest(msg proto.Message) (interface{}, error) {
+	switch in := msg.(type) {
+	case *capb.EnrollmentRequest:
+		req := &api.EnrollmentRequestNet{
+			SignRequest: signer.SignRequest{
+				Request: in.CertificateRequest,
+				Hosts:   in.Hosts,
+				Profile: in.Profile,
+				Label:   in.Label,
+			},
+			CAName: in.Caname,
+		}
+		for _, ar := range in.AttrReqs {
+			req.AttrReqs = append(req.AttrReqs, &api.AttributeRequest{Name: ar.Name, Optional: ar.Optional})
+		}
+		return req, nil
+	case *capb.RegistrationRequest:
+		req := &api.RegistrationRequestNet{
+			RegistrationRequest: api.RegistrationRequest{
+				Name:           in.Name,
+				Type:           in.Type,
+				Secret:         in.Secret,
+				MaxEnrollments: int(in.MaxEnrollments),
+				Affiliation:    in.Affiliation,
+				CAName:         in.Caname,
+			},
+		}
+		for _, a := range in.Attrs {
+			req.Attributes = append(req.Attributes, api.Attribute{Name: a.Name, Value: a.Value, ECert: a.Ecert})
+		}
+		return req, nil
+	case *capb.RevocationRequest:
+		return &api.RevocationRequestNet{
+			RevocationRequest: api.RevocationRequest{
+				Name:   in.Name,
+				Serial: in.Serial,
+				AKI:    in.Aki,
+				Reason: in.Reason,
+				CAName: in.Caname,
+				GenCRL: in.Gencrl,
+			},
+		}, nil
+	case *capb.GetCACertRequest:
+		return &api.GetCAInfoRequest{CAName: in.Caname}, nil
+	case *capb.GenCRLRequest:
+		req := &api.GenCRLRequest{CAName: in.Caname, PreviousKey: in.PreviousKey}
+		for _, t := range []struct {
+			ts  *timestamp.Timestamp
+			val *time.Time
+		}{
+			{in.RevokedAfter, &req.RevokedAfter},
+			{in.RevokedBefore, &req.RevokedBefore},
+			{in.ExpireAfter, &req.ExpireAfter},
+			{in.ExpireBefore, &req.ExpireBefore},
+		} {
+			if t.ts == nil {
+				continue
+			}
+			var err error
+			*t.val, err = ptypes.Timestamp(t.ts)
+			if err != nil {
+				return nil, errors.WithMessage(err, "Invalid time in request")
+			}
+		}
+		return req, nil
+	}
+	return nil, errors.Errorf("Unexpected request message %T", msg)
+}
+
+// Enroll implements capb.CAServer
+func (g *grpcService) Enroll(ctx context.Context, in *capb.EnrollmentRequest) (*capb.EnrollmentResponse, error) {
+	return g.enroll(ctx)
+}
+
+// Reenroll implements capb.CAServer
+func (g *grpcService) Reenroll(ctx context.Context, in *capb.EnrollmentRequest) (*capb.EnrollmentResponse, error) {
+	return g.enroll(ctx)
+}
+
+// enroll handles the enrollment or reenrollment call of 'ctx'
+func (g *grpcService) enroll(ctx context.Context) (*capb.EnrollmentResponse, error) {
+	var resp common.EnrollmentResponseNet
+	err := g.handle(ctx, &resp)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := grpcDecode(resp.Cert, "certificate")
+	if err != nil {
+		return nil, err
+	}
+	caInfo, err := grpcCAInfo(&resp.ServerInfo)
+	if err != nil {
+		return nil, err
+	}
+	return &capb.EnrollmentResponse{Cert: cert, ServerInfo: caInfo}, nil
+}
+
+// Register implements capb.CAServer
+func (g *grpcService) Register(ctx context.Context, in *capb.RegistrationRequest) (*capb.RegistrationResponse, error) {
+	var resp api.RegistrationResponseNet
+	err := g.handle(ctx, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &capb.RegistrationResponse{Secret: resp.Secret}, nil
+}
+
+// Revoke implements capb.CAServer
+func (g *grpcService) Revoke(ctx context.Context, in *capb.RevocationRequest) (*capb.RevocationResponse, error) {
+	var resp api.RevocationResponseNet
+	err := g.handle(ctx, &resp)
+	if err != nil {
+		return nil, err
+	}
+	out := &capb.RevocationResponse{}
+	for _, rc := range resp.RevokedCerts {
+		out.RevokedCerts = append(out.RevokedCerts, &capb.RevokedCert{Serial: rc.Serial, Aki: rc.AKI})
+	}
+	out.Crl, err = grpcDecode(resp.CRL, "CRL")
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetCACert implements capb.CAServer
+func (g *grpcService) GetCACert(ctx context.Context, in *capb.GetCACertRequest) (*capb.CAInfo, error) {
+	var resp common.CAInfoResponseNet
+	err := g.handle(ctx, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return grpcCAInfo(&resp)
+}
+
+// GenCRL implements capb.CAServer
+func (g *grpcService) GenCRL(ctx context.Context, in *capb.GenCRLRequest) (*capb.GenCRLResponse, error) {
+	var resp api.GenCRLResponseNet
+	err := g.handle(ctx, &resp)
+	if err != nil {
+		return nil, err
+	}
+	crl, err := grpcDecode(resp.CRL, "CRL")
+	if err != nil {
+		return nil, err
+	}
+	return &capb.GenCRLResponse{Crl: crl}, nil
+}
+
+// grpcCAInfo returns the CA information of the REST response 'info'
+func grpcCAInfo(info *common.CAInfoResponseNet) (*capb.CAInfo, error) {
+	chain, err := grpcDecode(info.CAChain, "CA chain")
+	if err != nil {
+		return nil, err
+	}
+	ipk, err := grpcDecode(info.IssuerPublicKey, "issuer public key")
+	if err != nil {
+		return nil, err
+	}
+	rpk, err := grpcDecode(info.IssuerRevocationPublicKey, "issuer revocation public key")
+	if err != nil {
+		return nil, err
+	}
+	return &capb.CAInfo{
+		Caname:                    info.CAName,
+		CaChain:                   chain,
+		IssuerPublicKey:           ipk,
+		IssuerRevocationPublicKey: rpk,
+		Version:                   info.Version,
+	}, nil
+}
+
+// grpcDecode decodes the base64 encoding 'b64' of 'what' in a REST response
+func grpcDecode(b64, what string) ([]byte, error) {
+	if b64 == "" {
+		return nil, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Invalid base64 encoding of the %s: %s", what, err)
+	}
+	return b, nil
+}
+
+// grpcResponseRecorder records the response of the REST request of a call:
+// the result which the handler of the endpoint writes rather than returns, or
+// the error response of the middleware
+type grpcResponseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *grpcResponseRecorder) Header() http.Header {
+	return rr.header
+}
+
+func (rr *grpcResponseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	return rr.body.Write(b)
+}
+
+func (rr *grpcResponseRecorder) WriteHeader(scode int) {
+	if rr.status == 0 {
+		rr.status = scode
+	}
+}
+
+func (rr *grpcResponseRecorder) Flush() {}
+
+// httpErr returns the error of the error response which the middleware wrote
+// in the error envelope or in the legacy format
+func (rr *grpcResponseRecorder) httpErr() *caerrors.HTTPErr {
+	var resp struct {
+		caerrors.ErrorResponse
+		Errors []cfsslapi.ResponseMessage `json:"errors"`
+	}
+	scode := rr.status
+	if scode < http.StatusBadRequest {
+		scode = http.StatusInternalServerError
+	}
+	if json.Unmarshal(rr.body.Bytes(), &resp) != nil {
+		return caerrors.CreateHTTPErr(scode, caerrors.ErrUnknown, "Internal server error")
+	}
+	if len(resp.Errors) > 0 {
+		return caerrors.CreateHTTPErr(scode, resp.Errors[0].Code, "%s", resp.Errors[0].Message)
+	}
+	return caerrors.CreateHTTPErr(scode, resp.Details.ErrorCode, "%s", resp.Message)
+}
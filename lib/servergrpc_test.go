@@ -0,0 +1,257 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/api/capb"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The HTTP and gRPC listeners of one server serve the same CA, and what is
+// done through either is seen through the other
+func TestGRPC(t *testing.T) {
+	srv := TestGetRootServer(t)
+	srv.Config.GRPC.ListenAddress = "127.0.0.1:0"
+	srv.Config.HTTP.MaxBodySizes = map[string]int{"register": 1024}
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	addr := srv.ListenAddresses().GRPC
+	if addr == "" {
+		t.Fatal("The address of the gRPC listener should be reported")
+	}
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	util.FatalError(t, err, "Failed to connect to the gRPC listener")
+	defer conn.Close()
+	ca := capb.NewCAClient(conn)
+	client := TestGetRootClient()
+
+	// The CA chain requires no credentials
+	caInfo, err := ca.GetCACert(grpcTestContext(nil), &capb.GetCACertRequest{})
+	util.FatalError(t, err, "Failed to get the CA certificate over gRPC")
+	httpInfo, err := client.GetCAInfo(&api.GetCAInfoRequest{})
+	util.FatalError(t, err, "Failed to get the CA certificate over HTTP")
+	assert.Equal(t, httpInfo.CAChain, caInfo.CaChain, "Both listeners should serve the same CA chain")
+	assert.Equal(t, httpInfo.CAName, caInfo.Caname)
+
+	// Enrollment requires the basic authorization of the enrollment secret
+	csr, _ := grpcTestCSR(t, "admin")
+	enrollReq := &capb.EnrollmentRequest{CertificateRequest: csr}
+	enrollResp, err := ca.Enroll(grpcTestContext(grpcBasicAuth("admin", "adminpw")), enrollReq)
+	util.FatalError(t, err, "Failed to enroll over gRPC")
+	cert := grpcTestCert(t, enrollResp.Cert)
+	assert.Equal(t, "admin", cert.Subject.CommonName)
+	assert.Equal(t, caInfo.CaChain, enrollResp.ServerInfo.CaChain)
+	_, err = ca.Enroll(grpcTestContext(nil), enrollReq)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "Enrollment without credentials should fail: %v", err)
+	_, err = ca.Enroll(grpcTestContext(grpcBasicAuth("admin", "wrongpw")), enrollReq)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "Enrollment with a wrong secret should fail: %v", err)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Authentication failure")
+	}
+
+	// The other operations require the token of an identity, which signs
+	// the JSON body of the REST request of the call
+	resp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll over HTTP")
+	admin := resp.Identity
+	regReq := &capb.RegistrationRequest{Name: "grpcuser", Affiliation: "org1", Attrs: []*capb.Attribute{{Name: "color", Value: "blue"}}}
+	_, err = ca.Register(grpcTestContext(grpcToken(t, admin, &capb.RegistrationRequest{Name: "other"})), regReq)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "A token which does not sign the request should be rejected: %v", err)
+	_, err = ca.Register(grpcTestContext(nil), regReq)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "Registration without credentials should fail: %v", err)
+	regResp, err := ca.Register(grpcTestContext(grpcToken(t, admin, regReq)), regReq)
+	util.FatalError(t, err, "Failed to register over gRPC")
+	assert.NotEmpty(t, regResp.Secret)
+	_, err = ca.Register(grpcTestContext(grpcToken(t, admin, regReq)), regReq)
+	assert.Error(t, err, "Registering the same identity again should fail")
+
+	// The calls have the limits of the REST endpoints
+	bigReq := &capb.RegistrationRequest{Name: "biguser", Affiliation: "org1", Attrs: []*capb.Attribute{{Name: "big", Value: strings.Repeat("x", 1024)}}}
+	_, err = ca.Register(grpcTestContext(grpcToken(t, admin, bigReq)), bigReq)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "A request over the body size limit should be rejected: %v", err)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), fmt.Sprintf("Error Code: %d", caerrors.ErrReqBodyTooLarge))
+	}
+
+	// The identity registered over gRPC enrolls over HTTP, and the identity
+	// enrolled over HTTP reenrolls over gRPC
+	resp, err = client.Enroll(&api.EnrollmentRequest{Name: "grpcuser", Secret: regResp.Secret})
+	util.FatalError(t, err, "Failed to enroll the identity registered over gRPC")
+	user := resp.Identity
+	csr, _ = grpcTestCSR(t, "grpcuser")
+	reenrollReq := &capb.EnrollmentRequest{CertificateRequest: csr, AttrReqs: []*capb.AttributeRequest{{Name: "color"}}}
+	reenrollResp, err := ca.Reenroll(grpcTestContext(grpcToken(t, user, reenrollReq)), reenrollReq)
+	util.FatalError(t, err, "Failed to reenroll over gRPC")
+	cert = grpcTestCert(t, reenrollResp.Cert)
+	assert.Equal(t, "grpcuser", cert.Subject.CommonName)
+
+	// Revocation and CRL generation are authorized as over HTTP
+	revReq := &capb.RevocationRequest{Name: "admin"}
+	_, err = ca.Revoke(grpcTestContext(grpcToken(t, user, revReq)), revReq)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "An identity without hf.Revoker should not revoke another: %v", err)
+	revReq = &capb.RevocationRequest{Name: "grpcuser", Gencrl: true}
+	revResp, err := ca.Revoke(grpcTestContext(grpcToken(t, admin, revReq)), revReq)
+	util.FatalError(t, err, "Failed to revoke over gRPC")
+	assert.Len(t, revResp.RevokedCerts, 2, "Both certificates of the identity should be revoked")
+	assert.NotEmpty(t, revResp.Crl)
+	crlReq := &capb.GenCRLRequest{RevokedAfter: grpcTimestamp(t, time.Now().Add(-time.Hour))}
+	crlResp, err := ca.GenCRL(grpcTestContext(grpcToken(t, admin, crlReq)), crlReq)
+	util.FatalError(t, err, "Failed to generate a CRL over gRPC")
+	block, _ := pem.Decode(crlResp.Crl)
+	if block == nil {
+		t.Fatal("The CRL should be PEM-encoded")
+	}
+	crl, err := x509.ParseCRL(block.Bytes)
+	util.FatalError(t, err, "Failed to parse the CRL")
+	revoked := map[string]bool{}
+	for _, rc := range crl.TBSCertList.RevokedCertificates {
+		revoked[rc.SerialNumber.Text(16)] = true
+	}
+	assert.True(t, revoked[cert.SerialNumber.Text(16)], "The CRL should list the certificate reenrolled over gRPC")
+	_, err = user.Reenroll(&api.ReenrollmentRequest{})
+	assert.Error(t, err, "The identity revoked over gRPC should not reenroll over HTTP")
+}
+
+// The gRPC listener has the TLS configuration of the server, including the
+// verification of the client certificates
+func TestGRPCTLS(t *testing.T) {
+	srv := TestGetRootServer(t)
+	srv.Config.GRPC.ListenAddress = "127.0.0.1:0"
+	srv.Config.TLS.Enabled = true
+	srv.Config.TLS.CertFile = "tls-cert.pem"
+	srv.Config.TLS.ClientAuth.Type = "VerifyClientCertIfGiven"
+	srv.Config.TLS.ClientAuth.CertFiles = []string{"ca-cert.pem"}
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+	}()
+	addr := srv.ListenAddresses().GRPC
+
+	_, err = grpcTestDial(t, addr, nil).GetCACert(grpcTestContext(nil), &capb.GetCACertRequest{})
+	util.FatalError(t, err, "Failed to get the CA certificate over gRPC with TLS")
+	csr, key := grpcTestCSR(t, "admin")
+	enrollResp, err := grpcTestDial(t, addr, nil).Enroll(grpcTestContext(grpcBasicAuth("admin", "adminpw")),
+		&capb.EnrollmentRequest{CertificateRequest: csr})
+	util.FatalError(t, err, "Failed to enroll over gRPC with TLS")
+
+	// A client certificate issued by the CA is accepted
+	cert := &tls.Certificate{Certificate: [][]byte{grpcTestCert(t, enrollResp.Cert).Raw}, PrivateKey: key}
+	_, err = grpcTestDial(t, addr, cert).GetCACert(grpcTestContext(nil), &capb.GetCACertRequest{})
+	assert.NoError(t, err, "A client certificate issued by the CA should be accepted")
+
+	// A client certificate which the server does not trust is rejected
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "untrusted"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	util.FatalError(t, err, "Failed to create certificate")
+	cert = &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	_, err = grpcTestDial(t, addr, cert).GetCACert(grpcTestContext(nil), &capb.GetCACertRequest{})
+	assert.Error(t, err, "A client certificate which is not trusted should be rejected")
+}
+
+// grpcTestDial returns a client of the gRPC listener 'addr' with TLS and the
+// client certificate 'cert', if any
+func grpcTestDial(t *testing.T, addr string, cert *tls.Certificate) capb.CAClient {
+	// The TLS certificate generated by the server has no host names
+	cfg := &tls.Config{InsecureSkipVerify: true}
+	if cert != nil {
+		// The client certificate is sent even if the server does not
+		// trust its issuer
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert, nil
+		}
+	}
+	creds := credentials.NewTLS(cfg)
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(creds))
+	util.FatalError(t, err, "Failed to connect to the gRPC listener")
+	return capb.NewCAClient(conn)
+}
+
+// grpcTestContext returns the context of a call with the metadata 'md'
+func grpcTestContext(md metadata.MD) context.Context {
+	ctx := context.Background()
+	if md == nil {
+		return ctx
+	}
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// grpcBasicAuth returns the metadata of the basic authorization of 'user'
+func grpcBasicAuth(user, secret string) metadata.MD {
+	return metadata.Pairs(grpcAuthMetadata, "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+secret)))
+}
+
+// grpcToken returns the metadata of the token of 'id' which signs 'msg'
+func grpcToken(t *testing.T, id *Identity, msg proto.Message) metadata.MD {
+	body, err := GRPCTokenBody(msg)
+	util.FatalError(t, err, "Failed to get the body of the token")
+	ecert := id.GetECert()
+	token, err := util.CreateToken(id.GetClient().GetCSP(), ecert.Cert(), ecert.Key(), body)
+	util.FatalError(t, err, "Failed to create token")
+	return metadata.Pairs(grpcAuthMetadata, token)
+}
+
+// grpcTestCSR returns a PEM-encoded CSR for 'cn' and its key
+func grpcTestCSR(t *testing.T, cn string) (string, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	util.FatalError(t, err, "Failed to generate key")
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}}, key)
+	util.FatalError(t, err, "Failed to create CSR")
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), key
+}
+
+// grpcTestCert parses the PEM-encoded certificate 'certPEM'
+func grpcTestCert(t *testing.T, certPEM []byte) *x509.Certificate {
+	cert, err := util.GetX509CertificateFromPEM(certPEM)
+	util.FatalError(t, err, "Failed to parse certificate")
+	return cert
+}
+
+// grpcTimestamp returns the timestamp of 't'
+func grpcTimestamp(t *testing.T, tm time.Time) *timestamp.Timestamp {
+	ts, err := ptypes.TimestampProto(tm)
+	util.FatalError(t, err, "Failed to convert time")
+	return ts
+}
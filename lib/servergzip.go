@@ -0,0 +1,331 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/pkg/errors"
+)
+
+// The defaults of the compression settings
+const (
+	defaultCompressionMinSize      = 1024
+	defaultMaxDecompressedBodySize = 10 << 20
+)
+
+// compressedContentTypes are the content types of responses which are
+// already compressed, and so are not compressed again
+var compressedContentTypes = []string{
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/zstd",
+	"image/",
+	"video/",
+}
+
+// errBodyTooLarge is the error of reading a request body which is larger
+// than the server allows, once decompressed if it is a gzip body
+type errBodyTooLarge struct {
+	limit        int64
+	decompressed bool
+}
+
+func (e *errBodyTooLarge) Error() string {
+	if e.decompressed {
+		return "the decompressed request body is larger than " + strconv.FormatInt(e.limit, 10) + " bytes"
+	}
+	return "the request body is larger than " + strconv.FormatInt(e.limit, 10) + " bytes"
+}
+
+// compressionSettings returns whether compression is enabled, the size below
+// which a response is not compressed and the maximum size of a decompressed
+// request body
+func (s *Server) compressionSettings() (bool, int, int64) {
+	if s.Config == nil {
+		return true, defaultCompressionMinSize, defaultMaxDecompressedBodySize
+	}
+	c := &s.Config.HTTP
+	minSize := c.CompressionMinSize
+	if minSize <= 0 {
+		minSize = defaultCompressionMinSize
+	}
+	maxSize := int64(c.MaxDecompressedBodySize)
+	if maxSize <= 0 {
+		maxSize = defaultMaxDecompressedBodySize
+	}
+	return !c.DisableCompression, minSize, maxSize
+}
+
+// handleGzip decompresses the gzip request bodies before they reach 'next',
+// so that the endpoints, and the verification of the authorization token in
+// particular, see the body which the client signed, and compresses the
+// responses of the clients which accept gzip
+func (s *Server) handleGzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enabled, minSize, maxSize := s.compressionSettings()
+		if !enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Tell the clients that they may compress their request bodies
+		w.Header().Set("Accept-Encoding", "gzip")
+		// The ETags of the client's copies of compressed responses are
+		// those of the uncompressed responses to the handlers
+		gzipETag := stripGzipETags(r)
+		if he := decompressRequest(r, maxSize); he != nil {
+			if info := getRequestInfo(r); info != nil {
+				info.code = he.GetLocalCode()
+				info.msg = he.GetLocalMsg()
+			}
+			s.writeError(w, he)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == "HEAD" || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, minSize: minSize, gzipETag: gzipETag}
+		// Not deferred, so that if 'next' panics, what it wrote is replaced
+		// by the error response rather than sent
+		next.ServeHTTP(gw, r)
+		gw.finish()
+	})
+}
+
+// decompressRequest replaces the body of 'r', if it is compressed with gzip,
+// with a reader of the decompressed body which fails once more than 'maxSize'
+// bytes are read
+func decompressRequest(r *http.Request, maxSize int64) *caerrors.HTTPErr {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+	default:
+		return caerrors.CreateHTTPErr(http.StatusUnsupportedMediaType, caerrors.ErrUnsupportedEncoding,
+			"Unsupported content encoding '%s' of the request body; it must be gzip or identity", encoding)
+	}
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return caerrors.CreateHTTPErr(http.StatusBadRequest, caerrors.ErrReadingReqBody, "Invalid gzip request body: %s", err)
+	}
+	r.Body = &gzipRequestBody{zr: zr, body: r.Body, limit: maxSize}
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+	return nil
+}
+
+// gzipRequestBody is the decompressed body of a gzip request, which fails
+// with an errBodyTooLarge once more than 'limit' bytes are read, so that a
+// small body cannot decompress into an unbounded amount of memory
+type gzipRequestBody struct {
+	zr    *gzip.Reader
+	body  io.ReadCloser
+	limit int64
+	read  int64
+}
+
+func (b *gzipRequestBody) Read(p []byte) (int, error) {
+	if b.read > b.limit {
+		return 0, &errBodyTooLarge{limit: b.limit, decompressed: true}
+	}
+	// Reading one byte more than the limit tells whether the body exceeds it
+	if max := b.limit + 1 - b.read; int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := b.zr.Read(p)
+	b.read += int64(n)
+	if b.read > b.limit {
+		return n, &errBodyTooLarge{limit: b.limit, decompressed: true}
+	}
+	if err != nil && err != io.EOF {
+		err = errors.Wrap(err, "Invalid gzip request body")
+	}
+	return n, err
+}
+
+func (b *gzipRequestBody) Close() error {
+	b.zr.Close()
+	return b.body.Close()
+}
+
+// acceptsGzip returns true if the Accept-Encoding header 'header' of a
+// request accepts gzip
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name != "gzip" && name != "x-gzip" {
+			continue
+		}
+		for _, parm := range fields[1:] {
+			parm = strings.TrimSpace(parm)
+			if strings.HasPrefix(parm, "q=") {
+				q, err := strconv.ParseFloat(parm[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// isCompressedContentType returns true if the content type 'ct' is that of
+// data which is already compressed
+func isCompressedContentType(ct string) bool {
+	ct = strings.ToLower(ct)
+	for _, prefix := range compressedContentTypes {
+		if strings.HasPrefix(ct, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses a response with gzip. It holds back the
+// response header until either 'minSize' bytes have been written, when it
+// knows whether the response is worth compressing, or the response is
+// complete.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize int
+	// The status code of the response, or 0 if it has not been written
+	status int
+	// The start of the body while the writer is undecided
+	buf []byte
+	// True once the header has been sent
+	decided bool
+	// The compressor of the body, or nil if it is not compressed
+	gz *gzip.Writer
+	// True if the client's copy of the response is compressed, so that a
+	// 304 (Not Modified) response has the ETag of the compressed response
+	gzipETag bool
+}
+
+// WriteHeader holds back the header until the writer decides whether to
+// compress the response
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		// The response has no body
+		w.decide(false)
+	}
+}
+
+// Write compresses 'p' or holds it back until the writer decides whether to
+// compress the response
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.decided {
+		if w.gz != nil {
+			return w.gz.Write(p)
+		}
+		return w.ResponseWriter.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= w.minSize {
+		err := w.decide(true)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends the data written so far to the client. A response which is
+// flushed is streamed, so it is compressed whatever its size.
+func (w *gzipResponseWriter) Flush() {
+	if w.status == 0 {
+		return
+	}
+	if !w.decided && w.decide(true) != nil {
+		return
+	}
+	if w.gz != nil && w.gz.Flush() != nil {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// decide sends the header and the body held back so far, compressed if
+// 'compress' is true and the response is not already compressed
+func (w *gzipResponseWriter) decide(compress bool) error {
+	w.decided = true
+	h := w.Header()
+	if h.Get("Content-Encoding") != "" || w.status == http.StatusPartialContent {
+		// The ranges of a partial response are of the uncompressed body
+		compress = false
+	}
+	if compress {
+		ct := h.Get("Content-Type")
+		if ct == "" {
+			// The content type would otherwise be sniffed from the
+			// compressed body
+			ct = http.DetectContentType(w.buf)
+			h.Set("Content-Type", ct)
+		}
+		compress = !isCompressedContentType(ct)
+	}
+	if compress {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	if compress || (w.status == http.StatusNotModified && w.gzipETag) {
+		if etag := h.Get("ETag"); strings.HasSuffix(etag, `"`) {
+			h.Set("ETag", strings.TrimSuffix(etag, `"`)+gzipETagSuffix+`"`)
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	if err != nil {
+		log.Debugf("Failed to write response: %s", err)
+	}
+	return err
+}
+
+// finish sends what the writer holds back, uncompressed since the response
+// is smaller than the minimum size, or completes the compressed body
+func (w *gzipResponseWriter) finish() {
+	if !w.decided {
+		if w.status == 0 {
+			// Nothing was written, so the server sends an empty response
+			return
+		}
+		w.decide(false)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
@@ -0,0 +1,259 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/lib/metrics"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// gzipBytes returns 'data' compressed with gzip
+func gzipBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(data)
+	util.FatalError(t, err, "Failed to compress")
+	util.FatalError(t, zw.Close(), "Failed to compress")
+	return buf.Bytes()
+}
+
+// gunzipBytes returns 'data' decompressed with gzip
+func gunzipBytes(t *testing.T, data []byte) []byte {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	util.FatalError(t, err, "Failed to decompress")
+	plain, err := ioutil.ReadAll(zr)
+	util.FatalError(t, err, "Failed to decompress")
+	return plain
+}
+
+func TestGzipResponses(t *testing.T) {
+	s := &Server{}
+	large := []byte(strings.Repeat(`{"name":"user"},`, 200))
+	body := large
+	contentType := ""
+	flush := false
+	h := s.handleGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		// The body is written in pieces, the first of which is smaller
+		// than the minimum size
+		half := len(body) / 2
+		w.Write(body[:half])
+		if flush {
+			w.(http.Flusher).Flush()
+		}
+		w.Write(body[half:])
+	}))
+	request := func(method, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/v1/identities", nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request("GET", "deflate, gzip")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"), "The content type should be sniffed from the uncompressed body")
+	assert.Contains(t, w.Header()["Vary"], "Accept-Encoding")
+	assert.Equal(t, "gzip", w.Header().Get("Accept-Encoding"), "The server should advertise that it accepts gzip bodies")
+	assert.True(t, w.Body.Len() < len(large))
+	assert.Equal(t, large, gunzipBytes(t, w.Body.Bytes()))
+
+	// Without gzip, for a HEAD request, for a tiny response or for a
+	// response which is already compressed, the response is not compressed
+	for _, acceptEncoding := range []string{"", "deflate", "gzip;q=0"} {
+		w = request("GET", acceptEncoding)
+		assert.Empty(t, w.Header().Get("Content-Encoding"), "Accept-Encoding: %s", acceptEncoding)
+		assert.Equal(t, large, w.Body.Bytes())
+	}
+	w = request("HEAD", "gzip")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	body = []byte(`{"success":true}`)
+	w = request("GET", "gzip")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, body, w.Body.Bytes())
+	body, contentType = gzipBytes(t, large), "application/gzip"
+	w = request("GET", "gzip")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, body, w.Body.Bytes())
+
+	// A response which is flushed is streamed, so it is compressed whatever
+	// its size
+	body, contentType, flush = []byte(`{"success":true}`), "application/json", true
+	w = request("GET", "gzip")
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, body, gunzipBytes(t, w.Body.Bytes()))
+
+	// When compression is disabled, nothing is compressed or advertised
+	s.Config = &ServerConfig{HTTP: HTTPConfig{DisableCompression: true}}
+	body, flush = large, false
+	w = request("GET", "gzip")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Empty(t, w.Header().Get("Accept-Encoding"))
+	assert.Equal(t, large, w.Body.Bytes())
+}
+
+func TestGzipRequests(t *testing.T) {
+	s := &Server{metrics: metrics.NewRegistry(), Config: &ServerConfig{HTTP: HTTPConfig{MaxDecompressedBodySize: 1000}}}
+	newRequestMetrics(s.metrics)
+	var received []byte
+	h := s.wrapEndpoint("register", &serverEndpoint{
+		Methods: []string{"POST"},
+		Handler: func(ctx *serverRequestContextImpl) (interface{}, error) {
+			body, err := ctx.ReadBodyBytes()
+			if err != nil {
+				return nil, err
+			}
+			received = body
+			return "ok", nil
+		},
+	})
+	post := func(body []byte, contentEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/v1/register", bytes.NewReader(body))
+		r.Header.Set("Content-Encoding", contentEncoding)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	plain := []byte(strings.Repeat("a", 1000))
+	w := post(gzipBytes(t, plain), "gzip")
+	assert.Equal(t, http.StatusOK, w.Code, "Failed to post gzip body: %s", w.Body)
+	assert.Equal(t, plain, received, "The endpoint should receive the decompressed body")
+
+	// A small body which decompresses to more than the limit is rejected
+	bomb := gzipBytes(t, []byte(strings.Repeat("a", 1001)))
+	assert.True(t, len(bomb) < 100)
+	w = post(bomb, "gzip")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	var envelope caerrors.ErrorResponse
+	err := json.Unmarshal(w.Body.Bytes(), &envelope)
+	util.FatalError(t, err, "Failed to parse error envelope")
+	assert.Equal(t, caerrors.ErrReqBodyTooLarge, envelope.Details.ErrorCode)
+
+	w = post(plain, "gzip")
+	assert.Equal(t, http.StatusBadRequest, w.Code, "A body which is not gzip should be rejected")
+	w = post(plain, "br")
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code, "An unsupported content encoding should be rejected")
+	assert.Equal(t, "gzip", w.Header().Get("Accept-Encoding"))
+}
+
+func TestGzipTokenOverPlaintext(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	client := TestGetRootClient()
+	eresp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin'")
+	admin := eresp.Identity
+
+	// registerBody returns the body of a registration request which is
+	// large enough to be compressed
+	registerBody := func(name string) []byte {
+		req := &api.RegistrationRequest{Name: name, Type: "client", Affiliation: "org1"}
+		for i := 0; i < 20; i++ {
+			req.Attributes = append(req.Attributes, api.Attribute{Name: fmt.Sprintf("attr%d", i), Value: strings.Repeat("v", 60)})
+		}
+		body, err := json.Marshal(req)
+		util.FatalError(t, err, "Failed to marshal registration request")
+		assert.True(t, len(body) > minRequestCompressionSize)
+		return body
+	}
+	// register sends 'body' compressed, with the token over 'signed'
+	register := func(body, signed []byte) (int, []byte) {
+		u := fmt.Sprintf("http://localhost:%d/api/v1/register", rootPort)
+		req, err := http.NewRequest("POST", u, bytes.NewReader(gzipBytes(t, body)))
+		util.FatalError(t, err, "Failed to create request")
+		req.Header.Set("Content-Encoding", "gzip")
+		err = admin.addTokenAuthHdr(req, signed)
+		util.FatalError(t, err, "Failed to add token")
+		resp, err := http.DefaultClient.Do(req)
+		util.FatalError(t, err, "Failed to send request")
+		defer resp.Body.Close()
+		respBody, err := ioutil.ReadAll(resp.Body)
+		util.FatalError(t, err, "Failed to read response")
+		return resp.StatusCode, respBody
+	}
+
+	// The token over the uncompressed body is verified over the body which
+	// the server decompresses
+	body := registerBody("gzipuser1")
+	status, respBody := register(body, body)
+	assert.Equal(t, http.StatusCreated, status, "Failed to register with a gzip body: %s", respBody)
+
+	// A token over the compressed body is not
+	body = registerBody("gzipuser2")
+	status, _ = register(body, gzipBytes(t, body))
+	assert.Equal(t, http.StatusUnauthorized, status, "A token over the compressed body should be rejected")
+
+	// The client compresses its request bodies once the server has
+	// advertised that it accepts them, after computing their token
+	transport := client.httpClient.Transport
+	if tt, ok := transport.(*traceTransport); ok {
+		transport = tt.base
+	}
+	gt, ok := transport.(*gzipTransport)
+	if !ok {
+		t.Fatalf("The transport of the client should compress requests, not %T", transport)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&gt.serverAccepts), "The server should have advertised that it accepts gzip bodies")
+	req := &api.RegistrationRequest{}
+	err = json.Unmarshal(registerBody("gzipuser3"), req)
+	util.FatalError(t, err, "Failed to unmarshal registration request")
+	_, err = admin.Register(req)
+	assert.NoError(t, err, "Failed to register with a compressed request")
+
+	// Unless compression is disabled
+	client2 := &Client{HomeDir: rootClientDir, Config: &ClientConfig{URL: client.Config.URL, DisableCompression: true}}
+	err = client2.Init()
+	util.FatalError(t, err, "Failed to initialize client")
+	_, ok = client2.httpClient.Transport.(*gzipTransport)
+	assert.False(t, ok, "A client with compression disabled should not compress requests")
+}
+
+func TestCompressRequest(t *testing.T) {
+	body := []byte(strings.Repeat("body", 500))
+	req := httptest.NewRequest("POST", "/api/v1/register", bytes.NewReader(body))
+	out, err := compressRequest(req)
+	util.FatalError(t, err, "Failed to compress request")
+	assert.Empty(t, req.Header.Get("Content-Encoding"), "The original request should not be modified")
+	assert.Equal(t, "gzip", out.Header.Get("Content-Encoding"))
+	compressed, err := ioutil.ReadAll(out.Body)
+	util.FatalError(t, err, "Failed to read body")
+	assert.Equal(t, int64(len(compressed)), out.ContentLength)
+	assert.Equal(t, body, gunzipBytes(t, compressed))
+	again, err := out.GetBody()
+	util.FatalError(t, err, "Failed to get body")
+	retried, err := ioutil.ReadAll(again)
+	util.FatalError(t, err, "Failed to read body")
+	assert.Equal(t, compressed, retried, "A retry should send the same compressed body")
+}
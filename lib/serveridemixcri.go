@@ -8,6 +8,7 @@ package lib
 
 import (
 	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/api"
 )
 
 func newIdemixCRIEndpoint(s *Server) *serverEndpoint {
@@ -16,6 +17,10 @@ func newIdemixCRIEndpoint(s *Server) *serverEndpoint {
 		Handler:   handleIdemixCRIReq,
 		Server:    s,
 		successRC: 201,
+		auth:      authToken,
+		docs: map[string]operationDoc{
+			"POST": {summary: "Get the Idemix credential revocation information", request: &api.GetCRIRequest{}, response: &api.GetCRIResponse{}},
+		},
 	}
 }
 
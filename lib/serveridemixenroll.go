@@ -8,6 +8,7 @@ package lib
 
 import (
 	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/api"
 	"github.com/hyperledger/fabric-ca/lib/common"
 	"github.com/hyperledger/fabric-ca/lib/server/idemix"
 	"github.com/hyperledger/fabric-ca/lib/spi"
@@ -19,6 +20,11 @@ func newIdemixEnrollEndpoint(s *Server) *serverEndpoint {
 		Handler:   handleIdemixEnrollReq,
 		Server:    s,
 		successRC: 201,
+		auth:      authBasicOrToken,
+		docs: map[string]operationDoc{
+			"POST": {summary: "Get the nonce of an Idemix credential request or, given the request, an Idemix credential",
+				request: &api.IdemixEnrollmentRequestNet{}, response: &common.IdemixEnrollmentResponseNet{}},
+		},
 	}
 }
 
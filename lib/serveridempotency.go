@@ -0,0 +1,272 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/pkg/errors"
+)
+
+const (
+	// IdempotentReplayHeader is set to "true" in the response to a request
+	// which is the stored response to an earlier request with the same key
+	IdempotentReplayHeader = "Idempotent-Replayed"
+
+	insertIdempotencyKey      = "INSERT INTO idempotency_keys (idem_key, request_hash, status, response, expiry) VALUES (:idem_key, :request_hash, :status, :response, :expiry)"
+	selectIdempotencyKey      = "SELECT * FROM idempotency_keys WHERE (idem_key = ?)"
+	updateIdempotencyKey      = "UPDATE idempotency_keys SET status = ?, response = ? WHERE (idem_key = ?)"
+	deleteIdempotencyKey      = "DELETE FROM idempotency_keys WHERE (idem_key = ?)"
+	deleteExpiredIdempotency  = "DELETE FROM idempotency_keys WHERE (expiry < ?)"
+	maxIdempotencyKeyLength   = 255
+	idempotencySweepInterval  = 15 * time.Minute
+	idempotencyStatusUnstored = 0
+)
+
+// idempotencyRecord is the record of a request with an idempotency key
+type idempotencyRecord struct {
+	Key         string `db:"idem_key"`
+	RequestHash string `db:"request_hash"`
+	// The HTTP status code of the response, or 0 while the request is
+	// being processed
+	Status   int       `db:"status"`
+	Response string    `db:"response"`
+	Expiry   time.Time `db:"expiry"`
+}
+
+// storedResponse is the response to a request with an idempotency key as it
+// is stored, which is either the result or the error of the request
+type storedResponse struct {
+	Result   json.RawMessage `json:"result,omitempty"`
+	Location string          `json:"location,omitempty"`
+	Code     int             `json:"code,omitempty"`
+	Message  string          `json:"message,omitempty"`
+}
+
+// handleIdempotent handles a request with the idempotency key 'key'. The first
+// request with the key is processed and its response stored; a request with
+// the same key and body, from the same caller, gets the stored response
+// instead, and one with a different body is rejected.
+func (se *serverEndpoint) handleIdempotent(ctx *serverRequestContextImpl, key string) (interface{}, error) {
+	ca, err := ctx.GetCA()
+	if err != nil {
+		return nil, err
+	}
+	retention := ctx.caConfig(ca).idempotency.Retention
+	if retention <= 0 {
+		return se.Handler(ctx)
+	}
+	if !validIdempotencyKey(key) {
+		return nil, caerrors.NewHTTPErr(400, caerrors.ErrInvalidIdempotencyKey,
+			"The idempotency key must be from 1 to %d printable ASCII characters", maxIdempotencyKeyLength)
+	}
+	// The stored response is only returned to the caller of the request
+	caller, err := ctx.TokenAuthentication()
+	if err != nil {
+		return nil, err
+	}
+	body, err := ctx.ReadBodyBytes()
+	if err != nil {
+		return nil, err
+	}
+	hash := idempotencyRequestHash(ctx.req, caller, body)
+	rec, err := ca.beginIdempotentRequest(key, hash, retention)
+	if err != nil {
+		return nil, err
+	}
+	if rec != nil {
+		log.Infof("Returning the stored response to the request of '%s' with idempotency key '%s'", caller, key)
+		return rec.replay(ctx.resp)
+	}
+	resp, err := se.Handler(ctx)
+	ca.completeIdempotentRequest(key, se.getSuccessRC(), ctx.resp.Header().Get("Location"), resp, err)
+	return resp, err
+}
+
+// validIdempotencyKey returns true if 'key' may be stored as an idempotency key
+func validIdempotencyKey(key string) bool {
+	if key == "" || len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// idempotencyRequestHash returns the hash which identifies a request of
+// 'caller' with the body 'body'
+func idempotencyRequestHash(r *http.Request, caller string, body []byte) string {
+	h := sha256.New()
+	for _, s := range []string{r.Method, r.URL.Path, caller} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// beginIdempotentRequest reserves the idempotency key 'key' for a request with
+// the hash 'hash'. It returns nil if the request is to be processed, or the
+// record of the earlier request with the key whose response is to be returned.
+func (ca *CA) beginIdempotentRequest(key, hash string, retention time.Duration) (*idempotencyRecord, error) {
+	now := time.Now().UTC()
+	ca.sweepIdempotencyKeysPeriodically(now)
+	rec, err := ca.getIdempotencyRecord(key)
+	if err != nil {
+		return nil, err
+	}
+	if rec != nil && rec.Expiry.Before(now) {
+		ca.deleteIdempotencyRecord(key)
+		rec = nil
+	}
+	if rec == nil {
+		_, err = ca.db.NamedExec(insertIdempotencyKey, &idempotencyRecord{
+			Key:         key,
+			RequestHash: hash,
+			Status:      idempotencyStatusUnstored,
+			Expiry:      now.Add(retention),
+		})
+		if err == nil {
+			return nil, nil
+		}
+		// Another request with the key may have reserved it first
+		rec, err = ca.getIdempotencyRecord(key)
+		if err != nil {
+			return nil, err
+		}
+		if rec == nil {
+			return nil, errors.New("Failed to store the idempotency key of the request")
+		}
+	}
+	if rec.RequestHash != hash {
+		return nil, caerrors.NewHTTPErr(409, caerrors.ErrIdempotencyKeyReused,
+			"The idempotency key '%s' was used by a different request", key)
+	}
+	if rec.Status == idempotencyStatusUnstored {
+		return nil, caerrors.NewHTTPErr(409, caerrors.ErrIdempotencyKeyInProgress,
+			"A request with the idempotency key '%s' is being processed", key)
+	}
+	return rec, nil
+}
+
+// completeIdempotentRequest stores the response to the request with the
+// idempotency key 'key', without the secrets in it (see storableResult). The
+// key of a request which failed with a server error is released instead, so
+// that a retry of the request is processed.
+func (ca *CA) completeIdempotentRequest(key string, successRC int, location string, resp interface{}, err error) {
+	var status int
+	var stored storedResponse
+	if he := getHTTPErr(err); he != nil {
+		if he.GetStatusCode() >= 500 {
+			ca.deleteIdempotencyRecord(key)
+			return
+		}
+		status = he.GetStatusCode()
+		stored.Code = he.GetRemoteCode()
+		stored.Message = he.GetRemoteMsg()
+	} else {
+		result, err := json.Marshal(storableResult(resp))
+		if err != nil {
+			ca.deleteIdempotencyRecord(key)
+			return
+		}
+		status = successRC
+		stored.Result = result
+		stored.Location = location
+	}
+	response, _ := json.Marshal(&stored)
+	_, err = ca.db.Exec(ca.db.Rebind(updateIdempotencyKey), status, string(response), key)
+	if err != nil {
+		log.Errorf("Failed to store the response to the request with idempotency key '%s': %s", key, err)
+		ca.deleteIdempotencyRecord(key)
+	}
+}
+
+// storableResult returns the result 'resp' of a request as it is stored with
+// its idempotency key. The enrollment secret of a registration is removed, as
+// the database only holds a hash of the secret, so a retry of a registration
+// gets the response without the secret.
+func storableResult(resp interface{}) interface{} {
+	if reg, ok := resp.(*api.RegistrationResponseNet); ok {
+		redacted := *reg
+		redacted.Secret = ""
+		return &redacted
+	}
+	return resp
+}
+
+// replay returns the stored response of the request
+func (rec *idempotencyRecord) replay(w http.ResponseWriter) (interface{}, error) {
+	var stored storedResponse
+	err := json.Unmarshal([]byte(rec.Response), &stored)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the stored response of the request")
+	}
+	w.Header().Set(IdempotentReplayHeader, "true")
+	if stored.Location != "" {
+		w.Header().Set("Location", stored.Location)
+	}
+	if rec.Status >= 400 {
+		return nil, caerrors.NewHTTPErr(rec.Status, stored.Code, "%s", stored.Message)
+	}
+	return stored.Result, nil
+}
+
+func (ca *CA) getIdempotencyRecord(key string) (*idempotencyRecord, error) {
+	var rec idempotencyRecord
+	err := ca.db.Get(&rec, ca.db.Rebind(selectIdempotencyKey), key)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get the idempotency key of the request")
+	}
+	return &rec, nil
+}
+
+func (ca *CA) deleteIdempotencyRecord(key string) {
+	_, err := ca.db.Exec(ca.db.Rebind(deleteIdempotencyKey), key)
+	if err != nil {
+		log.Errorf("Failed to delete the idempotency key '%s': %s", key, err)
+	}
+}
+
+// sweepIdempotencyKeysPeriodically removes the expired idempotency keys of
+// the CA if they have not been removed in the last sweep interval
+func (ca *CA) sweepIdempotencyKeysPeriodically(now time.Time) {
+	ca.mutex.Lock()
+	due := now.Sub(ca.idempotencySweep) >= idempotencySweepInterval
+	if due {
+		ca.idempotencySweep = now
+	}
+	ca.mutex.Unlock()
+	if due {
+		err := ca.sweepIdempotencyKeys(now)
+		if err != nil {
+			log.Errorf("Failed to remove the expired idempotency keys of CA '%s': %s", ca.Config.CA.Name, err)
+		}
+	}
+}
+
+// sweepIdempotencyKeys removes the idempotency keys of the CA which expired
+// before 'now'
+func (ca *CA) sweepIdempotencyKeys(now time.Time) error {
+	log.Debugf("Cleaning up expired idempotency keys for CA '%s'", ca.Config.CA.Name)
+	_, err := ca.db.Exec(ca.db.Rebind(deleteExpiredIdempotency), now)
+	return err
+}
@@ -0,0 +1,172 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	srv := TestGetRootServer(t)
+	srv.CA.Config.Idempotency.Retention = time.Hour
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	client := TestGetRootClient()
+	eresp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin'")
+	admin := eresp.Identity
+
+	// post sends 'req' to 'endpoint' with the idempotency key 'key'
+	post := func(endpoint, key string, req interface{}) (*http.Response, []byte) {
+		body, err := json.Marshal(req)
+		util.FatalError(t, err, "Failed to marshal request")
+		u := fmt.Sprintf("http://localhost:%d/api/v1/%s", rootPort, endpoint)
+		hreq, err := http.NewRequest("POST", u, bytes.NewReader(body))
+		util.FatalError(t, err, "Failed to create request")
+		if key != "" {
+			hreq.Header.Set(IdempotencyKeyHeader, key)
+		}
+		err = admin.addTokenAuthHdr(hreq, body)
+		util.FatalError(t, err, "Failed to add token")
+		resp, err := http.DefaultClient.Do(hreq)
+		util.FatalError(t, err, "Failed to send request")
+		defer resp.Body.Close()
+		respBody, err := ioutil.ReadAll(resp.Body)
+		util.FatalError(t, err, "Failed to read response")
+		return resp, respBody
+	}
+	errorCode := func(body []byte) int {
+		var envelope caerrors.ErrorResponse
+		err := json.Unmarshal(body, &envelope)
+		util.FatalError(t, err, "Failed to parse error envelope")
+		return envelope.Details.ErrorCode
+	}
+
+	// A retry of a registration gets the response of the first request
+	// rather than an error that the identity is already registered
+	register := &api.RegistrationRequest{Name: "idemuser", Affiliation: "org1"}
+	resp, first := post("register", "key1", register)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode, "Failed to register: %s", first)
+	assert.Empty(t, resp.Header.Get(IdempotentReplayHeader))
+	location := resp.Header.Get("Location")
+	assert.NotEmpty(t, location)
+	resp, again := post("register", "key1", register)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode, "The retry should succeed: %s", again)
+	assert.Equal(t, "true", resp.Header.Get(IdempotentReplayHeader))
+	assert.Equal(t, location, resp.Header.Get("Location"))
+	var registered, replayed struct {
+		Result api.RegistrationResponseNet
+	}
+	err = json.Unmarshal(first, &registered)
+	util.FatalError(t, err, "Failed to parse registration response")
+	err = json.Unmarshal(again, &replayed)
+	util.FatalError(t, err, "Failed to parse replayed registration response")
+	assert.NotEmpty(t, registered.Result.Secret)
+	assert.Empty(t, replayed.Result.Secret, "The retry should get the response of the first request without the secret")
+
+	// The secret is not stored with the key
+	var stored string
+	err = srv.CA.db.Get(&stored, srv.CA.db.Rebind("SELECT response FROM idempotency_keys WHERE (idem_key = ?)"), "key1")
+	util.FatalError(t, err, "Failed to get the stored response")
+	assert.NotContains(t, stored, registered.Result.Secret, "The stored response should not contain the secret")
+
+	// A key cannot be reused for another request
+	resp, body := post("register", "key1", &api.RegistrationRequest{Name: "idemuser2", Affiliation: "org1"})
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Equal(t, caerrors.ErrIdempotencyKeyReused, errorCode(body))
+	_, err = admin.GetIdentity("idemuser2", "")
+	assert.Error(t, err, "A request reusing a key should not be processed")
+
+	// A request which fails with a client error gets the same error again
+	existing := &api.RegistrationRequest{Name: "admin", Affiliation: "org1"}
+	resp, first = post("register", "key2", existing)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode, "Registering 'admin' again should fail: %s", first)
+	resp, again = post("register", "key2", existing)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Equal(t, "true", resp.Header.Get(IdempotentReplayHeader))
+	assert.Equal(t, errorCode(first), errorCode(again))
+
+	// but one which fails with a server error is processed again
+	registry := srv.CA.registry
+	srv.CA.registry = &failingRegistry{UserRegistry: registry}
+	failing := &api.RegistrationRequest{Name: "idemuser3", Affiliation: "org1"}
+	resp, _ = post("register", "key3", failing)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	resp, _ = post("register", "key3", failing)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get(IdempotentReplayHeader))
+	srv.CA.registry = registry
+
+	// A revocation is not repeated either
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "idemuser", Secret: registered.Result.Secret})
+	util.FatalError(t, err, "Failed to enroll 'idemuser'")
+	revoke := &api.RevocationRequest{Name: "idemuser"}
+	resp, first = post("revoke", "key4", revoke)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Failed to revoke: %s", first)
+	resp, again = post("revoke", "key4", revoke)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "The retry should succeed rather than fail as already revoked: %s", again)
+	assert.Equal(t, first, again)
+
+	// Once the key has expired, the request is processed again
+	_, err = srv.CA.db.Exec(srv.CA.db.Rebind("UPDATE idempotency_keys SET expiry = ? WHERE (idem_key = ?)"), time.Now().Add(-time.Minute).UTC(), "key1")
+	util.FatalError(t, err, "Failed to expire idempotency key")
+	resp, body = post("register", "key1", register)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode, "The expired key should not return the stored response: %s", body)
+	assert.Equal(t, caerrors.ErrIdentityExists, errorCode(body))
+	assert.Empty(t, resp.Header.Get(IdempotentReplayHeader))
+
+	// The expired keys are purged
+	_, err = srv.CA.db.Exec(srv.CA.db.Rebind("UPDATE idempotency_keys SET expiry = ?"), time.Now().Add(-time.Minute).UTC())
+	util.FatalError(t, err, "Failed to expire idempotency keys")
+	resp, body = post("purge", "", struct{}{})
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Failed to purge: %s", body)
+	var count int
+	err = srv.CA.db.Get(&count, "SELECT COUNT(*) FROM idempotency_keys")
+	util.FatalError(t, err, "Failed to count idempotency keys")
+	assert.Equal(t, 0, count, "The expired idempotency keys should be removed")
+
+	// An invalid key is rejected
+	resp, body = post("register", strings.Repeat("k", 256), register)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, caerrors.ErrInvalidIdempotencyKey, errorCode(body))
+
+	// The client sends a key with its register requests when retries are
+	// enabled, which the server stores
+	admin.client.Config.Retry = RetryConfig{MaxAttempts: 3}
+	_, err = admin.Register(&api.RegistrationRequest{Name: "idemuser4", Affiliation: "org1"})
+	util.FatalError(t, err, "Failed to register 'idemuser4'")
+	err = srv.CA.db.Get(&count, "SELECT COUNT(*) FROM idempotency_keys")
+	util.FatalError(t, err, "Failed to count idempotency keys")
+	assert.Equal(t, 1, count, "The client should send an idempotency key")
+
+	// With a retention of 0, the keys are ignored
+	srv.CA.Config.Idempotency.Retention = 0
+	srv.ApplyConfig()
+	register = &api.RegistrationRequest{Name: "idemuser5", Affiliation: "org1"}
+	resp, body = post("register", "key5", register)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode, "Failed to register: %s", body)
+	resp, _ = post("register", "key5", register)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode, "The key should be ignored")
+}
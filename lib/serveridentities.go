@@ -17,6 +17,7 @@ import (
 	"github.com/hyperledger/fabric-ca/api"
 	"github.com/hyperledger/fabric-ca/lib/attr"
 	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/lib/server"
 	"github.com/hyperledger/fabric-ca/lib/spi"
 	"github.com/hyperledger/fabric-ca/util"
 	"github.com/pkg/errors"
@@ -28,6 +29,13 @@ func newIdentitiesEndpoint(s *Server) *serverEndpoint {
 		Handler:   identitiesHandler,
 		Server:    s,
 		successRC: 200,
+		auth:      authToken,
+		docs: map[string]operationDoc{
+			"GET": {summary: "Get an identity", response: &api.GetIDResponse{}},
+			"DELETE": {summary: "Remove an identity", response: &api.IdentityResponse{},
+				query: map[string]string{"force": "Remove the identity even if it is the invoker"}},
+			"PUT": {summary: "Modify an identity", request: &api.ModifyIdentityRequest{}, response: &api.IdentityResponse{}},
+		},
 	}
 }
 
@@ -37,6 +45,15 @@ func newIdentitiesStreamingEndpoint(s *Server) *serverEndpoint {
 		Handler:   identitiesStreamingHandler,
 		Server:    s,
 		successRC: 200,
+		auth:      authToken,
+		docs: map[string]operationDoc{
+			"GET": {summary: "Get the identities which the invoker may see", response: &api.GetAllIDsResponse{},
+				query: listQueryDocs(identityListSpec, map[string]string{
+					"type":        "Get only the identities of this type",
+					"affiliation": "Get only the identities in this affiliation or its sub-affiliations",
+				})},
+			"POST": {summary: "Add an identity", request: &api.AddIdentityRequest{}, response: &api.IdentityResponse{}},
+		},
 	}
 }
 
@@ -161,13 +178,63 @@ func getIDs(ctx *serverRequestContextImpl, caller spi.User, caname string) error
 		return caerrors.NewAuthorizationErr(caerrors.ErrGettingUser, "Caller is not a registrar")
 	}
 
-	// Getting all identities of appropriate affiliation and type
-	callerAff := GetUserAffiliation(caller)
+	params, err := parseListParams(ctx, identityListSpec)
+	if err != nil {
+		return err
+	}
+
+	// Getting all identities of appropriate affiliation and type, which the
+	// request may narrow down to one type and to a sub-affiliation
+	types := callerTypes
+	if reqType := params.Filter("type"); reqType != "" {
+		err = ctx.CanActOnType(reqType)
+		if err != nil {
+			return err
+		}
+		types = reqType
+	}
+	affiliation := GetUserAffiliation(caller)
+	if reqAff := params.Filter("affiliation"); reqAff != "" {
+		err = ctx.ContainsAffiliation(reqAff)
+		if err != nil {
+			return err
+		}
+		affiliation = reqAff
+	}
 	registry := ctx.ca.registry
-	rows, err := registry.GetFilteredUsers(callerAff, callerTypes)
+	rows, err := registry.GetFilteredUsers(affiliation, types)
 	if err != nil {
 		return caerrors.NewHTTPErr(500, caerrors.ErrGettingUser, "Failed to get users by affiliation and type: %s", err)
 	}
+	defer rows.Close()
+	caMaxEnrollments := ctx.caConfig(ctx.ca).maxEnrollments
+
+	// A request for a page of identities gets the page in a list envelope
+	if params.Paged {
+		pager := params.NewPager()
+		for rows.Next() {
+			var id UserRecord
+			err := rows.StructScan(&id)
+			if err != nil {
+				return caerrors.NewHTTPErr(500, caerrors.ErrGettingUser, "Failed to get read row: %s", err)
+			}
+			pager.Add(&server.ListItem{
+				Keys:  map[string]string{"id": id.Name, "type": id.Type, "affiliation": id.Affiliation},
+				ID:    id.Name,
+				Value: newIdentityInfo(&id, caMaxEnrollments),
+			})
+		}
+		page, err := pager.Page()
+		if err != nil {
+			return caerrors.NewHTTPErr(500, caerrors.ErrGettingUser, "Failed to get page of identities: %s", err)
+		}
+		resp, err := util.Marshal(page, "identities page")
+		if err != nil {
+			return caerrors.NewHTTPErr(500, caerrors.ErrGettingUser, "Failed to marshal identities page: %s", err)
+		}
+		w.Write(resp)
+		return nil
+	}
 
 	// Get the number of identities to return back to client in a chunk based on the environment variable
 	// If environment variable not set, default to 100 identities
@@ -199,18 +266,7 @@ func getIDs(ctx *serverRequestContextImpl, caller spi.User, caname string) error
 			w.Write([]byte(","))
 		}
 
-		var attrs []api.Attribute
-		json.Unmarshal([]byte(id.Attributes), &attrs)
-
-		idInfo := api.IdentityInfo{
-			ID:             id.Name,
-			Type:           id.Type,
-			Affiliation:    id.Affiliation,
-			MaxEnrollments: id.MaxEnrollments,
-			Attributes:     attrs,
-		}
-
-		resp, err := util.Marshal(idInfo, "identities info")
+		resp, err := util.Marshal(newIdentityInfo(&id, caMaxEnrollments), "identities info")
 		if err != nil {
 			return caerrors.NewHTTPErr(500, caerrors.ErrGettingUser, "Failed to marshal identity info: %s", err)
 		}
@@ -229,6 +285,21 @@ func getIDs(ctx *serverRequestContextImpl, caller spi.User, caname string) error
 	return nil
 }
 
+// newIdentityInfo returns the information which the identities endpoints
+// return about the identity 'id'
+func newIdentityInfo(id *UserRecord, caMaxEnrollments int) api.IdentityInfo {
+	var attrs []api.Attribute
+	json.Unmarshal([]byte(id.Attributes), &attrs)
+	return api.IdentityInfo{
+		ID:                   id.Name,
+		Type:                 id.Type,
+		Affiliation:          id.Affiliation,
+		MaxEnrollments:       id.MaxEnrollments,
+		RemainingEnrollments: remainingEnrollments(id.MaxEnrollments, id.State, caMaxEnrollments),
+		Attributes:           attrs,
+	}
+}
+
 func getID(ctx *serverRequestContextImpl, caller spi.User, id, caname string) (*api.GetIDResponse, error) {
 	log.Debugf("Requesting identity '%s'", id)
 
@@ -248,22 +319,51 @@ func getID(ctx *serverRequestContextImpl, caller spi.User, id, caname string) (*
 		return nil, err
 	}
 
+	// The registry only limits the enrollments of the identities in the
+	// database
+	remaining := -1
+	if dbUser, ok := user.(*DBUser); ok {
+		remaining = remainingEnrollments(dbUser.MaxEnrollments, dbUser.State, ctx.caConfig(ctx.ca).maxEnrollments)
+	}
+
 	resp := &api.GetIDResponse{
-		ID:             user.GetName(),
-		Type:           user.GetType(),
-		Affiliation:    GetUserAffiliation(user),
-		Attributes:     allAttributes,
-		MaxEnrollments: user.GetMaxEnrollments(),
-		CAName:         caname,
+		ID:                   user.GetName(),
+		Type:                 user.GetType(),
+		Affiliation:          GetUserAffiliation(user),
+		Attributes:           allAttributes,
+		MaxEnrollments:       user.GetMaxEnrollments(),
+		RemainingEnrollments: remaining,
+		CAName:               caname,
 	}
 
 	return resp, nil
 }
 
+// remainingEnrollments returns the number of times that an identity with
+// 'maxEnrollments' which has enrolled 'state' times may still enroll with a
+// CA allowing 'caMaxEnrollments', or -1 if unlimited. This mirrors the check
+// of DBUser.Login.
+func remainingEnrollments(maxEnrollments, state, caMaxEnrollments int) int {
+	// A revoked identity can't enroll
+	if state < 0 {
+		return 0
+	}
+	if caMaxEnrollments != -1 && (maxEnrollments > caMaxEnrollments || maxEnrollments == -1) {
+		maxEnrollments = caMaxEnrollments
+	}
+	if maxEnrollments == -1 {
+		return -1
+	}
+	if state >= maxEnrollments {
+		return 0
+	}
+	return maxEnrollments - state
+}
+
 func processDeleteRequest(ctx *serverRequestContextImpl, caname string) (*api.IdentityResponse, error) {
 	log.Debug("Processing DELETE request")
 
-	if !ctx.ca.Config.Cfg.Identities.AllowRemove {
+	if !ctx.caConfig(ctx.ca).cfg.Identities.AllowRemove {
 		return nil, caerrors.NewHTTPErr(403, caerrors.ErrRemoveIdentity, "Identity removal is disabled")
 	}
 
@@ -307,6 +407,7 @@ func processDeleteRequest(ctx *serverRequestContextImpl, caname string) (*api.Id
 	if err != nil {
 		return nil, err
 	}
+	ctx.ca.server.publishEvent(EventIdentityRemoved, ctx.ca.Config.CA.Name, identityEventData(userToRemove, ctx.caller))
 
 	log.Debugf("Identity '%s' successfully removed", removeID)
 	return resp, nil
@@ -343,7 +444,13 @@ func processPostRequest(ctx *serverRequestContextImpl, caname string) (*api.Iden
 
 	pass, err := registerUser(addReq, callerID, ctx.ca, ctx)
 	if err != nil {
-		return nil, caerrors.NewHTTPErr(400, caerrors.ErrAddIdentity, "Failed to add identity: %s", err)
+		// A failure of the server is returned as is, so that its cause is
+		// only logged
+		he := getHTTPErr(err)
+		if he.GetLocalCode() == caerrors.ErrIdentityExists || he.GetStatusCode() >= 500 {
+			return nil, err
+		}
+		return nil, caerrors.NewValidationErr(caerrors.ErrAddIdentity, "Failed to add identity: %s", he.GetRemoteMsg())
 
 	}
 
@@ -429,11 +536,23 @@ func processPutRequest(ctx *serverRequestContextImpl, caname string) (*api.Ident
 	if err != nil {
 		return nil, err
 	}
+	ctx.ca.server.publishEvent(EventIdentityModified, ctx.ca.Config.CA.Name, identityEventData(userToModify, ctx.caller))
 
 	log.Debugf("Identity successfully modified")
 	return resp, nil
 }
 
+// identityEventData returns the data of an event of a change to 'user' made
+// by 'caller'
+func identityEventData(user, caller spi.User) *IdentityEventData {
+	return &IdentityEventData{
+		ID:          user.GetName(),
+		Type:        user.GetType(),
+		Affiliation: GetUserAffiliation(user),
+		Invoker:     caller.GetName(),
+	}
+}
+
 // Function takes the modification request and fills in missing information with the current user information
 // and parses the modification request to generate the correct input to be stored in the database
 func getModifyReq(user spi.User, req *api.ModifyIdentityRequest) (*spi.UserInfo, bool) {
@@ -31,6 +31,7 @@ import (
 
 	"github.com/hyperledger/fabric-ca/api"
 	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -141,6 +142,55 @@ func TestGetAllIDs(t *testing.T) {
 	if assert.Error(t, err, "Should have failed, caller is not a registrar") {
 		assert.Contains(t, err.Error(), "Authorization failure")
 	}
+
+	// The identities may be filtered by type and affiliation
+	getFilteredIDs := func(id *Identity, req *api.GetAllIDsRequest) ([]string, error) {
+		var ids []string
+		err := id.GetFilteredIdentities(req, func(decoder *json.Decoder) error {
+			var info api.IdentityInfo
+			err := decoder.Decode(&info)
+			ids = append(ids, info.ID)
+			return err
+		})
+		return ids, err
+	}
+	ids, err := getFilteredIDs(admin, &api.GetAllIDsRequest{Type: "peer", Affiliation: "org2"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"admin2", "testuser2", "testuser3"}, ids)
+	ids, err = getFilteredIDs(admin, &api.GetAllIDsRequest{Affiliation: "org2.dept1"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"testuser3"}, ids)
+	ids, err = getFilteredIDs(admin2, &api.GetAllIDsRequest{Affiliation: "org2.dept1"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"testuser3"}, ids)
+	ids, err = getFilteredIDs(admin, &api.GetAllIDsRequest{Affiliation: "org1"})
+	assert.NoError(t, err)
+	assert.Empty(t, ids, "No identities are in org1")
+	_, err = getFilteredIDs(admin2, &api.GetAllIDsRequest{Type: "client"})
+	if assert.Error(t, err, "admin2 can't act on clients") {
+		re, ok := errors.Cause(err).(*ResponseError)
+		assert.True(t, ok && re.IsAuthorizationFailure(), "The request should not be authorized: %s", err)
+	}
+	_, err = getFilteredIDs(admin2, &api.GetAllIDsRequest{Affiliation: "hyperledger"})
+	assert.Error(t, err, "admin2 is not in the hyperledger affiliation")
+}
+
+func TestRemainingEnrollments(t *testing.T) {
+	testCases := []struct {
+		max, state, caMax, remaining int
+	}{
+		{-1, 5, -1, -1},
+		{3, 1, -1, 2},
+		{3, 3, -1, 0},
+		{3, 1, 2, 1},
+		{-1, 1, 4, 3},
+		{2, 0, 0, 0},
+		{3, -1, -1, 0},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.remaining, remainingEnrollments(tc.max, tc.state, tc.caMax),
+			"Remaining enrollments of an identity with max %d and state %d of a CA with max %d", tc.max, tc.state, tc.caMax)
+	}
 }
 
 func TestGetID(t *testing.T) {
@@ -379,6 +429,7 @@ func TestDynamicRemoveIdentity(t *testing.T) {
 	assert.Error(t, err, "Should have failed to remove identities; identity removal is not enabled on server")
 
 	srv.CA.Config.Cfg.Identities.AllowRemove = true
+	srv.ApplyConfig()
 
 	remReq.ID = ""
 	_, err = admin.RemoveIdentity(remReq)
@@ -826,6 +877,7 @@ func TestDynamicWithMultCA(t *testing.T) {
 	}
 
 	srv.caMap["rootca2"].Config.Cfg.Identities.AllowRemove = true
+	srv.ApplyConfig()
 
 	remReq := &api.RemoveIdentityRequest{}
 	remReq.ID = "testuser"
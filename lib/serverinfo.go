@@ -7,8 +7,12 @@ SPDX-License-Identifier: Apache-2.0
 package lib
 
 import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric-ca/api"
 	"github.com/hyperledger/fabric-ca/lib/common"
 	"github.com/hyperledger/fabric-ca/lib/metadata"
+	"github.com/pkg/errors"
 )
 
 // ServerInfoResponseNet is the response to the GET /cainfo request
@@ -28,6 +32,12 @@ func newCAInfoEndpoint(s *Server) *serverEndpoint {
 		Methods: []string{"GET", "POST", "HEAD"},
 		Handler: cainfoHandler,
 		Server:  s,
+		docs: map[string]operationDoc{
+			"GET":  {summary: "Get the information of a CA", response: &common.CAInfoResponseNet{}},
+			"POST": {summary: "Get the information of a CA", request: &api.GetCAInfoRequest{}, response: &common.CAInfoResponseNet{}},
+			"HEAD": {summary: "Check that a CA is served"},
+		},
+		encodings: certEncodings("ca-chain"),
 	}
 }
 
@@ -37,11 +47,29 @@ func cainfoHandler(ctx *serverRequestContextImpl) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+	chain, err := ca.servedCAChain()
+	if err != nil {
+		return nil, err
+	}
 	resp := &common.CAInfoResponseNet{}
-	err = ca.fillCAInfo(resp)
+	err = ca.fillCAInfoFromChain(resp, chain)
 	if err != nil {
 		return nil, err
 	}
 	resp.Version = metadata.GetVersion()
+	resp.APIVersions = metadata.APIVersions
+	// Clients polling the CA chain revalidate their copy with its ETag, which
+	// combines the cached ETag of the chain with the rest of the response
+	ctx.setCacheControl()
+	rest := *resp
+	rest.CAChain = ""
+	body, err := json.Marshal(&rest)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to marshal result")
+	}
+	etag := strongETag([]byte(ctx.responseMediaType()), []byte(chain.etag), body)
+	if ctx.notModified(etag) {
+		return nil, nil
+	}
 	return resp, nil
 }
@@ -32,12 +32,16 @@ func TestGetServerVersion(t *testing.T) {
 	var err error
 
 	metadata.Version = "1.1.0"
-	srv := TestGetRootServer(t)
+	// Listen on a free port rather than a fixed one, which may be in use
+	srv := TestGetServer(0, rootDir, "", -1, t)
 	err = srv.Start()
 	util.FatalError(t, err, "Failed to start server")
 	defer srv.Stop()
 
-	client := getTestClient(7075)
+	client := &Client{
+		Config:  &ClientConfig{URL: srv.ListenAddresses().URL},
+		HomeDir: testdataDir,
+	}
 	resp, err := client.GetCAInfo(&api.GetCAInfoRequest{
 		CAName: "",
 	})
@@ -0,0 +1,124 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestServersIsolation runs two servers with different registries in one
+// process and sends them requests concurrently; neither server may see the
+// identities or accept the tokens of the other. Run it with -race to check
+// that the servers share no state.
+func TestServersIsolation(t *testing.T) {
+	servers := []struct {
+		url  string
+		home string
+		user string
+		srv  *Server
+	}{
+		{home: rootDir, user: "alice"},
+		{home: intermediateDir, user: "bob"},
+	}
+	// The servers listen on free ports, whose URLs are read back once they
+	// are started
+	for i := range servers {
+		s := &servers[i]
+		s.srv = TestGetServer(0, s.home, "", -1, t)
+		s.srv.CA.Config.Registry.Identities = append(s.srv.CA.Config.Registry.Identities,
+			CAConfigIdentity{Name: s.user, Pass: s.user + "pw", Type: "client", Affiliation: "org1"})
+		err := s.srv.Start()
+		util.FatalError(t, err, "Failed to start server")
+		s.url = s.srv.ListenAddresses().URL
+	}
+	defer func() {
+		for _, s := range servers {
+			s.srv.Stop()
+			os.RemoveAll(s.home)
+		}
+		os.RemoveAll(rootClientDir)
+	}()
+
+	// Each server is sent requests by several clients at once
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		other := servers[1-i]
+		for j := 0; j < 4; j++ {
+			client := &Client{
+				Config:  &ClientConfig{URL: s.url},
+				HomeDir: path.Join(rootClientDir, strconv.Itoa(i), strconv.Itoa(j)),
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for k := 0; k < 3; k++ {
+					resp, err := client.Enroll(&api.EnrollmentRequest{Name: s.user, Secret: s.user + "pw"})
+					if assert.NoError(t, err, "Failed to enroll '%s' with its server", s.user) {
+						assert.Equal(t, s.user, resp.Identity.GetName())
+					}
+					_, err = client.Enroll(&api.EnrollmentRequest{Name: other.user, Secret: other.user + "pw"})
+					assert.Error(t, err, "'%s' of another server should not be enrolled", other.user)
+					_, err = client.GetCAInfo(&api.GetCAInfoRequest{})
+					assert.NoError(t, err, "Failed to get the CA information")
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	// The identities of one server are not authenticated by the other, and a
+	// list token of one server is not accepted by the other
+	admins := make([]*Identity, len(servers))
+	for i, s := range servers {
+		client := &Client{
+			Config:  &ClientConfig{URL: s.url},
+			HomeDir: path.Join(rootClientDir, strconv.Itoa(i), "admin"),
+		}
+		resp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+		util.FatalError(t, err, "Failed to enroll 'admin'")
+		admins[i] = resp.Identity
+	}
+	// The connections are not kept alive for the tests which follow
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	httpClient := &http.Client{Transport: transport}
+	listURL := func(serverURL string, q url.Values) string {
+		return fmt.Sprintf("%s/api/v1/identities?%s", serverURL, q.Encode())
+	}
+	q := url.Values{"limit": {"1"}}
+	status, body := adminRequest(t, httpClient, "GET", listURL(servers[0].url, q), admins[0], "")
+	assert.Equal(t, http.StatusOK, status, "Failed to get page: %s", body)
+	var page struct {
+		Result struct {
+			NextToken string `json:"next_token"`
+		} `json:"result"`
+	}
+	err := json.Unmarshal(body, &page)
+	util.FatalError(t, err, "Failed to parse page")
+	if assert.NotEmpty(t, page.Result.NextToken) {
+		q.Set("next_token", page.Result.NextToken)
+		status, _ = adminRequest(t, httpClient, "GET", listURL(servers[0].url, q), admins[0], "")
+		assert.Equal(t, http.StatusOK, status, "The list token should be accepted by its server")
+		status, body = adminRequest(t, httpClient, "GET", listURL(servers[1].url, q), admins[1], "")
+		assert.Equal(t, http.StatusBadRequest, status, "The list token should not be accepted by another server")
+		assert.Contains(t, string(body), "'next_token' query parameter")
+	}
+	status, _ = adminRequest(t, httpClient, "GET", listURL(servers[1].url, url.Values{}), admins[0], "")
+	assert.Equal(t, http.StatusUnauthorized, status, "The identity of a server should not be authenticated by another server")
+}
@@ -0,0 +1,170 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/pkg/errors"
+)
+
+// The modes of a concurrency limit, which determine what happens to a request
+// which arrives when the endpoint is handling its maximum number of requests
+const (
+	// The request waits for one of the requests in progress to complete
+	concurrencyModeQueue = "queue"
+	// The request is rejected immediately
+	concurrencyModeReject = "reject"
+)
+
+// The defaults of a concurrency limit
+const (
+	defaultQueueTimeout = 30 * time.Second
+	defaultRetryAfter   = time.Second
+)
+
+// The names of the metrics of the concurrency limits
+const (
+	metricInFlight = "fabric_ca_requests_in_flight"
+	metricQueued   = "fabric_ca_requests_queued"
+	metricRejected = "fabric_ca_requests_rejected_total"
+)
+
+// concurrencyLimiter limits the number of requests which an endpoint handles
+// at the same time
+type concurrencyLimiter struct {
+	path string
+	cfg  ConcurrencyLimit
+	// Holds a value for each request in progress
+	slots chan struct{}
+	// Holds a value for each request waiting for a slot
+	queue chan struct{}
+}
+
+// initConcurrencyLimits validates the configured concurrency limits and
+// creates the limiters of the endpoints
+func (s *Server) initConcurrencyLimits() error {
+	s.limiters = map[string]*concurrencyLimiter{}
+	for path, cfg := range s.Config.Concurrency {
+		path = strings.Trim(path, "/")
+		cfg, err := checkConcurrencyLimit(path, cfg)
+		if err != nil {
+			return err
+		}
+		l := &concurrencyLimiter{
+			path:  path,
+			cfg:   cfg,
+			slots: make(chan struct{}, cfg.Max),
+		}
+		if cfg.Mode == concurrencyModeQueue {
+			l.queue = make(chan struct{}, cfg.QueueDepth)
+		}
+		s.limiters[path] = l
+		log.Debugf("Concurrency limit of '%s': %+v", path, cfg)
+	}
+	return nil
+}
+
+// checkConcurrencyLimit validates the concurrency limit of the endpoint at
+// 'path', returning it with the defaults of the settings which are not set
+func checkConcurrencyLimit(path string, cfg ConcurrencyLimit) (ConcurrencyLimit, error) {
+	if cfg.Max <= 0 {
+		return cfg, errors.Errorf("Invalid concurrency limit for '%s': max must be greater than 0", path)
+	}
+	cfg.Mode = strings.ToLower(cfg.Mode)
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = concurrencyModeQueue
+	case concurrencyModeQueue, concurrencyModeReject:
+	default:
+		return cfg, errors.Errorf("Invalid concurrency limit mode '%s' for '%s'; must be '%s' or '%s'",
+			cfg.Mode, path, concurrencyModeQueue, concurrencyModeReject)
+	}
+	if cfg.QueueDepth < 0 || cfg.QueueTimeout < 0 || cfg.RetryAfter < 0 {
+		return cfg, errors.Errorf("Invalid concurrency limit for '%s': queuedepth, queuetimeout and retryafter must not be negative", path)
+	}
+	if cfg.QueueDepth == 0 {
+		cfg.QueueDepth = cfg.Max
+	}
+	if cfg.QueueTimeout == 0 {
+		cfg.QueueTimeout = defaultQueueTimeout
+	}
+	if cfg.RetryAfter == 0 {
+		cfg.RetryAfter = defaultRetryAfter
+	}
+	return cfg, nil
+}
+
+// limitConcurrency applies the concurrency limit of the endpoint registered at
+// 'path', if any, to 'next'
+func (s *Server) limitConcurrency(path string, next http.Handler) http.Handler {
+	l := s.limiters[path]
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.acquire(l, r) {
+			s.metricWith(metricRejected, l.path).Add(1)
+			if info := getRequestInfo(r); info != nil {
+				info.code = caerrors.ErrServerBusy
+				info.msg = "Too many requests in progress"
+			}
+			seconds := int((l.cfg.RetryAfter + time.Second - 1) / time.Second)
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			s.writeError(w, caerrors.CreateHTTPErr(http.StatusServiceUnavailable, caerrors.ErrServerBusy,
+				"The server is busy; retry later"))
+			return
+		}
+		inFlight := s.metricWith(metricInFlight, l.path)
+		inFlight.Add(1)
+		defer func() {
+			inFlight.Add(-1)
+			<-l.slots
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acquire returns true when a slot of 'l' has been taken for 'r', or false if
+// 'r' is to be rejected
+func (s *Server) acquire(l *concurrencyLimiter, r *http.Request) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.queue == nil {
+		return false
+	}
+	// Wait in the queue if it is not full
+	select {
+	case l.queue <- struct{}{}:
+	default:
+		return false
+	}
+	queued := s.metricWith(metricQueued, l.path)
+	queued.Add(1)
+	defer func() {
+		queued.Add(-1)
+		<-l.queue
+	}()
+	timer := time.NewTimer(l.cfg.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/lib/metrics"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// limitedServer returns a server with the specified concurrency limit on the
+// endpoint "slow", whose handler takes 'delay' and records the maximum number
+// of requests which it handles at the same time in 'maxActive'
+func limitedServer(t *testing.T, limit ConcurrencyLimit, delay time.Duration, maxActive *int32) (*Server, http.Handler) {
+	s := &Server{
+		Config:  &ServerConfig{Concurrency: map[string]ConcurrencyLimit{"slow": limit}},
+		metrics: metrics.NewRegistry(),
+	}
+	newRequestMetrics(s.metrics)
+	err := s.initConcurrencyLimits()
+	util.FatalError(t, err, "Failed to initialize concurrency limits")
+	var active int32
+	h := s.wrapEndpoint("slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			max := atomic.LoadInt32(maxActive)
+			if n <= max || atomic.CompareAndSwapInt32(maxActive, max, n) {
+				break
+			}
+		}
+		time.Sleep(delay)
+		atomic.AddInt32(&active, -1)
+		w.Write([]byte("done"))
+	}))
+	return s, h
+}
+
+// sendConcurrently sends 'count' requests to 'h' at the same time and
+// returns the responses
+func sendConcurrently(h http.Handler, count int) []*httptest.ResponseRecorder {
+	responses := make([]*httptest.ResponseRecorder, count)
+	var wg sync.WaitGroup
+	for i := range responses {
+		responses[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder) {
+			defer wg.Done()
+			h.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/slow", nil))
+		}(responses[i])
+	}
+	wg.Wait()
+	return responses
+}
+
+func TestConcurrencyLimitReject(t *testing.T) {
+	var maxActive int32
+	s, h := limitedServer(t, ConcurrencyLimit{Max: 3, Mode: "reject", RetryAfter: 1500 * time.Millisecond},
+		100*time.Millisecond, &maxActive)
+
+	responses := sendConcurrently(h, 30)
+	var ok, rejected int
+	for _, w := range responses {
+		switch w.Code {
+		case 200:
+			ok++
+		case 503:
+			rejected++
+			assert.Equal(t, "2", w.Header().Get("Retry-After"), "Retry-After should be rounded up to seconds")
+			assert.Contains(t, w.Body.String(), `"code":"backend_unavailable"`)
+		default:
+			t.Errorf("Unexpected status %d", w.Code)
+		}
+	}
+	assert.True(t, maxActive <= 3, "%d requests were handled at the same time; the limit is 3", maxActive)
+	assert.True(t, ok >= 3, "At least 3 requests should succeed, but %d did", ok)
+	assert.True(t, rejected > 0, "Requests beyond the limit should be rejected")
+	assert.Equal(t, float64(rejected), s.metrics.Get(metricRejected).With("slow").Value())
+	assert.Equal(t, float64(rejected), s.metrics.Get(metricRequests).With("POST", "slow", "503").Value())
+	assert.Equal(t, float64(0), s.metrics.Get(metricInFlight).With("slow").Value())
+}
+
+func TestConcurrencyLimitQueue(t *testing.T) {
+	// Every request fits in the queue, so all of them succeed
+	var maxActive int32
+	s, h := limitedServer(t, ConcurrencyLimit{Max: 2, Mode: "queue", QueueDepth: 20},
+		20*time.Millisecond, &maxActive)
+	responses := sendConcurrently(h, 20)
+	for _, w := range responses {
+		assert.Equal(t, 200, w.Code)
+	}
+	assert.True(t, maxActive <= 2, "%d requests were handled at the same time; the limit is 2", maxActive)
+	assert.Equal(t, float64(0), s.metrics.Get(metricRejected).With("slow").Value())
+	assert.Equal(t, float64(0), s.metrics.Get(metricQueued).With("slow").Value())
+
+	// Requests beyond the queue depth, and those which time out in the
+	// queue, are rejected
+	maxActive = 0
+	s, h = limitedServer(t, ConcurrencyLimit{Max: 2, QueueDepth: 4, QueueTimeout: 150 * time.Millisecond},
+		100*time.Millisecond, &maxActive)
+	responses = sendConcurrently(h, 20)
+	var ok, rejected int
+	for _, w := range responses {
+		if w.Code == 200 {
+			ok++
+		} else if assert.Equal(t, 503, w.Code) {
+			rejected++
+			assert.Equal(t, "1", w.Header().Get("Retry-After"))
+		}
+	}
+	assert.True(t, maxActive <= 2, "%d requests were handled at the same time; the limit is 2", maxActive)
+	assert.True(t, ok >= 2 && ok <= 6, "Between 2 and 6 requests should succeed, but %d did", ok)
+	assert.Equal(t, float64(rejected), s.metrics.Get(metricRejected).With("slow").Value())
+}
+
+func TestConcurrencyLimitConfig(t *testing.T) {
+	for _, limit := range []ConcurrencyLimit{
+		{Max: 0},
+		{Max: 1, Mode: "drop"},
+		{Max: 1, QueueDepth: -1},
+	} {
+		s := &Server{Config: &ServerConfig{Concurrency: map[string]ConcurrencyLimit{"enroll": limit}}}
+		err := s.initConcurrencyLimits()
+		util.ErrorContains(t, err, "Invalid concurrency limit", "Invalid limit %+v should fail", limit)
+	}
+
+	s := &Server{Config: &ServerConfig{Concurrency: map[string]ConcurrencyLimit{"/tcert": {Max: 4}}}}
+	err := s.initConcurrencyLimits()
+	util.FatalError(t, err, "Failed to initialize concurrency limits")
+	l := s.limiters["tcert"]
+	if assert.NotNil(t, l, "The limit should apply to the endpoint without its leading slash") {
+		assert.Equal(t, concurrencyModeQueue, l.cfg.Mode)
+		assert.Equal(t, 4, l.cfg.QueueDepth)
+		assert.Equal(t, defaultQueueTimeout, l.cfg.QueueTimeout)
+		assert.Equal(t, defaultRetryAfter, l.cfg.RetryAfter)
+	}
+}
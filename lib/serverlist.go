@@ -0,0 +1,104 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/lib/server"
+	"github.com/pkg/errors"
+)
+
+// newListTokenKey returns a key which authenticates the next tokens returned
+// by the list endpoints of a server, which are therefore valid for as long as
+// the server runs and are not accepted by another server
+func newListTokenKey() ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to generate the key of the list tokens")
+	}
+	return key, nil
+}
+
+// The sorting and filtering of the list endpoints
+var (
+	identityListSpec = &server.ListSpec{
+		SortFields: []string{"id", "type", "affiliation"},
+		Filters: map[string]server.FilterKind{
+			"type":        server.FilterString,
+			"affiliation": server.FilterString,
+		},
+	}
+	certificateListSpec = &server.ListSpec{
+		SortFields: []string{"serial", "id", "expiry", "revoked_at"},
+		Filters: map[string]server.FilterKind{
+			"id":            server.FilterString,
+			"aki":           server.FilterString,
+			"serial":        server.FilterString,
+			"notrevoked":    server.FilterBool,
+			"notexpired":    server.FilterBool,
+			"revoked_start": server.FilterString,
+			"revoked_end":   server.FilterString,
+			"expired_start": server.FilterString,
+			"expired_end":   server.FilterString,
+		},
+	}
+	affiliationListSpec = &server.ListSpec{
+		SortFields: []string{"name"},
+	}
+)
+
+// parseListParams returns the list parameters of the request 'ctx' to a list
+// endpoint described by 'spec'
+func parseListParams(ctx server.ListContext, spec *server.ListSpec) (*server.ListParams, error) {
+	key, err := listTokenKey(ctx)
+	if err != nil {
+		return nil, caerrors.NewHTTPErr(500, caerrors.ErrUnknown, "%s", err)
+	}
+	p, err := server.ParseListParams(ctx, spec, key)
+	if err != nil {
+		return nil, caerrors.NewHTTPErr(400, caerrors.ErrInvalidListParm, "%s", err)
+	}
+	return p, nil
+}
+
+// listTokenKey returns the key of the list tokens of the server which handles
+// the request 'ctx'. Without the key, a next token can't be authenticated, so
+// an error is returned rather than accepting any token.
+func listTokenKey(ctx server.ListContext) ([]byte, error) {
+	if c, ok := ctx.(*serverRequestContextImpl); ok {
+		if s := c.server(); s != nil && len(s.listTokenKey) > 0 {
+			return s.listTokenKey, nil
+		}
+	}
+	return nil, errors.New("The key of the list tokens of the server is not available")
+}
+
+// listQueryDocs returns the descriptions of the query parameters of a list
+// endpoint described by 'spec' whose filters are described by 'filters'
+func listQueryDocs(spec *server.ListSpec, filters map[string]string) map[string]string {
+	docs := map[string]string{}
+	for name, doc := range server.ListQueryDocs {
+		docs[name] = doc
+	}
+	docs["sort"] = fmt.Sprintf("Sort the items by one of %s; %s by default", strings.Join(spec.SortFields, ", "), spec.SortFields[0])
+	for name, doc := range filters {
+		docs[name] = doc
+	}
+	return docs
+}
+
+// listTimeKey returns the sort key of the time 't', which sorts as a string
+// in the order of the times
+func listTimeKey(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000000Z")
+}
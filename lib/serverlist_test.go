@@ -0,0 +1,95 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListIdentityPages(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	client := TestGetRootClient()
+	eresp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin'")
+	admin := eresp.Identity
+	for i := 0; i < 4; i++ {
+		_, err = admin.Register(&api.RegistrationRequest{Name: fmt.Sprintf("pageuser%d", i), Type: "client", Affiliation: "org1"})
+		util.FatalError(t, err, "Failed to register user")
+	}
+
+	// listIdentities returns the status code and the body of a request for
+	// a page of identities with the query 'q'
+	listIdentities := func(q url.Values) (int, []byte) {
+		u := fmt.Sprintf("http://localhost:%d/api/v1/identities?%s", rootPort, q.Encode())
+		return adminRequest(t, &http.Client{}, "GET", u, admin, "")
+	}
+
+	var ids []string
+	q := url.Values{"limit": {"2"}, "affiliation": {"org1"}, "sort": {"id"}, "order": {"desc"}, "total": {"true"}}
+	for {
+		status, body := listIdentities(q)
+		assert.Equal(t, http.StatusOK, status, "Failed to get page: %s", body)
+		var resp struct {
+			Result struct {
+				Items     []api.IdentityInfo `json:"items"`
+				NextToken string             `json:"next_token"`
+				Total     int                `json:"total"`
+			} `json:"result"`
+		}
+		err = json.Unmarshal(body, &resp)
+		util.FatalError(t, err, "Failed to parse page")
+		assert.Equal(t, 4, resp.Result.Total)
+		for _, id := range resp.Result.Items {
+			ids = append(ids, id.ID)
+		}
+		if resp.Result.NextToken == "" {
+			break
+		}
+		q.Set("next_token", resp.Result.NextToken)
+	}
+	assert.Equal(t, []string{"pageuser3", "pageuser2", "pageuser1", "pageuser0"}, ids)
+
+	// A token which is modified, or used for other filters, is rejected
+	// with an error which names the parameter
+	token := []byte(q.Get("next_token"))
+	token[len(token)-2] ^= 1
+	q.Set("next_token", string(token))
+	for _, query := range []url.Values{q, {"limit": {"2"}, "sort": {"name"}}} {
+		status, body := listIdentities(query)
+		assert.Equal(t, http.StatusBadRequest, status)
+		var envelope caerrors.ErrorResponse
+		err = json.Unmarshal(body, &envelope)
+		util.FatalError(t, err, "Failed to parse error envelope")
+		assert.Equal(t, caerrors.ClassValidation, envelope.Code)
+		assert.Equal(t, caerrors.ErrInvalidListParm, envelope.Details.ErrorCode)
+	}
+	status, body := listIdentities(q)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, string(body), "'next_token' query parameter")
+
+	// Without list parameters, the identities are streamed as before
+	status, body = listIdentities(url.Values{"affiliation": {"org1"}})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, string(body), `"identities":[`)
+}
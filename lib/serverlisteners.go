@@ -0,0 +1,258 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	// unixSocketPrefix is the prefix of an address or URL which refers to a
+	// Unix domain socket
+	unixSocketPrefix = "unix://"
+	// defaultSocketMode is the default file permissions of the Unix domain
+	// sockets created for the listening addresses
+	defaultSocketMode = "0660"
+)
+
+// unixSocketPath returns the path of the Unix domain socket and true if
+// 'addr' is of the form unix://path; otherwise, it returns false
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixSocketPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, unixSocketPrefix), true
+}
+
+// listenOnAddresses creates a listener for each of the server's additional
+// listening addresses. The TCP listeners use the TLS configuration of the
+// server's listener, if any; Unix domain sockets are served without TLS since
+// access to them is controlled by their file permissions.
+func (s *Server) listenOnAddresses(tlsConfig *tls.Config) error {
+	c := s.Config.Listeners
+	if len(c.Addresses) == 0 {
+		return nil
+	}
+	mode, err := strconv.ParseUint(c.SocketMode, 8, 32)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid 'listeners.socketmode' value '%s'", c.SocketMode)
+	}
+	for _, addr := range c.Addresses {
+		var listener net.Listener
+		if path, ok := unixSocketPath(addr); ok {
+			path, err = util.MakeFileAbs(path, s.HomeDir)
+			if err != nil {
+				return err
+			}
+			listener, err = listenOnUnixSocket(path, os.FileMode(mode))
+			if err != nil {
+				return err
+			}
+			log.Infof("Listening on %s%s", unixSocketPrefix, path)
+		} else {
+			listener, err = net.Listen("tcp", addr)
+			if err != nil {
+				return errors.Wrapf(err, "TCP listen failed for %s", addr)
+			}
+			scheme := "http"
+			if tlsConfig != nil {
+				listener = tls.NewListener(listener, tlsConfig)
+				scheme = "https"
+			}
+			log.Infof("Listening on %s://%s", scheme, listener.Addr())
+		}
+		s.extraListeners = append(s.extraListeners, listener)
+	}
+	return nil
+}
+
+// listenOnUnixSocket creates a Unix domain socket at 'path' with the file
+// permissions 'mode'. A socket left behind by a server which did not shut
+// down cleanly is replaced, but one which is in use is not.
+func listenOnUnixSocket(path string, mode os.FileMode) (net.Listener, error) {
+	fi, err := os.Lstat(path)
+	if err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.Errorf("Failed to create Unix domain socket: '%s' exists and is not a socket", path)
+		}
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil, errors.Errorf("Failed to create Unix domain socket: '%s' is in use", path)
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to remove stale Unix domain socket '%s'", path)
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unix domain socket listen failed for %s", path)
+	}
+	err = os.Chmod(path, mode)
+	if err != nil {
+		listener.Close()
+		return nil, errors.Wrapf(err, "Failed to set the permissions of Unix domain socket '%s'", path)
+	}
+	return listener, nil
+}
+
+// serveAdditional serves requests received by the additional listeners
+func (s *Server) serveAdditional() {
+	for _, listener := range s.extraListeners {
+		go func(listener net.Listener) {
+			err := s.httpServer.Serve(listener)
+			log.Debugf("Stopped serving requests on %s: %s", listener.Addr(), err)
+		}(listener)
+	}
+}
+
+// closeAdditionalListeners closes the additional listeners, which removes
+// the Unix domain sockets
+func (s *Server) closeAdditionalListeners() {
+	for _, listener := range s.extraListeners {
+		err := listener.Close()
+		if err != nil {
+			log.Debugf("Stop: failed to close listener on %s: %s", listener.Addr(), err)
+		}
+	}
+	s.extraListeners = nil
+}
+
+// ListenAddresses are the addresses on which a started server listens. Ports
+// which are configured as 0 are those chosen when the server started.
+type ListenAddresses struct {
+	// URL of the server's listening port, such as https://localhost:7054,
+	// with the base path of the server if it has one
+	URL string `json:"url"`
+	// Address of the server's listening port, as host:port
+	Address string `json:"address"`
+	// The server's listening port
+	Port int `json:"port"`
+	// Address of the operations endpoints, as host:port, if they have their
+	// own listener; otherwise they are served on the server's listening port
+	Operations string `json:"operations,omitempty"`
+	// Address of the administration endpoints, as host:port or unix://path,
+	// if they have their own listener
+	Admin string `json:"admin,omitempty"`
+	// The additional listening addresses, each either host:port or
+	// unix://path for a Unix domain socket
+	Additional []string `json:"additional,omitempty"`
+	// Address of the gRPC service, as host:port, if it is served
+	GRPC string `json:"grpc,omitempty"`
+}
+
+// ListenAddresses returns the addresses on which the server listens, or nil
+// if the server is not listening
+func (s *Server) ListenAddresses() *ListenAddresses {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.listenAddrs
+}
+
+// reportListenAddresses records the addresses on which the server's
+// listeners are bound, writes them to the address file, if any, and passes
+// them to the OnListen callback, if any
+func (s *Server) reportListenAddresses() error {
+	tcpAddr, ok := s.listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return errors.Errorf("Unexpected listening address %s", s.listener.Addr())
+	}
+	addrs := &ListenAddresses{Address: tcpAddr.String(), Port: tcpAddr.Port}
+	// A client can't connect to an unspecified address such as 0.0.0.0
+	host := tcpAddr.IP.String()
+	if tcpAddr.IP.IsUnspecified() {
+		host = "localhost"
+	}
+	scheme := "http"
+	if s.Config.TLS.Enabled {
+		scheme = "https"
+	}
+	addrs.URL = fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, strconv.Itoa(tcpAddr.Port))) + s.basePath()
+	if s.opsListener != nil {
+		addrs.Operations = s.opsListener.Addr().String()
+	}
+	if s.adminListener != nil {
+		addrs.Admin = s.adminListener.Addr().String()
+		if s.adminListener.Addr().Network() == "unix" {
+			addrs.Admin = unixSocketPrefix + addrs.Admin
+		}
+	}
+	for _, l := range s.extraListeners {
+		if l.Addr().Network() == "unix" {
+			addrs.Additional = append(addrs.Additional, unixSocketPrefix+l.Addr().String())
+		} else {
+			addrs.Additional = append(addrs.Additional, l.Addr().String())
+		}
+	}
+	if s.grpcListener != nil {
+		addrs.GRPC = s.grpcListener.Addr().String()
+	}
+	s.mutex.Lock()
+	s.listenAddrs = addrs
+	s.mutex.Unlock()
+
+	file := s.Config.Listeners.AddressFile
+	if file != "" {
+		file, err := util.MakeFileAbs(file, s.HomeDir)
+		if err != nil {
+			return err
+		}
+		buf, err := json.Marshal(addrs)
+		if err != nil {
+			return errors.Wrap(err, "Failed to marshal listening addresses")
+		}
+		// The file is renamed into place so that a harness which polls for it
+		// never reads a partially written file
+		tmp := file + ".tmp"
+		err = ioutil.WriteFile(tmp, append(buf, '\n'), 0644)
+		if err == nil {
+			err = os.Rename(tmp, file)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return errors.Wrapf(err, "Failed to write listening addresses to '%s'", file)
+		}
+		log.Debugf("Wrote listening addresses to %s", file)
+	}
+	if s.OnListen != nil {
+		s.OnListen(addrs)
+	}
+	return nil
+}
+
+// removeAddressFile removes the file to which the listening addresses were
+// written, since they are no longer listened on. The caller must hold the
+// server's mutex.
+func (s *Server) removeAddressFile() {
+	if s.listenAddrs == nil {
+		return
+	}
+	s.listenAddrs = nil
+	if s.Config.Listeners.AddressFile == "" {
+		return
+	}
+	file, err := util.MakeFileAbs(s.Config.Listeners.AddressFile, s.HomeDir)
+	if err == nil {
+		err = os.Remove(file)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Debugf("Stop: failed to remove address file: %s", err)
+	}
+}
@@ -0,0 +1,189 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerListeners(t *testing.T) {
+	srv := TestGetRootServer(t)
+	srv.Config.Listeners.Addresses = []string{"unix://ca.sock", "127.0.0.1:0"}
+	srv.Config.Listeners.SocketMode = "0600"
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+
+	sock := filepath.Join(rootDir, "ca.sock")
+	fi, err := os.Lstat(sock)
+	util.FatalError(t, err, "The Unix domain socket was not created")
+	assert.True(t, fi.Mode()&os.ModeSocket != 0, "Not a Unix domain socket")
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm(), "Unexpected permissions of the Unix domain socket")
+
+	// Enroll over the Unix domain socket and use the enrolled identity
+	client := &Client{
+		Config:  &ClientConfig{URL: "unix://" + sock},
+		HomeDir: filepath.Join(rootClientDir, "unix"),
+	}
+	resp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll over the Unix domain socket")
+	_, err = resp.Identity.Register(&api.RegistrationRequest{Name: "unixuser", Affiliation: "org1"})
+	assert.NoError(t, err, "Failed to register over the Unix domain socket")
+
+	// The server's port and the additional TCP address serve requests at the same time
+	tcpClient := &Client{
+		Config:  &ClientConfig{URL: fmt.Sprintf("http://%s", srv.ListenAddresses().Additional[1])},
+		HomeDir: filepath.Join(rootClientDir, "tcp"),
+	}
+	_, err = tcpClient.GetCAInfo(&api.GetCAInfoRequest{})
+	assert.NoError(t, err, "Failed to get CA info from the additional TCP address")
+	_, err = TestGetRootClient().GetCAInfo(&api.GetCAInfoRequest{})
+	assert.NoError(t, err, "Failed to get CA info from the server's port")
+
+	err = srv.Stop()
+	util.FatalError(t, err, "Failed to stop server")
+	_, err = os.Lstat(sock)
+	assert.True(t, os.IsNotExist(err), "The Unix domain socket should be removed when the server stops")
+}
+
+func TestServerListenersUnixSocketErrors(t *testing.T) {
+	srv := TestGetRootServer(t)
+	defer os.RemoveAll(rootDir)
+	srv.Config.Listeners.Addresses = []string{"unix://ca.sock"}
+	srv.Config.Listeners.SocketMode = "rw"
+	err := srv.Start()
+	util.ErrorContains(t, err, "listeners.socketmode", "Invalid socket mode should fail")
+
+	// A file which is not a socket is not replaced
+	err = os.MkdirAll(rootDir, 0755)
+	util.FatalError(t, err, "Failed to create directory")
+	err = ioutil.WriteFile(filepath.Join(rootDir, "ca.sock"), []byte("data"), 0644)
+	util.FatalError(t, err, "Failed to create file")
+	srv = TestGetServer2(false, rootPort, rootDir, "", -1, t)
+	srv.Config.Listeners.Addresses = []string{"unix://ca.sock"}
+	err = srv.Start()
+	util.ErrorContains(t, err, "is not a socket", "Listening on a file which is not a socket should fail")
+}
+
+func TestServerListenAddresses(t *testing.T) {
+	defer os.RemoveAll(rootDir)
+	srv := TestGetServer(0, rootDir, "", -1, t)
+	srv.Config.Operations.ListenAddress = "127.0.0.1:0"
+	srv.Config.Listeners.Addresses = []string{"127.0.0.1:0", "unix://ca.sock"}
+	srv.Config.Listeners.AddressFile = "addresses.json"
+	var reported *ListenAddresses
+	srv.OnListen = func(addrs *ListenAddresses) {
+		reported = addrs
+	}
+	assert.Nil(t, srv.ListenAddresses(), "A server which is not started has no listening addresses")
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server on a free port")
+
+	addrs := srv.ListenAddresses()
+	if assert.NotNil(t, addrs) {
+		assert.Equal(t, addrs, reported, "The OnListen callback should receive the listening addresses")
+		assert.NotEqual(t, 0, addrs.Port, "The port chosen by the server should be reported")
+		assert.Equal(t, fmt.Sprintf("http://localhost:%d", addrs.Port), addrs.URL)
+		assert.NotContains(t, addrs.Operations, ":0", "The port of the operations endpoints should be reported")
+		if assert.Len(t, addrs.Additional, 2) {
+			assert.NotContains(t, addrs.Additional[0], ":0")
+			assert.Equal(t, "unix://"+filepath.Join(srv.HomeDir, "ca.sock"), addrs.Additional[1])
+		}
+	}
+
+	// The address file has the same addresses
+	addrFile := filepath.Join(rootDir, "addresses.json")
+	buf, err := ioutil.ReadFile(addrFile)
+	util.FatalError(t, err, "Failed to read the address file")
+	var fromFile ListenAddresses
+	err = json.Unmarshal(buf, &fromFile)
+	util.FatalError(t, err, "Failed to parse the address file")
+	assert.Equal(t, addrs, &fromFile)
+
+	err = srv.Stop()
+	util.FatalError(t, err, "Failed to stop server")
+	assert.Nil(t, srv.ListenAddresses(), "A stopped server has no listening addresses")
+	assert.False(t, util.FileExists(addrFile), "The address file should be removed when the server stops")
+}
+
+// Port 0 of a configuration is a free port, but a server which is given no
+// configuration listens on the default port
+func TestServerDefaultPort(t *testing.T) {
+	defer os.RemoveAll(rootDir)
+	srv := &Server{HomeDir: rootDir}
+	err := srv.initConfig()
+	util.FatalError(t, err, "Failed to initialize the configuration")
+	assert.Equal(t, DefaultServerPort, srv.Config.Port)
+}
+
+func TestServerBasePath(t *testing.T) {
+	defer os.RemoveAll(rootDir)
+	srv := TestGetServer(0, rootDir, "", -1, t)
+	// The base path is normalized, so that repeated and trailing slashes
+	// are ignored
+	srv.Config.BasePath = "//ca/"
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer srv.Stop()
+	addrs := srv.ListenAddresses()
+	root := fmt.Sprintf("http://localhost:%d", addrs.Port)
+	assert.Equal(t, root+"/ca", addrs.URL, "The URL of the server should have its base path")
+
+	// The endpoints, including the operations endpoints, are served only
+	// under the base path
+	for path, status := range map[string]int{
+		"/ca/api/v1/cainfo": http.StatusOK,
+		"/ca/cainfo":        http.StatusOK,
+		"/ca/healthz":       http.StatusOK,
+		"/api/v1/cainfo":    http.StatusNotFound,
+		"/cainfo":           http.StatusNotFound,
+		"/healthz":          http.StatusNotFound,
+		"/ca/ca/cainfo":     http.StatusNotFound,
+	} {
+		resp, err := http.Get(root + path)
+		if assert.NoError(t, err, "Failed to get %s", path) {
+			resp.Body.Close()
+			assert.Equal(t, status, resp.StatusCode, "Unexpected status of %s", path)
+		}
+	}
+
+	// A client whose URL has the base path, with or without a trailing slash
+	// or repeated slashes, sends its requests under it
+	var admin *Identity
+	for _, url := range []string{addrs.URL, addrs.URL + "/", root + "//ca//"} {
+		client := &Client{Config: &ClientConfig{URL: url}, InMemory: true}
+		resp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+		util.FatalError(t, err, "Failed to enroll with the URL "+url)
+		admin = resp.Identity
+	}
+
+	// The location of a registered identity is under the base path
+	body := []byte(`{"id":"basepathuser","affiliation":"org1"}`)
+	req, err := admin.client.newPost("register", body)
+	util.FatalError(t, err, "Failed to create the registration request")
+	err = admin.addTokenAuthHdr(req, body)
+	util.FatalError(t, err, "Failed to add the authorization header")
+	resp, err := http.DefaultClient.Do(req)
+	util.FatalError(t, err, "Failed to register")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode, "The registration should succeed")
+	assert.Equal(t, "/ca/api/v1/identities/basepathuser", resp.Header.Get("Location"))
+}
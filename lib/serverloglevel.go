@@ -0,0 +1,63 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/lib/logging"
+)
+
+func newLogLevelEndpoint(s *Server) *serverEndpoint {
+	return &serverEndpoint{
+		Methods: []string{"GET", "PUT"},
+		Handler: logLevelHandler,
+		Server:  s,
+		auth:    authAdmin,
+		docs: map[string]operationDoc{
+			"GET": {summary: "Get the log level of the server", response: &api.LogLevelResponse{}},
+			"PUT": {summary: "Set the log level of the server", request: &api.LogLevelRequest{}, response: &api.LogLevelResponse{}},
+		},
+	}
+}
+
+// Handle a request to get or set the log level of the server
+func logLevelHandler(ctx *serverRequestContextImpl) (interface{}, error) {
+	var req api.LogLevelRequest
+	if ctx.req.Method == "PUT" {
+		err := ctx.ReadBody(&req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	id, err := ctx.adminAuthorization("change the log level")
+	if err != nil {
+		return nil, err
+	}
+	if ctx.req.Method == "PUT" {
+		level, err := logging.ParseLevel(req.Level)
+		if err != nil {
+			return nil, caerrors.NewHTTPErr(400, caerrors.ErrInvalidLogLevel, "%s", err)
+		}
+		logging.SetLevel(level)
+		log.Warningf("Log level set to '%s' by '%s'", logging.LevelName(level), id)
+	}
+	return &api.LogLevelResponse{Level: logging.LevelName(log.Level)}, nil
+}
+
+// adjustLogLevel makes logging more verbose by the specified number of levels;
+// a negative number makes it less verbose
+func adjustLogLevel(levels int) {
+	level := log.Level - levels
+	if level < log.LevelDebug || level > log.LevelCritical {
+		log.Warningf("Log level is already '%s'", logging.LevelName(log.Level))
+		return
+	}
+	logging.SetLevel(level)
+	log.Warningf("Log level set to '%s'", logging.LevelName(level))
+}
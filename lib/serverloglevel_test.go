@@ -0,0 +1,107 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib/logging"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogLevelEndpoint(t *testing.T) {
+	logDir, err := ioutil.TempDir("", "loglevel")
+	util.FatalError(t, err, "Failed to create temp directory")
+	defer os.RemoveAll(logDir)
+	logFile := filepath.Join(logDir, "server.log")
+
+	srv := TestGetRootServer(t)
+	srv.Config.Log.File = logFile
+	srv.HandleSignals = true
+	err = srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		logging.Configure(&logging.Config{}, "")
+		logging.SetLevel(log.LevelInfo)
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+
+	c := TestGetRootClient()
+	enrollResp, err := c.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin'")
+	admin := enrollResp.Identity
+
+	resp, err := admin.SetLogLevel(&api.LogLevelRequest{Level: "debug"})
+	util.FatalError(t, err, "Failed to set log level")
+	assert.Equal(t, "debug", resp.Level)
+	offset := logFileSize(t, logFile)
+	resp, err = admin.GetLogLevel()
+	util.FatalError(t, err, "Failed to get log level")
+	assert.Equal(t, "debug", resp.Level)
+	assert.Contains(t, readLogFrom(t, logFile, offset), "[DEBUG]", "Debug messages should be logged")
+
+	_, err = admin.SetLogLevel(&api.LogLevelRequest{Level: "info"})
+	util.FatalError(t, err, "Failed to set log level")
+	offset = logFileSize(t, logFile)
+	resp, err = admin.GetLogLevel()
+	util.FatalError(t, err, "Failed to get log level")
+	assert.Equal(t, "info", resp.Level)
+	assert.NotContains(t, readLogFrom(t, logFile, offset), "[DEBUG]", "Debug messages should not be logged")
+
+	_, err = admin.SetLogLevel(&api.LogLevelRequest{Level: "verbose"})
+	util.ErrorContains(t, err, "74", "Invalid log level should fail")
+
+	// An identity without the hf.Admin attribute is not authorized
+	_, err = admin.Register(&api.RegistrationRequest{Name: "loguser", Secret: "loguserpw"})
+	util.FatalError(t, err, "Failed to register 'loguser'")
+	enrollResp, err = c.Enroll(&api.EnrollmentRequest{Name: "loguser", Secret: "loguserpw"})
+	util.FatalError(t, err, "Failed to enroll 'loguser'")
+	_, err = enrollResp.Identity.SetLogLevel(&api.LogLevelRequest{Level: "debug"})
+	util.ErrorContains(t, err, "71", "Identity without hf.Admin should not be able to set the log level")
+	_, err = enrollResp.Identity.GetLogLevel()
+	util.ErrorContains(t, err, "71", "Identity without hf.Admin should not be able to get the log level")
+
+	// SIGUSR1 makes logging more verbose and SIGUSR2 less verbose
+	proc, err := os.FindProcess(os.Getpid())
+	util.FatalError(t, err, "Failed to find own process")
+	err = proc.Signal(syscall.SIGUSR1)
+	util.FatalError(t, err, "Failed to send SIGUSR1")
+	waitForLogLevel(t, log.LevelDebug)
+	err = proc.Signal(syscall.SIGUSR2)
+	util.FatalError(t, err, "Failed to send SIGUSR2")
+	waitForLogLevel(t, log.LevelInfo)
+}
+
+func logFileSize(t *testing.T, file string) int64 {
+	fi, err := os.Stat(file)
+	util.FatalError(t, err, "Failed to stat log file")
+	return fi.Size()
+}
+
+func readLogFrom(t *testing.T, file string, offset int64) string {
+	buf, err := ioutil.ReadFile(file)
+	util.FatalError(t, err, "Failed to read log file")
+	return strings.TrimSpace(string(buf[offset:]))
+}
+
+func waitForLogLevel(t *testing.T, level int) {
+	for i := 0; i < 50 && log.Level != level; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, logging.LevelName(level), logging.LevelName(log.Level))
+}
@@ -0,0 +1,231 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/cloudflare/cfssl/api"
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/lib/logging"
+	"github.com/hyperledger/fabric-ca/lib/metrics"
+	"github.com/hyperledger/fabric-ca/util"
+)
+
+// The names of the metrics of the requests handled by the server's endpoints
+const (
+	metricRequests        = "fabric_ca_requests_total"
+	metricRequestDuration = "fabric_ca_request_duration_seconds"
+	metricResponseSize    = "fabric_ca_response_size_bytes"
+)
+
+// requestInfoKey is the key of the request's requestInfo in its context
+type requestInfoKey struct{}
+
+// requestInfo is the information about a request which is shared by the
+// middleware and the endpoint which handle it
+type requestInfo struct {
+	// ID which identifies the request in the server's log
+	id string
+	// Time at which the server started handling the request
+	start time.Time
+	// Enrollment ID of the authenticated caller, if any
+	identity string
+	// Local error code and message if the request failed
+	code int
+	msg  string
+	// Maximum size of the request body, which is that of the endpoint
+	maxBodySize int64
+}
+
+// getRequestInfo returns the requestInfo of 'r', or nil if it was not
+// received through the middleware
+func getRequestInfo(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// newRequestMetrics registers the metrics of the requests handled by the
+// server's endpoints
+func newRequestMetrics(reg *metrics.Registry) {
+	reg.NewCounter(metricRequests, "Number of requests handled", "method", "path", "status")
+	reg.NewSummary(metricRequestDuration, "Time taken to handle requests", "method", "path")
+	reg.NewSummary(metricResponseSize, "Size of the responses to requests", "method", "path")
+	reg.NewGauge(metricInFlight, "Number of requests in progress at endpoints with a concurrency limit", "path")
+	reg.NewGauge(metricQueued, "Number of requests waiting for the concurrency limit of their endpoint", "path")
+	reg.NewCounter(metricRejected, "Number of requests rejected by the concurrency limit of their endpoint", "path")
+	reg.NewCounter(metricBodyTooLarge, "Number of requests rejected because their body is larger than the maximum of their endpoint", "path")
+	reg.NewCounter(metricBodyReadTimeout, "Number of requests cut off because their body was not received within the body read timeout", "path")
+}
+
+// metricWith returns the metric of the server with the specified name and
+// label values, or an unregistered metric if the server has no metrics
+func (s *Server) metricWith(name string, labelValues ...string) *metrics.Metric {
+	if s.metrics == nil {
+		return new(metrics.Metric)
+	}
+	return s.metrics.Get(name).With(labelValues...)
+}
+
+// wrapEndpoint wraps the handler of the endpoint registered at 'path' with
+// the middleware which applies to all endpoints. Panic recovery is outermost,
+// so that it also recovers from panics in the other middleware; logging and
+// metrics come next, so that rejected requests are logged too, then the
+// limits of the request body, which apply to the body as it is sent, then
+// CORS, which answers preflight requests without authentication, then gzip
+// compression, which decompresses the request body before the endpoint
+// verifies the authorization token over it, then the endpoint's concurrency
+// limit, and then the endpoint itself, which authenticates the request.
+func (s *Server) wrapEndpoint(path string, h http.Handler) http.Handler {
+	return s.recoverPanics(path, s.logRequests(path, s.limitBody(path, s.handleCORS(s.handleGzip(s.limitConcurrency(path, h))))))
+}
+
+// recoverPanics assigns an ID to each request and, if handling the request
+// panics, logs the panic with the request's ID and stack and returns a 500
+// error instead of dropping the connection
+func (s *Server) recoverPanics(path string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := &requestInfo{id: util.RandomString(16), start: time.Now()}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		rec := newResponseRecorder(w)
+		rec.Header().Set(requestIDHeader, info.id)
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				// The handler aborted a response which it had started
+				s.recordRequest(path, r, info, rec)
+				panic(p)
+			}
+			log.Errorf("Panic while handling request %s for %s %s: %v\n%s", info.id, r.Method, r.URL.Path, p, debug.Stack())
+			if rec.status != 0 {
+				// The response has been started, so abort the connection so
+				// that the client does not mistake it for a complete one
+				s.recordRequest(path, r, info, rec)
+				panic(http.ErrAbortHandler)
+			}
+			info.code = caerrors.ErrUnknown
+			info.msg = fmt.Sprintf("Panic: %v", p)
+			s.writeError(rec, caerrors.CreateHTTPErr(http.StatusInternalServerError, caerrors.ErrUnknown, "Internal server error"))
+			s.recordRequest(path, r, info, rec)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// writeError writes the error response of 'he' in the format of the
+// responses of the server's endpoints
+func (s *Server) writeError(w http.ResponseWriter, he *caerrors.HTTPErr) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.legacyErrors() {
+		w.WriteHeader(he.GetEnvelopeStatusCode())
+		writeJSON(he.Envelope(), w)
+		return
+	}
+	w.WriteHeader(he.GetStatusCode())
+	writeJSON(&api.Response{
+		Success:  false,
+		Result:   "",
+		Errors:   []api.ResponseMessage{{Code: he.GetRemoteCode(), Message: he.GetRemoteMsg()}},
+		Messages: []api.ResponseMessage{},
+	}, w)
+}
+
+// legacyErrors returns true if errors are returned in the legacy format of
+// the cfssl responses rather than in error envelopes
+func (s *Server) legacyErrors() bool {
+	return s != nil && s.Config != nil && s.Config.API.LegacyErrors
+}
+
+// logRequests logs each request handled by 'next' and records it in the
+// server's metrics
+func (s *Server) logRequests(path string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := getRequestInfo(r)
+		log.Debugf("Received request %s for %s", info.id, r.URL)
+		rec := newResponseRecorder(w)
+		next.ServeHTTP(rec, r)
+		s.recordRequest(path, r, info, rec)
+	})
+}
+
+// recordRequest logs the request 'r' to the endpoint registered at 'path'
+// and records it in the server's metrics
+func (s *Server) recordRequest(path string, r *http.Request, info *requestInfo, rec *responseRecorder) {
+	duration := time.Since(info.start)
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	msg := info.msg
+	if msg == "" {
+		msg = "OK"
+	}
+	fields := logging.Fields{
+		"request_id":  info.id,
+		"remote":      r.RemoteAddr,
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"identity":    info.identity,
+		"status":      status,
+		"duration_ms": duration.Seconds() * 1000,
+		"size":        rec.size,
+	}
+	if status >= http.StatusBadRequest {
+		fields["code"] = info.code
+	}
+	logging.Log(log.LevelInfo, fmt.Sprintf(`%s %s %s %d %d "%s" %s`, r.RemoteAddr, r.Method, r.URL,
+		status, info.code, msg, duration), fields)
+
+	s.metricWith(metricRequests, r.Method, path, strconv.Itoa(status)).Add(1)
+	s.metricWith(metricRequestDuration, r.Method, path).Observe(duration.Seconds())
+	s.metricWith(metricResponseSize, r.Method, path).Observe(float64(rec.size))
+}
+
+// responseRecorder records the status code and size of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w}
+}
+
+// WriteHeader records the status code and sends the response header
+func (rr *responseRecorder) WriteHeader(scode int) {
+	if rr.status == 0 {
+		rr.status = scode
+	}
+	rr.ResponseWriter.WriteHeader(scode)
+}
+
+// Write records the size of the data and writes it to the response
+func (rr *responseRecorder) Write(buf []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(buf)
+	rr.size += n
+	return n, err
+}
+
+// Flush sends any buffered data to the client
+func (rr *responseRecorder) Flush() {
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
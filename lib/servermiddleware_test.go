@@ -0,0 +1,152 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/lib/logging"
+	"github.com/hyperledger/fabric-ca/lib/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerMiddleware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "middleware")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	err = logging.Configure(&logging.Config{Format: "json", Level: "info", File: "server.log"}, dir)
+	if err != nil {
+		t.Fatalf("Failed to configure logging: %s", err)
+	}
+	defer func() {
+		logging.Configure(&logging.Config{}, "")
+		log.Level = log.LevelInfo
+	}()
+
+	s := &Server{metrics: metrics.NewRegistry()}
+	newRequestMetrics(s.metrics)
+	var order []string
+	ok := s.wrapEndpoint("ok", &serverEndpoint{
+		Methods: []string{"GET"},
+		Handler: func(ctx *serverRequestContextImpl) (interface{}, error) {
+			// The endpoint runs inside the middleware, which has
+			// already assigned the request its ID
+			order = append(order, "handler")
+			assert.NotNil(t, getRequestInfo(ctx.req))
+			return "done", nil
+		},
+	})
+	panicking := s.wrapEndpoint("panic", &serverEndpoint{
+		Methods: []string{"GET"},
+		Handler: func(ctx *serverRequestContextImpl) (interface{}, error) {
+			panic("something went wrong")
+		},
+	})
+
+	w := httptest.NewRecorder()
+	ok.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/ok", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, []string{"handler"}, order)
+	okID := w.Header().Get(requestIDHeader)
+	assert.NotEmpty(t, okID, "Response should have a request ID")
+
+	// A panicking endpoint returns a clean 500 error
+	w = httptest.NewRecorder()
+	panicking.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/panic", nil))
+	assert.Equal(t, 500, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	panicID := w.Header().Get(requestIDHeader)
+	assert.NotEmpty(t, panicID, "Response should have a request ID")
+	assert.NotEqual(t, okID, panicID)
+	resp := &caerrors.ErrorResponse{}
+	err = json.Unmarshal(w.Body.Bytes(), resp)
+	if assert.NoError(t, err, "Response is not valid JSON: %s", w.Body.String()) {
+		assert.Equal(t, caerrors.ClassInternal, resp.Code)
+		assert.Equal(t, caerrors.ErrUnknown, resp.Details.ErrorCode)
+		assert.NotContains(t, w.Body.String(), "something went wrong",
+			"The panic value should not be returned to the client")
+	}
+
+	// Both requests are logged with their IDs, and the panic with its stack
+	entries := readLogEntries(t, filepath.Join(dir, "server.log"))
+	var okLogged, panicLogged, stackLogged bool
+	for _, e := range entries {
+		switch {
+		case e["request_id"] == okID:
+			okLogged = true
+			assert.EqualValues(t, 200, e["status"])
+			assert.Equal(t, "GET", e["method"])
+			assert.Equal(t, "/api/v1/ok", e["path"])
+			assert.Contains(t, e, "duration_ms")
+			assert.Contains(t, e, "size")
+		case e["request_id"] == panicID:
+			panicLogged = true
+			assert.EqualValues(t, 500, e["status"])
+			assert.EqualValues(t, caerrors.ErrUnknown, e["code"])
+		case strings.Contains(e["msg"].(string), "Panic while handling request "+panicID):
+			stackLogged = true
+			assert.Contains(t, e["msg"], "something went wrong")
+			assert.Contains(t, e["msg"], "runtime/debug.Stack")
+		}
+	}
+	assert.True(t, okLogged, "Successful request was not logged")
+	assert.True(t, panicLogged, "Panicking request was not logged")
+	assert.True(t, stackLogged, "Panic was not logged with its stack")
+
+	// Both requests are recorded in the metrics
+	assert.Equal(t, float64(1), s.metrics.Get(metricRequests).With("GET", "ok", "200").Value())
+	assert.Equal(t, float64(1), s.metrics.Get(metricRequests).With("GET", "panic", "500").Value())
+	assert.Equal(t, uint64(1), s.metrics.Get(metricRequestDuration).With("GET", "ok").Count())
+	size := s.metrics.Get(metricResponseSize).With("GET", "panic")
+	assert.Equal(t, float64(w.Body.Len()), size.Value())
+	w = httptest.NewRecorder()
+	s.metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, w.Body.String(), `fabric_ca_requests_total{method="GET",path="panic",status="500"} 1`)
+}
+
+// A panic after the response has been started aborts the connection
+func TestServerMiddlewareAbort(t *testing.T) {
+	s := &Server{}
+	h := s.wrapEndpoint("partial", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte("partial"))
+		panic("something went wrong")
+	}))
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/partial", nil))
+	})
+}
+
+func readLogEntries(t *testing.T, file string) []map[string]interface{} {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatalf("Failed to open log file: %s", err)
+	}
+	defer f.Close()
+	entries := []map[string]interface{}{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		entry := map[string]interface{}{}
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
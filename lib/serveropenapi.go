@@ -0,0 +1,338 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+//go:generate go run gen_openapi.go ../swagger/openapi.json
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cloudflare/cfssl/api"
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/lib/metadata"
+	"github.com/hyperledger/fabric-ca/lib/openapi"
+)
+
+const (
+	// openAPIPath is the path at which the server serves its API document
+	openAPIPath = "/openapi.json"
+	// swaggerUIPath is the path of the admin listener's page which browses
+	// the API document
+	swaggerUIPath = "/swagger/"
+)
+
+// swaggerUIPage is the page which browses the API document with the Swagger
+// UI distribution at the URL of the page's data
+var swaggerUIPage = template.Must(template.New("swagger").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Fabric CA Server API</title>
+<link rel="stylesheet" href="{{.}}/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="{{.}}/swagger-ui-bundle.js"></script>
+<script>
+SwaggerUIBundle({url: "../openapi.json", dom_id: "#swagger-ui"});
+</script>
+</body>
+</html>
+`))
+
+// endpointRegistration is an endpoint of the server's API
+type endpointRegistration struct {
+	// The API version of the endpoint
+	version string
+	// The path of the endpoint without the API version prefix
+	path string
+	// The handler of the endpoint, without the middleware
+	handler http.Handler
+	// True if the endpoint is served by the admin listener rather than on
+	// the server's port
+	admin bool
+}
+
+// endpointDoc describes an endpoint in the API document
+type endpointDoc struct {
+	// How the endpoint authenticates the invoker
+	auth authPolicy
+	// The HTTP methods of the endpoint
+	methods []string
+	// The HTTP status code of a successful response
+	successRC int
+	// The operations of the endpoint by HTTP method
+	docs map[string]operationDoc
+	// The encodings other than JSON of the result of a successful response
+	encodings []resultEncoding
+}
+
+// documentedEndpoint is the handler of an endpoint which describes itself in
+// the API document
+type documentedEndpoint interface {
+	apiDoc() endpointDoc
+}
+
+func (se *serverEndpoint) apiDoc() endpointDoc {
+	return endpointDoc{auth: se.auth, methods: se.Methods, successRC: se.getSuccessRC(), docs: se.docs,
+		encodings: se.encodings}
+}
+
+func (ae *rawAdminEndpoint) apiDoc() endpointDoc {
+	return endpointDoc{auth: authAdmin, methods: []string{"GET"}, successRC: http.StatusOK,
+		docs: map[string]operationDoc{"GET": ae.doc}}
+}
+
+// OpenAPIDocument returns the API document of a server with the default
+// configuration, which is committed as swagger/openapi.json
+func OpenAPIDocument() ([]byte, error) {
+	s := &Server{Config: &ServerConfig{}}
+	s.registerHandlers()
+	return marshalOpenAPIDocument(s.openAPIDocument())
+}
+
+// marshalOpenAPIDocument returns the indented JSON encoding of 'doc'
+func marshalOpenAPIDocument(doc *openapi.Document) ([]byte, error) {
+	buf, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, '\n'), nil
+}
+
+// registerOpenAPIHandlers registers the handler of the API document on the
+// server's mux and, if there is an admin listener, on the admin mux, with the
+// page which browses the document if a Swagger UI distribution is configured
+func (s *Server) registerOpenAPIHandlers() {
+	h := s.wrapEndpoint(strings.TrimPrefix(openAPIPath, "/"), http.HandlerFunc(s.openAPIHandler))
+	s.mux.Handle(s.basePath()+openAPIPath, h).Methods("GET")
+	if s.adminMux == nil {
+		return
+	}
+	s.adminMux.Handle(openAPIPath, h).Methods("GET")
+	if s.Config.Admin.SwaggerUI != "" {
+		ui := s.wrapEndpoint(strings.Trim(swaggerUIPath, "/"), http.HandlerFunc(s.swaggerUIHandler))
+		s.adminMux.Handle(swaggerUIPath, ui).Methods("GET")
+	}
+}
+
+// openAPIHandler serves the API document of the endpoints which the server
+// serves on its port
+func (s *Server) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	s.configMutex.RLock()
+	doc, err := marshalOpenAPIDocument(s.openAPIDocument())
+	s.configMutex.RUnlock()
+	if err != nil {
+		log.Errorf("Failed to encode the API document: %s", err)
+		s.writeError(w, caerrors.CreateHTTPErr(http.StatusInternalServerError, caerrors.ErrUnknown, "Failed to encode the API document"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(doc)
+}
+
+// swaggerUIHandler serves the page which browses the API document
+func (s *Server) swaggerUIHandler(w http.ResponseWriter, r *http.Request) {
+	s.configMutex.RLock()
+	assets := strings.TrimSuffix(s.Config.Admin.SwaggerUI, "/")
+	s.configMutex.RUnlock()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := swaggerUIPage.Execute(w, assets)
+	if err != nil {
+		log.Debugf("Failed to write the Swagger UI page: %s", err)
+	}
+}
+
+// openAPIDocument returns the API document of the endpoints which the server
+// serves on its port, generated from their registrations
+func (s *Server) openAPIDocument() *openapi.Document {
+	base := s.basePath()
+	if base == "" {
+		base = "/"
+	}
+	doc := &openapi.Document{
+		OpenAPI: openapi.Version,
+		Info: openapi.Info{
+			Title: "Fabric CA Server API",
+			Description: "The REST API of the Hyperledger Fabric CA server. Each endpoint of API version " +
+				metadata.APIVersion + " is also served without its " + apiPathPrefix + " prefix.",
+			Version: metadata.APIVersions[len(metadata.APIVersions)-1],
+		},
+		Servers: []openapi.Server{{URL: base}},
+		Paths:   map[string]*openapi.PathItem{},
+		Components: openapi.Components{
+			Schemas: map[string]*openapi.Schema{},
+			Parameters: map[string]*openapi.Parameter{
+				"ca": {
+					Name:        "ca",
+					In:          "query",
+					Description: "Name of the CA to which the request is sent, if not the default CA; it may also be the caname of the request body",
+					Schema:      &openapi.Schema{Type: "string"},
+				},
+			},
+			Responses: map[string]*openapi.Response{
+				"Error": {
+					Description: "The request failed",
+					Content:     jsonContent(openapi.SchemaRef("ErrorResponse")),
+				},
+				"Unauthorized": {
+					Description: "The invoker is not authenticated",
+					Content:     jsonContent(openapi.SchemaRef("ErrorResponse")),
+				},
+			},
+			SecuritySchemes: map[string]*openapi.SecurityScheme{
+				"basicAuth": {
+					Type:        "http",
+					Scheme:      "basic",
+					Description: "The enrollment ID and secret of the invoker",
+				},
+				"tokenAuth": {
+					Type: "apiKey",
+					In:   "header",
+					Name: "Authorization",
+					Description: "A token signed with the key of the invoker's enrollment certificate: the base64 encoding " +
+						"of the certificate and of the signature of the request, separated by a period",
+				},
+			},
+		},
+	}
+	schemas := openapi.NewSchemas(doc.Components.Schemas)
+	messages := &openapi.Schema{Type: "array", Items: schemas.For(api.ResponseMessage{})}
+	if s.legacyErrors() {
+		doc.Components.Schemas["ErrorResponse"] = responseSchema(&openapi.Schema{Type: "string", Description: "Empty"}, messages)
+	} else {
+		schemas.For(caerrors.ErrorResponse{})
+		envelope := doc.Components.Schemas["ErrorResponse"]
+		envelope.Required = []string{"code", "message", "details"}
+		code := envelope.Properties["code"]
+		code.Description = "The class of the error"
+		for _, class := range caerrors.Classes {
+			code.Enum = append(code.Enum, class)
+		}
+	}
+	for _, reg := range s.registrations {
+		de, ok := reg.handler.(documentedEndpoint)
+		if !ok || reg.admin {
+			continue
+		}
+		ed := de.apiDoc()
+		item := openapi.PathItem{}
+		for _, method := range ed.methods {
+			item[strings.ToLower(method)] = s.openAPIOperation(schemas, messages, reg, ed, method)
+		}
+		doc.Paths[apiVersionPrefix(reg.version)+reg.path] = &item
+	}
+	return doc
+}
+
+// openAPIOperation returns the operation of the method 'method' of the
+// endpoint of 'reg' in the API document
+func (s *Server) openAPIOperation(schemas *openapi.Schemas, messages *openapi.Schema, reg endpointRegistration,
+	ed endpointDoc, method string) *openapi.Operation {
+	od := ed.docs[method]
+	op := &openapi.Operation{
+		Tags:        []string{strings.Split(reg.path, "/")[0]},
+		Summary:     od.summary,
+		OperationID: operationID(method, reg),
+		Responses:   map[string]*openapi.Response{"default": {Ref: "#/components/responses/Error"}},
+	}
+	if successor := s.successors[reg.path]; successor != "" && reg.version == metadata.APIVersion {
+		op.Deprecated = true
+		op.Description = "Superseded by " + apiVersionPrefix(successor) + reg.path + "."
+	}
+	for _, elem := range strings.Split(reg.path, "/") {
+		if strings.HasPrefix(elem, "{") && strings.HasSuffix(elem, "}") {
+			op.Parameters = append(op.Parameters, &openapi.Parameter{
+				Name:     strings.Trim(elem, "{}"),
+				In:       "path",
+				Required: true,
+				Schema:   &openapi.Schema{Type: "string"},
+			})
+		}
+	}
+	op.Parameters = append(op.Parameters, &openapi.Parameter{Ref: "#/components/parameters/ca"})
+	names := make([]string, 0, len(od.query))
+	for name := range od.query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		op.Parameters = append(op.Parameters, &openapi.Parameter{
+			Name:        name,
+			In:          "query",
+			Description: od.query[name],
+			Schema:      &openapi.Schema{Type: "string"},
+		})
+	}
+	if od.request != nil {
+		op.RequestBody = &openapi.RequestBody{Content: jsonContent(schemas.For(od.request))}
+	}
+	success := &openapi.Response{Description: "Success"}
+	switch {
+	case method == "HEAD":
+	case od.contentType != "":
+		success.Content = map[string]openapi.MediaType{od.contentType: {Schema: &openapi.Schema{Type: "string", Format: "binary"}}}
+	default:
+		success.Content = jsonContent(responseSchema(schemas.For(od.response), messages))
+		for _, enc := range ed.encodings {
+			success.Content[enc.mediaType] = openapi.MediaType{Schema: &openapi.Schema{Type: "string", Format: "binary"}}
+		}
+	}
+	op.Responses[strconv.Itoa(ed.successRC)] = success
+	switch ed.auth {
+	case authBasic:
+		op.Security = []openapi.SecurityRequirement{{"basicAuth": {}}}
+	case authToken:
+		op.Security = []openapi.SecurityRequirement{{"tokenAuth": {}}}
+	case authBasicOrToken:
+		op.Security = []openapi.SecurityRequirement{{"basicAuth": {}}, {"tokenAuth": {}}}
+	case authAdmin:
+		op.Security = []openapi.SecurityRequirement{{"tokenAuth": {}}}
+		op.Description = strings.TrimSpace(op.Description + " The invoker must have the hf.Admin attribute " +
+			"unless the endpoint is served by the admin listener.")
+	}
+	if ed.auth != authNone {
+		op.Responses["401"] = &openapi.Response{Ref: "#/components/responses/Unauthorized"}
+	}
+	return op
+}
+
+// responseSchema returns the schema of a response whose result has the
+// schema 'result' and whose errors and messages have the schema 'messages'
+func responseSchema(result, messages *openapi.Schema) *openapi.Schema {
+	return &openapi.Schema{
+		Type: "object",
+		Properties: map[string]*openapi.Schema{
+			"success":  {Type: "boolean"},
+			"result":   result,
+			"errors":   messages,
+			"messages": messages,
+		},
+		Required: []string{"success", "result", "errors", "messages"},
+	}
+}
+
+// jsonContent returns the JSON content of the schema 'schema'
+func jsonContent(schema *openapi.Schema) map[string]openapi.MediaType {
+	return map[string]openapi.MediaType{"application/json": {Schema: schema}}
+}
+
+// operationID returns the ID of the operation of the method 'method' of the
+// endpoint of 'reg', such as postV1IdemixCredential
+func operationID(method string, reg endpointRegistration) string {
+	id := strings.ToLower(method) + strings.Title(reg.version)
+	for _, elem := range strings.Split(reg.path, "/") {
+		id += strings.Title(strings.Trim(elem, "{}"))
+	}
+	return id
+}
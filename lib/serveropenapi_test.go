@@ -0,0 +1,156 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/lib/openapi"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenAPIDocumentIsCurrent(t *testing.T) {
+	doc, err := OpenAPIDocument()
+	util.FatalError(t, err, "Failed to generate the API document")
+	committed, err := ioutil.ReadFile("../swagger/openapi.json")
+	util.FatalError(t, err, "Failed to read the committed API document")
+	assert.True(t, bytes.Equal(committed, doc),
+		"swagger/openapi.json does not match the endpoints of the server; run 'go generate ./lib' and commit the result")
+}
+
+func TestOpenAPIDocumentDescribesEndpoints(t *testing.T) {
+	s := &Server{Config: &ServerConfig{}}
+	s.registerHandlers()
+	doc := s.openAPIDocument()
+	for _, reg := range s.registrations {
+		de, ok := reg.handler.(documentedEndpoint)
+		if !assert.True(t, ok, "The endpoint %s should describe itself", reg.path) {
+			continue
+		}
+		path := apiVersionPrefix(reg.version) + reg.path
+		item := doc.Paths[path]
+		if !assert.NotNil(t, item, "The document should have %s", path) {
+			continue
+		}
+		for _, method := range de.apiDoc().methods {
+			op := (*item)[strings.ToLower(method)]
+			if assert.NotNil(t, op, "The document should have %s %s", method, path) {
+				assert.NotEmpty(t, op.Summary, "%s %s should have a summary", method, path)
+			}
+		}
+	}
+	enroll := (*doc.Paths["/api/v1/enroll"])["post"]
+	assert.True(t, enroll.Deprecated, "The v1 enroll endpoint is superseded by the v2 one")
+	assert.Equal(t, []openapi.SecurityRequirement{{"basicAuth": {}}}, enroll.Security)
+	assert.False(t, (*doc.Paths["/api/v2/enroll"])["post"].Deprecated)
+	assert.Empty(t, (*doc.Paths["/api/v1/cainfo"])["get"].Security, "The CA information requires no authentication")
+	for _, name := range []string{"ErrorResponse", "ResponseMessage", "EnrollmentRequestNet", "EnrollmentResponseNetV2"} {
+		assert.Contains(t, doc.Components.Schemas, name)
+	}
+
+	// The endpoints of an admin listener are not served on the server's port
+	s = &Server{Config: &ServerConfig{Admin: AdminConfig{ListenAddress: "unix://admin.sock"}}}
+	s.registerHandlers()
+	doc = s.openAPIDocument()
+	assert.NotContains(t, doc.Paths, "/api/v1/selftest")
+	assert.Contains(t, doc.Paths, "/api/v1/register")
+}
+
+func TestOpenAPIAuthPolicy(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+
+	// Each operation which declares that it authenticates the invoker
+	// refuses an unauthenticated request
+	client := newAdminTestClient("")
+	url := fmt.Sprintf("http://localhost:%d", rootPort)
+	for _, reg := range srv.registrations {
+		ed := reg.handler.(documentedEndpoint).apiDoc()
+		if ed.auth == authNone {
+			continue
+		}
+		path := strings.NewReplacer("{id}", "admin", "{affiliation}", "org1").Replace(apiVersionPrefix(reg.version) + reg.path)
+		for _, method := range ed.methods {
+			if ed.docs[method].summary == "Not implemented" {
+				continue
+			}
+			req, err := http.NewRequest(method, url+path, strings.NewReader("{}"))
+			util.FatalError(t, err, "Failed to create request")
+			resp, err := client.Do(req)
+			util.FatalError(t, err, "Failed to send request")
+			resp.Body.Close()
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "An unauthenticated %s %s should be refused", method, path)
+		}
+	}
+
+	status, body := adminRequest(t, client, "GET", url+"/openapi.json", nil, "")
+	if assert.Equal(t, http.StatusOK, status, "The API document should be served") {
+		var doc openapi.Document
+		err = json.Unmarshal(body, &doc)
+		util.FatalError(t, err, "Failed to decode the API document")
+		assert.Equal(t, openapi.Version, doc.OpenAPI)
+		assert.Contains(t, doc.Paths, "/api/v2/enroll")
+	}
+}
+
+func TestOpenAPISwaggerUI(t *testing.T) {
+	srv := TestGetRootServer(t)
+	srv.Config.BasePath = "/ca"
+	srv.Config.Admin.ListenAddress = "127.0.0.1:0"
+	srv.Config.Admin.Secret = "adminsecret"
+	srv.Config.Admin.SwaggerUI = "https://example.com/swagger-ui/"
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+
+	client := newAdminTestClient("")
+	status, body := adminRequest(t, client, "GET", fmt.Sprintf("http://localhost:%d/ca/openapi.json", rootPort), nil, "")
+	if assert.Equal(t, http.StatusOK, status, "The API document should be served under the base path") {
+		var doc openapi.Document
+		err = json.Unmarshal(body, &doc)
+		util.FatalError(t, err, "Failed to decode the API document")
+		assert.Equal(t, "/ca", doc.Servers[0].URL, "The document should be relative to the base path")
+		assert.NotContains(t, doc.Paths, "/api/v1/selftest", "The endpoints of the admin listener are not served on the server's port")
+	}
+	adminURL := "http://" + srv.ListenAddresses().Admin
+	status, body = adminRequest(t, client, "GET", adminURL+"/swagger/", nil, "adminsecret")
+	if assert.Equal(t, http.StatusOK, status, "The Swagger UI should be served by the admin listener") {
+		assert.Contains(t, string(body), `src="https://example.com/swagger-ui/swagger-ui-bundle.js"`)
+		assert.Contains(t, string(body), `"../openapi.json"`)
+	}
+	status, _ = adminRequest(t, client, "GET", adminURL+"/openapi.json", nil, "adminsecret")
+	assert.Equal(t, http.StatusOK, status, "The API document should be served by the admin listener")
+	status, _ = adminRequest(t, client, "GET", adminURL+"/swagger/", nil, "")
+	assert.Equal(t, http.StatusUnauthorized, status, "The Swagger UI should require the admin secret")
+	status, _ = adminRequest(t, client, "GET", fmt.Sprintf("http://localhost:%d/ca/swagger/", rootPort), nil, "")
+	assert.Equal(t, http.StatusNotFound, status, "The Swagger UI should not be served on the server's port")
+
+	for _, ui := range []string{"ftp://example.com/ui", "swagger-ui"} {
+		err = checkAdminConfig(&ServerConfig{Admin: AdminConfig{ListenAddress: "unix://admin.sock", SwaggerUI: ui}})
+		util.ErrorContains(t, err, "admin.swaggerui", "The Swagger UI URL '%s' should be invalid", ui)
+	}
+	err = checkAdminConfig(&ServerConfig{Admin: AdminConfig{SwaggerUI: "https://example.com/ui"}})
+	util.ErrorContains(t, err, "admin.listenaddress", "The Swagger UI requires an admin listener")
+}
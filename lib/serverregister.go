@@ -17,16 +17,22 @@ import (
 	"github.com/hyperledger/fabric-ca/api"
 	"github.com/hyperledger/fabric-ca/lib/attr"
 	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/lib/logging"
 	"github.com/hyperledger/fabric-ca/lib/spi"
 	"github.com/hyperledger/fabric-ca/util"
 )
 
 func newRegisterEndpoint(s *Server) *serverEndpoint {
 	return &serverEndpoint{
-		Methods:   []string{"POST"},
-		Handler:   registerHandler,
-		Server:    s,
-		successRC: 201,
+		Methods:    []string{"POST"},
+		Handler:    registerHandler,
+		Server:     s,
+		successRC:  201,
+		auth:       authToken,
+		idempotent: true,
+		docs: map[string]operationDoc{
+			"POST": {summary: "Register a new identity", request: &api.RegistrationRequestNet{}, response: &api.RegistrationResponseNet{}},
+		},
 	}
 }
 
@@ -86,13 +92,27 @@ func registerUser(req *api.RegistrationRequest, registrar string, ca *CA, ctx Se
 		return "", err
 	}
 
-	secret, err := registerUserID(req, ca)
+	secret, err := registerUserID(req, ca, requestCAConfig(ctx, ca).maxEnrollments)
 
 	if err != nil {
 		return "", errors.WithMessage(err, fmt.Sprintf("Registration of '%s' failed", req.Name))
 	}
+	// The registration is audited once it is committed
+	logging.Audit(log.LevelInfo, auditIdentityRegistered, fmt.Sprintf("Registered identity '%s' by '%s'", req.Name, registrar), logging.Fields{
+		"identity":    registrar,
+		"registered":  req.Name,
+		"type":        req.Type,
+		"affiliation": req.Affiliation,
+		"ca":          ca.Config.CA.Name,
+	})
+	ca.server.publishEvent(EventIdentityRegistered, ca.Config.CA.Name, &IdentityEventData{
+		ID:          req.Name,
+		Type:        req.Type,
+		Affiliation: req.Affiliation,
+		Invoker:     registrar,
+	})
 	// Set the location header to the URI of the identity that was created by the registration request
-	ctx.GetResp().Header().Set("Location", fmt.Sprintf("%sidentities/%s", apiPathPrefix, url.PathEscape(req.Name)))
+	ctx.GetResp().Header().Set("Location", fmt.Sprintf("%s%sidentities/%s", ca.server.basePath(), apiPathPrefix, url.PathEscape(req.Name)))
 	return secret, nil
 }
 
@@ -111,29 +131,16 @@ func normalizeRegistrationRequest(req *api.RegistrationRequest, registrar spi.Us
 	}
 }
 
-func validateAffiliation(req *api.RegistrationRequest, ca *CA, ctx ServerRequestContext) error {
-	affiliation := req.Affiliation
-	log.Debugf("Validating affiliation: %s", affiliation)
-	err := ctx.ContainsAffiliation(affiliation)
-	if err != nil {
-		return err
-	}
-
-	// If requested affiliation is for root then don't need to do lookup in affiliation's table
-	if affiliation == "" {
-		return nil
-	}
-
-	_, err = ca.registry.GetAffiliation(affiliation)
-	if err != nil {
-		return errors.WithMessage(err, fmt.Sprintf("Failed getting affiliation '%s'", affiliation))
-	}
-
-	return nil
+// validateAffiliation checks that the caller may register an identity of the
+// affiliation of 'req'; that the affiliation exists is checked when the
+// identity is registered
+func validateAffiliation(req *api.RegistrationRequest, ctx ServerRequestContext) error {
+	log.Debugf("Validating affiliation: %s", req.Affiliation)
+	return ctx.ContainsAffiliation(req.Affiliation)
 }
 
 // registerUserID registers a new user and its enrollmentID, role and state
-func registerUserID(req *api.RegistrationRequest, ca *CA) (string, error) {
+func registerUserID(req *api.RegistrationRequest, ca *CA, caMaxEnrollments int) (string, error) {
 	log.Debugf("Registering user id: %s\n", req.Name)
 	var err error
 
@@ -141,9 +148,9 @@ func registerUserID(req *api.RegistrationRequest, ca *CA) (string, error) {
 		req.Secret = util.RandomString(12)
 	}
 
-	req.MaxEnrollments, err = getMaxEnrollments(req.MaxEnrollments, ca.Config.Registry.MaxEnrollments)
+	req.MaxEnrollments, err = getMaxEnrollments(req.MaxEnrollments, caMaxEnrollments)
 	if err != nil {
-		return "", err
+		return "", caerrors.NewValidationErr(caerrors.ErrAddIdentity, "%s", err)
 	}
 
 	// Add attributes containing the enrollment ID, type, and affiliation if not
@@ -162,15 +169,11 @@ func registerUserID(req *api.RegistrationRequest, ca *CA) (string, error) {
 		Level:          ca.server.levels.Identity,
 	}
 
-	registry := ca.registry
-
-	_, err = registry.GetUser(req.Name, nil)
-	if err == nil {
-		return "", errors.Errorf("Identity '%s' is already registered", req.Name)
-	}
-
-	err = registry.InsertUser(&insert)
+	_, err = ca.registerUsers(&registration{users: []*spi.UserInfo{&insert}, checkAffiliations: true})
 	if err != nil {
+		if caerrors.AsHTTPErr(err) == nil {
+			return "", caerrors.NewInternalErr(caerrors.ErrAddIdentity, err, "Failed to insert identity '%s'", req.Name)
+		}
 		return "", err
 	}
 
@@ -185,9 +188,9 @@ func canRegister(registrar spi.User, req *api.RegistrationRequest, ca *CA, ctx S
 		return err
 	}
 	// Check that the affiliation requested is of the appropriate level
-	err = validateAffiliation(req, ca, ctx)
+	err = validateAffiliation(req, ctx)
 	if err != nil {
-		return fmt.Errorf("Registration of '%s' failed in affiliation validation: %s", req.Name, err)
+		return errors.WithMessage(err, fmt.Sprintf("Registration of '%s' failed in affiliation validation", req.Name))
 	}
 
 	err = attr.CanRegisterRequestedAttributes(req.Attributes, nil, registrar)
@@ -202,3 +205,127 @@ func canRegister(registrar spi.User, req *api.RegistrationRequest, ca *CA, ctx S
 func addAttributeToRequest(name, value string, attributes *[]api.Attribute) {
 	*attributes = append(*attributes, api.Attribute{Name: name, Value: value, ECert: true})
 }
+
+// The steps of the registration of an identity, after each of which a
+// registration may fail
+const (
+	// Its affiliation is checked
+	regStepAffiliation = "affiliation"
+	// It is checked that it is not already registered
+	regStepRegistered = "registered"
+	// Its secret is hashed
+	regStepSecret = "secret"
+	// It is inserted
+	regStepInsert = "insert"
+)
+
+// registration is the registration of identities as a unit: either all of
+// them are registered or none is
+type registration struct {
+	// The identities to register
+	users []*spi.UserInfo
+	// True if the identities which are already registered are skipped rather
+	// than failing the registration
+	skipRegistered bool
+	// True if the affiliation of each identity must exist
+	checkAffiliations bool
+	// Called after each step; the registration fails if it returns an error
+	fault func(step string) error
+}
+
+// step is called after the step 'step' of the registration of an identity
+func (reg *registration) step(step string) error {
+	if reg.fault == nil {
+		return nil
+	}
+	return reg.fault(step)
+}
+
+// transactionalRegistry is a user registry which registers identities in a
+// single transaction
+type transactionalRegistry interface {
+	// register registers the identities of 'reg' and returns those which
+	// were registered
+	register(reg *registration) ([]*spi.UserInfo, error)
+}
+
+// registerUsers registers the identities of 'reg' in the CA's registry and
+// returns those which were registered. If the registry has no transactions,
+// as LDAP, the identities which were registered are deleted if the
+// registration fails.
+func (ca *CA) registerUsers(reg *registration) ([]*spi.UserInfo, error) {
+	if reg.fault == nil {
+		reg.fault = ca.registrationFault
+	}
+	if r, ok := ca.registry.(transactionalRegistry); ok {
+		return r.register(reg)
+	}
+	return registerCompensated(ca.registry, reg)
+}
+
+// registerCompensated registers the identities of 'reg' one after the other
+// in 'registry', deleting those which were registered if one of them fails
+func registerCompensated(registry spi.UserRegistry, reg *registration) (registered []*spi.UserInfo, err error) {
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, user := range registered {
+			_, err2 := registry.DeleteUser(user.Name)
+			if err2 != nil {
+				log.Errorf("Failed to delete identity '%s' after the registration failed: %s", user.Name, err2)
+			}
+		}
+		registered = nil
+	}()
+	for _, user := range reg.users {
+		if reg.checkAffiliations && user.Affiliation != "" {
+			_, err = registry.GetAffiliation(user.Affiliation)
+			if caerrors.Is(err, caerrors.ClassNotFound) {
+				return registered, affiliationNotFoundErr(user.Affiliation)
+			}
+			if err != nil {
+				return registered, errors.WithMessage(err, fmt.Sprintf("Failed getting affiliation '%s'", user.Affiliation))
+			}
+		}
+		if err = reg.step(regStepAffiliation); err != nil {
+			return registered, err
+		}
+		_, err = registry.GetUser(user.Name, nil)
+		if caerrors.Is(err, caerrors.ClassBackendUnavailable) {
+			return registered, err
+		}
+		if err == nil {
+			if reg.skipRegistered {
+				log.Debugf("Identity '%s' already registered, loaded identity", user.Name)
+				continue
+			}
+			return registered, identityExistsErr(user.Name)
+		}
+		if err = reg.step(regStepRegistered); err != nil {
+			return registered, err
+		}
+		// The registry hashes the secret as it inserts the identity
+		err = registry.InsertUser(user)
+		if err != nil {
+			return registered, caerrors.NewInternalErr(caerrors.ErrAddIdentity, err, "Failed to insert identity '%s'", user.Name)
+		}
+		registered = append(registered, user)
+		if err = reg.step(regStepInsert); err != nil {
+			return registered, err
+		}
+	}
+	return registered, nil
+}
+
+// identityExistsErr returns the error of the registration of the identity
+// 'name' which is already registered
+func identityExistsErr(name string) error {
+	return caerrors.NewConflictErr(caerrors.ErrIdentityExists, "Identity '%s' is already registered", name)
+}
+
+// affiliationNotFoundErr returns the error of the registration of an
+// identity whose affiliation 'affiliation' does not exist
+func affiliationNotFoundErr(affiliation string) error {
+	return caerrors.NewValidationErr(caerrors.ErrGettingAffiliation, "Affiliation '%s' does not exist", affiliation)
+}
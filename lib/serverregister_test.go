@@ -14,7 +14,9 @@ import (
 	"github.com/hyperledger/fabric-ca/lib/attr"
 	"github.com/hyperledger/fabric-ca/lib/caerrors"
 	"github.com/hyperledger/fabric-ca/lib/mocks"
+	"github.com/hyperledger/fabric-ca/lib/spi"
 	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -536,3 +538,114 @@ func TestRegisterWithLDAP(t *testing.T) {
 	_, err := register(ctxMock, &CA{})
 	util.ErrorContains(t, err, "72", "Failed to get back write error for registering identities with LDAP")
 }
+
+// nonTransactionalRegistry is a user registry without transactions, as an
+// LDAP registry
+type nonTransactionalRegistry struct {
+	spi.UserRegistry
+}
+
+// TestRegistrationFaults fails registrations after each of their steps and
+// checks that none of the identities they register is left in the registry
+func TestRegistrationFaults(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	client := TestGetRootClient()
+	eresp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin'")
+	admin := eresp.Identity
+	ca := &srv.CA
+	defer func() { ca.registrationFault = nil }()
+	txRegistry := ca.registry
+
+	// failAfter returns a fault which fails a registration after the step
+	// 'step' of its 'n'th identity
+	failAfter := func(step string, n int) func(string) error {
+		return func(s string) error {
+			if s != step {
+				return nil
+			}
+			if n--; n > 0 {
+				return nil
+			}
+			return errors.Errorf("Fault injected after step '%s'", step)
+		}
+	}
+	// requireUnregistered checks that none of 'names' is registered
+	requireUnregistered := func(names ...string) {
+		for _, name := range names {
+			_, err := txRegistry.GetUser(name, nil)
+			assert.Error(t, err, "Identity '%s' should not be registered", name)
+		}
+	}
+	users := func(names ...string) []*spi.UserInfo {
+		users := []*spi.UserInfo{}
+		for _, name := range names {
+			users = append(users, &spi.UserInfo{Name: name, Pass: "secret", Type: "client", Affiliation: "org1", MaxEnrollments: -1, Level: ca.levels.Identity})
+		}
+		return users
+	}
+
+	for _, registry := range []spi.UserRegistry{txRegistry, &nonTransactionalRegistry{txRegistry}} {
+		ca.registry = registry
+		steps := []string{regStepAffiliation, regStepRegistered, regStepInsert}
+		if _, ok := registry.(transactionalRegistry); ok {
+			steps = append(steps, regStepSecret)
+		}
+		for _, step := range steps {
+			// A registration request
+			ca.registrationFault = failAfter(step, 1)
+			_, err = admin.Register(&api.RegistrationRequest{Name: "faultuser", Affiliation: "org1"})
+			assert.Error(t, err, "Registration should fail after step '%s'", step)
+			requireUnregistered("faultuser")
+
+			// A registration of several identities which fails at the
+			// second one
+			ca.registrationFault = failAfter(step, 2)
+			_, err = ca.registerUsers(&registration{users: users("bulk1", "bulk2", "bulk3"), checkAffiliations: true})
+			assert.Error(t, err, "Bulk registration should fail after step '%s'", step)
+			requireUnregistered("bulk1", "bulk2", "bulk3")
+		}
+		ca.registrationFault = nil
+
+		// A registration fails as a whole if one identity is registered
+		_, err = ca.registerUsers(&registration{users: users("bulk1", "admin")})
+		if assert.Error(t, err) {
+			assert.True(t, caerrors.Is(err, caerrors.ClassAlreadyExists), "%s", err)
+		}
+		requireUnregistered("bulk1")
+		// or its affiliation does not exist
+		unaffiliated := users("bulk1", "bulk2")
+		unaffiliated[1].Affiliation = "nonexistent"
+		_, err = ca.registerUsers(&registration{users: unaffiliated, checkAffiliations: true})
+		if assert.Error(t, err) {
+			assert.True(t, caerrors.Is(err, caerrors.ClassValidation), "%s", err)
+		}
+		requireUnregistered("bulk1", "bulk2")
+	}
+	ca.registry = txRegistry
+
+	// The identities which are registered are skipped by a bulk import, and
+	// the others are registered
+	registered, err := ca.registerUsers(&registration{users: users("admin", "bulk1"), skipRegistered: true})
+	util.FatalError(t, err, "Failed to import identities")
+	if assert.Len(t, registered, 1) {
+		assert.Equal(t, "bulk1", registered[0].Name)
+	}
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "bulk1", Secret: "secret"})
+	assert.NoError(t, err, "Failed to enroll an imported identity")
+
+	// A registration which succeeds after one which failed
+	resp, err := admin.Register(&api.RegistrationRequest{Name: "faultuser", Affiliation: "org1"})
+	util.FatalError(t, err, "Failed to register 'faultuser'")
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "faultuser", Secret: resp.Secret})
+	assert.NoError(t, err, "Failed to enroll 'faultuser'")
+	_, err = admin.Register(&api.RegistrationRequest{Name: "faultuser", Affiliation: "org1"})
+	util.ErrorContains(t, err, "already registered", "A second registration of 'faultuser' should fail")
+}
@@ -0,0 +1,308 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/cfssl/signer"
+	"github.com/hyperledger/fabric-ca/lib/logging"
+	"github.com/hyperledger/fabric-ca/lib/vault"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// serverEnvVarPrefix is the prefix of the environment variables which
+// override the settings of the server's configuration file
+const serverEnvVarPrefix = "FABRIC_CA_SERVER"
+
+// reloadedCA is the reloaded configuration of a CA which has been validated
+// and is ready to be put into service
+type reloadedCA struct {
+	ca     *CA
+	config *CAConfig
+	signer signer.Signer
+}
+
+// reloadConfig re-reads the server's configuration file and puts into service
+// the settings which can be changed while the server is running: the signing
+// profiles, the maximum number of enrollments, the CRL expiry, the retention
+// of idempotency keys, the options allowing removal of identities and
+// affiliations, the CRL size limit, the shutdown timeout and the logging
+// configuration. Changes to any other setting
+// are logged and take effect only when the server is restarted. If the file
+// is not valid, an error is returned and the current configuration is kept.
+// Requests in progress complete with the configuration they were received
+// with. The settings which are set by command line flags keep the values of
+// their flags.
+func (s *Server) reloadConfig() error {
+	file := s.CA.ConfigFilePath
+	if file == "" {
+		log.Info("The server was not started with a configuration file; there is no configuration to reload")
+		return nil
+	}
+	log.Infof("Reloading configuration from %s", file)
+
+	cfg, err := readServerConfig(file, s.FlagOverrides)
+	if err != nil {
+		return err
+	}
+	env, err := GetEnvOverrides(os.Environ())
+	if err != nil {
+		return err
+	}
+	prov, err := NewConfigProvenance(file, env, s.FlagOverrides.isSet)
+	if err != nil {
+		return err
+	}
+	err = logging.Validate(&cfg.Log)
+	if err != nil {
+		return err
+	}
+	s.checkRestartOnlyChanges(cfg)
+
+	// Read the configuration files of the non-default CAs before the default
+	// CA's configuration is initialized, as is done when the server starts
+	caNames := []string{}
+	caConfigs := map[string]*CAConfig{}
+	for name, ca := range s.caMap {
+		if ca == &s.CA {
+			continue
+		}
+		caCfg, err := readCAConfig(ca.ConfigFilePath, &cfg.CAcfg)
+		if err != nil {
+			return err
+		}
+		caNames = append(caNames, name)
+		caConfigs[name] = caCfg
+	}
+	sort.Strings(caNames)
+
+	reloaded := []*reloadedCA{}
+	r, err := s.reloadCA(&s.CA, &cfg.CAcfg)
+	if err != nil {
+		return err
+	}
+	reloaded = append(reloaded, r)
+	for _, name := range caNames {
+		r, err := s.reloadCA(s.caMap[name], caConfigs[name])
+		if err != nil {
+			return err
+		}
+		reloaded = append(reloaded, r)
+	}
+
+	err = logging.Configure(&cfg.Log, s.HomeDir)
+	if err != nil {
+		return err
+	}
+	if cfg.Debug {
+		logging.SetLevel(log.LevelDebug)
+	}
+
+	// Requests received from now on use the reloaded configuration
+	snap := &configSnapshot{
+		crlSizeLimit:    cfg.CRLSizeLimit,
+		shutdownTimeout: cfg.ShutdownTimeout,
+		cas:             map[*CA]*caConfigSnapshot{},
+	}
+	for _, r := range reloaded {
+		snap.cas[r.ca] = newCAConfigSnapshot(r.config, r.signer)
+	}
+	s.configMutex.Lock()
+	defer s.configMutex.Unlock()
+	s.publishConfig(snap)
+	if s.ConfigProvenance != nil {
+		s.ConfigProvenance = s.ConfigProvenance.withReloaded(prov)
+	}
+	s.Config.Debug = cfg.Debug
+	s.Config.Log = cfg.Log
+	s.Config.CRLSizeLimit = cfg.CRLSizeLimit
+	s.Config.ShutdownTimeout = cfg.ShutdownTimeout
+	for _, r := range reloaded {
+		c := r.ca.Config
+		c.Cfg = r.config.Cfg
+		c.Signing = r.config.Signing
+		c.Registry.MaxEnrollments = r.config.Registry.MaxEnrollments
+		c.CRL = r.config.CRL
+		c.Idempotency = r.config.Idempotency
+	}
+	log.Info("Successfully reloaded configuration")
+	return nil
+}
+
+// readServerConfig reads the server configuration from 'file', applying the
+// default values of settings which are not in the file, the environment
+// variables which override them and the command line flags in 'flags'
+func readServerConfig(file string, flags FlagOverrides) (*ServerConfig, error) {
+	envOverrides, err := GetEnvOverrides(os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	cfg := &ServerConfig{}
+	vp := viper.New()
+	vp.SetEnvPrefix(serverEnvVarPrefix)
+	vp.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	vp.AutomaticEnv()
+	setConfigDefaults(vp, cfg)
+	setConfigDefaults(vp, &cfg.CAcfg)
+	err = UnmarshalConfig(cfg, vp, file, true)
+	if err != nil {
+		return nil, err
+	}
+	err = envOverrides.Apply(cfg, flags.isSet)
+	if err != nil {
+		return nil, err
+	}
+	err = flags.Apply(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// setConfigDefaults sets the value of the "def" tag of each field of 'cfg'
+// as the default value of the corresponding viper key
+func setConfigDefaults(vp *viper.Viper, cfg interface{}) {
+	util.ParseObj(cfg, func(f *util.Field) error {
+		def := f.Tag.Get(util.TagDefault)
+		if f.Leaf && def != "" && f.Tag.Get(util.TagSkip) == "" {
+			vp.SetDefault(f.Path, def)
+		}
+		return nil
+	}, nil)
+}
+
+// checkRestartOnlyChanges logs the server settings in 'cfg' which differ from
+// the current configuration but cannot be changed without a restart
+func (s *Server) checkRestartOnlyChanges(cfg *ServerConfig) {
+	cur := s.Config
+	if cfg.Address == "" {
+		cfg.Address = DefaultServerAddr
+	}
+	if cfg.TLS.Enabled && cfg.TLS.ClientAuth.Type == "" {
+		cfg.TLS.ClientAuth.Type = defaultClientAuth
+	}
+	err := absTLSServer(&cfg.TLS, s.HomeDir)
+	if err != nil {
+		log.Debugf("Failed to make TLS filenames absolute: %s", err)
+	}
+	caFiles, err := util.NormalizeFileList(cfg.CAfiles, s.HomeDir)
+	if err == nil {
+		cfg.CAfiles = caFiles
+	}
+
+	var skipped []string
+	skip := func(name string, current, reloaded interface{}) {
+		if !reflect.DeepEqual(current, reloaded) {
+			skipped = append(skipped, name)
+		}
+	}
+	skipList := func(name string, current, reloaded []string) {
+		if len(current) > 0 || len(reloaded) > 0 {
+			skip(name, current, reloaded)
+		}
+	}
+	skip("address", cur.Address, cfg.Address)
+	skip("port", cur.Port, cfg.Port)
+	skipList("listeners.addresses", cur.Listeners.Addresses, cfg.Listeners.Addresses)
+	skip("listeners.socketmode", cur.Listeners.SocketMode, cfg.Listeners.SocketMode)
+	skip("tls.enabled", cur.TLS.Enabled, cfg.TLS.Enabled)
+	if cur.TLS.Enabled && cfg.TLS.Enabled {
+		skip("tls.certfile", cur.TLS.CertFile, cfg.TLS.CertFile)
+		skip("tls.keyfile", cur.TLS.KeyFile, cfg.TLS.KeyFile)
+		skip("tls.clientauth.type", strings.ToLower(cur.TLS.ClientAuth.Type), strings.ToLower(cfg.TLS.ClientAuth.Type))
+		skipList("tls.clientauth.certfiles", cur.TLS.ClientAuth.CertFiles, cfg.TLS.ClientAuth.CertFiles)
+	}
+	skip("cacount", cur.CAcount, cfg.CAcount)
+	// The configuration files of the CAs created for 'cacount' are added to 'cafiles'
+	if cur.CAcount == 0 {
+		skipList("cafiles", cur.CAfiles, cfg.CAfiles)
+	}
+	skip("operations.listenaddress", cur.Operations.ListenAddress, cfg.Operations.ListenAddress)
+	skip("profiling", cur.Profiling, cfg.Profiling)
+	skip("admin", cur.Admin, cfg.Admin)
+	skip("grpc.listenaddress", cur.GRPC.ListenAddress, cfg.GRPC.ListenAddress)
+	skip("http", cur.HTTP, cfg.HTTP)
+	skip("concurrency", cur.Concurrency, cfg.Concurrency)
+	skip("cors", cur.CORS, cfg.CORS)
+	skip("vault", cur.Vault, cfg.Vault)
+	logSkipped("the server", skipped)
+}
+
+// reloadCA validates the reloaded configuration 'cfg' of 'ca' and creates the
+// enrollment signer of its signing profiles, without changing the CA
+func (s *Server) reloadCA(ca *CA, cfg *CAConfig) (*reloadedCA, error) {
+	caName := ca.Config.CA.Name
+	tmp := &CA{HomeDir: ca.HomeDir, Config: cfg, server: s}
+	err := tmp.initConfig()
+	if err != nil {
+		return nil, errors.WithMessage(err, fmt.Sprintf("Invalid configuration of CA '%s'", caName))
+	}
+	err = tmp.makeFileNamesAbsolute()
+	if err != nil {
+		return nil, errors.WithMessage(err, fmt.Sprintf("Invalid configuration of CA '%s'", caName))
+	}
+	if cfg.Registry.MaxEnrollments < -1 {
+		return nil, errors.Errorf("Invalid configuration of CA '%s': registry.maxenrollments may not be less than -1, but was %d",
+			caName, cfg.Registry.MaxEnrollments)
+	}
+	if cfg.DB.Type == "" || cfg.DB.Type == defaultDatabaseType {
+		cfg.DB.Type = defaultDatabaseType
+		if cfg.DB.Datasource == "" {
+			cfg.DB.Datasource = "fabric-ca-server.db"
+		}
+		if !vault.IsRef(cfg.DB.Datasource) {
+			cfg.DB.Datasource, err = util.MakeFileAbs(cfg.DB.Datasource, ca.HomeDir)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	enrollSigner, err := ca.newEnrollmentSigner(cfg.Signing)
+	if err != nil {
+		return nil, errors.WithMessage(err, fmt.Sprintf("Invalid signing configuration of CA '%s'", caName))
+	}
+
+	cur := ca.Config
+	var skipped []string
+	skip := func(name string, current, reloaded interface{}) {
+		if !reflect.DeepEqual(current, reloaded) {
+			skipped = append(skipped, name)
+		}
+	}
+	skip("ca.name", cur.CA.Name, cfg.CA.Name)
+	skip("ca.certfile", cur.CA.Certfile, cfg.CA.Certfile)
+	skip("ca.keyfile", cur.CA.Keyfile, cfg.CA.Keyfile)
+	skip("ca.chainfile", cur.CA.Chainfile, cfg.CA.Chainfile)
+	skip("db.type", cur.DB.Type, cfg.DB.Type)
+	skip("db.datasource", cur.DB.Datasource, cfg.DB.Datasource)
+	skip("ldap.enabled", cur.LDAP.Enabled, cfg.LDAP.Enabled)
+	skip("ldap.url", cur.LDAP.URL, cfg.LDAP.URL)
+	skip("intermediate.parentserver.url", cur.Intermediate.ParentServer.URL, cfg.Intermediate.ParentServer.URL)
+	if cur.CSP != nil && cfg.CSP != nil {
+		skip("bccsp.default", cur.CSP.ProviderName, cfg.CSP.ProviderName)
+	}
+	logSkipped(fmt.Sprintf("CA '%s'", caName), skipped)
+
+	return &reloadedCA{ca: ca, config: cfg, signer: enrollSigner}, nil
+}
+
+// logSkipped logs the names of the changed settings of 'what' which are not
+// put into service until the server is restarted
+func logSkipped(what string, skipped []string) {
+	if len(skipped) > 0 {
+		log.Warningf("The following settings of %s were changed but require a restart to take effect: %s",
+			what, strings.Join(skipped, ", "))
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+const reloadConfigTemplate = `
+port: %d
+crlsizelimit: 1000
+registry:
+  maxenrollments: %d
+signing:
+  default:
+    usage:
+      - digital signature
+    expiry: 10h
+`
+
+func TestReloadConfig(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+
+	// Without a configuration file there is nothing to reload
+	err = srv.reloadConfig()
+	assert.NoError(t, err)
+
+	cfgFile := filepath.Join(rootDir, "reload.yaml")
+	srv.CA.ConfigFilePath = cfgFile
+	writeConfig := func(content string) {
+		err := ioutil.WriteFile(cfgFile, []byte(content), 0644)
+		util.FatalError(t, err, "Failed to write config file")
+	}
+
+	// The port can't be changed without a restart, but the rest is reloaded
+	writeConfig(fmt.Sprintf(reloadConfigTemplate, rootPort+1, 2))
+	err = srv.reloadConfig()
+	util.FatalError(t, err, "Failed to reload config")
+	assert.Equal(t, rootPort, srv.Config.Port)
+	assert.Equal(t, 1000, srv.Config.CRLSizeLimit)
+	assert.Equal(t, 2, srv.CA.Config.Registry.MaxEnrollments)
+	assert.Equal(t, 10*time.Hour, srv.CA.Config.Signing.Default.Expiry)
+
+	// Certificates are issued according to the reloaded signing profile
+	c := TestGetRootClient()
+	resp, err := c.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin' after reloading config")
+	cert := resp.Identity.GetECert().GetX509Cert()
+	assert.True(t, cert.NotAfter.Before(time.Now().Add(11*time.Hour)),
+		"Certificate should expire according to the reloaded signing profile")
+
+	// An invalid configuration leaves the current configuration in service
+	writeConfig(fmt.Sprintf(reloadConfigTemplate, rootPort, -5))
+	err = srv.reloadConfig()
+	util.ErrorContains(t, err, "maxenrollments", "Invalid maxenrollments should fail")
+	assert.Equal(t, 2, srv.CA.Config.Registry.MaxEnrollments)
+
+	writeConfig(fmt.Sprintf(reloadConfigTemplate, rootPort, 3) + "log:\n  level: verbose\n")
+	err = srv.reloadConfig()
+	util.ErrorContains(t, err, "Invalid log level", "Invalid log level should fail")
+	assert.Equal(t, 2, srv.CA.Config.Registry.MaxEnrollments)
+
+	writeConfig("signing: [")
+	err = srv.reloadConfig()
+	assert.Error(t, err, "Malformed config file should fail")
+	assert.Equal(t, 2, srv.CA.Config.Registry.MaxEnrollments)
+
+	// The settings which are set by command line flags keep their values
+	flagCfg := &ServerConfig{CRLSizeLimit: 500}
+	flagCfg.CAcfg.Registry.MaxEnrollments = 9
+	srv.FlagOverrides, err = GetFlagOverrides(flagCfg, func(path string) bool {
+		return path == "crlsizelimit" || path == "registry.maxenrollments"
+	})
+	util.FatalError(t, err, "Failed to get flag overrides")
+	writeConfig(fmt.Sprintf(reloadConfigTemplate, rootPort, 4) + "shutdowntimeout: 5s\n")
+	err = srv.reloadConfig()
+	util.FatalError(t, err, "Failed to reload config")
+	assert.Equal(t, 500, srv.Config.CRLSizeLimit, "A flag should override the reloaded config file")
+	assert.Equal(t, 9, srv.CA.Config.Registry.MaxEnrollments, "A flag should override the reloaded config file")
+	assert.Equal(t, 5*time.Second, srv.Config.ShutdownTimeout)
+}
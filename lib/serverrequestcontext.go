@@ -11,8 +11,8 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"runtime/debug"
 	"strconv"
 	"strings"
 
@@ -39,6 +39,7 @@ type ServerRequestContext interface {
 	BasicAuthentication() (string, error)
 	TokenAuthentication() (string, error)
 	GetCaller() (spi.User, error)
+	GetTLSPeerCertificate() *x509.Certificate
 	HasRole(role string) error
 	ChunksToDeliver(string) (int, error)
 	GetReq() *http.Request
@@ -63,11 +64,14 @@ type serverRequestContextImpl struct {
 	ui             spi.User
 	caller         spi.User
 	body           struct {
-		read bool   // true after body is read
-		buf  []byte // the body itself
-		err  error  // any error from reading the body
+		read   bool        // true after body is read
+		buf    []byte      // the body itself
+		err    error       // any error from reading the body
+		pooled *bodyBuffer // the pooled buffer of the body
 	}
 	callerRoles map[string]bool
+	// The configuration in service when the request was received
+	config *configSnapshot
 }
 
 const (
@@ -76,11 +80,14 @@ const (
 
 // newServerRequestContext is the constructor for a serverRequestContextImpl
 func newServerRequestContext(r *http.Request, w http.ResponseWriter, se *serverEndpoint) *serverRequestContextImpl {
-	return &serverRequestContextImpl{
+	ctx := &serverRequestContextImpl{
 		req:      r,
 		resp:     w,
 		endpoint: se,
 	}
+	// The request uses the configuration in service when it is received
+	ctx.config = ctx.server().configSnapshot()
+	return ctx
 }
 
 // BasicAuthentication authenticates the caller's username and password
@@ -97,19 +104,28 @@ func (ctx *serverRequestContextImpl) BasicAuthentication() (string, error) {
 	if !ok {
 		return "", caerrors.NewAuthenticationErr(caerrors.ErrNoUserPass, "No user/pass in authorization header")
 	}
+	return ctx.LoginUserBasicAuth(username, password)
+}
+
+// LoginUserBasicAuth authenticates the user 'username' by the enrollment
+// secret 'password', as the basic authorization header does.
+// Returns the enrollment ID or error.
+func (ctx *serverRequestContextImpl) LoginUserBasicAuth(username, password string) (string, error) {
 	// Get the CA that is targeted by this request
 	ca, err := ctx.GetCA()
 	if err != nil {
 		return "", err
 	}
 	// Error if max enrollments is disabled for this CA
-	log.Debugf("ca.Config: %+v", ca.Config)
-	caMaxEnrollments := ca.Config.Registry.MaxEnrollments
+	caMaxEnrollments := ctx.caConfig(ca).maxEnrollments
 	if caMaxEnrollments == 0 {
 		return "", caerrors.NewAuthenticationErr(caerrors.ErrEnrollDisabled, "Enroll is disabled")
 	}
 	// Get the user info object for this user
 	ctx.ui, err = ca.registry.GetUser(username, nil)
+	if caerrors.Is(err, caerrors.ClassBackendUnavailable) {
+		return "", err
+	}
 	if err != nil {
 		return "", caerrors.NewAuthenticationErr(caerrors.ErrInvalidUser, "Failed to get user: %s", err)
 	}
@@ -158,9 +174,9 @@ func (ctx *serverRequestContextImpl) verifyIdemixToken(authHdr string, body []by
 	log.Debug("Caller is using Idemix credential")
 	var err error
 
-	ctx.enrollmentID, err = ctx.ca.issuer.VerifyToken(authHdr, body)
+	ctx.enrollmentID, err = verifyIdemixSignature(ctx.ca.issuer, authHdr, body)
 	if err != nil {
-		return "", err
+		return "", caerrors.NewAuthenticationErr(caerrors.ErrInvalidToken, "Invalid Idemix token in authorization header: %s", err)
 	}
 
 	caller, err := ctx.GetCaller()
@@ -175,6 +191,19 @@ func (ctx *serverRequestContextImpl) verifyIdemixToken(authHdr string, body []by
 	return ctx.enrollmentID, nil
 }
 
+// verifyIdemixSignature verifies the Idemix token 'authHdr' over 'body' with
+// 'issuer' and returns the enrollment ID of the caller. The token is not
+// trusted, so a panic while it is verified fails the verification.
+func verifyIdemixSignature(issuer idemix.Issuer, authHdr string, body []byte) (id string, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Errorf("Panic while verifying an Idemix token: %v\n%s", p, debug.Stack())
+			id, err = "", errors.Errorf("Failed to verify the token: %v", p)
+		}
+	}()
+	return issuer.VerifyToken(authHdr, body)
+}
+
 func (ctx *serverRequestContextImpl) verifyX509Token(ca *CA, authHdr string, body []byte) (string, error) {
 	log.Debug("Caller is using a x509 certificate")
 	// Verify the token; the signature is over the header and body
@@ -182,8 +211,15 @@ func (ctx *serverRequestContextImpl) verifyX509Token(ca *CA, authHdr string, bod
 	if err2 != nil {
 		return "", caerrors.NewAuthenticationErr(caerrors.ErrInvalidToken, "Invalid token in authorization header: %s", err2)
 	}
+	return ctx.authenticateCertificate(ca, cert)
+}
+
+// authenticateCertificate authenticates the caller by the certificate 'cert',
+// which must be an unexpired and unrevoked certificate issued by 'ca'.
+// Returns the enrollment ID or error.
+func (ctx *serverRequestContextImpl) authenticateCertificate(ca *CA, cert *x509.Certificate) (string, error) {
 	// Make sure the caller's cert was issued by this CA
-	err2 = ca.VerifyCertificate(cert)
+	vc, err2 := ca.verifyCertificate(cert)
 	if err2 != nil {
 		return "", caerrors.NewAuthenticationErr(caerrors.ErrUntrustedCertificate, "Untrusted certificate: %s", err2)
 	}
@@ -200,19 +236,19 @@ func (ctx *serverRequestContextImpl) verifyX509Token(ca *CA, authHdr string, bod
 		return "", caerrors.NewAuthenticationErr(caerrors.ErrCertExpired,
 			"The certificate in the authorization header is a revoked or expired certificate")
 	}
-	aki := hex.EncodeToString(cert.AuthorityKeyId)
-	serial := util.GetSerialAsHex(cert.SerialNumber)
-	aki = strings.ToLower(strings.TrimLeft(aki, "0"))
-	serial = strings.ToLower(strings.TrimLeft(serial, "0"))
-	certs, err := ca.CertDBAccessor().GetCertificate(serial, aki)
+	aki, serial := vc.aki, vc.serial
+	statuses, err := ca.CertDBAccessor().getCertificateStatuses(serial, aki)
+	if caerrors.Is(err, caerrors.ClassBackendUnavailable) {
+		return "", err
+	}
 	if err != nil {
-		return "", caerrors.NewHTTPErr(500, caerrors.ErrCertNotFound, "Failed searching certificates: %s", err)
+		return "", caerrors.NewInternalErr(caerrors.ErrCertNotFound, err, "Failed searching certificates")
 	}
-	if len(certs) == 0 {
+	if len(statuses) == 0 {
 		return "", caerrors.NewAuthenticationErr(caerrors.ErrCertNotFound, "Certificate not found with AKI '%s' and serial '%s'", aki, serial)
 	}
-	for _, certificate := range certs {
-		if certificate.Status == "revoked" {
+	for _, status := range statuses {
+		if status == "revoked" {
 			return "", caerrors.NewAuthenticationErr(caerrors.ErrCertRevoked, "The certificate in the authorization header is a revoked certificate")
 		}
 	}
@@ -232,6 +268,17 @@ func (ctx *serverRequestContextImpl) GetECert() *x509.Certificate {
 	return ctx.enrollmentCert
 }
 
+// GetTLSPeerCertificate returns the client certificate which was presented
+// and verified during the TLS handshake, or nil if the request was not received
+// over TLS or no verified client certificate was presented
+func (ctx *serverRequestContextImpl) GetTLSPeerCertificate() *x509.Certificate {
+	state := ctx.req.TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
 // GetCA returns the CA to which this request is targeted and checks to make sure the database has been initialized
 func (ctx *serverRequestContextImpl) GetCA() (*CA, error) {
 	_, err := ctx.getCA()
@@ -359,8 +406,9 @@ func (ctx *serverRequestContextImpl) TryReadBody(body interface{}) (bool, error)
 	if !empty {
 		err = json.Unmarshal(buf, body)
 		if err != nil {
+			// The body is logged with the error, so it is redacted and bounded
 			return true, caerrors.NewHTTPErr(400, caerrors.ErrBadReqBody, "Invalid request body: %s; body=%s",
-				err, string(buf))
+				err, util.RedactBody(buf, util.BodyLogLimit()))
 		}
 	}
 	return empty, nil
@@ -370,18 +418,60 @@ func (ctx *serverRequestContextImpl) TryReadBody(body interface{}) (bool, error)
 func (ctx *serverRequestContextImpl) ReadBodyBytes() ([]byte, error) {
 	if !ctx.body.read {
 		r := ctx.req
-		buf, err := ioutil.ReadAll(r.Body)
-		ctx.body.buf = buf
+		// The body is read into a pooled buffer, which is returned to its
+		// pool by releaseBody once the request is handled
+		b, err := readBody(r.Body, r.ContentLength, ctx.maxBodySize())
+		if b != nil {
+			ctx.body.pooled = b
+			ctx.body.buf = b.buf
+		}
 		ctx.body.err = err
 		ctx.body.read = true
 	}
 	err := ctx.body.err
+	switch cause := errors.Cause(err).(type) {
+	case *errBodyTooLarge:
+		return nil, caerrors.NewHTTPErr(http.StatusRequestEntityTooLarge, caerrors.ErrReqBodyTooLarge, "Request body too large: %s", cause)
+	case *errBodyReadTimeout:
+		return nil, caerrors.NewHTTPErr(http.StatusRequestTimeout, caerrors.ErrReqBodyTimeout, "Request body too slow: %s", cause)
+	}
 	if err != nil {
 		return nil, caerrors.NewHTTPErr(400, caerrors.ErrReadingReqBody, "Failed reading request body: %s", err)
 	}
 	return ctx.body.buf, nil
 }
 
+// maxBodySize returns the maximum size of the request body, which is that
+// of its endpoint if the request was received through the middleware
+func (ctx *serverRequestContextImpl) maxBodySize() int64 {
+	if info := getRequestInfo(ctx.req); info != nil && info.maxBodySize > 0 {
+		return info.maxBodySize
+	}
+	return ctx.server().maxBodySize()
+}
+
+// releaseBody returns the buffer of the request body to its pool. It is
+// called once the request is handled, after which neither the body nor
+// anything which refers to it may be used.
+func (ctx *serverRequestContextImpl) releaseBody() {
+	if ctx.body.pooled != nil {
+		ctx.body.pooled.release()
+		ctx.body.pooled = nil
+		ctx.body.buf = nil
+	}
+}
+
+// server returns the server which handles the request, if any
+func (ctx *serverRequestContextImpl) server() *Server {
+	if ctx.endpoint != nil && ctx.endpoint.Server != nil {
+		return ctx.endpoint.Server
+	}
+	if ctx.ca != nil {
+		return ctx.ca.server
+	}
+	return nil
+}
+
 func (ctx *serverRequestContextImpl) GetUser(userName string) (spi.User, error) {
 	ca, err := ctx.getCA()
 	if err != nil {
@@ -468,6 +558,9 @@ func (ctx *serverRequestContextImpl) GetCaller() (spi.User, error) {
 	}
 	// Get the user info object for this user
 	ctx.caller, err = ca.registry.GetUser(id, nil)
+	if caerrors.Is(err, caerrors.ClassBackendUnavailable) {
+		return nil, err
+	}
 	if err != nil {
 		return nil, caerrors.NewAuthenticationErr(caerrors.ErrGettingUser, "Failed to get user")
 	}
@@ -478,7 +571,7 @@ func (ctx *serverRequestContextImpl) GetCaller() (spi.User, error) {
 func (ctx *serverRequestContextImpl) ContainsAffiliation(affiliation string) error {
 	validAffiliation, err := ctx.containsAffiliation(affiliation)
 	if err != nil {
-		return caerrors.NewHTTPErr(500, caerrors.ErrGettingAffiliation, "Failed to validate if caller has authority to get ID: %s", err)
+		return caerrors.NewInternalErr(caerrors.ErrGettingAffiliation, err, "Failed to validate if caller has authority to get ID")
 	}
 	if !validAffiliation {
 		return caerrors.NewAuthorizationErr(caerrors.ErrCallerNotAffiliated, "Caller does not have authority to act on affiliation '%s'", affiliation)
@@ -553,7 +646,12 @@ func (ctx *serverRequestContextImpl) isRegistrar() (string, bool, error) {
 func (ctx *serverRequestContextImpl) CanActOnType(userType string) error {
 	canAct, err := ctx.canActOnType(userType)
 	if err != nil {
-		return caerrors.NewHTTPErr(500, caerrors.ErrGettingType, "Failed to verify if user can act on type '%s': %s", userType, err)
+		// An authorization failure, such as when the caller is not a
+		// registrar, is returned as is so that the client can tell it apart
+		if caerrors.AsHTTPErr(err) != nil {
+			return err
+		}
+		return caerrors.NewInternalErr(caerrors.ErrGettingType, err, "Failed to verify if user can act on type '%s'", userType)
 	}
 	if !canAct {
 		return caerrors.NewAuthorizationErr(caerrors.ErrCallerNotAffiliated, "Registrar does not have authority to act on type '%s'", userType)
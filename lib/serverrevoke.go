@@ -17,11 +17,6 @@ import (
 	"github.com/hyperledger/fabric-ca/util"
 )
 
-type revocationResponseNet struct {
-	RevokedCerts []api.RevokedCert
-	CRL          string
-}
-
 // CertificateStatus represents status of an enrollment certificate
 type CertificateStatus string
 
@@ -34,9 +29,14 @@ const (
 
 func newRevokeEndpoint(s *Server) *serverEndpoint {
 	return &serverEndpoint{
-		Methods: []string{"POST"},
-		Handler: revokeHandler,
-		Server:  s,
+		Methods:    []string{"POST"},
+		Handler:    revokeHandler,
+		Server:     s,
+		auth:       authToken,
+		idempotent: true,
+		docs: map[string]operationDoc{
+			"POST": {summary: "Revoke a certificate or all certificates of an identity", request: &api.RevocationRequestNet{}, response: &api.RevocationResponseNet{}},
+		},
 	}
 }
 
@@ -66,15 +66,14 @@ func revokeHandler(ctx *serverRequestContextImpl) (interface{}, error) {
 	registry := ca.registry
 	reason := util.RevocationReasonCodes[req.Reason]
 
-	result := &revocationResponseNet{}
+	result := &api.RevocationResponseNet{}
 	if req.Serial != "" && req.AKI != "" {
 		calleraki := strings.ToLower(strings.TrimLeft(hex.EncodeToString(ctx.enrollmentCert.AuthorityKeyId), "0"))
 		callerserial := strings.ToLower(strings.TrimLeft(util.GetSerialAsHex(ctx.enrollmentCert.SerialNumber), "0"))
 
 		certificate, err := certDBAccessor.GetCertificateWithID(req.Serial, req.AKI)
 		if err != nil {
-			return nil, caerrors.NewHTTPErr(404, caerrors.ErrRevCertNotFound, "Certificate with serial %s and AKI %s was not found: %s",
-				req.Serial, req.AKI, err)
+			return nil, notFoundErr(err, caerrors.ErrRevCertNotFound, "Certificate with serial %s and AKI %s was not found", req.Serial, req.AKI)
 		}
 
 		// Authorization
@@ -84,18 +83,18 @@ func revokeHandler(ctx *serverRequestContextImpl) (interface{}, error) {
 		}
 
 		if certificate.Status == string(Revoked) {
-			return nil, caerrors.NewHTTPErr(404, caerrors.ErrCertAlreadyRevoked, "Certificate with serial %s and AKI %s was already revoked",
+			return nil, caerrors.NewConflictErr(caerrors.ErrCertAlreadyRevoked, "Certificate with serial %s and AKI %s was already revoked",
 				req.Serial, req.AKI)
 		}
 
 		if req.Name != "" && req.Name != certificate.ID {
-			return nil, caerrors.NewHTTPErr(400, caerrors.ErrCertWrongOwner, "Certificate with serial %s and AKI %s is not owned by %s",
+			return nil, caerrors.NewValidationErr(caerrors.ErrCertWrongOwner, "Certificate with serial %s and AKI %s is not owned by %s",
 				req.Serial, req.AKI, req.Name)
 		}
 
 		userInfo, err := registry.GetUser(certificate.ID, nil)
 		if err != nil {
-			return nil, caerrors.NewHTTPErr(404, caerrors.ErrRevokeIDNotFound, "Identity %s was not found: %s", certificate.ID, err)
+			return nil, notFoundErr(err, caerrors.ErrRevokeIDNotFound, "Identity %s was not found", certificate.ID)
 		}
 
 		if !((req.AKI == calleraki) && (req.Serial == callerserial)) {
@@ -107,9 +106,12 @@ func revokeHandler(ctx *serverRequestContextImpl) (interface{}, error) {
 
 		err = certDBAccessor.RevokeCertificate(req.Serial, req.AKI, reason)
 		if err != nil {
-			return nil, caerrors.NewHTTPErr(500, caerrors.ErrRevokeFailure, "Revoke of certificate <%s,%s> failed: %s", req.Serial, req.AKI, err)
+			return nil, caerrors.NewInternalErr(caerrors.ErrRevokeFailure, err, "Revoke of certificate <%s,%s> failed", req.Serial, req.AKI)
 		}
 		result.RevokedCerts = append(result.RevokedCerts, api.RevokedCert{Serial: req.Serial, AKI: req.AKI})
+		ca.server.publishEvent(EventCertRevoked, ca.Config.CA.Name, &CertificateEventData{
+			ID: certificate.ID, Serial: req.Serial, AKI: req.AKI, Reason: req.Reason, Invoker: caller,
+		})
 	} else if req.Name != "" {
 		// Authorization
 		err = checkAuth(caller, req.Name, ca)
@@ -119,7 +121,7 @@ func revokeHandler(ctx *serverRequestContextImpl) (interface{}, error) {
 
 		user, err := registry.GetUser(req.Name, nil)
 		if err != nil {
-			return nil, caerrors.NewHTTPErr(404, caerrors.ErrRevokeIDNotFound, "Identity %s was not found: %s", req.Name, err)
+			return nil, notFoundErr(err, caerrors.ErrRevokeIDNotFound, "Identity %s was not found", req.Name)
 		}
 
 		// Set user state to -1 for revoked user
@@ -138,15 +140,14 @@ func revokeHandler(ctx *serverRequestContextImpl) (interface{}, error) {
 
 			err = user.Revoke()
 			if err != nil {
-				return nil, caerrors.NewHTTPErr(500, caerrors.ErrRevokeUpdateUser, "Failed to revoke user: %s", err)
+				return nil, caerrors.NewInternalErr(caerrors.ErrRevokeUpdateUser, err, "Failed to revoke user")
 			}
 		}
 
 		var recs []CertRecord
 		recs, err = certDBAccessor.RevokeCertificatesByID(req.Name, reason)
 		if err != nil {
-			return nil, caerrors.NewHTTPErr(500, caerrors.ErrNoCertsRevoked, "Failed to revoke certificates for '%s': %s",
-				req.Name, err)
+			return nil, caerrors.NewInternalErr(caerrors.ErrNoCertsRevoked, err, "Failed to revoke certificates for '%s'", req.Name)
 		}
 
 		if len(recs) == 0 {
@@ -155,17 +156,20 @@ func revokeHandler(ctx *serverRequestContextImpl) (interface{}, error) {
 			log.Debugf("Revoked the following certificates owned by '%s': %+v", req.Name, recs)
 			for _, certRec := range recs {
 				result.RevokedCerts = append(result.RevokedCerts, api.RevokedCert{AKI: certRec.AKI, Serial: certRec.Serial})
+				ca.server.publishEvent(EventCertRevoked, ca.Config.CA.Name, &CertificateEventData{
+					ID: req.Name, Serial: certRec.Serial, AKI: certRec.AKI, Reason: req.Reason, Invoker: caller,
+				})
 			}
 		}
 	} else {
-		return nil, caerrors.NewHTTPErr(400, caerrors.ErrMissingRevokeArgs, "Either Name or Serial and AKI are required for a revoke request")
+		return nil, caerrors.NewValidationErr(caerrors.ErrMissingRevokeArgs, "Either Name or Serial and AKI are required for a revoke request")
 	}
 
 	log.Debugf("Revoke was successful: %+v", req)
 
 	if req.GenCRL && len(result.RevokedCerts) > 0 {
 		log.Debugf("Generating CRL")
-		crl, err := genCRL(ca, api.GenCRLRequest{CAName: ca.Config.CA.Name})
+		crl, err := genCRL(ca, api.GenCRLRequest{CAName: ca.Config.CA.Name}, ctx.caConfig(ca).crl)
 		if err != nil {
 			return nil, err
 		}
@@ -174,6 +178,16 @@ func revokeHandler(ctx *serverRequestContextImpl) (interface{}, error) {
 	return result, nil
 }
 
+// notFoundErr returns the error of a request for something which could not be
+// found because of the error 'err': a not found error with the code 'code',
+// unless the database failed
+func notFoundErr(err error, code int, format string, args ...interface{}) error {
+	if caerrors.Is(err, caerrors.ClassBackendUnavailable) {
+		return err
+	}
+	return caerrors.NewNotFoundErr(code, format, args...)
+}
+
 func parseInput(input string) string {
 	return strings.Replace(strings.TrimLeft(strings.ToLower(input), "0"), ":", "", -1)
 }
@@ -0,0 +1,237 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"strings"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/cfssl/signer"
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib/scep"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	// The path of the SCEP responder of the default CA; the responder of
+	// another CA is served under the path followed by the CA name
+	scepPath = "/scep"
+	// The operations of the SCEP responder
+	scepGetCACaps      = "GetCACaps"
+	scepGetCACert      = "GetCACert"
+	scepPKIOperation   = "PKIOperation"
+	scepPKIMessageMIME = "application/x-pki-message"
+)
+
+// scepCapabilities are the capabilities returned by the GetCACaps operation
+var scepCapabilities = []string{
+	"AES",
+	"DES3",
+	"POSTPKIOperation",
+	"Renewal",
+	"SHA-1",
+	"SHA-256",
+	"SHA-512",
+	"SCEPStandard",
+}
+
+// scepResponder is the certificate and key with which a CA's SCEP responder
+// signs and decrypts SCEP messages
+type scepResponder struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+}
+
+// initSCEP loads the certificate and key of the CA's SCEP responder if it is
+// enabled
+func (ca *CA) initSCEP() error {
+	ca.scep = nil
+	c := &ca.Config.SCEP
+	if !c.Enabled {
+		return nil
+	}
+	if getSigningProfile(ca.Config.Signing, c.Profile) == nil {
+		return errors.Errorf("The SCEP signing profile '%s' does not exist", c.Profile)
+	}
+	pair, err := tls.LoadX509KeyPair(c.Certfile, c.Keyfile)
+	if err != nil {
+		return errors.Wrap(err, "Failed to load the certificate and key of the SCEP responder")
+	}
+	key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return errors.Errorf("The key of the SCEP responder in '%s' is not an RSA key", c.Keyfile)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return errors.Wrapf(err, "Failed to parse the certificate of the SCEP responder in '%s'", c.Certfile)
+	}
+	err = ca.VerifyCertificate(cert)
+	if err != nil {
+		return errors.WithMessage(err, "The certificate of the SCEP responder is not issued by the CA")
+	}
+	ca.scep = &scepResponder{cert: cert, key: key}
+	log.Infof("SCEP responder of CA '%s' is enabled with certificate '%s'", ca.Config.CA.Name, c.Certfile)
+	return nil
+}
+
+// registerSCEPHandlers registers the handlers of the SCEP responders of the
+// server's CAs
+func (s *Server) registerSCEPHandlers() {
+	h := s.wrapEndpoint(strings.TrimPrefix(scepPath, "/"), http.HandlerFunc(s.scepHandler))
+	s.mux.Handle(s.basePath()+scepPath, h).Methods("GET", "POST")
+	s.mux.Handle(s.basePath()+scepPath+"/{ca}", h).Methods("GET", "POST")
+}
+
+// scepHandler handles the GetCACaps, GetCACert and PKIOperation operations
+// of the SCEP responder of the CA in the path
+func (s *Server) scepHandler(w http.ResponseWriter, r *http.Request) {
+	name := s.CA.Config.CA.Name
+	if i := strings.LastIndex(r.URL.Path, scepPath+"/"); i >= 0 {
+		name = r.URL.Path[i+len(scepPath)+1:]
+	}
+	ca, err := s.GetCA(name)
+	if err != nil || ca.scep == nil {
+		http.Error(w, "SCEP is not enabled for the CA", http.StatusNotFound)
+		return
+	}
+	switch op := r.URL.Query().Get("operation"); op {
+	case scepGetCACaps:
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(strings.Join(scepCapabilities, "\n")))
+	case scepGetCACert:
+		s.scepGetCACert(w, ca)
+	case scepPKIOperation:
+		s.scepPKIOperation(w, r, ca)
+	default:
+		http.Error(w, "Unsupported SCEP operation '"+op+"'", http.StatusBadRequest)
+	}
+}
+
+// scepGetCACert writes the certificate of the SCEP responder and the CA chain
+// as a degenerate PKCS #7 signed data
+func (s *Server) scepGetCACert(w http.ResponseWriter, ca *CA) {
+	certs, err := ca.getCAChainCertificates()
+	var chain []byte
+	if err == nil {
+		chain, err = scep.DegenerateCertificates(append([]*x509.Certificate{ca.scep.cert}, certs...))
+	}
+	if err != nil {
+		log.Errorf("Failed to get the CA chain of the SCEP responder: %s", err)
+		http.Error(w, "Failed to get the CA chain", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-x509-ca-ra-cert")
+	w.Write(chain)
+}
+
+// scepPKIOperation handles the PKI message in the 'message' query parameter
+// of a GET request or in the body of a POST request, and writes the CertRep
+func (s *Server) scepPKIOperation(w http.ResponseWriter, r *http.Request, ca *CA) {
+	ctx := &serverRequestContextImpl{req: r, resp: w, ca: ca, config: s.configSnapshot()}
+	defer ctx.releaseBody()
+	var der []byte
+	var err error
+	if r.Method == "GET" {
+		// A '+' of the base64 message which is not escaped is decoded as a space
+		msg := strings.Replace(r.URL.Query().Get("message"), " ", "+", -1)
+		der, err = base64.StdEncoding.DecodeString(msg)
+	} else {
+		der, err = ctx.ReadBodyBytes()
+	}
+	if err != nil {
+		http.Error(w, "Failed to read the PKI message", http.StatusBadRequest)
+		return
+	}
+	msg, err := scep.ParsePKIMessage(der)
+	if err != nil {
+		log.Debugf("Invalid SCEP PKI message: %s", err)
+		http.Error(w, "Invalid PKI message", http.StatusBadRequest)
+		return
+	}
+	certs, failInfo, err := handleSCEPRequest(ctx, ca, msg)
+	if info := getRequestInfo(r); info != nil {
+		info.identity = ctx.enrollmentID
+	}
+	var rep *scep.PKIMessage
+	if err != nil {
+		log.Infof("SCEP request of transaction '%s' failed: %s", msg.TransactionID, err)
+		rep, err = scep.NewFailureRep(msg, failInfo, ca.scep.cert, ca.scep.key)
+	} else {
+		rep, err = scep.NewCertRep(msg, certs, ca.scep.cert, ca.scep.key)
+	}
+	if err != nil {
+		log.Errorf("Failed to create the SCEP response of transaction '%s': %s", msg.TransactionID, err)
+		http.Error(w, "Failed to create the PKI message", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", scepPKIMessageMIME)
+	w.Write(rep.Raw)
+}
+
+// handleSCEPRequest issues a certificate for the PKCSReq or RenewalReq 'msg'.
+// A request signed by a certificate of the CA is a renewal, which follows the
+// policy of reenroll; otherwise the challenge password of the CSR must be the
+// enrollment secret of the identity in the CSR's common name.
+func handleSCEPRequest(ctx *serverRequestContextImpl, ca *CA, msg *scep.PKIMessage) ([]*x509.Certificate, scep.FailInfo, error) {
+	if msg.MessageType != scep.PKCSReq && msg.MessageType != scep.RenewalReq {
+		return nil, scep.BadRequest, errors.Errorf("Unsupported message type %s", msg.MessageType)
+	}
+	content, err := msg.DecryptEnvelope(ca.scep.cert, ca.scep.key)
+	if err != nil {
+		return nil, scep.BadMessageCheck, err
+	}
+	csr, err := x509.ParseCertificateRequest(content)
+	if err != nil {
+		return nil, scep.BadRequest, errors.Wrap(err, "Invalid CSR")
+	}
+	renewal := msg.MessageType == scep.RenewalReq || ca.VerifyCertificate(msg.SignerCert) == nil
+	var id string
+	if renewal {
+		id, err = ctx.authenticateCertificate(ca, msg.SignerCert)
+	} else {
+		var challenge string
+		challenge, err = scep.ChallengePassword(csr)
+		if err == nil {
+			id, err = ctx.LoginUserBasicAuth(csr.Subject.CommonName, challenge)
+		}
+	}
+	if err != nil {
+		return nil, scep.BadRequest, err
+	}
+	req := &api.EnrollmentRequestNet{
+		SignRequest: signer.SignRequest{
+			Request: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})),
+			Profile: ca.Config.SCEP.Profile,
+		},
+	}
+	event := EventCertIssued
+	if renewal {
+		event = EventCertReenrolled
+	}
+	certPEM, err := enrollCertificate(ctx, ca, id, req, event)
+	if err != nil {
+		return nil, scep.BadRequest, err
+	}
+	if !renewal {
+		err = ctx.ui.LoginComplete()
+		if err != nil {
+			return nil, scep.BadRequest, err
+		}
+	}
+	cert, err := util.GetX509CertificateFromPEM(certPEM)
+	if err != nil {
+		return nil, scep.BadRequest, err
+	}
+	return []*x509.Certificate{cert}, "", nil
+}
@@ -0,0 +1,198 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cfssl/signer"
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib/scep"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSCEP(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	httpClient := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	defer httpClient.CloseIdleConnections()
+	scepURL := fmt.Sprintf("http://localhost:%d/scep", rootPort)
+	resp, err := httpClient.Get(scepURL + "?operation=GetCACaps")
+	util.FatalError(t, err, "Failed to send GetCACaps")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "SCEP should be disabled by default")
+
+	// Issue the certificate of the SCEP responder and enable it
+	raKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	util.FatalError(t, err, "Failed to generate key")
+	raCSR, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "scep"}}, raKey)
+	util.FatalError(t, err, "Failed to create CSR")
+	raCertPEM, err := srv.CA.enrollSigner.Sign(signer.SignRequest{
+		Request: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: raCSR})),
+	})
+	util.FatalError(t, err, "Failed to issue the certificate of the SCEP responder")
+	certfile := "scep-cert.pem"
+	keyfile := "scep-key.pem"
+	err = ioutil.WriteFile(filepath.Join(rootDir, certfile), raCertPEM, 0644)
+	util.FatalError(t, err, "Failed to write certificate")
+	err = ioutil.WriteFile(filepath.Join(rootDir, keyfile), pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(raKey)}), 0600)
+	util.FatalError(t, err, "Failed to write key")
+	// Shut down the server so that the client does not reuse its connections
+	err = srv.Shutdown()
+	util.FatalError(t, err, "Failed to shut down server")
+
+	srv = TestGetServer2(false, rootPort, rootDir, "", -1, t)
+	srv.CA.Config.SCEP = SCEPConfig{Enabled: true, Profile: "noprofile", Certfile: certfile, Keyfile: keyfile}
+	err = srv.Start()
+	util.ErrorContains(t, err, "noprofile", "A SCEP profile which does not exist should fail")
+	srv = TestGetServer2(false, rootPort, rootDir, "", -1, t)
+	srv.CA.Config.SCEP = SCEPConfig{Enabled: true, Certfile: certfile, Keyfile: keyfile}
+	err = srv.Start()
+	util.FatalError(t, err, "Failed to start server with SCEP")
+
+	resp, err = httpClient.Get(scepURL + "?operation=GetCACaps")
+	util.FatalError(t, err, "Failed to send GetCACaps")
+	caps, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Contains(t, strings.Split(string(caps), "\n"), "POSTPKIOperation")
+	assert.Contains(t, strings.Split(string(caps), "\n"), "Renewal")
+	resp, err = httpClient.Get(scepURL + "?operation=GetCACert")
+	util.FatalError(t, err, "Failed to send GetCACert")
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "application/x-x509-ca-ra-cert", resp.Header.Get("Content-Type"))
+	chain, err := scep.ParseDegenerateCertificates(body)
+	util.FatalError(t, err, "Invalid GetCACert response")
+	caCert, err := getCACert(&srv.CA)
+	util.FatalError(t, err, "Failed to get the CA certificate")
+	if !assert.Len(t, chain, 2) {
+		t.FailNow()
+	}
+	raCert := chain[0]
+	assert.Equal(t, "scep", raCert.Subject.CommonName)
+	assert.Equal(t, caCert.Raw, chain[1].Raw)
+	resp, err = httpClient.Get(scepURL + "/unknownca?operation=GetCACaps")
+	util.FatalError(t, err, "Failed to send GetCACaps")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	client := TestGetRootClient()
+	enrollResp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin'")
+	_, err = enrollResp.Identity.Register(&api.RegistrationRequest{Name: "router1", Secret: "router1pw", Affiliation: "org1"})
+	util.FatalError(t, err, "Failed to register 'router1'")
+
+	// The device enrolls with a self-signed certificate and its enrollment secret
+	deviceKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	util.FatalError(t, err, "Failed to generate key")
+	selfSigned := newSelfSignedCert(t, "router1", deviceKey)
+	pkiOperation := func(method string, typ scep.MessageType, challenge string, signerCert *x509.Certificate, capability string) *scep.PKIMessage {
+		csr, err := scep.NewCSR(&x509.CertificateRequest{Subject: pkix.Name{CommonName: "router1"}}, deviceKey, challenge)
+		util.FatalError(t, err, "Failed to create CSR")
+		req, err := scep.NewPKIRequest(typ, csr, raCert, signerCert, deviceKey, capability)
+		util.FatalError(t, err, "Failed to create PKI message")
+		if method == "GET" {
+			resp, err = httpClient.Get(scepURL + "?operation=PKIOperation&message=" + url.QueryEscape(base64.StdEncoding.EncodeToString(req.Raw)))
+		} else {
+			resp, err = httpClient.Post(scepURL+"?operation=PKIOperation", "application/x-pki-message", bytes.NewReader(req.Raw))
+		}
+		util.FatalError(t, err, "Failed to send PKIOperation")
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !assert.Equal(t, http.StatusOK, resp.StatusCode, "PKIOperation failed: %s", body) {
+			t.FailNow()
+		}
+		rep, err := scep.ParsePKIMessage(body)
+		util.FatalError(t, err, "Invalid PKIOperation response")
+		assert.Equal(t, raCert.Raw, rep.SignerCert.Raw, "The response should be signed by the SCEP responder")
+		assert.Equal(t, req.TransactionID, rep.TransactionID)
+		assert.Equal(t, req.SenderNonce, rep.RecipientNonce)
+		return rep
+	}
+	issuedCert := func(rep *scep.PKIMessage, recipient *x509.Certificate) *x509.Certificate {
+		if !assert.Equal(t, scep.Success, rep.PKIStatus, "The request should succeed") {
+			t.FailNow()
+		}
+		content, err := rep.DecryptEnvelope(recipient, deviceKey)
+		util.FatalError(t, err, "Failed to decrypt the response")
+		certs, err := scep.ParseDegenerateCertificates(content)
+		util.FatalError(t, err, "Invalid certificates in the response")
+		if !assert.Len(t, certs, 1) {
+			t.FailNow()
+		}
+		assert.Equal(t, "router1", certs[0].Subject.CommonName)
+		assert.NoError(t, certs[0].CheckSignatureFrom(caCert), "The certificate should be issued by the CA")
+		return certs[0]
+	}
+	cert := issuedCert(pkiOperation("POST", scep.PKCSReq, "router1pw", selfSigned, "AES"), selfSigned)
+	aki := strings.TrimLeft(hex.EncodeToString(cert.AuthorityKeyId), "0")
+	serial := strings.TrimLeft(util.GetSerialAsHex(cert.SerialNumber), "0")
+	record, err := srv.CA.certDBAccessor.GetCertificateWithID(serial, aki)
+	util.FatalError(t, err, "The certificate should be recorded")
+	assert.Equal(t, "router1", record.ID)
+	issuedCert(pkiOperation("GET", scep.PKCSReq, "router1pw", selfSigned, "DES3"), selfSigned)
+
+	rep := pkiOperation("GET", scep.PKCSReq, "wrongpw", selfSigned, "DES3")
+	assert.Equal(t, scep.Failure, rep.PKIStatus, "A wrong challenge password should fail")
+	assert.Equal(t, scep.BadRequest, rep.FailInfo)
+
+	// A renewal is signed by the certificate it replaces, and its response
+	// is encrypted for that certificate
+	renewed := issuedCert(pkiOperation("POST", scep.RenewalReq, "", cert, "AES"), cert)
+	assert.NotEqual(t, cert.SerialNumber, renewed.SerialNumber)
+	rep = pkiOperation("POST", scep.RenewalReq, "", selfSigned, "AES")
+	assert.Equal(t, scep.Failure, rep.PKIStatus, "A renewal signed by a certificate not issued by the CA should fail")
+
+	// A revoked certificate cannot be renewed
+	_, err = enrollResp.Identity.Revoke(&api.RevocationRequest{
+		Serial: util.GetSerialAsHex(cert.SerialNumber),
+		AKI:    hex.EncodeToString(cert.AuthorityKeyId),
+	})
+	util.FatalError(t, err, "Failed to revoke certificate")
+	rep = pkiOperation("POST", scep.PKCSReq, "", cert, "AES")
+	assert.Equal(t, scep.Failure, rep.PKIStatus, "A renewal signed by a revoked certificate should fail")
+}
+
+// newSelfSignedCert returns a self-signed certificate of 'key' with the
+// common name 'cn'
+func newSelfSignedCert(t *testing.T, cn string, key *rsa.PrivateKey) *x509.Certificate {
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	util.FatalError(t, err, "Failed to create certificate")
+	cert, err := x509.ParseCertificate(der)
+	util.FatalError(t, err, "Failed to parse certificate")
+	return cert
+}
@@ -0,0 +1,205 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/cloudflare/cfssl/config"
+	cfcsr "github.com/cloudflare/cfssl/csr"
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/cfssl/signer"
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/hyperledger/fabric/bccsp"
+	cspsigner "github.com/hyperledger/fabric/bccsp/signer"
+	"github.com/pkg/errors"
+)
+
+// selfTestCN is the common name of the throwaway certificates signed by the self-test
+const selfTestCN = "fabric-ca-server-selftest"
+
+// SelfTest tests the signing and verification path of each CA of the server:
+// it signs a throwaway certificate with each signing profile, verifies that it
+// chains to the CA's certificate, creates and verifies an authentication token
+// with the certificate's key, and pings the user registry and certificate
+// database. If a CA's key is held by a cloud KMS, it also signs a random
+// digest with the KMS key and verifies the signature with the CA's
+// certificate. The certificates are not recorded in the certificate database.
+func (s *Server) SelfTest() *api.SelfTestResponse {
+	names := make([]string, 0, len(s.caMap))
+	for name := range s.caMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	snap := s.configSnapshot()
+	resp := &api.SelfTestResponse{Passed: true, Results: []api.SelfTestResult{}}
+	for _, name := range names {
+		ca := s.caMap[name]
+		for _, r := range ca.selfTest(snap.ca(ca)) {
+			if r.Error != "" {
+				resp.Passed = false
+			}
+			resp.Results = append(resp.Results, r)
+		}
+	}
+	return resp
+}
+
+// runSelfTest runs the self-test of the server and returns an error naming
+// the first component which failed
+func (s *Server) runSelfTest() error {
+	if s.SkipSelfTest {
+		log.Warning("Skipping the self-test of the server")
+		return nil
+	}
+	resp := s.SelfTest()
+	for _, r := range resp.Results {
+		if r.Error != "" {
+			return errors.Errorf("Self-test of '%s' failed: %s", r.Component, r.Error)
+		}
+	}
+	log.Infof("Self-test of %d components passed", len(resp.Results))
+	return nil
+}
+
+// selfTest runs the self-test of the components of the CA with its
+// configuration 'cfg'
+func (ca *CA) selfTest(cfg *caConfigSnapshot) []api.SelfTestResult {
+	name := ca.Config.CA.Name
+	var results []api.SelfTestResult
+	add := func(component string, err error) {
+		r := api.SelfTestResult{Component: name + "/" + component}
+		if err != nil {
+			r.Error = err.Error()
+			log.Errorf("Self-test of '%s' failed: %s", r.Component, err)
+		}
+		results = append(results, r)
+	}
+
+	key, csrPEM, err := ca.selfTestCSR()
+	if err != nil {
+		add("signer", err)
+	} else {
+		profiles := []string{""}
+		if cfg.signing != nil {
+			for p := range cfg.signing.Profiles {
+				profiles = append(profiles, p)
+			}
+			sort.Strings(profiles)
+		}
+		var certPEM []byte
+		for _, profile := range profiles {
+			component := "signer"
+			if profile != "" {
+				component += "/" + profile
+			}
+			cert, err := ca.selfTestSign(csrPEM, cfg.signing, profile)
+			if err == nil && certPEM == nil {
+				certPEM = cert
+			}
+			add(component, err)
+		}
+		if certPEM != nil {
+			add("token", ca.selfTestToken(certPEM, key))
+		} else {
+			add("token", errors.New("No certificate was signed with which to test authentication tokens"))
+		}
+	}
+	if ca.kms != nil {
+		add("kms", ca.selfTestKMS())
+	}
+	add("registry", ca.checkRegistry())
+	add("certdb", ca.checkCertDB())
+	return results
+}
+
+// selfTestCSR generates a temporary key and a certificate signing request for it
+func (ca *CA) selfTestCSR() (bccsp.Key, []byte, error) {
+	if ca.csp == nil {
+		return nil, nil, errors.New("BCCSP is not initialized")
+	}
+	key, err := ca.csp.KeyGen(&bccsp.ECDSAP256KeyGenOpts{Temporary: true})
+	if err != nil {
+		return nil, nil, errors.WithMessage(err, "Failed to generate a key")
+	}
+	cspSigner, err := cspsigner.New(ca.csp, key)
+	if err != nil {
+		return nil, nil, errors.WithMessage(err, "Failed to create a signer for the generated key")
+	}
+	csrPEM, err := cfcsr.Generate(cspSigner, &cfcsr.CertificateRequest{CN: selfTestCN})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to generate a certificate signing request")
+	}
+	return key, csrPEM, nil
+}
+
+// selfTestSign signs a certificate for 'csrPEM' with the signing profile
+// 'profile' of 'signing' and verifies that it was issued by the CA
+func (ca *CA) selfTestSign(csrPEM []byte, signing *config.Signing, profile string) ([]byte, error) {
+	s, err := ca.newSigner(signing)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to create the signer of the CA")
+	}
+	certPEM, err := s.Sign(signer.SignRequest{Request: string(csrPEM), Profile: profile})
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to sign a certificate")
+	}
+	cert, err := util.GetX509CertificateFromPEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	err = ca.VerifyCertificate(cert)
+	if err != nil {
+		return nil, errors.WithMessage(err, "The signed certificate does not chain to the CA's certificate")
+	}
+	return certPEM, nil
+}
+
+// selfTestToken creates an authentication token with 'key' and verifies it
+func (ca *CA) selfTestToken(certPEM []byte, key bccsp.Key) error {
+	body := []byte(selfTestCN)
+	token, err := util.CreateToken(ca.csp, certPEM, key, body)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to create an authentication token")
+	}
+	cert, err := util.VerifyToken(ca.csp, token, body)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to verify an authentication token")
+	}
+	signed, err := util.GetX509CertificateFromPEM(certPEM)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(cert.Raw, signed.Raw) {
+		return errors.New("The certificate of the verified authentication token is not the certificate with which it was created")
+	}
+	return nil
+}
+
+func newSelfTestEndpoint(s *Server) *serverEndpoint {
+	return &serverEndpoint{
+		Methods: []string{"POST"},
+		Handler: selfTestHandler,
+		Server:  s,
+		auth:    authAdmin,
+		docs: map[string]operationDoc{
+			"POST": {summary: "Run the self-test of the server", response: &api.SelfTestResponse{}},
+		},
+	}
+}
+
+// Handle a request to run the self-test of the server
+func selfTestHandler(ctx *serverRequestContextImpl) (interface{}, error) {
+	id, err := ctx.adminAuthorization("run the self-test")
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Self-test run by '%s'", id)
+	return ctx.endpoint.Server.SelfTest(), nil
+}
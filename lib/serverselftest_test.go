@@ -0,0 +1,111 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudflare/cfssl/config"
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelfTest(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "The self-test should pass when starting the server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	countCerts := func() int {
+		var n int
+		err := srv.CA.db.Get(&n, "SELECT COUNT(*) FROM certificates")
+		util.FatalError(t, err, "Failed to count the certificates")
+		return n
+	}
+	certs := countCerts()
+
+	c := TestGetRootClient()
+	enrollResp, err := c.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin'")
+	admin := enrollResp.Identity
+	resp, err := admin.SelfTest()
+	util.FatalError(t, err, "Failed to run the self-test")
+	assert.True(t, resp.Passed)
+	components := []string{}
+	for _, r := range resp.Results {
+		assert.Empty(t, r.Error, "The self-test of %s should pass", r.Component)
+		components = append(components, r.Component)
+	}
+	name := srv.CA.Config.CA.Name
+	assert.Contains(t, components, name+"/signer")
+	assert.Contains(t, components, name+"/signer/ca")
+	assert.Contains(t, components, name+"/token")
+	assert.Contains(t, components, name+"/registry")
+	assert.Contains(t, components, name+"/certdb")
+	assert.Equal(t, certs+1, countCerts(), "Only the enrollment certificate should be recorded, not the self-test certificates")
+
+	// An identity without the hf.Admin attribute is not authorized
+	_, err = admin.Register(&api.RegistrationRequest{Name: "selftestuser", Secret: "selftestuserpw"})
+	util.FatalError(t, err, "Failed to register 'selftestuser'")
+	enrollResp, err = c.Enroll(&api.EnrollmentRequest{Name: "selftestuser", Secret: "selftestuserpw"})
+	util.FatalError(t, err, "Failed to enroll 'selftestuser'")
+	_, err = enrollResp.Identity.SelfTest()
+	util.ErrorContains(t, err, "71", "Identity without hf.Admin should not be able to run the self-test")
+}
+
+func TestSelfTestFailures(t *testing.T) {
+	srv := TestGetRootServer(t)
+	defer os.RemoveAll(rootDir)
+	err := srv.init(false)
+	util.FatalError(t, err, "Failed to initialize server")
+	name := srv.CA.Config.CA.Name
+
+	// A signing profile whose certificates can't be issued fails the self-test
+	srv.CA.Config.Signing = &config.Signing{
+		Default:  config.DefaultConfig(),
+		Profiles: map[string]*config.SigningProfile{"broken": {Usage: []string{"cert sign"}, Expiry: -1}},
+	}
+	srv.ApplyConfig()
+	err = srv.runSelfTest()
+	util.ErrorContains(t, err, "Self-test of '"+name+"/signer/broken' failed", "A broken signing profile should fail the self-test")
+	srv.CA.Config.Signing = nil
+	srv.ApplyConfig()
+
+	// A CA without its private key fails the self-test
+	keystore := filepath.Join(rootDir, "msp", "keystore")
+	err = os.RemoveAll(keystore)
+	util.FatalError(t, err, "Failed to remove keystore")
+	err = os.MkdirAll(keystore, 0755)
+	util.FatalError(t, err, "Failed to create keystore")
+	os.Remove(srv.CA.Config.CA.Keyfile)
+	err = srv.runSelfTest()
+	util.ErrorContains(t, err, "Self-test of '"+name+"/signer' failed", "A CA without its key should fail the self-test")
+
+	// The self-test can be skipped
+	srv.SkipSelfTest = true
+	assert.NoError(t, srv.runSelfTest())
+
+	// An unavailable database fails the self-test
+	srv.SkipSelfTest = false
+	err = srv.closeDB()
+	util.FatalError(t, err, "Failed to close DB")
+	resp := srv.SelfTest()
+	assert.False(t, resp.Passed)
+	failed := map[string]bool{}
+	for _, r := range resp.Results {
+		if r.Error != "" {
+			failed[r.Component] = true
+		}
+	}
+	assert.True(t, failed[name+"/certdb"], "The self-test of the certificate database should fail: %+v", resp.Results)
+}
@@ -0,0 +1,313 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/cloudflare/cfssl/config"
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/cfssl/signer"
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/lib/spi"
+	"github.com/hyperledger/fabric/common/attrmgr"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultSPIFFEProfile = "spiffe"
+	defaultSPIFFEPath    = "/{{.Affiliation}}/{{.ID}}"
+	// The expiry of the X.509-SVIDs of the signing profile which is created
+	// for them
+	defaultSVIDExpiration = time.Hour
+	// The maximum length of a SPIFFE ID
+	maxSPIFFEIDLength = 2048
+)
+
+var (
+	// The X.509 SubjectAltName object identifier (RFC 5280, 4.2.1.6)
+	subjectAltNameOID = asn1.ObjectIdentifier{2, 5, 29, 17}
+	// The characters of a trust domain and of a segment of the path of a
+	// SPIFFE ID
+	spiffeTrustDomainRegexp = regexp.MustCompile(`^[a-z0-9._-]+$`)
+	spiffePathSegmentRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+)
+
+// svidPathFields are the fields of the template of the path of the SPIFFE
+// ID of an identity
+type svidPathFields struct {
+	ID          string
+	Type        string
+	Affiliation string
+}
+
+// initSPIFFE checks the SPIFFE configuration of the CA if it has a trust
+// domain, and creates its signing profile if it does not exist
+func (ca *CA) initSPIFFE() error {
+	ca.svidPath = nil
+	c := &ca.Config.SPIFFE
+	if c.TrustDomain == "" {
+		return nil
+	}
+	if !spiffeTrustDomainRegexp.MatchString(c.TrustDomain) {
+		return errors.Errorf("Invalid SPIFFE trust domain '%s'; it may only have lower case letters, digits, '.', '-' and '_'", c.TrustDomain)
+	}
+	if c.Profile == "" {
+		c.Profile = defaultSPIFFEProfile
+	}
+	if c.Path == "" {
+		c.Path = defaultSPIFFEPath
+	}
+	tmpl, err := template.New("spiffe.path").Parse(c.Path)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid template '%s' of the path of SPIFFE IDs", c.Path)
+	}
+	for _, host := range c.Hosts {
+		if net.ParseIP(host) == nil && !spiffeTrustDomainRegexp.MatchString(strings.TrimPrefix(host, "*.")) {
+			return errors.Errorf("Invalid SPIFFE host '%s'; it must be a DNS name or an IP address", host)
+		}
+	}
+	profiles := ca.Config.Signing.Profiles
+	sp := profiles[c.Profile]
+	if sp == nil {
+		sp = &config.SigningProfile{
+			Usage:  []string{"digital signature", "key encipherment", "key agreement", "server auth", "client auth"},
+			Expiry: defaultSVIDExpiration,
+		}
+		profiles[c.Profile] = sp
+	}
+	err = checkSVIDProfile(c.Profile, sp)
+	if err != nil {
+		return err
+	}
+	if sp.ExtensionWhitelist == nil {
+		sp.ExtensionWhitelist = map[string]bool{}
+	}
+	// The SPIFFE ID is added to the certificate in the SubjectAltName
+	// extension of the request, which cfssl only adds if it is allowed
+	sp.ExtensionWhitelist[subjectAltNameOID.String()] = true
+	sp.ExtensionWhitelist[attrmgr.AttrOIDString] = true
+	ca.svidPath = tmpl
+	log.Infof("CA '%s' issues X.509-SVIDs of trust domain '%s' with signing profile '%s'", ca.Config.CA.Name, c.TrustDomain, c.Profile)
+	return nil
+}
+
+// checkSVIDProfile checks that the signing profile 'sp' named 'name' issues
+// leaf certificates with the key usages of the SPIFFE X.509-SVID
+// specification
+func checkSVIDProfile(name string, sp *config.SigningProfile) error {
+	if sp.CAConstraint.IsCA {
+		return errors.Errorf("The SPIFFE signing profile '%s' may not issue CA certificates", name)
+	}
+	ku, _, unknown := sp.Usages()
+	if len(unknown) > 0 {
+		return errors.Errorf("The SPIFFE signing profile '%s' has unknown usages: %s", name, strings.Join(unknown, ", "))
+	}
+	if ku&x509.KeyUsageDigitalSignature == 0 {
+		return errors.Errorf("The SPIFFE signing profile '%s' must have the 'digital signature' usage", name)
+	}
+	if ku&(x509.KeyUsageCertSign|x509.KeyUsageCRLSign) != 0 {
+		return errors.Errorf("The SPIFFE signing profile '%s' may not have the 'cert sign' or 'crl sign' usage", name)
+	}
+	if sp.Expiry <= 0 {
+		sp.Expiry = defaultSVIDExpiration
+	}
+	return nil
+}
+
+// isSVIDProfile returns true if the certificates issued by the CA with the
+// signing profile 'profile' are X.509-SVIDs
+func (ca *CA) isSVIDProfile(profile string) bool {
+	return ca.svidPath != nil && profile == ca.Config.SPIFFE.Profile
+}
+
+// spiffeID returns the SPIFFE ID of the identity 'user'
+func (ca *CA) spiffeID(user spi.User) (*url.URL, error) {
+	fields := &svidPathFields{
+		ID:          user.GetName(),
+		Type:        user.GetType(),
+		Affiliation: strings.Join(user.GetAffiliationPath(), "/"),
+	}
+	var buf bytes.Buffer
+	err := ca.svidPath.Execute(&buf, fields)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create the path of the SPIFFE ID")
+	}
+	// The empty segments of an identity at the root of the affiliations are
+	// removed
+	segments := []string{}
+	for _, segment := range strings.Split(buf.String(), "/") {
+		if segment == "" {
+			continue
+		}
+		if segment == "." || segment == ".." || !spiffePathSegmentRegexp.MatchString(segment) {
+			return nil, caerrors.NewHTTPErr(400, caerrors.ErrBadCSR, "The path '%s' of the SPIFFE ID of '%s' is not valid; it may only have letters, digits, '.', '-' and '_'", buf.String(), user.GetName())
+		}
+		segments = append(segments, segment)
+	}
+	id := &url.URL{Scheme: "spiffe", Host: ca.Config.SPIFFE.TrustDomain}
+	if len(segments) > 0 {
+		id.Path = "/" + strings.Join(segments, "/")
+	}
+	if len(id.String()) > maxSPIFFEIDLength {
+		return nil, caerrors.NewHTTPErr(400, caerrors.ErrBadCSR, "The SPIFFE ID of '%s' exceeds the maximum length of %d", user.GetName(), maxSPIFFEIDLength)
+	}
+	return id, nil
+}
+
+// allowedSVIDHost returns true if the DNS name or IP address 'host' may be
+// in an X.509-SVID
+func (ca *CA) allowedSVIDHost(host string) bool {
+	ip := net.ParseIP(host)
+	for _, allowed := range ca.Config.SPIFFE.Hosts {
+		if ip != nil {
+			if ip.Equal(net.ParseIP(allowed)) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+		// A wildcard matches a single label
+		if strings.HasPrefix(allowed, "*.") {
+			i := strings.Index(host, ".")
+			if i > 0 && strings.EqualFold(host[i:], allowed[1:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// processSVIDRequest makes the enrollment request 'req' of the caller of
+// 'ctx' a request for an X.509-SVID if its signing profile is the SPIFFE
+// profile: its only URI is the caller's SPIFFE ID, it has no email address,
+// and its DNS names and IP addresses must be allowed by the configuration
+func (ca *CA) processSVIDRequest(ctx *serverRequestContextImpl, req *api.EnrollmentRequestNet) error {
+	if !ca.isSVIDProfile(req.Profile) {
+		return nil
+	}
+	caller, err := ctx.GetCaller()
+	if err != nil {
+		return err
+	}
+	id, err := ca.spiffeID(caller)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode([]byte(req.Request))
+	if block == nil {
+		return caerrors.NewHTTPErr(400, caerrors.ErrBadCSR, "The CSR is not PEM-encoded")
+	}
+	csrReq, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return caerrors.NewHTTPErr(400, caerrors.ErrBadCSR, "Failed to parse the CSR: %s", err)
+	}
+	isForCACert, err := isRequestForCASigningCert(csrReq, ctx.caConfig(ca).signing, req.Profile)
+	if err != nil {
+		return err
+	}
+	if isForCACert {
+		return caerrors.NewHTTPErr(400, caerrors.ErrBadCSR, "An X.509-SVID may not be a CA certificate")
+	}
+	for _, uri := range csrReq.URIs {
+		if uri.String() != id.String() {
+			return caerrors.NewHTTPErr(400, caerrors.ErrBadCSR, "The URI '%s' of the CSR is not the SPIFFE ID '%s' of the identity", uri, id)
+		}
+	}
+	if len(csrReq.EmailAddresses) > 0 {
+		return caerrors.NewHTTPErr(400, caerrors.ErrBadCSR, "An X.509-SVID may not have an email address")
+	}
+	hosts := append([]string{}, req.Hosts...)
+	hosts = append(hosts, csrReq.DNSNames...)
+	for _, ip := range csrReq.IPAddresses {
+		hosts = append(hosts, ip.String())
+	}
+	san := &svidSubjectAltName{uri: id.String()}
+	for _, host := range hosts {
+		if !ca.allowedSVIDHost(host) {
+			return caerrors.NewHTTPErr(400, caerrors.ErrBadCSR, "The host '%s' of the CSR is not allowed in an X.509-SVID", host)
+		}
+		san.add(host)
+	}
+	value, err := san.marshal()
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode the SubjectAltName extension")
+	}
+	// The extension replaces the names which cfssl would copy from the CSR
+	// and the hosts of the request
+	req.Hosts = nil
+	req.Extensions = append(req.Extensions, signer.Extension{
+		ID:    config.OID(subjectAltNameOID),
+		Value: hex.EncodeToString(value),
+	})
+	// X.509-SVIDs are short-lived whatever expiry is requested
+	maxNotAfter := time.Now().Round(time.Minute).Add(getSigningProfile(ctx.caConfig(ca).signing, req.Profile).Expiry).UTC()
+	if req.NotAfter.IsZero() || req.NotAfter.After(maxNotAfter) {
+		req.NotAfter = maxNotAfter
+	}
+	log.Debugf("Issuing an X.509-SVID with SPIFFE ID '%s' to '%s'", id, caller.GetName())
+	return nil
+}
+
+// svidSubjectAltName is the SubjectAltName extension of an X.509-SVID
+type svidSubjectAltName struct {
+	uri      string
+	dnsNames []string
+	ips      []net.IP
+}
+
+func (san *svidSubjectAltName) add(host string) {
+	if ip := net.ParseIP(host); ip != nil {
+		for _, seen := range san.ips {
+			if seen.Equal(ip) {
+				return
+			}
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		san.ips = append(san.ips, ip)
+		return
+	}
+	for _, seen := range san.dnsNames {
+		if strings.EqualFold(seen, host) {
+			return
+		}
+	}
+	san.dnsNames = append(san.dnsNames, host)
+}
+
+// marshal returns the DER encoding of the extension's GeneralNames
+// (RFC 5280, 4.2.1.6)
+func (san *svidSubjectAltName) marshal() ([]byte, error) {
+	const (
+		tagDNSName = 2
+		tagURI     = 6
+		tagIP      = 7
+	)
+	names := []asn1.RawValue{{Tag: tagURI, Class: asn1.ClassContextSpecific, Bytes: []byte(san.uri)}}
+	for _, name := range san.dnsNames {
+		names = append(names, asn1.RawValue{Tag: tagDNSName, Class: asn1.ClassContextSpecific, Bytes: []byte(name)})
+	}
+	for _, ip := range san.ips {
+		names = append(names, asn1.RawValue{Tag: tagIP, Class: asn1.ClassContextSpecific, Bytes: ip})
+	}
+	return asn1.Marshal(names)
+}
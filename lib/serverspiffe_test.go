@@ -0,0 +1,196 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cfssl/config"
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// checkSVID checks that 'cert' is an X.509-SVID of the leaf 'spiffeID' as
+// required by the SPIFFE X.509-SVID specification
+func checkSVID(t *testing.T, cert *x509.Certificate, spiffeID string) {
+	if assert.Len(t, cert.URIs, 1, "An X.509-SVID must have exactly one URI") {
+		assert.Equal(t, spiffeID, cert.URIs[0].String())
+		assert.Equal(t, "spiffe", cert.URIs[0].Scheme)
+	}
+	assert.Empty(t, cert.EmailAddresses)
+	assert.False(t, cert.IsCA, "An X.509-SVID leaf may not be a CA certificate")
+	assert.NotZero(t, cert.KeyUsage&x509.KeyUsageDigitalSignature, "An X.509-SVID leaf must have the digitalSignature key usage")
+	assert.Zero(t, cert.KeyUsage&(x509.KeyUsageCertSign|x509.KeyUsageCRLSign), "An X.509-SVID leaf may not have the keyCertSign or cRLSign key usage")
+	assert.Contains(t, cert.ExtKeyUsage, x509.ExtKeyUsageServerAuth)
+	assert.Contains(t, cert.ExtKeyUsage, x509.ExtKeyUsageClientAuth)
+	assert.True(t, cert.NotAfter.Sub(cert.NotBefore) <= defaultSVIDExpiration+10*time.Minute,
+		"The X.509-SVID is valid from %s to %s", cert.NotBefore, cert.NotAfter)
+}
+
+// svidCSR returns a PEM-encoded CSR with the common name 'cn' and the names
+// of 'template'
+func svidCSR(t *testing.T, cn string, template *x509.CertificateRequest) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	util.FatalError(t, err, "Failed to generate key")
+	template.Subject = pkix.Name{CommonName: cn}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	util.FatalError(t, err, "Failed to create CSR")
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+}
+
+func TestSPIFFE(t *testing.T) {
+	srv := TestGetRootServer(t)
+	srv.CA.Config.SPIFFE = SPIFFEConfig{
+		TrustDomain: "example.org",
+		Hosts:       []string{"*.svc.example.org", "10.0.0.1"},
+	}
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(testdataDir + "/msp")
+	}()
+	client := getTestClient(rootPort)
+
+	info, err := client.GetCAInfo(&api.GetCAInfoRequest{})
+	util.FatalError(t, err, "Failed to get CA info")
+	assert.Equal(t, "example.org", info.SPIFFETrustDomain)
+	assert.Equal(t, "spiffe", info.SPIFFEProfile)
+
+	resp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw", SVID: true,
+		CSR: &api.CSRInfo{Hosts: []string{"localhost"}}})
+	util.FatalError(t, err, "Failed to enroll an X.509-SVID")
+	admin := resp.Identity
+	cert := admin.GetECert().GetX509Cert()
+	// The identity at the root of the affiliations has no affiliation path
+	checkSVID(t, cert, "spiffe://example.org/admin")
+	assert.Empty(t, cert.DNSNames, "The hosts of the CSR are not requested for an X.509-SVID")
+	err = resp.VerifyCert()
+	assert.NoError(t, err, "The X.509-SVID does not verify against the CA chain")
+
+	_, err = admin.Register(&api.RegistrationRequest{Name: "workload1", Secret: "workload1pw", Type: "client", Affiliation: "org2.dept1"})
+	util.FatalError(t, err, "Failed to register workload1")
+	resp, err = client.Enroll(&api.EnrollmentRequest{Name: "workload1", Secret: "workload1pw", SVID: true})
+	util.FatalError(t, err, "Failed to enroll an X.509-SVID")
+	checkSVID(t, resp.Identity.GetECert().GetX509Cert(), "spiffe://example.org/org2/dept1/workload1")
+
+	// Reenrolling with the SPIFFE profile issues a new X.509-SVID
+	resp, err = resp.Identity.Reenroll(&api.ReenrollmentRequest{SVID: true})
+	util.FatalError(t, err, "Failed to reenroll an X.509-SVID")
+	checkSVID(t, resp.Identity.GetECert().GetX509Cert(), "spiffe://example.org/org2/dept1/workload1")
+
+	// The allowed hosts of the request are added to the X.509-SVID
+	resp, err = client.Enroll(&api.EnrollmentRequest{Name: "workload1", Secret: "workload1pw", Profile: "spiffe",
+		CSR: &api.CSRInfo{Hosts: []string{"api.svc.example.org", "10.0.0.1"}}})
+	util.FatalError(t, err, "Failed to enroll an X.509-SVID with hosts")
+	cert = resp.Identity.GetECert().GetX509Cert()
+	checkSVID(t, cert, "spiffe://example.org/org2/dept1/workload1")
+	assert.Equal(t, []string{"api.svc.example.org"}, cert.DNSNames)
+	if assert.Len(t, cert.IPAddresses, 1) {
+		assert.True(t, cert.IPAddresses[0].Equal(net.ParseIP("10.0.0.1")))
+	}
+
+	// The other profiles are not affected
+	resp, err = client.Enroll(&api.EnrollmentRequest{Name: "workload1", Secret: "workload1pw", Profile: "tls",
+		CSR: &api.CSRInfo{Hosts: []string{"other.example.com"}}})
+	util.FatalError(t, err, "Failed to enroll with the tls profile")
+	cert = resp.Identity.GetECert().GetX509Cert()
+	assert.Empty(t, cert.URIs)
+	assert.Equal(t, []string{"other.example.com"}, cert.DNSNames)
+
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "workload1", Secret: "workload1pw", SVID: true, Profile: "tls"})
+	util.ErrorContains(t, err, "is not the SPIFFE signing profile", "The SVID flag should conflict with another profile")
+
+	// CSRs with conflicting names are rejected
+	otherURI, _ := url.Parse("spiffe://example.org/other")
+	svidURI, _ := url.Parse("spiffe://example.org/org2/dept1/workload1")
+	for _, test := range []struct {
+		csr    *x509.CertificateRequest
+		hosts  []string
+		reject string
+	}{
+		{csr: &x509.CertificateRequest{URIs: []*url.URL{otherURI}}, reject: "is not the SPIFFE ID"},
+		{csr: &x509.CertificateRequest{URIs: []*url.URL{svidURI, otherURI}}, reject: "is not the SPIFFE ID"},
+		{csr: &x509.CertificateRequest{EmailAddresses: []string{"workload1@example.org"}}, reject: "email address"},
+		{csr: &x509.CertificateRequest{DNSNames: []string{"a.b.svc.example.org"}}, reject: "not allowed"},
+		{csr: &x509.CertificateRequest{IPAddresses: []net.IP{net.ParseIP("10.0.0.2")}}, reject: "not allowed"},
+		{csr: &x509.CertificateRequest{}, hosts: []string{"example.com"}, reject: "not allowed"},
+		{csr: &x509.CertificateRequest{URIs: []*url.URL{svidURI}}},
+	} {
+		reqNet := &api.EnrollmentRequestNet{}
+		reqNet.Request = svidCSR(t, "workload1", test.csr)
+		reqNet.Profile = "spiffe"
+		reqNet.Hosts = test.hosts
+		// The requested expiry is capped for an X.509-SVID
+		reqNet.NotAfter = time.Now().Add(24 * time.Hour)
+		body, err := util.Marshal(reqNet, "SignRequest")
+		util.FatalError(t, err, "Failed to marshal enroll request")
+		post, err := client.newPost("enroll", body)
+		util.FatalError(t, err, "Failed to create post request")
+		post.SetBasicAuth("workload1", "workload1pw")
+		var result struct{ Cert string }
+		err = client.SendReq(post, &result)
+		if test.reject != "" {
+			util.ErrorContains(t, err, test.reject, "The CSR should be rejected")
+			continue
+		}
+		util.FatalError(t, err, "Failed to enroll a CSR with the SPIFFE ID")
+		certPEM, err := util.B64Decode(result.Cert)
+		util.FatalError(t, err, "Failed to decode the certificate")
+		cert, err := util.GetX509CertificateFromPEM(certPEM)
+		util.FatalError(t, err, "Failed to parse the certificate")
+		checkSVID(t, cert, svidURI.String())
+	}
+}
+
+func TestSPIFFEConfig(t *testing.T) {
+	// A CA without a trust domain does not issue X.509-SVIDs
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	client := getTestClient(rootPort)
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw", SVID: true})
+	util.ErrorContains(t, err, "does not issue X.509-SVIDs", "Enrolling an X.509-SVID should fail")
+	srv.Stop()
+	os.RemoveAll(rootDir)
+
+	for _, test := range []struct {
+		spiffe  SPIFFEConfig
+		profile *config.SigningProfile
+		err     string
+	}{
+		{spiffe: SPIFFEConfig{TrustDomain: "Example.org"}, err: "Invalid SPIFFE trust domain"},
+		{spiffe: SPIFFEConfig{TrustDomain: "example.org", Path: "/{{.ID"}, err: "Invalid template"},
+		{spiffe: SPIFFEConfig{TrustDomain: "example.org", Hosts: []string{"bad host"}}, err: "Invalid SPIFFE host"},
+		{spiffe: SPIFFEConfig{TrustDomain: "example.org", Profile: "ca"}, err: "may not issue CA certificates"},
+		{spiffe: SPIFFEConfig{TrustDomain: "example.org"},
+			profile: &config.SigningProfile{Usage: []string{"key encipherment"}}, err: "must have the 'digital signature' usage"},
+		{spiffe: SPIFFEConfig{TrustDomain: "example.org"},
+			profile: &config.SigningProfile{Usage: []string{"digital signature", "cert sign"}}, err: "may not have the 'cert sign'"},
+	} {
+		srv := TestGetRootServer(t)
+		srv.CA.Config.SPIFFE = test.spiffe
+		if test.profile != nil {
+			srv.CA.Config.Signing.Profiles["spiffe"] = test.profile
+		}
+		err := srv.Init(false)
+		util.ErrorContains(t, err, test.err, "Invalid SPIFFE configuration %+v should fail", test.spiffe)
+		os.RemoveAll(rootDir)
+	}
+}
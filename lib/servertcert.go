@@ -29,6 +29,10 @@ func newTCertEndpoint(s *Server) *serverEndpoint {
 		Methods: []string{"POST"},
 		Handler: tcertHandler,
 		Server:  s,
+		auth:    authToken,
+		docs: map[string]operationDoc{
+			"POST": {summary: "Get a batch of transaction certificates", request: &api.GetTCertBatchRequestNet{}, response: &api.GetTCertBatchResponse{}},
+		},
 	}
 }
 
@@ -0,0 +1,444 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cfssl/config"
+	"github.com/cloudflare/cfssl/log"
+	gmux "github.com/gorilla/mux"
+	"github.com/hyperledger/fabric-ca/lib/dbutil"
+	"github.com/hyperledger/fabric-ca/lib/kms"
+	"github.com/hyperledger/fabric-ca/lib/ldap"
+	"github.com/hyperledger/fabric-ca/lib/logging"
+	stls "github.com/hyperledger/fabric-ca/lib/tls"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+)
+
+// ConfigProblem is a problem found by validating the server's configuration
+type ConfigProblem struct {
+	// Name of the CA whose configuration has the problem; empty if the
+	// problem is in a setting of the server
+	CA string `json:"ca,omitempty"`
+	// Setting or component with the problem, such as 'db' or 'signing.profiles.tls'
+	Setting string `json:"setting"`
+	Message string `json:"message"`
+}
+
+func (p ConfigProblem) String() string {
+	if p.CA != "" {
+		return fmt.Sprintf("CA '%s': %s: %s", p.CA, p.Setting, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.Setting, p.Message)
+}
+
+// configValidator collects the problems found in the configuration of the
+// server or of one of its CAs
+type configValidator struct {
+	ca       string
+	problems *[]ConfigProblem
+}
+
+func (v configValidator) add(setting string, err error) {
+	*v.problems = append(*v.problems, ConfigProblem{CA: v.ca, Setting: setting, Message: err.Error()})
+}
+
+func (v configValidator) addf(setting, format string, args ...interface{}) {
+	v.add(setting, errors.Errorf(format, args...))
+}
+
+// Validate checks the server's configuration without starting the server:
+// the settings of the server, the key and certificate of each CA, the
+// connections to the user registry and certificate database, and the
+// signing profiles. The databases are connected to but not created, and
+// missing CA and TLS certificates are not generated. Every problem found is
+// returned; none means the configuration is valid.
+func (s *Server) Validate() []ConfigProblem {
+	problems := []ConfigProblem{}
+	v := configValidator{problems: &problems}
+	if s.Config == nil {
+		s.Config = new(ServerConfig)
+	}
+	cfg := s.Config
+	if s.HomeDir == "" {
+		s.HomeDir = "."
+	}
+	homeDir, err := filepath.Abs(s.HomeDir)
+	if err != nil {
+		v.add("home", err)
+		return problems
+	}
+	s.HomeDir = homeDir
+	s.CA.server = s
+	s.CA.HomeDir = s.HomeDir
+
+	err = logging.Validate(&cfg.Log)
+	if err != nil {
+		v.add("log", err)
+	}
+	if strings.ContainsAny(cfg.BasePath, "{}?#") {
+		v.addf("basepath", "Invalid base path '%s'; it may not contain '{', '}', '?' or '#'", cfg.BasePath)
+	}
+	s.validateConcurrency(v)
+	s.validateListeners(v)
+	s.validateAPI(v)
+	if err := checkEventsConfig(&cfg.Events); err != nil {
+		v.add("events", err)
+	}
+	if _, err := newCORSPolicy(&cfg.CORS); err != nil {
+		v.add("cors", err)
+	}
+	// The secrets referenced in the configuration are read from Vault
+	if err := s.initVault(); err != nil {
+		v.add("vault", err)
+	}
+
+	// Validate the default CA and those of the CA configuration files
+	if s.CA.Config == nil {
+		s.CA.Config = &cfg.CAcfg
+	}
+	s.CA.validate(&problems)
+	caFilesByName := map[string]string{s.CA.Config.CA.Name: s.CA.ConfigFilePath}
+	if cfg.CAcount != 0 && len(cfg.CAfiles) > 0 {
+		v.addf("cafiles", "The --cacount and --cafiles options are mutually exclusive")
+	}
+	if cfg.CAcfg.Intermediate.ParentServer.URL != "" && cfg.CAcount > 0 {
+		v.addf("cacount", "The --cacount option is not permissible for an intermediate server; use the --cafiles option instead")
+	}
+	caFiles, err := util.NormalizeFileList(cfg.CAfiles, s.HomeDir)
+	if err != nil {
+		v.add("cafiles", err)
+	}
+	for _, caFile := range caFiles {
+		if !util.FileExists(caFile) {
+			v.addf("cafiles", "%s file does not exist", caFile)
+			continue
+		}
+		caCfg, err := readCAConfig(caFile, s.CA.Config)
+		if err != nil {
+			v.add("cafiles", err)
+			continue
+		}
+		if other, ok := caFilesByName[caCfg.CA.Name]; ok {
+			v.addf("cafiles", "CA name '%s' is used in '%s' and '%s'", caCfg.CA.Name, caFile, other)
+		}
+		caFilesByName[caCfg.CA.Name] = caFile
+		ca := &CA{HomeDir: filepath.Dir(caFile), Config: caCfg, ConfigFilePath: caFile, server: s}
+		ca.validate(&problems)
+	}
+
+	// The TLS key of the server may be stored by the BCCSP of the default CA
+	s.csp = s.CA.csp
+	s.validateTLS(v)
+	return problems
+}
+
+// validateConcurrency checks that each concurrency limit is valid and is of
+// an endpoint of the server
+func (s *Server) validateConcurrency(v configValidator) {
+	paths := s.endpointPaths()
+	for path, limit := range s.Config.Concurrency {
+		path = strings.Trim(path, "/")
+		setting := "concurrency." + path
+		if !paths[path] {
+			v.addf(setting, "'%s' is not an endpoint of the server", path)
+		}
+		_, err := checkConcurrencyLimit(path, limit)
+		if err != nil {
+			v.add(setting, err)
+		}
+	}
+}
+
+// endpointPaths returns the paths at which the endpoints of the server's API
+// are registered, without the leading '/' or API prefix
+func (s *Server) endpointPaths() map[string]bool {
+	scratch := &Server{Config: s.Config}
+	scratch.registerHandlers()
+	paths := map[string]bool{}
+	scratch.mux.Walk(func(route *gmux.Route, router *gmux.Router, ancestors []*gmux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		prefix := s.basePath() + apiPathPrefix
+		if err == nil && strings.HasPrefix(tpl, prefix) {
+			paths[strings.TrimPrefix(tpl, prefix)] = true
+		}
+		return nil
+	})
+	return paths
+}
+
+// validateListeners checks the addresses of the server's listeners
+func (s *Server) validateListeners(v configValidator) {
+	c := s.Config
+	for _, addr := range c.Listeners.Addresses {
+		if _, ok := unixSocketPath(addr); ok {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			v.addf("listeners.addresses", "Invalid address '%s': %s", addr, err)
+		}
+	}
+	if c.Operations.ListenAddress != "" {
+		if _, _, err := net.SplitHostPort(c.Operations.ListenAddress); err != nil {
+			v.addf("operations.listenaddress", "Invalid address '%s': %s", c.Operations.ListenAddress, err)
+		}
+	}
+	if c.GRPC.ListenAddress != "" {
+		if _, _, err := net.SplitHostPort(c.GRPC.ListenAddress); err != nil {
+			v.addf("grpc.listenaddress", "Invalid address '%s': %s", c.GRPC.ListenAddress, err)
+		}
+	}
+	if err := checkProfilingConfig(c); err != nil {
+		v.add("profiling.operations", err)
+	}
+	if err := checkAdminConfig(c); err != nil {
+		v.add("admin", err)
+	}
+}
+
+// validateTLS checks the TLS settings of the server's listening port
+func (s *Server) validateTLS(v configValidator) {
+	c := &s.Config.TLS
+	if !c.Enabled {
+		return
+	}
+	err := absTLSServer(c, s.HomeDir)
+	if err != nil {
+		v.add("tls", err)
+		return
+	}
+	if isTLSVaultRef(c) {
+		if err = checkTLSVaultRef(c); err != nil {
+			v.add("tls.keyfile", err)
+		} else if _, err = s.loadTLSKeyPair(c); err != nil {
+			v.add("tls.certfile", err)
+		}
+	} else if c.KeyFile != "" && !util.FileExists(c.KeyFile) {
+		v.addf("tls.keyfile", "File specified by 'tls.keyfile' does not exist: %s", c.KeyFile)
+	} else if c.KeyFile != "" && !util.FileExists(c.CertFile) {
+		v.addf("tls.certfile", "File specified by 'tls.certfile' does not exist: %s", c.CertFile)
+	} else if util.FileExists(c.CertFile) {
+		// A certificate which does not exist is generated when the server starts
+		_, err = util.LoadX509KeyPair(c.CertFile, c.KeyFile, s.csp)
+		if err != nil {
+			v.add("tls.certfile", err)
+		}
+	}
+
+	authType := c.ClientAuth.Type
+	if authType == "" {
+		authType = defaultClientAuth
+	}
+	clientAuth, ok := clientAuthTypes[strings.ToLower(authType)]
+	if !ok {
+		v.addf("tls.clientauth.type", "Invalid client auth type '%s'", authType)
+	}
+	verifyClientCert := clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert
+	if verifyClientCert && len(c.ClientAuth.CertFiles) == 0 {
+		v.addf("tls.clientauth.certfiles", "Client authentication type '%s' requires trusted certificate files", authType)
+	}
+	if clientAuth != tls.NoClientCert && len(c.ClientAuth.CertFiles) > 0 {
+		if _, err = LoadPEMCertPool(c.ClientAuth.CertFiles); err != nil {
+			v.add("tls.clientauth.certfiles", err)
+		}
+	}
+	minVersion, err := stls.GetVersion(c.MinVersion, tls.VersionTLS12)
+	if err != nil {
+		v.add("tls.minversion", err)
+	}
+	maxVersion, err := stls.GetVersion(c.MaxVersion, tls.VersionTLS12)
+	if err != nil {
+		v.add("tls.maxversion", err)
+	}
+	if minVersion > maxVersion {
+		v.addf("tls.minversion", "The value of 'tls.minversion' (%s) is greater than 'tls.maxversion' (%s)", c.MinVersion, c.MaxVersion)
+	}
+	if _, err = stls.GetCipherSuites(c.CipherSuites); err != nil {
+		v.add("tls.ciphersuites", err)
+	}
+	if _, err = stls.GetCurvePreferences(c.CurvePreferences); err != nil {
+		v.add("tls.curvepreferences", err)
+	}
+}
+
+// validate checks the configuration of the CA, adding the problems found to
+// 'problems'
+func (ca *CA) validate(problems *[]ConfigProblem) {
+	v := configValidator{ca: ca.Config.CA.Name, problems: problems}
+	err := ca.initConfig()
+	if err != nil {
+		v.add("version", err)
+		return
+	}
+	err = ca.makeFileNamesAbsolute()
+	if err != nil {
+		v.add("ca", err)
+		return
+	}
+	cfg := ca.Config
+
+	// The BCCSP is required to check the key and to connect to the databases
+	// with TLS
+	ca.csp, err = util.InitBCCSP(&cfg.CSP, "", ca.HomeDir)
+	if err != nil {
+		v.add("bccsp", err)
+	} else {
+		ca.validateKeyMaterial(v)
+	}
+	if cfg.CSR.CA != nil && cfg.CSR.CA.Expiry != "" {
+		if _, err = time.ParseDuration(cfg.CSR.CA.Expiry); err != nil {
+			v.addf("csr.ca.expiry", "Invalid expiry '%s': %s", cfg.CSR.CA.Expiry, err)
+		}
+	}
+	ca.validateDB(v)
+	if cfg.Registry.MaxEnrollments < -1 {
+		v.addf("registry.maxenrollments", "Invalid value %d; must be -1 (unlimited), 0 (disabled) or greater", cfg.Registry.MaxEnrollments)
+	}
+	if cfg.CRL.Expiry < 0 {
+		v.addf("crl.expiry", "Invalid expiry %s; must not be negative", cfg.CRL.Expiry)
+	}
+	if cfg.Idempotency.Retention < 0 {
+		v.addf("idempotency.retention", "Invalid retention %s; must not be negative", cfg.Idempotency.Retention)
+	}
+	validateSigningProfile(v, "signing.default", cfg.Signing.Default)
+	names := make([]string, 0, len(cfg.Signing.Profiles))
+	for name := range cfg.Signing.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		validateSigningProfile(v, "signing.profiles."+name, cfg.Signing.Profiles[name])
+	}
+}
+
+// validateKeyMaterial checks the CA's key and certificate, if they exist;
+// those which do not exist are generated when the server is initialized
+func (ca *CA) validateKeyMaterial(v configValidator) {
+	certFile := ca.Config.CA.Certfile
+	keyFile := ca.Config.CA.Keyfile
+	if ca.Config.KMS.Enabled() {
+		ca.validateKMS(v)
+		return
+	}
+	if !util.FileExists(certFile) {
+		return
+	}
+	if util.FileExists(keyFile) {
+		if err := ca.validateCertAndKey(certFile, keyFile); err != nil {
+			v.add("ca.certfile", err)
+		}
+		return
+	}
+	// The key may be stored by BCCSP
+	_, _, _, err := util.GetSignerFromCertFile(certFile, ca.csp)
+	if err != nil {
+		v.addf("ca.keyfile", "Failed to find private key for certificate in '%s': %s", certFile, err)
+	}
+}
+
+// validateKMS checks that the CA's key can be got from the cloud KMS and that
+// the CA's certificate, if it exists, is that of the key
+func (ca *CA) validateKMS(v configValidator) {
+	err := ca.Config.KMS.Validate()
+	if err != nil {
+		v.add("kms", err)
+		return
+	}
+	s, err := kms.New(&ca.Config.KMS, nil)
+	if err != nil {
+		v.add("kms.keyid", err)
+		return
+	}
+	certFile := ca.Config.CA.Certfile
+	if !util.FileExists(certFile) {
+		return
+	}
+	cert, err := ca.validateCert(certFile)
+	if err != nil {
+		v.add("ca.certfile", err)
+		return
+	}
+	if !equalPublicKeys(cert.PublicKey, s.Public()) {
+		v.addf("ca.certfile", "The certificate in '%s' is not that of the %s KMS key '%s'", certFile, s.Provider(), s.KeyID())
+	}
+}
+
+// validateDB checks that the CA's user registry and certificate database can
+// be connected to
+func (ca *CA) validateDB(v configValidator) {
+	db := ca.Config.DB
+	if db.Type == "" {
+		db.Type = defaultDatabaseType
+	}
+	ds, err := ca.resolveSecret(db.Datasource)
+	if err != nil {
+		v.add("db.datasource", err)
+		return
+	}
+	db.Datasource = ds
+	if db.Type == defaultDatabaseType {
+		if db.Datasource == "" {
+			db.Datasource = "fabric-ca-server.db"
+		}
+		ds, err := util.MakeFileAbs(db.Datasource, ca.HomeDir)
+		if err != nil {
+			v.add("db.datasource", err)
+			return
+		}
+		db.Datasource = ds
+		if dir := filepath.Dir(ds); !util.FileExists(dir) {
+			v.addf("db.datasource", "The directory of the database '%s' does not exist", dir)
+			return
+		}
+	}
+	err = dbutil.Ping(db.Type, db.Datasource, &db.TLS, ca.csp)
+	if err != nil {
+		v.add("db", err)
+	}
+
+	if ca.Config.LDAP.Enabled {
+		client, err := ldap.NewClient(&ca.Config.LDAP, ca.csp)
+		if err == nil {
+			err = client.Ping()
+		}
+		if err != nil {
+			v.add("ldap", err)
+		}
+	}
+}
+
+// validateSigningProfile checks the expiry and usages of a signing profile
+func validateSigningProfile(v configValidator, setting string, p *config.SigningProfile) {
+	if p == nil {
+		return
+	}
+	if p.Expiry < 0 {
+		v.addf(setting+".expiry", "Invalid expiry %s; must be greater than 0", p.Expiry)
+	}
+	if len(p.Usage) == 0 {
+		v.addf(setting+".usage", "No key usages are specified")
+	}
+	for _, usage := range p.Usage {
+		_, ku := config.KeyUsage[usage]
+		_, eku := config.ExtKeyUsage[usage]
+		if !ku && !eku {
+			v.addf(setting+".usage", "Unknown key usage '%s'", usage)
+		}
+	}
+	if p.CAConstraint.MaxPathLen < 0 {
+		v.addf(setting+".caconstraint.maxpathlen", "Invalid value %d; must not be negative", p.CAConstraint.MaxPathLen)
+	}
+	log.Debugf("Validated signing profile '%s'", setting)
+}
@@ -0,0 +1,85 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+const validateFixtures = "../testdata/validate"
+
+func TestValidateConfig(t *testing.T) {
+	// The settings with problems in each fixture
+	fixtures := map[string][]string{
+		"valid.yaml":          {},
+		"mismatched-key.yaml": {"ca.certfile"},
+		"bad-signing.yaml": {"csr.ca.expiry", "signing.default.expiry",
+			"signing.profiles.ca.caconstraint.maxpathlen", "signing.profiles.tls.usage"},
+		"bad-db.yaml": {"db", "ldap", "registry.maxenrollments"},
+		"bad-server.yaml": {"api.sunset", "basepath", "concurrency.enrol", "concurrency.tcert", "listeners.addresses", "log",
+			"tls.clientauth.type", "tls.minversion"},
+	}
+	for fixture, expected := range fixtures {
+		problems := validateFixture(t, fixture)
+		settings := []string{}
+		for _, p := range problems {
+			settings = append(settings, p.Setting)
+		}
+		sort.Strings(settings)
+		assert.Equal(t, expected, settings, "Unexpected problems found in %s: %v", fixture, problems)
+	}
+}
+
+func TestValidateConfigProblem(t *testing.T) {
+	problems := validateFixture(t, "mismatched-key.yaml")
+	if assert.Len(t, problems, 1) {
+		p := problems[0]
+		assert.Equal(t, "mismatchedca", p.CA)
+		assert.Contains(t, p.Message, "Public key and private key do not match")
+		assert.Contains(t, p.String(), "CA 'mismatchedca': ca.certfile: ")
+	}
+}
+
+// validateFixture validates the configuration in the fixture 'name' in a
+// temporary home directory
+func validateFixture(t *testing.T, name string) []ConfigProblem {
+	testdata, err := filepath.Abs(filepath.Dir(validateFixtures))
+	util.FatalError(t, err, "Failed to get the testdata directory")
+	buf, err := ioutil.ReadFile(filepath.Join(validateFixtures, name))
+	util.FatalError(t, err, "Failed to read fixture")
+	homeDir, err := ioutil.TempDir("", "validate")
+	util.FatalError(t, err, "Failed to create home directory")
+	defer os.RemoveAll(homeDir)
+	cfgFile := filepath.Join(homeDir, "fabric-ca-server-config.yaml")
+	cfgYaml := os.Expand(string(buf), func(key string) string {
+		if key == "TESTDATA" {
+			return testdata
+		}
+		return "$" + key
+	})
+	err = ioutil.WriteFile(cfgFile, []byte(cfgYaml), 0644)
+	util.FatalError(t, err, "Failed to write config file")
+
+	cfg, err := readServerConfig(cfgFile, nil)
+	util.FatalError(t, err, "Failed to read fixture "+name)
+	srv := &Server{
+		HomeDir: homeDir,
+		Config:  cfg,
+		CA:      CA{Config: &cfg.CAcfg, ConfigFilePath: cfgFile},
+	}
+	problems := srv.Validate()
+	assert.False(t, util.FileExists(filepath.Join(homeDir, "fabric-ca-server.db")), "Validating should not create the database")
+	assert.False(t, util.FileExists(filepath.Join(homeDir, "ca-cert.pem")), "Validating should not create a CA certificate")
+	return problems
+}
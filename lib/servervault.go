@@ -0,0 +1,185 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"crypto/tls"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/lib/dbutil"
+	stls "github.com/hyperledger/fabric-ca/lib/tls"
+	"github.com/hyperledger/fabric-ca/lib/vault"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/pkg/errors"
+)
+
+// initVault logs in to the Vault server of the configuration, from which
+// the secrets referenced in the configuration are read
+func (s *Server) initVault() error {
+	if s.vault != nil {
+		s.vault.Stop()
+		s.vault = nil
+	}
+	cfg := &s.Config.Vault
+	if !cfg.Enabled() {
+		return nil
+	}
+	client, err := vault.New(cfg, s.HomeDir, nil)
+	if err != nil {
+		return err
+	}
+	client.OnRotate(s.vaultSecretRotated)
+	s.vault = client
+	log.Infof("Reading the secrets referenced in the configuration from Vault at %s", cfg.Address)
+	return nil
+}
+
+// resolveSecret returns 'value' with the references to secrets in Vault
+// which it contains replaced by the secrets
+func (s *Server) resolveSecret(value string) (string, error) {
+	if !vault.IsRef(value) {
+		return value, nil
+	}
+	if s.vault == nil {
+		return "", errors.New("A secret in Vault is referenced, but no Vault server is configured in 'vault.address'")
+	}
+	return s.vault.Resolve(value)
+}
+
+// resolveSecret returns 'value' with the references to secrets in Vault
+// which it contains replaced by the secrets
+func (ca *CA) resolveSecret(value string) (string, error) {
+	if !vault.IsRef(value) {
+		return value, nil
+	}
+	if ca.server == nil {
+		return "", errors.New("A secret in Vault is referenced, but no Vault server is configured in 'vault.address'")
+	}
+	return ca.server.resolveSecret(value)
+}
+
+// vaultSecretRotated reconnects the databases and reloads the TLS
+// certificate whose settings reference the secret at 'path', which was
+// read again from Vault with new credentials
+func (s *Server) vaultSecretRotated(path string) {
+	for _, ca := range s.caMap {
+		if referencesPath(ca.Config.DB.Datasource, path) {
+			ca.reconnectDB()
+		}
+	}
+	c := &s.Config.TLS
+	if s.tlsCertReloader != nil && (referencesPath(c.CertFile, path) || referencesPath(c.KeyFile, path)) {
+		s.reloadMutex.Lock()
+		defer s.reloadMutex.Unlock()
+		err := s.tlsCertReloader.Reload()
+		if err != nil {
+			log.Errorf("Failed to reload the TLS certificate from Vault; continuing to use the current certificate: %s", err)
+		} else {
+			log.Info("Reloaded the TLS certificate from Vault")
+		}
+	}
+}
+
+// referencesPath returns true if 'value' references the secret in Vault at 'path'
+func referencesPath(value, path string) bool {
+	for _, p := range vault.Paths(value) {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// reconnectDB makes the CA's database open its new connections with the
+// credentials read again from Vault
+func (ca *CA) reconnectDB() {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	if ca.db == nil {
+		return
+	}
+	next, err := ca.openDB()
+	if err == nil {
+		err = ca.db.Reconnect(next)
+	}
+	if err != nil {
+		log.Errorf("Failed to reconnect the database of CA '%s' with the credentials read again from Vault: %s", ca.Config.CA.Name, err)
+		return
+	}
+	ca.limitConnLifetime(ca.db)
+	log.Infof("Reconnected the database of CA '%s' with the credentials read again from Vault", ca.Config.CA.Name)
+}
+
+// limitConnLifetime limits the lifetime of the connections of 'db' to a
+// quarter of the lease of the credentials in its datasource, if Vault leases
+// them, so that they are closed well before the credentials expire
+func (ca *CA) limitConnLifetime(db *dbutil.DB) {
+	if ca.server == nil || ca.server.vault == nil {
+		return
+	}
+	lease := ca.server.vault.LeaseDuration(ca.Config.DB.Datasource)
+	if lease > 0 {
+		db.SetConnMaxLifetime(lease / 4)
+	}
+}
+
+// loadTLSKeyPair loads the certificate and key of the TLS listening
+// endpoint, which are either files or PEM read from Vault
+func (s *Server) loadTLSKeyPair(c *stls.ServerTLSConfig) (*tls.Certificate, error) {
+	if !isTLSVaultRef(c) {
+		return util.LoadX509KeyPair(c.CertFile, c.KeyFile, s.csp)
+	}
+	certPEM, err := s.resolveSecret(c.CertFile)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to read 'tls.certfile' from Vault")
+	}
+	keyPEM, err := s.resolveSecret(c.KeyFile)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to read 'tls.keyfile' from Vault")
+	}
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid TLS certificate and key read from Vault")
+	}
+	return &cert, nil
+}
+
+// isTLSVaultRef returns true if the certificate and key of the TLS
+// listening endpoint are read from Vault
+func isTLSVaultRef(c *stls.ServerTLSConfig) bool {
+	return vault.IsRef(c.CertFile) || vault.IsRef(c.KeyFile)
+}
+
+// absTLSServer makes the file names of 'c' absolute, except the certificate
+// and key if they are read from Vault
+func absTLSServer(c *stls.ServerTLSConfig, homeDir string) error {
+	if !isTLSVaultRef(c) {
+		return stls.AbsTLSServer(c, homeDir)
+	}
+	certFile, keyFile := c.CertFile, c.KeyFile
+	err := stls.AbsTLSServer(c, homeDir)
+	c.CertFile, c.KeyFile = certFile, keyFile
+	return err
+}
+
+// checkTLSVaultRef checks that the certificate and key of the TLS listening
+// endpoint are both read from Vault if either is
+func checkTLSVaultRef(c *stls.ServerTLSConfig) error {
+	if isTLSVaultRef(c) && !(vault.IsRef(c.CertFile) && vault.IsRef(c.KeyFile)) {
+		return errors.New("'tls.certfile' and 'tls.keyfile' must both reference secrets in Vault if either does")
+	}
+	return nil
+}
+
+// checkVault reports the failure to renew the lease of a secret read from
+// Vault before it expires
+func (s *Server) checkVault() error {
+	if s.vault == nil {
+		return nil
+	}
+	return s.vault.Check()
+}
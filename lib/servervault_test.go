@@ -0,0 +1,152 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/lib/vault"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+const testVaultToken = "s.testtoken"
+
+// vaultStub is a stub of Vault which holds the TLS certificate and key of
+// the server at secret/data/tls, and leases the name of the server's
+// database file at database/creds/ca; the name changes each time the lease
+// can't be renewed
+type vaultStub struct {
+	mutex     sync.Mutex
+	tls       map[string]interface{}
+	creds     int
+	failReads bool
+}
+
+func (s *vaultStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if r.Header.Get("X-Vault-Token") != testVaultToken {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errors":["permission denied"]}`))
+		return
+	}
+	var resp interface{}
+	switch strings.TrimPrefix(r.URL.Path, "/v1/") {
+	case "auth/token/lookup-self":
+		resp = map[string]interface{}{"data": map[string]interface{}{"ttl": 3600, "renewable": true}}
+	case "secret/data/tls":
+		resp = map[string]interface{}{"data": map[string]interface{}{"data": s.tls, "metadata": map[string]interface{}{}}}
+	case "database/creds/ca":
+		if s.failReads {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"errors":["Vault is sealed"]}`))
+			return
+		}
+		s.creds++
+		resp = map[string]interface{}{
+			"lease_id": fmt.Sprintf("database/creds/ca/%d", s.creds), "lease_duration": 1, "renewable": true,
+			"data": map[string]interface{}{"file": fmt.Sprintf("ca%d.db", s.creds)}}
+	case "sys/leases/renew":
+		// The lease can't be extended, so the credentials are read again
+		resp = map[string]interface{}{"lease_duration": 0}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors":[]}`))
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func TestServerVault(t *testing.T) {
+	certPEM, err := ioutil.ReadFile("../testdata/tls_server-cert.pem")
+	util.FatalError(t, err, "Failed to read the TLS certificate")
+	keyPEM, err := ioutil.ReadFile("../testdata/tls_server-key.pem")
+	util.FatalError(t, err, "Failed to read the TLS key")
+	stub := &vaultStub{tls: map[string]interface{}{"cert": string(certPEM), "key": string(keyPEM)}}
+	vaultSrv := httptest.NewServer(stub)
+	defer vaultSrv.Close()
+
+	// A reference to a secret fails the start if no Vault server is configured
+	srv := TestGetRootServer(t)
+	defer os.RemoveAll(rootDir)
+	srv.CA.Config.DB.Datasource = "vault:database/creds/ca#file"
+	err = srv.Start()
+	util.ErrorContains(t, err, "no Vault server is configured", "A reference to Vault should fail without a Vault server")
+	srv.Config.Vault = vault.Config{Address: vaultSrv.URL, Token: "s.wrong"}
+	err = srv.Start()
+	util.ErrorContains(t, err, "permission denied", "A wrong Vault token should fail the start")
+
+	// The TLS certificate and key and the database are read from Vault
+	srv = TestGetRootServer(t)
+	srv.Config.Vault = vault.Config{Address: vaultSrv.URL, Token: testVaultToken}
+	srv.Config.TLS.Enabled = true
+	srv.Config.TLS.CertFile = "vault:secret/data/tls#cert"
+	srv.Config.TLS.KeyFile = "vault:secret/data/tls#key"
+	srv.CA.Config.DB.Datasource = "vault:database/creds/ca#file"
+	assert.Empty(t, srv.Validate(), "The configuration with secrets in Vault should be valid")
+	err = srv.Start()
+	util.FatalError(t, err, "Failed to start the server with secrets in Vault")
+	defer srv.Stop()
+	assert.Equal(t, "vault:secret/data/tls#cert", srv.Config.TLS.CertFile, "A reference should not be made a file name")
+
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := httpClient.Get(fmt.Sprintf("https://localhost:%d/api/v1/cainfo", rootPort))
+	util.FatalError(t, err, "Failed to get the CA info over TLS")
+	resp.Body.Close()
+	block, _ := pem.Decode(certPEM)
+	if assert.NotEmpty(t, resp.TLS.PeerCertificates) {
+		assert.True(t, bytes.Equal(block.Bytes, resp.TLS.PeerCertificates[0].Raw), "The TLS certificate should be that read from Vault")
+	}
+	// The file name of the database is that of the credentials last read
+	dbFile := func() string {
+		stub.mutex.Lock()
+		defer stub.mutex.Unlock()
+		return filepath.Join(srv.HomeDir, fmt.Sprintf("ca%d.db", stub.creds))
+	}
+	firstDB := dbFile()
+	assert.True(t, util.FileExists(firstDB), "The database should be that read from Vault")
+	_, err = srv.CA.registry.GetUser("admin", nil)
+	assert.NoError(t, err, "The bootstrap identity should be in the database")
+
+	// The CA reconnects to the database of the credentials read again when
+	// their lease can't be renewed
+	time.Sleep(time.Second)
+	srv.vault.Renew()
+	assert.NotEqual(t, firstDB, dbFile())
+	assert.True(t, util.FileExists(dbFile()), "The database should be reconnected with the new credentials")
+	_, err = srv.CA.registry.GetUser("admin", nil)
+	assert.Error(t, err, "The identities should be read from the reconnected database")
+	assert.NoError(t, srv.checkVault())
+
+	// The health check reports the failure to read them again
+	stub.mutex.Lock()
+	stub.failReads = true
+	stub.mutex.Unlock()
+	time.Sleep(time.Second)
+	srv.vault.Renew()
+	err = srv.checkVault()
+	util.ErrorContains(t, err, "Vault is sealed", "A failed renewal should fail the health check")
+	names := []string{}
+	for _, c := range srv.healthChecks() {
+		names = append(names, c.name)
+	}
+	assert.Contains(t, names, "vault")
+}
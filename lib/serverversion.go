@@ -0,0 +1,58 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"net/http"
+	"runtime"
+
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib/metadata"
+)
+
+const (
+	// versionHeader is the response header containing the release version
+	// of the server
+	versionHeader = "X-Fabric-CA-Version"
+	// apiVersionHeader is the response header containing the version of the
+	// REST API of the endpoint
+	apiVersionHeader = "X-Fabric-CA-API-Version"
+)
+
+func newVersionEndpoint(s *Server) *serverEndpoint {
+	return &serverEndpoint{
+		Methods: []string{"GET"},
+		Handler: versionHandler,
+		Server:  s,
+		docs: map[string]operationDoc{
+			"GET": {summary: "Get the version of the server", response: &api.VersionResponse{}},
+		},
+	}
+}
+
+// Handle a request for the version of the server, which requires no
+// authentication
+func versionHandler(ctx *serverRequestContextImpl) (interface{}, error) {
+	return &api.VersionResponse{
+		Version:     metadata.GetVersion(),
+		APIVersion:  metadata.APIVersion,
+		APIVersions: metadata.APIVersions,
+		Commit:      metadata.Commit,
+		BuildDate:   metadata.BuildDate,
+		GoVersion:   runtime.Version(),
+	}, nil
+}
+
+// addVersionHeaders adds the version headers to each response of 'next'
+func addVersionHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(versionHeader, metadata.GetVersion())
+		w.Header().Set(apiVersionHeader, metadata.APIVersion)
+		w.Header().Set(apiVersionsHeader, apiVersionsHeaderValue())
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,266 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib/common"
+	"github.com/hyperledger/fabric-ca/lib/logging"
+	"github.com/hyperledger/fabric-ca/lib/metadata"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// stubVersion sets the version variables to test values and returns a
+// function which restores them
+func stubVersion() func() {
+	version, commit, buildDate := metadata.Version, metadata.Commit, metadata.BuildDate
+	metadata.Version = "1.3.1-test"
+	metadata.Commit = "abc1234"
+	metadata.BuildDate = "2018-09-01T12:00:00Z"
+	return func() {
+		metadata.Version, metadata.Commit, metadata.BuildDate = version, commit, buildDate
+	}
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	defer stubVersion()()
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+	}()
+
+	for _, path := range []string{"/api/v1/cfssl/version", "/cfssl/version"} {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d%s", rootPort, path))
+		util.FatalError(t, err, "Failed to get "+path)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		util.FatalError(t, err, "Failed to read response")
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "The version endpoint should not require authentication")
+		var result struct {
+			Result api.VersionResponse
+		}
+		err = json.Unmarshal(body, &result)
+		util.FatalError(t, err, "Failed to parse response")
+		assert.Equal(t, "1.3.1-test", result.Result.Version)
+		assert.Equal(t, metadata.APIVersion, result.Result.APIVersion)
+		assert.Equal(t, "abc1234", result.Result.Commit)
+		assert.Equal(t, "2018-09-01T12:00:00Z", result.Result.BuildDate)
+		assert.NotEmpty(t, result.Result.GoVersion)
+	}
+
+	// Every response has the version headers
+	for _, path := range []string{"/api/v1/cainfo", "/api/v1/enroll", "/healthz", "/no/such/path"} {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d%s", rootPort, path))
+		util.FatalError(t, err, "Failed to get "+path)
+		resp.Body.Close()
+		assert.Equal(t, "1.3.1-test", resp.Header.Get(versionHeader), "The response for %s should have the version header", path)
+		assert.Equal(t, metadata.APIVersion, resp.Header.Get(apiVersionHeader), "The response for %s should have the API version header", path)
+	}
+}
+
+func TestClientServerVersionMismatch(t *testing.T) {
+	logDir, err := ioutil.TempDir("", "version")
+	util.FatalError(t, err, "Failed to create temp directory")
+	defer os.RemoveAll(logDir)
+	logFile := filepath.Join(logDir, "client.log")
+	err = logging.Configure(&logging.Config{File: logFile}, "")
+	util.FatalError(t, err, "Failed to configure logging")
+	defer func() {
+		logging.Configure(&logging.Config{}, "")
+		logging.SetLevel(log.LevelInfo)
+	}()
+
+	apiVersion := metadata.APIVersion
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(versionHeader, "2.0.0")
+		w.Header().Set(apiVersionHeader, apiVersion)
+		w.Write([]byte(`{"success":true,"result":{"CAName":"ca"},"errors":[],"messages":[]}`))
+	}))
+	defer srv.Close()
+	c := &Client{Config: &ClientConfig{URL: srv.URL}, HomeDir: filepath.Join(logDir, "client")}
+
+	// The same API version is compatible
+	_, err = c.GetCAInfo(&api.GetCAInfoRequest{})
+	util.FatalError(t, err, "Failed to get CA info")
+	assert.True(t, c.serverVersionChecked)
+	offset := logFileSize(t, logFile)
+	assert.NotContains(t, readLogFrom(t, logFile, 0), "differs", "No warning is expected for the same API version")
+
+	// A different API version is warned about once, without failing the request
+	apiVersion = "v2"
+	c.serverVersionChecked = false
+	_, err = c.GetCAInfo(&api.GetCAInfoRequest{})
+	assert.NoError(t, err, "An API version mismatch should not fail the request")
+	warning := readLogFrom(t, logFile, offset)
+	assert.Contains(t, warning, "[WARNING]")
+	assert.Contains(t, warning, "The API version of the server (v2, version 2.0.0) differs from the API version of this client")
+	offset = logFileSize(t, logFile)
+	_, err = c.GetCAInfo(&api.GetCAInfoRequest{})
+	assert.NoError(t, err)
+	assert.NotContains(t, readLogFrom(t, logFile, offset), "differs", "The mismatch should only be warned about once")
+}
+
+func TestAPIVersions(t *testing.T) {
+	defer os.RemoveAll(rootDir)
+	srv := TestGetServer(0, rootDir, "", -1, t)
+	srv.Config.API.Sunset = "2027-06-30"
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer srv.Stop()
+	url := srv.ListenAddresses().URL
+
+	c := &Client{Config: &ClientConfig{URL: url}, InMemory: true}
+	err = c.Init()
+	util.FatalError(t, err, "Failed to initialize client")
+	csrPEM, _, err := c.GenCSR(nil, "admin")
+	util.FatalError(t, err, "Failed to generate CSR")
+	body, err := json.Marshal(map[string]string{"certificate_request": string(csrPEM)})
+	util.FatalError(t, err, "Failed to marshal the enroll request")
+	enroll := func(path string, result interface{}) http.Header {
+		req, err := http.NewRequest("POST", url+path, bytes.NewReader(body))
+		util.FatalError(t, err, "Failed to create the enroll request")
+		req.SetBasicAuth("admin", "adminpw")
+		resp, err := http.DefaultClient.Do(req)
+		util.FatalError(t, err, "Failed to post to "+path)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode, "The enrollment with %s should succeed", path)
+		err = json.NewDecoder(resp.Body).Decode(&struct{ Result interface{} }{result})
+		util.FatalError(t, err, "Failed to parse the response of "+path)
+		return resp.Header
+	}
+
+	// The v1 and v2 enroll endpoints are served at the same time, and the
+	// v1 endpoint is deprecated
+	for _, path := range []string{"/api/v1/enroll", "/enroll"} {
+		var result common.EnrollmentResponseNet
+		header := enroll(path, &result)
+		assert.NotEmpty(t, result.Cert, "The v1 response should have the base64 encoded certificate")
+		assert.NotEmpty(t, result.ServerInfo.CAChain)
+		assert.Equal(t, "v1", header.Get(apiVersionHeader))
+		assert.Equal(t, "v1, v2", header.Get(apiVersionsHeader))
+		assert.Equal(t, "true", header.Get(deprecationHeader), "The v1 enroll endpoint should be deprecated")
+		assert.Equal(t, "Wed, 30 Jun 2027 00:00:00 GMT", header.Get(sunsetHeader))
+		assert.Equal(t, `</api/v2/enroll>; rel="successor-version"`, header.Get("Link"))
+	}
+	var result common.EnrollmentResponseNetV2
+	header := enroll("/api/v2/enroll", &result)
+	assert.Equal(t, "v2", header.Get(apiVersionHeader))
+	assert.Empty(t, header.Get(deprecationHeader), "The v2 enroll endpoint should not be deprecated")
+	cert, err := util.GetX509CertificateFromPEM([]byte(result.Certificate))
+	if assert.NoError(t, err, "The v2 response should have the PEM-encoded certificate") {
+		assert.Equal(t, "admin", cert.Subject.CommonName)
+		assert.Equal(t, util.GetSerialAsHex(cert.SerialNumber), result.SerialNumber)
+		assert.Equal(t, cert.NotAfter.UTC().Format(time.RFC3339), result.NotAfter)
+	}
+	if assert.Len(t, result.CA.Chain, 1, "The CA chain should have the root certificate") {
+		_, err = util.GetX509CertificateFromPEM([]byte(result.CA.Chain[0]))
+		assert.NoError(t, err, "The CA chain should be PEM-encoded")
+	}
+	assert.Equal(t, metadata.GetVersion(), result.CA.Version)
+
+	// An endpoint which is not superseded is not deprecated, and the CA
+	// information has the API versions
+	info, err := c.GetCAInfo(&api.GetCAInfoRequest{})
+	util.FatalError(t, err, "Failed to get CA info")
+	assert.Equal(t, metadata.APIVersions, info.APIVersions)
+	resp, err := http.Get(url + "/api/v1/cainfo")
+	util.FatalError(t, err, "Failed to get CA info")
+	resp.Body.Close()
+	assert.Empty(t, resp.Header.Get(deprecationHeader), "The cainfo endpoint should not be deprecated")
+	var version struct {
+		Result api.VersionResponse
+	}
+	resp, err = http.Get(url + "/api/v1/cfssl/version")
+	util.FatalError(t, err, "Failed to get the version")
+	err = json.NewDecoder(resp.Body).Decode(&version)
+	resp.Body.Close()
+	util.FatalError(t, err, "Failed to parse the version")
+	assert.Equal(t, metadata.APIVersions, version.Result.APIVersions)
+}
+
+func TestClientAPIVersionNegotiation(t *testing.T) {
+	defer os.RemoveAll(rootDir)
+	srv := TestGetServer(0, rootDir, "", -1, t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer srv.Stop()
+	target, err := url.Parse(srv.ListenAddresses().URL)
+	util.FatalError(t, err, "Failed to parse the URL of the server")
+
+	// The proxy records the paths of the requests and, if 'v1Only' is set,
+	// stands for a server which only serves v1 and doesn't report its API
+	// versions
+	var paths []string
+	v1Only := false
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if v1Only {
+			resp.Header.Del(apiVersionsHeader)
+			resp.Header.Del(apiVersionHeader)
+		}
+		return nil
+	}
+	ps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if v1Only && strings.HasPrefix(r.URL.Path, "/api/v2/") {
+			http.NotFound(w, r)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer ps.Close()
+	enroll := func(c *Client) {
+		resp, err := c.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+		util.FatalError(t, err, "Failed to enroll")
+		assert.Equal(t, "admin", resp.Identity.GetECert().GetX509Cert().Subject.CommonName)
+		assert.NotEmpty(t, resp.CAInfo.CAChain, "The enrollment response should have the CA chain")
+	}
+
+	// The client enrolls with the v2 endpoint of a server which serves it
+	c := &Client{Config: &ClientConfig{URL: ps.URL}, InMemory: true}
+	enroll(c)
+	assert.Equal(t, []string{"/api/v2/enroll"}, paths)
+
+	// and falls back to the v1 endpoint of a server which doesn't, which it
+	// remembers
+	v1Only = true
+	paths = nil
+	c = &Client{Config: &ClientConfig{URL: ps.URL}, InMemory: true}
+	enroll(c)
+	assert.Equal(t, []string{"/api/v2/enroll", "/enroll"}, paths)
+	paths = nil
+	enroll(c)
+	assert.Equal(t, []string{"/enroll"}, paths, "The client should remember that the server does not serve v2")
+
+	// An error of the v2 endpoint is not mistaken for a server which does
+	// not serve it
+	v1Only = false
+	paths = nil
+	c = &Client{Config: &ClientConfig{URL: ps.URL}, InMemory: true}
+	_, err = c.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw", CAName: "nosuchca"})
+	util.ErrorContains(t, err, "does not exist", "The enrollment with an unknown CA should fail")
+	assert.Equal(t, []string{"/api/v2/enroll"}, paths)
+}
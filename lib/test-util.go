@@ -20,15 +20,19 @@ import (
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -239,3 +243,91 @@ func TestGetClient(port int, home string) *Client {
 		HomeDir: home,
 	}
 }
+
+// TestEventReceiver is a webhook which records the events sent to it by the
+// event subscriptions of a server
+type TestEventReceiver struct {
+	*httptest.Server
+	// Secret with which the signature of each event is verified; if empty,
+	// the signatures are not verified
+	Secret   string
+	mutex    sync.Mutex
+	failures int
+	attempts int
+	events   []*Event
+}
+
+// NewTestEventReceiver returns a started receiver which verifies the
+// signatures of the events with 'secret'
+func NewTestEventReceiver(secret string) *TestEventReceiver {
+	r := &TestEventReceiver{Secret: secret}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.receive))
+	return r
+}
+
+// FailNext makes the receiver fail the next 'n' requests with a 503 response
+func (r *TestEventReceiver) FailNext(n int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.failures = n
+}
+
+// Attempts returns the number of requests received, including those which failed
+func (r *TestEventReceiver) Attempts() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.attempts
+}
+
+// Events returns the events received, without duplicates
+func (r *TestEventReceiver) Events() []*Event {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]*Event{}, r.events...)
+}
+
+// WaitForEvents waits up to 'timeout' for 'n' events to be received and
+// returns the events received
+func (r *TestEventReceiver) WaitForEvents(n int, timeout time.Duration) []*Event {
+	deadline := time.Now().Add(timeout)
+	for {
+		events := r.Events()
+		if len(events) >= n || time.Now().After(deadline) {
+			return events
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (r *TestEventReceiver) receive(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.attempts++
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if r.Secret != "" && !VerifyEventSignature(r.Secret, body, req.Header.Get(EventSignatureHeader)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	e := new(Event)
+	err = json.Unmarshal(body, e)
+	if err != nil || e.ID != req.Header.Get(EventIDHeader) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, prev := range r.events {
+		if prev.ID == e.ID {
+			// A redelivery of an event which was already received
+			return
+		}
+	}
+	r.events = append(r.events, e)
+}
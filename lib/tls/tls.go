@@ -17,9 +17,14 @@ limitations under the License.
 package tls
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -40,12 +45,32 @@ var DefaultCipherSuites = []uint16{
 	tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
 }
 
+// tlsVersions maps the configurable TLS version names to their values
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// curves maps the configurable elliptic curve names to their IDs
+var curves = map[string]tls.CurveID{
+	"p256":   tls.CurveP256,
+	"p384":   tls.CurveP384,
+	"p521":   tls.CurveP521,
+	"x25519": tls.X25519,
+}
+
 // ServerTLSConfig defines key material for a TLS server
 type ServerTLSConfig struct {
-	Enabled    bool   `help:"Enable TLS on the listening port"`
-	CertFile   string `def:"tls-cert.pem" help:"PEM-encoded TLS certificate file for server's listening port"`
-	KeyFile    string `help:"PEM-encoded TLS key for server's listening port"`
-	ClientAuth ClientAuth
+	Enabled          bool     `help:"Enable TLS on the listening port"`
+	CertFile         string   `def:"tls-cert.pem" help:"PEM-encoded TLS certificate file for server's listening port"`
+	KeyFile          string   `help:"PEM-encoded TLS key for server's listening port"`
+	MinVersion       string   `def:"1.2" help:"Minimum TLS version accepted on the listening port (1.0, 1.1, 1.2, or 1.3)"`
+	MaxVersion       string   `def:"1.2" help:"Maximum TLS version accepted on the listening port (1.0, 1.1, 1.2, or 1.3)"`
+	CipherSuites     []string `help:"A list of comma-separated TLS cipher suite names (e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256)"`
+	CurvePreferences []string `help:"A list of comma-separated elliptic curves in order of preference (P256, P384, P521, X25519)"`
+	ClientAuth       ClientAuth
 }
 
 // ClientAuth defines the key material needed to verify client certificates
@@ -56,9 +81,11 @@ type ClientAuth struct {
 
 // ClientTLSConfig defines the key material for a TLS client
 type ClientTLSConfig struct {
-	Enabled   bool     `skip:"true"`
-	CertFiles []string `help:"A list of comma-separated PEM-encoded trusted certificate files (e.g. root1.pem,root2.pem)"`
-	Client    KeyCertFiles
+	Enabled    bool     `skip:"true"`
+	CertFiles  []string `help:"A list of comma-separated PEM-encoded trusted certificate files (e.g. root1.pem,root2.pem)"`
+	ServerName string   `help:"The name used to verify the server's TLS certificate, if it is not the host name of the server's URL"`
+	Insecure   bool     `help:"Skip verification of the server's TLS certificate; this is insecure and should only be used for testing"`
+	Client     KeyCertFiles
 }
 
 // KeyCertFiles defines the files need for client on TLS
@@ -94,6 +121,15 @@ func GetClientTLSConfig(cfg *ClientTLSConfig, csp bccsp.BCCSP) (*tls.Config, err
 	} else {
 		log.Debug("Client TLS certificate and/or key file not provided")
 	}
+	if cfg.Insecure {
+		log.Warning("Verification of the server's TLS certificate is disabled; the connection is not protected against man-in-the-middle attacks")
+		return &tls.Config{
+			Certificates:       certs,
+			ServerName:         cfg.ServerName,
+			InsecureSkipVerify: true,
+		}, nil
+	}
+
 	rootCAPool := x509.NewCertPool()
 	if len(cfg.CertFiles) == 0 {
 		return nil, errors.New("No trusted root certificates for TLS were provided")
@@ -113,11 +149,50 @@ func GetClientTLSConfig(cfg *ClientTLSConfig, csp bccsp.BCCSP) (*tls.Config, err
 	config := &tls.Config{
 		Certificates: certs,
 		RootCAs:      rootCAPool,
+		ServerName:   cfg.ServerName,
 	}
 
 	return config, nil
 }
 
+// DescribeVerificationError returns a description of the failure to verify
+// the server's TLS certificate which caused 'err', including the subject and
+// fingerprint of the certificate and how to resolve the failure, or an empty
+// string if 'err' was not caused by such a failure
+func DescribeVerificationError(err error) string {
+	cause := errors.Cause(err)
+	if ue, ok := cause.(*url.Error); ok {
+		cause = ue.Err
+	}
+	if cve, ok := cause.(*tls.CertificateVerificationError); ok {
+		cause = cve.Err
+	}
+	switch e := cause.(type) {
+	case x509.UnknownAuthorityError:
+		return fmt.Sprintf("The server's TLS certificate %s was not issued by a trusted CA; "+
+			"add the certificate of the CA which issued it to tls.certfiles", describeCert(e.Cert))
+	case x509.HostnameError:
+		return fmt.Sprintf("The server's TLS certificate %s is not valid for '%s'; "+
+			"connect to one of the names of the certificate or set tls.servername to one of them", describeCert(e.Certificate), e.Host)
+	case x509.CertificateInvalidError:
+		return fmt.Sprintf("The server's TLS certificate %s is invalid (%s)", describeCert(e.Cert), e.Error())
+	}
+	return ""
+}
+
+// describeCert returns the subject and SHA-256 fingerprint of 'cert'
+func describeCert(cert *x509.Certificate) string {
+	if cert == nil {
+		return "(unknown)"
+	}
+	sum := sha256.Sum256(cert.Raw)
+	fp := make([]string, len(sum))
+	for i, b := range sum {
+		fp[i] = fmt.Sprintf("%02X", b)
+	}
+	return fmt.Sprintf("with subject '%s' and SHA-256 fingerprint %s", cert.Subject, strings.Join(fp, ":"))
+}
+
 // AbsTLSClient makes TLS client files absolute
 func AbsTLSClient(cfg *ClientTLSConfig, configDir string) error {
 	var err error
@@ -168,6 +243,100 @@ func AbsTLSServer(cfg *ServerTLSConfig, configDir string) error {
 	return nil
 }
 
+// GetVersion returns the TLS version corresponding to 'version', or 'def'
+// if 'version' is empty
+func GetVersion(version string, def uint16) (uint16, error) {
+	if version == "" {
+		return def, nil
+	}
+	// A version of "1.0" in a YAML file is read as the number 1
+	if !strings.Contains(version, ".") {
+		version = version + ".0"
+	}
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, errors.Errorf("Invalid TLS version '%s'; expecting one of 1.0, 1.1, 1.2, or 1.3", version)
+	}
+	return v, nil
+}
+
+// GetCipherSuites returns the IDs of the named cipher suites; the
+// DefaultCipherSuites are returned if no names are specified.
+// Cipher suites which are known to be insecure are rejected.
+func GetCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return DefaultCipherSuites, nil
+	}
+	suites := map[string]uint16{}
+	for _, cs := range tls.CipherSuites() {
+		suites[cs.Name] = cs.ID
+	}
+	ids := []uint16{}
+	for _, name := range names {
+		id, ok := suites[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, errors.Errorf("Unsupported or insecure TLS cipher suite '%s'", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// GetCurvePreferences returns the IDs of the named elliptic curves in the order
+// specified, or nil if none are specified so that the Go defaults are used
+func GetCurvePreferences(names []string) ([]tls.CurveID, error) {
+	var ids []tls.CurveID
+	for _, name := range names {
+		id, ok := curves[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, errors.Errorf("Unsupported elliptic curve '%s'; expecting one of P256, P384, P521, or X25519", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// CertReloader holds a server's TLS certificate and allows it to be
+// replaced while the server is running, so that a renewed certificate
+// is picked up by new connections without a restart
+type CertReloader struct {
+	mutex sync.RWMutex
+	cert  *tls.Certificate
+	load  func() (*tls.Certificate, error)
+}
+
+// NewCertReloader returns a CertReloader which uses 'load' to load the
+// certificate; the certificate is loaded once before returning
+func NewCertReloader(load func() (*tls.Certificate, error)) (*CertReloader, error) {
+	cr := &CertReloader{load: load}
+	err := cr.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Reload loads the certificate again; the current certificate is kept
+// if loading fails
+func (cr *CertReloader) Reload() error {
+	cert, err := cr.load()
+	if err != nil {
+		return err
+	}
+	cr.mutex.Lock()
+	cr.cert = cert
+	cr.mutex.Unlock()
+	return nil
+}
+
+// GetCertificate returns the current certificate; it is suitable for
+// use as the GetCertificate callback of a tls.Config
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mutex.RLock()
+	defer cr.mutex.RUnlock()
+	return cr.cert, nil
+}
+
 func checkCertDates(certFile string) error {
 	log.Debug("Check client TLS certificate for valid dates")
 	certPEM, err := ioutil.ReadFile(certFile)
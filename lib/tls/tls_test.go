@@ -19,12 +19,18 @@ package tls
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -167,6 +173,159 @@ func TestCheckCertDates(t *testing.T) {
 	os.Remove("notbefore.pem")
 }
 
+func TestGetVersion(t *testing.T) {
+	v, err := GetVersion("", tls.VersionTLS12)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), v)
+	v, err = GetVersion("1.3", tls.VersionTLS12)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), v)
+	// YAML reads 1.0 as the number 1
+	v, err = GetVersion("1", tls.VersionTLS12)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS10), v)
+	_, err = GetVersion("3.0", tls.VersionTLS12)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Invalid TLS version '3.0'")
+}
+
+func TestGetCipherSuites(t *testing.T) {
+	suites, err := GetCipherSuites(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultCipherSuites, suites)
+	suites, err = GetCipherSuites([]string{"tls_ecdhe_ecdsa_with_aes_256_gcm_sha384", " TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, suites)
+	// RC4 is insecure and must be rejected
+	_, err = GetCipherSuites([]string{"TLS_ECDHE_RSA_WITH_RC4_128_SHA"})
+	assert.Error(t, err)
+	_, err = GetCipherSuites([]string{"bogus"})
+	assert.Error(t, err)
+}
+
+func TestGetCurvePreferences(t *testing.T) {
+	curves, err := GetCurvePreferences(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, curves)
+	curves, err = GetCurvePreferences([]string{"P384", "x25519"})
+	assert.NoError(t, err)
+	assert.Equal(t, []tls.CurveID{tls.CurveP384, tls.X25519}, curves)
+	_, err = GetCurvePreferences([]string{"P192"})
+	assert.Error(t, err)
+}
+
+func TestCertReloader(t *testing.T) {
+	certs := []string{"tls_server-cert.pem", "ec256-1-cert.pem"}
+	keys := []string{"tls_server-key.pem", "ec256-1-key.pem"}
+	idx := 0
+	cr, err := NewCertReloader(func() (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(configDir+"/"+certs[idx], configDir+"/"+keys[idx])
+		return &cert, err
+	})
+	assert.NoError(t, err)
+	first, err := cr.GetCertificate(nil)
+	assert.NoError(t, err)
+
+	idx = 1
+	err = cr.Reload()
+	assert.NoError(t, err)
+	second, err := cr.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.Certificate[0], second.Certificate[0], "Reload should have replaced the certificate")
+
+	// A failed reload keeps the current certificate, e.g. if the key
+	// no longer matches the certificate
+	keys[1] = keys[0]
+	err = cr.Reload()
+	assert.Error(t, err)
+	current, _ := cr.GetCertificate(nil)
+	assert.Equal(t, second, current)
+
+	// Initial load failure
+	_, err = NewCertReloader(func() (*tls.Certificate, error) {
+		return nil, errors.New("load failure")
+	})
+	assert.Error(t, err)
+}
+
+func TestClientTLSConfigWithServer(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+		}
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "tlsclient")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	serverCert := srv.Certificate()
+	serverCertFile := filepath.Join(dir, "server-cert.pem")
+	err = ioutil.WriteFile(serverCertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: serverCert.Raw}), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write the server's certificate: %s", err)
+	}
+	get := func(cfg *ClientTLSConfig) (string, error) {
+		tlsConfig, err := GetClientTLSConfig(cfg, nil)
+		if err != nil {
+			return "", err
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true}}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	// The pinned certificate of the server is trusted
+	_, err = get(&ClientTLSConfig{CertFiles: []string{serverCertFile}})
+	assert.NoError(t, err, "The server's certificate should be trusted")
+
+	// A certificate which is not issued by a trusted CA is rejected
+	_, err = get(&ClientTLSConfig{CertFiles: []string{filepath.Join(configDir, caCert)}})
+	if assert.Error(t, err, "The server's certificate should not be trusted") {
+		msg := DescribeVerificationError(err)
+		assert.Contains(t, msg, "was not issued by a trusted CA")
+		assert.Contains(t, msg, serverCert.Subject.String(), "The description should include the certificate's subject")
+		sum := sha256.Sum256(serverCert.Raw)
+		assert.Contains(t, msg, fmt.Sprintf("%02X:%02X:%02X", sum[0], sum[1], sum[2]), "The description should include the certificate's fingerprint")
+	}
+	assert.Empty(t, DescribeVerificationError(errors.New("connection refused")))
+
+	// The name of the server can be overridden
+	_, err = get(&ClientTLSConfig{CertFiles: []string{serverCertFile}, ServerName: "unknown.example.org"})
+	if assert.Error(t, err, "A name which is not in the server's certificate should fail") {
+		assert.Contains(t, DescribeVerificationError(err), "is not valid for 'unknown.example.org'")
+	}
+	_, err = get(&ClientTLSConfig{CertFiles: []string{serverCertFile}, ServerName: "example.com"})
+	assert.NoError(t, err, "A name in the server's certificate should be accepted")
+
+	// Verification is skipped only if explicitly requested
+	_, err = get(&ClientTLSConfig{Insecure: true})
+	assert.NoError(t, err, "The server's certificate should not be verified")
+
+	// The client's certificate is presented for mutual TLS
+	cfg := &ClientTLSConfig{
+		CertFiles: []string{serverCertFile},
+		Client:    KeyCertFiles{CertFile: certFile, KeyFile: keyFile},
+	}
+	err = AbsTLSClient(cfg, configDir)
+	if err != nil {
+		t.Fatalf("Failed to get absolute paths: %s", err)
+	}
+	cfg.CertFiles = []string{serverCertFile}
+	cn, err := get(cfg)
+	assert.NoError(t, err, "The request with a client certificate should succeed")
+	assert.Equal(t, "localhost", cn, "The server should receive the client's certificate")
+}
+
 func createTestCertificate() error {
 	// Dynamically create a certificate with future valid date for testing purposes
 	certTemplate := &x509.Certificate{
@@ -0,0 +1,92 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/hyperledger/fabric/bccsp"
+	"github.com/pkg/errors"
+)
+
+// The functions of this file let tools which send their own requests to the
+// fabric-ca-server, such as to endpoints which this client does not support
+// yet, create the token of the authorization header of the requests, and let
+// servers which embed this package verify it.
+//
+// The token is "<base64 certificate>.<base64 signature>", where the signature
+// is over "<base64 body>.<base64 certificate>" with the private key of the
+// certificate. The method and path of a request are not signed, so the token
+// of a request is the same at any endpoint. The body is the uncompressed
+// body, even if the request is sent with a gzip Content-Encoding, which the
+// server decompresses before verifying the token. Only ECDSA keys are
+// supported.
+
+// NewRequestToken returns the token of the authorization header of a request
+// with 'body', signed by the PEM-encoded private key 'keyPEM' of the
+// PEM-encoded certificate 'certPEM'. The key may be an EC private key or an
+// unencrypted PKCS #8 private key.
+func NewRequestToken(certPEM, keyPEM, body []byte) (string, error) {
+	csp := util.GetDefaultBCCSP()
+	key, err := util.ImportBCCSPKeyFromPEMBytes(keyPEM, csp, true)
+	if err != nil {
+		return "", errors.WithMessage(err, "Failed to import the private key of the token")
+	}
+	return util.CreateToken(csp, certPEM, key, body)
+}
+
+// SetRequestToken sets the authorization header of 'req' to the token of its
+// body, signed by the PEM-encoded private key 'keyPEM' of the PEM-encoded
+// certificate 'certPEM'. The body of the request is read and replaced.
+func SetRequestToken(req *http.Request, certPEM, keyPEM []byte) error {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return err
+	}
+	token, err := NewRequestToken(certPEM, keyPEM, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("authorization", token)
+	return nil
+}
+
+// VerifyRequestToken verifies the token of the authorization header of 'req'
+// with 'csp' and returns the certificate of the caller. Only the signature of
+// the token is verified; the caller must check that the certificate was
+// issued by a trusted CA and is not revoked. The body of the request is read
+// and replaced.
+func VerifyRequestToken(csp bccsp.BCCSP, req *http.Request) (*x509.Certificate, error) {
+	token := req.Header.Get("authorization")
+	if token == "" {
+		return nil, errors.New("The request has no authorization header")
+	}
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	return util.VerifyToken(csp, token, body)
+}
+
+// readRequestBody returns the body of 'req', which is replaced so that it can
+// be read again
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read the request body")
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
@@ -0,0 +1,203 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package lib
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	proto "github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-ca/lib/server/idemix"
+	"github.com/hyperledger/fabric-ca/util"
+	fidemix "github.com/hyperledger/fabric/idemix"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTokenKeyPair returns a PEM-encoded self-signed certificate and its
+// PEM-encoded private key
+func newTokenKeyPair(t *testing.T, priv crypto.Signer) ([]byte, []byte) {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "tokenuser"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, priv.Public(), priv)
+	util.FatalError(t, err, "Failed to create certificate")
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	util.FatalError(t, err, "Failed to marshal key")
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestNewRequestToken(t *testing.T) {
+	curves := []elliptic.Curve{elliptic.P256(), elliptic.P384()}
+	for _, curve := range curves {
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		util.FatalError(t, err, "Failed to generate key")
+		certPEM, keyPEM := newTokenKeyPair(t, priv)
+		body := []byte(`{"id":"user1"}`)
+
+		token, err := NewRequestToken(certPEM, keyPEM, body)
+		if !assert.NoError(t, err, "Failed to create a token with a %s key", curve.Params().Name) {
+			continue
+		}
+		// The token must be accepted by the verification of the server
+		cert, err := util.VerifyToken(util.GetDefaultBCCSP(), token, body)
+		if assert.NoError(t, err, "The server should accept the token of a %s key", curve.Params().Name) {
+			assert.Equal(t, "tokenuser", cert.Subject.CommonName)
+		}
+		_, err = util.VerifyToken(util.GetDefaultBCCSP(), token, []byte(`{"id":"user2"}`))
+		assert.Error(t, err, "The token should not be valid for another body")
+
+		// The token of util.CreateToken must be accepted by VerifyRequestToken
+		csp := util.GetDefaultBCCSP()
+		key, err := util.ImportBCCSPKeyFromPEMBytes(keyPEM, csp, true)
+		util.FatalError(t, err, "Failed to import key")
+		token, err = util.CreateToken(csp, certPEM, key, body)
+		util.FatalError(t, err, "Failed to create token")
+		req, err := http.NewRequest("POST", "http://localhost:7054/api/v1/register", bytes.NewReader(body))
+		util.FatalError(t, err, "Failed to create request")
+		req.Header.Set("authorization", token)
+		_, err = VerifyRequestToken(csp, req)
+		assert.NoError(t, err, "The token of util.CreateToken should be verified")
+	}
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	util.FatalError(t, err, "Failed to generate key")
+	certPEM, keyPEM := newTokenKeyPair(t, priv)
+	_, err = NewRequestToken(certPEM, keyPEM, nil)
+	assert.Error(t, err, "RSA keys are not supported")
+
+	ecPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	util.FatalError(t, err, "Failed to generate key")
+	_, ecKeyPEM := newTokenKeyPair(t, ecPriv)
+	_, err = util.CreateToken(util.GetDefaultBCCSP(), certPEM, nil, nil)
+	assert.Error(t, err, "A token should not be created for an RSA certificate")
+	_, err = NewRequestToken(certPEM, []byte("not a key"), nil)
+	assert.Error(t, err)
+	_, err = NewRequestToken([]byte("not a certificate"), ecKeyPEM, nil)
+	assert.Error(t, err)
+}
+
+func TestSetRequestToken(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	util.FatalError(t, err, "Failed to generate key")
+	certPEM, keyPEM := newTokenKeyPair(t, priv)
+	body := []byte(`{"id":"user1"}`)
+	req, err := http.NewRequest("POST", "http://localhost:7054/api/v1/identities", bytes.NewReader(body))
+	util.FatalError(t, err, "Failed to create request")
+
+	err = SetRequestToken(req, certPEM, keyPEM)
+	util.FatalError(t, err, "Failed to set the token")
+	cert, err := VerifyRequestToken(util.GetDefaultBCCSP(), req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "tokenuser", cert.Subject.CommonName)
+	}
+	buf, err := ioutil.ReadAll(req.Body)
+	util.FatalError(t, err, "Failed to read body")
+	assert.Equal(t, body, buf, "The body of the request should be readable after the token is verified")
+
+	// A GET request has no body
+	req, err = http.NewRequest("GET", "http://localhost:7054/api/v1/identities", nil)
+	util.FatalError(t, err, "Failed to create request")
+	err = SetRequestToken(req, certPEM, keyPEM)
+	util.FatalError(t, err, "Failed to set the token")
+	_, err = util.VerifyToken(util.GetDefaultBCCSP(), req.Header.Get("authorization"), nil)
+	assert.NoError(t, err)
+
+	req.Header.Del("authorization")
+	_, err = VerifyRequestToken(util.GetDefaultBCCSP(), req)
+	assert.Error(t, err, "A request with no authorization header should fail")
+}
+
+// panickingIssuer is an Idemix issuer whose verification of tokens panics
+type panickingIssuer struct {
+	idemix.Issuer
+}
+
+func (panickingIssuer) VerifyToken(authHdr string, body []byte) (string, error) {
+	panic("malformed token")
+}
+
+func TestTokenAuthenticationMalformed(t *testing.T) {
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer func() {
+		srv.Stop()
+		os.RemoveAll(rootDir)
+		os.RemoveAll(rootClientDir)
+	}()
+	client := TestGetRootClient()
+	eresp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	util.FatalError(t, err, "Failed to enroll 'admin'")
+	cert := util.B64Encode(eresp.Identity.GetECert().Cert())
+	truncatedSig, err := proto.Marshal(&fidemix.Signature{APrime: &fidemix.ECP{X: []byte{1}}})
+	util.FatalError(t, err, "Failed to marshal the signature")
+
+	httpClient := &http.Client{Transport: &http.Transport{}}
+	defer httpClient.CloseIdleConnections()
+	// authenticate sends a request with the authorization header 'authHdr'
+	// and checks that it fails the authentication
+	authenticate := func(authHdr string) {
+		u := fmt.Sprintf("http://localhost:%d/api/v1/identities/admin", rootPort)
+		req, err := http.NewRequest("GET", u, nil)
+		util.FatalError(t, err, "Failed to create request")
+		req.Header.Set("authorization", authHdr)
+		resp, err := httpClient.Do(req)
+		util.FatalError(t, err, "Failed to send request")
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		util.FatalError(t, err, "Failed to read response")
+		if assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "Token '%.64s' should fail the authentication: %s", authHdr, body) {
+			var envelope caerrors.ErrorResponse
+			err = json.Unmarshal(body, &envelope)
+			util.FatalError(t, err, "Failed to parse error envelope")
+			assert.Equal(t, caerrors.ErrAuthenticationFailure, envelope.Details.ErrorCode)
+		}
+	}
+
+	for _, authHdr := range []string{
+		"x",
+		"x.y",
+		"QQ=.QQ=",
+		util.B64Encode([]byte("-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n")) + ".MEUCIQ==",
+		strings.Repeat("A", 1<<17) + ".QQ==",
+		cert + ".",
+		cert + "." + strings.Repeat("A", 8192),
+		"idemix.1.admin.",
+		"idemix.1.admin.***",
+		"idemix.1.admin." + util.B64Encode(truncatedSig),
+	} {
+		authenticate(authHdr)
+	}
+
+	// A panic while an Idemix token is verified fails the authentication
+	issuer := srv.CA.issuer
+	srv.CA.issuer = panickingIssuer{}
+	defer func() { srv.CA.issuer = issuer }()
+	authenticate("idemix.1.admin.c2ln")
+}
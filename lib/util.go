@@ -7,6 +7,7 @@ SPDX-License-Identifier: Apache-2.0
 package lib
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
@@ -35,6 +36,10 @@ var clientAuthTypes = map[string]tls.ClientAuthType{
 	"requireanyclientcert":       tls.RequireAnyClientCert,
 	"verifyclientcertifgiven":    tls.VerifyClientCertIfGiven,
 	"requireandverifyclientcert": tls.RequireAndVerifyClientCert,
+	// Short aliases for the most commonly used types
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require-and-verify": tls.RequireAndVerifyClientCert,
 }
 
 // GetCertID returns both the serial number and AKI (Authority Key ID) for the certificate
@@ -61,6 +66,54 @@ func BytesToX509Cert(bytes []byte) (*x509.Certificate, error) {
 	return cert, err
 }
 
+// getVerifyOptions returns the options to verify a certificate issued by a
+// CA whose chain of PEM certificates is 'chain'. Roots is nil if the chain
+// has no root certificate.
+func getVerifyOptions(chain []byte) (*x509.VerifyOptions, error) {
+	var intPool *x509.CertPool
+	var rootPool *x509.CertPool
+
+	for len(chain) > 0 {
+		var block *pem.Block
+		block, chain = pem.Decode(chain)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to parse CA chain certificate")
+		}
+
+		if !cert.IsCA {
+			return nil, errors.New("A certificate in the CA chain is not a CA certificate")
+		}
+
+		// If authority key id is not present or if it is present and equal to subject key id,
+		// then it is a root certificate
+		if len(cert.AuthorityKeyId) == 0 || bytes.Equal(cert.AuthorityKeyId, cert.SubjectKeyId) {
+			if rootPool == nil {
+				rootPool = x509.NewCertPool()
+			}
+			rootPool.AddCert(cert)
+		} else {
+			if intPool == nil {
+				intPool = x509.NewCertPool()
+			}
+			intPool.AddCert(cert)
+		}
+	}
+
+	return &x509.VerifyOptions{
+		Roots:         rootPool,
+		Intermediates: intPool,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}, nil
+}
+
 // LoadPEMCertPool loads a pool of PEM certificates from list of files
 func LoadPEMCertPool(certFiles []string) (*x509.CertPool, error) {
 	certPool := x509.NewCertPool()
@@ -0,0 +1,620 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package vault resolves the secrets which the server's configuration
+// references in HashiCorp Vault rather than holding them itself. A reference
+// is "vault:<path>#<key>", the value of the field <key> of the secret read
+// from <path>, such as "vault:secret/data/ca#dbpassword". The secrets which
+// Vault leases, such as the credentials of its database secrets engine, are
+// renewed before they expire and read again when they can no longer be
+// renewed.
+package vault
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	stls "github.com/hyperledger/fabric-ca/lib/tls"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/hyperledger/fabric/bccsp"
+	"github.com/pkg/errors"
+)
+
+// RefPrefix is the prefix of a reference to a secret in Vault
+const RefPrefix = "vault:"
+
+// The methods with which the server authenticates to Vault
+const (
+	AuthToken      = "token"
+	AuthKubernetes = "kubernetes"
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+	// The interval at which the leases are checked for renewal
+	defaultRenewInterval = 10 * time.Second
+	// The maximum size of a response of Vault which is read
+	maxResponseSize = 1 << 20
+)
+
+// embeddedRef matches a reference embedded in a value as ${vault:<path>#<key>}
+var embeddedRef = regexp.MustCompile(`\$\{vault:([^}#]+)#([^}]+)\}`)
+
+// Config is the configuration of the Vault server from which the secrets
+// referenced in the server's configuration are read
+type Config struct {
+	Address   string        `help:"URL of the Vault server from which the secrets referenced as vault:<path>#<key> are read"`
+	Auth      string        `def:"token" help:"Method with which the server authenticates to Vault: token or kubernetes"`
+	Token     string        `help:"Vault token for token auth, as the token, env:<variable> or file:<path>; VAULT_TOKEN if not set" mask:"password"`
+	Role      string        `help:"Vault role for kubernetes auth"`
+	Mount     string        `def:"kubernetes" help:"Path at which the kubernetes auth method is mounted in Vault"`
+	JWTFile   string        `def:"/var/run/secrets/kubernetes.io/serviceaccount/token" help:"Kubernetes service account token file for kubernetes auth"`
+	Namespace string        `help:"Vault Enterprise namespace of the secrets"`
+	Timeout   time.Duration `def:"10s" help:"Maximum time of a request to Vault"`
+	TLS       stls.ClientTLSConfig
+}
+
+// Enabled returns true if a Vault server is configured
+func (c *Config) Enabled() bool {
+	return c.Address != ""
+}
+
+// IsRef returns true if 'value' is or contains a reference to a secret in Vault
+func IsRef(value string) bool {
+	return strings.HasPrefix(value, RefPrefix) || embeddedRef.MatchString(value)
+}
+
+// Paths returns the paths of the secrets referenced by 'value'
+func Paths(value string) []string {
+	if strings.HasPrefix(value, RefPrefix) {
+		path, _, err := parseRef(value)
+		if err != nil {
+			return nil
+		}
+		return []string{path}
+	}
+	var paths []string
+	for _, m := range embeddedRef.FindAllStringSubmatch(value, -1) {
+		paths = append(paths, m[1])
+	}
+	return paths
+}
+
+// parseRef returns the path and key of the reference 'ref'
+func parseRef(ref string) (string, string, error) {
+	s := strings.TrimPrefix(ref, RefPrefix)
+	i := strings.LastIndex(s, "#")
+	if i <= 0 || i == len(s)-1 {
+		return "", "", errors.Errorf("Invalid Vault reference '%s'; it must be of the form vault:<path>#<key>", ref)
+	}
+	return strings.Trim(s[:i], "/"), s[i+1:], nil
+}
+
+// secret is a secret read from Vault
+type secret struct {
+	data map[string]interface{}
+	// The lease of the secret, if Vault leases it
+	leaseID   string
+	duration  time.Duration
+	renewable bool
+	expiry    time.Time
+	// Time at which the lease is to be renewed
+	renewAt time.Time
+	// Error of the last failed attempt to renew the lease
+	failure error
+}
+
+func (s *secret) leased() bool {
+	return s.leaseID != ""
+}
+
+// Client reads secrets from Vault and keeps the leases of those it has read
+// until it is stopped
+type Client struct {
+	cfg     Config
+	homeDir string
+	http    *http.Client
+	mutex   sync.Mutex
+	// The token with which the client authenticates, and its lease
+	token      *secret
+	secrets    map[string]*secret
+	listeners  []func(path string)
+	done       chan struct{}
+	now        func() time.Time
+	renewEvery time.Duration
+}
+
+// New returns a client of the Vault server of 'cfg', which it logs in to.
+// Relative file names are relative to 'homeDir'.
+func New(cfg *Config, homeDir string, csp bccsp.BCCSP) (*Client, error) {
+	c := &Client{
+		cfg:        *cfg,
+		homeDir:    homeDir,
+		secrets:    map[string]*secret{},
+		now:        time.Now,
+		renewEvery: defaultRenewInterval,
+	}
+	c.cfg.Address = strings.TrimRight(c.cfg.Address, "/")
+	if c.cfg.Timeout <= 0 {
+		c.cfg.Timeout = defaultTimeout
+	}
+	if c.cfg.Auth == "" {
+		c.cfg.Auth = AuthToken
+	}
+	transport := &http.Transport{}
+	// TLS is used with an https address, verifying the certificate of Vault
+	// with the trusted certificate files, or else the system's roots
+	tlsCfg := &c.cfg.TLS
+	tlsCfg.Enabled = strings.HasPrefix(strings.ToLower(c.cfg.Address), "https://")
+	if tlsCfg.Enabled && (len(tlsCfg.CertFiles) > 0 || tlsCfg.Client.CertFile != "" || tlsCfg.Insecure) {
+		err := stls.AbsTLSClient(tlsCfg, homeDir)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig, err = stls.GetClientTLSConfig(tlsCfg, csp)
+		if err != nil {
+			return nil, errors.WithMessage(err, "Failed to get the TLS configuration of the Vault client")
+		}
+	}
+	c.http = &http.Client{Transport: transport, Timeout: c.cfg.Timeout}
+	err := c.login()
+	if err != nil {
+		return nil, errors.WithMessage(err, fmt.Sprintf("Failed to authenticate to Vault at %s", c.cfg.Address))
+	}
+	return c, nil
+}
+
+// login gets the token of the client with its authentication method
+func (c *Client) login() error {
+	switch c.cfg.Auth {
+	case AuthToken:
+		token := os.Getenv("VAULT_TOKEN")
+		if c.cfg.Token != "" {
+			var err error
+			token, err = util.ResolveSecret(c.cfg.Token, c.homeDir)
+			if err != nil {
+				return err
+			}
+		}
+		if token == "" {
+			return errors.New("No Vault token is set in 'vault.token' or VAULT_TOKEN")
+		}
+		// Looking up the token checks it and gets its lease
+		var resp struct {
+			Data struct {
+				TTL       int64 `json:"ttl"`
+				Renewable bool  `json:"renewable"`
+			} `json:"data"`
+		}
+		err := c.do("GET", "auth/token/lookup-self", token, nil, &resp)
+		if err != nil {
+			return err
+		}
+		c.setToken(token, resp.Data.TTL, resp.Data.Renewable)
+		return nil
+	case AuthKubernetes:
+		if c.cfg.Role == "" {
+			return errors.New("The Vault role for kubernetes auth is not set in 'vault.role'")
+		}
+		jwtFile, err := util.MakeFileAbs(c.cfg.JWTFile, c.homeDir)
+		if err != nil {
+			return err
+		}
+		jwt, err := ioutil.ReadFile(jwtFile)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to read the Kubernetes service account token '%s'", jwtFile)
+		}
+		mount := c.cfg.Mount
+		if mount == "" {
+			mount = AuthKubernetes
+		}
+		req := map[string]string{"role": c.cfg.Role, "jwt": strings.TrimSpace(string(jwt))}
+		var resp struct {
+			Auth struct {
+				ClientToken   string `json:"client_token"`
+				LeaseDuration int64  `json:"lease_duration"`
+				Renewable     bool   `json:"renewable"`
+			} `json:"auth"`
+		}
+		err = c.do("POST", "auth/"+strings.Trim(mount, "/")+"/login", "", req, &resp)
+		if err != nil {
+			return err
+		}
+		c.setToken(resp.Auth.ClientToken, resp.Auth.LeaseDuration, resp.Auth.Renewable)
+		return nil
+	}
+	return errors.Errorf("Invalid Vault auth method '%s'; it must be '%s' or '%s'", c.cfg.Auth, AuthToken, AuthKubernetes)
+}
+
+func (c *Client) setToken(token string, ttl int64, renewable bool) {
+	t := &secret{data: map[string]interface{}{"token": token}}
+	if ttl > 0 {
+		t.leaseID = "token"
+		t.renewable = renewable
+		c.setLease(t, time.Duration(ttl)*time.Second)
+	}
+	c.mutex.Lock()
+	c.token = t
+	c.mutex.Unlock()
+}
+
+// setLease sets the lease of 's' to 'duration' from now; it is to be
+// renewed when two thirds of it have elapsed
+func (c *Client) setLease(s *secret, duration time.Duration) {
+	now := c.now()
+	s.duration = duration
+	s.expiry = now.Add(duration)
+	s.renewAt = now.Add(duration * 2 / 3)
+	s.failure = nil
+}
+
+func (c *Client) currentToken() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.token.data["token"].(string)
+}
+
+// Resolve returns 'value' with the references to secrets in Vault which it
+// contains replaced by the secrets: 'value' is either a reference, or
+// contains references of the form ${vault:<path>#<key>}
+func (c *Client) Resolve(value string) (string, error) {
+	if strings.HasPrefix(value, RefPrefix) {
+		return c.resolveRef(value)
+	}
+	var err error
+	resolved := embeddedRef.ReplaceAllStringFunc(value, func(ref string) string {
+		if err != nil {
+			return ""
+		}
+		var v string
+		v, err = c.resolveRef(ref[2 : len(ref)-1])
+		return v
+	})
+	if err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// resolveRef returns the secret referenced by 'ref', which is read from
+// Vault unless it has already been read
+func (c *Client) resolveRef(ref string) (string, error) {
+	path, key, err := parseRef(ref)
+	if err != nil {
+		return "", err
+	}
+	c.mutex.Lock()
+	s := c.secrets[path]
+	c.mutex.Unlock()
+	if s == nil {
+		s, err = c.read(path)
+		if err != nil {
+			return "", err
+		}
+		c.mutex.Lock()
+		// Another reference may have read the secret in the meantime
+		if cur := c.secrets[path]; cur != nil {
+			s = cur
+		} else {
+			c.secrets[path] = s
+		}
+		c.mutex.Unlock()
+	}
+	value, ok := s.data[key]
+	if !ok {
+		return "", errors.Errorf("The secret at Vault path '%s' has no key '%s'", path, key)
+	}
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case nil:
+		return "", nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// read reads the secret at 'path' from Vault
+func (c *Client) read(path string) (*secret, error) {
+	var resp struct {
+		Data          map[string]interface{} `json:"data"`
+		LeaseID       string                 `json:"lease_id"`
+		LeaseDuration int64                  `json:"lease_duration"`
+		Renewable     bool                   `json:"renewable"`
+	}
+	err := c.do("GET", path, c.currentToken(), nil, &resp)
+	if err != nil {
+		return nil, errors.WithMessage(err, fmt.Sprintf("Failed to read the secret at Vault path '%s'", path))
+	}
+	s := &secret{data: resp.Data}
+	// The data of a version 2 KV secret is in the field 'data', next to its metadata
+	if data, ok := resp.Data["data"].(map[string]interface{}); ok {
+		if _, ok := resp.Data["metadata"]; ok {
+			s.data = data
+		}
+	}
+	if resp.LeaseID != "" && resp.LeaseDuration > 0 {
+		s.leaseID = resp.LeaseID
+		s.renewable = resp.Renewable
+		c.setLease(s, time.Duration(resp.LeaseDuration)*time.Second)
+	}
+	log.Debugf("Read the secret at Vault path '%s'", path)
+	return s, nil
+}
+
+// LeaseDuration returns the shortest duration of the leases of the secrets
+// referenced by 'value', or 0 if none of them is leased
+func (c *Client) LeaseDuration(value string) time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var d time.Duration
+	for _, path := range Paths(value) {
+		s := c.secrets[path]
+		if s != nil && s.leased() && (d == 0 || s.duration < d) {
+			d = s.duration
+		}
+	}
+	return d
+}
+
+// Refresh discards the secrets which are not leased, so that they are read
+// from Vault again when next resolved
+func (c *Client) Refresh() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for path, s := range c.secrets {
+		if !s.leased() {
+			delete(c.secrets, path)
+		}
+	}
+}
+
+// OnRotate registers 'f' to be called with the path of each leased secret
+// which is read again because its lease could not be renewed further
+func (c *Client) OnRotate(f func(path string)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.listeners = append(c.listeners, f)
+}
+
+// Start renews the leases of the token and the secrets in the background
+// until the client is stopped
+func (c *Client) Start() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.done != nil {
+		return
+	}
+	c.done = make(chan struct{})
+	go func(done chan struct{}) {
+		ticker := time.NewTicker(c.renewEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.Renew()
+			case <-done:
+				return
+			}
+		}
+	}(c.done)
+}
+
+// Stop stops renewing the leases
+func (c *Client) Stop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.done != nil {
+		close(c.done)
+		c.done = nil
+	}
+}
+
+// Renew renews the leases which are due for renewal. A secret whose lease
+// can't be renewed for its full duration is read again, and the listeners
+// registered with OnRotate are called with its path. The failures are
+// reported by Check until a later renewal succeeds.
+func (c *Client) Renew() {
+	c.renewToken()
+	c.mutex.Lock()
+	due := map[string]*secret{}
+	now := c.now()
+	for path, s := range c.secrets {
+		if s.leased() && !now.Before(s.renewAt) {
+			due[path] = s
+		}
+	}
+	c.mutex.Unlock()
+	var rotated []string
+	for path, s := range due {
+		if c.renewSecret(path, s) {
+			rotated = append(rotated, path)
+		}
+	}
+	c.mutex.Lock()
+	listeners := c.listeners
+	c.mutex.Unlock()
+	for _, path := range rotated {
+		for _, f := range listeners {
+			f(path)
+		}
+	}
+}
+
+// renewToken renews the lease of the client's token if it is due, logging
+// in again if it can't be renewed
+func (c *Client) renewToken() {
+	c.mutex.Lock()
+	t := c.token
+	due := t.leased() && !c.now().Before(t.renewAt)
+	c.mutex.Unlock()
+	if !due {
+		return
+	}
+	var err error
+	if t.renewable {
+		var resp struct {
+			Auth struct {
+				LeaseDuration int64 `json:"lease_duration"`
+			} `json:"auth"`
+		}
+		err = c.do("POST", "auth/token/renew-self", c.currentToken(), map[string]string{}, &resp)
+		if err == nil && time.Duration(resp.Auth.LeaseDuration)*time.Second >= t.duration {
+			c.mutex.Lock()
+			c.setLease(t, time.Duration(resp.Auth.LeaseDuration)*time.Second)
+			c.mutex.Unlock()
+			log.Debug("Renewed the Vault token")
+			return
+		}
+	}
+	// A token which can't be renewed for its full duration is replaced by
+	// logging in again, which is only possible with kubernetes auth
+	if c.cfg.Auth == AuthKubernetes {
+		err = c.login()
+		if err == nil {
+			log.Info("Logged in to Vault again as the Vault token could not be renewed")
+			return
+		}
+	}
+	if err == nil {
+		err = errors.New("the token can't be renewed")
+	}
+	log.Errorf("Failed to renew the Vault token, which expires at %s: %s", t.expiry.Format(time.RFC3339), err)
+	c.mutex.Lock()
+	t.failure = err
+	c.mutex.Unlock()
+}
+
+// renewSecret renews the lease of the secret 's' read from 'path', or reads
+// it again if the lease can't be renewed for its full duration; it returns
+// true if the secret was read again
+func (c *Client) renewSecret(path string, s *secret) bool {
+	if s.renewable {
+		var resp struct {
+			LeaseDuration int64 `json:"lease_duration"`
+		}
+		req := map[string]interface{}{"lease_id": s.leaseID, "increment": int64(s.duration / time.Second)}
+		err := c.do("PUT", "sys/leases/renew", c.currentToken(), req, &resp)
+		if err == nil && time.Duration(resp.LeaseDuration)*time.Second >= s.duration {
+			c.mutex.Lock()
+			c.setLease(s, time.Duration(resp.LeaseDuration)*time.Second)
+			c.mutex.Unlock()
+			log.Debugf("Renewed the lease of the secret at Vault path '%s'", path)
+			return false
+		}
+		if err != nil {
+			log.Warningf("Failed to renew the lease of the secret at Vault path '%s'; reading it again: %s", path, err)
+		}
+	}
+	next, err := c.read(path)
+	if err != nil {
+		log.Errorf("Failed to renew the secret at Vault path '%s', whose lease expires at %s: %s", path, s.expiry.Format(time.RFC3339), err)
+		c.mutex.Lock()
+		s.failure = err
+		c.mutex.Unlock()
+		return false
+	}
+	c.mutex.Lock()
+	c.secrets[path] = next
+	c.mutex.Unlock()
+	log.Infof("Read the secret at Vault path '%s' again as its lease could not be renewed", path)
+	return true
+}
+
+// Check returns an error if the renewal of the lease of the token or of a
+// secret has failed, or a lease has expired
+func (c *Client) Check() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.now()
+	check := func(name string, s *secret) error {
+		if !s.leased() {
+			return nil
+		}
+		if !now.Before(s.expiry) {
+			if s.failure != nil {
+				return errors.Errorf("The lease of %s expired at %s as it could not be renewed: %s", name, s.expiry.Format(time.RFC3339), s.failure)
+			}
+			return errors.Errorf("The lease of %s expired at %s", name, s.expiry.Format(time.RFC3339))
+		}
+		if s.failure != nil {
+			return errors.Errorf("Failed to renew %s, whose lease expires at %s: %s", name, s.expiry.Format(time.RFC3339), s.failure)
+		}
+		return nil
+	}
+	err := check("the Vault token", c.token)
+	if err != nil {
+		return err
+	}
+	for path, s := range c.secrets {
+		err = check(fmt.Sprintf("the secret at Vault path '%s'", path), s)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// do sends the request 'method' for 'path' of the Vault API with 'token'
+// and the JSON encoding of 'req', if not nil, and decodes the response into
+// 'resp'
+func (c *Client) do(method, path, token string, req, resp interface{}) error {
+	var body io.Reader
+	if req != nil {
+		buf, err := json.Marshal(req)
+		if err != nil {
+			return errors.Wrap(err, "Failed to marshal the request to Vault")
+		}
+		body = bytes.NewReader(buf)
+	}
+	httpReq, err := http.NewRequest(method, c.cfg.Address+"/v1/"+strings.TrimLeft(path, "/"), body)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create the request to Vault")
+	}
+	if token != "" {
+		httpReq.Header.Set("X-Vault-Token", token)
+	}
+	if c.cfg.Namespace != "" {
+		httpReq.Header.Set("X-Vault-Namespace", c.cfg.Namespace)
+	}
+	if req != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	httpResp, err := c.http.Do(httpReq)
+	if err != nil {
+		return errors.Wrap(err, "Failed to send the request to Vault")
+	}
+	defer httpResp.Body.Close()
+	respBody, err := ioutil.ReadAll(io.LimitReader(httpResp.Body, maxResponseSize))
+	if err != nil {
+		return errors.Wrap(err, "Failed to read the response of Vault")
+	}
+	if httpResp.StatusCode < 200 || httpResp.StatusCode >= 300 {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		json.Unmarshal(respBody, &vaultErr)
+		return errors.Errorf("Vault returned %d: %s", httpResp.StatusCode, strings.Join(vaultErr.Errors, "; "))
+	}
+	if resp == nil || len(respBody) == 0 {
+		return nil
+	}
+	err = json.Unmarshal(respBody, resp)
+	if err != nil {
+		return errors.Wrap(err, "Failed to parse the response of Vault")
+	}
+	return nil
+}
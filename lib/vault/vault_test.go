@@ -0,0 +1,352 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package vault
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	stls "github.com/hyperledger/fabric-ca/lib/tls"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testToken = "s.testtoken"
+	testJWT   = "test.service.account.jwt"
+)
+
+// vaultStub is a stub of the Vault API. It holds a version 2 KV secret at
+// secret/data/ca, a version 1 KV secret at kv/ca, and issues leased
+// database credentials at database/creds/ca.
+type vaultStub struct {
+	t     *testing.T
+	mutex sync.Mutex
+	// The lease duration of the database credentials, in seconds
+	leaseDuration int64
+	// The remaining duration to which a lease can be renewed, in seconds
+	maxRenewal int64
+	failRenew  bool
+	sealed     bool
+	creds      int
+	renewals   int
+	logins     int
+	namespace  string
+}
+
+func (s *vaultStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	s.namespace = r.Header.Get("X-Vault-Namespace")
+	if path == "auth/kubernetes/login" {
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		if req["role"] != "ca" || req["jwt"] != testJWT {
+			s.fail(w, http.StatusForbidden, "permission denied")
+			return
+		}
+		s.logins++
+		s.reply(w, map[string]interface{}{"auth": map[string]interface{}{
+			"client_token": testToken, "lease_duration": 3600, "renewable": true}})
+		return
+	}
+	if r.Header.Get("X-Vault-Token") != testToken {
+		s.fail(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	switch path {
+	case "auth/token/lookup-self":
+		s.reply(w, map[string]interface{}{"data": map[string]interface{}{"ttl": 3600, "renewable": true}})
+	case "auth/token/renew-self":
+		s.reply(w, map[string]interface{}{"auth": map[string]interface{}{"lease_duration": 3600}})
+	case "secret/data/ca":
+		s.reply(w, map[string]interface{}{"data": map[string]interface{}{
+			"data":     map[string]interface{}{"dbpassword": "kvpw", "port": 5432},
+			"metadata": map[string]interface{}{"version": 1}}})
+	case "kv/ca":
+		s.reply(w, map[string]interface{}{"data": map[string]interface{}{"user": "kvuser"}})
+	case "database/creds/ca":
+		if s.sealed {
+			s.fail(w, http.StatusServiceUnavailable, "Vault is sealed")
+			return
+		}
+		s.creds++
+		s.reply(w, map[string]interface{}{
+			"lease_id":       fmt.Sprintf("database/creds/ca/%d", s.creds),
+			"lease_duration": s.leaseDuration,
+			"renewable":      true,
+			"data": map[string]interface{}{
+				"username": fmt.Sprintf("user%d", s.creds),
+				"password": fmt.Sprintf("pw%d", s.creds)}})
+	case "sys/leases/renew":
+		if s.failRenew {
+			s.fail(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		var req struct {
+			LeaseID   string `json:"lease_id"`
+			Increment int64  `json:"increment"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		assert.Equal(s.t, fmt.Sprintf("database/creds/ca/%d", s.creds), req.LeaseID)
+		s.renewals++
+		d := req.Increment
+		if d > s.maxRenewal {
+			d = s.maxRenewal
+		}
+		s.reply(w, map[string]interface{}{"lease_id": req.LeaseID, "lease_duration": d, "renewable": true})
+	default:
+		s.fail(w, http.StatusNotFound, "")
+	}
+}
+
+func (s *vaultStub) reply(w http.ResponseWriter, resp interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *vaultStub) fail(w http.ResponseWriter, status int, msg string) {
+	w.WriteHeader(status)
+	errs := []string{}
+	if msg != "" {
+		errs = append(errs, msg)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": errs})
+}
+
+// newTestClient returns a client of 'stub' authenticated with testToken
+// whose clock is 'now'
+func newTestClient(t *testing.T, stub *httptest.Server, now *time.Time) *Client {
+	c, err := New(&Config{Address: stub.URL, Token: testToken}, "", nil)
+	if err != nil {
+		t.Fatalf("Failed to create the Vault client: %s", err)
+	}
+	c.now = func() time.Time { return *now }
+	return c
+}
+
+func TestIsRef(t *testing.T) {
+	assert.True(t, IsRef("vault:secret/data/ca#dbpassword"))
+	assert.True(t, IsRef("host=db password=${vault:secret/data/ca#dbpassword}"))
+	assert.False(t, IsRef("host=db password=vault"))
+	assert.False(t, IsRef("ca-cert.pem"))
+	assert.Equal(t, []string{"secret/data/ca"}, Paths("vault:/secret/data/ca#dbpassword"))
+	assert.Equal(t, []string{"kv/ca", "database/creds/ca"}, Paths("${vault:kv/ca#user}:${vault:database/creds/ca#password}"))
+	_, _, err := parseRef("vault:secret/data/ca")
+	assert.Error(t, err, "A reference without a key should be invalid")
+	_, _, err = parseRef("vault:#key")
+	assert.Error(t, err, "A reference without a path should be invalid")
+}
+
+func TestResolve(t *testing.T) {
+	stub := httptest.NewServer(&vaultStub{t: t, leaseDuration: 60, maxRenewal: 60})
+	defer stub.Close()
+	now := time.Now()
+	c := newTestClient(t, stub, &now)
+
+	v, err := c.Resolve("vault:secret/data/ca#dbpassword")
+	assert.NoError(t, err)
+	assert.Equal(t, "kvpw", v, "The data of a version 2 KV secret should be unwrapped")
+	v, err = c.Resolve("vault:secret/data/ca#port")
+	assert.NoError(t, err)
+	assert.Equal(t, "5432", v)
+	v, err = c.Resolve("host=db user=${vault:kv/ca#user} password=${vault:secret/data/ca#dbpassword}")
+	assert.NoError(t, err)
+	assert.Equal(t, "host=db user=kvuser password=kvpw", v)
+	assert.Equal(t, time.Duration(0), c.LeaseDuration("vault:kv/ca#user"))
+
+	_, err = c.Resolve("vault:secret/data/ca#unknown")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "has no key 'unknown'")
+	}
+	_, err = c.Resolve("vault:secret/data/unknown#key")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Vault returned 404")
+	}
+
+	// The leased secrets are cached, so each reference to them gets the same credentials
+	user, err := c.Resolve("vault:database/creds/ca#username")
+	assert.NoError(t, err)
+	pw, err := c.Resolve("vault:database/creds/ca#password")
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", user)
+	assert.Equal(t, "pw1", pw)
+	assert.Equal(t, time.Minute, c.LeaseDuration("${vault:kv/ca#user}:${vault:database/creds/ca#password}"))
+
+	// Refreshing reads the KV secrets again, but keeps the leased ones
+	c.Refresh()
+	c.mutex.Lock()
+	_, kv := c.secrets["kv/ca"]
+	_, creds := c.secrets["database/creds/ca"]
+	c.mutex.Unlock()
+	assert.False(t, kv, "A KV secret should be read again after a refresh")
+	assert.True(t, creds, "A leased secret should be kept after a refresh")
+}
+
+func TestAuth(t *testing.T) {
+	stub := &vaultStub{t: t}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	// The token is read from VAULT_TOKEN if it isn't configured
+	os.Setenv("VAULT_TOKEN", testToken)
+	c, err := New(&Config{Address: srv.URL, Namespace: "ns1"}, "", nil)
+	os.Unsetenv("VAULT_TOKEN")
+	assert.NoError(t, err)
+	if c != nil {
+		assert.Equal(t, "ns1", stub.namespace, "The Vault namespace should be sent")
+	}
+	_, err = New(&Config{Address: srv.URL}, "", nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "No Vault token")
+	}
+	_, err = New(&Config{Address: srv.URL, Token: "s.wrong"}, "", nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "permission denied")
+	}
+
+	// The token may be read from a file
+	dir, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "token"), []byte(testToken+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write the token file: %s", err)
+	}
+	_, err = New(&Config{Address: srv.URL, Token: "file:token"}, dir, nil)
+	assert.NoError(t, err)
+
+	// Kubernetes auth logs in with the service account token
+	err = ioutil.WriteFile(filepath.Join(dir, "jwt"), []byte(testJWT), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write the service account token: %s", err)
+	}
+	c, err = New(&Config{Address: srv.URL, Auth: AuthKubernetes, Role: "ca", JWTFile: "jwt"}, dir, nil)
+	assert.NoError(t, err)
+	if c != nil {
+		assert.Equal(t, testToken, c.currentToken())
+	}
+	_, err = New(&Config{Address: srv.URL, Auth: AuthKubernetes, Role: "other", JWTFile: "jwt"}, dir, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "permission denied")
+	}
+	// Vault is connected to with TLS at an https address
+	tlsSrv := httptest.NewTLSServer(stub)
+	defer tlsSrv.Close()
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsSrv.Certificate().Raw})
+	err = ioutil.WriteFile(filepath.Join(dir, "vault-ca.pem"), certPEM, 0600)
+	if err != nil {
+		t.Fatalf("Failed to write the certificate of Vault: %s", err)
+	}
+	tlsCfg := stls.ClientTLSConfig{CertFiles: []string{"vault-ca.pem"}}
+	_, err = New(&Config{Address: tlsSrv.URL, Token: testToken, TLS: tlsCfg}, dir, nil)
+	assert.NoError(t, err)
+	_, err = New(&Config{Address: tlsSrv.URL, Token: testToken}, dir, nil)
+	if assert.Error(t, err, "The certificate of Vault should be verified with the system's roots") {
+		assert.Contains(t, err.Error(), "certificate")
+	}
+	_, err = New(&Config{Address: srv.URL, Auth: "ldap"}, dir, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Invalid Vault auth method 'ldap'")
+	}
+}
+
+func TestRenew(t *testing.T) {
+	stub := &vaultStub{t: t, leaseDuration: 60, maxRenewal: 60}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	now := time.Now()
+	c := newTestClient(t, srv, &now)
+	var rotated []string
+	c.OnRotate(func(path string) {
+		rotated = append(rotated, path)
+	})
+	_, err := c.Resolve("vault:database/creds/ca#password")
+	assert.NoError(t, err)
+
+	// The lease isn't renewed until two thirds of it have elapsed
+	now = now.Add(30 * time.Second)
+	c.Renew()
+	assert.Equal(t, 0, stub.renewals)
+	now = now.Add(15 * time.Second)
+	c.Renew()
+	assert.Equal(t, 1, stub.renewals)
+	assert.Empty(t, rotated)
+	assert.NoError(t, c.Check())
+
+	// A lease which can't be renewed for its full duration is replaced by
+	// new credentials
+	stub.maxRenewal = 20
+	now = now.Add(45 * time.Second)
+	c.Renew()
+	assert.Equal(t, []string{"database/creds/ca"}, rotated)
+	pw, err := c.Resolve("vault:database/creds/ca#password")
+	assert.NoError(t, err)
+	assert.Equal(t, "pw2", pw)
+	assert.NoError(t, c.Check())
+
+	// A failed renewal is reported by the health check until the lease
+	// expires
+	stub.mutex.Lock()
+	stub.failRenew = true
+	stub.sealed = true
+	stub.mutex.Unlock()
+	now = now.Add(45 * time.Second)
+	c.Renew()
+	err = c.Check()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Failed to renew the secret at Vault path 'database/creds/ca', whose lease expires at")
+		assert.Contains(t, err.Error(), "Vault is sealed")
+	}
+	now = now.Add(time.Minute)
+	err = c.Check()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "The lease of the secret at Vault path 'database/creds/ca' expired")
+	}
+	assert.Len(t, rotated, 1)
+
+	// The token is renewed too
+	now = now.Add(time.Hour)
+	c.Renew()
+	c.mutex.Lock()
+	expiry := c.token.expiry
+	c.mutex.Unlock()
+	assert.Equal(t, now.Add(time.Hour), expiry)
+}
+
+func TestStartStop(t *testing.T) {
+	stub := &vaultStub{t: t, leaseDuration: 1, maxRenewal: 1}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	c, err := New(&Config{Address: srv.URL, Token: testToken}, "", nil)
+	if err != nil {
+		t.Fatalf("Failed to create the Vault client: %s", err)
+	}
+	c.renewEvery = 10 * time.Millisecond
+	_, err = c.Resolve("vault:database/creds/ca#password")
+	assert.NoError(t, err)
+	c.Start()
+	c.Start()
+	time.Sleep(time.Second)
+	c.Stop()
+	c.Stop()
+	stub.mutex.Lock()
+	defer stub.mutex.Unlock()
+	assert.True(t, stub.renewals > 0, "The lease should have been renewed in the background")
+}
@@ -0,0 +1,60 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package util
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"sync"
+)
+
+// maxCachedTokenCerts is the number of certificates of tokens which are kept
+// parsed; a certificate is evicted at random to add one beyond it
+const maxCachedTokenCerts = 1024
+
+// tokenCerts are the parsed certificates of the tokens which were decoded
+var tokenCerts = newCertCache(maxCachedTokenCerts)
+
+// certCache is a bounded cache of parsed X509 certificates keyed by the
+// SHA-256 hash of their base64 encoding. A certificate only depends on its
+// bytes, so it may be shared by every caller; the callers must not modify it.
+type certCache struct {
+	mutex sync.RWMutex
+	certs map[[sha256.Size]byte]*x509.Certificate
+	max   int
+}
+
+func newCertCache(max int) *certCache {
+	return &certCache{certs: map[[sha256.Size]byte]*x509.Certificate{}, max: max}
+}
+
+// get returns the certificate encoded as 'b64cert', calling 'parse' to parse
+// it if it is not in the cache. A certificate which fails to parse is not
+// cached.
+func (c *certCache) get(b64cert string, parse func(string) (*x509.Certificate, error)) (*x509.Certificate, error) {
+	key := sha256.Sum256([]byte(b64cert))
+	c.mutex.RLock()
+	cert := c.certs[key]
+	c.mutex.RUnlock()
+	if cert != nil {
+		return cert, nil
+	}
+	cert, err := parse(b64cert)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	if len(c.certs) >= c.max {
+		for k := range c.certs {
+			delete(c.certs, k)
+			break
+		}
+	}
+	c.certs[key] = cert
+	c.mutex.Unlock()
+	return cert, nil
+}
@@ -0,0 +1,54 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package util
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertCache(t *testing.T) {
+	pem, err := ioutil.ReadFile(getPath("ec.pem"))
+	if err != nil {
+		t.Fatalf("Failed to read the certificate: %s", err)
+	}
+	b64cert := B64Encode(pem)
+	parsed := 0
+	parse := func(s string) (*x509.Certificate, error) {
+		parsed++
+		return parseTokenCert(s)
+	}
+
+	c := newCertCache(2)
+	cert, err := c.get(b64cert, parse)
+	assert.NoError(t, err)
+	cert2, err := c.get(b64cert, parse)
+	assert.NoError(t, err)
+	assert.True(t, cert == cert2, "The parsed certificate should be reused")
+	assert.Equal(t, 1, parsed)
+
+	// A certificate which fails to parse is parsed again
+	for i := 0; i < 2; i++ {
+		_, err = c.get("bad", parse)
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 3, parsed)
+	assert.Len(t, c.certs, 1)
+
+	// The cache does not grow beyond its bound
+	for i := 0; i < 4; i++ {
+		_, err = c.get(strconv.Itoa(i), func(string) (*x509.Certificate, error) {
+			return &x509.Certificate{}, nil
+		})
+		assert.NoError(t, err)
+	}
+	assert.Len(t, c.certs, 2)
+}
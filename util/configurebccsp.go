@@ -54,12 +54,24 @@ func ConfigureBCCSP(optsPtr **factory.FactoryOpts, mspDir, homeDir string) error
 	if err != nil {
 		return errors.WithMessage(err, "Failed to make BCCSP files absolute")
 	}
+	if opts.Pkcs11Opts != nil {
+		// The PIN may reference an environment variable or file so that it
+		// need not be stored in the configuration file
+		opts.Pkcs11Opts.Pin, err = ResolveSecret(opts.Pkcs11Opts.Pin, homeDir)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to get PKCS11 PIN")
+		}
+	}
 	log.Debugf("Initializing BCCSP: %+v", opts)
 	if opts.SwOpts != nil {
 		log.Debugf("Initializing BCCSP with software options %+v", opts.SwOpts)
 	}
 	if opts.Pkcs11Opts != nil {
-		log.Debugf("Initializing BCCSP with PKCS11 options %+v", opts.Pkcs11Opts)
+		p11 := *opts.Pkcs11Opts
+		if p11.Pin != "" {
+			p11.Pin = "****"
+		}
+		log.Debugf("Initializing BCCSP with PKCS11 options %+v", p11)
 	}
 	// Init the BCCSP factories
 	err = factory.InitFactories(opts)
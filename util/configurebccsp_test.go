@@ -0,0 +1,41 @@
+// +build pkcs11
+
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package util
+
+import (
+	"os"
+	"testing"
+
+	"github.com/hyperledger/fabric/bccsp/factory"
+	"github.com/hyperledger/fabric/bccsp/pkcs11"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigureBCCSPPKCS11Pin(t *testing.T) {
+	opts := &factory.FactoryOpts{
+		ProviderName: "PKCS11",
+		Pkcs11Opts: &pkcs11.PKCS11Opts{
+			SecLevel:   256,
+			HashFamily: "SHA2",
+			Pin:        "env:FABRIC_CA_TEST_PKCS11_PIN_UNSET",
+		},
+	}
+	err := ConfigureBCCSP(&opts, "", "")
+	if assert.Error(t, err, "Unresolvable PIN should fail") {
+		assert.Contains(t, err.Error(), "Failed to get PKCS11 PIN")
+	}
+
+	os.Setenv("FABRIC_CA_TEST_PKCS11_PIN", "98765432")
+	defer os.Unsetenv("FABRIC_CA_TEST_PKCS11_PIN")
+	opts.Pkcs11Opts.Pin = "env:FABRIC_CA_TEST_PKCS11_PIN"
+	// Without a token library, BCCSP initialization itself may fail, but the
+	// PIN must have been resolved first
+	ConfigureBCCSP(&opts, "", "")
+	assert.Equal(t, "98765432", opts.Pkcs11Opts.Pin)
+}
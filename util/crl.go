@@ -0,0 +1,57 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package util
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// oidCRLReasonCode is the object identifier of the reasonCode extension of
+// the entries of a CRL, as defined in RFC 5280
+var oidCRLReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+// CRLReasonCodeExtension returns the reasonCode extension of a CRL entry of
+// a certificate revoked for 'reason', one of RevocationReasonCodes
+func CRLReasonCodeExtension(reason int) (pkix.Extension, error) {
+	value, err := asn1.Marshal(asn1.Enumerated(reason))
+	if err != nil {
+		return pkix.Extension{}, errors.Wrap(err, "Failed to marshal the revocation reason")
+	}
+	return pkix.Extension{Id: oidCRLReasonCode, Value: value}, nil
+}
+
+// CRLEntryReason returns the revocation reason of the CRL entry 'entry',
+// which is unspecified if the entry has no reasonCode extension
+func CRLEntryReason(entry *pkix.RevokedCertificate) (int, error) {
+	for _, ext := range entry.Extensions {
+		if !ext.Id.Equal(oidCRLReasonCode) {
+			continue
+		}
+		var reason asn1.Enumerated
+		rest, err := asn1.Unmarshal(ext.Value, &reason)
+		if err != nil || len(rest) > 0 {
+			return 0, errors.Errorf("Invalid reasonCode extension of the CRL entry of serial %x", entry.SerialNumber)
+		}
+		return int(reason), nil
+	}
+	return RevocationReasonCodes["unspecified"], nil
+}
+
+// RevocationReasonName returns the name of the revocation reason 'reason' in
+// RevocationReasonCodes
+func RevocationReasonName(reason int) string {
+	for name, code := range RevocationReasonCodes {
+		if code == reason {
+			return name
+		}
+	}
+	return fmt.Sprintf("unknown (%d)", reason)
+}
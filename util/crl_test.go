@@ -0,0 +1,36 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package util
+
+import (
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCRLEntryReason(t *testing.T) {
+	entry := pkix.RevokedCertificate{SerialNumber: big.NewInt(10)}
+	reason, err := CRLEntryReason(&entry)
+	assert.NoError(t, err)
+	assert.Equal(t, "unspecified", RevocationReasonName(reason), "An entry without a reason code is unspecified")
+
+	for name, code := range RevocationReasonCodes {
+		ext, err := CRLReasonCodeExtension(code)
+		assert.NoError(t, err)
+		entry.Extensions = []pkix.Extension{ext}
+		reason, err = CRLEntryReason(&entry)
+		assert.NoError(t, err)
+		assert.Equal(t, name, RevocationReasonName(reason))
+	}
+
+	entry.Extensions[0].Value = []byte{0x0a}
+	_, err = CRLEntryReason(&entry)
+	assert.Error(t, err, "A malformed reason code should fail")
+	assert.Equal(t, "unknown (42)", RevocationReasonName(42))
+}
@@ -71,6 +71,12 @@ func GetBCCSP(opts *factory.FactoryOpts, homeDir string) (bccsp.BCCSP, error) {
 	if err != nil {
 		return nil, errors.WithMessage(err, "Failed to get BCCSP with opts")
 	}
+	// A PKCS11 BCCSP logs in to the token again if its sessions are lost
+	if opts != nil && strings.ToUpper(opts.ProviderName) == "PKCS11" {
+		csp = newSessionCSP(csp, func() (bccsp.BCCSP, error) {
+			return factory.GetBCCSPFromOpts(opts)
+		})
+	}
 	return csp, nil
 }
 
@@ -219,29 +225,62 @@ func BCCSPKeyRequestGenerate(req *csr.CertificateRequest, myCSP bccsp.BCCSP) (bc
 
 // ImportBCCSPKeyFromPEM attempts to create a private BCCSP key from a pem file keyFile
 func ImportBCCSPKeyFromPEM(keyFile string, myCSP bccsp.BCCSP, temporary bool) (bccsp.Key, error) {
+	return ImportBCCSPKeyFromEncryptedPEM(keyFile, myCSP, temporary, nil)
+}
+
+// ImportBCCSPKeyFromEncryptedPEM is like ImportBCCSPKeyFromPEM, but the key in
+// keyFile may also be encrypted, as PKCS #8, with the passphrase returned by
+// the passphrase function
+func ImportBCCSPKeyFromEncryptedPEM(keyFile string, myCSP bccsp.BCCSP, temporary bool, passphrase func() ([]byte, error)) (bccsp.Key, error) {
 	keyBuff, err := ioutil.ReadFile(keyFile)
 	if err != nil {
 		return nil, err
 	}
+	if block, _ := pem.Decode(keyBuff); block != nil && block.Type == EncryptedPrivateKeyPEMType {
+		if passphrase == nil {
+			return nil, errors.WithMessage(ErrNoPassphrase, fmt.Sprintf("Failed to decrypt the private key in '%s'", keyFile))
+		}
+		pwd, err := passphrase()
+		if err != nil {
+			return nil, err
+		}
+		der, err := DecryptPKCS8PrivateKey(block, pwd)
+		if err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("Failed to decrypt the private key in '%s'", keyFile))
+		}
+		keyBuff = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}
+	return importBCCSPKey(keyBuff, keyFile, myCSP, temporary)
+}
+
+// ImportBCCSPKeyFromPEMBytes attempts to create a private BCCSP key from the
+// PEM-encoded, unencrypted private key keyPEM
+func ImportBCCSPKeyFromPEMBytes(keyPEM []byte, myCSP bccsp.BCCSP, temporary bool) (bccsp.Key, error) {
+	return importBCCSPKey(keyPEM, "the PEM bytes", myCSP, temporary)
+}
+
+// importBCCSPKey imports the PEM-encoded private key keyBuff, read from
+// source, into myCSP
+func importBCCSPKey(keyBuff []byte, source string, myCSP bccsp.BCCSP, temporary bool) (bccsp.Key, error) {
 	key, err := utils.PEMtoPrivateKey(keyBuff, nil)
 	if err != nil {
-		return nil, errors.WithMessage(err, fmt.Sprintf("Failed parsing private key from %s", keyFile))
+		return nil, errors.WithMessage(err, fmt.Sprintf("Failed parsing private key from %s", source))
 	}
 	switch key.(type) {
 	case *ecdsa.PrivateKey:
 		priv, err := utils.PrivateKeyToDER(key.(*ecdsa.PrivateKey))
 		if err != nil {
-			return nil, errors.WithMessage(err, fmt.Sprintf("Failed to convert ECDSA private key for '%s'", keyFile))
+			return nil, errors.WithMessage(err, fmt.Sprintf("Failed to convert ECDSA private key for '%s'", source))
 		}
 		sk, err := myCSP.KeyImport(priv, &bccsp.ECDSAPrivateKeyImportOpts{Temporary: temporary})
 		if err != nil {
-			return nil, errors.WithMessage(err, fmt.Sprintf("Failed to import ECDSA private key for '%s'", keyFile))
+			return nil, errors.WithMessage(err, fmt.Sprintf("Failed to import ECDSA private key for '%s'", source))
 		}
 		return sk, nil
 	case *rsa.PrivateKey:
-		return nil, errors.Errorf("Failed to import RSA key from %s; RSA private key import is not supported", keyFile)
+		return nil, errors.Errorf("Failed to import RSA key from %s; RSA private key import is not supported", source)
 	default:
-		return nil, errors.Errorf("Failed to import key from %s: invalid secret key type", keyFile)
+		return nil, errors.Errorf("Failed to import key from %s: invalid secret key type", source)
 	}
 }
 
@@ -0,0 +1,203 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package util
+
+import (
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric/bccsp"
+	"github.com/pkg/errors"
+)
+
+// The PKCS11 errors after which the sessions of a PKCS11 BCCSP can't be used
+// any more, e.g. because the HSM was restarted or its token was removed, and
+// the failed operation is retried with new sessions
+var pkcs11SessionErrors = []string{
+	"CKR_SESSION_HANDLE_INVALID",
+	"CKR_SESSION_CLOSED",
+	"CKR_USER_NOT_LOGGED_IN",
+	"CKR_DEVICE_REMOVED",
+	"CKR_DEVICE_ERROR",
+	"CKR_TOKEN_NOT_PRESENT",
+	"CKR_CRYPTOKI_NOT_INITIALIZED",
+	"OpenSession failed",
+}
+
+// IsPKCS11SessionError returns true if 'err' is the error of a PKCS11
+// operation whose session can't be used any more
+func IsPKCS11SessionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, s := range pkcs11SessionErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionCSP is a PKCS11 BCCSP which is created again, with a new login and
+// new sessions, when an operation fails because the sessions of the current
+// one can't be used any more; the operation is then retried once. The PKCS11
+// BCCSP pools its sessions itself, but it keeps using a pooled session after
+// the HSM has closed it.
+type sessionCSP struct {
+	mutex  sync.RWMutex
+	csp    bccsp.BCCSP
+	reopen func() (bccsp.BCCSP, error)
+}
+
+// newSessionCSP returns 'csp', which is created again by 'reopen' if its
+// sessions are lost
+func newSessionCSP(csp bccsp.BCCSP, reopen func() (bccsp.BCCSP, error)) bccsp.BCCSP {
+	return &sessionCSP{csp: csp, reopen: reopen}
+}
+
+// do calls 'f' with the current BCCSP, and once more with a new one if it
+// failed because its sessions were lost
+func (s *sessionCSP) do(f func(csp bccsp.BCCSP) error) error {
+	s.mutex.RLock()
+	csp := s.csp
+	s.mutex.RUnlock()
+	err := callCSP(csp, f)
+	if !IsPKCS11SessionError(err) {
+		return err
+	}
+	log.Warningf("The PKCS11 session was lost; logging in to the token again: %s", err)
+	csp, err2 := s.reopenCSP(csp)
+	if err2 != nil {
+		return errors.WithMessage(err2, fmt.Sprintf("Failed to log in to the PKCS11 token again after: %s", err))
+	}
+	return callCSP(csp, f)
+}
+
+// reopenCSP replaces 'failed', unless it was already replaced by another
+// operation, and returns the new BCCSP
+func (s *sessionCSP) reopenCSP(failed bccsp.BCCSP) (bccsp.BCCSP, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.csp != failed {
+		return s.csp, nil
+	}
+	csp, err := s.reopen()
+	if err != nil {
+		return nil, err
+	}
+	s.csp = csp
+	return csp, nil
+}
+
+// callCSP calls 'f' with 'csp'. The PKCS11 BCCSP panics if it can't open a
+// session, which is returned as an error instead.
+func callCSP(csp bccsp.BCCSP, f func(csp bccsp.BCCSP) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(error); ok && IsPKCS11SessionError(e) {
+				err = e
+				return
+			}
+			panic(r)
+		}
+	}()
+	return f(csp)
+}
+
+// KeyGen implements bccsp.BCCSP
+func (s *sessionCSP) KeyGen(opts bccsp.KeyGenOpts) (k bccsp.Key, err error) {
+	err = s.do(func(csp bccsp.BCCSP) (err error) {
+		k, err = csp.KeyGen(opts)
+		return err
+	})
+	return k, err
+}
+
+// KeyDeriv implements bccsp.BCCSP
+func (s *sessionCSP) KeyDeriv(k bccsp.Key, opts bccsp.KeyDerivOpts) (dk bccsp.Key, err error) {
+	err = s.do(func(csp bccsp.BCCSP) (err error) {
+		dk, err = csp.KeyDeriv(k, opts)
+		return err
+	})
+	return dk, err
+}
+
+// KeyImport implements bccsp.BCCSP
+func (s *sessionCSP) KeyImport(raw interface{}, opts bccsp.KeyImportOpts) (k bccsp.Key, err error) {
+	err = s.do(func(csp bccsp.BCCSP) (err error) {
+		k, err = csp.KeyImport(raw, opts)
+		return err
+	})
+	return k, err
+}
+
+// GetKey implements bccsp.BCCSP
+func (s *sessionCSP) GetKey(ski []byte) (k bccsp.Key, err error) {
+	err = s.do(func(csp bccsp.BCCSP) (err error) {
+		k, err = csp.GetKey(ski)
+		return err
+	})
+	return k, err
+}
+
+// Hash implements bccsp.BCCSP
+func (s *sessionCSP) Hash(msg []byte, opts bccsp.HashOpts) (digest []byte, err error) {
+	err = s.do(func(csp bccsp.BCCSP) (err error) {
+		digest, err = csp.Hash(msg, opts)
+		return err
+	})
+	return digest, err
+}
+
+// GetHash implements bccsp.BCCSP
+func (s *sessionCSP) GetHash(opts bccsp.HashOpts) (h hash.Hash, err error) {
+	err = s.do(func(csp bccsp.BCCSP) (err error) {
+		h, err = csp.GetHash(opts)
+		return err
+	})
+	return h, err
+}
+
+// Sign implements bccsp.BCCSP
+func (s *sessionCSP) Sign(k bccsp.Key, digest []byte, opts bccsp.SignerOpts) (signature []byte, err error) {
+	err = s.do(func(csp bccsp.BCCSP) (err error) {
+		signature, err = csp.Sign(k, digest, opts)
+		return err
+	})
+	return signature, err
+}
+
+// Verify implements bccsp.BCCSP
+func (s *sessionCSP) Verify(k bccsp.Key, signature, digest []byte, opts bccsp.SignerOpts) (valid bool, err error) {
+	err = s.do(func(csp bccsp.BCCSP) (err error) {
+		valid, err = csp.Verify(k, signature, digest, opts)
+		return err
+	})
+	return valid, err
+}
+
+// Encrypt implements bccsp.BCCSP
+func (s *sessionCSP) Encrypt(k bccsp.Key, plaintext []byte, opts bccsp.EncrypterOpts) (ciphertext []byte, err error) {
+	err = s.do(func(csp bccsp.BCCSP) (err error) {
+		ciphertext, err = csp.Encrypt(k, plaintext, opts)
+		return err
+	})
+	return ciphertext, err
+}
+
+// Decrypt implements bccsp.BCCSP
+func (s *sessionCSP) Decrypt(k bccsp.Key, ciphertext []byte, opts bccsp.DecrypterOpts) (plaintext []byte, err error) {
+	err = s.do(func(csp bccsp.BCCSP) (err error) {
+		plaintext, err = csp.Decrypt(k, ciphertext, opts)
+		return err
+	})
+	return plaintext, err
+}
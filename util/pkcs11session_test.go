@@ -0,0 +1,85 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric/bccsp"
+	"github.com/stretchr/testify/assert"
+)
+
+// lostSessionCSP is a BCCSP whose sessions are lost after 'ok' signatures
+type lostSessionCSP struct {
+	bccsp.BCCSP
+	ok    int
+	signs int
+}
+
+func (c *lostSessionCSP) Sign(k bccsp.Key, digest []byte, opts bccsp.SignerOpts) ([]byte, error) {
+	c.signs++
+	if c.signs > c.ok {
+		return nil, fmt.Errorf("P11: sign failed [pkcs11: 0xB3: CKR_SESSION_HANDLE_INVALID]")
+	}
+	return []byte("signature"), nil
+}
+
+func (c *lostSessionCSP) GetKey(ski []byte) (bccsp.Key, error) {
+	if c.ok < 0 {
+		panic(fmt.Errorf("OpenSession failed [pkcs11: 0xE0: CKR_TOKEN_NOT_PRESENT]"))
+	}
+	return nil, errors.New("Key not found")
+}
+
+func TestPKCS11SessionReopen(t *testing.T) {
+	first := &lostSessionCSP{ok: 1}
+	second := &lostSessionCSP{ok: 10}
+	reopened := 0
+	csp := newSessionCSP(first, func() (bccsp.BCCSP, error) {
+		reopened++
+		return second, nil
+	})
+
+	sig, err := csp.Sign(nil, []byte("digest"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("signature"), sig)
+	assert.Equal(t, 0, reopened)
+
+	// The sessions are lost: the signature is retried after logging in again
+	sig, err = csp.Sign(nil, []byte("digest"), nil)
+	assert.NoError(t, err, "A signature should succeed after the sessions are lost")
+	assert.Equal(t, []byte("signature"), sig)
+	assert.Equal(t, 1, reopened, "The token should be logged in to again once")
+	assert.Equal(t, 1, second.signs)
+
+	// Other errors are not retried
+	_, err = csp.GetKey([]byte("ski"))
+	assert.EqualError(t, err, "Key not found")
+	assert.Equal(t, 1, reopened)
+}
+
+func TestPKCS11SessionReopenFails(t *testing.T) {
+	csp := newSessionCSP(&lostSessionCSP{ok: -1}, func() (bccsp.BCCSP, error) {
+		return nil, errors.New("Could not find token with label ForFabric")
+	})
+	_, err := csp.Sign(nil, []byte("digest"), nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Could not find token")
+		assert.Contains(t, err.Error(), "CKR_SESSION_HANDLE_INVALID")
+	}
+	// The panic of the PKCS11 BCCSP when it can't open a session is an error
+	_, err = csp.GetKey([]byte("ski"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Could not find token")
+	}
+
+	assert.True(t, IsPKCS11SessionError(errors.New("P11: sign failed [pkcs11: 0x32: CKR_DEVICE_REMOVED]")))
+	assert.False(t, IsPKCS11SessionError(errors.New("P11: sign failed [pkcs11: 0xC0: CKR_SIGNATURE_INVALID]")))
+	assert.False(t, IsPKCS11SessionError(nil))
+}
@@ -0,0 +1,255 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package util
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"hash"
+
+	"github.com/pkg/errors"
+)
+
+// EncryptedPrivateKeyPEMType is the type of the PEM block of a private key
+// encrypted with a passphrase, as PKCS #8
+const EncryptedPrivateKeyPEMType = "ENCRYPTED PRIVATE KEY"
+
+// pbkdf2Iterations is the number of iterations of PBKDF2 which derives the
+// encryption key of a private key from its passphrase
+const pbkdf2Iterations = 100000
+
+// ErrIncorrectPassphrase is the cause of the error returned when an
+// encrypted private key is decrypted with the wrong passphrase
+var ErrIncorrectPassphrase = errors.New("The passphrase of the private key is incorrect")
+
+// ErrNoPassphrase is the cause of the error returned when an encrypted
+// private key is needed but no passphrase is available to decrypt it
+var ErrNoPassphrase = errors.New("The private key is encrypted, but no passphrase was provided")
+
+// CorruptKeyError is the error returned when an encrypted private key can
+// not be decrypted regardless of its passphrase, because it is malformed or
+// encrypted with an unsupported algorithm
+type CorruptKeyError struct {
+	Reason string
+}
+
+func (e *CorruptKeyError) Error() string {
+	return fmt.Sprintf("The encrypted private key is corrupt: %s", e.Reason)
+}
+
+// IsKeyDecryptionError returns true if 'err' was caused by the failure to
+// decrypt an encrypted private key
+func IsKeyDecryptionError(err error) bool {
+	cause := errors.Cause(err)
+	if cause == ErrIncorrectPassphrase || cause == ErrNoPassphrase {
+		return true
+	}
+	_, ok := cause.(*CorruptKeyError)
+	return ok
+}
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// The ASN.1 structures of RFC 5958 and RFC 8018
+type encryptedPrivateKeyInfo struct {
+	EncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedData       []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// EncryptPKCS8PrivateKey encrypts the PKCS #8 DER-encoded private key 'der'
+// with 'passphrase', using PBES2 with PBKDF2-HMAC-SHA256 and AES-256-CBC
+func EncryptPKCS8PrivateKey(der, passphrase []byte) (*pem.Block, error) {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	_, err := rand.Read(salt)
+	if err == nil {
+		_, err = rand.Read(iv)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to generate the salt of the private key's encryption")
+	}
+	key := pbkdf2Key(passphrase, salt, pbkdf2Iterations, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create the cipher of the private key's encryption")
+	}
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	plaintext := append(append([]byte{}, der...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: pbkdf2Iterations,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to marshal the key derivation parameters")
+	}
+	ivParams, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to marshal the encryption parameters")
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParams}},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to marshal the encryption parameters")
+	}
+	info, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		EncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData:       ciphertext,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to marshal the encrypted private key")
+	}
+	return &pem.Block{Type: EncryptedPrivateKeyPEMType, Bytes: info}, nil
+}
+
+// DecryptPKCS8PrivateKey decrypts the encrypted private key 'block' with
+// 'passphrase' and returns the PKCS #8 DER-encoded private key. PBES2 with
+// PBKDF2-HMAC-SHA1 or SHA256 and AES-CBC, as used by OpenSSL, is supported.
+func DecryptPKCS8PrivateKey(block *pem.Block, passphrase []byte) ([]byte, error) {
+	if block.Type != EncryptedPrivateKeyPEMType {
+		return nil, errors.WithStack(&CorruptKeyError{Reason: fmt.Sprintf("unexpected PEM block type '%s'", block.Type)})
+	}
+	var info encryptedPrivateKeyInfo
+	if rest, err := asn1.Unmarshal(block.Bytes, &info); err != nil || len(rest) > 0 {
+		return nil, corruptKey("malformed encrypted private key info", err)
+	}
+	if !info.EncryptionAlgorithm.Algorithm.Equal(oidPBES2) {
+		return nil, corruptKey(fmt.Sprintf("unsupported encryption algorithm %s", info.EncryptionAlgorithm.Algorithm), nil)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.EncryptionAlgorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, corruptKey("malformed PBES2 parameters", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, corruptKey(fmt.Sprintf("unsupported key derivation function %s", params.KeyDerivationFunc.Algorithm), nil)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, corruptKey("malformed PBKDF2 parameters", err)
+	}
+	var prf func() hash.Hash
+	switch {
+	case len(kdf.PRF.Algorithm) == 0 || kdf.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	default:
+		return nil, corruptKey(fmt.Sprintf("unsupported pseudorandom function %s", kdf.PRF.Algorithm), nil)
+	}
+	var keyLen int
+	switch {
+	case params.EncryptionScheme.Algorithm.Equal(oidAES128CBC):
+		keyLen = 16
+	case params.EncryptionScheme.Algorithm.Equal(oidAES192CBC):
+		keyLen = 24
+	case params.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, corruptKey(fmt.Sprintf("unsupported encryption scheme %s", params.EncryptionScheme.Algorithm), nil)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, corruptKey("malformed initialization vector", err)
+	}
+	if kdf.IterationCount <= 0 || kdf.KeyLength != 0 && kdf.KeyLength != keyLen {
+		return nil, corruptKey("invalid PBKDF2 parameters", nil)
+	}
+	if len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, corruptKey("the length of the encrypted data is not a multiple of the block size", nil)
+	}
+
+	key := pbkdf2Key(passphrase, kdf.Salt, kdf.IterationCount, keyLen, prf)
+	cb, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create the cipher of the private key's encryption")
+	}
+	plaintext := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(cb, iv).CryptBlocks(plaintext, info.EncryptedData)
+	// With the wrong passphrase, the padding or the decrypted key are invalid
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(plaintext[len(plaintext)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, errors.WithStack(ErrIncorrectPassphrase)
+	}
+	der := plaintext[:len(plaintext)-padding]
+	if _, err := x509.ParsePKCS8PrivateKey(der); err != nil {
+		return nil, errors.WithStack(ErrIncorrectPassphrase)
+	}
+	return der, nil
+}
+
+func corruptKey(reason string, err error) error {
+	if err != nil {
+		reason = fmt.Sprintf("%s: %s", reason, err)
+	}
+	return errors.WithStack(&CorruptKeyError{Reason: reason})
+}
+
+// pbkdf2Key derives a key of 'keyLen' bytes from 'password' as specified
+// by RFC 8018
+func pbkdf2Key(password, salt []byte, iter, keyLen int, h func() hash.Hash) []byte {
+	prf := hmac.New(h, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+	var buf [4]byte
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		prf.Write(buf[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+		for n := 2; n <= iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = u[:0]
+			u = prf.Sum(u)
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
@@ -0,0 +1,113 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package util_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/hyperledger/fabric/bccsp/factory"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func newPKCS8Key(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	util.FatalError(t, err, "Failed to generate key")
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	util.FatalError(t, err, "Failed to marshal key")
+	return der
+}
+
+func TestEncryptPKCS8PrivateKey(t *testing.T) {
+	der := newPKCS8Key(t)
+	block, err := util.EncryptPKCS8PrivateKey(der, []byte("passphrase"))
+	util.FatalError(t, err, "Failed to encrypt key")
+	assert.Equal(t, util.EncryptedPrivateKeyPEMType, block.Type)
+
+	decrypted, err := util.DecryptPKCS8PrivateKey(block, []byte("passphrase"))
+	assert.NoError(t, err)
+	assert.Equal(t, der, decrypted, "The decrypted key should be the original key")
+
+	_, err = util.DecryptPKCS8PrivateKey(block, []byte("wrong"))
+	assert.Equal(t, util.ErrIncorrectPassphrase, errors.Cause(err), "A wrong passphrase should be reported as such")
+	assert.True(t, util.IsKeyDecryptionError(err))
+}
+
+func TestDecryptPKCS8PrivateKeyOpenSSL(t *testing.T) {
+	// Encrypted by "openssl pkcs8 -topk8 -v2 aes-128-cbc -v2prf hmacWithSHA1"
+	buf, err := ioutil.ReadFile("../testdata/ec-key-encrypted.pem")
+	util.FatalError(t, err, "Failed to read encrypted key")
+	block, _ := pem.Decode(buf)
+	der, err := util.DecryptPKCS8PrivateKey(block, []byte("testpass"))
+	util.FatalError(t, err, "Failed to decrypt the key encrypted by OpenSSL")
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	util.FatalError(t, err, "Failed to parse the decrypted key")
+
+	buf, err = ioutil.ReadFile("../testdata/ec-key.pem")
+	util.FatalError(t, err, "Failed to read key")
+	block, _ = pem.Decode(buf)
+	expected, err := x509.ParseECPrivateKey(block.Bytes)
+	util.FatalError(t, err, "Failed to parse key")
+	assert.Equal(t, expected.D, key.(*ecdsa.PrivateKey).D)
+}
+
+func TestDecryptCorruptPKCS8PrivateKey(t *testing.T) {
+	block, err := util.EncryptPKCS8PrivateKey(newPKCS8Key(t), []byte("passphrase"))
+	util.FatalError(t, err, "Failed to encrypt key")
+
+	corrupt := []*pem.Block{
+		{Type: util.EncryptedPrivateKeyPEMType, Bytes: block.Bytes[:len(block.Bytes)-5]},
+		{Type: util.EncryptedPrivateKeyPEMType, Bytes: []byte("not ASN.1")},
+		{Type: "PRIVATE KEY", Bytes: block.Bytes},
+	}
+	for _, b := range corrupt {
+		_, err = util.DecryptPKCS8PrivateKey(b, []byte("passphrase"))
+		if assert.Error(t, err) {
+			_, ok := errors.Cause(err).(*util.CorruptKeyError)
+			assert.True(t, ok, "A malformed key should be reported as corrupt, not as a wrong passphrase: %s", err)
+			assert.True(t, util.IsKeyDecryptionError(err))
+		}
+	}
+	assert.False(t, util.IsKeyDecryptionError(errors.New("Other error")))
+}
+
+func TestImportBCCSPKeyFromEncryptedPEM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryptedkey")
+	util.FatalError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(dir)
+	block, err := util.EncryptPKCS8PrivateKey(newPKCS8Key(t), []byte("passphrase"))
+	util.FatalError(t, err, "Failed to encrypt key")
+	keyFile := filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600)
+	util.FatalError(t, err, "Failed to write key")
+
+	opts := &factory.FactoryOpts{}
+	csp, err := util.InitBCCSP(&opts, "", dir)
+	util.FatalError(t, err, "Failed to initialize BCCSP")
+	passphrase := func(p string) func() ([]byte, error) {
+		return func() ([]byte, error) { return []byte(p), nil }
+	}
+	key, err := util.ImportBCCSPKeyFromEncryptedPEM(keyFile, csp, true, passphrase("passphrase"))
+	if assert.NoError(t, err) {
+		assert.True(t, key.Private())
+	}
+	_, err = util.ImportBCCSPKeyFromEncryptedPEM(keyFile, csp, true, passphrase("wrong"))
+	assert.Equal(t, util.ErrIncorrectPassphrase, errors.Cause(err))
+	_, err = util.ImportBCCSPKeyFromEncryptedPEM(keyFile, csp, true, nil)
+	assert.Equal(t, util.ErrNoPassphrase, errors.Cause(err))
+	_, err = util.ImportBCCSPKeyFromPEM(keyFile, csp, true)
+	assert.Equal(t, util.ErrNoPassphrase, errors.Cause(err))
+}
@@ -0,0 +1,275 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// redacted replaces the values of the sensitive headers and fields
+const redacted = "****"
+
+// DefaultBodyLogLimit is the default number of bytes of a body which are
+// logged or included in an error message
+const DefaultBodyLogLimit = 2048
+
+// bodyLogLimit is the number of bytes of a body which are logged
+var bodyLogLimit int64 = DefaultBodyLogLimit
+
+// sensitiveHeaders are the HTTP headers whose values are redacted
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+// sensitiveFields are the lowercased names of the JSON fields whose values
+// are redacted, at any depth of a body
+var sensitiveFields = map[string]bool{
+	"secret":     true,
+	"password":   true,
+	"passphrase": true,
+	"pin":        true,
+	"token":      true,
+	"key":        true,
+	"privatekey": true,
+}
+
+// sensitiveFieldPattern matches a sensitive JSON field with a string or
+// scalar value, which may be cut off by the truncation of the body, capturing
+// the name of the field and its value
+var sensitiveFieldPattern = regexp.MustCompile(`(?i)("(?:` + sensitiveFieldNames() + `)"\s*:\s*)("(?:[^"\\]|\\.)*"?|[^\s,\]}"{\[]+)`)
+
+// sensitiveFieldNames returns the names of the sensitive fields as the
+// alternatives of a regular expression
+func sensitiveFieldNames() string {
+	names := make([]string, 0, len(sensitiveFields))
+	for name := range sensitiveFields {
+		names = append(names, regexp.QuoteMeta(name))
+	}
+	sort.Strings(names)
+	return strings.Join(names, "|")
+}
+
+// SetBodyLogLimit sets the number of bytes of a body which are logged or
+// included in an error message; if 'limit' is not greater than 0, it is
+// DefaultBodyLogLimit
+func SetBodyLogLimit(limit int) {
+	if limit <= 0 {
+		limit = DefaultBodyLogLimit
+	}
+	atomic.StoreInt64(&bodyLogLimit, int64(limit))
+}
+
+// BodyLogLimit returns the number of bytes of a body which are logged or
+// included in an error message
+func BodyLogLimit() int {
+	return int(atomic.LoadInt64(&bodyLogLimit))
+}
+
+// RedactHeader returns the lines "name: value" of the header 'h', sorted by
+// name, with the values of the authorization and cookie headers redacted
+func RedactHeader(h http.Header) string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		value := strings.Join(h[name], ", ")
+		if sensitiveHeaders[http.CanonicalHeaderKey(name)] {
+			value = redacted
+		}
+		fmt.Fprintf(&buf, "%s: %s\n", name, value)
+	}
+	return buf.String()
+}
+
+// RedactBody returns the body 'body' with the values of its sensitive JSON
+// fields, such as secrets and passwords, redacted. A body which is not JSON
+// is returned as is. If 'limit' is greater than 0, the returned body is
+// truncated to 'limit' bytes; only those bytes are redacted, so that the
+// cost of redacting a large body is bounded by 'limit'.
+func RedactBody(body []byte, limit int) string {
+	if limit > 0 && len(body) > limit {
+		return truncatedBody(body[:limit], int64(len(body)))
+	}
+	var v interface{}
+	if json.Unmarshal(body, &v) == nil {
+		if redactValue(v) {
+			if b, err := json.Marshal(v); err == nil {
+				body = b
+			}
+		}
+		return string(body)
+	}
+	return redactText(body)
+}
+
+// truncatedBody returns the first bytes 'prefix' of a body of 'size' bytes,
+// or of an unknown size if 'size' is less than 0, redacted and followed by a
+// truncation marker. A body which is not text is replaced by its size.
+func truncatedBody(prefix []byte, size int64) string {
+	if isBinary(prefix) {
+		if size < 0 {
+			return "(binary data)"
+		}
+		return fmt.Sprintf("(%d bytes of binary data)", size)
+	}
+	prefix = prefix[:validUTF8Prefix(prefix)]
+	if size < 0 {
+		return fmt.Sprintf("%s... (more bytes)", redactText(prefix))
+	}
+	return fmt.Sprintf("%s... (%d more bytes)", redactText(prefix), size-int64(len(prefix)))
+}
+
+// redactText redacts the sensitive fields of 'text', which may be JSON cut
+// off at any byte
+func redactText(text []byte) string {
+	return sensitiveFieldPattern.ReplaceAllStringFunc(string(text), func(field string) string {
+		m := sensitiveFieldPattern.FindStringSubmatch(field)
+		if m[2] == `""` {
+			// An empty field reveals nothing
+			return field
+		}
+		return m[1] + `"` + redacted + `"`
+	})
+}
+
+// isBinary returns true if 'b', the beginning of a body, is not text
+func isBinary(b []byte) bool {
+	b = b[:validUTF8Prefix(b)]
+	if !utf8.Valid(b) {
+		return true
+	}
+	for _, c := range b {
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\r' {
+			return true
+		}
+	}
+	return false
+}
+
+// validUTF8Prefix returns the length of 'b' without the bytes of a UTF-8
+// encoded character which is cut off at its end
+func validUTF8Prefix(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(b)
+}
+
+// isTextContentType returns true if the content type 'ct' is text, or is
+// not set so that the body is looked at to tell
+func isTextContentType(ct string) bool {
+	if ct == "" {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mt, "text/") || mt == "application/x-www-form-urlencoded" ||
+		mt == "application/json" || strings.HasSuffix(mt, "+json") ||
+		mt == "application/xml" || strings.HasSuffix(mt, "+xml")
+}
+
+// bodyToString returns the body 'body' of a request or response as it is
+// logged, with its sensitive fields redacted and truncated to the body log
+// limit, and a body which reads as 'body' did, from which the bytes which
+// were read are not read again. Only the logged bytes are read from 'body',
+// so that logging a large body does not copy it. If 'getBody' is not nil,
+// it returns a copy of the body, which is read rather than 'body'.
+func bodyToString(body io.ReadCloser, getBody func() (io.ReadCloser, error), size int64, contentType string) (string, io.ReadCloser) {
+	if body == nil || body == http.NoBody {
+		return "", body
+	}
+	if !isTextContentType(contentType) {
+		if size < 0 {
+			return fmt.Sprintf("(binary data of type %s)", contentType), body
+		}
+		return fmt.Sprintf("(%d bytes of binary data of type %s)", size, contentType), body
+	}
+	limit := BodyLogLimit()
+	var prefix []byte
+	var err error
+	if getBody != nil {
+		var rc io.ReadCloser
+		rc, err = getBody()
+		if err == nil {
+			prefix, err = ioutil.ReadAll(io.LimitReader(rc, int64(limit)+1))
+			rc.Close()
+		}
+	} else {
+		prefix, err = ioutil.ReadAll(io.LimitReader(body, int64(limit)+1))
+		// The bytes which were read are read again before the rest of the body
+		body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(prefix), body), body}
+	}
+	if err != nil {
+		return fmt.Sprintf("(unreadable body: %s)", err), body
+	}
+	if len(prefix) <= limit {
+		if isBinary(prefix) {
+			return fmt.Sprintf("(%d bytes of binary data)", len(prefix)), body
+		}
+		return RedactBody(prefix, 0), body
+	}
+	if size < int64(len(prefix)) {
+		// The size of the body is not known
+		size = -1
+	}
+	return truncatedBody(prefix[:limit], size), body
+}
+
+// redactValue redacts the sensitive fields of the decoded JSON value 'v' in
+// place and returns true if any was redacted
+func redactValue(v interface{}) bool {
+	found := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for name, value := range v {
+			if sensitiveFields[strings.ToLower(name)] {
+				if value != nil && value != "" {
+					v[name] = redacted
+					found = true
+				}
+				continue
+			}
+			if redactValue(value) {
+				found = true
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			if redactValue(value) {
+				found = true
+			}
+		}
+	}
+	return found
+}
@@ -0,0 +1,52 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// SecretRefEnvPrefix is the prefix of a secret which is read from an
+	// environment variable, e.g. "env:FABRIC_CA_PKCS11_PIN"
+	SecretRefEnvPrefix = "env:"
+	// SecretRefFilePrefix is the prefix of a secret which is read from a
+	// file, e.g. "file:/etc/hyperledger/fabric-ca/pin"
+	SecretRefFilePrefix = "file:"
+)
+
+// ResolveSecret returns the value of a secret found in configuration.
+// If 'ref' is of the form "env:<name>", the value is read from the named
+// environment variable; if it is of the form "file:<path>", the value is
+// read from the file with trailing white space removed, where a relative
+// path is relative to 'homeDir'. Any other value is returned unchanged.
+func ResolveSecret(ref, homeDir string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, SecretRefEnvPrefix):
+		name := strings.TrimPrefix(ref, SecretRefEnvPrefix)
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.Errorf("Environment variable '%s' is not set", name)
+		}
+		return val, nil
+	case strings.HasPrefix(ref, SecretRefFilePrefix):
+		file, err := MakeFileAbs(strings.TrimPrefix(ref, SecretRefFilePrefix), homeDir)
+		if err != nil {
+			return "", err
+		}
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", errors.Wrapf(err, "Failed to read secret from file '%s'", file)
+		}
+		return strings.TrimRight(string(buf), " \t\r\n"), nil
+	}
+	return ref, nil
+}
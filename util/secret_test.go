@@ -0,0 +1,50 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveSecret(t *testing.T) {
+	val, err := ResolveSecret("98765432", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "98765432", val)
+
+	os.Setenv("FABRIC_CA_TEST_SECRET", "envpin")
+	defer os.Unsetenv("FABRIC_CA_TEST_SECRET")
+	val, err = ResolveSecret("env:FABRIC_CA_TEST_SECRET", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "envpin", val)
+
+	_, err = ResolveSecret("env:FABRIC_CA_TEST_SECRET_UNSET", "")
+	assert.Error(t, err, "Unset environment variable should fail")
+
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "pin"), []byte("filepin\n"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write pin file: %s", err)
+	}
+	val, err = ResolveSecret("file:pin", dir)
+	assert.NoError(t, err)
+	assert.Equal(t, "filepin", val, "Relative file should be relative to the home directory")
+	val, err = ResolveSecret("file:"+filepath.Join(dir, "pin"), "")
+	assert.NoError(t, err)
+	assert.Equal(t, "filepin", val)
+
+	_, err = ResolveSecret("file:missing", dir)
+	assert.Error(t, err, "Missing secret file should fail")
+}
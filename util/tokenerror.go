@@ -0,0 +1,68 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package util
+
+const (
+	// maxTokenLength is the maximum length of an authentication token, which
+	// is well beyond the length of a token of a certificate with many
+	// attributes
+	maxTokenLength = 64 * 1024
+	// maxTokenSignatureLength is the maximum length of the decoded signature
+	// of a token, which is beyond the length of an RSA 4096 signature
+	maxTokenSignatureLength = 1024
+)
+
+// TokenErrorReason is what is wrong with an authentication token
+type TokenErrorReason int
+
+const (
+	// TokenEmpty is the reason of the error of an empty token
+	TokenEmpty TokenErrorReason = iota + 1
+	// TokenTooLong is the reason of the error of a token which is longer than
+	// any valid token
+	TokenTooLong
+	// TokenBadFormat is the reason of the error of a token which is not made
+	// of a certificate and a signature separated by '.'
+	TokenBadFormat
+	// TokenBadCertEncoding is the reason of the error of a token whose
+	// certificate is not base64 encoded
+	TokenBadCertEncoding
+	// TokenBadCert is the reason of the error of a token whose certificate is
+	// not a PEM encoded X509 certificate
+	TokenBadCert
+	// TokenBadSignatureEncoding is the reason of the error of a token whose
+	// signature is not base64 encoded
+	TokenBadSignatureEncoding
+	// TokenSignatureTooLong is the reason of the error of a token whose
+	// signature is longer than any valid signature
+	TokenSignatureTooLong
+	// TokenBadSignature is the reason of the error of a token whose signature
+	// can't be verified with the key of its certificate or is not valid
+	TokenBadSignature
+)
+
+// TokenError is the error returned when an authentication token is
+// malformed or its signature is not valid
+type TokenError struct {
+	// Reason is what is wrong with the token
+	Reason TokenErrorReason
+	msg    string
+	err    error
+}
+
+func newTokenError(reason TokenErrorReason, err error, msg string) *TokenError {
+	return &TokenError{Reason: reason, msg: msg, err: err}
+}
+
+// Error returns the message of the error, followed by the message of the
+// error which caused it if any
+func (e *TokenError) Error() string {
+	if e.err != nil {
+		return e.msg + ": " + e.err.Error()
+	}
+	return e.msg
+}
@@ -0,0 +1,43 @@
+// +build go1.18
+
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package util
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+// FuzzVerifyToken verifies that the verification of any token fails with a
+// *TokenError rather than panicking. Its seeds run with the tests; run
+// "go test -fuzz FuzzVerifyToken ./util" to fuzz it.
+func FuzzVerifyToken(f *testing.F) {
+	cert, err := ioutil.ReadFile(getPath("ec.pem"))
+	if err != nil {
+		f.Fatalf("Failed to read the certificate: %s", err)
+	}
+	csp := GetDefaultBCCSP()
+	key, err := ImportBCCSPKeyFromPEM(getPath("ec-key.pem"), csp, true)
+	if err != nil {
+		f.Fatalf("Failed to import the key: %s", err)
+	}
+	token, err := CreateToken(csp, cert, key, []byte("{}"))
+	if err != nil {
+		f.Fatalf("Failed to create the token: %s", err)
+	}
+	f.Add(token, []byte("{}"))
+	for _, test := range malformedTokens(f) {
+		f.Add(test.token, []byte("{}"))
+	}
+	f.Fuzz(func(t *testing.T, token string, body []byte) {
+		_, err := VerifyToken(csp, token, body)
+		if _, ok := err.(*TokenError); err != nil && !ok {
+			t.Fatalf("The error of token '%s' is not a *TokenError: %s", token, err)
+		}
+	})
+}
@@ -0,0 +1,75 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package util
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// malformedToken is a token which must fail the verification with a
+// *TokenError of the reason
+type malformedToken struct {
+	name   string
+	token  string
+	reason TokenErrorReason
+}
+
+// malformedTokens returns malformed tokens over the body '{}', among which
+// those which were found to crash the decoding of tokens
+func malformedTokens(t testing.TB) []malformedToken {
+	ecPEM, err := ioutil.ReadFile(getPath("ec.pem"))
+	if err != nil {
+		t.Fatalf("Failed to read the certificate: %s", err)
+	}
+	rsaPEM, err := ioutil.ReadFile(getPath("rsa.pem"))
+	if err != nil {
+		t.Fatalf("Failed to read the certificate: %s", err)
+	}
+	csp := GetDefaultBCCSP()
+	key, err := ImportBCCSPKeyFromPEM(getPath("ec-key.pem"), csp, true)
+	if err != nil {
+		t.Fatalf("Failed to import the key: %s", err)
+	}
+	token, err := CreateToken(csp, ecPEM, key, []byte("{}"))
+	if err != nil {
+		t.Fatalf("Failed to create the token: %s", err)
+	}
+	ecCert := B64Encode(ecPEM)
+	sig := token[strings.IndexByte(token, '.')+1:]
+	return []malformedToken{
+		{"empty", "", TokenEmpty},
+		{"too long", strings.Repeat("A", maxTokenLength+1), TokenTooLong},
+		{"one part", ecCert, TokenBadFormat},
+		{"three parts", token + ".x", TokenBadFormat},
+		{"bad certificate padding", "QQ=." + sig, TokenBadCertEncoding},
+		{"bad certificate encoding", "*." + sig, TokenBadCertEncoding},
+		{"not a certificate", B64Encode([]byte("hello")) + "." + sig, TokenBadCert},
+		{"truncated certificate", B64Encode(ecPEM[:len(ecPEM)/2]) + "." + sig, TokenBadCert},
+		{"empty certificate", "." + sig, TokenBadCert},
+		{"truncated certificate bytes", B64Encode([]byte("-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n")) + "." + sig, TokenBadCert},
+		{"bad signature padding", ecCert + ".QQ=", TokenBadSignatureEncoding},
+		{"signature too long", ecCert + "." + strings.Repeat("A", 4*maxTokenSignatureLength), TokenSignatureTooLong},
+		{"empty signature", ecCert + ".", TokenBadSignature},
+		{"truncated signature", ecCert + "." + sig[:len(sig)/2-len(sig)/2%4], TokenBadSignature},
+		{"signature of another certificate", B64Encode(rsaPEM) + "." + sig, TokenBadSignature},
+		{"signature over another body", strings.Replace(token, sig, B64Encode([]byte{0x30, 0x06, 0x02, 0x01, 0x01, 0x02, 0x01, 0x01}), 1), TokenBadSignature},
+	}
+}
+
+func TestVerifyTokenMalformed(t *testing.T) {
+	csp := GetDefaultBCCSP()
+	for _, test := range malformedTokens(t) {
+		_, err := VerifyToken(csp, test.token, []byte("{}"))
+		if te, ok := err.(*TokenError); assert.True(t, ok, "%s: %v should be a *TokenError", test.name, err) {
+			assert.Equal(t, test.reason, te.Reason, "%s: %s", test.name, te)
+		}
+	}
+}
@@ -38,6 +38,7 @@ import (
 	"reflect"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -52,6 +53,8 @@ import (
 
 var (
 	rnd = mrand.NewSource(time.Now().UnixNano())
+	// rndMutex serializes the use of rnd, which is not safe for concurrent use
+	rndMutex sync.Mutex
 	// ErrNotImplemented used to return errors for functions not implemented
 	ErrNotImplemented = errors.New("NOT YET IMPLEMENTED")
 )
@@ -92,6 +95,8 @@ type ECDSASignature struct {
 func RandomString(n int) string {
 	b := make([]byte, n)
 
+	rndMutex.Lock()
+	defer rndMutex.Unlock()
 	for i, cache, remain := n-1, rnd.Int63(), letterIdxMax; i >= 0; {
 		if remain == 0 {
 			cache, remain = rnd.Int63(), letterIdxMax
@@ -137,6 +142,39 @@ func WriteFile(file string, buf []byte, perm os.FileMode) error {
 	return ioutil.WriteFile(file, buf, perm)
 }
 
+// WriteFileAtomic writes a file by writing a temporary file in the same
+// directory and renaming it, so that the file is either replaced entirely or,
+// if writing fails, left as it was
+func WriteFileAtomic(file string, buf []byte, perm os.FileMode) error {
+	dir := filepath.Dir(file)
+	// Create the directory if it doesn't exist
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to create directory '%s' for file '%s'", dir, file)
+		}
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(file)+".tmp")
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create temporary file for '%s'", file)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(buf)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write temporary file for '%s'", file)
+	}
+	return errors.Wrapf(os.Rename(tmp.Name(), file), "Failed to rename temporary file to '%s'", file)
+}
+
 // FileExists checks to see if a file exists
 func FileExists(name string) bool {
 	if _, err := os.Stat(name); err != nil {
@@ -201,6 +239,8 @@ func CreateToken(csp bccsp.BCCSP, cert []byte, key bccsp.Key, body []byte) (stri
 		if err != nil {
 			return "", err
 		}
+	default:
+		return "", errors.Errorf("Tokens can't be created for %T keys; only ECDSA keys are supported", publicKey)
 	}
 	return token, nil
 }
@@ -257,8 +297,9 @@ func GenECDSAToken(csp bccsp.BCCSP, cert []byte, key bccsp.Key, body []byte) (st
 }
 
 // VerifyToken verifies token signed by either ECDSA or RSA and
-// returns the associated user ID
-func VerifyToken(csp bccsp.BCCSP, token string, body []byte) (*x509.Certificate, error) {
+// returns the associated user ID. An error about the token itself, rather
+// than about 'csp', is a *TokenError.
+func VerifyToken(csp bccsp.BCCSP, token string, body []byte) (cert *x509.Certificate, err error) {
 
 	if csp == nil {
 		return nil, errors.New("BCCSP instance is not present")
@@ -267,23 +308,39 @@ func VerifyToken(csp bccsp.BCCSP, token string, body []byte) (*x509.Certificate,
 	if err != nil {
 		return nil, err
 	}
+	if base64.StdEncoding.DecodedLen(len(b64Sig)) > maxTokenSignatureLength {
+		return nil, newTokenError(TokenSignatureTooLong, nil, fmt.Sprintf("Invalid signature in token; it is longer than %d bytes", maxTokenSignatureLength))
+	}
 	sig, err := B64Decode(b64Sig)
 	if err != nil {
-		return nil, errors.WithMessage(err, "Invalid base64 encoded signature in token")
-	}
-	b64Body := B64Encode(body)
-	sigString := b64Body + "." + b64Cert
-
+		return nil, newTokenError(TokenBadSignatureEncoding, err, "Invalid base64 encoded signature in token")
+	}
+	// The signed string is the base64 encoded body and certificate
+	// separated by '.', which is encoded into a single buffer
+	bodyLen := base64.StdEncoding.EncodedLen(len(body))
+	sigString := make([]byte, bodyLen+1+len(b64Cert))
+	base64.StdEncoding.Encode(sigString, body)
+	sigString[bodyLen] = '.'
+	copy(sigString[bodyLen+1:], b64Cert)
+
+	// The key of the certificate and the signature are not trusted, so a
+	// BCCSP implementation which panics on them fails the verification
+	defer func() {
+		if p := recover(); p != nil {
+			cert = nil
+			err = newTokenError(TokenBadSignature, nil, fmt.Sprintf("Token signature validation failure: %v", p))
+		}
+	}()
 	pk2, err := csp.KeyImport(x509Cert, &bccsp.X509PublicKeyImportOpts{Temporary: true})
 	if err != nil {
-		return nil, errors.WithMessage(err, "Public Key import into BCCSP failed with error")
+		return nil, newTokenError(TokenBadSignature, err, "Public Key import into BCCSP failed with error")
 	}
 	if pk2 == nil {
-		return nil, errors.New("Public Key Cannot be imported into BCCSP")
+		return nil, newTokenError(TokenBadSignature, nil, "Public Key Cannot be imported into BCCSP")
 	}
 	//bccsp.X509PublicKeyImportOpts
 	//Using default hash algo
-	digest, digestError := csp.Hash([]byte(sigString), &bccsp.SHAOpts{})
+	digest, digestError := csp.Hash(sigString, &bccsp.SHAOpts{})
 	if digestError != nil {
 		return nil, errors.WithMessage(digestError, "Message digest failed")
 	}
@@ -291,34 +348,48 @@ func VerifyToken(csp bccsp.BCCSP, token string, body []byte) (*x509.Certificate,
 	valid, validErr := csp.Verify(pk2, sig, digest, nil)
 
 	if validErr != nil {
-		return nil, errors.WithMessage(validErr, "Token signature validation failure")
+		return nil, newTokenError(TokenBadSignature, validErr, "Token signature validation failure")
 	}
 	if !valid {
-		return nil, errors.New("Token signature validation failed")
+		return nil, newTokenError(TokenBadSignature, nil, "Token signature validation failed")
 	}
 
 	return x509Cert, nil
 }
 
-// DecodeToken extracts an X509 certificate and base64 encoded signature from a token
+// DecodeToken extracts an X509 certificate and base64 encoded signature from a token.
+// The certificate may be shared with other callers and must not be modified.
+// The error of a malformed token is a *TokenError.
 func DecodeToken(token string) (*x509.Certificate, string, string, error) {
 	if token == "" {
-		return nil, "", "", errors.New("Invalid token; it is empty")
+		return nil, "", "", newTokenError(TokenEmpty, nil, "Invalid token; it is empty")
+	}
+	if len(token) > maxTokenLength {
+		return nil, "", "", newTokenError(TokenTooLong, nil, fmt.Sprintf("Invalid token; it is longer than %d bytes", maxTokenLength))
 	}
-	parts := strings.Split(token, ".")
-	if len(parts) != 2 {
-		return nil, "", "", errors.New("Invalid token format; expecting 2 parts separated by '.'")
+	i := strings.IndexByte(token, '.')
+	if i < 0 || strings.IndexByte(token[i+1:], '.') >= 0 {
+		return nil, "", "", newTokenError(TokenBadFormat, nil, "Invalid token format; expecting 2 parts separated by '.'")
+	}
+	b64cert := token[:i]
+	x509Cert, err := tokenCerts.get(b64cert, parseTokenCert)
+	if err != nil {
+		return nil, "", "", err
 	}
-	b64cert := parts[0]
+	return x509Cert, b64cert, token[i+1:], nil
+}
+
+// parseTokenCert parses the base64 encoded PEM certificate of a token
+func parseTokenCert(b64cert string) (*x509.Certificate, error) {
 	certDecoded, err := B64Decode(b64cert)
 	if err != nil {
-		return nil, "", "", errors.WithMessage(err, "Failed to decode base64 encoded x509 cert")
+		return nil, newTokenError(TokenBadCertEncoding, err, "Failed to decode base64 encoded x509 cert")
 	}
 	x509Cert, err := GetX509CertificateFromPEM(certDecoded)
 	if err != nil {
-		return nil, "", "", errors.WithMessage(err, "Error in parsing x509 certificate given block bytes")
+		return nil, newTokenError(TokenBadCert, err, "Error in parsing x509 certificate given block bytes")
 	}
-	return x509Cert, b64cert, parts[1], nil
+	return x509Cert, nil
 }
 
 //GetECPrivateKey get *ecdsa.PrivateKey from key pem
@@ -406,20 +477,26 @@ func IsSubsetOf(small, big string) error {
 	return nil
 }
 
-// HTTPRequestToString returns a string for an HTTP request for debuggging
+// HTTPRequestToString returns a string for an HTTP request for debuggging,
+// with its authorization headers and the sensitive fields of its body
+// redacted. At most BodyLogLimit bytes of the body are read and included,
+// followed by a truncation marker, and a binary body is not included; the
+// body can still be read in full afterwards.
 func HTTPRequestToString(req *http.Request) string {
-	body, _ := ioutil.ReadAll(req.Body)
-	req.Body = ioutil.NopCloser(bytes.NewReader(body))
-	return fmt.Sprintf("%s %s\n%s",
-		req.Method, req.URL, string(body))
+	var body string
+	body, req.Body = bodyToString(req.Body, req.GetBody, req.ContentLength, req.Header.Get("Content-Type"))
+	return fmt.Sprintf("%s %s\n%s%s",
+		req.Method, GetMaskedURL(req.URL.String()), RedactHeader(req.Header), body)
 }
 
-// HTTPResponseToString returns a string for an HTTP response for debuggging
+// HTTPResponseToString returns a string for an HTTP response for debuggging,
+// with its cookies and the sensitive fields of its body redacted, and its
+// body bounded as by HTTPRequestToString
 func HTTPResponseToString(resp *http.Response) string {
-	body, _ := ioutil.ReadAll(resp.Body)
-	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
-	return fmt.Sprintf("statusCode=%d (%s)\n%s",
-		resp.StatusCode, resp.Status, string(body))
+	var body string
+	body, resp.Body = bodyToString(resp.Body, nil, resp.ContentLength, resp.Header.Get("Content-Type"))
+	return fmt.Sprintf("statusCode=%d (%s)\n%s%s",
+		resp.StatusCode, resp.Status, RedactHeader(resp.Header), body)
 }
 
 // CreateClientHome will create a home directory if it does not exist
@@ -636,6 +713,10 @@ func StructToString(si interface{}) string {
 			} else {
 				fStr = fmt.Sprintf("%s:%v ", tf.Name, rval.Field(i).Interface())
 			}
+		} else if s, ok := rval.Field(i).Addr().Interface().(fmt.Stringer); ok {
+			// A struct field whose String method masks its own secrets,
+			// such as one with a pointer receiver, is printed with it
+			fStr = fmt.Sprintf("%s:%s ", tf.Name, s.String())
 		} else {
 			fStr = fmt.Sprintf("%s:%v ", tf.Name, rval.Field(i).Interface())
 		}
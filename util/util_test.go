@@ -417,6 +417,37 @@ func TestWriteFile(t *testing.T) {
 	assert.Error(t, err, "Should fail to create 'test' directory as the parent directory is read only")
 }
 
+func TestWriteFileAtomic(t *testing.T) {
+	testdir, err := ioutil.TempDir(".", "writefileatomictest")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %s", err.Error())
+	}
+	defer os.RemoveAll(testdir)
+	file := path.Join(testdir, "dir", "test.txt")
+	err = WriteFileAtomic(file, []byte("foo"), 0600)
+	assert.NoError(t, err)
+	err = WriteFileAtomic(file, []byte("bar"), 0600)
+	assert.NoError(t, err)
+	buf, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", string(buf), "The file should be replaced")
+	fi, err := os.Stat(file)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	}
+
+	// Replacing a non-empty directory fails, and neither it nor a temporary
+	// file is left behind
+	dir := path.Join(testdir, "dir")
+	err = WriteFileAtomic(dir, []byte("baz"), 0600)
+	assert.Error(t, err, "Replacing a non-empty directory should fail")
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	if assert.Len(t, files, 1, "The temporary file should be removed") {
+		assert.Equal(t, "test.txt", files[0].Name())
+	}
+}
+
 func getPath(file string) string {
 	return "../testdata/" + file
 }
@@ -878,3 +909,28 @@ func TestListContains(t *testing.T) {
 	found = ListContains(list, "*")
 	assert.Equal(t, found, false)
 }
+
+func BenchmarkVerifyToken(b *testing.B) {
+	cert, err := ioutil.ReadFile(getPath("ec.pem"))
+	if err != nil {
+		b.Fatalf("Failed to read the certificate: %s", err)
+	}
+	csp := GetDefaultBCCSP()
+	privKey, err := ImportBCCSPKeyFromPEM(getPath("ec-key.pem"), csp, true)
+	if err != nil {
+		b.Fatalf("Failed to import the key: %s", err)
+	}
+	body := []byte(`{"certificate_request":"request byte array"}`)
+	token, err := CreateToken(csp, cert, privKey, body)
+	if err != nil {
+		b.Fatalf("Failed to create the token: %s", err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = VerifyToken(csp, token, body)
+		if err != nil {
+			b.Fatalf("Failed to verify the token: %s", err)
+		}
+	}
+}